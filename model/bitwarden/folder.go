@@ -8,18 +8,11 @@ import (
 
 // Folder is a space to organize ciphers. Its name is encrypted on client-side.
 type Folder struct {
-	CouchID  string                 `json:"_id,omitempty"`
-	CouchRev string                 `json:"_rev,omitempty"`
+	couchdb.BaseDoc
 	Name     string                 `json:"name"`
 	Metadata *metadata.CozyMetadata `json:"cozyMetadata,omitempty"`
 }
 
-// ID returns the folder qualified identifier
-func (f *Folder) ID() string { return f.CouchID }
-
-// Rev returns the folder revision
-func (f *Folder) Rev() string { return f.CouchRev }
-
 // DocType returns the folder document type
 func (f *Folder) DocType() string { return consts.BitwardenFolders }
 
@@ -32,10 +25,4 @@ func (f *Folder) Clone() couchdb.Doc {
 	return &cloned
 }
 
-// SetID changes the folder qualified identifier
-func (f *Folder) SetID(id string) { f.CouchID = id }
-
-// SetRev changes the folder revision
-func (f *Folder) SetRev(rev string) { f.CouchRev = rev }
-
 var _ couchdb.Doc = &Folder{}
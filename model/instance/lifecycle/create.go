@@ -188,13 +188,7 @@ func CreateWithoutHooks(opts *Options) (*instance.Instance, error) {
 	opts.trace("init couchdb", func() {
 		g, _ := errgroup.WithContext(context.Background())
 		g.Go(func() error { return couchdb.CreateDoc(couchdb.GlobalDB, i) })
-		g.Go(func() error { return couchdb.CreateDB(i, consts.Files) })
-		g.Go(func() error { return couchdb.CreateDB(i, consts.Apps) })
-		g.Go(func() error { return couchdb.CreateDB(i, consts.Konnectors) })
-		g.Go(func() error { return couchdb.CreateDB(i, consts.OAuthClients) })
-		g.Go(func() error { return couchdb.CreateDB(i, consts.Jobs) })
-		g.Go(func() error { return couchdb.CreateDB(i, consts.Permissions) })
-		g.Go(func() error { return couchdb.CreateDB(i, consts.Sharings) })
+		g.Go(func() error { return couchdb.CreateAllDBs(i, bootstrapDoctypes()) })
 		g.Go(func() error {
 			var errg error
 			if errg = couchdb.CreateNamedDocWithDB(i, settings); errg != nil {
@@ -209,13 +203,6 @@ func CreateWithoutHooks(opts *Options) (*instance.Instance, error) {
 		return nil, err
 	}
 
-	opts.trace("define views and indexes", func() {
-		err = DefineViewsAndIndex(i)
-	})
-	if err != nil {
-		return nil, err
-	}
-
 	opts.trace("init VFS", func() {
 		if err = i.MakeVFS(); err != nil {
 			return
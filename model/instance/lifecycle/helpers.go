@@ -54,6 +54,38 @@ func DefineViewsAndIndex(inst *instance.Instance) error {
 	return nil
 }
 
+// bootstrapDoctypes returns the doctypes whose databases are created with an
+// instance: the ones used by the stack from the start, and the ones with
+// views or indexes.
+func bootstrapDoctypes() []string {
+	doctypes := []string{
+		consts.Files,
+		consts.Apps,
+		consts.Konnectors,
+		consts.OAuthClients,
+		consts.Jobs,
+		consts.Permissions,
+		consts.Sharings,
+	}
+	seen := make(map[string]bool)
+	for _, doctype := range doctypes {
+		seen[doctype] = true
+	}
+	for _, index := range couchdb.Indexes {
+		if !seen[index.Doctype] {
+			seen[index.Doctype] = true
+			doctypes = append(doctypes, index.Doctype)
+		}
+	}
+	for _, view := range couchdb.Views {
+		if !seen[view.Doctype] {
+			seen[view.Doctype] = true
+			doctypes = append(doctypes, view.Doctype)
+		}
+	}
+	return doctypes
+}
+
 func createDefaultFilesTree(inst *instance.Instance) error {
 	var errf error
 
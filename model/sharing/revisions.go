@@ -1,6 +1,7 @@
 package sharing
 
 import (
+	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"strconv"
@@ -206,8 +207,17 @@ func revsMapToStruct(revs interface{}) *RevsStruct {
 	if !ok {
 		return nil
 	}
-	start, ok := revisions["start"].(float64)
-	if !ok {
+	var start int
+	switch s := revisions["start"].(type) {
+	case float64:
+		start = int(s)
+	case json.Number:
+		n, err := s.Int64()
+		if err != nil {
+			return nil
+		}
+		start = int(n)
+	default:
 		return nil
 	}
 	slice, ok := revisions["ids"].([]interface{})
@@ -219,7 +229,7 @@ func revsMapToStruct(revs interface{}) *RevsStruct {
 		ids[i], _ = id.(string)
 	}
 	return &RevsStruct{
-		Start: int(start),
+		Start: start,
 		IDs:   ids,
 	}
 }
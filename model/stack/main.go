@@ -12,6 +12,7 @@ import (
 	build "github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/prommetrics"
 	"github.com/cozy/cozy-stack/pkg/utils"
 
 	"github.com/google/gops/agent"
@@ -46,9 +47,26 @@ security features. Please do not use this binary as your production server.
 		return
 	}
 
+	slow := config.GetConfig().CouchDB.SlowRequests
+	couchdb.SetSlowRequestThresholds(slow.Threshold, slow.Doctypes)
+	couchdb.SetStrictDoctypes(config.GetConfig().CouchDB.StrictDoctypes)
+	couchdb.SetMaxResponseSize(config.GetConfig().CouchDB.MaxResponseSize)
+	couchdb.SetKnownDBsSize(config.GetConfig().CouchDB.KnownDBs)
+	docCache := config.GetConfig().CouchDB.DocCache
+	for _, doctype := range docCache.Doctypes {
+		couchdb.RegisterCachedDoctype(doctype)
+	}
+	couchdb.SetDocCache(docCache.Size, docCache.TTL)
+	validationCache := config.GetConfig().CouchDB.ValidationCache
+	for _, doctype := range validationCache.Doctypes {
+		couchdb.RegisterValidatedDoctype(doctype)
+	}
+	couchdb.SetValidationCache(validationCache.Size, validationCache.MaxBytes)
+	if err = couchdb.SetEncryptionKeys(config.GetConfig().CouchDB.EncryptionKeys); err != nil {
+		return
+	}
+
 	// Check that we can properly reach CouchDB.
-	u := config.CouchURL()
-	u.User = config.GetConfig().CouchDB.Auth
 	attempts := 8
 	attemptsSpacing := 1 * time.Second
 	for i := 0; i < attempts; i++ {
@@ -68,6 +86,14 @@ security features. Please do not use this binary as your production server.
 	if err = couchdb.InitGlobalDB(); err != nil {
 		return
 	}
+	if config.GetConfig().CouchDB.Expvar {
+		couchdb.InitExpvar()
+	}
+	if config.GetConfig().CouchDB.Prometheus {
+		if err = prommetrics.Init(); err != nil {
+			return
+		}
+	}
 
 	// Init the main global connection to the swift server
 	if err = config.InitDefaultSwiftConnection(); err != nil {
@@ -103,10 +129,25 @@ security features. Please do not use this binary as your production server.
 	sessionSweeper := session.SweepLoginRegistrations()
 
 	// Global shutdowner that composes all the running processes of the stack
-	processes = utils.NewGroupShutdown(
+	shutdowners := []utils.Shutdowner{
 		job.System(),
 		sessionSweeper,
 		gopAgent{},
-	)
+	}
+	if interval := config.GetConfig().CouchDB.HealthCheckInterval; interval > 0 {
+		checker := couchdb.StartHealthChecker(context.Background(), interval)
+		shutdowners = append(shutdowners, checker)
+	}
+	if docCache := config.GetConfig().CouchDB.DocCache; docCache.Size > 0 && docCache.FollowChanges {
+		invalidator := couchdb.StartCacheInvalidator(context.Background())
+		shutdowners = append(shutdowners, invalidator)
+	}
+	eventHub := config.GetConfig().CouchDB.EventHub
+	hub := couchdb.StartEventHub(context.Background(), &couchdb.EventHubOptions{
+		BufferSize:    eventHub.BufferSize,
+		FollowChanges: eventHub.FollowChanges,
+	})
+	shutdowners = append(shutdowners, hub)
+	processes = utils.NewGroupShutdown(shutdowners...)
 	return
 }
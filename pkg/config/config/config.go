@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
@@ -176,9 +177,196 @@ type FsVersioning struct {
 
 // CouchDB contains the configuration values of the database
 type CouchDB struct {
-	Auth   *url.Userinfo
-	URL    *url.URL
-	Client *http.Client
+	Auth *url.Userinfo
+	URL  *url.URL
+	// URLs are the nodes of the CouchDB cluster, when several are configured.
+	// URL is the first one.
+	URLs []*url.URL
+	// ReplicationURL is the URL where CouchDB can reach itself, for the
+	// replications between two of its databases
+	ReplicationURL *url.URL
+	// Clusters are the CouchDB clusters dedicated to some doctypes, the other
+	// doctypes are stored on the cluster of URL
+	Clusters []CouchDBCluster
+	Client   *http.Client
+	// StreamingClient is the client for the streaming requests, like the
+	// changes feeds. It is restricted to HTTP/1.1, unless HTTP/2 is allowed
+	// for them. When it is nil, Client is used.
+	StreamingClient *http.Client
+	SessionAuth     bool
+	// LogBodies enables the logs of the bodies of the requests and responses,
+	// in addition to the debug level
+	LogBodies bool
+	// LogRedactedFields are the names of the fields masked in the logs of
+	// the bodies
+	LogRedactedFields []string
+	// LogMaxBodySize is the size after which the bodies are truncated in the
+	// logs
+	LogMaxBodySize int
+	// Timeout is the maximal duration of a request to CouchDB, unless it is
+	// overridden for a call
+	Timeout time.Duration
+	Retry   CouchDBRetry
+	// RateLimit is the limit of requests that an instance can make to
+	// CouchDB
+	RateLimit CouchDBRateLimit
+	// Concurrency is the limit of requests sent to CouchDB at the same time
+	Concurrency CouchDBConcurrency
+	// CircuitBreaker is the configuration for failing fast when CouchDB is
+	// down
+	CircuitBreaker CouchDBCircuitBreaker
+	// HealthCheckInterval is the delay between two pings of the CouchDB
+	// nodes in background, 0 disables them
+	HealthCheckInterval time.Duration
+	// AcceptedWrites is the policy for the writes that CouchDB has only
+	// accepted (202), without meeting the quorum: warn, error or ignore
+	AcceptedWrites string
+	// SlowRequests is the configuration of the logs for the slow requests
+	SlowRequests CouchDBSlowRequests
+	// DocCache is the configuration of the cache of the documents read on
+	// nearly every request
+	DocCache CouchDBDocCache
+	// ValidationCache is the configuration of the cache of the ETags of the
+	// documents, for the conditional reads
+	ValidationCache CouchDBValidationCache
+	// EventHub is the configuration of the in-process hub for the events of
+	// the documents
+	EventHub CouchDBEventHub
+	// MaxDocumentSize is the size in bytes over which a document is not sent
+	// to CouchDB, 0 disables the check
+	MaxDocumentSize int
+	// MaxResponseSize is the size in bytes over which a response from CouchDB
+	// is not read, 0 disables the limit
+	MaxResponseSize int64
+	// KnownDBs is the number of databases remembered as existing, to skip the
+	// checks before creating them, 0 disables it
+	KnownDBs int
+	// StrictDoctypes are the doctypes whose documents are decoded strictly,
+	// with an error for the fields unknown by their Go type
+	StrictDoctypes []string
+	// EncryptionKeys are the keys, in base64, used to encrypt the fields
+	// registered as encrypted: the first one encrypts, and the others are
+	// the old keys that can still decrypt
+	EncryptionKeys []string
+	// Expvar publishes some counters on the requests made to CouchDB as an
+	// expvar, for debugging
+	Expvar bool
+	// Prometheus exports the metrics of the requests made to CouchDB with
+	// the other Prometheus metrics of the stack
+	Prometheus bool
+	// ProxyAuthSecret is the secret shared with CouchDB to sign the tokens
+	// of its proxy authentication
+	ProxyAuthSecret string
+}
+
+// CouchDBCluster contains the configuration of a CouchDB cluster dedicated to
+// some doctypes
+type CouchDBCluster struct {
+	Name string
+	Auth *url.Userinfo
+	URLs []*url.URL
+	// ReplicationURL is the URL where the cluster can reach itself
+	ReplicationURL *url.URL
+	// Doctypes are the doctypes whose databases are stored on this cluster. A
+	// doctype ending with a "*" matches all the doctypes with this prefix.
+	Doctypes []string
+}
+
+// CouchDBSlowRequests contains the configuration of the logs for the
+// requests to CouchDB that are slow
+type CouchDBSlowRequests struct {
+	// Threshold is the duration after which a request is logged as slow, 0
+	// disables the logs
+	Threshold time.Duration
+	// Doctypes are the thresholds for some doctypes, instead of Threshold
+	Doctypes map[string]time.Duration
+}
+
+// CouchDBDocCache contains the configuration of the cache of the documents
+type CouchDBDocCache struct {
+	// Size is the maximal number of documents in the cache, 0 disables it
+	Size int
+	// TTL is the duration for which a document is kept in the cache
+	TTL time.Duration
+	// Doctypes are the doctypes whose documents are cached
+	Doctypes []string
+	// FollowChanges enables the CacheInvalidator, that follows the changes
+	// feeds of the cached databases
+	FollowChanges bool
+}
+
+// CouchDBEventHub contains the configuration of the in-process hub for the
+// events of the documents
+type CouchDBEventHub struct {
+	// BufferSize is the number of events kept for a slow subscriber
+	BufferSize int
+	// FollowChanges makes the hub follow the changes feeds of the databases
+	// with subscribers, for the writes made by the other processes
+	FollowChanges bool
+}
+
+// CouchDBValidationCache contains the configuration of the validation cache
+type CouchDBValidationCache struct {
+	// Size is the maximal number of ETags in the cache, 0 disables it
+	Size int
+	// MaxBytes is the maximal size in bytes of the documents in the cache
+	MaxBytes int64
+	// Doctypes are the doctypes whose documents are read conditionally
+	Doctypes []string
+}
+
+// CouchDBRetry contains the configuration for retrying the requests when
+// CouchDB is overloaded or unreachable
+type CouchDBRetry struct {
+	// MaxAttempts is the maximal number of attempts for a request, including
+	// the first one
+	MaxAttempts int
+	// MaxDuration is the time budget for all the attempts of a request
+	MaxDuration time.Duration
+}
+
+// CouchDBCircuitBreaker contains the configuration of the circuit breaker of
+// the CouchDB nodes
+type CouchDBCircuitBreaker struct {
+	// Threshold is the number of consecutive failures that opens the circuit,
+	// 0 disables the circuit breaker
+	Threshold int
+	// Window is the duration in which the failures must happen
+	Window time.Duration
+	// CoolDown is the duration during which the requests fail fast, before a
+	// probe request is sent to CouchDB
+	CoolDown time.Duration
+}
+
+// CouchDBRateLimit contains the configuration for limiting the rate of the
+// requests made to CouchDB by each instance
+type CouchDBRateLimit struct {
+	// Rate is the number of requests per second, 0 disables the rate limiting
+	Rate float64
+	// Burst is the number of requests that can be made at once
+	Burst int
+	// Wait tells if a request over the limit should wait (up to the deadline
+	// of its context) instead of failing immediately
+	Wait bool
+	// MaxPrefixes is the number of instances for which the usage is kept in
+	// memory
+	MaxPrefixes int
+}
+
+// CouchDBConcurrency contains the configuration for limiting the number of
+// requests sent to CouchDB at the same time
+type CouchDBConcurrency struct {
+	// MaxRequests is the number of requests in flight, 0 disables the limit
+	MaxRequests int
+	// MaxPerPrefix is the number of requests in flight for an instance, 0
+	// disables the limit
+	MaxPerPrefix int
+	// MaxFeeds is the number of streaming requests, like the changes feeds,
+	// that are open at the same time, 0 disables the limit
+	MaxFeeds int
+	// MaxWait is how long a request can wait for a slot, when the deadline of
+	// its context is later
+	MaxWait time.Duration
 }
 
 // Jobs contains the configuration values for the jobs and triggers
@@ -319,6 +507,14 @@ func CouchURL() *url.URL {
 	return config.CouchDB.URL
 }
 
+// CouchURLs returns the URLs of the nodes of the CouchDB cluster
+func CouchURLs() []*url.URL {
+	if len(config.CouchDB.URLs) == 0 {
+		return []*url.URL{config.CouchDB.URL}
+	}
+	return config.CouchDB.URLs
+}
+
 // Client returns the redis.Client for a RedisConfig
 func (rc *RedisConfig) Client() redis.UniversalClient {
 	return rc.cli
@@ -414,6 +610,26 @@ func applyDefaults(v *viper.Viper) {
 	v.SetDefault("assets_polling_interval", 2*time.Minute)
 	v.SetDefault("fs.versioning.max_number_of_versions_to_keep", 20)
 	v.SetDefault("fs.versioning.min_delay_between_two_versions", 15*time.Minute)
+	v.SetDefault("couchdb.timeout", 30*time.Second)
+	v.SetDefault("couchdb.dial_timeout", 5*time.Second)
+	v.SetDefault("couchdb.tls_handshake_timeout", 5*time.Second)
+	v.SetDefault("couchdb.max_idle_conns_per_host", 100)
+	v.SetDefault("couchdb.max_conns_per_host", 0)
+	v.SetDefault("couchdb.idle_conn_timeout", 90*time.Second)
+	v.SetDefault("couchdb.http2.enabled", true)
+	v.SetDefault("couchdb.http2.ping_timeout", 15*time.Second)
+	v.SetDefault("couchdb.retry.max_attempts", 3)
+	v.SetDefault("couchdb.retry.max_duration", 10*time.Second)
+	v.SetDefault("couchdb.rate_limit.max_prefixes", 10000)
+	v.SetDefault("couchdb.concurrency.max_wait", 10*time.Second)
+	v.SetDefault("couchdb.circuit_breaker.threshold", 5)
+	v.SetDefault("couchdb.circuit_breaker.window", 10*time.Second)
+	v.SetDefault("couchdb.circuit_breaker.cool_down", 10*time.Second)
+	v.SetDefault("couchdb.accepted_writes", "warn")
+	v.SetDefault("couchdb.max_document_size", 8000000)
+	v.SetDefault("couchdb.max_response_size", 64<<20)
+	v.SetDefault("couchdb.known_dbs", 100000)
+	v.SetDefault("couchdb.slow_requests.threshold", time.Second)
 }
 
 func envMap() map[string]string {
@@ -449,26 +665,83 @@ func UseViper(v *viper.Viper) error {
 		}
 	}
 
-	couchURL, couchAuth, err := parseURL(v.GetString("couchdb.url"))
+	couchSockets := make(map[string]string)
+	couchURL, couchAuth, err := parseCouchURL(v.GetString("couchdb.url"), couchSockets)
 	if err != nil {
 		return err
 	}
-	if couchURL.Path == "" {
-		couchURL.Path = "/"
+	var couchURLs []*url.URL
+	for _, u := range v.GetStringSlice("couchdb.urls") {
+		nodeURL, nodeAuth, err := parseCouchURL(u, couchSockets)
+		if err != nil {
+			return err
+		}
+		if couchAuth == nil {
+			couchAuth = nodeAuth
+		}
+		couchURLs = append(couchURLs, nodeURL)
 	}
-	couchClient, _, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
-		Timeout:    10 * time.Second,
-		RootCAFile: v.GetString("couchdb.root_ca"),
+	if len(couchURLs) > 0 {
+		couchURL = couchURLs[0]
+	}
+	couchReplicationURL, err := parseReplicationURL(v.GetString("couchdb.replication_url"))
+	if err != nil {
+		return err
+	}
+	couchClusters, err := makeCouchClusters(v.GetStringMap("couchdb.clusters"), couchSockets)
+	if err != nil {
+		return err
+	}
+	slowDoctypes, err := makeSlowDoctypes(v.GetStringMapString("couchdb.slow_requests.doctypes"))
+	if err != nil {
+		return err
+	}
+	if user := v.GetString("couchdb.user"); user != "" {
+		couchAuth = url.UserPassword(user, v.GetString("couchdb.password"))
+	}
+	couchInsecure := v.GetBool("couchdb.insecure_skip_validation")
+	if couchInsecure && !build.IsDevRelease() && !v.GetBool("couchdb.allow_insecure") {
+		return fmt.Errorf("CouchDB insecure_skip_validation is only allowed on development releases, or with allow_insecure")
+	}
+	// The timeout of the requests is applied by the couchdb package, as it can
+	// be overridden for some calls, like the longpoll changes feeds.
+	couchEndpoint := tlsclient.HTTPEndpoint{
+		DialTimeout:         v.GetDuration("couchdb.dial_timeout"),
+		TLSHandshakeTimeout: v.GetDuration("couchdb.tls_handshake_timeout"),
+		MaxIdleConnsPerHost: v.GetInt("couchdb.max_idle_conns_per_host"),
+		MaxConnsPerHost:     v.GetInt("couchdb.max_conns_per_host"),
+		IdleConnTimeout:     v.GetDuration("couchdb.idle_conn_timeout"),
+		RootCAFile:          v.GetString("couchdb.root_ca"),
+		RootCAPEM:           []byte(v.GetString("couchdb.root_ca_pem")),
 		ClientCertificateFiles: tlsclient.ClientCertificateFilePair{
 			CertificateFile: v.GetString("couchdb.client_cert"),
 			KeyFile:         v.GetString("couchdb.client_key"),
 		},
+		ClientCertificatePEM: tlsclient.ClientCertificatePEMPair{
+			Certificate: []byte(v.GetString("couchdb.client_cert_pem")),
+			Key:         []byte(v.GetString("couchdb.client_key_pem")),
+		},
 		PinnedKey:              v.GetString("couchdb.pinned_key"),
-		InsecureSkipValidation: v.GetBool("couchdb.insecure_skip_validation"),
-	})
+		InsecureSkipValidation: couchInsecure,
+		UnixSockets:            couchSockets,
+		DisableHTTP2:           !v.GetBool("couchdb.http2.enabled"),
+		HTTP2ReadIdleTimeout:   v.GetDuration("couchdb.http2.read_idle_timeout"),
+		HTTP2PingTimeout:       v.GetDuration("couchdb.http2.ping_timeout"),
+	}
+	couchClient, _, err := tlsclient.NewHTTPClient(couchEndpoint)
 	if err != nil {
 		return err
 	}
+	// The streaming requests have their own pool of connections, so that a
+	// proxy does not multiplex them with the other requests
+	var couchStreamingClient *http.Client
+	if !couchEndpoint.DisableHTTP2 && !v.GetBool("couchdb.http2.streaming") {
+		couchEndpoint.DisableHTTP2 = true
+		couchStreamingClient, _, err = tlsclient.NewHTTPClient(couchEndpoint)
+		if err != nil {
+			return err
+		}
+	}
 
 	fsClient, _, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
 		RootCAFile: v.GetString("fs.root_ca"),
@@ -688,9 +961,69 @@ func UseViper(v *viper.Viper) error {
 			},
 		},
 		CouchDB: CouchDB{
-			Auth:   couchAuth,
-			URL:    couchURL,
-			Client: couchClient,
+			Auth:            couchAuth,
+			URL:             couchURL,
+			URLs:            couchURLs,
+			ReplicationURL:  couchReplicationURL,
+			Clusters:        couchClusters,
+			Client:          couchClient,
+			StreamingClient: couchStreamingClient,
+			SessionAuth:     v.GetBool("couchdb.session_auth"),
+			Timeout:         v.GetDuration("couchdb.timeout"),
+			Retry: CouchDBRetry{
+				MaxAttempts: v.GetInt("couchdb.retry.max_attempts"),
+				MaxDuration: v.GetDuration("couchdb.retry.max_duration"),
+			},
+			RateLimit: CouchDBRateLimit{
+				Rate:        v.GetFloat64("couchdb.rate_limit.rate"),
+				Burst:       v.GetInt("couchdb.rate_limit.burst"),
+				Wait:        v.GetBool("couchdb.rate_limit.wait"),
+				MaxPrefixes: v.GetInt("couchdb.rate_limit.max_prefixes"),
+			},
+			Concurrency: CouchDBConcurrency{
+				MaxRequests:  v.GetInt("couchdb.concurrency.max_requests"),
+				MaxPerPrefix: v.GetInt("couchdb.concurrency.max_per_prefix"),
+				MaxFeeds:     v.GetInt("couchdb.concurrency.max_feeds"),
+				MaxWait:      v.GetDuration("couchdb.concurrency.max_wait"),
+			},
+			CircuitBreaker: CouchDBCircuitBreaker{
+				Threshold: v.GetInt("couchdb.circuit_breaker.threshold"),
+				Window:    v.GetDuration("couchdb.circuit_breaker.window"),
+				CoolDown:  v.GetDuration("couchdb.circuit_breaker.cool_down"),
+			},
+			HealthCheckInterval: v.GetDuration("couchdb.health_check_interval"),
+			AcceptedWrites:      v.GetString("couchdb.accepted_writes"),
+			Expvar:              v.GetBool("couchdb.expvar"),
+			Prometheus:          v.GetBool("couchdb.prometheus"),
+			SlowRequests: CouchDBSlowRequests{
+				Threshold: v.GetDuration("couchdb.slow_requests.threshold"),
+				Doctypes:  slowDoctypes,
+			},
+			DocCache: CouchDBDocCache{
+				Size:          v.GetInt("couchdb.doc_cache.size"),
+				TTL:           v.GetDuration("couchdb.doc_cache.ttl"),
+				Doctypes:      v.GetStringSlice("couchdb.doc_cache.doctypes"),
+				FollowChanges: v.GetBool("couchdb.doc_cache.follow_changes"),
+			},
+			ValidationCache: CouchDBValidationCache{
+				Size:     v.GetInt("couchdb.validation_cache.size"),
+				MaxBytes: v.GetInt64("couchdb.validation_cache.max_bytes"),
+				Doctypes: v.GetStringSlice("couchdb.validation_cache.doctypes"),
+			},
+			EventHub: CouchDBEventHub{
+				BufferSize:    v.GetInt("couchdb.event_hub.buffer_size"),
+				FollowChanges: v.GetBool("couchdb.event_hub.follow_changes"),
+			},
+			StrictDoctypes:  v.GetStringSlice("couchdb.strict_doctypes"),
+			EncryptionKeys:  v.GetStringSlice("couchdb.encryption_keys"),
+			MaxDocumentSize: v.GetInt("couchdb.max_document_size"),
+			MaxResponseSize: v.GetInt64("couchdb.max_response_size"),
+			KnownDBs:        v.GetInt("couchdb.known_dbs"),
+
+			ProxyAuthSecret:   v.GetString("couchdb.proxy_auth_secret"),
+			LogBodies:         v.GetBool("couchdb.log_bodies"),
+			LogRedactedFields: v.GetStringSlice("couchdb.log_redacted_fields"),
+			LogMaxBodySize:    v.GetInt("couchdb.log_max_body_size"),
 		},
 		Jobs: jobs,
 		Konnectors: Konnectors{
@@ -863,6 +1196,71 @@ func makeRegistries(v *viper.Viper) (map[string][]*url.URL, error) {
 	return regs, nil
 }
 
+// makeSlowDoctypes parses the thresholds of the slow requests for some
+// doctypes.
+func makeSlowDoctypes(raw map[string]string) (map[string]time.Duration, error) {
+	doctypes := make(map[string]time.Duration, len(raw))
+	for doctype, val := range raw {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Bad format in the couchdb.slow_requests.doctypes section of the configuration file: %s", err)
+		}
+		doctypes[doctype] = d
+	}
+	return doctypes, nil
+}
+
+func makeCouchClusters(raw map[string]interface{}, sockets map[string]string) ([]CouchDBCluster, error) {
+	var clusters []CouchDBCluster
+	for name, val := range raw {
+		entry, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf(
+				"Bad format in the couchdb.clusters section of the configuration file: "+
+					"should be a map, got %#v", val)
+		}
+		cluster := CouchDBCluster{Name: name}
+		rawURLs, _ := entry["urls"].([]interface{})
+		if u, ok := entry["url"].(string); ok {
+			rawURLs = append([]interface{}{u}, rawURLs...)
+		}
+		for _, raw := range rawURLs {
+			s, _ := raw.(string)
+			u, auth, err := parseCouchURL(s, sockets)
+			if err != nil {
+				return nil, err
+			}
+			if cluster.Auth == nil {
+				cluster.Auth = auth
+			}
+			cluster.URLs = append(cluster.URLs, u)
+		}
+		if len(cluster.URLs) == 0 {
+			return nil, fmt.Errorf("The CouchDB cluster %s has no url", name)
+		}
+		rawReplicationURL, _ := entry["replication_url"].(string)
+		replicationURL, err := parseReplicationURL(rawReplicationURL)
+		if err != nil {
+			return nil, err
+		}
+		cluster.ReplicationURL = replicationURL
+		if user, _ := entry["user"].(string); user != "" {
+			password, _ := entry["password"].(string)
+			cluster.Auth = url.UserPassword(user, password)
+		}
+		doctypes, _ := entry["doctypes"].([]interface{})
+		for _, doctype := range doctypes {
+			if s, ok := doctype.(string); ok {
+				cluster.Doctypes = append(cluster.Doctypes, s)
+			}
+		}
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Name < clusters[j].Name })
+	return clusters, nil
+}
+
 func makeSMS(raw map[string]interface{}) map[string]SMS {
 	sms := make(map[string]SMS)
 	for name, val := range raw {
@@ -974,6 +1372,65 @@ func findConfigFiles(name string) ([]string, error) {
 	return configFiles, nil
 }
 
+// parseCouchURL parses the URL of a CouchDB node. A URL like
+// unix:///var/run/couchdb.sock is for a node listening on a unix socket: it is
+// replaced by a HTTP URL with a placeholder host, and the socket is added to
+// sockets for this host, so that the client can dial it.
+func parseCouchURL(raw string, sockets map[string]string) (*url.URL, *url.Userinfo, error) {
+	u, auth, err := parseURL(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme == "unix" {
+		info, err := os.Stat(u.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("The CouchDB socket %s cannot be used: %s", u.Path, err)
+		}
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, nil, fmt.Errorf("The CouchDB socket %s is not a unix socket", u.Path)
+		}
+		host := ""
+		for h, path := range sockets {
+			if path == u.Path {
+				host = h
+			}
+		}
+		if host == "" {
+			host = fmt.Sprintf("unix-socket-%d", len(sockets)+1)
+			sockets[host] = u.Path
+		}
+		u = &url.URL{Scheme: "http", Host: host}
+	}
+	// The path is a prefix for the requests, when CouchDB is served by a
+	// reverse proxy, and the paths of the requests are appended to it
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+		if u.RawPath != "" {
+			u.RawPath += "/"
+		}
+	}
+	return u, auth, nil
+}
+
+// parseReplicationURL parses the URL where CouchDB reaches itself. It has no
+// credentials, as they are sent in the headers of the replication.
+func parseReplicationURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, _, err := parseURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("The CouchDB replication_url %s should be an http(s) URL", raw)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u, nil
+}
+
 func parseURL(u string) (*url.URL, *url.Userinfo, error) {
 	parsedURL, err := url.Parse(u)
 	if err != nil {
@@ -0,0 +1,173 @@
+package couchdb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// anonymizedJitter is the maximal relative change of the anonymized numbers.
+const anonymizedJitter = 0.1
+
+var (
+	anonymizedFields = make(map[string][]string)
+
+	emailRegexp = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	ibanRegexp  = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{10,30}$`)
+)
+
+// RegisterAnonymizedFields registers the fields of a doctype with personal
+// content, as paths with dots like "address.city", that are replaced by
+// fakes in the anonymized exports. For an object or an array, all the values
+// inside are replaced. It is meant to be called in an init function.
+func RegisterAnonymizedFields(doctype string, paths ...string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	anonymizedFields[doctype] = append(anonymizedFields[doctype], paths...)
+}
+
+func anonymizedFieldsFor(doctype string) []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return anonymizedFields[doctype]
+}
+
+// anonymizeDoc replaces the registered fields of an exported document by
+// fakes. The _id, _rev and _attachments are never changed, so that the
+// relationships between the documents still resolve.
+func anonymizeDoc(doc map[string]json.RawMessage, doctype string, seed int64) error {
+	a := anonymizer{seed: seed}
+	for _, path := range anonymizedFieldsFor(doctype) {
+		parts := strings.Split(path, ".")
+		key := parts[0]
+		raw, ok := doc[key]
+		if !ok || key == "_id" || key == "_rev" || key == "_attachments" {
+			continue
+		}
+		var value interface{}
+		if err := decodeUseNumber(raw, &value); err != nil {
+			return err
+		}
+		value = a.replaceAt(value, parts[1:])
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		doc[key] = data
+	}
+	return nil
+}
+
+// anonymizer makes the fakes. They only depend on the seed and on the
+// original values, so that two exports with the same seed can be compared,
+// and the same email is replaced by the same fake in all the documents.
+type anonymizer struct {
+	seed int64
+}
+
+func (a anonymizer) replaceAt(value interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return a.replace(value)
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		if child, ok := m[path[0]]; ok {
+			m[path[0]] = a.replaceAt(child, path[1:])
+		}
+	}
+	return value
+}
+
+func (a anonymizer) replace(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = a.replace(child)
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = a.replace(child)
+		}
+		return v
+	case string:
+		return a.fakeString(v)
+	case json.Number:
+		return a.jitter(v)
+	}
+	// The booleans and null are kept
+	return value
+}
+
+func (a anonymizer) fakeString(s string) string {
+	next := a.stream(s)
+	switch {
+	case emailRegexp.MatchString(s):
+		return fmt.Sprintf("user%d@example.com", next()%1000000)
+	case ibanRegexp.MatchString(strings.Replace(s, " ", "", -1)):
+		// The country prefix is kept
+		return s[:2] + a.fakeText(s[2:], next)
+	}
+	return a.fakeText(s, next)
+}
+
+// fakeText keeps the length and the shape of a text: the letters are
+// replaced by letters of the same case, the digits by digits, and the other
+// characters, like the spaces and the punctuation, are kept.
+func (a anonymizer) fakeText(s string, next func() uint64) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		switch {
+		case unicode.IsUpper(r):
+			b.WriteByte(byte('A' + next()%26))
+		case unicode.IsLetter(r):
+			b.WriteByte(byte('a' + next()%26))
+		case unicode.IsDigit(r):
+			b.WriteByte(byte('0' + next()%10))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// jitter changes a number by up to 10%, and keeps the integers as integers.
+func (a anonymizer) jitter(n json.Number) json.Number {
+	f, err := n.Float64()
+	if err != nil {
+		return n
+	}
+	ratio := float64(a.stream(n.String())()%2001)/1000 - 1
+	f *= 1 + ratio*anonymizedJitter
+	if !strings.ContainsAny(n.String(), ".eE") {
+		return json.Number(fmt.Sprintf("%d", int64(math.Round(f))))
+	}
+	return json.Number(fmt.Sprintf("%g", f))
+}
+
+// stream returns a deterministic sequence of pseudo-random numbers for a
+// value.
+func (a anonymizer) stream(value string) func() uint64 {
+	var block [sha256.Size]byte
+	var counter uint64
+	pos := len(block)
+	return func() uint64 {
+		if pos+8 > len(block) {
+			h := sha256.New()
+			_ = binary.Write(h, binary.BigEndian, a.seed)
+			_ = binary.Write(h, binary.BigEndian, counter)
+			h.Write([]byte(value))
+			h.Sum(block[:0])
+			counter++
+			pos = 0
+		}
+		n := binary.BigEndian.Uint64(block[pos:])
+		pos += 8
+		return n
+	}
+}
@@ -0,0 +1,85 @@
+package couchdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnonymizer(t *testing.T) {
+	a := anonymizer{seed: 42}
+	fake := a.fakeString("Hello World 42!")
+	assert.Len(t, fake, len("Hello World 42!"))
+	assert.Regexp(t, `^[A-Z][a-z]{4} [A-Z][a-z]{4} [0-9]{2}!$`, fake)
+	assert.Equal(t, fake, a.fakeString("Hello World 42!"))
+	assert.NotEqual(t, fake, anonymizer{seed: 43}.fakeString("Hello World 42!"))
+
+	assert.Regexp(t, `^user[0-9]+@example\.com$`, a.fakeString("alice@cozy.tools"))
+	iban := a.fakeString("FR76 3000 6000 0112 3456 7890 189")
+	assert.Regexp(t, `^FR[0-9]{2} [0-9]{4} [0-9]{4} [0-9]{4} [0-9]{4} [0-9]{4} [0-9]{3}$`, iban)
+	assert.NotEqual(t, "FR76 3000 6000 0112 3456 7890 189", iban)
+
+	n, err := a.jitter("1000").Int64()
+	assert.NoError(t, err)
+	assert.InDelta(t, 1000, n, 100)
+	f, err := a.jitter("12.5").Float64()
+	assert.NoError(t, err)
+	assert.InDelta(t, 12.5, f, 1.25)
+}
+
+func TestExportDocsAnonymized(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := newMemCouch()
+	restore := useTestServer(t, server)
+	defer restore()
+
+	doctype := "io.cozy.tests.anonymized"
+	RegisterAnonymizedFields(doctype, "name", "email", "address.city", "amounts", "_id")
+	db := prefixer.NewPrefixer("anonymized.cozy.tools", "anonymized")
+	server.seed(db, doctype,
+		`{"_id":"contact1","name":"Alice","email":"alice@cozy.tools","address":{"city":"Paris","country":"France"},"amounts":[10,20.5],"age":30,"friend":"contact2"}`,
+		`{"_id":"contact2","name":"Bob","email":"alice@cozy.tools"}`,
+	)
+
+	export := func(seed int64) []map[string]json.RawMessage {
+		var buf bytes.Buffer
+		_, err := ExportDocs(db, doctype, &buf, ExportOptions{Anonymize: true, AnonymizeSeed: seed})
+		assert.NoError(t, err)
+		var docs []map[string]json.RawMessage
+		scanner := bufio.NewScanner(&buf)
+		scanner.Scan() // The header
+		for scanner.Scan() {
+			var doc map[string]json.RawMessage
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+			docs = append(docs, doc)
+		}
+		return docs
+	}
+
+	docs := export(1)
+	if assert.Len(t, docs, 2) {
+		alice, bob := docs[0], docs[1]
+		// The identifiers, the revisions and the unlisted fields are kept
+		assert.JSONEq(t, `"contact1"`, string(alice["_id"]))
+		assert.JSONEq(t, `"1-seed"`, string(alice["_rev"]))
+		assert.JSONEq(t, `"contact2"`, string(alice["friend"]))
+		assert.JSONEq(t, `30`, string(alice["age"]))
+		assert.Contains(t, string(alice["address"]), `"country":"France"`)
+
+		assert.NotEqual(t, `"Alice"`, string(alice["name"]))
+		assert.Len(t, string(alice["name"]), len(`"Alice"`))
+		assert.NotContains(t, string(alice["address"]), "Paris")
+		assert.Regexp(t, `^"user[0-9]+@example\.com"$`, string(alice["email"]))
+		assert.Equal(t, string(alice["email"]), string(bob["email"]))
+		var amounts []float64
+		assert.NoError(t, json.Unmarshal(alice["amounts"], &amounts))
+		assert.InDelta(t, 10, amounts[0], 1)
+		assert.InDelta(t, 20.5, amounts[1], 2.05)
+	}
+	assert.Equal(t, docs, export(1))
+	assert.NotEqual(t, docs, export(2))
+}
@@ -0,0 +1,96 @@
+package couchdb
+
+import (
+	"context"
+)
+
+// ArchiveSuffix is added to a doctype for the database where its deleted
+// documents are archived.
+const ArchiveSuffix = "/archived"
+
+var archived = make(map[string]bool)
+
+// RegisterArchive enables the archive of the deleted documents of a doctype:
+// DeleteDoc and BulkDeleteDocs first copy the documents to the archive
+// doctype (see ArchiveDoctype), with the date and the reason of the deletion,
+// and the deletion is aborted if they cannot be archived. It is meant to be
+// called in an init function.
+func RegisterArchive(doctype string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	archived[doctype] = true
+}
+
+// ArchiveDoctype returns the doctype where the deleted documents of a
+// doctype are archived.
+func ArchiveDoctype(doctype string) string {
+	return doctype + ArchiveSuffix
+}
+
+func isArchived(doctype string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return archived[doctype]
+}
+
+type archiveReasonKey struct{}
+
+// WithArchiveReason returns a context where the documents deleted and
+// archived have the given reason in their archive.
+func WithArchiveReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, archiveReasonKey{}, reason)
+}
+
+// archiveDoc copies the document, as it is in CouchDB for the revision that
+// will be deleted, to the archive doctype. The archive has the same _id as
+// the document, and it replaces the previous one if the document has already
+// been deleted and restored.
+func archiveDoc(ctx context.Context, db Database, doc Doc) error {
+	doctype := doc.DocType()
+	var current JSONDoc
+	if err := GetDocRevContext(ctx, db, doctype, doc.ID(), doc.Rev(), &current); err != nil {
+		return err
+	}
+	delete(current.M, "_id")
+	delete(current.M, "_rev")
+	reason, _ := ctx.Value(archiveReasonKey{}).(string)
+	archive := &JSONDoc{
+		Type: ArchiveDoctype(doctype),
+		M: map[string]interface{}{
+			"_id":        doc.ID(),
+			"rev":        doc.Rev(),
+			"archivedAt": timestampNow().Format(timestampLayout),
+			"doc":        current.M,
+		},
+	}
+	if reason != "" {
+		archive.M["reason"] = reason
+	}
+	return UpsertContext(ctx, db, archive)
+}
+
+// RestoreFromArchive calls RestoreFromArchiveContext with a background
+// context.
+func RestoreFromArchive(db Database, doctype, id string) (*JSONDoc, error) {
+	return RestoreFromArchiveContext(context.Background(), db, doctype, id)
+}
+
+// RestoreFromArchiveContext brings back a deleted document from the archive
+// of its doctype: it is created again with the same _id and content, and its
+// archive is removed.
+func RestoreFromArchiveContext(ctx context.Context, db Database, doctype, id string) (*JSONDoc, error) {
+	var archive JSONDoc
+	if err := GetDocContext(ctx, db, ArchiveDoctype(doctype), id, &archive); err != nil {
+		return nil, err
+	}
+	content, _ := archive.Get("doc").(map[string]interface{})
+	doc := &JSONDoc{Type: doctype, M: content}
+	doc.SetID(id)
+	if err := CreateNamedDocContext(ctx, db, doc); err != nil {
+		return nil, err
+	}
+	if err := DeleteDocContext(ctx, db, &archive); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,116 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchive(t *testing.T) {
+	var mu sync.Mutex
+	docs := make(map[string]map[string]interface{})
+	var deleted []string
+	failArchive := false
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path := r.URL.EscapedPath()
+		isArchive := strings.Contains(path, "%2Farchived")
+		switch {
+		case strings.HasSuffix(path, "/_bulk_docs"):
+			var body struct {
+				Docs []map[string]interface{} `json:"docs"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			res := make([]UpdateResponse, len(body.Docs))
+			for i, doc := range body.Docs {
+				id := doc["_id"].(string)
+				deleted = append(deleted, id)
+				delete(docs, strings.TrimSuffix(path, "_bulk_docs")+id)
+				res[i] = UpdateResponse{ID: id, Rev: "9-deleted", Ok: true}
+			}
+			_ = json.NewEncoder(w).Encode(res)
+		case r.Method == http.MethodGet:
+			doc, ok := docs[path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(doc)
+		case r.Method == http.MethodPut:
+			if isArchive && failArchive {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"error":"forbidden","reason":"no"}`))
+				return
+			}
+			var doc map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&doc)
+			doc["_rev"] = "1-put"
+			docs[path] = doc
+			_ = json.NewEncoder(w).Encode(UpdateResponse{ID: doc["_id"].(string), Rev: "1-put", Ok: true})
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, path)
+			delete(docs, path)
+			_, _ = w.Write([]byte(`{"ok":true,"id":"x","rev":"9-deleted"}`))
+		}
+	}))
+	defer restore()
+
+	const doctype = "io.cozy.tests.archived"
+	RegisterArchive(doctype)
+	defer func() {
+		registryMu.Lock()
+		delete(archived, doctype)
+		registryMu.Unlock()
+	}()
+	docPath := "/" + makeDBName(TestPrefix, doctype) + "/foo"
+	archivePath := "/" + makeDBName(TestPrefix, ArchiveDoctype(doctype)) + "/foo"
+	docs[docPath] = map[string]interface{}{"_id": "foo", "_rev": "1-abc", "name": "bar"}
+	ctx := WithArchiveReason(context.Background(), "asked by the user")
+
+	// The deletion is aborted if the document cannot be archived
+	failArchive = true
+	doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"_id": "foo", "_rev": "1-abc"}}
+	assert.Error(t, DeleteDocContext(ctx, TestPrefix, doc))
+	assert.Empty(t, deleted)
+
+	failArchive = false
+	assert.NoError(t, DeleteDocContext(ctx, TestPrefix, doc))
+	assert.Equal(t, []string{docPath}, deleted)
+	archive := docs[archivePath]
+	if assert.NotNil(t, archive) {
+		assert.Equal(t, "1-abc", archive["rev"])
+		assert.Equal(t, "asked by the user", archive["reason"])
+		assert.NotEmpty(t, archive["archivedAt"])
+		assert.Equal(t, map[string]interface{}{"name": "bar"}, archive["doc"])
+	}
+
+	restored, err := RestoreFromArchive(TestPrefix, doctype, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", restored.ID())
+	assert.Equal(t, "bar", restored.GetString("name"))
+	assert.Equal(t, "bar", docs[docPath]["name"])
+	assert.Nil(t, docs[archivePath])
+	_, err = RestoreFromArchive(TestPrefix, doctype, "foo")
+	assert.True(t, IsNotFoundError(err))
+
+	// The bulk deletions archive all the documents
+	deleted = nil
+	doc.SetRev("1-put")
+	assert.NoError(t, BulkDeleteDocsContext(ctx, TestPrefix, doctype, []Doc{doc}))
+	assert.Equal(t, []string{"foo"}, deleted)
+	assert.NotNil(t, docs[archivePath])
+
+	// The other doctypes are not archived
+	deleted = nil
+	other := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo", "_rev": "1-abc"}}
+	assert.NoError(t, DeleteDocContext(ctx, TestPrefix, other))
+	assert.Len(t, deleted, 1)
+	assert.Len(t, docs, 1)
+}
@@ -0,0 +1,245 @@
+package couchdb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"golang.org/x/sync/singleflight"
+)
+
+// sessionCookieName is the name of the cookie used by CouchDB for its
+// cookie authentication.
+const sessionCookieName = "AuthSession"
+
+// ProxyAuth is the identity of a CouchDB user, used with the proxy
+// authentication of CouchDB to make the requests of an instance with a
+// low-privilege user instead of the admin.
+type ProxyAuth struct {
+	UserName string
+	Roles    []string
+}
+
+// ProxyAuthResolver returns the CouchDB user to use for the requests on the
+// given database, or nil to use the credentials from the configuration.
+type ProxyAuthResolver func(db Database) *ProxyAuth
+
+var proxyAuthResolver ProxyAuthResolver
+
+// SetProxyAuthResolver sets the function used to know which CouchDB user
+// should be used for the requests on a database. By default, there is no
+// resolver, and all the requests are made with the credentials from the
+// configuration.
+func SetProxyAuthResolver(resolver ProxyAuthResolver) {
+	proxyAuthResolver = resolver
+}
+
+// proxyAuthFor returns the proxy authentication to use for a database, or
+// nil if the credentials from the configuration should be used.
+func proxyAuthFor(db Database) *ProxyAuth {
+	if proxyAuthResolver == nil || db == nil {
+		return nil
+	}
+	return proxyAuthResolver(db)
+}
+
+// setProxyAuth adds the headers of the proxy authentication of CouchDB. The
+// token is the HMAC-SHA1 of the username, signed with the shared secret.
+func setProxyAuth(req *http.Request, auth *ProxyAuth) {
+	req.Header.Set("X-Auth-CouchDB-UserName", auth.UserName)
+	req.Header.Set("X-Auth-CouchDB-Roles", strings.Join(auth.Roles, ","))
+	if secret := config.GetConfig().CouchDB.ProxyAuthSecret; secret != "" {
+		mac := hmac.New(sha1.New, []byte(secret))
+		_, _ = mac.Write([]byte(auth.UserName))
+		req.Header.Set("X-Auth-CouchDB-Token", hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+// setAuth adds the credentials to a request made to CouchDB for the given
+// database: the proxy authentication headers if a user is resolved for it,
+// or the credentials of the cluster. The credentials are sent in a header,
+// never in the URL, to avoid leaking them in the logs and the errors.
+func setAuth(db Database, cl *cluster, req *http.Request) {
+	if auth := proxyAuthFor(db); auth != nil {
+		setProxyAuth(req, auth)
+		return
+	}
+	auth := cl.auth
+	if auth == nil {
+		return
+	}
+	if p, ok := auth.Password(); ok {
+		req.SetBasicAuth(auth.Username(), p)
+	}
+}
+
+// doRequest sends a request to CouchDB with the authentication for the given
+// database, on the cluster of the context of the request. With the session
+// authentication, the AuthSession cookie is attached to the request, and if
+// CouchDB responds with a 401 because the session has expired, the stack
+// logins again and retries the request once.
+func doRequest(db Database, req *http.Request) (*http.Response, error) {
+	cl := clusterFromContext(req.Context())
+	if !config.GetConfig().CouchDB.SessionAuth || cl.auth == nil || proxyAuthFor(db) != nil {
+		setAuth(db, cl, req)
+		return clientFor(req).Do(req)
+	}
+
+	sessions := cl.sessions()
+	cookie, err := sessions.get(cl)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sendWithSession(sessions, req, cookie)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	// The session has expired, renew it and retry the request
+	cookie, err = sessions.renew(cl, cookie)
+	if err != nil {
+		return resp, nil
+	}
+	drainAndClose(resp.Body)
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Del("Cookie")
+	return sendWithSession(sessions, retry, cookie)
+}
+
+func sendWithSession(sessions *sessionStore, req *http.Request, cookie *http.Cookie) (*http.Response, error) {
+	req.AddCookie(cookie)
+	resp, err := clientFor(req).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// CouchDB refreshes the cookie when it is close to its expiration
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookieName && c.Value != "" {
+			sessions.set(c)
+		}
+	}
+	return resp, nil
+}
+
+// sessionStore keeps the AuthSession cookie shared by all the requests made
+// to a CouchDB cluster.
+type sessionStore struct {
+	mu     sync.RWMutex
+	cookie *http.Cookie
+	group  singleflight.Group
+}
+
+var sessions sessionStore
+
+// get returns the current session cookie, and creates a new session if there
+// is none.
+func (s *sessionStore) get(cl *cluster) (*http.Cookie, error) {
+	s.mu.RLock()
+	cookie := s.cookie
+	s.mu.RUnlock()
+	if cookie != nil {
+		return cookie, nil
+	}
+	return s.renew(cl, nil)
+}
+
+func (s *sessionStore) set(cookie *http.Cookie) {
+	s.mu.Lock()
+	s.cookie = &http.Cookie{Name: cookie.Name, Value: cookie.Value}
+	s.mu.Unlock()
+}
+
+func (s *sessionStore) reset() {
+	s.mu.Lock()
+	s.cookie = nil
+	s.mu.Unlock()
+}
+
+// renew creates a new session. The expired parameter is the cookie that was
+// rejected by CouchDB: if another goroutine has already renewed it, the new
+// cookie is returned without a new login. And concurrent calls are
+// deduplicated, so that a burst of 401 triggers only one login.
+func (s *sessionStore) renew(cl *cluster, expired *http.Cookie) (*http.Cookie, error) {
+	s.mu.RLock()
+	current := s.cookie
+	s.mu.RUnlock()
+	if current != nil && (expired == nil || current.Value != expired.Value) {
+		return current, nil
+	}
+
+	v, err, _ := s.group.Do("login", func() (interface{}, error) {
+		cookie, err := login(cl)
+		if err != nil {
+			return nil, err
+		}
+		s.set(cookie)
+		return cookie, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*http.Cookie), nil
+}
+
+// login opens a new session on a CouchDB cluster with its credentials.
+func login(cl *cluster) (*http.Cookie, error) {
+	password, _ := cl.auth.Password()
+	form := url.Values{
+		"name":     {cl.auth.Username()},
+		"password": {password},
+	}
+	ctx, watchdog := withRequestTimeout(context.Background())
+	defer watchdog.stop()
+	u := nodeURL(pickNode(cl.urls, nil), "_session")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, newRequestError(err)
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return nil, newConnectionError(err)
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, newIOReadError(err)
+		}
+		return nil, newCouchdbError(resp.StatusCode, body)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookieName && c.Value != "" {
+			return c, nil
+		}
+	}
+	return nil, newCouchdbError(resp.StatusCode, []byte(`{"error":"no_session","reason":"no AuthSession cookie"}`))
+}
+
+// maxDrainSize is the maximal number of bytes read by drainAndClose. For a
+// larger body, it is cheaper to open a new connection than to read it.
+const maxDrainSize = 64 * 1024
+
+// drainAndClose reads what is left of a response body before closing it, so
+// that the connection can be reused.
+func drainAndClose(body io.ReadCloser) {
+	_, _ = io.CopyN(ioutil.Discard, body, maxDrainSize)
+	_ = body.Close()
+}
@@ -0,0 +1,157 @@
+package couchdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// sessionServer is a fake CouchDB where the sessions expire after a given
+// number of requests.
+type sessionServer struct {
+	mu       sync.Mutex
+	maxReqs  int
+	nbReqs   int
+	current  string
+	logins   int32
+	requests int32
+}
+
+func (s *sessionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/_session" && r.Method == http.MethodPost {
+		_ = r.ParseForm()
+		if r.Form.Get("name") != "admin" || r.Form.Get("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"unauthorized","reason":"Name or password is incorrect."}`)
+			return
+		}
+		n := atomic.AddInt32(&s.logins, 1)
+		s.mu.Lock()
+		s.current = fmt.Sprintf("token-%d", n)
+		s.nbReqs = 0
+		s.mu.Unlock()
+		http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: s.current})
+		fmt.Fprint(w, `{"ok":true}`)
+		return
+	}
+
+	atomic.AddInt32(&s.requests, 1)
+	cookie, err := r.Cookie(sessionCookieName)
+	s.mu.Lock()
+	valid := err == nil && cookie.Value == s.current && (s.maxReqs == 0 || s.nbReqs < s.maxReqs)
+	if valid {
+		s.nbReqs++
+	}
+	s.mu.Unlock()
+	if !valid || r.Header.Get("Authorization") != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"unauthorized","reason":"You are not authorized to access this db."}`)
+		return
+	}
+	fmt.Fprint(w, `{"db_name":"test"}`)
+}
+
+func (s *sessionServer) expire() {
+	s.mu.Lock()
+	s.current = "expired"
+	s.mu.Unlock()
+}
+
+func useSessionServer(t *testing.T, s *sessionServer) func() {
+	restore := useTestServer(t, s)
+	config.GetConfig().CouchDB.Auth = url.UserPassword("admin", "secret")
+	config.GetConfig().CouchDB.SessionAuth = true
+	sessions.reset()
+	return func() {
+		sessions.reset()
+		restore()
+	}
+}
+
+func TestSessionAuthRenewal(t *testing.T) {
+	s := &sessionServer{maxReqs: 3}
+	defer useSessionServer(t, s)()
+
+	for i := 0; i < 10; i++ {
+		_, err := DBStatus(TestPrefix, TestDoctype)
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 4, atomic.LoadInt32(&s.logins))
+}
+
+func TestSessionAuthSingleFlight(t *testing.T) {
+	s := &sessionServer{}
+	defer useSessionServer(t, s)()
+
+	_, err := DBStatus(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&s.logins))
+
+	s.expire()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := DBStatus(TestPrefix, TestDoctype)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 2, atomic.LoadInt32(&s.logins))
+}
+
+func TestSessionAuthBadCredentials(t *testing.T) {
+	s := &sessionServer{}
+	defer useSessionServer(t, s)()
+	config.GetConfig().CouchDB.Auth = url.UserPassword("admin", "wrong")
+
+	_, err := DBStatus(TestPrefix, TestDoctype)
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&s.requests))
+}
+
+func TestProxyAuth(t *testing.T) {
+	var headers http.Header
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		fmt.Fprint(w, `{"db_name":"test"}`)
+	}))
+	defer restore()
+	config.GetConfig().CouchDB.Auth = url.UserPassword("admin", "secret")
+	config.GetConfig().CouchDB.ProxyAuthSecret = "92de07df7e7a3fe14808cef90a7cc0d91"
+
+	// Without a resolver, the admin credentials are used
+	_, err := DBStatus(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, headers.Get("Authorization"))
+	assert.Empty(t, headers.Get("X-Auth-CouchDB-UserName"))
+
+	SetProxyAuthResolver(func(db Database) *ProxyAuth {
+		return &ProxyAuth{
+			UserName: "user-" + db.DBPrefix(),
+			Roles:    []string{"instance", "reader"},
+		}
+	})
+	defer SetProxyAuthResolver(nil)
+
+	_, err = DBStatus(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.Empty(t, headers.Get("Authorization"))
+	assert.Equal(t, "user-couchdb-tests", headers.Get("X-Auth-CouchDB-UserName"))
+	assert.Equal(t, "instance,reader", headers.Get("X-Auth-CouchDB-Roles"))
+	mac := hmac.New(sha1.New, []byte("92de07df7e7a3fe14808cef90a7cc0d91"))
+	mac.Write([]byte("user-couchdb-tests"))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), headers.Get("X-Auth-CouchDB-Token"))
+}
@@ -0,0 +1,64 @@
+package couchdb
+
+import (
+	"strings"
+)
+
+// The identifiers of the documents are bare by default: they are generated
+// by CouchDB, or by an IDGenerator. But a generator can prefix them with the
+// doctype and a slash, like "io.cozy.files/abcd", and such prefixed
+// identifiers are redundant with the database, and leak in the URLs.
+//
+// With the bare IDs mode, the prefix is removed from the generated
+// identifiers, and the documents created before with a prefix can still be
+// fetched with either form of their identifier.
+
+var (
+	globalBareIDs bool
+	bareIDs       = make(map[string]bool)
+)
+
+// SetBareIDs enables or disables the bare IDs mode for all the doctypes.
+func SetBareIDs(enabled bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	globalBareIDs = enabled
+}
+
+// RegisterBareIDs enables the bare IDs mode for a doctype. It is meant to be
+// called in an init function.
+func RegisterBareIDs(doctype string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	bareIDs[doctype] = true
+}
+
+func hasBareIDs(doctype string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return globalBareIDs || bareIDs[doctype]
+}
+
+// BareID returns the identifier without the doctype prefix, if it has one.
+func BareID(doctype, id string) string {
+	return strings.TrimPrefix(id, doctype+"/")
+}
+
+// PrefixedID returns the identifier with the doctype prefix, as it was
+// generated before the bare IDs mode.
+func PrefixedID(doctype, id string) string {
+	return doctype + "/" + BareID(doctype, id)
+}
+
+// legacyID returns the other form of an identifier, to look for a document
+// created before the bare IDs mode, or with a prefixed identifier given by a
+// client. It returns an empty string if the mode is disabled.
+func legacyID(doctype, id string) string {
+	if id == "" || !hasBareIDs(doctype) {
+		return ""
+	}
+	if bare := BareID(doctype, id); bare != id {
+		return bare
+	}
+	return PrefixedID(doctype, id)
+}
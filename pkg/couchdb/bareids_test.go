@@ -0,0 +1,109 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBareIDs(t *testing.T) {
+	legacy := TestDoctype + "/abc"
+	var requested []string
+	noDB := false
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			var doc map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&doc)
+			_ = json.NewEncoder(w).Encode(UpdateResponse{ID: doc["_id"].(string), Rev: "1-abc", Ok: true})
+			return
+		}
+		parts := strings.Split(r.URL.EscapedPath(), "/")
+		id, _ := url.PathUnescape(parts[len(parts)-1])
+		requested = append(requested, id)
+		switch {
+		case noDB:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"Database does not exist."}`))
+		case id == legacy:
+			_, _ = w.Write([]byte(`{"_id":"` + legacy + `","_rev":"1-abc","test":"legacy"}`))
+		case id == "def":
+			_, _ = w.Write([]byte(`{"_id":"def","_rev":"1-abc","test":"bare"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+		}
+	}))
+	defer restore()
+	defer func() {
+		SetBareIDs(false)
+		SetIDGenerator(nil)
+		registryMu.Lock()
+		delete(bareIDs, TestDoctype)
+		registryMu.Unlock()
+	}()
+
+	assert.Equal(t, "abc", BareID(TestDoctype, legacy))
+	assert.Equal(t, "abc", BareID(TestDoctype, "abc"))
+	assert.Equal(t, legacy, PrefixedID(TestDoctype, "abc"))
+	assert.Equal(t, legacy, PrefixedID(TestDoctype, legacy))
+
+	// Without the mode, the identifiers are used as they are
+	doc := &testDoc{}
+	assert.True(t, IsNotFoundError(GetDoc(TestPrefix, TestDoctype, "abc", doc)))
+	assert.Equal(t, []string{"abc"}, requested)
+
+	// With it, the old documents can be fetched with their bare identifier
+	RegisterBareIDs(TestDoctype)
+	requested = nil
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "abc", doc))
+	assert.Equal(t, legacy, doc.ID())
+	assert.Equal(t, "legacy", doc.Test)
+	assert.Equal(t, []string{"abc", legacy}, requested)
+
+	// And the prefixed identifiers are still accepted
+	requested = nil
+	doc = &testDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, legacy, doc))
+	assert.Equal(t, "legacy", doc.Test)
+	assert.Equal(t, []string{legacy}, requested)
+	doc = &testDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, TestDoctype+"/def", doc))
+	assert.Equal(t, "def", doc.ID())
+	assert.Equal(t, "bare", doc.Test)
+
+	// A missing document is not found with both forms
+	requested = nil
+	err := GetDoc(TestPrefix, TestDoctype, "missing", &testDoc{})
+	assert.True(t, IsNotFoundError(err))
+	assert.Equal(t, []string{"missing", TestDoctype + "/missing"}, requested)
+
+	// The fallback is not tried for a missing database
+	requested = nil
+	noDB = true
+	err = GetDoc(TestPrefix, TestDoctype, "abc", &testDoc{})
+	assert.True(t, IsNoDatabaseError(err))
+	assert.Len(t, requested, 1)
+	noDB = false
+
+	// The new identifiers are bare, even with a generator that prefixes them
+	SetIDGenerator(IDGeneratorFunc(func(doc Doc) (string, error) {
+		return doc.DocType() + "/ghi", nil
+	}))
+	created := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"test": "new"}}
+	assert.NoError(t, CreateDoc(TestPrefix, created))
+	assert.Equal(t, "ghi", created.ID())
+
+	// The mode can also be enabled for all the doctypes
+	const other = "io.cozy.tests.bareids"
+	created = &JSONDoc{Type: other, M: map[string]interface{}{"test": "new"}}
+	assert.NoError(t, CreateDoc(TestPrefix, created))
+	assert.Equal(t, other+"/ghi", created.ID())
+	SetBareIDs(true)
+	created = &JSONDoc{Type: other, M: map[string]interface{}{"test": "new"}}
+	assert.NoError(t, CreateDoc(TestPrefix, created))
+	assert.Equal(t, "ghi", created.ID())
+}
@@ -0,0 +1,33 @@
+package couchdb
+
+// BaseDoc can be embedded in the Go types of the documents to implement the
+// ID, Rev, SetID and SetRev methods of the Doc interface, with the right JSON
+// tags. The _id and _rev fields are omitted when they are empty, so that a
+// new document can be given to CreateDoc.
+//
+// The embedding type still has to define the DocType and Clone methods, like
+// this:
+//
+//	type Folder struct {
+//	    couchdb.BaseDoc
+//	    Name string `json:"name"`
+//	}
+//
+//	func (f *Folder) DocType() string { return consts.BitwardenFolders }
+//	func (f *Folder) Clone() couchdb.Doc { cloned := *f; return &cloned }
+type BaseDoc struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+}
+
+// ID returns the document identifier
+func (b *BaseDoc) ID() string { return b.DocID }
+
+// Rev returns the document revision
+func (b *BaseDoc) Rev() string { return b.DocRev }
+
+// SetID changes the document identifier
+func (b *BaseDoc) SetID(id string) { b.DocID = id }
+
+// SetRev changes the document revision
+func (b *BaseDoc) SetRev(rev string) { b.DocRev = rev }
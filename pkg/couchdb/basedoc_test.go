@@ -0,0 +1,42 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type baseTestDoc struct {
+	BaseDoc
+	Name string `json:"name"`
+}
+
+func (d *baseTestDoc) DocType() string { return TestDoctype }
+func (d *baseTestDoc) Clone() Doc      { cloned := *d; return &cloned }
+
+var _ Doc = &baseTestDoc{}
+
+func TestBaseDoc(t *testing.T) {
+	doc := &baseTestDoc{Name: "foo"}
+	data, err := json.Marshal(doc)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"name":"foo"}`, string(data))
+
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ok":true,"id":"bar","rev":"1-abc"}`))
+	}))
+	defer restore()
+	assert.NoError(t, CreateDocContext(context.Background(), TestPrefix, doc))
+	assert.Equal(t, "bar", doc.ID())
+	assert.Equal(t, "1-abc", doc.Rev())
+
+	data, err = json.Marshal(doc)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"_id":"bar","_rev":"1-abc","name":"foo"}`, string(data))
+	decoded := &baseTestDoc{}
+	assert.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, doc, decoded)
+}
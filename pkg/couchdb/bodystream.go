@@ -0,0 +1,162 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// streamBodyThreshold is the size in bytes over which the body of a
+// _bulk_docs request is encoded while it is sent, instead of being held in
+// memory.
+var streamBodyThreshold = 1 << 20
+
+// errOverThreshold stops the encoding of a body in memory, when it is large
+// enough to be streamed.
+var errOverThreshold = errors.New("body over the streaming threshold")
+
+// bulkDocsBody is the body of a _bulk_docs request. It is encoded document by
+// document, so that only one document at a time is held in memory when it is
+// streamed to CouchDB.
+type bulkDocsBody struct {
+	// noNewEdits sets new_edits to false, to force the revisions
+	noNewEdits bool
+	n          int
+	doc        func(i int) interface{}
+}
+
+func newBulkDocsBody(docs []interface{}) *bulkDocsBody {
+	return &bulkDocsBody{n: len(docs), doc: func(i int) interface{} { return docs[i] }}
+}
+
+// MarshalJSON is used when the body is not streamed, for example to encrypt
+// its fields.
+func (b *bulkDocsBody) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := b.encode(&buf, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encode writes the JSON of the body. Each document is encoded on its own,
+// and an error is returned if one is larger than limit (when positive).
+func (b *bulkDocsBody) encode(w io.Writer, limit int) error {
+	prefix := `{"docs":[`
+	if b.noNewEdits {
+		prefix = `{"new_edits":false,"docs":[`
+	}
+	if _, err := io.WriteString(w, prefix); err != nil {
+		return err
+	}
+	p := encoderPool.Get().(*pooledEncoder)
+	defer putEncoder(p)
+	for i := 0; i < b.n; i++ {
+		p.buf.Reset()
+		if err := p.enc.Encode(b.doc(i)); err != nil {
+			return err
+		}
+		// Encode adds a newline that json.Marshal doesn't
+		data := bytes.TrimSuffix(p.buf.Bytes(), []byte{'\n'})
+		if limit > 0 && len(data) > limit {
+			return newDocumentTooLargeError(data, i, limit)
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]}")
+	return err
+}
+
+// thresholdWriter writes in a buffer, until the threshold is exceeded.
+type thresholdWriter struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (w *thresholdWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.max {
+		return 0, errOverThreshold
+	}
+	return w.buf.Write(p)
+}
+
+// canStreamBody returns false when the body of a request must be in memory:
+// for the dry runs, the encrypted fields, and the debug logs of the bodies.
+func canStreamBody(ctx context.Context, db Database, doctype string) bool {
+	return dryRunFor(ctx) == nil &&
+		len(encryptedFieldsFor(doctype)) == 0 &&
+		!logBodies(loggerFor(db), doctype)
+}
+
+// encodeBulkDocs encodes the body of a _bulk_docs request in a pooled buffer
+// if it is small, or returns an encodedBody to stream it if it is larger than
+// the threshold. The size of the documents is checked either way.
+func encodeBulkDocs(ctx context.Context, body *bulkDocsBody) (*requestBody, *encodedBody, error) {
+	limit := maxDocumentSizeFor(ctx)
+	p := encoderPool.Get().(*pooledEncoder)
+	p.buf.Reset()
+	// The pooled encoder of the writer is not the one used for the documents
+	err := body.encode(&thresholdWriter{buf: &p.buf, max: streamBodyThreshold}, limit)
+	if err == nil {
+		return &requestBody{data: p.buf.Bytes(), p: p, refs: 1}, nil, nil
+	}
+	putEncoder(p)
+	if err == errOverThreshold {
+		return nil, &encodedBody{body: body, limit: limit}, nil
+	}
+	return nil, nil, err
+}
+
+// encodedBody is a request body encoded while it is sent, through a pipe.
+// Each attempt of the request encodes it again, so that the request can be
+// retried without keeping a copy of its body.
+type encodedBody struct {
+	body  *bulkDocsBody
+	limit int
+	mu    sync.Mutex
+	err   error
+}
+
+// reader returns a new reader on the body, encoded by another goroutine.
+func (e *encodedBody) reader() io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		err := e.body.encode(writtenCounter{pw}, e.limit)
+		// The transport has closed the body, it is not an encoding error
+		if err != nil && err != io.ErrClosedPipe {
+			e.mu.Lock()
+			e.err = err
+			e.mu.Unlock()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// error returns the error of the encoding, like a document too large, that
+// has interrupted the request.
+func (e *encodedBody) error() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// writtenCounter counts the bytes of a streamed body in the expvar stats.
+type writtenCounter struct {
+	w io.Writer
+}
+
+func (c writtenCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	countWritten(n)
+	return n, err
+}
@@ -0,0 +1,197 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// bulkRecorder is a fake CouchDB that records the _bulk_docs requests. The
+// first requests (as many as failures) fail with a 503.
+type bulkRecorder struct {
+	mu       sync.Mutex
+	failures int
+	bodies   []string
+	lengths  []int64
+}
+
+func (s *bulkRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	s.bodies = append(s.bodies, string(body))
+	s.lengths = append(s.lengths, r.ContentLength)
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	s.mu.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"error":"service_unavailable","reason":"busy"}`))
+		return
+	}
+	var req struct {
+		Docs []map[string]interface{} `json:"docs"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"bad_request","reason":"invalid json"}`))
+		return
+	}
+	res := make([]UpdateResponse, len(req.Docs))
+	for i, doc := range req.Docs {
+		id, _ := doc["_id"].(string)
+		res[i] = UpdateResponse{ID: id, Rev: "1-abc", Ok: true}
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func (s *bulkRecorder) requests() ([]string, []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bodies, s.lengths
+}
+
+func bulkTestDocs(n int, size int) []interface{} {
+	docs := make([]interface{}, n)
+	for i := range docs {
+		docs[i] = &JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+			"_id":   fmt.Sprintf("doc%02d", i),
+			"value": strings.Repeat("x", size),
+		}}
+	}
+	return docs
+}
+
+func useStreamBodyThreshold(threshold int) func() {
+	old := streamBodyThreshold
+	streamBodyThreshold = threshold
+	return func() { streamBodyThreshold = old }
+}
+
+func TestBulkDocsBodyJSON(t *testing.T) {
+	docs := []interface{}{
+		map[string]interface{}{"_id": "a", "n": 1},
+		map[string]interface{}{"_id": "b", "html": "<b>"},
+	}
+	data, err := json.Marshal(newBulkDocsBody(docs))
+	assert.NoError(t, err)
+	expected, _ := json.Marshal(struct {
+		Docs []interface{} `json:"docs"`
+	}{docs})
+	assert.Equal(t, string(expected), string(data))
+
+	data, err = json.Marshal(&bulkDocsBody{noNewEdits: true, n: 0})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"new_edits":false,"docs":[]}`, string(data))
+}
+
+func TestBulkDocsStreamed(t *testing.T) {
+	server := &bulkRecorder{}
+	restore := useTestServer(t, server)
+	defer restore()
+	defer useStreamBodyThreshold(200)()
+
+	// A small body is buffered and sent with its length
+	assert.NoError(t, BulkUpdateDocs(TestPrefix, TestDoctype, bulkTestDocs(1, 10), nil))
+	// A large body is encoded while it is sent
+	docs := bulkTestDocs(20, 50)
+	expected, _ := json.Marshal(newBulkDocsBody(docs))
+	assert.NoError(t, BulkUpdateDocs(TestPrefix, TestDoctype, docs, nil))
+
+	bodies, lengths := server.requests()
+	if assert.Len(t, bodies, 2) {
+		assert.Equal(t, int64(len(bodies[0])), lengths[0])
+		assert.Equal(t, int64(-1), lengths[1])
+		assert.Equal(t, string(expected), bodies[1])
+	}
+	for _, doc := range docs {
+		assert.Equal(t, "1-abc", doc.(Doc).Rev())
+	}
+}
+
+func TestBulkDocsStreamedRetry(t *testing.T) {
+	server := &bulkRecorder{failures: 1}
+	restore := useTestServer(t, server)
+	defer restore()
+	defer useStreamBodyThreshold(200)()
+
+	docs := make([]map[string]interface{}, 20)
+	for i := range docs {
+		docs[i] = map[string]interface{}{"_id": "doc", "_rev": "1-abc", "value": strings.Repeat("x", 50)}
+	}
+	assert.NoError(t, BulkForceUpdateDocs(TestPrefix, TestDoctype, docs))
+
+	// The retry sends the whole body again
+	bodies, _ := server.requests()
+	if assert.Len(t, bodies, 2) {
+		assert.True(t, strings.HasPrefix(bodies[0], `{"new_edits":false,"docs":[`))
+		assert.Equal(t, bodies[0], bodies[1])
+	}
+}
+
+func TestBulkDocsStreamedTooLarge(t *testing.T) {
+	server := &bulkRecorder{}
+	restore := useTestServer(t, server)
+	defer restore()
+	defer useStreamBodyThreshold(200)()
+
+	ctx := WithMaxDocumentSize(context.Background(), 100)
+	docs := bulkTestDocs(20, 10)
+	docs[15] = &JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+		"_id":   "bigdoc",
+		"value": strings.Repeat("x", 200),
+	}}
+	err := BulkUpdateDocsContext(ctx, TestPrefix, TestDoctype, docs, nil)
+	assert.True(t, errors.Is(err, ErrDocumentTooLarge))
+	assert.Contains(t, err.Error(), "bigdoc (#15 of the bulk)")
+	// The request was interrupted before the end of the body
+	bodies, _ := server.requests()
+	for _, body := range bodies {
+		assert.NotContains(t, body, "bigdoc")
+	}
+
+	// A small body is not sent at all
+	err = BulkUpdateDocsContext(ctx, TestPrefix, TestDoctype, docs[14:16], nil)
+	assert.True(t, errors.Is(err, ErrDocumentTooLarge))
+	assert.Contains(t, err.Error(), "bigdoc (#1 of the bulk)")
+	bodies2, _ := server.requests()
+	assert.Equal(t, len(bodies), len(bodies2))
+}
+
+func TestBulkDocsBufferedFallbacks(t *testing.T) {
+	server := &bulkRecorder{}
+	restore := useTestServer(t, server)
+	defer restore()
+	defer useStreamBodyThreshold(200)()
+	defer SetLogger(defaultLogger)
+
+	// The bodies are buffered when they are logged
+	rec := &recordLogger{}
+	SetLogger(func(db Database) Logger { return rec })
+	config.GetConfig().CouchDB.LogBodies = true
+	docs := bulkTestDocs(20, 50)
+	assert.NoError(t, BulkUpdateDocs(TestPrefix, TestDoctype, docs, nil))
+	assert.Contains(t, rec.String(), strings.Repeat("x", 50))
+	_, lengths := server.requests()
+	if assert.Len(t, lengths, 1) {
+		assert.True(t, lengths[0] > 200)
+	}
+	config.GetConfig().CouchDB.LogBodies = false
+
+	// And they are recorded by the dry runs
+	ctx, report := WithDryRun(context.Background())
+	assert.NoError(t, BulkUpdateDocsContext(ctx, TestPrefix, TestDoctype, bulkTestDocs(20, 50), nil))
+	assert.Len(t, report.Operations(), 20)
+	bodies, _ := server.requests()
+	assert.Len(t, bodies, 1)
+}
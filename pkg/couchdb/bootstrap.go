@@ -0,0 +1,103 @@
+package couchdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// createAllDBsConcurrency is the number of doctypes whose database and
+// indexes are created at the same time by CreateAllDBs.
+const createAllDBsConcurrency = 8
+
+// CreateAllDBsError is the error returned by CreateAllDBs when some doctypes
+// have failed. The caller can retry CreateAllDBs with only these doctypes.
+type CreateAllDBsError struct {
+	// Errors are the errors by doctype
+	Errors map[string]error
+}
+
+// Doctypes returns the doctypes that have failed, sorted.
+func (e *CreateAllDBsError) Doctypes() []string {
+	doctypes := make([]string, 0, len(e.Errors))
+	for doctype := range e.Errors {
+		doctypes = append(doctypes, doctype)
+	}
+	sort.Strings(doctypes)
+	return doctypes
+}
+
+func (e *CreateAllDBsError) Error() string {
+	doctypes := e.Doctypes()
+	msgs := make([]string, len(doctypes))
+	for i, doctype := range doctypes {
+		msgs[i] = fmt.Sprintf("%s (%s)", doctype, e.Errors[doctype])
+	}
+	return fmt.Sprintf("CouchDB: cannot create the databases of %d doctypes: %s",
+		len(doctypes), strings.Join(msgs, ", "))
+}
+
+// CreateAllDBs calls CreateAllDBsContext with a background context.
+func CreateAllDBs(db Database, doctypes []string) error {
+	return CreateAllDBsContext(context.Background(), db, doctypes)
+}
+
+// CreateAllDBsContext creates the databases of the doctypes, with their
+// indexes and views (those of the Indexes and Views lists, and the registered
+// ones), for the bootstrap of an instance. The doctypes are handled
+// concurrently, 8 at a time, and a database that already exists is not an
+// error. The failures do not stop the other doctypes: they are returned
+// together in a *CreateAllDBsError. When the context is canceled, the
+// doctypes that have not been started fail with the error of the context.
+func CreateAllDBsContext(ctx context.Context, db Database, doctypes []string) error {
+	var mu sync.Mutex
+	errs := make(map[string]error)
+	fail := func(doctype string, err error) {
+		mu.Lock()
+		errs[doctype] = err
+		mu.Unlock()
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < createAllDBsConcurrency && i < len(doctypes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for doctype := range queue {
+				if err := createDBWithIndexes(ctx, db, doctype); err != nil {
+					fail(doctype, err)
+				}
+			}
+		}()
+	}
+	for i, doctype := range doctypes {
+		select {
+		case queue <- doctype:
+			continue
+		case <-ctx.Done():
+		}
+		for _, skipped := range doctypes[i:] {
+			fail(skipped, ctx.Err())
+		}
+		break
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return &CreateAllDBsError{Errors: errs}
+	}
+	return nil
+}
+
+// createDBWithIndexes creates the database of a doctype, and then its indexes
+// and views, including those registered with RegisterIndexes.
+func createDBWithIndexes(ctx context.Context, db Database, doctype string) error {
+	if err := createDBOnce(withoutIndexes(ctx), db, doctype); err != nil {
+		return err
+	}
+	return defineRequiredIndexes(ctx, db, doctype)
+}
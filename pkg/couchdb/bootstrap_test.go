@@ -0,0 +1,154 @@
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/stretchr/testify/assert"
+)
+
+// bootstrapServer is a fake CouchDB where the databases can be created, with
+// their indexes and views. It fails to create the databases whose name ends
+// with "broken", and the indexes when failIndexes is true.
+type bootstrapServer struct {
+	mu          sync.Mutex
+	dbs         map[string]bool
+	indexes     map[string]int
+	views       map[string]int
+	docs        map[string]int
+	running     int
+	maxRunning  int
+	failIndexes bool
+}
+
+func newBootstrapServer(existing ...string) *bootstrapServer {
+	s := &bootstrapServer{
+		dbs:     make(map[string]bool),
+		indexes: make(map[string]int),
+		views:   make(map[string]int),
+		docs:    make(map[string]int),
+	}
+	for _, doctype := range existing {
+		s.dbs[makeDBName(TestPrefix, doctype)] = true
+	}
+	return s
+}
+
+func (s *bootstrapServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.Trim(r.URL.EscapedPath(), "/"), "/", 2)
+	dbname, _ := url.PathUnescape(parts[0])
+	dbname = url.PathEscape(dbname)
+	if len(parts) == 1 && r.Method == http.MethodPut {
+		s.mu.Lock()
+		s.running++
+		if s.running > s.maxRunning {
+			s.maxRunning = s.running
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.running--
+		switch {
+		case strings.HasSuffix(dbname, "broken"):
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"unknown_error","reason":"eacces"}`))
+		case s.dbs[dbname]:
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = w.Write([]byte(`{"error":"file_exists","reason":"The database could not be created, the file already exists."}`))
+		default:
+			s.dbs[dbname] = true
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"ok":true}`))
+		}
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dbs[dbname] {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"not_found","reason":"Database does not exist."}`))
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		delete(s.dbs, dbname)
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		s.docs[dbname]++
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"ok":true,"id":"doc%d","rev":"1-abc"}`, s.docs[dbname])
+	case r.Method == http.MethodPost && parts[1] == "_index" && s.failIndexes:
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error":"unknown_error","reason":"timeout"}`))
+	case r.Method == http.MethodPost && parts[1] == "_index":
+		s.indexes[dbname]++
+		_, _ = w.Write([]byte(`{"result":"created","id":"_design/idx","name":"idx"}`))
+	case r.Method == http.MethodPut && strings.HasPrefix(parts[1], "_design"):
+		s.views[dbname]++
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"ok":true,"id":"_design/view","rev":"1-abc"}`))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCreateAllDBs(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	doctypes := []string{consts.Files, consts.Sharings}
+	for i := 0; i < 20; i++ {
+		doctypes = append(doctypes, fmt.Sprintf("io.cozy.tests.bootstrap%d", i))
+	}
+	doctypes = append(doctypes, "io.cozy.tests.broken", "io.cozy.tests.also.broken")
+	server := newBootstrapServer("io.cozy.tests.bootstrap3")
+	restore := useTestServer(t, server)
+	defer restore()
+
+	err := CreateAllDBs(TestPrefix, doctypes)
+	var createErr *CreateAllDBsError
+	if assert.True(t, errors.As(err, &createErr)) {
+		assert.Equal(t, []string{"io.cozy.tests.also.broken", "io.cozy.tests.broken"}, createErr.Doctypes())
+		assert.Contains(t, err.Error(), "io.cozy.tests.broken (")
+		assert.True(t, IsInternalServerError(createErr.Errors["io.cozy.tests.broken"]))
+	}
+	for _, doctype := range doctypes[:len(doctypes)-2] {
+		assert.True(t, server.dbs[makeDBName(TestPrefix, doctype)], doctype)
+	}
+	assert.True(t, server.maxRunning > 1)
+	assert.True(t, server.maxRunning <= createAllDBsConcurrency)
+
+	// The registered indexes and views are defined
+	files := makeDBName(TestPrefix, consts.Files)
+	assert.Equal(t, len(IndexesByDoctype(consts.Files)), server.indexes[files])
+	assert.Equal(t, len(ViewsByDoctype(consts.Files)), server.views[files])
+	sharings := makeDBName(TestPrefix, consts.Sharings)
+	assert.Equal(t, len(ViewsByDoctype(consts.Sharings)), server.views[sharings])
+
+	// A retry does not fail on the databases already created
+	assert.NoError(t, CreateAllDBs(TestPrefix, doctypes[:3]))
+}
+
+func TestCreateAllDBsCanceled(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := newBootstrapServer()
+	restore := useTestServer(t, server)
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	doctypes := []string{"io.cozy.tests.a", "io.cozy.tests.b"}
+	err := CreateAllDBsContext(ctx, TestPrefix, doctypes)
+	var createErr *CreateAllDBsError
+	if assert.True(t, errors.As(err, &createErr)) {
+		assert.Equal(t, doctypes, createErr.Doctypes())
+	}
+	assert.Empty(t, server.dbs)
+}
@@ -0,0 +1,209 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// CircuitState is the state of the circuit breaker of a CouchDB node.
+type CircuitState int
+
+const (
+	// CircuitClosed is the normal state: the requests are sent to CouchDB.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen is the state after too many failures: the requests fail
+	// fast with ErrCircuitOpen, without being sent to CouchDB.
+	CircuitOpen
+	// CircuitHalfOpen is the state after the cool-down: a probe request is
+	// sent to CouchDB, and the circuit is closed if it succeeds.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler, for the health endpoints.
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// CircuitBreakerStatus is the current state of the circuit breaker of a
+// CouchDB node.
+type CircuitBreakerStatus struct {
+	Node     string       `json:"node"`
+	State    CircuitState `json:"state"`
+	Failures int          `json:"failures"`
+	OpenedAt *time.Time   `json:"opened_at,omitempty"`
+}
+
+// breaker is the circuit breaker of a CouchDB node. It counts the
+// consecutive failures (connection errors and 5xx responses) within a
+// window, and opens the circuit when the threshold is reached.
+type breaker struct {
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	first    time.Time // the time of the first failure of the window
+	openedAt time.Time
+	probing  bool
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*breaker)
+)
+
+// breakerFor returns the circuit breaker for the CouchDB node of the given
+// request, or nil if the circuit breaker is disabled.
+func breakerFor(req *http.Request) *breaker {
+	if config.GetConfig().CouchDB.CircuitBreaker.Threshold <= 0 {
+		return nil
+	}
+	node := req.URL.Host
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[node]
+	if !ok {
+		b = &breaker{}
+		breakers[node] = b
+	}
+	return b
+}
+
+// allow returns true if a request can be sent to the node. When the
+// cool-down has expired, a single probe request is allowed, and the others
+// still fail fast until the result of the probe is known. The streaming
+// feeds can reconnect as probes even during the cool-down, so that they
+// don't wait longer than needed.
+func (b *breaker) allow(now time.Time, streaming bool) bool {
+	conf := config.GetConfig().CouchDB.CircuitBreaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitClosed:
+		return true
+	case CircuitOpen:
+		if now.Sub(b.openedAt) < conf.CoolDown && !streaming {
+			return false
+		}
+		b.state = CircuitHalfOpen
+	}
+	if b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record updates the breaker with the result of a request.
+func (b *breaker) record(now time.Time, failed bool) {
+	conf := config.GetConfig().CouchDB.CircuitBreaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+	if b.state == CircuitHalfOpen {
+		b.state = CircuitOpen
+		b.openedAt = now
+		return
+	}
+	if b.failures == 0 || (conf.Window > 0 && now.Sub(b.first) > conf.Window) {
+		b.failures = 0
+		b.first = now
+	}
+	b.failures++
+	if b.failures >= conf.Threshold {
+		b.state = CircuitOpen
+		b.openedAt = now
+	}
+}
+
+// isNodeFailure returns true if the response or error of a request means
+// that the CouchDB node is unavailable.
+func isNodeFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		couchErr, isCouchErr := IsCouchError(err)
+		return !isCouchErr || couchErr.StatusCode >= 500
+	}
+	return resp.StatusCode >= 500
+}
+
+// isCircuitOpen returns true if the circuit of the node is open, and its
+// cool-down has not expired yet.
+func isCircuitOpen(node string) bool {
+	breakersMu.Lock()
+	b, ok := breakers[node]
+	breakersMu.Unlock()
+	if !ok {
+		return false
+	}
+	coolDown := config.GetConfig().CouchDB.CircuitBreaker.CoolDown
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == CircuitOpen && time.Since(b.openedAt) < coolDown
+}
+
+// doRequestWithBreaker sends a request to CouchDB, unless the circuit of the
+// node is open. The result is also recorded for picking the next nodes.
+func doRequestWithBreaker(ctx context.Context, db Database, req *http.Request) (*http.Response, error) {
+	b := breakerFor(req)
+	if b != nil && !b.allow(time.Now(), isStreaming(ctx)) {
+		return nil, newCircuitOpenError()
+	}
+	resp, err := doRequest(db, req)
+	if ctx.Err() != nil {
+		// The caller has given up, it says nothing about the node
+		if b != nil {
+			b.mu.Lock()
+			b.probing = false
+			b.mu.Unlock()
+		}
+		return resp, err
+	}
+	recordNode(req.URL.Host, isNodeDown(resp, err))
+	if b != nil {
+		b.record(time.Now(), isNodeFailure(resp, err))
+	}
+	return resp, err
+}
+
+// GetCircuitBreakers returns the state of the circuit breakers of the
+// CouchDB nodes, for the health endpoints.
+func GetCircuitBreakers() []CircuitBreakerStatus {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	statuses := make([]CircuitBreakerStatus, 0, len(breakers))
+	for node, b := range breakers {
+		b.mu.Lock()
+		status := CircuitBreakerStatus{
+			Node:     node,
+			State:    b.state,
+			Failures: b.failures,
+		}
+		if b.state != CircuitClosed {
+			openedAt := b.openedAt
+			status.OpenedAt = &openedAt
+		}
+		b.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Node < statuses[j].Node })
+	return statuses
+}
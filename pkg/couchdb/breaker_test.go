@@ -0,0 +1,91 @@
+package couchdb
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls int32
+	var down int32 = 1
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"db_name":"foo"}`))
+	}))
+	defer restore()
+	config.GetConfig().CouchDB.Retry = config.CouchDBRetry{MaxAttempts: 1}
+	config.GetConfig().CouchDB.CircuitBreaker = config.CouchDBCircuitBreaker{
+		Threshold: 2,
+		Window:    time.Minute,
+		CoolDown:  50 * time.Millisecond,
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := DBStatus(TestPrefix, TestDoctype)
+		assert.Error(t, err)
+		assert.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+	_, err := DBStatus(TestPrefix, TestDoctype)
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+	node := config.CouchURL().Host
+	for _, status := range GetCircuitBreakers() {
+		if status.Node == node {
+			assert.Equal(t, CircuitOpen, status.State)
+		}
+	}
+
+	// After the cool-down, a probe is sent and closes the circuit
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	_, err = DBStatus(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+	_, err = DBStatus(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+}
+
+func TestBreakerStates(t *testing.T) {
+	conf := config.GetConfig().CouchDB.CircuitBreaker
+	defer func() { config.GetConfig().CouchDB.CircuitBreaker = conf }()
+	config.GetConfig().CouchDB.CircuitBreaker = config.CouchDBCircuitBreaker{
+		Threshold: 2,
+		Window:    time.Second,
+		CoolDown:  10 * time.Second,
+	}
+	now := time.Now()
+	b := &breaker{}
+
+	// The failures outside of the window are not consecutive
+	b.record(now, true)
+	b.record(now.Add(2*time.Second), true)
+	assert.Equal(t, CircuitClosed, b.state)
+	b.record(now.Add(2500*time.Millisecond), true)
+	assert.Equal(t, CircuitOpen, b.state)
+	now = now.Add(2500 * time.Millisecond)
+
+	// Fail fast during the cool-down, except for the streaming feeds
+	assert.False(t, b.allow(now.Add(time.Second), false))
+	assert.True(t, b.allow(now.Add(time.Second), true))
+	assert.Equal(t, CircuitHalfOpen, b.state)
+
+	// Only one probe at a time, and a failed probe opens the circuit again
+	assert.False(t, b.allow(now.Add(11*time.Second), false))
+	b.record(now.Add(11*time.Second), true)
+	assert.Equal(t, CircuitOpen, b.state)
+	assert.True(t, b.allow(now.Add(22*time.Second), false))
+	b.record(now.Add(22*time.Second), false)
+	assert.Equal(t, CircuitClosed, b.state)
+	assert.True(t, b.allow(now.Add(22*time.Second), false))
+}
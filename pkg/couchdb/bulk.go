@@ -1,9 +1,9 @@
 package couchdb
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
@@ -49,20 +49,41 @@ type BulkGetResponse struct {
 	} `json:"results"`
 }
 
-// CountAllDocs returns the number of documents of the given doctype.
+// CountAllDocs calls CountAllDocsContext with a background context. It is kept
+// for compatibility, new code should use CountAllDocsContext.
+//
+// Deprecated: use CountAllDocsContext.
 func CountAllDocs(db Database, doctype string) (int, error) {
+	return CountAllDocsContext(context.Background(), db, doctype)
+}
+
+// CountAllDocsContext returns the number of documents of the given doctype.
+func CountAllDocsContext(ctx context.Context, db Database, doctype string) (int, error) {
 	var response AllDocsResponse
 	url := "_all_docs?limit=0"
-	err := makeRequest(db, doctype, http.MethodGet, url, nil, &response)
+	err := makeRequest(ctx, db, doctype, http.MethodGet, url, nil, &response)
 	if err != nil {
 		return 0, err
 	}
 	return response.TotalRows, nil
 }
 
-// GetAllDocs returns all documents of a specified doctype. It filters
-// out the possible _design document.
+// GetAllDocs calls GetAllDocsContext with a background context. It is kept for
+// compatibility, new code should use GetAllDocsContext.
+//
+// Deprecated: use GetAllDocsContext.
 func GetAllDocs(db Database, doctype string, req *AllDocsRequest, results interface{}) (err error) {
+	return GetAllDocsContext(context.Background(), db, doctype, req, results)
+}
+
+// GetAllDocsContext returns all documents of a specified doctype. It filters
+// out the possible _design document.
+func GetAllDocsContext(ctx context.Context, db Database, doctype string, req *AllDocsRequest, results interface{}) (err error) {
+	return defaultClient.GetAllDocs(ctx, db, doctype, req, results)
+}
+
+// GetAllDocs is part of the Client interface.
+func (couchClient) GetAllDocs(ctx context.Context, db Database, doctype string, req *AllDocsRequest, results interface{}) (err error) {
 	var v url.Values
 	if req != nil {
 		v, err = req.Values()
@@ -76,7 +97,7 @@ func GetAllDocs(db Database, doctype string, req *AllDocsRequest, results interf
 	var response AllDocsResponse
 	if req == nil || len(req.Keys) == 0 {
 		url := "_all_docs?" + v.Encode()
-		err = makeRequest(db, doctype, http.MethodGet, url, nil, &response)
+		err = makeRequest(ctx, db, doctype, http.MethodGet, url, nil, &response)
 	} else {
 		v.Del("keys")
 		url := "_all_docs?" + v.Encode()
@@ -85,36 +106,66 @@ func GetAllDocs(db Database, doctype string, req *AllDocsRequest, results interf
 		}{
 			Keys: req.Keys,
 		}
-		err = makeRequest(db, doctype, http.MethodPost, url, body, &response)
+		err = makeRequest(ctx, db, doctype, http.MethodPost, url, body, &response)
 	}
 	if err != nil {
 		return err
 	}
 
-	var docs []json.RawMessage
+	docs := make([]json.RawMessage, 0, len(response.Rows))
 	for _, row := range response.Rows {
-		if !strings.HasPrefix(row.ID, "_design") {
-			docs = append(docs, row.Doc)
+		// The rows of the missing or deleted keys have no document
+		if strings.HasPrefix(row.ID, "_design") || len(row.Doc) == 0 || string(row.Doc) == "null" {
+			continue
 		}
+		docs = append(docs, row.Doc)
 	}
 	data, err := json.Marshal(docs)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data, results)
+	return decodeDocs(ctx, doctype, data, results)
 }
 
-// ForeachDocs traverse all the documents from the given database with the
-// specified doctype and calls a function for each document.
+// ForeachDocs calls ForeachDocsContext with a background context. It is kept
+// for compatibility, new code should use ForeachDocsContext.
+//
+// Deprecated: use ForeachDocsContext.
 func ForeachDocs(db Database, doctype string, fn func(id string, doc json.RawMessage) error) error {
-	return ForeachDocsWithCustomPagination(db, doctype, 100, fn)
+	return ForeachDocsContext(context.Background(), db, doctype, fn)
 }
 
-// ForeachDocsWithCustomPagination traverse all the documents from the given
+// ForeachDocsContext traverse all the documents from the given database with the
+// specified doctype and calls a function for each document.
+func ForeachDocsContext(ctx context.Context, db Database, doctype string, fn func(id string, doc json.RawMessage) error) error {
+	return ForeachDocsWithCustomPaginationContext(ctx, db, doctype, 100, fn)
+}
+
+// ForeachDocsWithCustomPagination calls ForeachDocsWithCustomPaginationContext
+// with a background context. It is kept for compatibility, new code should use
+// ForeachDocsWithCustomPaginationContext.
+//
+// Deprecated: use ForeachDocsWithCustomPaginationContext.
+func ForeachDocsWithCustomPagination(db Database, doctype string, limit int, fn func(id string, doc json.RawMessage) error) error {
+	return ForeachDocsWithCustomPaginationContext(context.Background(), db, doctype, limit, fn)
+}
+
+// ForeachDocsWithCustomPaginationContext traverse all the documents from the given
 // database, and calls a function for each document. The documents are fetched
 // from CouchDB with a pagination with a custom number of items per page.
-func ForeachDocsWithCustomPagination(db Database, doctype string, limit int, fn func(id string, doc json.RawMessage) error) error {
-	var startKey string
+func ForeachDocsWithCustomPaginationContext(ctx context.Context, db Database, doctype string, limit int, fn func(id string, doc json.RawMessage) error) error {
+	return foreachDocsAfter(ctx, db, doctype, limit, "", fn)
+}
+
+// foreachDocsAfter is like ForeachDocsWithCustomPaginationContext, but it
+// starts after the document with the given id, if any.
+func foreachDocsAfter(ctx context.Context, db Database, doctype string, limit int, startKey string, fn func(id string, doc json.RawMessage) error) error {
+	return foreachDocsWithParams(ctx, db, doctype, limit, startKey, nil, fn)
+}
+
+// foreachDocsWithParams is like foreachDocsAfter, with more parameters for
+// the _all_docs requests, like conflicts=true.
+func foreachDocsWithParams(ctx context.Context, db Database, doctype string, limit int, startKey string, params url.Values, fn func(id string, doc json.RawMessage) error) error {
 	for {
 		skip := 0
 		if startKey != "" {
@@ -130,24 +181,34 @@ func ForeachDocsWithCustomPagination(db Database, doctype string, limit int, fn
 			return err
 		}
 		v.Add("include_docs", "true")
-
-		var res AllDocsResponse
-		url := "_all_docs?" + v.Encode()
-		err = makeRequest(db, doctype, http.MethodGet, url, nil, &res)
-		if err != nil {
-			return err
+		for key, values := range params {
+			v[key] = values
 		}
 
+		// The rows are streamed, to avoid keeping the whole page in memory
+		count := 0
 		startKey = ""
-		for _, row := range res.Rows {
-			if !strings.HasPrefix(row.ID, "_design") {
-				if err = fn(row.ID, row.Doc); err != nil {
-					return err
-				}
+		stream := newRowStream("rows", func(item json.RawMessage) error {
+			var row struct {
+				ID  string          `json:"id"`
+				Doc json.RawMessage `json:"doc"`
 			}
+			if err := json.Unmarshal(item, &row); err != nil {
+				return err
+			}
+			count++
 			startKey = row.ID
+			if strings.HasPrefix(row.ID, "_design") {
+				return nil
+			}
+			return fn(row.ID, row.Doc)
+		})
+		url := "_all_docs?" + v.Encode()
+		err = makeRequest(ctx, db, doctype, http.MethodGet, url, nil, stream)
+		if err != nil {
+			return err
 		}
-		if len(res.Rows) < limit {
+		if count < limit {
 			break
 		}
 	}
@@ -155,8 +216,16 @@ func ForeachDocsWithCustomPagination(db Database, doctype string, limit int, fn
 	return nil
 }
 
-// BulkGetDocs returns the documents with the given id at the given revision
+// BulkGetDocs calls BulkGetDocsContext with a background context. It is kept
+// for compatibility, new code should use BulkGetDocsContext.
+//
+// Deprecated: use BulkGetDocsContext.
 func BulkGetDocs(db Database, doctype string, payload []IDRev) ([]map[string]interface{}, error) {
+	return BulkGetDocsContext(context.Background(), db, doctype, payload)
+}
+
+// BulkGetDocsContext returns the documents with the given id at the given revision
+func BulkGetDocsContext(ctx context.Context, db Database, doctype string, payload []IDRev) ([]map[string]interface{}, error) {
 	path := "_bulk_get?revs=true"
 	body := struct {
 		Docs []IDRev `json:"docs"`
@@ -164,7 +233,7 @@ func BulkGetDocs(db Database, doctype string, payload []IDRev) ([]map[string]int
 		Docs: payload,
 	}
 	var response BulkGetResponse
-	err := makeRequest(db, doctype, http.MethodPost, path, body, &response)
+	err := makeRequest(ctx, db, doctype, http.MethodPost, path, body, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -179,19 +248,48 @@ func BulkGetDocs(db Database, doctype string, payload []IDRev) ([]map[string]int
 	return results, nil
 }
 
-// BulkUpdateDocs is used to update several docs in one call, as a bulk.
-// olddocs parameter is used for realtime / event triggers.
+// BulkUpdateDocs calls BulkUpdateDocsContext with a background context. It is
+// kept for compatibility, new code should use BulkUpdateDocsContext.
+//
+// Deprecated: use BulkUpdateDocsContext.
 func BulkUpdateDocs(db Database, doctype string, docs, olddocs []interface{}) error {
+	return BulkUpdateDocsContext(context.Background(), db, doctype, docs, olddocs)
+}
+
+// BulkUpdateDocsContext is used to update several docs in one call, as a bulk.
+// olddocs parameter is used for realtime / event triggers.
+func BulkUpdateDocsContext(ctx context.Context, db Database, doctype string, docs, olddocs []interface{}) error {
 	if len(docs) == 0 {
 		return nil
 	}
-	body := struct {
-		Docs []interface{} `json:"docs"`
-	}{
-		Docs: docs,
+	err := checkBulk(len(docs), func(i int) error {
+		if d, ok := docs[i].(Doc); ok {
+			return checkDoc(d)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if d, ok := doc.(Doc); ok && d.ID() != "" {
+			if err := ValidateDocID(d.ID()); err != nil {
+				return err
+			}
+		}
+	}
+	for _, doc := range docs {
+		if d, ok := doc.(Doc); ok {
+			if d.ID() == "" && d.Rev() == "" {
+				if err := setGeneratedID(d); err != nil {
+					return err
+				}
+			}
+			stampDoc(ctx, d, d.Rev() == "")
+		}
 	}
 	var res []UpdateResponse
-	if err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
+	if err := makeRequest(ctx, db, doctype, http.MethodPost, "_bulk_docs", newBulkDocsBody(docs), &res); err != nil {
 		return err
 	}
 	if len(res) != len(docs) {
@@ -205,58 +303,103 @@ func BulkUpdateDocs(db Database, doctype string, docs, olddocs []interface{}) er
 				d.SetID(res[i].ID)
 			}
 			d.SetRev(res[i].Rev)
-			if old, ok := olddocs[i].(Doc); ok {
-				RTEvent(db, realtime.EventUpdate, d, old)
+			var old Doc
+			if i < len(olddocs) {
+				old, _ = olddocs[i].(Doc)
+			}
+			if old != nil {
+				rtEvent(ctx, db, realtime.EventUpdate, d, old)
 			} else {
-				RTEvent(db, event, d, nil)
+				rtEvent(ctx, db, event, d, nil)
 			}
 		}
 	}
 	return nil
 }
 
-// BulkDeleteDocs is used to delete serveral documents in one call.
+// BulkDeleteDocs calls BulkDeleteDocsContext with a background context. It is
+// kept for compatibility, new code should use BulkDeleteDocsContext.
+//
+// Deprecated: use BulkDeleteDocsContext.
 func BulkDeleteDocs(db Database, doctype string, docs []Doc) error {
+	return BulkDeleteDocsContext(context.Background(), db, doctype, docs)
+}
+
+// BulkDeleteDocsContext is used to delete serveral documents in one call.
+func BulkDeleteDocsContext(ctx context.Context, db Database, doctype string, docs []Doc) error {
 	if len(docs) == 0 {
 		return nil
 	}
-	body := struct {
-		Docs []json.RawMessage `json:"docs"`
-	}{
-		Docs: make([]json.RawMessage, 0, len(docs)),
+	type deletion struct {
+		ID      string `json:"_id"`
+		Rev     string `json:"_rev"`
+		Deleted bool   `json:"_deleted"`
+	}
+	deletions := make([]deletion, 0, len(docs))
+	err := checkBulk(len(docs), func(i int) error {
+		return checkDoc(docs[i])
+	})
+	if err != nil {
+		return err
 	}
 	for _, doc := range docs {
-		body.Docs = append(body.Docs, json.RawMessage(
-			fmt.Sprintf(`{"_id":"%s","_rev":"%s","_deleted":true}`, doc.ID(), doc.Rev()),
-		))
+		if err := ValidateDocID(doc.ID()); err != nil {
+			return err
+		}
+	}
+	if isArchived(doctype) {
+		for _, doc := range docs {
+			if err := archiveDoc(ctx, db, doc); err != nil {
+				return err
+			}
+		}
+	}
+	for _, doc := range docs {
+		deletions = append(deletions, deletion{ID: doc.ID(), Rev: doc.Rev(), Deleted: true})
+	}
+	body := &bulkDocsBody{
+		n:   len(deletions),
+		doc: func(i int) interface{} { return deletions[i] },
 	}
 	var res []UpdateResponse
-	if err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
+	if err := makeRequest(ctx, db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
 		return err
 	}
+	if len(res) != len(docs) {
+		return errors.New("BulkDeleteDocs receive an unexpected number of responses")
+	}
 	for i, doc := range docs {
-		if d, ok := doc.(Doc); ok {
-			d.SetRev(res[i].Rev)
-			RTEvent(db, realtime.EventDelete, d, nil)
-		}
+		doc.SetRev(res[i].Rev)
+		rtEvent(ctx, db, realtime.EventDelete, doc, nil)
 	}
 	return nil
 }
 
-// BulkForceUpdateDocs is used to update several docs in one call, and to force
-// the revisions history. It is used by replications.
+// BulkForceUpdateDocs calls BulkForceUpdateDocsContext with a background
+// context. It is kept for compatibility, new code should use
+// BulkForceUpdateDocsContext.
+//
+// Deprecated: use BulkForceUpdateDocsContext.
 func BulkForceUpdateDocs(db Database, doctype string, docs []map[string]interface{}) error {
+	return BulkForceUpdateDocsContext(context.Background(), db, doctype, docs)
+}
+
+// BulkForceUpdateDocsContext is used to update several docs in one call, and to force
+// the revisions history. It is used by replications.
+func BulkForceUpdateDocsContext(ctx context.Context, db Database, doctype string, docs []map[string]interface{}) error {
 	if len(docs) == 0 {
 		return nil
 	}
-	body := struct {
-		NewEdits bool                     `json:"new_edits"`
-		Docs     []map[string]interface{} `json:"docs"`
-	}{
-		NewEdits: false,
-		Docs:     docs,
+	body := &bulkDocsBody{
+		noNewEdits: true,
+		n:          len(docs),
+		doc:        func(i int) interface{} { return docs[i] },
+	}
+	// Forcing the revisions can be replayed safely
+	if _, ok := retryPolicyFor(ctx); !ok {
+		ctx = WithRetryPolicy(ctx, RetryAlways)
 	}
 	// XXX CouchDB returns just an empty array when new_edits is false, so we
 	// ignore the response
-	return makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, nil)
+	return makeRequest(ctx, db, doctype, http.MethodPost, "_bulk_docs", body, nil)
 }
@@ -0,0 +1,376 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+const (
+	// defaultImportMaxDocs is the default number of documents in a chunk of
+	// BulkImport.
+	defaultImportMaxDocs = 1000
+	// defaultImportMaxBytes is the default size of the body of a chunk of
+	// BulkImport.
+	defaultImportMaxBytes = 8 << 20
+)
+
+// errImportAborted stops the encoding of a chunk when its request has ended.
+var errImportAborted = errors.New("CouchDB: import aborted")
+
+// DocSource gives the documents of BulkImport, one at a time. It returns
+// io.EOF when there are no more documents. The documents can be of any type
+// that can be marshaled to JSON, and the Doc have their ID and revision set
+// when they are written. It is never called concurrently, but it can be
+// called from another goroutine than the one of BulkImport.
+type DocSource func() (interface{}, error)
+
+// SliceSource returns a DocSource for the documents of a slice.
+func SliceSource(docs []interface{}) DocSource {
+	i := 0
+	return func() (interface{}, error) {
+		if i >= len(docs) {
+			return nil, io.EOF
+		}
+		i++
+		return docs[i-1], nil
+	}
+}
+
+// ChanSource returns a DocSource for the documents sent on a channel, until
+// it is closed.
+func ChanSource(ch <-chan interface{}) DocSource {
+	return func() (interface{}, error) {
+		doc, ok := <-ch
+		if !ok {
+			return nil, io.EOF
+		}
+		return doc, nil
+	}
+}
+
+// BulkImportOptions are the options of BulkImport. The zero value uses the
+// default limits, and has no progress callback.
+type BulkImportOptions struct {
+	// MaxDocs is the maximal number of documents in a chunk (1000 by default)
+	MaxDocs int
+	// MaxBytes is the maximal size of the body of a chunk (8MB by default). A
+	// document larger than that is sent alone.
+	MaxBytes int
+	// Progress is called after each chunk
+	Progress func(BulkImportProgress)
+}
+
+// BulkImportProgress tells how far an import is.
+type BulkImportProgress struct {
+	Chunks  int
+	Written int
+	Bytes   int64
+}
+
+// BulkImportRowError is the error of a document that has not been written,
+// with its index in the source.
+type BulkImportRowError struct {
+	Index int
+	ID    string
+	Err   error
+}
+
+// BulkImportResult is the result of BulkImport: the documents read from the
+// source, the documents written, the size of the bodies sent, and the errors
+// of the documents that have not been written.
+type BulkImportResult struct {
+	BulkImportProgress
+	Docs   int
+	Errors []BulkImportRowError
+}
+
+// BulkImportError is returned by BulkImport when a chunk has failed: the
+// documents before First have been imported, and the documents from First to
+// Last (included) may or may not have been written.
+type BulkImportError struct {
+	Chunk int
+	First int
+	Last  int
+	Err   error
+}
+
+func (e *BulkImportError) Error() string {
+	return fmt.Sprintf("CouchDB: chunk %d of the import has failed, documents %d to %d are in doubt: %s",
+		e.Chunk, e.First, e.Last, e.Err)
+}
+
+func (e *BulkImportError) Unwrap() error {
+	return e.Err
+}
+
+// sourceError is an error of the DocSource, while a chunk is encoded.
+type sourceError struct {
+	err error
+}
+
+func (e *sourceError) Error() string { return e.err.Error() }
+
+// streamedBody is a request body for makeRequest that is encoded while it is
+// sent, instead of being marshaled before.
+type streamedBody struct {
+	r io.ReadCloser
+}
+
+// importItem is a document of an import, encoded to JSON.
+type importItem struct {
+	index int
+	doc   Doc
+	data  []byte
+}
+
+type importer struct {
+	ctx      context.Context
+	doctype  string
+	source   DocSource
+	maxDocs  int
+	maxBytes int
+	res      *BulkImportResult
+	pending  *importItem
+	eof      bool
+}
+
+// BulkImport calls BulkImportContext with a background context.
+func BulkImport(db Database, doctype string, source DocSource, opts *BulkImportOptions) (*BulkImportResult, error) {
+	return BulkImportContext(context.Background(), db, doctype, source, opts)
+}
+
+// BulkImportContext writes the documents of the source with _bulk_docs, in
+// chunks bounded by a number of documents and a size. The documents are read
+// from the source only when their chunk is sent, and a chunk is encoded while
+// it is sent, so that an import of hundreds of thousands of documents is
+// never kept in memory. The documents that are not valid, or that CouchDB has
+// rejected, like the conflicts, are in the errors of the result, and the
+// import goes on. If a chunk fails, the import stops with a *BulkImportError
+// that tells which documents are in doubt. The result is returned even with
+// an error.
+func BulkImportContext(ctx context.Context, db Database, doctype string, source DocSource, opts *BulkImportOptions) (*BulkImportResult, error) {
+	if opts == nil {
+		opts = &BulkImportOptions{}
+	}
+	imp := &importer{
+		ctx:      ctx,
+		doctype:  doctype,
+		source:   source,
+		maxDocs:  opts.MaxDocs,
+		maxBytes: opts.MaxBytes,
+		res:      &BulkImportResult{},
+	}
+	if imp.maxDocs <= 0 {
+		imp.maxDocs = defaultImportMaxDocs
+	}
+	if imp.maxBytes <= 0 {
+		imp.maxBytes = defaultImportMaxBytes
+	}
+	for {
+		if err := imp.fill(); err != nil {
+			return imp.res, err
+		}
+		if imp.pending == nil {
+			return imp.res, nil
+		}
+		if err := imp.sendChunk(db); err != nil {
+			return imp.res, err
+		}
+		if opts.Progress != nil {
+			opts.Progress(imp.res.BulkImportProgress)
+		}
+	}
+}
+
+// fill reads the source until it has a document to send, or until the end.
+func (imp *importer) fill() error {
+	for imp.pending == nil && !imp.eof {
+		item, err := imp.next()
+		if err != nil {
+			return err
+		}
+		imp.pending = item
+	}
+	return nil
+}
+
+// next reads a document from the source and encodes it. The invalid
+// documents are added to the errors of the result and skipped. It returns
+// nil at the end of the source.
+func (imp *importer) next() (*importItem, error) {
+	for {
+		v, err := imp.source()
+		if err == io.EOF {
+			imp.eof = true
+			return nil, nil
+		}
+		if err != nil {
+			return nil, &sourceError{err}
+		}
+		item := &importItem{index: imp.res.Docs}
+		imp.res.Docs++
+		if err := imp.encode(item, v); err != nil {
+			var id string
+			if item.doc != nil {
+				id = item.doc.ID()
+			}
+			imp.addError(item.index, id, err)
+			continue
+		}
+		return item, nil
+	}
+}
+
+func (imp *importer) encode(item *importItem, v interface{}) error {
+	if d, ok := v.(Doc); ok {
+		item.doc = d
+		if err := checkDoc(d); err != nil {
+			return err
+		}
+		if d.ID() != "" {
+			if err := ValidateDocID(d.ID()); err != nil {
+				return err
+			}
+		} else if d.Rev() == "" {
+			if err := setGeneratedID(d); err != nil {
+				return err
+			}
+		}
+		stampDoc(imp.ctx, d, d.Rev() == "")
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if data, err = encryptRequest(imp.doctype, http.MethodPost, "", data); err != nil {
+		return err
+	}
+	if limit := maxDocumentSizeFor(imp.ctx); limit > 0 && len(data) > limit {
+		return newDocumentTooLargeError(data, item.index, limit)
+	}
+	item.data = data
+	return nil
+}
+
+func (imp *importer) addError(index int, id string, err error) {
+	imp.res.Errors = append(imp.res.Errors, BulkImportRowError{Index: index, ID: id, Err: err})
+}
+
+// writeChunk encodes the body of a chunk on w, starting with the pending
+// document, and reading the next ones from the source while the chunk is not
+// full. The documents written on w are added to items.
+func (imp *importer) writeChunk(w io.Writer, items *[]*importItem) (int, error) {
+	n, err := io.WriteString(w, `{"docs":[`)
+	if err != nil {
+		return n, err
+	}
+	for imp.pending != nil {
+		item := imp.pending
+		if len(*items) > 0 && (len(*items) >= imp.maxDocs || n+len(item.data)+3 > imp.maxBytes) {
+			break
+		}
+		if len(*items) > 0 {
+			written, err := io.WriteString(w, ",")
+			n += written
+			if err != nil {
+				return n, err
+			}
+		}
+		written, err := w.Write(item.data)
+		n += written
+		*items = append(*items, item)
+		// The JSON is no longer needed once it has been sent
+		item.data = nil
+		imp.pending = nil
+		if err != nil {
+			return n, err
+		}
+		if len(*items) < imp.maxDocs {
+			if imp.pending, err = imp.next(); err != nil {
+				return n, err
+			}
+		}
+	}
+	written, err := io.WriteString(w, `]}`)
+	return n + written, err
+}
+
+// sendChunk sends a chunk with _bulk_docs, while it is encoded by another
+// goroutine, and adds the rows of the response to the result.
+func (imp *importer) sendChunk(db Database) error {
+	chunk := imp.res.Chunks
+	first := imp.pending.index
+	var items []*importItem
+	var size int
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		n, err := imp.writeChunk(pw, &items)
+		size = n
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	var rows []UpdateResponse
+	err := makeRequest(imp.ctx, db, imp.doctype, http.MethodPost, "_bulk_docs", &streamedBody{r: pr}, &rows)
+	// The encoding stops if the request has ended before reading the body
+	pr.CloseWithError(errImportAborted)
+	writeErr := <-done
+
+	imp.res.Chunks++
+	imp.res.Bytes += int64(size)
+	countWritten(size)
+	last := first
+	if len(items) > 0 {
+		last = items[len(items)-1].index
+	}
+	if srcErr, ok := writeErr.(*sourceError); ok {
+		err = srcErr.err
+	} else if err == nil && writeErr != nil {
+		err = writeErr
+	}
+	if err == nil && len(rows) != len(items) {
+		err = fmt.Errorf("unexpected number of rows: %d for %d documents", len(rows), len(items))
+	}
+	if err != nil {
+		return &BulkImportError{Chunk: chunk, First: first, Last: last, Err: err}
+	}
+
+	for i, row := range rows {
+		item := items[i]
+		if row.Error != "" {
+			imp.addError(item.index, row.ID, newBulkRowError(row))
+			continue
+		}
+		imp.res.Written++
+		if d := item.doc; d != nil {
+			event := realtime.EventUpdate
+			if d.Rev() == "" {
+				event = realtime.EventCreate
+				d.SetID(row.ID)
+			}
+			d.SetRev(row.Rev)
+			rtEvent(imp.ctx, db, event, d, nil)
+		}
+	}
+	return nil
+}
+
+// newBulkRowError returns the error of a row of a _bulk_docs response.
+func newBulkRowError(row UpdateResponse) error {
+	status := http.StatusBadRequest
+	switch row.Error {
+	case "conflict":
+		status = http.StatusConflict
+	case "forbidden":
+		status = http.StatusForbidden
+	case "unauthorized":
+		status = http.StatusUnauthorized
+	}
+	return &Error{StatusCode: status, Name: row.Error, Reason: row.Reason}
+}
@@ -0,0 +1,245 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bulkServer answers to _bulk_docs, with a conflict for the documents with
+// the conflict ID, and keeps the bodies that it has received.
+type bulkServer struct {
+	mu     sync.Mutex
+	bodies [][]byte
+	counts []int
+	fail   int
+	onBulk func()
+}
+
+func (s *bulkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/_bulk_docs") {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.bodies = append(s.bodies, data)
+	n := len(s.bodies)
+	s.mu.Unlock()
+	if s.onBulk != nil {
+		s.onBulk()
+	}
+	if n == s.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error":"unknown_error","reason":"function_clause"}`))
+		return
+	}
+	var body struct {
+		Docs []map[string]interface{} `json:"docs"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.counts = append(s.counts, len(body.Docs))
+	s.mu.Unlock()
+	rows := make([]map[string]interface{}, len(body.Docs))
+	for i, doc := range body.Docs {
+		id, _ := doc["_id"].(string)
+		if id == "conflict" {
+			rows[i] = map[string]interface{}{"id": id, "error": "conflict", "reason": "Document update conflict."}
+		} else {
+			rows[i] = map[string]interface{}{"ok": true, "id": id, "rev": "1-abc"}
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(rows)
+}
+
+func importDocs(n int) []interface{} {
+	docs := make([]interface{}, n)
+	for i := range docs {
+		docs[i] = &testDoc{TestID: fmt.Sprintf("doc%03d", i), Test: "imported"}
+	}
+	return docs
+}
+
+func TestBulkImportChunks(t *testing.T) {
+	server := &bulkServer{}
+	restore := useTestServer(t, server)
+	defer restore()
+
+	docs := importDocs(25)
+	docs[3] = &testDoc{TestID: "_bad"}
+	docs[12] = &testDoc{TestID: "conflict"}
+	var progress []BulkImportProgress
+	res, err := BulkImport(TestPrefix, TestDoctype, SliceSource(docs), &BulkImportOptions{
+		MaxDocs:  10,
+		Progress: func(p BulkImportProgress) { progress = append(progress, p) },
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{10, 10, 4}, server.counts)
+	assert.Equal(t, 25, res.Docs)
+	assert.Equal(t, 23, res.Written)
+	assert.Equal(t, 3, res.Chunks)
+	if assert.Len(t, res.Errors, 2) {
+		assert.Equal(t, 3, res.Errors[0].Index)
+		assert.True(t, errors.Is(res.Errors[0].Err, ErrBadDocID))
+		assert.Equal(t, 12, res.Errors[1].Index)
+		assert.Equal(t, "conflict", res.Errors[1].ID)
+		assert.True(t, IsConflictError(res.Errors[1].Err))
+	}
+	var size int64
+	for _, body := range server.bodies {
+		size += int64(len(body))
+	}
+	assert.Equal(t, size, res.Bytes)
+	if assert.Len(t, progress, 3) {
+		assert.Equal(t, 10, progress[0].Written)
+		assert.Equal(t, 19, progress[1].Written)
+		assert.Equal(t, res.BulkImportProgress, progress[2])
+	}
+	assert.Equal(t, "1-abc", docs[0].(*testDoc).Rev())
+	assert.Equal(t, "", docs[12].(*testDoc).Rev())
+
+	// The chunks are bounded by their size too
+	server.bodies, server.counts = nil, nil
+	maxBytes := 200
+	res, err = BulkImport(TestPrefix, TestDoctype, SliceSource(importDocs(25)), &BulkImportOptions{MaxBytes: maxBytes})
+	assert.NoError(t, err)
+	assert.Equal(t, 25, res.Written)
+	assert.True(t, len(server.bodies) > 1)
+	for _, body := range server.bodies {
+		assert.True(t, len(body) <= maxBytes, "%d bytes", len(body))
+		assert.True(t, json.Valid(body))
+	}
+
+	// A document larger than the limit is sent alone
+	server.bodies, server.counts = nil, nil
+	big := &testDoc{TestID: "big", Test: strings.Repeat("x", 2*maxBytes)}
+	res, err = BulkImport(TestPrefix, TestDoctype, SliceSource([]interface{}{big, docs[1]}), &BulkImportOptions{MaxBytes: maxBytes})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Written)
+	assert.Equal(t, []int{1, 1}, server.counts)
+}
+
+func TestBulkImportIsLazy(t *testing.T) {
+	var mu sync.Mutex
+	read := 0
+	var readAtBulk []int
+	server := &bulkServer{onBulk: func() {
+		mu.Lock()
+		readAtBulk = append(readAtBulk, read)
+		mu.Unlock()
+	}}
+	restore := useTestServer(t, server)
+	defer restore()
+
+	ch := make(chan interface{})
+	go func() {
+		for _, doc := range importDocs(30) {
+			ch <- doc
+		}
+		close(ch)
+	}()
+	source := ChanSource(ch)
+	counting := func() (interface{}, error) {
+		doc, err := source()
+		if err == nil {
+			mu.Lock()
+			read++
+			mu.Unlock()
+		}
+		return doc, err
+	}
+	res, err := BulkImport(TestPrefix, TestDoctype, counting, &BulkImportOptions{MaxDocs: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 30, res.Written)
+	assert.Equal(t, []int{10, 20, 30}, readAtBulk)
+}
+
+func TestBulkImportFailures(t *testing.T) {
+	server := &bulkServer{fail: 2}
+	restore := useTestServer(t, server)
+	defer restore()
+
+	// A chunk rejected by CouchDB
+	res, err := BulkImport(TestPrefix, TestDoctype, SliceSource(importDocs(25)), &BulkImportOptions{MaxDocs: 10})
+	var importErr *BulkImportError
+	if assert.True(t, errors.As(err, &importErr)) {
+		assert.Equal(t, 1, importErr.Chunk)
+		assert.Equal(t, 10, importErr.First)
+		assert.Equal(t, 19, importErr.Last)
+		assert.Contains(t, err.Error(), "documents 10 to 19 are in doubt")
+		couchErr, ok := IsCouchError(err)
+		if assert.True(t, ok) {
+			assert.Equal(t, "unknown_error", couchErr.Name)
+		}
+	}
+	assert.Equal(t, 10, res.Written)
+	assert.Equal(t, 20, res.Docs)
+
+	// An error of the source in the middle of a chunk
+	server.bodies, server.fail = nil, 0
+	errSource := errors.New("cannot read the archive")
+	docs := importDocs(25)
+	i := 0
+	source := func() (interface{}, error) {
+		if i == 15 {
+			return nil, errSource
+		}
+		i++
+		return docs[i-1], nil
+	}
+	res, err = BulkImport(TestPrefix, TestDoctype, source, &BulkImportOptions{MaxDocs: 10})
+	if assert.True(t, errors.As(err, &importErr)) {
+		assert.Equal(t, 1, importErr.Chunk)
+		assert.Equal(t, 10, importErr.First)
+		assert.Equal(t, 14, importErr.Last)
+		assert.True(t, errors.Is(err, errSource))
+	}
+	assert.Equal(t, 10, res.Written)
+	assert.Equal(t, 15, i)
+	assert.Len(t, server.bodies, 1)
+}
+
+func TestBulkImportDryRun(t *testing.T) {
+	server := &bulkServer{}
+	restore := useTestServer(t, server)
+	defer restore()
+
+	ctx, report := WithDryRun(context.Background())
+	docs := importDocs(5)
+	res, err := BulkImportContext(ctx, TestPrefix, TestDoctype, SliceSource(docs), &BulkImportOptions{MaxDocs: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, res.Written)
+	assert.Equal(t, 3, res.Chunks)
+	assert.Empty(t, server.bodies)
+	assert.Len(t, report.Operations(), 5)
+	assert.True(t, strings.HasPrefix(docs[4].(*testDoc).Rev(), "1-"))
+}
+
+func TestSliceSource(t *testing.T) {
+	source := SliceSource([]interface{}{"a", "b"})
+	for _, expected := range []string{"a", "b"} {
+		v, err := source()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, v)
+	}
+	_, err := source()
+	assert.Equal(t, io.EOF, err)
+}
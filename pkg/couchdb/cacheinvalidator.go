@@ -0,0 +1,262 @@
+package couchdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// invalidatorRetryDelay is the delay before following again a changes feed
+// that has failed.
+var invalidatorRetryDelay = time.Second
+
+// InvalidationMetricsCollector can be implemented by a MetricsCollector to
+// also observe how far the CacheInvalidator is behind the changes of
+// CouchDB. It is called after each response of a changes feed, and after
+// each failure, with a lag of 0 when the feed is caught up.
+type InvalidationMetricsCollector interface {
+	ObserveInvalidationLag(doctype string, lag time.Duration)
+}
+
+// CacheInvalidator follows the changes feeds of the databases with documents
+// in the cache, to remove the documents changed by the other processes, or
+// directly on CouchDB (like by a replication). A feed is started on the
+// first document of a database put in the cache, and it is stopped when the
+// cache has no more documents of this database.
+type CacheInvalidator struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	watchers map[string]*cacheWatcher
+}
+
+// cacheWatcher is the state of the changes feed of a database.
+type cacheWatcher struct {
+	doctype string
+	// behindSince is when the feed has stopped being caught up, or zero
+	behindSince time.Time
+}
+
+var (
+	cacheInvalidatorMu sync.Mutex
+	cacheInvalidator   *CacheInvalidator
+)
+
+// StartCacheInvalidator starts a CacheInvalidator, that runs until the
+// context is canceled or the invalidator is closed. The feeds are started
+// lazily, for the cached documents.
+func StartCacheInvalidator(ctx context.Context) *CacheInvalidator {
+	ctx, cancel := context.WithCancel(ctx)
+	inv := &CacheInvalidator{
+		ctx:      ctx,
+		cancel:   cancel,
+		watchers: make(map[string]*cacheWatcher),
+	}
+	cacheInvalidatorMu.Lock()
+	cacheInvalidator = inv
+	cacheInvalidatorMu.Unlock()
+	return inv
+}
+
+func getCacheInvalidator() *CacheInvalidator {
+	cacheInvalidatorMu.Lock()
+	defer cacheInvalidatorMu.Unlock()
+	return cacheInvalidator
+}
+
+// watchCachedDB is called when a document is put in the cache, to start the
+// feed of its database, if needed.
+func watchCachedDB(db Database, doctype string) {
+	if inv := getCacheInvalidator(); inv != nil {
+		inv.watch(db, doctype)
+	}
+}
+
+func (inv *CacheInvalidator) watch(db Database, doctype string) {
+	dbname := makeDBName(db, doctype)
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if _, ok := inv.watchers[dbname]; ok || inv.ctx.Err() != nil {
+		return
+	}
+	w := &cacheWatcher{doctype: doctype, behindSince: time.Now()}
+	inv.watchers[dbname] = w
+	inv.wg.Add(1)
+	go func() {
+		defer inv.wg.Done()
+		inv.follow(db, dbname, w)
+	}()
+}
+
+// follow invalidates the documents of a database as its changes arrive. The
+// feed starts at the current sequence, resolved before the first request as
+// a longpoll feed since now could miss the changes made while it is sent, and
+// the documents cached before are removed, as they may have changed in the
+// meantime. After a failure, the
+// feed is resumed from the last sequence seen.
+func (inv *CacheInvalidator) follow(db Database, dbname string, w *cacheWatcher) {
+	ctx := inv.ctx
+	invalidateAll := func() {
+		if c := getDocCache(); c != nil {
+			c.invalidate(dbname, "", "")
+		}
+	}
+
+	var since string
+	for since == "" {
+		seq, err := GetLastSeqContext(ctx, db, w.doctype)
+		if err == nil {
+			since = seq.String()
+			invalidateAll()
+			inv.mu.Lock()
+			w.behindSince = time.Time{}
+			inv.mu.Unlock()
+		} else if !inv.retry(db, dbname, w, err) {
+			return
+		}
+	}
+
+	for {
+		req := &ChangesRequest{
+			DocType: w.doctype,
+			Feed:    ChangesModeLongpoll,
+			Since:   since,
+		}
+		res, err := ForeachChangeContext(ctx, db, req, func(change *Change) error {
+			if c := getDocCache(); c != nil {
+				var rev string
+				if len(change.Changes) > 0 {
+					rev = change.Changes[0].Rev
+				}
+				c.invalidate(dbname, change.DocID, rev)
+			}
+			return nil
+		})
+		if err != nil {
+			if !inv.retry(db, dbname, w, err) {
+				return
+			}
+			continue
+		}
+		since = res.LastSeq
+		inv.mu.Lock()
+		if res.Pending > 0 {
+			if w.behindSince.IsZero() {
+				w.behindSince = time.Now()
+			}
+		} else {
+			w.behindSince = time.Time{}
+		}
+		inv.mu.Unlock()
+		inv.observeLag(w)
+
+		// The feed is stopped when it is no longer useful, and it will be
+		// started again with the next document put in the cache
+		inv.mu.Lock()
+		c := getDocCache()
+		if c == nil || !c.hasEntries(dbname) || ctx.Err() != nil {
+			delete(inv.watchers, dbname)
+			inv.mu.Unlock()
+			return
+		}
+		inv.mu.Unlock()
+	}
+}
+
+// retry is called after a failure of a feed, and returns false if the feed
+// must be stopped. The documents of a database that has been deleted are
+// removed from the cache.
+func (inv *CacheInvalidator) retry(db Database, dbname string, w *cacheWatcher, err error) bool {
+	stop := inv.ctx.Err() != nil
+	if !stop {
+		inv.mu.Lock()
+		if w.behindSince.IsZero() {
+			w.behindSince = time.Now()
+		}
+		inv.mu.Unlock()
+		inv.observeLag(w)
+		if IsNoDatabaseError(err) {
+			if c := getDocCache(); c != nil {
+				c.invalidate(dbname, "", "")
+			}
+			stop = true
+		} else {
+			loggerFor(db).Warnf("cannot follow the changes of %s for the cache: %s", w.doctype, err)
+			select {
+			case <-inv.ctx.Done():
+				stop = true
+			case <-time.After(invalidatorRetryDelay):
+			}
+		}
+	}
+	if stop {
+		inv.mu.Lock()
+		delete(inv.watchers, dbname)
+		inv.mu.Unlock()
+	}
+	return !stop
+}
+
+func (inv *CacheInvalidator) observeLag(w *cacheWatcher) {
+	collector, ok := metricsCollector.(InvalidationMetricsCollector)
+	if !ok {
+		return
+	}
+	inv.mu.Lock()
+	lag := lagSince(w.behindSince)
+	inv.mu.Unlock()
+	collector.ObserveInvalidationLag(w.doctype, lag)
+}
+
+func lagSince(behindSince time.Time) time.Duration {
+	if behindSince.IsZero() {
+		return 0
+	}
+	return time.Since(behindSince)
+}
+
+// Lag returns for how long the most late feed has not been caught up, or 0
+// if they all are.
+func (inv *CacheInvalidator) Lag() time.Duration {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	var lag time.Duration
+	for _, w := range inv.watchers {
+		if l := lagSince(w.behindSince); l > lag {
+			lag = l
+		}
+	}
+	return lag
+}
+
+// Feeds returns the number of changes feeds followed.
+func (inv *CacheInvalidator) Feeds() int {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return len(inv.watchers)
+}
+
+// Close stops the feeds, and waits for their goroutines to exit.
+func (inv *CacheInvalidator) Close() {
+	// No feed can be started after the cancel
+	inv.mu.Lock()
+	inv.cancel()
+	inv.mu.Unlock()
+	inv.wg.Wait()
+	cacheInvalidatorMu.Lock()
+	if cacheInvalidator == inv {
+		cacheInvalidator = nil
+	}
+	cacheInvalidatorMu.Unlock()
+}
+
+// Shutdown implements the utils.Shutdowner interface.
+func (inv *CacheInvalidator) Shutdown(ctx context.Context) error {
+	fmt.Print("  shutting down couchdb cache invalidator...")
+	inv.Close()
+	fmt.Println("ok.")
+	return nil
+}
@@ -0,0 +1,159 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// feedRecorder wraps a docStore to record the since of the longpoll feeds,
+// and to make some of them fail.
+type feedRecorder struct {
+	store *docStore
+	mu    sync.Mutex
+	since []string
+	fails int
+}
+
+func (f *feedRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/_changes") && r.URL.Query().Get("feed") == "longpoll" {
+		f.mu.Lock()
+		f.since = append(f.since, r.URL.Query().Get("since"))
+		fail := f.fails > 0
+		if fail {
+			f.fails--
+		}
+		f.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"unknown_error","reason":"badarg"}`))
+			return
+		}
+	}
+	f.store.ServeHTTP(w, r)
+}
+
+func (f *feedRecorder) feeds() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.since...)
+}
+
+type lagMetrics struct {
+	nopMetrics
+	mu   sync.Mutex
+	lags []time.Duration
+}
+
+func (m *lagMetrics) ObserveInvalidationLag(doctype string, lag time.Duration) {
+	m.mu.Lock()
+	m.lags = append(m.lags, lag)
+	m.mu.Unlock()
+}
+
+func useInvalidator(t *testing.T, fails int) (*docStore, *feedRecorder, *CacheInvalidator, func()) {
+	store := newDocStore()
+	feeds := &feedRecorder{store: store, fails: fails}
+	restore := useTestServer(t, feeds)
+	SetDocCache(10, time.Minute)
+	oldDelay := invalidatorRetryDelay
+	invalidatorRetryDelay = 10 * time.Millisecond
+	inv := StartCacheInvalidator(context.Background())
+	return store, feeds, inv, func() {
+		inv.Close()
+		invalidatorRetryDelay = oldDelay
+		SetDocCache(0, 0)
+		restore()
+	}
+}
+
+func TestCacheInvalidator(t *testing.T) {
+	store, feeds, inv, restore := useInvalidator(t, 0)
+	defer restore()
+	ctx := context.Background()
+	store.set("settings", map[string]interface{}{"theme": "dark"})
+
+	// The feed is started by the first cached document
+	assert.Equal(t, 0, inv.Feeds())
+	assert.Equal(t, "dark", getCached(ctx, t, "settings").M["theme"])
+	assert.Eventually(t, func() bool { return len(feeds.feeds()) == 1 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"0-a"}, feeds.feeds())
+	assert.Equal(t, 1, inv.Feeds())
+	assert.Equal(t, time.Duration(0), inv.Lag())
+
+	getCached(ctx, t, "settings")
+	assert.Equal(t, 1, GetDocCacheStats().Size)
+
+	// A write made by another process is seen without waiting for the TTL
+	store.set("settings", map[string]interface{}{"theme": "blue"})
+	store.changes <- "settings"
+	assert.Eventually(t, func() bool { return GetDocCacheStats().Size == 0 }, 5*time.Second, 5*time.Millisecond)
+
+	// The feed is stopped when the database has no more cached documents
+	assert.Eventually(t, func() bool { return inv.Feeds() == 0 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, "blue", getCached(ctx, t, "settings").M["theme"])
+	assert.Eventually(t, func() bool { return inv.Feeds() == 1 }, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestCacheInvalidatorReconnect(t *testing.T) {
+	store, feeds, inv, restore := useInvalidator(t, 2)
+	defer restore()
+	metrics := &lagMetrics{}
+	SetMetricsCollector(metrics)
+	defer SetMetricsCollector(nil)
+	ctx := context.Background()
+	store.set("settings", map[string]interface{}{"theme": "dark"})
+
+	getCached(ctx, t, "settings")
+	assert.Eventually(t, func() bool { return len(feeds.feeds()) == 3 }, 5*time.Second, 5*time.Millisecond)
+	// The feed is resumed from the last sequence after the failures
+	assert.Equal(t, []string{"0-a", "0-a", "0-a"}, feeds.feeds())
+	assert.True(t, inv.Lag() > 0)
+
+	getCached(ctx, t, "settings")
+	store.set("settings", map[string]interface{}{"theme": "blue"})
+	store.changes <- "settings"
+	assert.Eventually(t, func() bool { return inv.Feeds() == 0 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, "blue", getCached(ctx, t, "settings").M["theme"])
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if assert.Len(t, metrics.lags, 3) {
+		assert.True(t, metrics.lags[0] >= 0)
+		assert.True(t, metrics.lags[1] > 0)
+		assert.Equal(t, time.Duration(0), metrics.lags[2])
+	}
+}
+
+func TestCacheInvalidatorClose(t *testing.T) {
+	store, feeds, inv, restore := useInvalidator(t, 0)
+	defer restore()
+	store.set("settings", map[string]interface{}{"theme": "dark"})
+
+	getCached(context.Background(), t, "settings")
+	assert.Eventually(t, func() bool { return len(feeds.feeds()) == 1 }, 5*time.Second, 5*time.Millisecond)
+
+	// Close interrupts the feeds that are waiting for a change
+	done := make(chan struct{})
+	go func() {
+		inv.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the invalidator has not been closed")
+	}
+	assert.Equal(t, 0, inv.Feeds())
+	assert.Nil(t, getCacheInvalidator())
+
+	// No feed is started after the close
+	store.set("other", map[string]interface{}{"theme": "light"})
+	getCached(context.Background(), t, "other")
+	assert.Equal(t, 0, inv.Feeds())
+}
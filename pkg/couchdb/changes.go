@@ -1,10 +1,15 @@
 package couchdb
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/google/go-querystring/query"
 )
 
@@ -17,6 +22,12 @@ type ChangesFeedStyle string
 const (
 	// ChangesModeNormal is the only mode supported by cozy-stack
 	ChangesModeNormal ChangesFeedMode = "normal"
+	// ChangesModeLongpoll waits for a change before sending the response. It
+	// is not accepted from the clients, but can be used inside the stack.
+	ChangesModeLongpoll ChangesFeedMode = "longpoll"
+	// ChangesSinceNow can be used as the Since of a ChangesRequest to get only
+	// the changes made from now.
+	ChangesSinceNow = "now"
 	// ChangesStyleAllDocs pass all revisions including conflicts
 	ChangesStyleAllDocs ChangesFeedStyle = "all_docs"
 	// ChangesStyleMainOnly only pass the winning revision
@@ -87,6 +98,10 @@ type ChangesRequest struct {
 	Limit int `url:"limit,omitempty"`
 	// Start the results from the change immediately after the given update
 	// sequence. Can be valid update sequence or now value. Default is 0.
+	// With ChangesSinceNow, the longpoll feeds are sent as is to CouchDB, and
+	// for the normal feeds, it is replaced by the current update sequence of
+	// the database. In both cases, a change made just before the request may
+	// or may not be in the results.
 	Since string `url:"since,omitempty"`
 	// Specifies how many revisions are returned in the changes array. The
 	// default, main_only, will only return the current “winning” revision;
@@ -125,8 +140,41 @@ type Change struct {
 	} `json:"changes"`
 }
 
-// GetChanges returns a list of change in couchdb
+// GetChanges calls GetChangesContext with a background context. It is kept for
+// compatibility, new code should use GetChangesContext.
+//
+// Deprecated: use GetChangesContext.
 func GetChanges(db Database, req *ChangesRequest) (*ChangesResponse, error) {
+	return GetChangesContext(context.Background(), db, req)
+}
+
+// GetChangesContext returns a list of change in couchdb
+func GetChangesContext(ctx context.Context, db Database, req *ChangesRequest) (*ChangesResponse, error) {
+	return defaultClient.GetChanges(ctx, db, req)
+}
+
+// GetChanges is part of the Client interface.
+func (couchClient) GetChanges(ctx context.Context, db Database, req *ChangesRequest) (*ChangesResponse, error) {
+	results := make([]Change, 0)
+	response, err := ForeachChangeContext(ctx, db, req, func(change *Change) error {
+		results = append(results, *change)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	response.Results = results
+	return response, nil
+}
+
+// ForeachChangeContext requests the changes feed of a database and calls fn
+// for each change, as they are read: the whole feed is not kept in memory.
+// The returned response has the last sequence and the count of pending
+// changes, but no results.
+//
+// With a cluster, a streaming feed that is interrupted by its node is resumed
+// on another node, from the sequence of the last change that has been read.
+func ForeachChangeContext(ctx context.Context, db Database, req *ChangesRequest, fn func(change *Change) error) (*ChangesResponse, error) {
 	if req.DocType == "" {
 		return nil, errors.New("Empty doctype in GetChanges")
 	}
@@ -136,12 +184,95 @@ func GetChanges(db Database, req *ChangesRequest) (*ChangesResponse, error) {
 		return nil, err
 	}
 
-	var response ChangesResponse
-	url := "_changes?" + v.Encode()
-	err = makeRequest(db, req.DocType, http.MethodGet, url, nil, &response)
+	if req.Feed == ChangesModeLongpoll && !hasTimeout(ctx) {
+		ctx = withLongpollTimeout(ctx, req)
+	}
 
-	if err != nil {
-		return nil, err
+	if req.Since == ChangesSinceNow && req.Feed != ChangesModeLongpoll {
+		seq, err := GetLastSeqContext(ctx, db, req.DocType)
+		if err != nil {
+			return nil, err
+		}
+		v.Set("since", seq.String())
+	}
+
+	var lastSeq string
+	var count int
+	var callbackFailed bool
+	reconnects := 0
+	for {
+		stream := newRowStream("results", func(item json.RawMessage) error {
+			var change Change
+			if err := json.Unmarshal(item, &change); err != nil {
+				return err
+			}
+			if err := fn(&change); err != nil {
+				callbackFailed = true
+				return err
+			}
+			lastSeq = change.Seq
+			count++
+			return nil
+		})
+		url := "_changes?" + v.Encode()
+		err = makeRequest(ctx, db, req.DocType, http.MethodGet, url, nil, stream)
+		if err == nil {
+			var response ChangesResponse
+			if err = stream.decodeMeta(&response); err != nil {
+				return nil, err
+			}
+			return &response, nil
+		}
+		if callbackFailed || !canResumeFeed(ctx, req.DocType, err, reconnects) {
+			return nil, err
+		}
+		reconnects++
+		if lastSeq != "" {
+			v.Set("since", lastSeq)
+		}
+		if req.Limit > 0 {
+			if count >= req.Limit {
+				return &ChangesResponse{LastSeq: lastSeq}, nil
+			}
+			v.Set("limit", strconv.Itoa(req.Limit-count))
+		}
+		loggerFor(db).Warnf("resume the changes feed of %s since %q: %s",
+			req.DocType, v.Get("since"), err)
+	}
+}
+
+// canResumeFeed returns true if a streaming feed that has failed with the
+// given error can be resumed on another node of the cluster.
+func canResumeFeed(ctx context.Context, doctype string, err error, reconnects int) bool {
+	if !isStreaming(ctx) || ctx.Err() != nil {
+		return false
+	}
+	if reconnects >= len(clusterFor(ctx, doctype).urls)-1 {
+		return false
+	}
+	// The errors sent by CouchDB are not related to the node, except for
+	// the 503
+	if couchErr, ok := IsCouchError(err); ok {
+		return couchErr.StatusCode == http.StatusServiceUnavailable
+	}
+	return true
+}
+
+// defaultChangesTimeout is the default value of httpd/changes_timeout in
+// CouchDB, ie how long a longpoll feed waits for a change.
+const defaultChangesTimeout = 60 * time.Second
+
+// withLongpollTimeout returns a context where the timeout is long enough for
+// the longpoll changes feed to wait for a change. With heartbeats, CouchDB can
+// keep the connection open indefinitely, so only the idle time is limited.
+func withLongpollTimeout(ctx context.Context, req *ChangesRequest) context.Context {
+	margin := config.GetConfig().CouchDB.Timeout
+	if req.Heartbeat > 0 {
+		return WithIdleTimeout(ctx, time.Duration(req.Heartbeat)*time.Millisecond+margin)
+	}
+	wait := defaultChangesTimeout
+	if req.Timeout > 0 {
+		wait = time.Duration(req.Timeout) * time.Millisecond
 	}
-	return &response, nil
+	return WithTimeout(ctx, wait+margin)
 }
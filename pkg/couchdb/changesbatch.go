@@ -0,0 +1,144 @@
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrRetryLater can be returned, or wrapped, by the handler of
+// ProcessChangesBatched when it cannot process a batch for now, like when the
+// service where the documents are indexed is unavailable. The same batch is
+// given again to the handler after a delay.
+var ErrRetryLater = errors.New("CouchDB: retry later")
+
+// defaultChangesBatchSize is the size of the batches when no size is given to
+// ProcessChangesBatched.
+const defaultChangesBatchSize = 100
+
+// changesRetryDelay is the delay before calling again a handler that has
+// returned ErrRetryLater. It is doubled for each consecutive retry, up to
+// maxChangesRetryDelay.
+var (
+	changesRetryDelay    = time.Second
+	maxChangesRetryDelay = time.Minute
+)
+
+// changesCheckpointID returns the identifier of the _local document where the
+// last sequence processed by a consumer is saved.
+func changesCheckpointID(consumer string) string {
+	return "changes-" + consumer
+}
+
+// ProcessChangesBatched calls ProcessChangesBatchedContext with a background
+// context.
+func ProcessChangesBatched(db Database, doctype, consumer string, batchSize int, flushEvery time.Duration, handler func([]Change) error) error {
+	return ProcessChangesBatchedContext(context.Background(), db, doctype, consumer, batchSize, flushEvery, handler)
+}
+
+// ProcessChangesBatchedContext follows the changes of a doctype, and calls
+// the handler with batches of changes: a batch is given to the handler when it
+// has batchSize changes, or flushEvery after its first change. It runs until
+// the context is canceled, or the handler returns an error other than
+// ErrRetryLater.
+//
+// The changes are delivered at least once: the sequence of the last change
+// of a batch is saved in a _local document for the consumer only after the
+// handler has returned successfully, and the processing is resumed from it.
+// So, if the processing is interrupted, the changes of the current batch are
+// delivered again by the next run, and the handler should be idempotent.
+func ProcessChangesBatchedContext(ctx context.Context, db Database, doctype, consumer string, batchSize int, flushEvery time.Duration, handler func([]Change) error) error {
+	if batchSize <= 0 {
+		batchSize = defaultChangesBatchSize
+	}
+	checkpointID := changesCheckpointID(consumer)
+	state, err := GetLocalContext(ctx, db, doctype, checkpointID)
+	if err != nil {
+		if !IsNotFoundError(err) || IsNoDatabaseError(err) {
+			return err
+		}
+		state = map[string]interface{}{}
+	}
+	since, _ := state["last_seq"].(string)
+	if since == "" {
+		since = "0"
+	}
+
+	var batch []Change
+	var deadline time.Time
+	for {
+		req := &ChangesRequest{
+			DocType: doctype,
+			Feed:    ChangesModeLongpoll,
+			Since:   since,
+			Limit:   batchSize - len(batch),
+		}
+		if wait := waitForBatch(deadline, flushEvery); wait > 0 {
+			req.Timeout = int(wait / time.Millisecond)
+		}
+		res, err := ForeachChangeContext(ctx, db, req, func(change *Change) error {
+			batch = append(batch, *change)
+			return nil
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		since = res.LastSeq
+		if len(batch) > 0 && deadline.IsZero() {
+			deadline = time.Now().Add(flushEvery)
+		}
+
+		if len(batch) == 0 || (len(batch) < batchSize && time.Now().Before(deadline)) {
+			continue
+		}
+		if err := handleBatch(ctx, handler, batch); err != nil {
+			return err
+		}
+		state["last_seq"] = since
+		if err := PutLocalContext(ctx, db, doctype, checkpointID, state); err != nil {
+			return err
+		}
+		batch = nil
+		deadline = time.Time{}
+	}
+}
+
+// waitForBatch returns how long the feed can wait for new changes, before
+// the current batch must be given to the handler. It is 0 when there is no
+// limit.
+func waitForBatch(deadline time.Time, flushEvery time.Duration) time.Duration {
+	if flushEvery <= 0 {
+		return 0
+	}
+	if deadline.IsZero() {
+		return flushEvery
+	}
+	wait := time.Until(deadline)
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// handleBatch calls the handler with a batch of changes, and calls it again,
+// after a delay, while it returns ErrRetryLater.
+func handleBatch(ctx context.Context, handler func([]Change) error, batch []Change) error {
+	delay := changesRetryDelay
+	for {
+		err := handler(batch)
+		if !errors.Is(err, ErrRetryLater) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxChangesRetryDelay {
+			delay = maxChangesRetryDelay
+		}
+	}
+}
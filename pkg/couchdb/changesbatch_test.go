@@ -0,0 +1,197 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// batchFeed is a fake CouchDB with a changes feed of fixed documents, and the
+// _local documents for the checkpoints.
+type batchFeed struct {
+	mu     sync.Mutex
+	ids    []string
+	locals map[string]map[string]interface{}
+}
+
+func newBatchFeed(ids ...string) *batchFeed {
+	return &batchFeed{ids: ids, locals: make(map[string]map[string]interface{})}
+}
+
+func (f *batchFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	path, _ = url.PathUnescape(path[strings.Index(path[1:], "/")+2:])
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.HasPrefix(path, "_local/") && r.Method == http.MethodGet:
+		doc, ok := f.locals[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(doc)
+	case strings.HasPrefix(path, "_local/"):
+		var doc map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&doc)
+		f.locals[path] = doc
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"ok":true,"id":"` + path + `","rev":"0-1"}`))
+	case path == "_changes":
+		var since int
+		_, _ = fmt.Sscanf(r.URL.Query().Get("since"), "%d", &since)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end := len(f.ids)
+		if limit > 0 && since+limit < end {
+			end = since + limit
+		}
+		if since >= end {
+			// Nothing new: wait for the timeout of the longpoll feed
+			timeout, _ := strconv.Atoi(r.URL.Query().Get("timeout"))
+			f.mu.Unlock()
+			select {
+			case <-time.After(time.Duration(timeout) * time.Millisecond):
+			case <-r.Context().Done():
+			}
+			f.mu.Lock()
+			fmt.Fprintf(w, `{"results":[],"last_seq":"%d-x"}`, since)
+			return
+		}
+		var results []string
+		for i := since; i < end; i++ {
+			results = append(results, fmt.Sprintf(`{"seq":"%d-x","id":%q,"changes":[{"rev":"1-a"}]}`, i+1, f.ids[i]))
+		}
+		fmt.Fprintf(w, `{"results":[%s],"last_seq":"%d-x"}`, strings.Join(results, ","), end)
+	}
+}
+
+func (f *batchFeed) checkpoint(consumer string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seq, _ := f.locals["_local/"+changesCheckpointID(consumer)]["last_seq"].(string)
+	return seq
+}
+
+// batchRecorder is a handler for ProcessChangesBatched that records the
+// identifiers of the documents of each batch.
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (b *batchRecorder) record(changes []Change) {
+	ids := make([]string, len(changes))
+	for i, change := range changes {
+		ids[i] = change.DocID
+	}
+	b.mu.Lock()
+	b.batches = append(b.batches, ids)
+	b.mu.Unlock()
+}
+
+func (b *batchRecorder) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.batches)
+}
+
+func processInBackground(ctx context.Context, consumer string, handler func([]Change) error) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- ProcessChangesBatchedContext(ctx, TestPrefix, TestDoctype, consumer, 2, 50*time.Millisecond, handler)
+	}()
+	return done
+}
+
+func TestProcessChangesBatched(t *testing.T) {
+	feed := newBatchFeed("a", "b", "c", "d", "e")
+	restore := useTestServer(t, feed)
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rec := &batchRecorder{}
+	done := processInBackground(ctx, "indexer", func(changes []Change) error {
+		rec.record(changes)
+		return nil
+	})
+	// The last batch is not full, and it is given after flushEvery
+	assert.Eventually(t, func() bool { return rec.count() == 3 }, 5*time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool { return feed.checkpoint("indexer") == "5-x" }, 5*time.Second, 5*time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}, rec.batches)
+
+	// Another consumer has its own checkpoint
+	assert.Equal(t, "", feed.checkpoint("thumbnails"))
+}
+
+func TestProcessChangesBatchedRestart(t *testing.T) {
+	feed := newBatchFeed("a", "b", "c", "d", "e")
+	restore := useTestServer(t, feed)
+	defer restore()
+
+	// The processor is killed while it handles the second batch
+	crash := errors.New("crash")
+	ctx, cancel := context.WithCancel(context.Background())
+	first := &batchRecorder{}
+	done := processInBackground(ctx, "indexer", func(changes []Change) error {
+		first.record(changes)
+		if first.count() == 2 {
+			cancel()
+			return crash
+		}
+		return nil
+	})
+	assert.Equal(t, crash, <-done)
+	assert.Equal(t, "2-x", feed.checkpoint("indexer"))
+
+	// The restarted processor delivers the batch again, and nothing is lost
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	second := &batchRecorder{}
+	done = processInBackground(ctx, "indexer", func(changes []Change) error {
+		second.record(changes)
+		return nil
+	})
+	assert.Eventually(t, func() bool { return feed.checkpoint("indexer") == "5-x" }, 5*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d"}}, first.batches)
+	assert.Equal(t, [][]string{{"c", "d"}, {"e"}}, second.batches)
+}
+
+func TestProcessChangesBatchedRetryLater(t *testing.T) {
+	feed := newBatchFeed("a", "b", "c")
+	restore := useTestServer(t, feed)
+	defer restore()
+	oldDelay := changesRetryDelay
+	changesRetryDelay = time.Millisecond
+	defer func() { changesRetryDelay = oldDelay }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rec := &batchRecorder{}
+	done := processInBackground(ctx, "indexer", func(changes []Change) error {
+		rec.record(changes)
+		if rec.count() <= 2 {
+			return fmt.Errorf("search is unavailable: %w", ErrRetryLater)
+		}
+		return nil
+	})
+	assert.Eventually(t, func() bool { return feed.checkpoint("indexer") == "3-x" }, 5*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+	// The checkpoint is not advanced before the batch has been handled
+	assert.Equal(t, [][]string{{"a", "b"}, {"a", "b"}, {"a", "b"}, {"c"}}, rec.batches)
+}
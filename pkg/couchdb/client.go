@@ -0,0 +1,102 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+var injectedClient *http.Client
+
+// SetClient sets the HTTP client used for all the requests to CouchDB: the
+// JSON requests, the changes feeds, the session login and the proxied
+// requests. It can be used for tests, or for a custom transport. A nil
+// client restores the client built from the configuration.
+func SetClient(client *http.Client) {
+	injectedClient = client
+}
+
+// SetTransport is like SetClient, with a client using the given transport.
+// The timeouts are applied by the couchdb package, so the client has none.
+func SetTransport(transport http.RoundTripper) {
+	if transport == nil {
+		SetClient(nil)
+		return
+	}
+	SetClient(&http.Client{Transport: transport})
+}
+
+// httpClient returns the client to use for the requests to CouchDB.
+func httpClient() *http.Client {
+	if injectedClient != nil {
+		return injectedClient
+	}
+	if client := config.GetConfig().CouchDB.Client; client != nil {
+		return client
+	}
+	return http.DefaultClient
+}
+
+// streamingClient returns the client to use for the streaming requests to
+// CouchDB, like the changes feeds, that can be restricted to HTTP/1.1.
+func streamingClient() *http.Client {
+	if injectedClient != nil {
+		return injectedClient
+	}
+	if client := config.GetConfig().CouchDB.StreamingClient; client != nil {
+		return client
+	}
+	return httpClient()
+}
+
+// clientFor returns the client to use for a request to CouchDB.
+func clientFor(req *http.Request) *http.Client {
+	if isStreaming(req.Context()) {
+		return streamingClient()
+	}
+	return httpClient()
+}
+
+// httpTransport returns the transport of the streaming client, for the
+// reverse proxies, as their responses can be long.
+func httpTransport() http.RoundTripper {
+	if transport := streamingClient().Transport; transport != nil {
+		return transport
+	}
+	return http.DefaultTransport
+}
+
+// Client is the interface of the main operations on the documents in
+// CouchDB. The package-level functions, like GetDocContext or
+// CreateDocContext, use the default client, that can be replaced by a mock
+// with SetDefaultClient in the tests that don't have a CouchDB.
+type Client interface {
+	GetDoc(ctx context.Context, db Database, doctype, id string, out Doc) error
+	CreateDoc(ctx context.Context, db Database, doc Doc) error
+	CreateNamedDoc(ctx context.Context, db Database, doc Doc) error
+	UpdateDoc(ctx context.Context, db Database, doc Doc) error
+	DeleteDoc(ctx context.Context, db Database, doc Doc) error
+	GetAllDocs(ctx context.Context, db Database, doctype string, req *AllDocsRequest, results interface{}) error
+	FindDocs(ctx context.Context, db Database, doctype string, req *FindRequest, results interface{}) error
+	GetChanges(ctx context.Context, db Database, req *ChangesRequest) (*ChangesResponse, error)
+}
+
+// couchClient is the Client that makes the requests to CouchDB.
+type couchClient struct{}
+
+var defaultClient Client = couchClient{}
+
+// NewClient returns a Client that makes the requests to CouchDB.
+func NewClient() Client {
+	return couchClient{}
+}
+
+// SetDefaultClient sets the client used by the package-level functions. A
+// nil client restores the client that makes the requests to CouchDB.
+func SetDefaultClient(client Client) {
+	if client == nil {
+		client = couchClient{}
+	}
+	defaultClient = client
+}
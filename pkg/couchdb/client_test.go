@@ -0,0 +1,82 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTransport records the requests, and answers them without any
+// network.
+type recordingTransport struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.requests = append(rt.requests, req.Method+" "+req.URL.Path)
+	rt.mu.Unlock()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"ok":true,"_id":"foo","_rev":"1-abc"}`))),
+		Request:    req,
+	}, nil
+}
+
+func TestSetTransport(t *testing.T) {
+	rt := &recordingTransport{}
+	SetTransport(rt)
+	defer SetClient(nil)
+
+	var doc JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &doc))
+	assert.Equal(t, "1-abc", doc.Rev())
+	_, err := CheckStatus()
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/data/io.cozy.testobject/foo", nil)
+	Proxy(TestPrefix, TestDoctype, "foo").ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, []string{
+		"GET /couchdb-tests/io-cozy-testobject/foo",
+		"GET /_up",
+		"GET /couchdb-tests/io-cozy-testobject/foo",
+	}, rt.requests)
+}
+
+func TestStreamingClient(t *testing.T) {
+	couch := config.GetConfig().CouchDB
+	defer func() { config.GetConfig().CouchDB = couch }()
+	normal, streaming := &recordingTransport{}, &recordingTransport{}
+	config.GetConfig().CouchDB.Client = &http.Client{Transport: normal}
+	config.GetConfig().CouchDB.StreamingClient = &http.Client{Transport: streaming}
+
+	var doc JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &doc))
+	ctx := WithIdleTimeout(context.Background(), time.Minute)
+	assert.NoError(t, GetDocContext(ctx, TestPrefix, TestDoctype, "foo", &doc))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/data/io.cozy.testobject/_changes", nil)
+	Proxy(TestPrefix, TestDoctype, "_changes").ServeHTTP(w, req)
+
+	assert.Equal(t, []string{
+		"GET /couchdb-tests/io-cozy-testobject/foo",
+	}, normal.requests)
+	assert.Equal(t, []string{
+		"GET /couchdb-tests/io-cozy-testobject/foo",
+		"GET /couchdb-tests/io-cozy-testobject/_changes",
+	}, streaming.requests)
+}
@@ -0,0 +1,68 @@
+package couchdb
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// CloneOptions are the options of Clone.
+type CloneOptions struct {
+	// NewID generates the _id of the copy, with the ID generator of the
+	// doctype, or a random one. Without it, the copy has no _id, and CouchDB
+	// will choose it on creation.
+	NewID bool
+	// KeepAttachments keeps the _attachments stubs of the document, for the
+	// flows that copy the binaries, like the COPY of CouchDB. By default, they
+	// are dropped, as they reference the binaries of the original document.
+	KeepAttachments bool
+}
+
+// Clone returns a deep copy of a document, to be created as a new document:
+// unlike the Clone method of the Doc interface, the copy has no _rev, and no
+// nested map or slice is shared with the original document. The JSONDoc are
+// copied recursively, and the other types with a JSON round-trip, so their
+// fields that are not serialized are not copied.
+func Clone(doc Doc, opts CloneOptions) (Doc, error) {
+	var cloned Doc
+	if j, ok := doc.(*JSONDoc); ok {
+		c := &JSONDoc{Type: j.Type, M: deepClone(j.M)}
+		delete(c.M, "_id")
+		delete(c.M, "_rev")
+		if !opts.KeepAttachments {
+			delete(c.M, "_attachments")
+		}
+		cloned = c
+	} else {
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var m map[string]interface{}
+		if err := dec.Decode(&m); err != nil {
+			return nil, err
+		}
+		delete(m, "_id")
+		delete(m, "_rev")
+		if !opts.KeepAttachments {
+			delete(m, "_attachments")
+		}
+		if data, err = json.Marshal(m); err != nil {
+			return nil, err
+		}
+		cloned = NewEmptyObjectOfSameType(doc).(Doc)
+		if err := json.Unmarshal(data, cloned); err != nil {
+			return nil, err
+		}
+	}
+	if opts.NewID {
+		if err := setGeneratedID(cloned); err != nil {
+			return nil, err
+		}
+		if cloned.ID() == "" {
+			cloned.SetID(randomHex())
+		}
+	}
+	return cloned, nil
+}
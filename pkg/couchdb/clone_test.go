@@ -0,0 +1,142 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type attachedDoc struct {
+	testDoc
+	Tags        []string               `json:"tags"`
+	Attachments map[string]interface{} `json:"_attachments,omitempty"`
+}
+
+func randomValue(r *rand.Rand, depth int) interface{} {
+	n := r.Intn(6)
+	if depth > 3 {
+		n = r.Intn(3)
+	}
+	switch n {
+	case 0:
+		return strconv.Itoa(r.Int())
+	case 1:
+		return r.Intn(2) == 0
+	case 2:
+		return nil
+	case 3:
+		m := make(map[string]interface{})
+		for i := r.Intn(4); i >= 0; i-- {
+			m[strconv.Itoa(r.Intn(10))] = randomValue(r, depth+1)
+		}
+		return m
+	default:
+		s := make([]interface{}, r.Intn(4)+1)
+		for i := range s {
+			s[i] = randomValue(r, depth+1)
+		}
+		return s
+	}
+}
+
+// mutate changes a random nested value, and returns false if there was
+// nothing to change.
+func mutate(r *rand.Rand, v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if r.Intn(2) == 0 && mutate(r, child) {
+				return true
+			}
+			v[k] = "mutated"
+			return true
+		}
+	case []interface{}:
+		i := r.Intn(len(v))
+		if !mutate(r, v[i]) {
+			v[i] = "mutated"
+		}
+		return true
+	}
+	return false
+}
+
+func TestCloneIsolation(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 200; i++ {
+		m := randomValue(r, 0)
+		if _, ok := m.(map[string]interface{}); !ok {
+			m = map[string]interface{}{"value": m}
+		}
+		m.(map[string]interface{})["_id"] = "foo"
+		m.(map[string]interface{})["_rev"] = "1-abc"
+		doc := &JSONDoc{Type: TestDoctype, M: m.(map[string]interface{})}
+		before, err := json.Marshal(doc)
+		assert.NoError(t, err)
+
+		cloned, err := Clone(doc, CloneOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, cloned.ID())
+		assert.Empty(t, cloned.Rev())
+		for j := 0; j < 5; j++ {
+			mutate(r, cloned.(*JSONDoc).M)
+		}
+		after, err := json.Marshal(doc)
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(before), string(after))
+
+		// And the other way around
+		cloned, err = Clone(doc, CloneOptions{})
+		assert.NoError(t, err)
+		snapshot, err := json.Marshal(cloned)
+		assert.NoError(t, err)
+		for j := 0; j < 5; j++ {
+			mutate(r, doc.M)
+		}
+		after, err = json.Marshal(cloned)
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(snapshot), string(after))
+	}
+}
+
+func TestCloneOptions(t *testing.T) {
+	stubs := map[string]interface{}{"photo.jpg": map[string]interface{}{"stub": true}}
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+		"_id":          "foo",
+		"_rev":         "1-abc",
+		"_attachments": stubs,
+		"big":          json.Number("9007199254740993"),
+	}}
+	cloned, err := Clone(doc, CloneOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, cloned.(*JSONDoc).Get("_attachments"))
+	assert.Equal(t, json.Number("9007199254740993"), cloned.(*JSONDoc).Get("big"))
+	assert.Equal(t, TestDoctype, cloned.DocType())
+	cloned, err = Clone(doc, CloneOptions{KeepAttachments: true, NewID: true})
+	assert.NoError(t, err)
+	assert.Equal(t, stubs, cloned.(*JSONDoc).Get("_attachments"))
+	assert.Len(t, cloned.ID(), 32)
+	assert.NotEqual(t, "foo", cloned.ID())
+
+	SetIDGenerator(NewCounterIDGenerator(0))
+	defer SetIDGenerator(nil)
+	typed := &attachedDoc{
+		testDoc:     testDoc{TestID: "foo", TestRev: "1-abc", Test: "bar"},
+		Tags:        []string{"a", "b"},
+		Attachments: stubs,
+	}
+	cloned, err = Clone(typed, CloneOptions{NewID: true})
+	assert.NoError(t, err)
+	if assert.IsType(t, &attachedDoc{}, cloned) {
+		c := cloned.(*attachedDoc)
+		assert.Equal(t, "00000000000000000000000000000001", c.ID())
+		assert.Empty(t, c.Rev())
+		assert.Equal(t, "bar", c.Test)
+		assert.Nil(t, c.Attachments)
+		c.Tags[0] = "mutated"
+		assert.Equal(t, []string{"a", "b"}, typed.Tags)
+	}
+}
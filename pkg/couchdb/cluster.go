@@ -0,0 +1,116 @@
+package couchdb
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// cluster is a group of CouchDB nodes, with the credentials to use them. The
+// default cluster has an empty name, and the doctypes can be routed to
+// dedicated clusters by the configuration.
+type cluster struct {
+	name string
+	urls []*url.URL
+	auth *url.Userinfo
+	// replicationURL is the URL where CouchDB reaches itself, nil for the
+	// default one
+	replicationURL *url.URL
+}
+
+type clusterKey struct{}
+
+// withCluster returns a context where the requests made to CouchDB are sent
+// to the given cluster, whatever their doctype.
+func withCluster(ctx context.Context, cl *cluster) context.Context {
+	return context.WithValue(ctx, clusterKey{}, cl)
+}
+
+// clusterFromContext returns the cluster of a context, or the default
+// cluster.
+func clusterFromContext(ctx context.Context) *cluster {
+	if cl, ok := ctx.Value(clusterKey{}).(*cluster); ok {
+		return cl
+	}
+	return defaultCluster()
+}
+
+func defaultCluster() *cluster {
+	return &cluster{
+		urls:           config.CouchURLs(),
+		auth:           config.GetConfig().CouchDB.Auth,
+		replicationURL: config.GetConfig().CouchDB.ReplicationURL,
+	}
+}
+
+func newCluster(conf config.CouchDBCluster) *cluster {
+	return &cluster{
+		name:           conf.Name,
+		urls:           conf.URLs,
+		auth:           conf.Auth,
+		replicationURL: conf.ReplicationURL,
+	}
+}
+
+// clusterFor returns the cluster where the databases of the given doctype
+// are stored, unless the context already says which cluster to use.
+func clusterFor(ctx context.Context, doctype string) *cluster {
+	if cl, ok := ctx.Value(clusterKey{}).(*cluster); ok {
+		return cl
+	}
+	if doctype != "" {
+		for _, conf := range config.GetConfig().CouchDB.Clusters {
+			if matchDoctypes(conf.Doctypes, doctype) {
+				return newCluster(conf)
+			}
+		}
+	}
+	return defaultCluster()
+}
+
+// allClusters returns the default cluster, followed by the dedicated ones.
+func allClusters() []*cluster {
+	clusters := []*cluster{defaultCluster()}
+	for _, conf := range config.GetConfig().CouchDB.Clusters {
+		clusters = append(clusters, newCluster(conf))
+	}
+	return clusters
+}
+
+// matchDoctypes returns true if the doctype is in the list, where a pattern
+// ending with "*" matches all the doctypes with this prefix.
+func matchDoctypes(patterns []string, doctype string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(doctype, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == doctype {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	clusterSessionsMu sync.Mutex
+	clusterSessions   = make(map[string]*sessionStore)
+)
+
+// sessions returns the store of the session cookie for the cluster.
+func (cl *cluster) sessions() *sessionStore {
+	if cl.name == "" {
+		return &sessions
+	}
+	clusterSessionsMu.Lock()
+	defer clusterSessionsMu.Unlock()
+	s, ok := clusterSessions[cl.name]
+	if !ok {
+		s = &sessionStore{}
+		clusterSessions[cl.name] = s
+	}
+	return s
+}
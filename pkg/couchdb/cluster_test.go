@@ -0,0 +1,138 @@
+package couchdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchDoctypes(t *testing.T) {
+	patterns := []string{"io.cozy.files", "io.cozy.bank.*"}
+	assert.True(t, matchDoctypes(patterns, "io.cozy.files"))
+	assert.True(t, matchDoctypes(patterns, "io.cozy.bank.operations"))
+	assert.False(t, matchDoctypes(patterns, "io.cozy.files.versions"))
+	assert.False(t, matchDoctypes(patterns, "io.cozy.bank"))
+	assert.False(t, matchDoctypes(nil, "io.cozy.files"))
+}
+
+// fakeCluster is a CouchDB that only knows _all_dbs, _uuids and DELETE of a
+// database, and records the requests it has received.
+type fakeCluster struct {
+	mu       sync.Mutex
+	dbs      []string
+	requests []string
+	users    []string
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.EscapedPath())
+	user, _, _ := r.BasicAuth()
+	f.users = append(f.users, user)
+	switch {
+	case r.URL.Path == "/_all_dbs":
+		start := strings.Trim(r.URL.Query().Get("start_key"), `"`)
+		var dbs []string
+		for _, db := range f.dbs {
+			if strings.HasPrefix(db, start) {
+				dbs = append(dbs, fmt.Sprintf("%q", db))
+			}
+		}
+		_, _ = fmt.Fprintf(w, "[%s]", strings.Join(dbs, ","))
+	case r.URL.Path == "/_uuids":
+		_, _ = w.Write([]byte(`{"uuids":["123"]}`))
+	case r.Method == http.MethodDelete:
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	default:
+		_, _ = w.Write([]byte(`{"db_name":"foo"}`))
+	}
+}
+
+func useTestClusters(t *testing.T, main, files *fakeCluster) func() {
+	t.Helper()
+	couch := config.GetConfig().CouchDB
+	mainServer := httptest.NewServer(main)
+	filesServer := httptest.NewServer(files)
+	mainURL, _ := url.Parse(mainServer.URL + "/")
+	filesURL, _ := url.Parse(filesServer.URL + "/")
+	config.GetConfig().CouchDB.URL = mainURL
+	config.GetConfig().CouchDB.Auth = url.UserPassword("main", "secret")
+	config.GetConfig().CouchDB.Client = mainServer.Client()
+	config.GetConfig().CouchDB.SessionAuth = false
+	config.GetConfig().CouchDB.Clusters = []config.CouchDBCluster{{
+		Name:     "files",
+		URLs:     []*url.URL{filesURL},
+		Auth:     url.UserPassword("files", "secret"),
+		Doctypes: []string{"io.cozy.files", "io.cozy.bank.*"},
+	}}
+	return func() {
+		config.GetConfig().CouchDB = couch
+		mainServer.Close()
+		filesServer.Close()
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	main, files := &fakeCluster{}, &fakeCluster{}
+	restore := useTestClusters(t, main, files)
+	defer restore()
+
+	for _, doctype := range []string{"io.cozy.files", "io.cozy.bank.operations", "io.cozy.apps"} {
+		_, err := DBStatus(TestPrefix, doctype)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{
+		"GET /couchdb-tests%2Fio-cozy-apps/",
+	}, main.requests)
+	assert.Equal(t, []string{"main"}, main.users)
+	assert.Equal(t, []string{
+		"GET /couchdb-tests%2Fio-cozy-files/",
+		"GET /couchdb-tests%2Fio-cozy-bank-operations/",
+	}, files.requests)
+	assert.Equal(t, []string{"files", "files"}, files.users)
+
+	// The requests without a doctype go to the default cluster
+	main.requests, files.requests = nil, nil
+	_, err := UUIDContext(context.Background(), TestPrefix)
+	assert.NoError(t, err)
+	assert.Len(t, main.requests, 1)
+	assert.Len(t, files.requests, 0)
+}
+
+func TestClusterFanOut(t *testing.T) {
+	main := &fakeCluster{dbs: []string{
+		"couchdb-tests/io-cozy-apps",
+		"couchdb-tests/io-cozy-files", // left from before the move
+		"other/io-cozy-apps",
+	}}
+	files := &fakeCluster{dbs: []string{
+		"couchdb-tests/io-cozy-files",
+		"couchdb-tests/io-cozy-bank-operations",
+	}}
+	restore := useTestClusters(t, main, files)
+	defer restore()
+
+	doctypes, err := AllDoctypes(TestPrefix)
+	assert.NoError(t, err)
+	sort.Strings(doctypes)
+	assert.Equal(t, []string{"io.cozy.apps", "io.cozy.bank.operations", "io.cozy.files"}, doctypes)
+
+	// Each database is deleted on the cluster where it has been found
+	main.requests, files.requests = nil, nil
+	assert.NoError(t, DeleteAllDBs(TestPrefix))
+	assert.Contains(t, main.requests, "DELETE /couchdb-tests%2Fio-cozy-apps/")
+	assert.Contains(t, main.requests, "DELETE /couchdb-tests%2Fio-cozy-files/")
+	assert.Contains(t, files.requests, "DELETE /couchdb-tests%2Fio-cozy-files/")
+	assert.Contains(t, files.requests, "DELETE /couchdb-tests%2Fio-cozy-bank-operations/")
+	assert.NotContains(t, main.requests, "DELETE /other%2Fio-cozy-apps/")
+}
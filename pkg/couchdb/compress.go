@@ -0,0 +1,46 @@
+package couchdb
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// acceptGzip asks CouchDB to compress the JSON response. As the header is set
+// explicitly, the http transport no longer decompresses the body by itself:
+// it is done by decompressBody. The attachments are not fetched this way,
+// they go through the proxy that forwards the body as is.
+func acceptGzip(req *http.Request) {
+	req.Header.Set("Accept-Encoding", "gzip")
+}
+
+// decompressBody returns a reader for the decompressed body of a response
+// from CouchDB. The response body is returned as is if it is not compressed.
+func decompressBody(resp *http.Response) (io.ReadCloser, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body, nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err == io.EOF {
+		// An empty body, like for a HEAD request
+		return resp.Body, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return &gzipBody{Reader: gz, body: resp.Body}, nil
+}
+
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g *gzipBody) Close() error {
+	_ = g.Reader.Close()
+	return g.body.Close()
+}
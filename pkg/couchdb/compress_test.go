@@ -0,0 +1,102 @@
+package couchdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write(data)
+	_ = gz.Close()
+	return buf.Bytes()
+}
+
+func TestGzipResponses(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write(gzipped([]byte(`{"error":"not_found","reason":"missing"}`)))
+			return
+		}
+		_, _ = w.Write(gzipped([]byte(`{"_id":"foo","_rev":"1-abc","bar":"baz"}`)))
+	}))
+	defer restore()
+
+	var doc JSONDoc
+	err := GetDoc(TestPrefix, TestDoctype, "foo", &doc)
+	assert.NoError(t, err)
+	assert.Equal(t, "baz", doc.M["bar"])
+
+	err = GetDoc(TestPrefix, TestDoctype, "missing", &doc)
+	assert.True(t, IsNotFoundError(err))
+}
+
+// makeAllDocsResponse returns the response of CouchDB for _all_docs with
+// the given number of rows and their documents.
+func makeAllDocsResponse(n int) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"total_rows":%d,"offset":0,"rows":[`, n)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		id := fmt.Sprintf("%032x", i)
+		row := map[string]interface{}{
+			"id":    id,
+			"key":   id,
+			"value": map[string]string{"rev": "1-abcdef0123456789"},
+			"doc": map[string]interface{}{
+				"_id":  id,
+				"_rev": "1-abcdef0123456789",
+				"name": fmt.Sprintf("file-%d.jpg", i),
+				"type": "file",
+				"size": i * 1024,
+			},
+		}
+		data, _ := json.Marshal(row)
+		buf.Write(data)
+	}
+	buf.WriteString("]}")
+	return buf.Bytes()
+}
+
+func benchmarkAllDocs(b *testing.B, compressed bool) {
+	body := makeAllDocsResponse(10000)
+	if compressed {
+		body = gzipped(body)
+	}
+	var written int64
+	restore := useTestServer(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if compressed {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		n, _ := w.Write(body)
+		atomic.AddInt64(&written, int64(n))
+	}))
+	defer restore()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var results []JSONDoc
+		req := &AllDocsRequest{Limit: 10000}
+		if err := GetAllDocs(TestPrefix, TestDoctype, req, &results); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&written))/float64(b.N), "wire-B/op")
+}
+
+func BenchmarkAllDocsPlain(b *testing.B) { benchmarkAllDocs(b, false) }
+func BenchmarkAllDocsGzip(b *testing.B)  { benchmarkAllDocs(b, true) }
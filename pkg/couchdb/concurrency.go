@@ -0,0 +1,206 @@
+package couchdb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+const (
+	// SlotsRequests is the label of the slots for the requests
+	SlotsRequests = "requests"
+	// SlotsPrefix is the label of the slots for the requests of an instance
+	SlotsPrefix = "prefix"
+	// SlotsFeeds is the label of the slots for the streaming requests
+	SlotsFeeds = "feeds"
+)
+
+// SaturationMetricsCollector can be implemented by a MetricsCollector to also
+// observe the requests that have waited for a slot, as the limit of requests
+// in flight was reached. The slots are SlotsRequests, SlotsPrefix or
+// SlotsFeeds.
+type SaturationMetricsCollector interface {
+	ObserveSaturated(slots string)
+}
+
+// semaphore is a counting semaphore, with a slot per value in the channel.
+type semaphore chan struct{}
+
+// acquire takes a slot, waiting for one until the deadline. It reports the
+// saturation of the semaphore when it has to wait.
+func (s semaphore) acquire(ctx context.Context, deadline time.Time, slots string) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	default:
+	}
+	observeSaturated(slots)
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return saturatedError(ctx)
+		}
+		return ctx.Err()
+	case <-timer.C:
+		return saturatedError(ctx)
+	}
+}
+
+// saturatedError returns the error for a request that has not found a slot
+// before its deadline, wrapping context.DeadlineExceeded if it was the
+// deadline of its context.
+func saturatedError(ctx context.Context) error {
+	err := newTooManyRequestsError()
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		err.(*Error).Original = context.DeadlineExceeded
+	}
+	return err
+}
+
+func (s semaphore) release() {
+	<-s
+}
+
+// prefixSlots is the semaphore of an instance, with the number of requests
+// that use it, so that it can be removed when it is no longer used.
+type prefixSlots struct {
+	sem   semaphore
+	users int
+}
+
+// concurrencyLimiter limits the number of requests in flight: in total, by
+// instance, and for the streaming requests that have their own budget.
+type concurrencyLimiter struct {
+	conf     config.CouchDBConcurrency
+	requests semaphore
+	feeds    semaphore
+	mu       sync.Mutex
+	prefixes map[string]*prefixSlots
+}
+
+func newConcurrencyLimiter(conf config.CouchDBConcurrency) *concurrencyLimiter {
+	l := &concurrencyLimiter{
+		conf:     conf,
+		prefixes: make(map[string]*prefixSlots),
+	}
+	if conf.MaxRequests > 0 {
+		l.requests = make(semaphore, conf.MaxRequests)
+	}
+	if conf.MaxFeeds > 0 {
+		l.feeds = make(semaphore, conf.MaxFeeds)
+	}
+	return l
+}
+
+var (
+	concurrencyMu sync.Mutex
+	concurrency   *concurrencyLimiter
+)
+
+// getConcurrencyLimiter returns the limiter for the current configuration, or
+// nil if there is no limit.
+func getConcurrencyLimiter() *concurrencyLimiter {
+	conf := config.GetConfig().CouchDB.Concurrency
+	if conf.MaxRequests <= 0 && conf.MaxPerPrefix <= 0 && conf.MaxFeeds <= 0 {
+		return nil
+	}
+	concurrencyMu.Lock()
+	defer concurrencyMu.Unlock()
+	if concurrency == nil || concurrency.conf != conf {
+		concurrency = newConcurrencyLimiter(conf)
+	}
+	return concurrency
+}
+
+// acquireSlot waits for a slot to send a request to CouchDB, and returns a
+// function to call to release it once the request is finished. The streaming
+// requests take a slot of their own budget, and the other requests take a
+// slot of their instance and then a slot in the total. A request waits up to
+// the MaxWait of the configuration, or the deadline of its context if it is
+// closer, and then fails with a too_many_requests error (that also matches
+// context.DeadlineExceeded in the latter case).
+func acquireSlot(ctx context.Context, db Database) (func(), error) {
+	l := getConcurrencyLimiter()
+	if l == nil {
+		return func() {}, nil
+	}
+	deadline := time.Now().Add(l.conf.MaxWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	if isStreaming(ctx) {
+		if l.feeds == nil {
+			return func() {}, nil
+		}
+		if err := l.feeds.acquire(ctx, deadline, SlotsFeeds); err != nil {
+			return nil, err
+		}
+		return l.feeds.release, nil
+	}
+
+	var releases []func()
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+	if l.conf.MaxPerPrefix > 0 && isRateLimited(db) {
+		prefix := db.DBPrefix()
+		slots := l.usePrefix(prefix)
+		releases = append(releases, func() { l.unusePrefix(prefix) })
+		if err := slots.sem.acquire(ctx, deadline, SlotsPrefix); err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, slots.sem.release)
+	}
+	if l.requests != nil {
+		if err := l.requests.acquire(ctx, deadline, SlotsRequests); err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, l.requests.release)
+	}
+	return release, nil
+}
+
+// usePrefix returns the semaphore of an instance, and counts its use.
+func (l *concurrencyLimiter) usePrefix(prefix string) *prefixSlots {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots, ok := l.prefixes[prefix]
+	if !ok {
+		slots = &prefixSlots{sem: make(semaphore, l.conf.MaxPerPrefix)}
+		l.prefixes[prefix] = slots
+	}
+	slots.users++
+	return slots
+}
+
+// unusePrefix removes the semaphore of an instance when no request uses it,
+// so that only the instances with requests in flight are kept in memory.
+func (l *concurrencyLimiter) unusePrefix(prefix string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if slots, ok := l.prefixes[prefix]; ok {
+		slots.users--
+		if slots.users <= 0 {
+			delete(l.prefixes, prefix)
+		}
+	}
+}
+
+// observeSaturated reports a request that waits for a slot to the metrics
+// collector, if it is interested.
+func observeSaturated(slots string) {
+	if collector, ok := metricsCollector.(SaturationMetricsCollector); ok {
+		collector.ObserveSaturated(slots)
+	}
+}
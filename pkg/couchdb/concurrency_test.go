@@ -0,0 +1,169 @@
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+// inFlightServer is a fake CouchDB that counts the requests in flight, in
+// total and by database. The _changes requests wait for the release channel
+// to be closed.
+type inFlightServer struct {
+	mu       sync.Mutex
+	running  map[string]int
+	max      map[string]int
+	total    int
+	maxTotal int
+	release  chan struct{}
+}
+
+func newInFlightServer() *inFlightServer {
+	return &inFlightServer{
+		running: make(map[string]int),
+		max:     make(map[string]int),
+		release: make(chan struct{}),
+	}
+}
+
+func (s *inFlightServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dbname := strings.SplitN(strings.Trim(r.URL.EscapedPath(), "/"), "/", 2)[0]
+	s.mu.Lock()
+	s.total++
+	if s.total > s.maxTotal {
+		s.maxTotal = s.total
+	}
+	s.running[dbname]++
+	if s.running[dbname] > s.max[dbname] {
+		s.max[dbname] = s.running[dbname]
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.total--
+		s.running[dbname]--
+		s.mu.Unlock()
+	}()
+	if strings.HasSuffix(r.URL.Path, "/_changes") {
+		<-s.release
+		_, _ = w.Write([]byte(`{"results":[],"last_seq":"1-a"}`))
+		return
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, _ = w.Write([]byte(`{"db_name":"foo","doc_count":0}`))
+}
+
+func (s *inFlightServer) maxFor(db Database) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max[makeDBName(db, TestDoctype)]
+}
+
+type saturationMetrics struct {
+	nopMetrics
+	mu        sync.Mutex
+	saturated map[string]int
+}
+
+func (m *saturationMetrics) ObserveSaturated(slots string) {
+	m.mu.Lock()
+	m.saturated[slots]++
+	m.mu.Unlock()
+}
+
+func TestConcurrencyLimitLoad(t *testing.T) {
+	server := newInFlightServer()
+	restore := useTestServer(t, server)
+	defer restore()
+	config.GetConfig().CouchDB.Concurrency = config.CouchDBConcurrency{
+		MaxRequests:  5,
+		MaxPerPrefix: 2,
+		MaxWait:      10 * time.Second,
+	}
+	metrics := &saturationMetrics{saturated: make(map[string]int)}
+	SetMetricsCollector(metrics)
+	defer SetMetricsCollector(nil)
+
+	alice := prefixer.NewPrefixer("alice.cozy.tools", "concurrencyalice")
+	bob := prefixer.NewPrefixer("bob.cozy.tools", "concurrencybob")
+	dbs := []Database{alice, bob, GlobalDB}
+	var wg sync.WaitGroup
+	for i := 0; i < 90; i++ {
+		wg.Add(1)
+		go func(db Database) {
+			defer wg.Done()
+			_, err := DBStatus(db, TestDoctype)
+			assert.NoError(t, err)
+		}(dbs[i%len(dbs)])
+	}
+	wg.Wait()
+
+	assert.Equal(t, 5, server.maxTotal)
+	assert.Equal(t, 2, server.maxFor(alice))
+	assert.Equal(t, 2, server.maxFor(bob))
+	// The global databases are only limited by the total
+	assert.True(t, server.maxFor(GlobalDB) > 2)
+	assert.True(t, metrics.saturated[SlotsRequests] > 0)
+	assert.True(t, metrics.saturated[SlotsPrefix] > 0)
+	assert.Empty(t, getConcurrencyLimiter().prefixes)
+}
+
+func TestConcurrencyLimitSaturated(t *testing.T) {
+	server := newInFlightServer()
+	restore := useTestServer(t, server)
+	defer restore()
+	config.GetConfig().CouchDB.Concurrency = config.CouchDBConcurrency{
+		MaxRequests: 1,
+		MaxFeeds:    1,
+		MaxWait:     50 * time.Millisecond,
+	}
+
+	// A feed holds its slot until it ends
+	feed := func(ctx context.Context) error {
+		ctx = WithIdleTimeout(ctx, time.Minute)
+		return makeRequest(ctx, TestPrefix, TestDoctype, http.MethodGet, "_changes?feed=longpoll", nil, &ChangesResponse{})
+	}
+	done := make(chan error)
+	go func() { done <- feed(context.Background()) }()
+	for {
+		server.mu.Lock()
+		total := server.total
+		server.mu.Unlock()
+		if total == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The feeds have their own budget
+	_, err := DBStatus(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	err = feed(context.Background())
+	assert.True(t, errors.Is(err, ErrTooManyRequests))
+	couchErr, ok := IsCouchError(err)
+	if assert.True(t, ok) {
+		assert.Equal(t, http.StatusServiceUnavailable, couchErr.StatusCode)
+	}
+
+	// The deadline of the context is respected
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = feed(ctx)
+	assert.True(t, time.Since(start) < 40*time.Millisecond, fmt.Sprint(time.Since(start)))
+	assert.True(t, errors.Is(err, ErrTooManyRequests))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	close(server.release)
+	assert.NoError(t, <-done)
+	assert.NoError(t, feed(context.Background()))
+}
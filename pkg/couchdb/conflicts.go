@@ -0,0 +1,292 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// conflictsPageSize is the number of documents fetched per page by
+// ResolveConflicts.
+const conflictsPageSize = 100
+
+var (
+	// ErrConflictNotResolved can be returned by a ConflictResolver that
+	// cannot resolve a conflict: the document is left as is.
+	ErrConflictNotResolved = errors.New("CouchDB: conflict not resolved")
+	// ErrNoConflictResolver is returned by ResolveConflicts for a doctype
+	// without a registered ConflictResolver.
+	ErrNoConflictResolver = errors.New("CouchDB: no conflict resolver for the doctype")
+)
+
+// ConflictResolution is how a ConflictResolver resolves the conflict of a
+// document.
+type ConflictResolution struct {
+	// Winner is the body of the document after the resolution. Its _rev is
+	// the leaf revision that it updates.
+	Winner *JSONDoc
+	// Deleted are the other leaf revisions, to delete.
+	Deleted []string
+}
+
+// ConflictResolver resolves the conflicts of the documents of a doctype,
+// like those made by the replications between the devices of an instance.
+type ConflictResolver interface {
+	// ResolveConflict is called with all the leaf revisions of a document,
+	// the current one (chosen by CouchDB) first.
+	ResolveConflict(leaves []*JSONDoc) (*ConflictResolution, error)
+}
+
+// ConflictResolverFunc is an adapter to use a function as a
+// ConflictResolver.
+type ConflictResolverFunc func(leaves []*JSONDoc) (*ConflictResolution, error)
+
+// ResolveConflict implements the ConflictResolver interface.
+func (f ConflictResolverFunc) ResolveConflict(leaves []*JSONDoc) (*ConflictResolution, error) {
+	return f(leaves)
+}
+
+var (
+	conflictResolvers = make(map[string]ConflictResolver)
+
+	// LatestUpdateWins is a ConflictResolver that keeps the leaf revision
+	// with the most recent updated_at (or cozyMetadata.updatedAt), and
+	// deletes the others. On a tie, the current revision wins.
+	LatestUpdateWins ConflictResolver = ConflictResolverFunc(latestUpdateWins)
+
+	// MergeFields is a ConflictResolver that adds to the current revision
+	// the fields that are only in the other leaf revisions, and deletes
+	// them. If a field has different values in two revisions, the conflict
+	// is not resolved. As the common ancestor is not known, a field removed
+	// in a revision is brought back by the others.
+	MergeFields ConflictResolver = ConflictResolverFunc(mergeFields)
+)
+
+// RegisterConflictResolver registers the resolver used by ResolveConflicts
+// for a doctype. It is meant to be called in an init function.
+func RegisterConflictResolver(doctype string, resolver ConflictResolver) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	conflictResolvers[doctype] = resolver
+}
+
+func conflictResolverFor(doctype string) ConflictResolver {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return conflictResolvers[doctype]
+}
+
+// UnresolvedConflict is a conflicted document that ResolveConflicts has
+// left as is.
+type UnresolvedConflict struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// ConflictsReport is the result of ResolveConflicts.
+type ConflictsReport struct {
+	Doctype string `json:"doctype"`
+	// Conflicted is the number of documents with conflicts
+	Conflicted int `json:"conflicted"`
+	// Resolved are the identifiers of the documents resolved
+	Resolved []string `json:"resolved,omitempty"`
+	// Unresolved are the documents still in conflict
+	Unresolved []UnresolvedConflict `json:"unresolved,omitempty"`
+}
+
+// ResolveConflicts calls ResolveConflictsContext with a background context.
+func ResolveConflicts(db Database, doctype string) (*ConflictsReport, error) {
+	return ResolveConflictsContext(context.Background(), db, doctype)
+}
+
+// ResolveConflictsContext scans the documents of a doctype, and resolves
+// their conflicts with the registered ConflictResolver. The resolution of a
+// document is written with a single _bulk_docs request, for the update of
+// the winner and the deletions of the other revisions, and an update event
+// is emitted for it. The documents that cannot be resolved are listed in
+// the report, which is returned even with an error.
+func ResolveConflictsContext(ctx context.Context, db Database, doctype string) (*ConflictsReport, error) {
+	resolver := conflictResolverFor(doctype)
+	if resolver == nil {
+		return nil, ErrNoConflictResolver
+	}
+	report := &ConflictsReport{Doctype: doctype}
+	params := url.Values{"conflicts": {"true"}}
+	err := foreachDocsWithParams(ctx, db, doctype, conflictsPageSize, "", params, func(id string, raw json.RawMessage) error {
+		var current map[string]interface{}
+		if err := json.Unmarshal(raw, &current); err != nil {
+			return err
+		}
+		revs, _ := current["_conflicts"].([]interface{})
+		if len(revs) == 0 {
+			return nil
+		}
+		report.Conflicted++
+		delete(current, "_conflicts")
+		leaves := []*JSONDoc{{M: current, Type: doctype}}
+		for _, rev := range revs {
+			if rev, ok := rev.(string); ok {
+				leaves = append(leaves, &JSONDoc{M: map[string]interface{}{"_id": id, "_rev": rev}, Type: doctype})
+			}
+		}
+		reason, err := resolveConflict(ctx, db, doctype, resolver, leaves)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			report.Unresolved = append(report.Unresolved, UnresolvedConflict{ID: id, Reason: reason})
+		} else {
+			report.Resolved = append(report.Resolved, id)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// resolveConflict fetches the leaf revisions of a document, and writes the
+// resolution. It returns the reason why the document has not been
+// resolved, or an error if the sweep must stop.
+func resolveConflict(ctx context.Context, db Database, doctype string, resolver ConflictResolver, leaves []*JSONDoc) (string, error) {
+	id := leaves[0].ID()
+	payload := make([]IDRev, 0, len(leaves)-1)
+	for _, leaf := range leaves[1:] {
+		payload = append(payload, IDRev{ID: id, Rev: leaf.Rev()})
+	}
+	docs, err := BulkGetDocsContext(ctx, db, doctype, payload)
+	if err != nil {
+		return "", err
+	}
+	fetched := make(map[string]map[string]interface{}, len(docs))
+	for _, doc := range docs {
+		delete(doc, "_revisions")
+		if rev, _ := doc["_rev"].(string); rev != "" {
+			fetched[rev] = doc
+		}
+	}
+	for _, leaf := range leaves[1:] {
+		doc, ok := fetched[leaf.Rev()]
+		if !ok {
+			return fmt.Sprintf("the revision %s cannot be fetched", leaf.Rev()), nil
+		}
+		leaf.M = doc
+	}
+
+	// The resolver can change the current revision to make the winner
+	old := leaves[0].Clone()
+	res, err := resolver.ResolveConflict(leaves)
+	if err != nil {
+		return err.Error(), nil
+	}
+	if reason := checkResolution(id, leaves, res); reason != "" {
+		return reason, nil
+	}
+	winner := res.Winner
+	winner.Type = doctype
+	body := []interface{}{winner.M}
+	for _, rev := range res.Deleted {
+		body = append(body, map[string]interface{}{"_id": id, "_rev": rev, "_deleted": true})
+	}
+	var rows []UpdateResponse
+	err = makeRequest(ctx, db, doctype, http.MethodPost, "_bulk_docs", newBulkDocsBody(body), &rows)
+	if err != nil {
+		return "", err
+	}
+	for _, row := range rows {
+		if row.Error != "" {
+			return newBulkRowError(row).Error(), nil
+		}
+	}
+	if len(rows) > 0 {
+		winner.SetRev(rows[0].Rev)
+	}
+	rtEvent(ctx, db, EventUpdate, winner, old)
+	return "", nil
+}
+
+// checkResolution returns why the resolution of a resolver cannot be
+// written, if it cannot.
+func checkResolution(id string, leaves []*JSONDoc, res *ConflictResolution) string {
+	if res == nil || res.Winner == nil || res.Winner.M == nil {
+		return "the resolver has returned no winner"
+	}
+	if res.Winner.ID() != id {
+		return "the winner has another _id"
+	}
+	isLeaf := func(rev string) bool {
+		for _, leaf := range leaves {
+			if leaf.Rev() == rev {
+				return true
+			}
+		}
+		return false
+	}
+	if !isLeaf(res.Winner.Rev()) {
+		return "the winner does not update a leaf revision"
+	}
+	for _, rev := range res.Deleted {
+		if !isLeaf(rev) || rev == res.Winner.Rev() {
+			return fmt.Sprintf("the revision %s cannot be deleted", rev)
+		}
+	}
+	return ""
+}
+
+func latestUpdateWins(leaves []*JSONDoc) (*ConflictResolution, error) {
+	winner := 0
+	latest := updatedAt(leaves[0])
+	for i, leaf := range leaves[1:] {
+		if t := updatedAt(leaf); t.After(latest) {
+			winner, latest = i+1, t
+		}
+	}
+	res := &ConflictResolution{Winner: leaves[winner]}
+	for i, leaf := range leaves {
+		if i != winner {
+			res.Deleted = append(res.Deleted, leaf.Rev())
+		}
+	}
+	return res, nil
+}
+
+// updatedAt returns the date of the last update of a document, from its
+// updated_at field or from its cozyMetadata.
+func updatedAt(doc *JSONDoc) time.Time {
+	if t, ok := doc.GetTimeOk("updated_at"); ok {
+		return t
+	}
+	if s, ok := doc.GetPath("cozyMetadata.updatedAt"); ok {
+		if s, ok := s.(string); ok {
+			t, _ := time.Parse(time.RFC3339Nano, s)
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func mergeFields(leaves []*JSONDoc) (*ConflictResolution, error) {
+	merged := make(map[string]interface{}, len(leaves[0].M))
+	for k, v := range leaves[0].M {
+		merged[k] = v
+	}
+	res := &ConflictResolution{Winner: &JSONDoc{M: merged, Type: leaves[0].Type}}
+	for _, leaf := range leaves[1:] {
+		for k, v := range leaf.M {
+			if strings.HasPrefix(k, "_") {
+				continue
+			}
+			if existing, ok := merged[k]; !ok {
+				merged[k] = v
+			} else if !reflect.DeepEqual(existing, v) {
+				return nil, fmt.Errorf("%w: the field %s has been changed in several revisions", ErrConflictNotResolved, k)
+			}
+		}
+		res.Deleted = append(res.Deleted, leaf.Rev())
+	}
+	return res, nil
+}
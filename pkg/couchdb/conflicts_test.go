@@ -0,0 +1,192 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatestUpdateWins(t *testing.T) {
+	leaves := []*JSONDoc{
+		{M: map[string]interface{}{"_id": "a", "_rev": "2-a", "updated_at": "2020-01-01T00:00:00Z"}},
+		{M: map[string]interface{}{"_id": "a", "_rev": "2-b", "cozyMetadata": map[string]interface{}{"updatedAt": "2020-03-01T00:00:00Z"}}},
+		{M: map[string]interface{}{"_id": "a", "_rev": "2-c", "updated_at": "2020-02-01T00:00:00Z"}},
+	}
+	res, err := LatestUpdateWins.ResolveConflict(leaves)
+	assert.NoError(t, err)
+	assert.Equal(t, "2-b", res.Winner.Rev())
+	assert.Equal(t, []string{"2-a", "2-c"}, res.Deleted)
+
+	// On a tie, the current revision wins
+	leaves[1].M = map[string]interface{}{"_id": "a", "_rev": "2-b"}
+	leaves[2].M["updated_at"] = "2020-01-01T00:00:00Z"
+	res, err = LatestUpdateWins.ResolveConflict(leaves)
+	assert.NoError(t, err)
+	assert.Equal(t, "2-a", res.Winner.Rev())
+	assert.Equal(t, []string{"2-b", "2-c"}, res.Deleted)
+}
+
+func TestMergeFields(t *testing.T) {
+	leaves := []*JSONDoc{
+		{M: map[string]interface{}{"_id": "a", "_rev": "2-a", "name": "foo", "tags": []interface{}{"x"}}},
+		{M: map[string]interface{}{"_id": "a", "_rev": "2-b", "name": "foo", "color": "red"}},
+		{M: map[string]interface{}{"_id": "a", "_rev": "2-c", "tags": []interface{}{"x"}, "size": 3.0}},
+	}
+	res, err := MergeFields.ResolveConflict(leaves)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"_id":   "a",
+		"_rev":  "2-a",
+		"name":  "foo",
+		"tags":  []interface{}{"x"},
+		"color": "red",
+		"size":  3.0,
+	}, res.Winner.M)
+	assert.Equal(t, []string{"2-b", "2-c"}, res.Deleted)
+	// The leaves are not changed
+	assert.NotContains(t, leaves[0].M, "color")
+
+	leaves[2].M["name"] = "bar"
+	_, err = MergeFields.ResolveConflict(leaves)
+	assert.True(t, errors.Is(err, ErrConflictNotResolved))
+	assert.Contains(t, err.Error(), "name")
+}
+
+// conflictCouch is a fake CouchDB with some conflicted documents, that
+// records the _bulk_docs requests.
+type conflictCouch struct {
+	docs  []map[string]interface{}
+	revs  map[string]map[string]interface{}
+	bulks [][]map[string]interface{}
+	fail  bool
+}
+
+func (c *conflictCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_all_docs"):
+		if r.URL.Query().Get("conflicts") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rows := make([]map[string]interface{}, len(c.docs))
+		for i, doc := range c.docs {
+			rows[i] = map[string]interface{}{"id": doc["_id"], "doc": doc}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"rows": rows})
+	case strings.HasSuffix(r.URL.Path, "/_bulk_get"):
+		var body struct {
+			Docs []IDRev `json:"docs"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		var results []interface{}
+		for _, d := range body.Docs {
+			var docs []interface{}
+			if doc, ok := c.revs[d.Rev]; ok {
+				with := map[string]interface{}{"_revisions": map[string]interface{}{"start": 2}}
+				for k, v := range doc {
+					with[k] = v
+				}
+				docs = append(docs, map[string]interface{}{"ok": with})
+			} else {
+				docs = append(docs, map[string]interface{}{"error": map[string]interface{}{"error": "not_found"}})
+			}
+			results = append(results, map[string]interface{}{"id": d.ID, "docs": docs})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	case strings.HasSuffix(r.URL.Path, "/_bulk_docs"):
+		var body struct {
+			Docs []map[string]interface{} `json:"docs"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		c.bulks = append(c.bulks, body.Docs)
+		rows := make([]UpdateResponse, len(body.Docs))
+		for i, doc := range body.Docs {
+			rows[i] = UpdateResponse{ID: doc["_id"].(string), Rev: "3-new", Ok: true}
+			if c.fail && i == 0 {
+				rows[i] = UpdateResponse{ID: doc["_id"].(string), Error: "conflict", Reason: "Document update conflict."}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(rows)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// conflictRuns makes the doctype of TestResolveConflicts unique for each
+// run, with -count.
+var conflictRuns int
+
+// unregisterConflicts removes the resolver and the hooks of a doctype.
+func unregisterConflicts(doctype string) {
+	registryMu.Lock()
+	delete(conflictResolvers, doctype)
+	registryMu.Unlock()
+	delete(hooks, key{doctype, EventUpdate})
+}
+
+func TestResolveConflicts(t *testing.T) {
+	conflictRuns++
+	doctype := fmt.Sprintf("io.cozy.tests.conflicts%d", conflictRuns)
+	defer unregisterConflicts(doctype)
+	c := &conflictCouch{
+		docs: []map[string]interface{}{
+			{"_id": "a", "_rev": "2-a", "name": "foo", "_conflicts": []string{"2-b"}},
+			{"_id": "b", "_rev": "1-b", "name": "bar"},
+			{"_id": "c", "_rev": "2-c", "name": "baz", "_conflicts": []string{"2-d"}},
+			{"_id": "e", "_rev": "2-e", "_conflicts": []string{"2-missing"}},
+		},
+		revs: map[string]map[string]interface{}{
+			"2-b": {"_id": "a", "_rev": "2-b", "color": "red"},
+			"2-d": {"_id": "c", "_rev": "2-d", "name": "qux"},
+		},
+	}
+	restore := useTestServer(t, c)
+	defer restore()
+
+	_, err := ResolveConflicts(TestPrefix, doctype)
+	assert.Equal(t, ErrNoConflictResolver, err)
+
+	RegisterConflictResolver(doctype, MergeFields)
+	var events []string
+	AddHook(doctype, EventUpdate, func(db prefixer.Prefixer, doc Doc, old Doc) error {
+		events = append(events, doc.ID()+" "+old.Rev()+" -> "+doc.Rev())
+		return nil
+	})
+
+	report, err := ResolveConflicts(TestPrefix, doctype)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Conflicted)
+	assert.Equal(t, []string{"a"}, report.Resolved)
+	if assert.Len(t, report.Unresolved, 2) {
+		assert.Equal(t, "c", report.Unresolved[0].ID)
+		assert.Contains(t, report.Unresolved[0].Reason, "name")
+		assert.Equal(t, "e", report.Unresolved[1].ID)
+		assert.Contains(t, report.Unresolved[1].Reason, "2-missing")
+	}
+
+	// The winner and the deletion are written with a single request
+	if assert.Len(t, c.bulks, 1) {
+		assert.Equal(t, []map[string]interface{}{
+			{"_id": "a", "_rev": "2-a", "name": "foo", "color": "red"},
+			{"_id": "a", "_rev": "2-b", "_deleted": true},
+		}, c.bulks[0])
+	}
+	assert.Equal(t, []string{"a 2-a -> 3-new"}, events)
+
+	// A write rejected by CouchDB leaves the document unresolved
+	c.fail = true
+	report, err = ResolveConflicts(TestPrefix, doctype)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Resolved)
+	if assert.Len(t, report.Unresolved, 3) {
+		assert.Equal(t, "a", report.Unresolved[0].ID)
+		assert.Contains(t, report.Unresolved[0].Reason, "conflict")
+	}
+	assert.Len(t, events, 1)
+}
@@ -0,0 +1,247 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/tlsclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingListener counts the connections accepted by a test server.
+type countingListener struct {
+	net.Listener
+	count int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.count, 1)
+	}
+	return conn, err
+}
+
+func TestConnectionReuse(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			// Not decoded by the client
+			_, _ = w.Write([]byte(`{"ok":true}`))
+		case strings.Contains(r.URL.Path, "missing"):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+		default:
+			// Some bytes are left after the JSON object by the decoder
+			_, _ = w.Write([]byte(`{"db_name":"foo"}` + strings.Repeat(" ", 32*1024) + "\n"))
+		}
+	}))
+	listener := &countingListener{Listener: ts.Listener}
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+
+	client, _, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
+		MaxIdleConnsPerHost: 10,
+	})
+	assert.NoError(t, err)
+	couch := config.GetConfig().CouchDB
+	defer func() { config.GetConfig().CouchDB = couch }()
+	config.GetConfig().CouchDB.URL, _ = url.Parse(ts.URL + "/")
+	config.GetConfig().CouchDB.Client = client
+
+	for i := 0; i < 5; i++ {
+		_, err = DBStatus(TestPrefix, TestDoctype)
+		assert.NoError(t, err)
+		err = DeleteDB(TestPrefix, TestDoctype)
+		assert.NoError(t, err)
+		var doc JSONDoc
+		err = GetDoc(TestPrefix, TestDoctype, "missing", &doc)
+		assert.True(t, IsNotFoundError(err))
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&listener.count))
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "couchdb")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "couchdb.sock")
+	ln, err := net.Listen("unix", socket)
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_changes"):
+			_, _ = w.Write([]byte(`{"results":[{"seq":"1-a","id":"foo","changes":[{"rev":"1-abc"}]}],"last_seq":"1-a"}`))
+		default:
+			_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc"}`))
+		}
+	})}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	endpoint := tlsclient.HTTPEndpoint{UnixSockets: map[string]string{"unix-socket-1": socket}}
+	client, _, err := tlsclient.NewHTTPClient(endpoint)
+	assert.NoError(t, err)
+	endpoint.DisableHTTP2 = true
+	streaming, _, err := tlsclient.NewHTTPClient(endpoint)
+	assert.NoError(t, err)
+	couch := config.GetConfig().CouchDB
+	defer func() { config.GetConfig().CouchDB = couch }()
+	config.GetConfig().CouchDB.URL, _ = url.Parse("http://unix-socket-1/")
+	config.GetConfig().CouchDB.Client = client
+	config.GetConfig().CouchDB.StreamingClient = streaming
+
+	var doc JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &doc))
+	assert.Equal(t, "1-abc", doc.Rev())
+
+	ctx := WithIdleTimeout(context.Background(), time.Minute)
+	var ids []string
+	_, err = ForeachChangeContext(ctx, TestPrefix, &ChangesRequest{DocType: TestDoctype}, func(change *Change) error {
+		ids = append(ids, change.DocID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, ids)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/data/io.cozy.testobject/foo", nil)
+	Proxy(TestPrefix, TestDoctype, "foo").ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "1-abc")
+}
+
+func TestURLPrefix(t *testing.T) {
+	for _, base := range []string{"/", "/couchdb", "/couchdb/"} {
+		prefix := strings.TrimSuffix(base, "/")
+		var paths []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.Method+" "+r.URL.EscapedPath())
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/_changes"):
+				_, _ = w.Write([]byte(`{"results":[],"last_seq":"1-a"}`))
+			case strings.HasSuffix(r.URL.Path, "/_session"):
+				http.SetCookie(w, &http.Cookie{Name: "AuthSession", Value: "abc"})
+				_, _ = w.Write([]byte(`{"ok":true}`))
+			default:
+				_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc","status":"ok"}`))
+			}
+		}))
+		couch := config.GetConfig().CouchDB
+		config.GetConfig().CouchDB.URL, _ = url.Parse(ts.URL + base)
+		config.GetConfig().CouchDB.Client = ts.Client()
+		config.GetConfig().CouchDB.Auth = url.UserPassword("admin", "secret")
+		config.GetConfig().CouchDB.SessionAuth = true
+		sessions.reset()
+
+		var doc JSONDoc
+		assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &doc))
+		ctx := WithIdleTimeout(context.Background(), time.Minute)
+		_, err := ForeachChangeContext(ctx, TestPrefix, &ChangesRequest{DocType: TestDoctype}, func(change *Change) error {
+			return nil
+		})
+		assert.NoError(t, err)
+		_, err = CheckStatus()
+		assert.NoError(t, err)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/data/io.cozy.testobject/foo", nil)
+		Proxy(TestPrefix, TestDoctype, "foo").ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, []string{
+			"POST " + prefix + "/_session",
+			"GET " + prefix + "/couchdb-tests%2Fio-cozy-testobject/foo",
+			"GET " + prefix + "/couchdb-tests%2Fio-cozy-testobject/_changes",
+			"GET " + prefix + "/_up",
+			"GET " + prefix + "/couchdb-tests%2Fio-cozy-testobject/foo",
+		}, paths, base)
+
+		config.GetConfig().CouchDB = couch
+		sessions.reset()
+		ts.Close()
+	}
+}
+
+func TestNoLeaks(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_all_docs"):
+			_, _ = w.Write([]byte(`{"rows":[{"id":"a","doc":{}},{"id":"b","doc":{}},{"id":"c","doc":{}}]}`))
+		case strings.HasSuffix(r.URL.Path, "/missing"):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+		case strings.HasSuffix(r.URL.Path, "/broken"):
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"unknown_error","reason":"function_clause"}`))
+		case strings.HasSuffix(r.URL.Path, "/truncated"):
+			_, _ = w.Write([]byte(`{"_id":"truncated","_rev":`))
+		default:
+			_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc"}`))
+		}
+	}))
+	listener := &countingListener{Listener: ts.Listener}
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+
+	client, _, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
+		MaxIdleConnsPerHost: 10,
+	})
+	assert.NoError(t, err)
+	couch := config.GetConfig().CouchDB
+	defer func() { config.GetConfig().CouchDB = couch }()
+	config.GetConfig().CouchDB.URL, _ = url.Parse(ts.URL + "/")
+	config.GetConfig().CouchDB.Client = client
+	config.GetConfig().CouchDB.CircuitBreaker.Threshold = 0
+
+	before := runtime.NumGoroutine()
+	errStop := errors.New("stop")
+	for i := 0; i < 1000; i++ {
+		var doc JSONDoc
+		switch i % 5 {
+		case 0:
+			assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &doc))
+		case 1:
+			err = GetDoc(TestPrefix, TestDoctype, "missing", &doc)
+			assert.True(t, IsNotFoundError(err))
+		case 2:
+			err = GetDoc(TestPrefix, TestDoctype, "broken", &doc)
+			assert.True(t, IsInternalServerError(err))
+		case 3:
+			assert.Error(t, GetDoc(TestPrefix, TestDoctype, "truncated", &doc))
+		case 4:
+			// The callback stops before the end of the response
+			err = ForeachDocs(TestPrefix, TestDoctype, func(id string, doc json.RawMessage) error {
+				return errStop
+			})
+			assert.Equal(t, errStop, err)
+		}
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&listener.count))
+
+	client.CloseIdleConnections()
+	ts.Close()
+	// Let the goroutines of the connections finish
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
@@ -0,0 +1,187 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	// MismatchWrongPrefix is the kind of mismatch of a document whose _id is
+	// prefixed by another doctype than the one of its database.
+	MismatchWrongPrefix = "wrong_prefix"
+	// MismatchMissingDoctype is the kind of mismatch of a document without
+	// the doctype field.
+	MismatchMissingDoctype = "missing_doctype"
+	// MismatchWrongDoctype is the kind of mismatch of a document whose
+	// doctype field is not the doctype of its database.
+	MismatchWrongDoctype = "wrong_doctype"
+)
+
+// consistencyPageSize is the number of documents fetched per page by
+// VerifyDoctypeConsistency.
+const consistencyPageSize = 1000
+
+// errScanLimit stops a scan when the limit of documents has been reached.
+var errScanLimit = errors.New("CouchDB: scan limit reached")
+
+// ConsistencyOptions are the options of VerifyDoctypeConsistency.
+type ConsistencyOptions struct {
+	// Field is the name of the field where the documents keep their doctype.
+	// The stack does not persist the doctype (_type is a reserved key), so
+	// the field is checked only if it is given, for the doctypes where the
+	// clients store it.
+	Field string
+	// Repair sets the field on the documents where it is missing or wrong.
+	Repair bool
+	// StartAfter is the identifier of the last document scanned by a
+	// previous run, to resume the scan after it.
+	StartAfter string
+	// Limit is the maximum number of documents scanned by this run (no
+	// limit if 0).
+	Limit int
+}
+
+// ConsistencyMismatch is a document that does not agree with its database.
+type ConsistencyMismatch struct {
+	ID string `json:"id"`
+	// Kind is MismatchWrongPrefix, MismatchMissingDoctype or
+	// MismatchWrongDoctype
+	Kind string `json:"kind"`
+	// Found is the doctype found in the _id or in the field, if any
+	Found string `json:"found,omitempty"`
+	// Reason explains why an unfixable mismatch has not been repaired
+	Reason string `json:"reason,omitempty"`
+}
+
+// ConsistencyReport is the result of VerifyDoctypeConsistency.
+type ConsistencyReport struct {
+	Doctype string `json:"doctype"`
+	// Scanned is the number of documents scanned by this run
+	Scanned int `json:"scanned"`
+	// Mismatches are all the mismatches found by this run
+	Mismatches []ConsistencyMismatch `json:"mismatches,omitempty"`
+	// Repaired are the identifiers of the documents repaired
+	Repaired []string `json:"repaired,omitempty"`
+	// Unfixable are the mismatches to review manually
+	Unfixable []ConsistencyMismatch `json:"unfixable,omitempty"`
+	// LastID is the identifier of the last document scanned, to give as
+	// StartAfter to resume the scan
+	LastID string `json:"last_id,omitempty"`
+	// Done is true when the scan has reached the end of the database
+	Done bool `json:"done"`
+}
+
+// VerifyDoctypeConsistency calls VerifyDoctypeConsistencyContext with a
+// background context.
+func VerifyDoctypeConsistency(db Database, doctype string, opts *ConsistencyOptions) (*ConsistencyReport, error) {
+	return VerifyDoctypeConsistencyContext(context.Background(), db, doctype, opts)
+}
+
+// VerifyDoctypeConsistencyContext scans the documents of a doctype, and
+// reports those that do not agree with their database: an _id prefixed by
+// another doctype, or a doctype field missing or wrong. With Repair, the
+// field is set on the documents in bulk, and the documents that cannot be
+// repaired (like a wrong prefix, as the _id cannot be changed) are listed as
+// unfixable. A large database can be scanned in several runs, with Limit and
+// StartAfter set to the LastID of the previous report. The report is
+// returned even with an error.
+func VerifyDoctypeConsistencyContext(ctx context.Context, db Database, doctype string, opts *ConsistencyOptions) (*ConsistencyReport, error) {
+	if opts == nil {
+		opts = &ConsistencyOptions{}
+	}
+	report := &ConsistencyReport{Doctype: doctype, LastID: opts.StartAfter}
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := repairConsistency(ctx, db, doctype, batch, report)
+		batch = batch[:0]
+		return err
+	}
+
+	err := foreachDocsAfter(ctx, db, doctype, consistencyPageSize, opts.StartAfter, func(id string, raw json.RawMessage) error {
+		if opts.Limit > 0 && report.Scanned >= opts.Limit {
+			return errScanLimit
+		}
+		report.Scanned++
+		report.LastID = id
+		if found := idDoctype(id); found != "" && found != doctype {
+			m := ConsistencyMismatch{ID: id, Kind: MismatchWrongPrefix, Found: found}
+			report.Mismatches = append(report.Mismatches, m)
+			m.Reason = "the _id cannot be changed"
+			report.Unfixable = append(report.Unfixable, m)
+		}
+		if opts.Field == "" {
+			return nil
+		}
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		m := ConsistencyMismatch{ID: id}
+		var found string
+		if value, ok := doc[opts.Field]; !ok {
+			m.Kind = MismatchMissingDoctype
+		} else if err := json.Unmarshal(value, &found); err != nil || found != doctype {
+			m.Kind = MismatchWrongDoctype
+			m.Found = found
+		} else {
+			return nil
+		}
+		report.Mismatches = append(report.Mismatches, m)
+		if !opts.Repair {
+			return nil
+		}
+		doc[opts.Field], _ = json.Marshal(doctype)
+		batch = append(batch, doc)
+		if len(batch) >= seqPageSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		report.Done = true
+	} else if err != errScanLimit {
+		return report, err
+	}
+	return report, flush()
+}
+
+// repairConsistency writes the repaired documents, and lists those that
+// have been rejected by CouchDB as unfixable.
+func repairConsistency(ctx context.Context, db Database, doctype string, batch []interface{}, report *ConsistencyReport) error {
+	var rows []UpdateResponse
+	err := makeRequest(ctx, db, doctype, http.MethodPost, "_bulk_docs", newBulkDocsBody(batch), &rows)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if row.Error == "" {
+			report.Repaired = append(report.Repaired, row.ID)
+			continue
+		}
+		for _, m := range report.Mismatches {
+			if m.ID == row.ID && m.Kind != MismatchWrongPrefix {
+				m.Reason = newBulkRowError(row).Error()
+				report.Unfixable = append(report.Unfixable, m)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// idDoctype returns the doctype of the prefix of an identifier, like
+// io.cozy.files for io.cozy.files/123, or an empty string if it has none.
+// The generated identifiers have no slash apart from this prefix.
+func idDoctype(id string) string {
+	i := strings.LastIndex(id, "/")
+	if i <= 0 || !strings.Contains(id[:i], ".") {
+		return ""
+	}
+	return id[:i]
+}
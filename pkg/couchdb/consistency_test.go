@@ -0,0 +1,75 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyDoctypeConsistency(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := newMemCouch()
+	restore := useTestServer(t, server)
+	defer restore()
+
+	db := prefixer.NewPrefixer("consistency.cozy.tools", "consistency")
+	doctype := "io.cozy.tests.notes"
+	server.seed(db, doctype,
+		`{"_id":"io.cozy.tests.notes/1","doctype":"io.cozy.tests.notes"}`,
+		`{"_id":"io.cozy.tests.todos/2","doctype":"io.cozy.tests.notes"}`,
+		`{"_id":"note3"}`,
+		`{"_id":"note4","doctype":"io.cozy.tests.todos"}`,
+		`{"_id":"note5","doctype":"io.cozy.tests.notes"}`,
+	)
+
+	// Without a field, only the prefixes are checked
+	report, err := VerifyDoctypeConsistency(db, doctype, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, report.Scanned)
+	assert.True(t, report.Done)
+	assert.Equal(t, []ConsistencyMismatch{
+		{ID: "io.cozy.tests.todos/2", Kind: MismatchWrongPrefix, Found: "io.cozy.tests.todos"},
+	}, report.Mismatches)
+	assert.Len(t, report.Unfixable, 1)
+
+	// The scan is resumable
+	opts := &ConsistencyOptions{Field: "doctype", Limit: 3}
+	report, err = VerifyDoctypeConsistency(db, doctype, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Scanned)
+	assert.False(t, report.Done)
+	assert.Equal(t, "note3", report.LastID)
+	assert.Len(t, report.Mismatches, 2)
+	opts.StartAfter = report.LastID
+	report, err = VerifyDoctypeConsistency(db, doctype, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Scanned)
+	assert.True(t, report.Done)
+	assert.Equal(t, []ConsistencyMismatch{
+		{ID: "note4", Kind: MismatchWrongDoctype, Found: "io.cozy.tests.todos"},
+	}, report.Mismatches)
+	assert.Empty(t, report.Repaired)
+
+	// The repair sets the field, but cannot fix the prefixes
+	report, err = VerifyDoctypeConsistency(db, doctype, &ConsistencyOptions{Field: "doctype", Repair: true})
+	assert.NoError(t, err)
+	assert.Len(t, report.Mismatches, 3)
+	assert.Equal(t, []string{"note3", "note4"}, report.Repaired)
+	if assert.Len(t, report.Unfixable, 1) {
+		assert.Equal(t, "io.cozy.tests.todos/2", report.Unfixable[0].ID)
+		assert.NotEmpty(t, report.Unfixable[0].Reason)
+	}
+	notes := server.dbs[EscapeCouchdbName(db.DBPrefix()+"/"+doctype)]
+	assert.JSONEq(t, `"io.cozy.tests.notes"`, string(notes["note3"]["doctype"]))
+	assert.JSONEq(t, `"io.cozy.tests.notes"`, string(notes["note4"]["doctype"]))
+
+	data, err := json.Marshal(report)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"last_id":"note5"`)
+
+	report, err = VerifyDoctypeConsistency(db, doctype, &ConsistencyOptions{Field: "doctype"})
+	assert.NoError(t, err)
+	assert.Len(t, report.Mismatches, 1)
+}
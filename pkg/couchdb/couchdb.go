@@ -2,8 +2,10 @@ package couchdb
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -12,7 +14,6 @@ import (
 	"time"
 
 	build "github.com/cozy/cozy-stack/pkg/config"
-	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -58,11 +59,11 @@ func newDatabase(prefix string) prefixer.Prefixer {
 // RTEvent published a realtime event for a couchDB change
 func RTEvent(db Database, verb string, doc, oldDoc Doc) {
 	if err := runHooks(db, verb, doc, oldDoc); err != nil {
-		logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb").
-			Errorf("error in hooks on %s %s %v\n", verb, doc.DocType(), err)
+		loggerFor(db).Errorf("error in hooks on %s %s %v", verb, doc.DocType(), err)
 	}
 	docClone := doc.Clone()
 	go realtime.GetHub().Publish(db, verb, docClone, oldDoc)
+	publishEvent(db, verb, docClone, oldDoc)
 }
 
 // GlobalDB is the prefix used for stack-scoped db
@@ -87,37 +88,82 @@ type JSONDoc struct {
 	Type string
 }
 
-// ID returns the identifier field of the document
+// ID returns the identifier field of the document, or "" if it is missing
+// or is not a string
 //   "io.cozy.event/123abc123" == doc.ID()
 func (j *JSONDoc) ID() string {
-	id, ok := j.M["_id"].(string)
-	if ok {
-		return id
-	}
-	return ""
+	id, _ := j.IDOk()
+	return id
 }
 
-// Rev returns the revision field of the document
+// IDOk returns the identifier field of the document, and false if it is
+// missing or is not a string.
+func (j *JSONDoc) IDOk() (string, bool) {
+	return j.stringField("_id")
+}
+
+// Rev returns the revision field of the document, or "" if it is missing or
+// is not a string
 //   "3-1234def1234" == doc.Rev()
 func (j *JSONDoc) Rev() string {
-	rev, ok := j.M["_rev"].(string)
-	if ok {
-		return rev
+	rev, _ := j.RevOk()
+	return rev
+}
+
+// RevOk returns the revision field of the document, and false if it is
+// missing or is not a string.
+func (j *JSONDoc) RevOk() (string, bool) {
+	return j.stringField("_rev")
+}
+
+func (j *JSONDoc) stringField(key string) (string, bool) {
+	if j == nil {
+		return "", false
 	}
-	return ""
+	value, ok := j.M[key].(string)
+	return value, ok
 }
 
 // DocType returns the document type of the document
 //   "io.cozy.event" == doc.Doctype()
 func (j *JSONDoc) DocType() string {
+	if j == nil {
+		return ""
+	}
 	return j.Type
 }
 
+// Validate checks that the document has the minimal shape to be saved in
+// CouchDB: a doctype, and an _id and a _rev that are strings if they are
+// present.
+func (j *JSONDoc) Validate() error {
+	if j == nil || j.M == nil {
+		return newInvalidDocError("the document is empty")
+	}
+	if j.Type == "" {
+		return newInvalidDocError("the document has no doctype")
+	}
+	if _, ok := j.M["_id"]; ok {
+		if _, ok := j.IDOk(); !ok {
+			return newInvalidDocError("the _id of the document is not a string")
+		}
+	}
+	if _, ok := j.M["_rev"]; ok {
+		if _, ok := j.RevOk(); !ok {
+			return newInvalidDocError("the _rev of the document is not a string")
+		}
+	}
+	return nil
+}
+
 // SetID is used to set the identifier of the document
 func (j *JSONDoc) SetID(id string) {
 	if id == "" {
 		delete(j.M, "_id")
 	} else {
+		if j.M == nil {
+			j.M = make(map[string]interface{})
+		}
 		j.M["_id"] = id
 	}
 }
@@ -127,6 +173,9 @@ func (j *JSONDoc) SetRev(rev string) {
 	if rev == "" {
 		delete(j.M, "_rev")
 	} else {
+		if j.M == nil {
+			j.M = make(map[string]interface{})
+		}
 		j.M["_rev"] = rev
 	}
 }
@@ -166,9 +215,10 @@ func deepCloneSlice(s []interface{}) []interface{} {
 	return clone
 }
 
-// MarshalJSON implements json.Marshaller by proxying to internal map
+// MarshalJSON implements json.Marshaller by proxying to internal map. The
+// keys reserved for the stack, like _type, are not written.
 func (j *JSONDoc) MarshalJSON() ([]byte, error) {
-	return json.Marshal(j.M)
+	return json.Marshal(j.withoutReservedKeys())
 }
 
 // UnmarshalJSON implements json.Unmarshaller by proxying to internal map
@@ -177,23 +227,46 @@ func (j *JSONDoc) UnmarshalJSON(bytes []byte) error {
 	if err != nil {
 		return err
 	}
+	j.extractType()
+	return nil
+}
+
+// decodeResponse is used when a JSONDoc is fetched from CouchDB. The numbers
+// are kept as json.Number, so that the big integers (above 2^53) are not
+// rounded, and are written back with their original digits.
+func (j *JSONDoc) decodeResponse(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&j.M); err != nil {
+		return err
+	}
+	j.extractType()
+	return nil
+}
+
+func (j *JSONDoc) extractType() {
 	doctype, ok := j.M["_type"].(string)
 	if ok {
 		j.Type = doctype
 	}
 	delete(j.M, "_type")
-	return nil
 }
 
 // ToMapWithType returns the JSONDoc internal map including its DocType
 // its used in request response.
 func (j *JSONDoc) ToMapWithType() map[string]interface{} {
+	if j.M == nil {
+		j.M = make(map[string]interface{})
+	}
 	j.M["_type"] = j.DocType()
 	return j.M
 }
 
 // Get returns the value of one of the db fields
 func (j *JSONDoc) Get(key string) interface{} {
+	if j == nil {
+		return nil
+	}
 	return j.M[key]
 }
 
@@ -251,145 +324,412 @@ func dbNameHasPrefix(dbname, dbprefix string) (bool, string) {
 	return true, strings.Replace(dbname, dbprefix, "", 1)
 }
 
-func makeRequest(db Database, doctype, method, path string, reqbody interface{}, resbody interface{}) error {
+func makeRequest(ctx context.Context, db Database, doctype, method, path string, reqbody interface{}, resbody interface{}) (err error) {
 	var reqjson []byte
-	var err error
-
-	if reqbody != nil {
-		reqjson, err = json.Marshal(reqbody)
+	var pooled *requestBody
+	defer func() {
+		addRequestContext(err, method, doctype)
+		addAuthContext(err, db)
+	}()
+
+	var ifMatch string
+	reqbody, ifMatch = unwrapIfMatch(reqbody)
+	stream, _ := reqbody.(*streamedBody)
+	bulk, _ := reqbody.(*bulkDocsBody)
+	var encoded *encodedBody
+	if stream != nil {
+		// The body is encoded by the caller while it is sent, so it can be
+		// sent only once
+		ctx = WithRetryPolicy(ctx, RetryNever)
+	} else if bulk != nil && canStreamBody(ctx, db, doctype) {
+		pooled, encoded, err = encodeBulkDocs(ctx, bulk)
+		if err != nil {
+			loggerFor(db).Warnf("request %s %s not sent: %s", method, doctype, err)
+			return err
+		}
+		if pooled != nil {
+			defer pooled.release()
+			reqjson = pooled.data
+		}
+	} else if reqbody != nil {
+		pooled, err = marshalRequest(reqbody)
+		if err != nil {
+			return err
+		}
+		defer pooled.release()
+		reqjson, err = encryptRequest(doctype, method, path, pooled.data)
 		if err != nil {
 			return err
 		}
+		pooled.data = reqjson
+		if err = checkDocumentSize(ctx, method, path, reqjson); err != nil {
+			loggerFor(db).Warnf("request %s %s not sent: %s", method, doctype, err)
+			return err
+		}
+	}
+
+	if isWrite(method, path) {
+		if report := dryRunFor(ctx); report != nil {
+			if stream != nil {
+				if reqjson, err = ioutil.ReadAll(stream.r); err != nil {
+					return err
+				}
+			}
+			fakePath := path
+			if ifMatch != "" {
+				// The fake writes read the revision from the query string
+				fakePath += "?rev=" + url.QueryEscape(ifMatch)
+			}
+			report.fake(method, doctype, fakePath, reqjson, resbody)
+			return nil
+		}
+		if isReadOnly(db) {
+			return newReadOnlyError()
+		}
+		if err = checkQuota(ctx, db, method, path, reqjson, bulk); err != nil {
+			loggerFor(db).Warnf("request %s %s not sent: %s", method, doctype, err)
+			return err
+		}
+		defer invalidateDocCache(db, doctype, path)
+	}
+	if doctype != "" {
+		dbPath := path
+		defer func() { trackKnownDB(db, doctype, method, dbPath, err) }()
 	}
 
+	ctx = withRequestInfo(ctx, doctype, path)
 	if doctype != "" {
 		path = makeDBName(db, doctype) + "/" + path
 	}
+	ctx = withCluster(ctx, clusterFor(ctx, doctype))
+	ctx = withDatabase(ctx, db)
 
-	log := logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb")
-
-	// We do not log the account doctype to avoid printing account informations
-	// in the log files.
-	logDebug := doctype != accountDocType && logger.IsDebug(log)
+	log := loggerFor(db)
+	verbose := logBodies(log, doctype)
+	if verbose {
+		log.Debugf("request: %s %s %s", method, path, redactBody(reqjson))
+	}
 
-	if logDebug {
-		log.Debugf("request: %s %s %s", method, path, string(bytes.TrimSpace(reqjson)))
+	if err = waitRateLimit(ctx, db); err != nil {
+		observeError(ErrorKindRateLimited)
+		log.Warnf("request %s %s not sent: %s", method, path, err)
+		return err
 	}
 
-	req, err := http.NewRequest(
-		method,
-		config.CouchURL().String()+path,
-		bytes.NewReader(reqjson),
-	)
-	// Possible err = wrong method, unparsable url
+	release, err := acquireSlot(ctx, db)
 	if err != nil {
-		return newRequestError(err)
-	}
-	req.Header.Add("Accept", "application/json")
-	if reqbody != nil {
-		req.Header.Add("Content-Type", "application/json")
+		if _, ok := err.(*Error); ok {
+			observeError(ErrorKindTooManyRequests)
+		}
+		log.Warnf("request %s %s not sent: %s", method, path, err)
+		return err
 	}
+	defer release()
 
-	auth := config.GetConfig().CouchDB.Auth
-	if auth != nil {
-		if p, ok := auth.Password(); ok {
-			req.SetBasicAuth(auth.Username(), p)
-		}
+	if isStreaming(ctx) {
+		defer observeFeed(doctype)()
 	}
+
+	defer trackInFlight(method)()
+
+	reqID := requestIDFor(ctx)
 	start := time.Now()
-	resp, err := config.GetConfig().CouchDB.Client.Do(req)
+	idempotent := isIdempotent(method, path, reqbody) || ifMatch != ""
+	resp, watchdog, err := sendWithRetry(ctx, db, doctype, log, idempotent, func(ctx context.Context, node *url.URL) (*http.Request, error) {
+		var body io.ReadCloser
+		if pooled != nil {
+			body = pooled.reader()
+		} else if stream != nil {
+			body = stream.r
+		} else if encoded != nil {
+			if err := encoded.error(); err != nil {
+				return nil, err
+			}
+			body = encoded.reader()
+		}
+		req, err := http.NewRequestWithContext(ctx, method, nodeURL(node, path), body)
+		// Possible err = wrong method, unparsable url
+		if err != nil {
+			if body != nil {
+				body.Close()
+			}
+			return nil, err
+		}
+		if pooled != nil {
+			req.ContentLength = int64(len(reqjson))
+			req.GetBody = func() (io.ReadCloser, error) {
+				return pooled.reader(), nil
+			}
+		} else if encoded != nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				return encoded.reader(), nil
+			}
+		}
+		req.Header.Add("Accept", "application/json")
+		req.Header.Set(RequestIDHeader, reqID)
+		acceptGzip(req)
+		if cond, ok := resbody.(conditionalResponse); ok && cond.ifNoneMatch() != "" {
+			req.Header.Set("If-None-Match", cond.ifNoneMatch())
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		if reqbody != nil {
+			req.Header.Add("Content-Type", "application/json")
+		}
+		countWritten(len(reqjson))
+		return req, nil
+	})
 	elapsed := time.Since(start)
+	if encoded != nil && encoded.error() != nil {
+		// The request has been interrupted by the encoding of its body
+		if resp != nil {
+			drainAndClose(resp.Body)
+		}
+		if watchdog != nil {
+			watchdog.stop()
+		}
+		err = encoded.error()
+		log.Warnf("%s %s not sent: %s (request %s)", method, path, err, reqID)
+		return err
+	}
+	if hookErr, ok := err.(*hookError); ok {
+		log.Warnf("%s %s not sent: %s (request %s)", method, path, hookErr.err, reqID)
+		return hookErr.err
+	}
 	// Possible err = mostly connection failure
 	if err != nil {
-		err = newConnectionError(err)
-		log.Error(err.Error())
+		if watchdog != nil {
+			watchdog.stop()
+		}
+		kind := ErrorKindConnection
+		if couchErr, ok := IsCouchError(err); !ok {
+			err = newConnectionError(err)
+		} else if couchErr.Reason == "could not create a request to the server" {
+			kind = ErrorKindRequest
+		} else if couchErr.Name == "circuit_open" {
+			kind = ErrorKindCircuitOpen
+		}
+		if kind == ErrorKindConnection {
+			metricsCollector.ObserveRequest(method, doctype, 0, elapsed)
+		}
+		if couchErr, ok := IsCouchError(err); ok && couchErr.RequestID == "" {
+			couchErr.RequestID = reqID
+		}
+		observeError(kind)
+		log.Errorf("%s %s: %s (request %s)", method, path, err, reqID)
+		return err
+	}
+	reqID = responseRequestID(resp, reqID)
+	metricsCollector.ObserveRequest(method, doctype, resp.StatusCode, elapsed)
+	resp.Body = countRead(watchdog.body(resp.Body))
+	// The body is drained, even when it is not decoded or when the decoder
+	// stops before the end, so that the connection can be reused
+	defer drainAndClose(resp.Body)
+	decoded, err := decompressBody(resp)
+	if err != nil {
+		err = newIOReadError(err)
+		observeError(ErrorKindRead)
+		log.Errorf("%s %s: %s (request %s)", method, path, err, reqID)
 		return err
 	}
-	defer resp.Body.Close()
+	resp.Body = decoded
+	if _, ok := resbody.(*rowStream); !ok && !isStreaming(ctx) {
+		// The rows streams keep only one row in memory at a time
+		resp.Body = limitResponse(resp.Body)
+	}
 
-	if elapsed.Seconds() >= 10 {
-		log.Printf("slow request on %s %s (%s)", method, path, elapsed)
+	if cond, ok := resbody.(conditionalResponse); ok {
+		if resp.StatusCode == http.StatusNotModified {
+			cond.setNotModified()
+			return nil
+		}
+		cond.setETag(resp.Header.Get("ETag"))
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		var body []byte
-		body, err = ioutil.ReadAll(resp.Body)
+		body, err = readErrorBody(resp.Body)
 		if err != nil {
 			err = newIOReadError(err)
-			log.Error(err.Error())
+			observeError(ErrorKindRead)
+			log.Errorf("%s %s: %s (request %s)", method, path, err, reqID)
 		} else {
 			err = newCouchdbError(resp.StatusCode, body)
-			log.Debug(err.Error())
+			if ifMatch != "" {
+				err = conflictOnPrecondition(err.(*Error))
+			}
+			observeError(ErrorKindCouchDB)
+			log.Debugf("%s %s: %s (request %s)", method, path, err, reqID)
 		}
+		err.(*Error).RequestID = reqID
 		return err
 	}
 	if resbody == nil {
 		return nil
 	}
 
-	if logDebug {
+	if verbose {
 		var data []byte
 		data, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
+			observeError(ErrorKindRead)
 			return err
 		}
-		log.Debugf("response: %s", string(bytes.TrimSpace(data)))
-		err = json.Unmarshal(data, &resbody)
+		log.Debugf("response: %s", redactBody(data))
+		err = decodeResponse(decryptedBody(ctx, doctype, bytes.NewReader(data)), resbody)
 	} else {
-		err = json.NewDecoder(resp.Body).Decode(&resbody)
+		err = decodeResponse(decryptedBody(ctx, doctype, resp.Body), resbody)
+	}
+	if cbErr, ok := err.(*callbackError); ok {
+		// The error comes from the caller, not from the response
+		return cbErr.err
+	}
+	if fieldErr, ok := err.(*UnknownFieldError); ok {
+		// The response is fine, it is the document that has an unknown field
+		log.Warnf("%s %s: %s (request %s)", method, path, fieldErr, reqID)
+		return fieldErr
+	}
+	if couchErr, ok := err.(*Error); ok && couchErr.Name == "response_too_large" {
+		couchErr.RequestID = reqID
+		observeError(ErrorKindRead)
+		log.Warnf("%s %s: %s (request %s)", method, path, err, reqID)
+		return err
+	}
+	if err != nil {
+		observeError(ErrorKindDecode)
+		if isStreaming(ctx) && ctx.Err() == nil {
+			// The feed has been interrupted by the node
+			recordNode(resp.Request.URL.Host, true)
+		}
+	} else if setter, ok := resbody.(statusSetter); ok {
+		setter.setStatus(resp.StatusCode)
 	}
 
 	return err
 }
 
-// UUID requests a Universally Unique Identifier (UUID) from CouchDB.
+// UUID calls UUIDContext with a background context. It is kept for
+// compatibility, new code should use UUIDContext.
+//
+// Deprecated: use UUIDContext.
 func UUID(db Database) (string, error) {
+	return UUIDContext(context.Background(), db)
+}
+
+// UUIDContext requests a Universally Unique Identifier (UUID) from CouchDB.
+func UUIDContext(ctx context.Context, db Database) (string, error) {
 	var out UUIDResponse
-	if err := makeRequest(db, "", http.MethodGet, "_uuids", nil, &out); err != nil {
+	if err := makeRequest(ctx, db, "", http.MethodGet, "_uuids", nil, &out); err != nil {
 		return "", err
 	}
 	return out.UUIDs[0], nil
 }
 
-// DBStatus responds with informations on the database: size, number of
-// documents, sequence numbers, etc.
+// DBStatus calls DBStatusContext with a background context. It is kept for
+// compatibility, new code should use DBStatusContext.
+//
+// Deprecated: use DBStatusContext.
 func DBStatus(db Database, doctype string) (*DBStatusResponse, error) {
+	return DBStatusContext(context.Background(), db, doctype)
+}
+
+// DBStatusContext responds with informations on the database: size, number of
+// documents, sequence numbers, etc.
+func DBStatusContext(ctx context.Context, db Database, doctype string) (*DBStatusResponse, error) {
 	var out DBStatusResponse
-	return &out, makeRequest(db, doctype, http.MethodGet, "", nil, &out)
+	return &out, makeRequest(ctx, db, doctype, http.MethodGet, "", nil, &out)
 }
 
-func allDbs(db Database) ([]string, error) {
+func allDbs(ctx context.Context, db Database) ([]string, error) {
 	var dbs []string
 	prefix := EscapeCouchdbName(db.DBPrefix())
 	u := fmt.Sprintf(`_all_dbs?start_key="%s"&end_key="%s"`, prefix+"/", prefix+"0")
-	if err := makeRequest(db, "", http.MethodGet, u, nil, &dbs); err != nil {
+	if err := makeRequest(ctx, db, "", http.MethodGet, u, nil, &dbs); err != nil {
 		return nil, err
 	}
 	return dbs, nil
 }
 
-// AllDoctypes returns a list of all the doctypes that have a database
-// on a given instance
-func AllDoctypes(db Database) ([]string, error) {
-	dbs, err := allDbs(db)
-	if err != nil {
-		return nil, err
+// forEachCluster calls fn for each CouchDB cluster, with a context where the
+// requests are sent to this cluster. It is used for the operations on all
+// the databases of an instance, which can be spread over several clusters.
+func forEachCluster(ctx context.Context, fn func(ctx context.Context) error) error {
+	for _, cl := range allClusters() {
+		if err := fn(withCluster(ctx, cl)); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// AllDoctypes calls AllDoctypesContext with a background context. It is kept
+// for compatibility, new code should use AllDoctypesContext.
+//
+// Deprecated: use AllDoctypesContext.
+func AllDoctypes(db Database) ([]string, error) {
+	return AllDoctypesContext(context.Background(), db)
+}
+
+// AllDoctypesContext returns a list of all the doctypes that have a database
+// on a given instance, on all the CouchDB clusters
+func AllDoctypesContext(ctx context.Context, db Database) ([]string, error) {
 	prefix := EscapeCouchdbName(db.DBPrefix())
+	seen := make(map[string]bool)
 	var doctypes []string
-	for _, dbname := range dbs {
-		parts := strings.Split(dbname, "/")
-		if len(parts) == 2 && parts[0] == prefix {
-			doctype := unescapeCouchdbName(parts[1])
-			doctypes = append(doctypes, doctype)
+	err := forEachCluster(ctx, func(ctx context.Context) error {
+		dbs, err := allDbs(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, dbname := range dbs {
+			parts := strings.Split(dbname, "/")
+			if len(parts) == 2 && parts[0] == prefix {
+				doctype := unescapeCouchdbName(parts[1])
+				if !seen[doctype] {
+					seen[doctype] = true
+					doctypes = append(doctypes, doctype)
+				}
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return doctypes, nil
 }
 
-// GetDoc fetches a document by its docType and id
-// It fills with out by json.Unmarshal-ing
+// GetDoc calls GetDocContext with a background context. It is kept for
+// compatibility, new code should use GetDocContext.
+//
+// Deprecated: use GetDocContext.
 func GetDoc(db Database, doctype, id string, out Doc) error {
+	return GetDocContext(context.Background(), db, doctype, id, out)
+}
+
+// GetDocContext fetches a document by its docType and id
+// It fills with out by json.Unmarshal-ing
+//
+// With the bare IDs mode, a document created with an identifier prefixed by
+// its doctype can be fetched with its bare identifier, and reciprocally.
+func GetDocContext(ctx context.Context, db Database, doctype, id string, out Doc) error {
+	err := defaultClient.GetDoc(ctx, db, doctype, id, out)
+	if IsDocNotFoundError(err) {
+		if legacy := legacyID(doctype, id); legacy != "" {
+			if errLegacy := defaultClient.GetDoc(ctx, db, doctype, legacy, out); !IsNotFoundError(errLegacy) {
+				return errLegacy
+			}
+		}
+		if couchErr, ok := IsCouchError(err); ok && couchErr.DocID == "" {
+			couchErr.DocID = id
+		}
+	}
+	return err
+}
+
+// GetDoc is part of the Client interface.
+func (couchClient) GetDoc(ctx context.Context, db Database, doctype, id string, out Doc) error {
 	var err error
 	id, err = validateDocID(id)
 	if err != nil {
@@ -398,12 +738,26 @@ func GetDoc(db Database, doctype, id string, out Doc) error {
 	if id == "" {
 		return fmt.Errorf("Missing ID for GetDoc")
 	}
-	return makeRequest(db, doctype, http.MethodGet, url.PathEscape(id), nil, out)
+	if c := getDocCache(); c != nil && isCachedDoctype(doctype) {
+		return getCachedDoc(ctx, c, db, doctype, id, out)
+	}
+	if c := getValidationCache(); c != nil && isValidatedDoctype(doctype) {
+		return getValidatedDoc(ctx, c, db, doctype, id, out)
+	}
+	return makeRequest(ctx, db, doctype, http.MethodGet, url.PathEscape(id), nil, strictOut(ctx, doctype, out))
 }
 
-// GetDocRev fetch a document by its docType and ID on a specific revision, out
-// is filled with the document by json.Unmarshal-ing
+// GetDocRev calls GetDocRevContext with a background context. It is kept for
+// compatibility, new code should use GetDocRevContext.
+//
+// Deprecated: use GetDocRevContext.
 func GetDocRev(db Database, doctype, id, rev string, out Doc) error {
+	return GetDocRevContext(context.Background(), db, doctype, id, rev, out)
+}
+
+// GetDocRevContext fetch a document by its docType and ID on a specific revision, out
+// is filled with the document by json.Unmarshal-ing
+func GetDocRevContext(ctx context.Context, db Database, doctype, id, rev string, out Doc) error {
 	var err error
 	id, err = validateDocID(id)
 	if err != nil {
@@ -413,13 +767,21 @@ func GetDocRev(db Database, doctype, id, rev string, out Doc) error {
 		return fmt.Errorf("Missing ID for GetDoc")
 	}
 	url := url.PathEscape(id) + "?rev=" + url.QueryEscape(rev)
-	return makeRequest(db, doctype, http.MethodGet, url, nil, out)
+	return makeRequest(ctx, db, doctype, http.MethodGet, url, nil, strictOut(ctx, doctype, out))
 }
 
-// GetDocWithRevs fetches a document by its docType and ID.
+// GetDocWithRevs calls GetDocWithRevsContext with a background context. It is
+// kept for compatibility, new code should use GetDocWithRevsContext.
+//
+// Deprecated: use GetDocWithRevsContext.
+func GetDocWithRevs(db Database, doctype, id string, out Doc) error {
+	return GetDocWithRevsContext(context.Background(), db, doctype, id, out)
+}
+
+// GetDocWithRevsContext fetches a document by its docType and ID.
 // out is filled with the document by json.Unmarshal-ing and contains the list
 // of all revisions
-func GetDocWithRevs(db Database, doctype, id string, out Doc) error {
+func GetDocWithRevsContext(ctx context.Context, db Database, doctype, id string, out Doc) error {
 	var err error
 	id, err = validateDocID(id)
 	if err != nil {
@@ -429,22 +791,54 @@ func GetDocWithRevs(db Database, doctype, id string, out Doc) error {
 		return fmt.Errorf("Missing ID for GetDoc")
 	}
 	url := url.PathEscape(id) + "?revs=true"
-	return makeRequest(db, doctype, http.MethodGet, url, nil, out)
+	return makeRequest(ctx, db, doctype, http.MethodGet, url, nil, strictOut(ctx, doctype, out))
 }
 
-// EnsureDBExist creates the database for the doctype if it doesn't exist
+// EnsureDBExist calls EnsureDBExistContext with a background context. It is
+// kept for compatibility, new code should use EnsureDBExistContext.
+//
+// Deprecated: use EnsureDBExistContext.
 func EnsureDBExist(db Database, doctype string) error {
-	if _, err := DBStatus(db, doctype); IsNoDatabaseError(err) {
-		if err = CreateDB(db, doctype); err != nil {
-			_, err = DBStatus(db, doctype)
+	return EnsureDBExistContext(context.Background(), db, doctype)
+}
+
+// EnsureDBExistContext creates the database for the doctype if it doesn't
+// exist. A database known to exist by this process is not checked again.
+func EnsureDBExistContext(ctx context.Context, db Database, doctype string) error {
+	if isKnownDB(db, doctype) {
+		return nil
+	}
+	if _, err := DBStatusContext(ctx, db, doctype); IsNoDatabaseError(err) {
+		if err = createDBOnce(ctx, db, doctype); err != nil {
+			_, err = DBStatusContext(ctx, db, doctype)
 			return err
 		}
 	}
 	return nil
 }
 
-// CreateDB creates the necessary database for a doctype
+// CreateDB calls CreateDBContext with a background context. It is kept for
+// compatibility, new code should use CreateDBContext.
+//
+// Deprecated: use CreateDBContext.
 func CreateDB(db Database, doctype string) error {
+	return CreateDBContext(context.Background(), db, doctype)
+}
+
+// CreateDBContext creates the necessary database for a doctype, and then
+// defines the indexes and views required by the doctype (see
+// RegisterIndexes). A failure to define them is logged, and they are
+// defined again on the next creation of a document.
+func CreateDBContext(ctx context.Context, db Database, doctype string) error {
+	if err := createBareDB(ctx, db, doctype); err != nil {
+		return err
+	}
+	ensureIndexes(ctx, db, doctype)
+	return nil
+}
+
+// createBareDB creates the database for a doctype, without its indexes.
+func createBareDB(ctx context.Context, db Database, doctype string) error {
 	// XXX On dev release of the stack, we force some parameters at the
 	// creation of a database. It helps CouchDB to have more acceptable
 	// performances inside Docker. Those parameters are not suitable for
@@ -453,54 +847,96 @@ func CreateDB(db Database, doctype string) error {
 	if build.IsDevRelease() {
 		query = "?q=1&n=1"
 	}
-	return makeRequest(db, doctype, http.MethodPut, query, nil, nil)
+	return makeRequest(ctx, db, doctype, http.MethodPut, query, nil, nil)
 }
 
-// DeleteDB destroy the database for a doctype
+// DeleteDB calls DeleteDBContext with a background context. It is kept for
+// compatibility, new code should use DeleteDBContext.
+//
+// Deprecated: use DeleteDBContext.
 func DeleteDB(db Database, doctype string) error {
-	return makeRequest(db, doctype, http.MethodDelete, "", nil, nil)
+	return DeleteDBContext(context.Background(), db, doctype)
 }
 
-// DeleteAllDBs will remove all the couchdb doctype databases for
-// a couchdb.DB.
+// DeleteDBContext destroy the database for a doctype
+func DeleteDBContext(ctx context.Context, db Database, doctype string) error {
+	return makeRequest(ctx, db, doctype, http.MethodDelete, "", nil, nil)
+}
+
+// DeleteAllDBs calls DeleteAllDBsContext with a background context. It is kept
+// for compatibility, new code should use DeleteAllDBsContext.
+//
+// Deprecated: use DeleteAllDBsContext.
 func DeleteAllDBs(db Database) error {
+	return DeleteAllDBsContext(context.Background(), db)
+}
+
+// DeleteAllDBsContext will remove all the couchdb doctype databases for
+// a couchdb.DB, on all the CouchDB clusters.
+func DeleteAllDBsContext(ctx context.Context, db Database) error {
 	dbprefix := db.DBPrefix()
 	if dbprefix == "" {
 		return fmt.Errorf("You need to provide a valid database")
 	}
 
-	dbsList, err := allDbs(db)
-	if err != nil {
-		return err
-	}
-
-	for _, doctypedb := range dbsList {
-		hasPrefix, doctype := dbNameHasPrefix(doctypedb, dbprefix)
-		if !hasPrefix {
-			continue
-		}
-		if err = DeleteDB(db, doctype); err != nil {
+	// The databases are deleted on the cluster where they have been found
+	return forEachCluster(ctx, func(ctx context.Context) error {
+		dbsList, err := allDbs(ctx, db)
+		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		for _, doctypedb := range dbsList {
+			hasPrefix, doctype := dbNameHasPrefix(doctypedb, dbprefix)
+			if !hasPrefix {
+				continue
+			}
+			if err = DeleteDBContext(ctx, db, doctype); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-// ResetDB destroy and recreate the database for a doctype
+// ResetDB calls ResetDBContext with a background context. It is kept for
+// compatibility, new code should use ResetDBContext.
+//
+// Deprecated: use ResetDBContext.
 func ResetDB(db Database, doctype string) error {
-	err := DeleteDB(db, doctype)
+	return ResetDBContext(context.Background(), db, doctype)
+}
+
+// ResetDBContext destroy and recreate the database for a doctype
+func ResetDBContext(ctx context.Context, db Database, doctype string) error {
+	err := DeleteDBContext(ctx, db, doctype)
 	if err != nil && !IsNoDatabaseError(err) {
 		return err
 	}
-	return CreateDB(db, doctype)
+	return CreateDBContext(ctx, db, doctype)
 }
 
-// DeleteDoc deletes a struct implementing the couchb.Doc interface
+// DeleteDoc calls DeleteDocContext with a background context. It is kept for
+// compatibility, new code should use DeleteDocContext.
+//
+// Deprecated: use DeleteDocContext.
+func DeleteDoc(db Database, doc Doc) error {
+	return DeleteDocContext(context.Background(), db, doc)
+}
+
+// DeleteDocContext deletes a struct implementing the couchb.Doc interface
 // If the document's current rev does not match the one passed,
 // a CouchdbError(409 conflict) will be returned.
 // The document's SetRev will be called with tombstone revision
-func DeleteDoc(db Database, doc Doc) error {
+func DeleteDocContext(ctx context.Context, db Database, doc Doc) error {
+	return defaultClient.DeleteDoc(ctx, db, doc)
+}
+
+// DeleteDoc is part of the Client interface.
+func (couchClient) DeleteDoc(ctx context.Context, db Database, doc Doc) error {
+	if err := checkDoc(doc); err != nil {
+		return err
+	}
 	id, err := validateDocID(doc.ID())
 	if err != nil {
 		return err
@@ -508,6 +944,11 @@ func DeleteDoc(db Database, doc Doc) error {
 	if id == "" {
 		return fmt.Errorf("Missing ID for DeleteDoc")
 	}
+	if isArchived(doc.DocType()) {
+		if err := archiveDoc(ctx, db, doc); err != nil {
+			return err
+		}
+	}
 	old := doc.Clone()
 
 	// XXX Specific log for the deletion of an account, to help monitor this
@@ -524,14 +965,17 @@ func DeleteDoc(db Database, doc Doc) error {
 	}
 
 	var res UpdateResponse
-	url := url.PathEscape(id) + "?rev=" + url.QueryEscape(doc.Rev())
-	err = makeRequest(db, doc.DocType(), http.MethodDelete, url, nil, &res)
+	path, body := revRequest(ctx, db, doc.DocType(), url.PathEscape(id), nil, doc.Rev())
+	err = makeRequest(ctx, db, doc.DocType(), http.MethodDelete, path, body, &res)
 	if err != nil {
 		return err
 	}
+	if err = res.check(); err != nil {
+		return err
+	}
 	doc.SetRev(res.Rev)
-	RTEvent(db, realtime.EventDelete, doc, old)
-	return nil
+	rtEvent(ctx, db, realtime.EventDelete, doc, old)
+	return checkAccepted(db, doc.DocType(), &res)
 }
 
 // NewEmptyObjectOfSameType takes an object and returns a new object of the
@@ -547,9 +991,25 @@ func NewEmptyObjectOfSameType(obj interface{}) interface{} {
 	return value.Interface()
 }
 
-// UpdateDoc update a document. The document ID and Rev should be filled.
-// The doc SetRev function will be called with the new rev.
+// UpdateDoc calls UpdateDocContext with a background context. It is kept for
+// compatibility, new code should use UpdateDocContext.
+//
+// Deprecated: use UpdateDocContext.
 func UpdateDoc(db Database, doc Doc) error {
+	return UpdateDocContext(context.Background(), db, doc)
+}
+
+// UpdateDocContext update a document. The document ID and Rev should be filled.
+// The doc SetRev function will be called with the new rev.
+func UpdateDocContext(ctx context.Context, db Database, doc Doc) error {
+	return defaultClient.UpdateDoc(ctx, db, doc)
+}
+
+// UpdateDoc is part of the Client interface.
+func (couchClient) UpdateDoc(ctx context.Context, db Database, doc Doc) error {
+	if err := checkDoc(doc); err != nil {
+		return err
+	}
 	id, err := validateDocID(doc.ID())
 	if err != nil {
 		return err
@@ -559,27 +1019,43 @@ func UpdateDoc(db Database, doc Doc) error {
 		return fmt.Errorf("UpdateDoc doc argument should have doctype, id and rev")
 	}
 
+	stampDoc(ctx, doc, false)
 	url := url.PathEscape(id)
 	// The old doc is requested to be emitted thought RTEvent.
 	// This is useful to keep track of the modifications for the triggers.
 	oldDoc := NewEmptyObjectOfSameType(doc).(Doc)
-	err = makeRequest(db, doctype, http.MethodGet, url, nil, oldDoc)
+	err = makeRequest(ctx, db, doctype, http.MethodGet, url, nil, oldDoc)
 	if err != nil {
 		return err
 	}
 	var res UpdateResponse
-	err = makeRequest(db, doctype, http.MethodPut, url, doc, &res)
+	path, body := revRequest(ctx, db, doctype, url, doc, doc.Rev())
+	err = makeRequest(ctx, db, doctype, http.MethodPut, path, body, &res)
 	if err != nil {
 		return err
 	}
+	if err = res.check(); err != nil {
+		return err
+	}
 	doc.SetRev(res.Rev)
-	RTEvent(db, realtime.EventUpdate, doc, oldDoc)
-	return nil
+	rtEvent(ctx, db, realtime.EventUpdate, doc, oldDoc)
+	return checkAccepted(db, doctype, &res)
 }
 
-// UpdateDocWithOld updates a document, like UpdateDoc. The difference is that
-// if we already have oldDoc there is no need to refetch it from database.
+// UpdateDocWithOld calls UpdateDocWithOldContext with a background context. It
+// is kept for compatibility, new code should use UpdateDocWithOldContext.
+//
+// Deprecated: use UpdateDocWithOldContext.
 func UpdateDocWithOld(db Database, doc, oldDoc Doc) error {
+	return UpdateDocWithOldContext(context.Background(), db, doc, oldDoc)
+}
+
+// UpdateDocWithOldContext updates a document, like UpdateDoc. The difference is that
+// if we already have oldDoc there is no need to refetch it from database.
+func UpdateDocWithOldContext(ctx context.Context, db Database, doc, oldDoc Doc) error {
+	if err := checkDoc(doc); err != nil {
+		return err
+	}
 	id, err := validateDocID(doc.ID())
 	if err != nil {
 		return err
@@ -589,22 +1065,43 @@ func UpdateDocWithOld(db Database, doc, oldDoc Doc) error {
 		return fmt.Errorf("UpdateDoc doc argument should have doctype, id and rev")
 	}
 
+	stampDoc(ctx, doc, false)
 	url := url.PathEscape(id)
 	var res UpdateResponse
-	err = makeRequest(db, doctype, http.MethodPut, url, doc, &res)
+	path, body := revRequest(ctx, db, doctype, url, doc, doc.Rev())
+	err = makeRequest(ctx, db, doctype, http.MethodPut, path, body, &res)
 	if err != nil {
 		return err
 	}
+	if err = res.check(); err != nil {
+		return err
+	}
 	doc.SetRev(res.Rev)
-	RTEvent(db, realtime.EventUpdate, doc, oldDoc)
-	return nil
+	rtEvent(ctx, db, realtime.EventUpdate, doc, oldDoc)
+	return checkAccepted(db, doctype, &res)
 }
 
-// CreateNamedDoc persist a document with an ID.
+// CreateNamedDoc calls CreateNamedDocContext with a background context. It is
+// kept for compatibility, new code should use CreateNamedDocContext.
+//
+// Deprecated: use CreateNamedDocContext.
+func CreateNamedDoc(db Database, doc Doc) error {
+	return CreateNamedDocContext(context.Background(), db, doc)
+}
+
+// CreateNamedDocContext persist a document with an ID.
 // if the document already exist, it will return a 409 error.
 // The document ID should be fillled.
 // The doc SetRev function will be called with the new rev.
-func CreateNamedDoc(db Database, doc Doc) error {
+func CreateNamedDocContext(ctx context.Context, db Database, doc Doc) error {
+	return defaultClient.CreateNamedDoc(ctx, db, doc)
+}
+
+// CreateNamedDoc is part of the Client interface.
+func (couchClient) CreateNamedDoc(ctx context.Context, db Database, doc Doc) error {
+	if err := checkDoc(doc); err != nil {
+		return err
+	}
 	id, err := validateDocID(doc.ID())
 	if err != nil {
 		return err
@@ -613,96 +1110,156 @@ func CreateNamedDoc(db Database, doc Doc) error {
 	if doc.Rev() != "" || id == "" || doctype == "" {
 		return fmt.Errorf("CreateNamedDoc should have type and id but no rev")
 	}
+	stampDoc(ctx, doc, true)
 	var res UpdateResponse
-	err = makeRequest(db, doctype, http.MethodPut, url.PathEscape(id), doc, &res)
+	err = makeRequest(ctx, db, doctype, http.MethodPut, url.PathEscape(id), doc, &res)
 	if err != nil {
 		return err
 	}
+	if err = res.check(); err != nil {
+		return err
+	}
 	doc.SetRev(res.Rev)
-	RTEvent(db, realtime.EventCreate, doc, nil)
-	return nil
+	rtEvent(ctx, db, realtime.EventCreate, doc, nil)
+	return checkAccepted(db, doctype, &res)
 }
 
-// CreateNamedDocWithDB is equivalent to CreateNamedDoc but creates the database
-// if it does not exist
+// CreateNamedDocWithDB calls CreateNamedDocWithDBContext with a background
+// context. It is kept for compatibility, new code should use
+// CreateNamedDocWithDBContext.
+//
+// Deprecated: use CreateNamedDocWithDBContext.
 func CreateNamedDocWithDB(db Database, doc Doc) error {
-	err := CreateNamedDoc(db, doc)
+	return CreateNamedDocWithDBContext(context.Background(), db, doc)
+}
+
+// CreateNamedDocWithDBContext is equivalent to CreateNamedDoc but creates the database
+// if it does not exist
+func CreateNamedDocWithDBContext(ctx context.Context, db Database, doc Doc) error {
+	err := CreateNamedDocContext(ctx, db, doc)
 	if IsNoDatabaseError(err) {
-		err = CreateDB(db, doc.DocType())
+		err = createDBOnce(ctx, db, doc.DocType())
 		if err != nil {
 			return err
 		}
-		return CreateNamedDoc(db, doc)
+		return CreateNamedDocContext(ctx, db, doc)
 	}
 	return err
 }
 
-// Upsert create the doc or update it if it already exists.
+// Upsert calls UpsertContext with a background context. It is kept for
+// compatibility, new code should use UpsertContext.
+//
+// Deprecated: use UpsertContext.
 func Upsert(db Database, doc Doc) error {
+	return UpsertContext(context.Background(), db, doc)
+}
+
+// UpsertContext create the doc or update it if it already exists.
+func UpsertContext(ctx context.Context, db Database, doc Doc) error {
+	if err := checkDoc(doc); err != nil {
+		return err
+	}
 	id, err := validateDocID(doc.ID())
 	if err != nil {
 		return err
 	}
 
 	var old JSONDoc
-	err = GetDoc(db, doc.DocType(), id, &old)
+	err = GetDocContext(ctx, db, doc.DocType(), id, &old)
 	if IsNoDatabaseError(err) {
-		err = CreateDB(db, doc.DocType())
+		err = createDBOnce(ctx, db, doc.DocType())
 		if err != nil {
 			return err
 		}
-		return CreateNamedDoc(db, doc)
+		return CreateNamedDocContext(ctx, db, doc)
 	}
 	if IsNotFoundError(err) {
-		return CreateNamedDoc(db, doc)
+		return CreateNamedDocContext(ctx, db, doc)
 	}
 	if err != nil {
 		return err
 	}
 
 	doc.SetRev(old.Rev())
-	return UpdateDoc(db, doc)
+	return UpdateDocContext(ctx, db, doc)
 }
 
-func createDocOrDB(db Database, doc Doc, response interface{}) error {
+func createDocOrDB(ctx context.Context, db Database, doc Doc, response interface{}) error {
 	doctype := doc.DocType()
-	err := makeRequest(db, doctype, http.MethodPost, "", doc, response)
+	err := makeRequest(ctx, db, doctype, http.MethodPost, "", doc, response)
+	if err == nil {
+		retryIndexes(ctx, db, doctype)
+	}
 	if err == nil || !IsNoDatabaseError(err) {
 		return err
 	}
-	err = CreateDB(db, doctype)
-	if err == nil || IsFileExists(err) {
-		err = makeRequest(db, doctype, http.MethodPost, "", doc, response)
+	if err = createDBOnce(ctx, db, doctype); err == nil {
+		err = makeRequest(ctx, db, doctype, http.MethodPost, "", doc, response)
 	}
 	return err
 }
 
-// CreateDoc is used to persist the given document in the couchdb
+// CreateDoc calls CreateDocContext with a background context. It is kept for
+// compatibility, new code should use CreateDocContext.
+//
+// Deprecated: use CreateDocContext.
+func CreateDoc(db Database, doc Doc) error {
+	return CreateDocContext(context.Background(), db, doc)
+}
+
+// CreateDocContext is used to persist the given document in the couchdb
 // database. The document's SetRev and SetID function will be called
 // with the document's new ID and Rev.
 // This function creates a database if this is the first document of its type
-func CreateDoc(db Database, doc Doc) error {
-	var res *UpdateResponse
+func CreateDocContext(ctx context.Context, db Database, doc Doc) error {
+	return defaultClient.CreateDoc(ctx, db, doc)
+}
 
+// CreateDoc is part of the Client interface.
+func (couchClient) CreateDoc(ctx context.Context, db Database, doc Doc) error {
+	var res UpdateResponse
+
+	if err := checkDoc(doc); err != nil {
+		return err
+	}
 	if doc.ID() != "" {
 		return newDefinedIDError()
 	}
+	if err := setGeneratedID(doc); err != nil {
+		return err
+	}
+	stampDoc(ctx, doc, true)
 
-	err := createDocOrDB(db, doc, &res)
+	err := createDocOrDB(ctx, db, doc, &res)
+	if err == nil {
+		err = res.check()
+	}
 	if err != nil {
+		// The generated ID is removed, so that the document can be given
+		// again to CreateDoc
+		doc.SetID("")
 		return err
-	} else if !res.Ok {
-		return fmt.Errorf("CouchDB replied with 200 ok=false")
 	}
 
 	doc.SetID(res.ID)
 	doc.SetRev(res.Rev)
-	RTEvent(db, realtime.EventCreate, doc, nil)
-	return nil
+	rtEvent(ctx, db, realtime.EventCreate, doc, nil)
+	return checkAccepted(db, doc.DocType(), &res)
 }
 
-// DefineViews creates a design doc with some views
+// DefineViews calls DefineViewsContext with a background context. It is kept
+// for compatibility, new code should use DefineViewsContext.
+//
+// Deprecated: use DefineViewsContext.
 func DefineViews(g *errgroup.Group, db Database, views []*View) {
+	DefineViewsContext(context.Background(), g, db, views)
+}
+
+// DefineViewsContext creates a design doc with some views. A design doc
+// that already exists is written only if its views have changed, and it is
+// upgraded without a cold index for the queries (see upgradeViews).
+func DefineViewsContext(ctx context.Context, g *errgroup.Group, db Database, views []*View) {
 	for i := range views {
 		v := views[i]
 		g.Go(func() error {
@@ -713,40 +1270,26 @@ func DefineViews(g *errgroup.Group, db Database, views []*View) {
 				Lang:  "javascript",
 				Views: map[string]*View{v.Name: v},
 			}
-			err := makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
+			doc.Hash = viewsHash(doc)
+			err := makeRequest(ctx, db, v.Doctype, http.MethodPut, url, &doc, nil)
 			if IsNoDatabaseError(err) {
-				err = CreateDB(db, v.Doctype)
-				if err != nil && !IsFileExists(err) {
+				err = createDBOnce(ctx, db, v.Doctype)
+				if err != nil {
 					if err != nil {
-						logger.WithDomain(db.DomainName()).
-							Printf("Cannot create view %s %s: cannot create DB - %s",
+						loggerFor(db).
+							Infof("Cannot create view %s %s: cannot create DB - %s",
 								db.DBPrefix(), v.Doctype, err)
 					}
 					return err
 				}
-				err = makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
+				err = makeRequest(ctx, db, v.Doctype, http.MethodPut, url, &doc, nil)
 			}
 			if IsConflictError(err) {
-				var old ViewDesignDoc
-				err = makeRequest(db, v.Doctype, http.MethodGet, url, nil, &old)
-				if err != nil {
-					if err != nil {
-						logger.WithDomain(db.DomainName()).
-							Printf("Cannot create view %s %s: conflict - %s",
-								db.DBPrefix(), v.Doctype, err)
-					}
-					return err
-				}
-				if !equalViews(&old, doc) {
-					doc.Rev = old.Rev
-					err = makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
-				} else {
-					err = nil
-				}
+				err = upgradeViews(ctx, db, v.Doctype, doc)
 			}
 			if err != nil {
-				logger.WithDomain(db.DomainName()).
-					Printf("Cannot create view %s %s: %s", db.DBPrefix(), v.Doctype, err)
+				loggerFor(db).
+					Infof("Cannot create view %s %s: %s", db.DBPrefix(), v.Doctype, err)
 			}
 			return err
 		})
@@ -773,8 +1316,16 @@ func equalViews(v1 *ViewDesignDoc, v2 *ViewDesignDoc) bool {
 	return true
 }
 
-// ExecView executes the specified view function
+// ExecView calls ExecViewContext with a background context. It is kept for
+// compatibility, new code should use ExecViewContext.
+//
+// Deprecated: use ExecViewContext.
 func ExecView(db Database, view *View, req *ViewRequest, results interface{}) error {
+	return ExecViewContext(context.Background(), db, view, req, results)
+}
+
+// ExecViewContext executes the specified view function
+func ExecViewContext(ctx context.Context, db Database, view *View, req *ViewRequest, results interface{}) error {
 	viewurl := fmt.Sprintf("_design/%s/_view/%s", view.Name, view.Name)
 	if req.GroupLevel > 0 {
 		req.Group = true
@@ -785,13 +1336,13 @@ func ExecView(db Database, view *View, req *ViewRequest, results interface{}) er
 	}
 	viewurl += "?" + v.Encode()
 	if req.Keys != nil {
-		return makeRequest(db, view.Doctype, http.MethodPost, viewurl, req, &results)
+		return makeRequest(ctx, db, view.Doctype, http.MethodPost, viewurl, req, &results)
 	}
-	err = makeRequest(db, view.Doctype, http.MethodGet, viewurl, nil, &results)
+	err = makeRequest(ctx, db, view.Doctype, http.MethodGet, viewurl, nil, &results)
 	if IsInternalServerError(err) {
 		time.Sleep(1 * time.Second)
 		// Retry the error on 500, sa it may be just that CouchDB is slow to build the view
-		err = makeRequest(db, view.Doctype, http.MethodGet, viewurl, nil, &results)
+		err = makeRequest(ctx, db, view.Doctype, http.MethodGet, viewurl, nil, &results)
 		if IsInternalServerError(err) {
 			logger.
 				WithDomain(db.DomainName()).
@@ -803,27 +1354,43 @@ func ExecView(db Database, view *View, req *ViewRequest, results interface{}) er
 	return err
 }
 
-// DefineIndex define the index on the doctype database
-// see query package on how to define an index
+// DefineIndex calls DefineIndexContext with a background context. It is kept
+// for compatibility, new code should use DefineIndexContext.
+//
+// Deprecated: use DefineIndexContext.
 func DefineIndex(db Database, index *mango.Index) error {
-	_, err := DefineIndexRaw(db, index.Doctype, index.Request)
+	return DefineIndexContext(context.Background(), db, index)
+}
+
+// DefineIndexContext define the index on the doctype database
+// see query package on how to define an index
+func DefineIndexContext(ctx context.Context, db Database, index *mango.Index) error {
+	_, err := DefineIndexRawContext(ctx, db, index.Doctype, index.Request)
 	if err != nil {
-		logger.WithDomain(db.DomainName()).
-			Printf("Cannot create index %s %s: %s", db.DBPrefix(), index.Doctype, err)
+		loggerFor(db).
+			Infof("Cannot create index %s %s: %s", db.DBPrefix(), index.Doctype, err)
 	}
 	return err
 }
 
-// DefineIndexRaw defines a index
+// DefineIndexRaw calls DefineIndexRawContext with a background context. It is
+// kept for compatibility, new code should use DefineIndexRawContext.
+//
+// Deprecated: use DefineIndexRawContext.
 func DefineIndexRaw(db Database, doctype string, index interface{}) (*IndexCreationResponse, error) {
+	return DefineIndexRawContext(context.Background(), db, doctype, index)
+}
+
+// DefineIndexRawContext defines a index
+func DefineIndexRawContext(ctx context.Context, db Database, doctype string, index interface{}) (*IndexCreationResponse, error) {
 	url := "_index"
 	response := &IndexCreationResponse{}
-	err := makeRequest(db, doctype, http.MethodPost, url, &index, &response)
+	err := makeRequest(ctx, db, doctype, http.MethodPost, url, &index, &response)
 	if IsNoDatabaseError(err) {
-		if err = CreateDB(db, doctype); err != nil && !IsFileExists(err) {
+		if err = CreateDBContext(ctx, db, doctype); err != nil && !IsFileExists(err) {
 			return nil, err
 		}
-		err = makeRequest(db, doctype, http.MethodPost, url, &index, &response)
+		err = makeRequest(ctx, db, doctype, http.MethodPost, url, &index, &response)
 	}
 	if err != nil {
 		return nil, err
@@ -831,33 +1398,66 @@ func DefineIndexRaw(db Database, doctype string, index interface{}) (*IndexCreat
 	return response, nil
 }
 
-// DefineIndexes defines a list of indexes
+// DefineIndexes calls DefineIndexesContext with a background context. It is
+// kept for compatibility, new code should use DefineIndexesContext.
+//
+// Deprecated: use DefineIndexesContext.
 func DefineIndexes(g *errgroup.Group, db Database, indexes []*mango.Index) {
+	DefineIndexesContext(context.Background(), g, db, indexes)
+}
+
+// DefineIndexesContext defines a list of indexes
+func DefineIndexesContext(ctx context.Context, g *errgroup.Group, db Database, indexes []*mango.Index) {
 	for i := range indexes {
 		index := indexes[i]
-		g.Go(func() error { return DefineIndex(db, index) })
+		g.Go(func() error { return DefineIndexContext(ctx, db, index) })
 	}
 }
 
-// FindDocs returns all documents matching the passed FindRequest
-// documents will be unmarshalled in the provided results slice.
+// FindDocs calls FindDocsContext with a background context. It is kept for
+// compatibility, new code should use FindDocsContext.
+//
+// Deprecated: use FindDocsContext.
 func FindDocs(db Database, doctype string, req *FindRequest, results interface{}) error {
-	_, err := FindDocsRaw(db, doctype, req, results)
+	return FindDocsContext(context.Background(), db, doctype, req, results)
+}
+
+// FindDocsContext returns all documents matching the passed FindRequest
+// documents will be unmarshalled in the provided results slice.
+func FindDocsContext(ctx context.Context, db Database, doctype string, req *FindRequest, results interface{}) error {
+	return defaultClient.FindDocs(ctx, db, doctype, req, results)
+}
+
+// FindDocs is part of the Client interface.
+func (couchClient) FindDocs(ctx context.Context, db Database, doctype string, req *FindRequest, results interface{}) error {
+	_, err := FindDocsRawContext(ctx, db, doctype, req, results)
 	return err
 }
 
-// FindDocsUnoptimized allows search on non-indexed fields.
-// /!\ Use with care
+// FindDocsUnoptimized calls FindDocsUnoptimizedContext with a background
+// context. It is kept for compatibility, new code should use
+// FindDocsUnoptimizedContext.
+//
+// Deprecated: use FindDocsUnoptimizedContext.
 func FindDocsUnoptimized(db Database, doctype string, req *FindRequest, results interface{}) error {
-	_, err := findDocsRaw(db, doctype, req, results, true)
+	return FindDocsUnoptimizedContext(context.Background(), db, doctype, req, results)
+}
+
+// FindDocsUnoptimizedContext allows search on non-indexed fields.
+// /!\ Use with care
+func FindDocsUnoptimizedContext(ctx context.Context, db Database, doctype string, req *FindRequest, results interface{}) error {
+	_, err := findDocsRaw(ctx, db, doctype, req, results, true)
 	return err
 }
 
-func findDocsRaw(db Database, doctype string, req interface{}, results interface{}, ignoreUnoptimized bool) (*FindResponse, error) {
+func findDocsRaw(ctx context.Context, db Database, doctype string, req interface{}, results interface{}, ignoreUnoptimized bool) (*FindResponse, error) {
+	if r, ok := req.(*FindRequest); ok && r.ExcludeTrashed {
+		req = r.excludingTrashed()
+	}
 	url := "_find"
 	// prepare a structure to receive the results
 	var response FindResponse
-	err := makeRequest(db, doctype, http.MethodPost, url, &req, &response)
+	err := makeRequest(ctx, db, doctype, http.MethodPost, url, &req, &response)
 	if err != nil {
 		if isIndexError(err) {
 			jsonReq, errm := json.Marshal(req)
@@ -878,18 +1478,34 @@ func findDocsRaw(db Database, doctype string, req interface{}, results interface
 		// CouchDB surprisingly returns "nil" when there is no doc
 		response.Bookmark = ""
 	}
-	return &response, json.Unmarshal(response.Docs, results)
+	return &response, decodeDocs(ctx, doctype, response.Docs, results)
 }
 
-// FindDocsRaw find documents
-// TODO: pagination
+// FindDocsRaw calls FindDocsRawContext with a background context. It is kept
+// for compatibility, new code should use FindDocsRawContext.
+//
+// Deprecated: use FindDocsRawContext.
 func FindDocsRaw(db Database, doctype string, req interface{}, results interface{}) (*FindResponse, error) {
-	return findDocsRaw(db, doctype, req, results, false)
+	return FindDocsRawContext(context.Background(), db, doctype, req, results)
 }
 
-// NormalDocs returns all the documents from a database, with pagination, but
-// it excludes the design docs.
+// FindDocsRawContext find documents
+// TODO: pagination
+func FindDocsRawContext(ctx context.Context, db Database, doctype string, req interface{}, results interface{}) (*FindResponse, error) {
+	return findDocsRaw(ctx, db, doctype, req, results, false)
+}
+
+// NormalDocs calls NormalDocsContext with a background context. It is kept for
+// compatibility, new code should use NormalDocsContext.
+//
+// Deprecated: use NormalDocsContext.
 func NormalDocs(db Database, doctype string, skip, limit int, bookmark string) (*NormalDocsResponse, error) {
+	return NormalDocsContext(context.Background(), db, doctype, skip, limit, bookmark)
+}
+
+// NormalDocsContext returns all the documents from a database, with pagination, but
+// it excludes the design docs.
+func NormalDocsContext(ctx context.Context, db Database, doctype string, skip, limit int, bookmark string) (*NormalDocsResponse, error) {
 	var findRes struct {
 		Docs     []json.RawMessage `json:"docs"`
 		Bookmark string            `json:"bookmark"`
@@ -905,7 +1521,7 @@ func NormalDocs(db Database, doctype string, skip, limit int, bookmark string) (
 	} else {
 		req.Skip = skip
 	}
-	err := makeRequest(db, doctype, http.MethodPost, "_find", &req, &findRes)
+	err := makeRequest(ctx, db, doctype, http.MethodPost, "_find", &req, &findRes)
 	if err != nil {
 		return nil, err
 	}
@@ -916,7 +1532,7 @@ func NormalDocs(db Database, doctype string, skip, limit int, bookmark string) (
 		res.Total = skip + len(res.Rows)
 	} else {
 		var designRes ViewResponse
-		err = makeRequest(db, doctype, http.MethodGet, "_design_docs", nil, &designRes)
+		err = makeRequest(ctx, db, doctype, http.MethodGet, "_design_docs", nil, &designRes)
 		if err != nil {
 			return nil, err
 		}
@@ -926,7 +1542,7 @@ func NormalDocs(db Database, doctype string, skip, limit int, bookmark string) (
 		// - is the total number of design documents on CouchDB 2.3+
 		// See https://github.com/apache/couchdb/issues/1603
 		if total == len(designRes.Rows) {
-			if total, err = CountAllDocs(db, doctype); err != nil {
+			if total, err = CountAllDocsContext(ctx, db, doctype); err != nil {
 				return nil, err
 			}
 		}
@@ -940,19 +1556,15 @@ func NormalDocs(db Database, doctype string, skip, limit int, bookmark string) (
 	return &res, nil
 }
 
-func validateDocID(id string) (string, error) {
-	if len(id) > 0 && id[0] == '_' {
-		return "", newBadIDError(id)
-	}
-	return id, nil
-}
-
 // ViewDesignDoc is the structure if a _design doc containing views
 type ViewDesignDoc struct {
 	ID    string           `json:"_id,omitempty"`
 	Rev   string           `json:"_rev,omitempty"`
 	Lang  string           `json:"language"`
 	Views map[string]*View `json:"views"`
+	// Hash is the hash of the views and of IndexViewsVersion, to know if
+	// the design doc must be upgraded
+	Hash string `json:"version_hash,omitempty"`
 }
 
 // IndexCreationResponse is the response from couchdb when we create an Index
@@ -969,6 +1581,13 @@ type UpdateResponse struct {
 	ID  string `json:"id"`
 	Rev string `json:"rev"`
 	Ok  bool   `json:"ok"`
+	// Error and Reason are set for the rows of a _bulk_docs response that
+	// have not been written, like a conflict
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// StatusCode is the status of the response: 201, or 202 if the write has
+	// only been accepted
+	StatusCode int `json:"-"`
 }
 
 // FindResponse is the response from couchdb on a find request
@@ -988,6 +1607,8 @@ type FindRequest struct {
 	Sort      mango.SortBy `json:"sort,omitempty"`
 	Fields    []string     `json:"fields,omitempty"`
 	Conflicts bool         `json:"conflicts,omitempty"`
+	// ExcludeTrashed excludes the soft-deleted documents from the results
+	ExcludeTrashed bool `json:"-"`
 }
 
 // ViewRequest are all params that can be passed to a view
@@ -1,9 +1,15 @@
 package couchdb
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
@@ -13,6 +19,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/couchdb/recorder"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/stretchr/testify/assert"
 )
@@ -309,6 +316,7 @@ func TestChangesSuccess(t *testing.T) {
 }
 
 func TestEnsureDBExist(t *testing.T) {
+	defer useRecorder(t)()
 	defer func() { _ = DeleteDB(TestPrefix, "io.cozy.tests.db1") }()
 	_, err := DBStatus(TestPrefix, "io.cozy.tests.db1")
 	assert.True(t, IsNoDatabaseError(err))
@@ -318,6 +326,7 @@ func TestEnsureDBExist(t *testing.T) {
 }
 
 func TestUUID(t *testing.T) {
+	defer useRecorder(t)()
 	uuid, err := UUID(TestPrefix)
 	assert.NoError(t, err)
 	assert.Len(t, uuid, 32)
@@ -399,6 +408,30 @@ func TestUpdateJSONDoc(t *testing.T) {
 	assert.Equal(t, "3", evt.Doc.(*JSONDoc).M["test"])
 }
 
+func TestIfMatchWithCouchDB(t *testing.T) {
+	// The version of the CouchDB of the tests supports If-Match
+	assert.True(t, useIfMatch(context.Background(), TestPrefix, TestDoctype))
+
+	doc := &testDoc{Test: "ifmatch"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	oldRev := doc.Rev()
+	doc.Test = "updated"
+	assert.NoError(t, UpdateDoc(TestPrefix, doc))
+	assert.NotEqual(t, oldRev, doc.Rev())
+
+	// A stale revision is a conflict, for the updates and the deletions
+	stale := &testDoc{TestID: doc.ID(), TestRev: oldRev, Test: "stale"}
+	assert.True(t, IsConflictError(UpdateDoc(TestPrefix, stale)))
+	assert.True(t, IsConflictError(UpdateDocWithOld(TestPrefix, stale, doc)))
+	assert.True(t, IsConflictError(DeleteDoc(TestPrefix, stale)))
+
+	fetched := &testDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, doc.ID(), fetched))
+	assert.Equal(t, "updated", fetched.Test)
+	assert.NoError(t, DeleteDoc(TestPrefix, doc))
+	assert.NotEmpty(t, doc.Rev())
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -484,7 +517,110 @@ func TestJSONDocClone(t *testing.T) {
 	assert.NotEqual(t, hdr1.Len, hdr4.Len)
 }
 
+func TestJSONDocAccessors(t *testing.T) {
+	var nilDoc *JSONDoc
+	assert.Equal(t, "", nilDoc.ID())
+	assert.Equal(t, "", nilDoc.Rev())
+	assert.Equal(t, "", nilDoc.DocType())
+	assert.Nil(t, nilDoc.Get("foo"))
+	assert.Error(t, nilDoc.Validate())
+
+	doc := &JSONDoc{}
+	assert.Equal(t, "", doc.ID())
+	_, ok := doc.IDOk()
+	assert.False(t, ok)
+	assert.Error(t, doc.Validate())
+	doc.SetID("foo")
+	doc.SetRev("1-abc")
+	assert.Equal(t, "foo", doc.ID())
+	assert.Equal(t, "1-abc", doc.Rev())
+
+	doc = &JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+		"_id":  42,
+		"_rev": []interface{}{"1-abc"},
+	}}
+	id, ok := doc.IDOk()
+	assert.Equal(t, "", id)
+	assert.False(t, ok)
+	_, ok = doc.RevOk()
+	assert.False(t, ok)
+	assert.Equal(t, "", doc.Rev())
+	assert.Error(t, doc.Validate())
+
+	doc = &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": ""}}
+	id, ok = doc.IDOk()
+	assert.Equal(t, "", id)
+	assert.True(t, ok)
+	assert.NoError(t, doc.Validate())
+
+	var unmarshaled JSONDoc
+	assert.NoError(t, json.Unmarshal([]byte(`{"_type":42}`), &unmarshaled))
+	assert.Equal(t, "", unmarshaled.DocType())
+	assert.Error(t, unmarshaled.Validate())
+}
+
+func TestMalformedDocs(t *testing.T) {
+	var calls int
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"ok":true,"id":"123","rev":"1-abc"}`))
+	}))
+	defer restore()
+
+	malformed := map[string]func() *JSONDoc{
+		"nil":        func() *JSONDoc { return nil },
+		"nil map":    func() *JSONDoc { return &JSONDoc{Type: TestDoctype} },
+		"no doctype": func() *JSONDoc { return &JSONDoc{M: map[string]interface{}{"_id": "foo"}} },
+		"numeric id": func() *JSONDoc { return &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": 42}} },
+		"numeric rev": func() *JSONDoc {
+			return &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo", "_rev": 1}}
+		},
+		"object _id": func() *JSONDoc {
+			return &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": map[string]interface{}{}}}
+		},
+		"boolean _rev": func() *JSONDoc { return &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_rev": true}} },
+	}
+	fns := map[string]func(doc *JSONDoc) error{
+		"CreateDoc":        func(doc *JSONDoc) error { return CreateDoc(TestPrefix, doc) },
+		"CreateNamedDoc":   func(doc *JSONDoc) error { return CreateNamedDoc(TestPrefix, doc) },
+		"UpdateDoc":        func(doc *JSONDoc) error { return UpdateDoc(TestPrefix, doc) },
+		"UpdateDocWithOld": func(doc *JSONDoc) error { return UpdateDocWithOld(TestPrefix, doc, doc) },
+		"Upsert":           func(doc *JSONDoc) error { return Upsert(TestPrefix, doc) },
+		"DeleteDoc":        func(doc *JSONDoc) error { return DeleteDoc(TestPrefix, doc) },
+		"BulkDeleteDocs":   func(doc *JSONDoc) error { return BulkDeleteDocs(TestPrefix, TestDoctype, []Doc{doc}) },
+	}
+	for docName, makeDoc := range malformed {
+		for fnName, fn := range fns {
+			var err error
+			assert.NotPanics(t, func() { err = fn(makeDoc()) }, "%s with %s", fnName, docName)
+			if assert.Error(t, err, "%s with %s", fnName, docName) {
+				assert.Equal(t, http.StatusBadRequest, err.(*Error).StatusCode)
+			}
+		}
+	}
+	assert.Equal(t, 0, calls)
+
+	// A document with a numeric _id in the response does not panic
+	restore()
+	restore = useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"_id":42,"_rev":null}`))
+	}))
+	defer restore()
+	var out JSONDoc
+	assert.NotPanics(t, func() { err := GetDoc(TestPrefix, TestDoctype, "foo", &out); assert.NoError(t, err) })
+	assert.Equal(t, "", out.ID())
+	assert.Equal(t, "", out.Rev())
+
+	// Nor does a bulk response with too few rows
+	var bulkErr error
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo", "_rev": "1-abc"}}
+	assert.NotPanics(t, func() { bulkErr = BulkDeleteDocs(TestPrefix, TestDoctype, []Doc{doc, doc}) })
+	assert.Error(t, bulkErr)
+}
+
 func TestLocalDocuments(t *testing.T) {
+	defer useRecorder(t)()
 	id := "foo"
 	_, err := GetLocal(TestPrefix, TestDoctype, id)
 	assert.True(t, IsNotFoundError(err))
@@ -505,6 +641,22 @@ func TestLocalDocuments(t *testing.T) {
 	assert.True(t, IsNotFoundError(err))
 }
 
+func TestContextCancellation(t *testing.T) {
+	unblock := make(chan struct{})
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer restore()
+	defer close(unblock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var doc JSONDoc
+	err := GetDocContext(ctx, TestPrefix, TestDoctype, "foo", &doc)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
 func assertGotEvent(t *testing.T, eventType, id string) *realtime.Event {
 	t.Helper()
 
@@ -525,3 +677,67 @@ func assertGotEvent(t *testing.T, eventType, id string) *realtime.Event {
 	assert.True(t, ok, "Expected event %s:%s", eventType, id)
 	return event
 }
+
+// useTestServer makes the couchdb package send its requests to the given
+// handler instead of CouchDB. It returns a function to restore the
+// configuration.
+// useRecorder replays the exchanges with CouchDB of a test from its golden
+// file in testdata/recordings, or records them with a CouchDB when
+// COZY_COUCHDB_RECORD is set.
+func useRecorder(t *testing.T) func() {
+	t.Helper()
+	file := filepath.Join("testdata", "recordings", t.Name()+".json")
+	rec, err := recorder.New(file, recorder.ModeFromEnv(), httpClient().Transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTransport(rec)
+	return func() {
+		SetClient(nil)
+		if err := rec.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func useTestServer(t testing.TB, handler http.Handler) func() {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	couch := config.GetConfig().CouchDB
+	u, err := url.Parse(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.GetConfig().CouchDB.URL = u
+	config.GetConfig().CouchDB.Client = ts.Client()
+	return func() {
+		config.GetConfig().CouchDB = couch
+		ts.Close()
+	}
+}
+
+func TestGetAllDocsWithMissingKeys(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("skip") != "" {
+			_, _ = w.Write([]byte(`{"total_rows":2,"offset":10,"rows":[]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"total_rows":2,"rows":[
+			{"id":"doc4","key":"doc4","value":{"rev":"1-abc"},"doc":{"_id":"doc4","_rev":"1-abc"}},
+			{"key":"missing","error":"not_found"},
+			{"id":"doc5","key":"doc5","value":{"rev":"2-abc","deleted":true},"doc":null}
+		]}`))
+	}))
+	defer restore()
+
+	var docs []JSONDoc
+	req := &AllDocsRequest{Keys: []string{"doc4", "missing", "doc5"}}
+	assert.NoError(t, GetAllDocs(TestPrefix, TestDoctype, req, &docs))
+	if assert.Len(t, docs, 1) {
+		assert.Equal(t, "doc4", docs[0].ID())
+	}
+
+	// An empty page empties the results
+	assert.NoError(t, GetAllDocs(TestPrefix, TestDoctype, &AllDocsRequest{Skip: 10}, &docs))
+	assert.Len(t, docs, 0)
+}
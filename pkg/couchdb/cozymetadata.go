@@ -0,0 +1,134 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/metadata"
+)
+
+// MetadataSource describes the application that writes the documents, for
+// their cozyMetadata.
+type MetadataSource struct {
+	Slug           string
+	Version        string
+	Instance       string
+	DoctypeVersion string
+}
+
+// CozyMetadataHolder is the optional interface of the Go types with a
+// cozyMetadata, to have it maintained on writes, like for JSONDoc.
+type CozyMetadataHolder interface {
+	GetCozyMetadata() *metadata.CozyMetadata
+	SetCozyMetadata(md *metadata.CozyMetadata)
+}
+
+// DefaultMaxUpdatedByApps is the number of updatedByApps entries kept for
+// each slug in the cozyMetadata of a document.
+const DefaultMaxUpdatedByApps = 3
+
+var maxUpdatedByApps int32 = DefaultMaxUpdatedByApps
+
+// SetMaxUpdatedByApps sets the number of updatedByApps entries kept for each
+// slug in the cozyMetadata of a document. Zero or a negative value restores
+// the default.
+func SetMaxUpdatedByApps(max int) {
+	if max <= 0 {
+		max = DefaultMaxUpdatedByApps
+	}
+	atomic.StoreInt32(&maxUpdatedByApps, int32(max))
+}
+
+type metadataSourceKey struct{}
+
+// WithMetadataSource returns a context where the documents written are
+// given a cozyMetadata: it is initialized when a document is created, and an
+// updatedByApps entry for the source is added on each write. Without it, the
+// cozyMetadata are left as they are.
+func WithMetadataSource(ctx context.Context, source MetadataSource) context.Context {
+	return context.WithValue(ctx, metadataSourceKey{}, source)
+}
+
+func metadataSourceFrom(ctx context.Context) (MetadataSource, bool) {
+	source, ok := ctx.Value(metadataSourceKey{}).(MetadataSource)
+	return source, ok
+}
+
+// stampMetadata updates the cozyMetadata of a document before writing it,
+// if the context has a metadata source.
+func stampMetadata(ctx context.Context, doc Doc, created bool) {
+	source, ok := metadataSourceFrom(ctx)
+	if !ok {
+		return
+	}
+	now := timestampNow()
+	switch d := doc.(type) {
+	case CozyMetadataHolder:
+		md := d.GetCozyMetadata()
+		if md == nil {
+			md = &metadata.CozyMetadata{}
+		}
+		source.apply(md, created, now)
+		d.SetCozyMetadata(md)
+	case *JSONDoc:
+		stampJSONMetadata(d, source, created, now)
+	}
+}
+
+func (s MetadataSource) apply(md *metadata.CozyMetadata, created bool, now time.Time) {
+	if md.MetadataVersion == 0 {
+		md.MetadataVersion = metadata.MetadataVersion
+	}
+	if md.DocTypeVersion == "" {
+		md.DocTypeVersion = s.DoctypeVersion
+	}
+	if md.CreatedAt.IsZero() {
+		md.CreatedAt = now
+	}
+	if created && md.CreatedByApp == "" {
+		md.CreatedByApp = s.Slug
+		md.CreatedByAppVersion = s.Version
+	}
+	md.UpdatedAt = now
+	entry := &metadata.UpdatedByAppEntry{
+		Slug:     s.Slug,
+		Date:     now,
+		Version:  s.Version,
+		Instance: s.Instance,
+	}
+	md.AddUpdatedByApp(entry, int(atomic.LoadInt32(&maxUpdatedByApps)))
+}
+
+// stampJSONMetadata updates the cozyMetadata of a JSONDoc. The fields that
+// are unknown to metadata.CozyMetadata are kept, and a cozyMetadata that
+// cannot be parsed is left untouched.
+func stampJSONMetadata(doc *JSONDoc, source MetadataSource, created bool, now time.Time) {
+	raw, _ := doc.Get("cozyMetadata").(map[string]interface{})
+	var md metadata.CozyMetadata
+	if raw != nil {
+		data, err := json.Marshal(raw)
+		if err != nil || json.Unmarshal(data, &md) != nil {
+			return
+		}
+	} else {
+		raw = make(map[string]interface{})
+	}
+	source.apply(&md, created, now)
+	data, err := json.Marshal(&md)
+	if err != nil {
+		return
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+	for k, v := range fields {
+		raw[k] = v
+	}
+	if doc.M == nil {
+		doc.M = make(map[string]interface{})
+	}
+	doc.M["cozyMetadata"] = raw
+}
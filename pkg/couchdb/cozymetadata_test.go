@@ -0,0 +1,109 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+type metadataDoc struct {
+	testDoc
+	Metadata *metadata.CozyMetadata `json:"cozyMetadata,omitempty"`
+}
+
+func (d *metadataDoc) GetCozyMetadata() *metadata.CozyMetadata   { return d.Metadata }
+func (d *metadataDoc) SetCozyMetadata(md *metadata.CozyMetadata) { d.Metadata = md }
+
+func TestCozyMetadata(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_bulk_docs") {
+			_, _ = w.Write([]byte(`[{"ok":true,"id":"foo","rev":"3-c"}]`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"id":"foo","rev":"2-b","_id":"foo","_rev":"1-a"}`))
+	}))
+	defer restore()
+
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+	SetMaxUpdatedByApps(2)
+	defer SetMaxUpdatedByApps(0)
+
+	// Without a source, the cozyMetadata are not changed
+	plain := &metadataDoc{}
+	assert.NoError(t, CreateDocContext(context.Background(), TestPrefix, plain))
+	assert.Nil(t, plain.Metadata)
+
+	drive := WithMetadataSource(context.Background(), MetadataSource{
+		Slug:           "drive",
+		Version:        "1.2.3",
+		Instance:       "alice.cozy.example",
+		DoctypeVersion: "1",
+	})
+	typed := &metadataDoc{}
+	assert.NoError(t, CreateDocContext(drive, TestPrefix, typed))
+	if assert.NotNil(t, typed.Metadata) {
+		md := typed.Metadata
+		assert.Equal(t, metadata.MetadataVersion, md.MetadataVersion)
+		assert.Equal(t, "1", md.DocTypeVersion)
+		assert.Equal(t, "drive", md.CreatedByApp)
+		assert.Equal(t, "1.2.3", md.CreatedByAppVersion)
+		assert.Equal(t, now, md.CreatedAt)
+		assert.Equal(t, now, md.UpdatedAt)
+		if assert.Len(t, md.UpdatedByApps, 1) {
+			assert.Equal(t, "alice.cozy.example", md.UpdatedByApps[0].Instance)
+		}
+	}
+
+	// The updatedByApps are capped for each slug
+	for _, instance := range []string{"bob.cozy.example", "carol.cozy.example", "bob.cozy.example"} {
+		now = now.Add(time.Minute)
+		ctx := WithMetadataSource(context.Background(), MetadataSource{Slug: "drive", Instance: instance})
+		assert.NoError(t, UpdateDocContext(ctx, TestPrefix, typed))
+	}
+	photos := WithMetadataSource(context.Background(), MetadataSource{Slug: "photos"})
+	assert.NoError(t, UpdateDocContext(photos, TestPrefix, typed))
+	md := typed.Metadata
+	assert.Equal(t, "drive", md.CreatedByApp)
+	assert.Equal(t, now, md.UpdatedAt)
+	if assert.Len(t, md.UpdatedByApps, 3) {
+		assert.Equal(t, "carol.cozy.example", md.UpdatedByApps[0].Instance)
+		assert.Equal(t, "bob.cozy.example", md.UpdatedByApps[1].Instance)
+		assert.Equal(t, "photos", md.UpdatedByApps[2].Slug)
+	}
+
+	// The JSONDoc keep the fields they have in their cozyMetadata
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+		"_id":  "foo",
+		"_rev": "1-a",
+		"cozyMetadata": map[string]interface{}{
+			"createdAt":     "2020-01-01T00:00:00Z",
+			"createdByApp":  "notes",
+			"sourceAccount": "account",
+			"updatedByApps": []interface{}{map[string]interface{}{"slug": "notes", "date": "2020-01-01T00:00:00Z"}},
+		},
+	}}
+	err := BulkUpdateDocsContext(drive, TestPrefix, TestDoctype, []interface{}{doc}, nil)
+	assert.NoError(t, err)
+	get := func(path string) interface{} {
+		value, _ := doc.GetPath(path)
+		return value
+	}
+	assert.Equal(t, "account", get("cozyMetadata.sourceAccount"))
+	assert.Equal(t, "notes", get("cozyMetadata.createdByApp"))
+	assert.Equal(t, "2020-01-01T00:00:00Z", get("cozyMetadata.createdAt"))
+	assert.Equal(t, "2021-03-04T05:09:07Z", get("cozyMetadata.updatedAt"))
+	assert.Equal(t, "notes", get("cozyMetadata.updatedByApps.0.slug"))
+	assert.Equal(t, "drive", get("cozyMetadata.updatedByApps.1.slug"))
+
+	created := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{}}
+	assert.NoError(t, CreateDocContext(drive, TestPrefix, created))
+	value, _ := created.GetPath("cozyMetadata.createdByApp")
+	assert.Equal(t, "drive", value)
+}
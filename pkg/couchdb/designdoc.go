@@ -0,0 +1,114 @@
+package couchdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// viewsHash returns the hash of the views of a design doc and of
+// IndexViewsVersion. It is stored in the design doc, and compared before
+// writing it again: the _rev changes on each write even when the content is
+// the same, and so it cannot be used for that.
+func viewsHash(doc *ViewDesignDoc) string {
+	names := make([]string, 0, len(doc.Views))
+	for name := range doc.Views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00", IndexViewsVersion, doc.Lang)
+	for _, name := range names {
+		v := doc.Views[name]
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00", name, v.Map, v.Reduce)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// needsUpgrade returns true if the design doc in CouchDB is not the same as
+// the new one. The design docs written before the hashes are compared by
+// their views.
+func needsUpgrade(old, doc *ViewDesignDoc) bool {
+	if old.Hash != "" {
+		return old.Hash != doc.Hash
+	}
+	return !equalViews(old, doc)
+}
+
+// upgradeViews is called when a design doc with views already exists: it is
+// not written if it has not changed, and else it is swapped with the new
+// one by swapDesignDoc.
+func upgradeViews(ctx context.Context, db Database, doctype string, doc *ViewDesignDoc) error {
+	var old ViewDesignDoc
+	err := makeRequest(ctx, db, doctype, http.MethodGet, url.PathEscape(doc.ID), nil, &old)
+	if err != nil {
+		return err
+	}
+	if !needsUpgrade(&old, doc) {
+		return nil
+	}
+	return swapDesignDoc(ctx, db, doctype, doc, &old)
+}
+
+// swapDesignDoc upgrades a design doc without making the queries wait for
+// the build of its indexes. The new version is written under a versioned
+// name, like _design/files-0123456789abcdef, and its indexes are built.
+// Then, it replaces the old version, and the versioned one is deleted. As
+// CouchDB shares the indexes between the design docs with the same views,
+// the queries on the design doc use the indexes already built as soon as it
+// is replaced.
+func swapDesignDoc(ctx context.Context, db Database, doctype string, doc, old *ViewDesignDoc) error {
+	staged := *doc
+	staged.ID = doc.ID + "-" + doc.Hash
+	staged.Rev = ""
+	stagedPath := url.PathEscape(staged.ID)
+	var res UpdateResponse
+	err := makeRequest(ctx, db, doctype, http.MethodPut, stagedPath, &staged, &res)
+	if IsConflictError(err) {
+		// The versioned design doc has been left by an interrupted upgrade,
+		// and it has the same views, as its name has the same hash
+		var existing ViewDesignDoc
+		err = makeRequest(ctx, db, doctype, http.MethodGet, stagedPath, nil, &existing)
+		res.Rev = existing.Rev
+	}
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(doc.Views))
+	for name := range doc.Views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		stagedName := strings.TrimPrefix(staged.ID, "_design/")
+		if err = warmView(ctx, db, doctype, stagedName, names[0]); err != nil {
+			return err
+		}
+	}
+
+	doc.Rev = old.Rev
+	err = makeRequest(ctx, db, doctype, http.MethodPut, url.PathEscape(doc.ID), doc, nil)
+	if IsConflictError(err) {
+		// The design doc may have been upgraded by another stack
+		var current ViewDesignDoc
+		if makeRequest(ctx, db, doctype, http.MethodGet, url.PathEscape(doc.ID), nil, &current) == nil &&
+			current.Hash == doc.Hash {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	path := stagedPath + "?rev=" + url.QueryEscape(res.Rev)
+	if err := makeRequest(ctx, db, doctype, http.MethodDelete, path, nil, nil); err != nil && !IsNotFoundError(err) {
+		loggerFor(db).Warnf("cannot delete the design doc %s after the upgrade: %s", staged.ID, err)
+	}
+	return nil
+}
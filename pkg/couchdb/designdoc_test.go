@@ -0,0 +1,187 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/errgroup"
+)
+
+// ddocServer is a fake CouchDB that keeps the design docs of a database,
+// and records the requests made on them.
+type ddocServer struct {
+	mu       sync.Mutex
+	ddocs    map[string]*ViewDesignDoc
+	requests []string
+	failWarm bool
+}
+
+func (s *ddocServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := r.URL.EscapedPath()
+	path = path[strings.Index(path[1:], "/")+2:]
+	id, _ := url.PathUnescape(path)
+	if i := strings.Index(id, "/_view/"); i >= 0 {
+		s.requests = append(s.requests, "VIEW "+id[:i])
+		if s.failWarm {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"os_process_error","reason":"timeout"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"total_rows":0,"rows":[]}`))
+		return
+	}
+	s.requests = append(s.requests, r.Method+" "+id)
+	existing := s.ddocs[id]
+	switch r.Method {
+	case http.MethodGet:
+		if existing == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(existing)
+	case http.MethodPut:
+		var doc ViewDesignDoc
+		_ = json.NewDecoder(r.Body).Decode(&doc)
+		if existing != nil && existing.Rev != doc.Rev {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"error":"conflict","reason":"Document update conflict."}`))
+			return
+		}
+		gen := 1
+		if existing != nil {
+			_, _ = fmt.Sscanf(existing.Rev, "%d-", &gen)
+			gen++
+		}
+		doc.Rev = fmt.Sprintf("%d-abc", gen)
+		s.ddocs[id] = &doc
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(UpdateResponse{ID: id, Rev: doc.Rev, Ok: true})
+	case http.MethodDelete:
+		if existing == nil || existing.Rev != r.URL.Query().Get("rev") {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"error":"conflict","reason":"Document update conflict."}`))
+			return
+		}
+		delete(s.ddocs, id)
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}
+}
+
+func defineTestView(t *testing.T, view *View) error {
+	var g errgroup.Group
+	DefineViews(&g, TestPrefix, []*View{view})
+	return g.Wait()
+}
+
+func TestViewsHash(t *testing.T) {
+	doc := &ViewDesignDoc{
+		ID:   "_design/foo",
+		Lang: "javascript",
+		Views: map[string]*View{
+			"a": {Map: "function(doc) { emit(doc.a) }"},
+			"b": {Map: "function(doc) { emit(doc.b) }", Reduce: "_count"},
+		},
+	}
+	hash := viewsHash(doc)
+	assert.Len(t, hash, 16)
+
+	// The revision and the hash itself are not part of the content
+	doc.Rev = "3-abc"
+	doc.Hash = hash
+	assert.Equal(t, hash, viewsHash(doc))
+
+	doc.Views["b"] = &View{Map: "function(doc) { emit(doc.b) }"}
+	assert.NotEqual(t, hash, viewsHash(doc))
+	doc.Views["b"] = &View{Map: "function(doc) { emit(doc.b) }", Reduce: "_count"}
+	assert.Equal(t, hash, viewsHash(doc))
+	doc.Lang = "erlang"
+	assert.NotEqual(t, hash, viewsHash(doc))
+}
+
+func TestDefineViewsNoChange(t *testing.T) {
+	s := &ddocServer{ddocs: make(map[string]*ViewDesignDoc)}
+	restore := useTestServer(t, s)
+	defer restore()
+
+	view := &View{Name: "by-name", Doctype: TestDoctype, Map: "function(doc) { emit(doc.name) }"}
+	assert.NoError(t, defineTestView(t, view))
+	assert.Equal(t, []string{"PUT _design/by-name"}, s.requests)
+	assert.NotEmpty(t, s.ddocs["_design/by-name"].Hash)
+
+	// The same views are not written again
+	s.requests = nil
+	assert.NoError(t, defineTestView(t, view))
+	assert.Equal(t, []string{"PUT _design/by-name", "GET _design/by-name"}, s.requests)
+	assert.Equal(t, "1-abc", s.ddocs["_design/by-name"].Rev)
+
+	// Nor those of a design doc written before the hashes
+	s.ddocs["_design/by-name"].Hash = ""
+	s.requests = nil
+	assert.NoError(t, defineTestView(t, view))
+	assert.Equal(t, []string{"PUT _design/by-name", "GET _design/by-name"}, s.requests)
+}
+
+func TestDefineViewsSwap(t *testing.T) {
+	s := &ddocServer{ddocs: make(map[string]*ViewDesignDoc)}
+	restore := useTestServer(t, s)
+	defer restore()
+
+	view := &View{Name: "by-name", Doctype: TestDoctype, Map: "function(doc) { emit(doc.name) }"}
+	assert.NoError(t, defineTestView(t, view))
+
+	view.Map = "function(doc) { emit(doc.name.toLowerCase()) }"
+	hash := viewsHash(&ViewDesignDoc{Lang: "javascript", Views: map[string]*View{view.Name: view}})
+	staged := "_design/by-name-" + hash
+	s.requests = nil
+	assert.NoError(t, defineTestView(t, view))
+	// The new version is built under a versioned name before the swap
+	assert.Equal(t, []string{
+		"PUT _design/by-name",
+		"GET _design/by-name",
+		"PUT " + staged,
+		"VIEW " + staged,
+		"PUT _design/by-name",
+		"DELETE " + staged,
+	}, s.requests)
+	if assert.Contains(t, s.ddocs, "_design/by-name") {
+		assert.Equal(t, hash, s.ddocs["_design/by-name"].Hash)
+		assert.Equal(t, view.Map, s.ddocs["_design/by-name"].Views["by-name"].Map)
+		assert.Equal(t, "2-abc", s.ddocs["_design/by-name"].Rev)
+	}
+	assert.NotContains(t, s.ddocs, staged)
+}
+
+func TestDefineViewsSwapFailure(t *testing.T) {
+	s := &ddocServer{ddocs: make(map[string]*ViewDesignDoc)}
+	restore := useTestServer(t, s)
+	defer restore()
+
+	view := &View{Name: "by-name", Doctype: TestDoctype, Map: "function(doc) { emit(doc.name) }"}
+	assert.NoError(t, defineTestView(t, view))
+	oldHash := s.ddocs["_design/by-name"].Hash
+
+	// If the new version cannot be built, the old one is kept
+	view.Map = "function(doc) { emit(doc.title) }"
+	s.failWarm = true
+	err := defineTestView(t, view)
+	assert.True(t, IsInternalServerError(err))
+	assert.Equal(t, oldHash, s.ddocs["_design/by-name"].Hash)
+	assert.Len(t, s.ddocs, 2)
+
+	// The versioned design doc left by the failure is reused by the next try
+	s.failWarm = false
+	s.requests = nil
+	assert.NoError(t, defineTestView(t, view))
+	assert.NotEqual(t, oldHash, s.ddocs["_design/by-name"].Hash)
+	assert.Len(t, s.ddocs, 1)
+	assert.Contains(t, s.requests[3], "GET _design/by-name-")
+}
@@ -0,0 +1,235 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ChangeKind is the kind of change made on a field between two versions of
+// a document.
+type ChangeKind string
+
+const (
+	// FieldAdded is used for a field that is only in the second version.
+	FieldAdded ChangeKind = "added"
+	// FieldRemoved is used for a field that is only in the first version.
+	FieldRemoved ChangeKind = "removed"
+	// FieldModified is used for a field that has another value in the second
+	// version.
+	FieldModified ChangeKind = "modified"
+)
+
+// DefaultDiffValueSize is the maximal size of the JSON of a value in a
+// FieldChange, after which it is truncated.
+const DefaultDiffValueSize = 1024
+
+// FieldChange is a change on a field between two versions of a document. The
+// path is a JSON pointer, like "/metadata/datetime". When the JSON of a value
+// is too large, it is replaced by the beginning of this JSON, as a string, and
+// Truncated is true.
+type FieldChange struct {
+	Kind      ChangeKind  `json:"kind"`
+	Path      string      `json:"path"`
+	Before    interface{} `json:"before,omitempty"`
+	After     interface{} `json:"after,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// DiffOptions are the options of DiffDocsWithOptions.
+type DiffOptions struct {
+	// ArraysAsSets compares the arrays as sets: the order of the elements is
+	// ignored, and the changes are only added or removed elements, with their
+	// index in the version where they are.
+	ArraysAsSets bool
+	// MaxValueSize is the maximal size of the JSON of a value in a change. It
+	// is DefaultDiffValueSize if zero, and there is no limit if negative.
+	MaxValueSize int
+}
+
+// DiffDocs returns the changes between two versions of a document. The _rev
+// fields are ignored, as they are always different.
+func DiffDocs(a, b json.RawMessage) ([]FieldChange, error) {
+	return DiffDocsWithOptions(a, b, DiffOptions{})
+}
+
+// DiffDocsWithOptions returns the changes between two versions of a
+// document, like DiffDocs.
+func DiffDocsWithOptions(a, b json.RawMessage, opts DiffOptions) ([]FieldChange, error) {
+	var before, after map[string]interface{}
+	if err := decodeDiffDoc(a, &before); err != nil {
+		return nil, err
+	}
+	if err := decodeDiffDoc(b, &after); err != nil {
+		return nil, err
+	}
+	delete(before, "_rev")
+	delete(after, "_rev")
+	if opts.MaxValueSize == 0 {
+		opts.MaxValueSize = DefaultDiffValueSize
+	}
+	d := differ{opts: opts, changes: []FieldChange{}}
+	d.diff("", before, after)
+	return d.changes, nil
+}
+
+// DiffRevs calls DiffRevsContext with a background context.
+func DiffRevs(db Database, doctype, id, revA, revB string) ([]FieldChange, error) {
+	return DiffRevsContext(context.Background(), db, doctype, id, revA, revB)
+}
+
+// DiffRevsContext fetches two revisions of a document, and returns the
+// changes between them, like DiffDocs.
+func DiffRevsContext(ctx context.Context, db Database, doctype, id, revA, revB string) ([]FieldChange, error) {
+	var docs [2]json.RawMessage
+	for i, rev := range []string{revA, revB} {
+		var doc JSONDoc
+		if err := GetDocRevContext(ctx, db, doctype, id, rev, &doc); err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(&doc)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = data
+	}
+	return DiffDocs(docs[0], docs[1])
+}
+
+func decodeDiffDoc(data json.RawMessage, out *map[string]interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(out)
+}
+
+type differ struct {
+	opts    DiffOptions
+	changes []FieldChange
+}
+
+func (d *differ) diff(path string, before, after interface{}) {
+	switch b := before.(type) {
+	case map[string]interface{}:
+		if a, ok := after.(map[string]interface{}); ok {
+			d.diffObjects(path, b, a)
+			return
+		}
+	case []interface{}:
+		if a, ok := after.([]interface{}); ok {
+			if d.opts.ArraysAsSets {
+				d.diffSets(path, b, a)
+			} else {
+				d.diffArrays(path, b, a)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(before, after) {
+		d.add(FieldModified, path, before, after)
+	}
+}
+
+func (d *differ) diffObjects(path string, before, after map[string]interface{}) {
+	keys := make([]string, 0, len(before)+len(after))
+	for k := range before {
+		keys = append(keys, k)
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := path + "/" + escapePointer(k)
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		switch {
+		case !inAfter:
+			d.add(FieldRemoved, p, b, nil)
+		case !inBefore:
+			d.add(FieldAdded, p, nil, a)
+		default:
+			d.diff(p, b, a)
+		}
+	}
+}
+
+func (d *differ) diffArrays(path string, before, after []interface{}) {
+	for i := 0; i < len(before) || i < len(after); i++ {
+		p := path + "/" + strconv.Itoa(i)
+		switch {
+		case i >= len(after):
+			d.add(FieldRemoved, p, before[i], nil)
+		case i >= len(before):
+			d.add(FieldAdded, p, nil, after[i])
+		default:
+			d.diff(p, before[i], after[i])
+		}
+	}
+}
+
+// diffSets compares two arrays as multisets, with the JSON of their elements.
+func (d *differ) diffSets(path string, before, after []interface{}) {
+	count := make(map[string]int)
+	for _, v := range after {
+		count[canonicalJSON(v)]++
+	}
+	for i, v := range before {
+		key := canonicalJSON(v)
+		if count[key] > 0 {
+			count[key]--
+			continue
+		}
+		d.add(FieldRemoved, path+"/"+strconv.Itoa(i), v, nil)
+	}
+	count = make(map[string]int)
+	for _, v := range before {
+		count[canonicalJSON(v)]++
+	}
+	for i, v := range after {
+		key := canonicalJSON(v)
+		if count[key] > 0 {
+			count[key]--
+			continue
+		}
+		d.add(FieldAdded, path+"/"+strconv.Itoa(i), nil, v)
+	}
+}
+
+func (d *differ) add(kind ChangeKind, path string, before, after interface{}) {
+	change := FieldChange{Kind: kind, Path: path}
+	change.Before, change.Truncated = d.truncate(before)
+	var truncated bool
+	change.After, truncated = d.truncate(after)
+	change.Truncated = change.Truncated || truncated
+	d.changes = append(d.changes, change)
+}
+
+func (d *differ) truncate(value interface{}) (interface{}, bool) {
+	if value == nil || d.opts.MaxValueSize < 0 {
+		return value, false
+	}
+	data := canonicalJSON(value)
+	if len(data) <= d.opts.MaxValueSize {
+		return value, false
+	}
+	return strings.ToValidUTF8(data[:d.opts.MaxValueSize], ""), true
+}
+
+// canonicalJSON returns the JSON of a decoded value. The keys of the objects
+// are sorted by encoding/json, so equal values have the same JSON.
+func canonicalJSON(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// escapePointer escapes a key for a JSON pointer (RFC 6901).
+func escapePointer(key string) string {
+	key = strings.Replace(key, "~", "~0", -1)
+	return strings.Replace(key, "/", "~1", -1)
+}
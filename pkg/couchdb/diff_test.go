@@ -0,0 +1,103 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffDocs(t *testing.T) {
+	a := json.RawMessage(`{
+		"_id": "foo",
+		"_rev": "1-abc",
+		"name": "bar.txt",
+		"size": 12,
+		"tags": ["a", "b", "c"],
+		"metadata": {"datetime": "2021-03-04T05:06:07Z", "a/b": 1},
+		"trashed": false
+	}`)
+	b := json.RawMessage(`{
+		"_id": "foo",
+		"_rev": "2-def",
+		"name": "baz.txt",
+		"size": 12,
+		"tags": ["c", "a"],
+		"metadata": {"datetime": "2021-03-04T05:06:07Z", "a/b": 2, "gps": {"lat": 1.5}},
+		"trashed": "no"
+	}`)
+	changes, err := DiffDocs(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []FieldChange{
+		{Kind: FieldModified, Path: "/metadata/a~1b", Before: json.Number("1"), After: json.Number("2")},
+		{Kind: FieldAdded, Path: "/metadata/gps", After: map[string]interface{}{"lat": json.Number("1.5")}},
+		{Kind: FieldModified, Path: "/name", Before: "bar.txt", After: "baz.txt"},
+		{Kind: FieldModified, Path: "/tags/0", Before: "a", After: "c"},
+		{Kind: FieldModified, Path: "/tags/1", Before: "b", After: "a"},
+		{Kind: FieldRemoved, Path: "/tags/2", Before: "c"},
+		{Kind: FieldModified, Path: "/trashed", Before: false, After: "no"},
+	}, changes)
+
+	changes, err = DiffDocsWithOptions(a, b, DiffOptions{ArraysAsSets: true})
+	assert.NoError(t, err)
+	var tags []FieldChange
+	for _, change := range changes {
+		if strings.HasPrefix(change.Path, "/tags") {
+			tags = append(tags, change)
+		}
+	}
+	assert.Equal(t, []FieldChange{{Kind: FieldRemoved, Path: "/tags/1", Before: "b"}}, tags)
+
+	changes, err = DiffDocs(a, a)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+
+	_, err = DiffDocs(a, json.RawMessage(`[1, 2]`))
+	assert.Error(t, err)
+
+	// The large values are truncated
+	large := json.RawMessage(`{"content": "` + strings.Repeat("é", 1000) + `"}`)
+	changes, err = DiffDocsWithOptions(a, large, DiffOptions{MaxValueSize: 11})
+	assert.NoError(t, err)
+	for _, change := range changes {
+		switch change.Path {
+		case "/content":
+			assert.True(t, change.Truncated)
+			assert.Equal(t, `"ééééé`, change.After)
+		case "/size", "/trashed":
+			assert.False(t, change.Truncated, change.Path)
+		}
+	}
+	changes, err = DiffDocsWithOptions(a, large, DiffOptions{MaxValueSize: 12})
+	assert.NoError(t, err)
+	for _, change := range changes {
+		if change.Path == "/content" {
+			// A character is never cut in the middle
+			assert.Equal(t, `"ééééé`, change.After)
+		}
+	}
+	changes, err = DiffDocsWithOptions(a, large, DiffOptions{MaxValueSize: -1})
+	assert.NoError(t, err)
+	for _, change := range changes {
+		assert.False(t, change.Truncated, change.Path)
+	}
+}
+
+func TestDiffRevs(t *testing.T) {
+	var revs []string
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rev := r.URL.Query().Get("rev")
+		revs = append(revs, rev)
+		_, _ = w.Write([]byte(`{"_id":"foo","_rev":"` + rev + `","name":"` + rev + `"}`))
+	}))
+	defer restore()
+
+	changes, err := DiffRevs(TestPrefix, TestDoctype, "foo", "1-abc", "3-def")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1-abc", "3-def"}, revs)
+	assert.Equal(t, []FieldChange{
+		{Kind: FieldModified, Path: "/name", Before: "1-abc", After: "3-def"},
+	}, changes)
+}
@@ -0,0 +1,363 @@
+package couchdb
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDocCacheTTL is the duration for which a document is kept in the
+// cache of the documents, when no TTL is given to SetDocCache.
+const DefaultDocCacheTTL = 30 * time.Second
+
+// CacheMetricsCollector can be implemented by a MetricsCollector to also
+// observe the hits and misses of the cache of the documents.
+type CacheMetricsCollector interface {
+	ObserveCacheHit(doctype string)
+	ObserveCacheMiss(doctype string)
+}
+
+// DocCacheStats are the counters of the cache of the documents.
+type DocCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+	// InvalidationLag is the Lag of the running CacheInvalidator, if any
+	InvalidationLag time.Duration
+}
+
+type noDocCacheKey struct{}
+
+// WithoutDocCache returns a context where GetDoc always reads the documents
+// from CouchDB, even for the cached doctypes. The document read is still put
+// in the cache.
+func WithoutDocCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noDocCacheKey{}, true)
+}
+
+var cachedDoctypes = make(map[string]bool)
+
+// RegisterCachedDoctype enables the cache of the documents for a doctype. It
+// is meant for the documents read on nearly every request, like the settings
+// or the app manifests, and never for the volatile doctypes. The cache must
+// also be enabled with SetDocCache.
+//
+// The cached documents are only those read by GetDoc, and their Go type must
+// decode the JSON of the document like they do for a response of CouchDB.
+// Within a process, a document read after a write made with this package
+// returns, successful or not, is never older than this write: the writes
+// invalidate the entries of their documents, or of their whole database for
+// the bulk operations, and a read that started before a write is not cached.
+// The writes of the other processes, or made directly on CouchDB, are seen
+// after the TTL at most, unless WatchDocCache is used for the database, or a
+// CacheInvalidator is running.
+func RegisterCachedDoctype(doctype string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	cachedDoctypes[doctype] = true
+}
+
+func isCachedDoctype(doctype string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return cachedDoctypes[doctype]
+}
+
+// docCacheKey identifies a document by the name of its database, so that
+// the escaped doctypes used by DeleteAllDBs match too.
+type docCacheKey struct {
+	dbname string
+	id     string
+}
+
+type docCacheEntry struct {
+	key     docCacheKey
+	rev     string
+	data    []byte
+	expires time.Time
+}
+
+// docCache is a LRU cache of the JSON of the documents, bounded by a number
+// of entries.
+type docCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	lru     *list.List
+	entries map[docCacheKey]*list.Element
+	// perDB is the number of entries for each database
+	perDB map[string]int
+	// epoch is incremented by each invalidation, so that a document read
+	// before a write is not put in the cache after it
+	epoch     uint64
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+var (
+	docCacheMu sync.RWMutex
+	theCache   *docCache
+)
+
+// SetDocCache enables the cache of the documents of the registered doctypes,
+// with a maximal number of entries, and the duration for which they are kept
+// (DefaultDocCacheTTL if zero). A size of zero disables the cache. The
+// entries of the previous cache are dropped.
+func SetDocCache(size int, ttl time.Duration) {
+	var c *docCache
+	if size > 0 {
+		if ttl <= 0 {
+			ttl = DefaultDocCacheTTL
+		}
+		c = &docCache{
+			size:    size,
+			ttl:     ttl,
+			lru:     list.New(),
+			entries: make(map[docCacheKey]*list.Element),
+			perDB:   make(map[string]int),
+		}
+	}
+	docCacheMu.Lock()
+	theCache = c
+	docCacheMu.Unlock()
+}
+
+func getDocCache() *docCache {
+	docCacheMu.RLock()
+	defer docCacheMu.RUnlock()
+	return theCache
+}
+
+// GetDocCacheStats returns the counters of the cache of the documents.
+func GetDocCacheStats() DocCacheStats {
+	c := getDocCache()
+	if c == nil {
+		return DocCacheStats{}
+	}
+	var lag time.Duration
+	if inv := getCacheInvalidator(); inv != nil {
+		lag = inv.Lag()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return DocCacheStats{
+		Hits:            c.hits,
+		Misses:          c.misses,
+		Evictions:       c.evictions,
+		Size:            c.lru.Len(),
+		InvalidationLag: lag,
+	}
+}
+
+func (c *docCache) get(key docCacheKey) ([]byte, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*docCacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			c.hits++
+			return entry.data, c.epoch, true
+		}
+		c.remove(elem)
+	}
+	c.misses++
+	return nil, c.epoch, false
+}
+
+func (c *docCache) currentEpoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+// put adds a document to the cache, unless an invalidation has happened since
+// the given epoch.
+func (c *docCache) put(key docCacheKey, rev string, data []byte, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.epoch != epoch {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	entry := &docCacheEntry{key: key, rev: rev, data: data, expires: time.Now().Add(c.ttl)}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.perDB[key.dbname]++
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *docCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*docCacheEntry)
+	delete(c.entries, entry.key)
+	if c.perDB[entry.key.dbname]--; c.perDB[entry.key.dbname] <= 0 {
+		delete(c.perDB, entry.key.dbname)
+	}
+}
+
+// hasEntries returns true if some documents of the database are cached.
+func (c *docCache) hasEntries(dbname string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.perDB[dbname] > 0
+}
+
+// invalidate removes a document from the cache, unless it is already at the
+// given revision. An empty id removes all the documents of the database.
+func (c *docCache) invalidate(dbname, id, rev string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id != "" {
+		elem, ok := c.entries[docCacheKey{dbname, id}]
+		if ok && rev != "" && elem.Value.(*docCacheEntry).rev == rev {
+			return
+		}
+		c.epoch++
+		if ok {
+			c.remove(elem)
+		}
+		return
+	}
+	c.epoch++
+	for key, elem := range c.entries {
+		if key.dbname == dbname {
+			c.remove(elem)
+		}
+	}
+}
+
+// invalidateDocCache is called by makeRequest for the writes. A write on a
+// document invalidates this document, with its bare and prefixed IDs, and the
+// other writes (_bulk_docs, _purge, deletion of the database, etc.)
+// invalidate the whole database.
+func invalidateDocCache(db Database, doctype, path string) {
+	c := getDocCache()
+	if c == nil || doctype == "" {
+		return
+	}
+	dbname := makeDBName(db, doctype)
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if path == "" || strings.HasPrefix(path, "_") || strings.Contains(path, "/") {
+		c.invalidate(dbname, "", "")
+		return
+	}
+	id, err := url.PathUnescape(path)
+	if err != nil {
+		c.invalidate(dbname, "", "")
+		return
+	}
+	c.invalidate(dbname, id, "")
+	if legacy := legacyID(doctype, id); legacy != "" {
+		c.invalidate(dbname, legacy, "")
+	}
+}
+
+// observeCache reports a hit or a miss of the cache to the metrics collector,
+// if it is interested.
+func observeCache(doctype string, hit bool) {
+	collector, ok := metricsCollector.(CacheMetricsCollector)
+	if !ok {
+		return
+	}
+	if hit {
+		collector.ObserveCacheHit(doctype)
+	} else {
+		collector.ObserveCacheMiss(doctype)
+	}
+}
+
+// capturingDecoder decodes a response like makeRequest does, and keeps its
+// body for the cache.
+type capturingDecoder struct {
+	out interface{}
+	buf bytes.Buffer
+}
+
+func (d *capturingDecoder) decodeResponse(r io.Reader) error {
+	return decodeResponse(io.TeeReader(r, &d.buf), d.out)
+}
+
+// getCachedDoc is GetDoc for a cached doctype: the document is decoded from
+// the cache if it is there, and put in the cache if it has been read from
+// CouchDB.
+func getCachedDoc(ctx context.Context, c *docCache, db Database, doctype, id string, out Doc) error {
+	key := docCacheKey{dbname: makeDBName(db, doctype), id: id}
+	var data []byte
+	var epoch uint64
+	var ok bool
+	if ctx.Value(noDocCacheKey{}) == nil {
+		data, epoch, ok = c.get(key)
+	} else {
+		epoch = c.currentEpoch()
+	}
+	if ok {
+		observeCache(doctype, true)
+		return decodeResponse(bytes.NewReader(data), strictOut(ctx, doctype, out))
+	}
+	observeCache(doctype, false)
+	capture := &capturingDecoder{out: strictOut(ctx, doctype, out)}
+	if err := makeRequest(ctx, db, doctype, http.MethodGet, url.PathEscape(id), nil, capture); err != nil {
+		return err
+	}
+	c.put(key, out.Rev(), capture.buf.Bytes(), epoch)
+	watchCachedDB(db, doctype)
+	return nil
+}
+
+// WatchDocCache follows the changes feed of a database, to remove from the
+// cache the documents changed by the other processes, until the context is
+// canceled. It is meant for the databases shared by all the instances, as it
+// keeps a connection open to CouchDB for each call.
+func WatchDocCache(ctx context.Context, db Database, doctype string) error {
+	dbname := makeDBName(db, doctype)
+	since := "now"
+	for {
+		req := &ChangesRequest{
+			DocType: doctype,
+			Feed:    ChangesModeLongpoll,
+			Since:   since,
+		}
+		res, err := ForeachChangeContext(ctx, db, req, func(change *Change) error {
+			if c := getDocCache(); c != nil {
+				var rev string
+				if len(change.Changes) > 0 {
+					rev = change.Changes[0].Rev
+				}
+				c.invalidate(dbname, change.DocID, rev)
+			}
+			return nil
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// The changes missed during the failure are unknown
+			if c := getDocCache(); c != nil {
+				c.invalidate(dbname, "", "")
+			}
+			loggerFor(db).Warnf("cannot watch the changes of %s for the cache: %s", doctype, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second):
+			}
+			since = "now"
+			continue
+		}
+		since = res.LastSeq
+	}
+}
@@ -0,0 +1,330 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const cachedDoctype = "io.cozy.tests.cached"
+
+func init() {
+	RegisterCachedDoctype(cachedDoctype)
+}
+
+// docStore is a fake CouchDB for the documents of a database, that counts
+// the reads of the documents, and answers 304 to the conditional reads of a
+// document that has not changed. A change can be sent on its changes feed.
+type docStore struct {
+	mu          sync.Mutex
+	docs        map[string]map[string]interface{}
+	gets        int
+	notModified int
+	changes     chan string
+}
+
+func newDocStore() *docStore {
+	return &docStore{
+		docs:    make(map[string]map[string]interface{}),
+		changes: make(chan string, 10),
+	}
+}
+
+// set changes a document, like another process would do.
+func (s *docStore) set(id string, fields map[string]interface{}) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rev := 1
+	if old, ok := s.docs[id]; ok {
+		_, _ = fmt.Sscanf(old["_rev"].(string), "%d-", &rev)
+		rev++
+	}
+	doc := map[string]interface{}{"_id": id, "_rev": fmt.Sprintf("%d-abc", rev)}
+	for k, v := range fields {
+		doc[k] = v
+	}
+	s.docs[id] = doc
+	return doc["_rev"].(string)
+}
+
+func (s *docStore) getCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+func (s *docStore) notModifiedCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.notModified
+}
+
+func (s *docStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/", 2)
+	if len(parts) < 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id, _ := url.PathUnescape(parts[1])
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		_, _ = w.Write([]byte(`{"update_seq":"0-a","doc_count":0}`))
+	case id == "_changes" && r.URL.Query().Get("feed") == "":
+		_, _ = w.Write([]byte(`{"results":[],"last_seq":"0-a"}`))
+	case id == "_changes":
+		select {
+		case docID := <-s.changes:
+			s.mu.Lock()
+			rev := s.docs[docID]["_rev"]
+			s.mu.Unlock()
+			fmt.Fprintf(w, `{"results":[{"seq":"1-a","id":%q,"changes":[{"rev":%q}]}],"last_seq":"1-a"}`, docID, rev)
+		case <-r.Context().Done():
+		}
+	case id == "_bulk_docs":
+		var body struct {
+			Docs []map[string]interface{} `json:"docs"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		var rows []string
+		for _, doc := range body.Docs {
+			docID := doc["_id"].(string)
+			delete(doc, "_id")
+			delete(doc, "_rev")
+			rev := s.set(docID, doc)
+			rows = append(rows, fmt.Sprintf(`{"ok":true,"id":%q,"rev":%q}`, docID, rev))
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("[" + strings.Join(rows, ",") + "]"))
+	case r.Method == http.MethodGet:
+		s.mu.Lock()
+		s.gets++
+		doc, ok := s.docs[id]
+		var data []byte
+		if ok {
+			data, _ = json.Marshal(doc)
+		}
+		etag := fmt.Sprintf("%q", doc["_rev"])
+		notModified := ok && r.Header.Get("If-None-Match") == etag
+		if notModified {
+			s.notModified++
+		}
+		s.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+			return
+		}
+		w.Header().Set("ETag", etag)
+		if notModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write(data)
+	case r.Method == http.MethodPut:
+		var doc map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&doc)
+		delete(doc, "_id")
+		delete(doc, "_rev")
+		rev := s.set(id, doc)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"ok":true,"id":%q,"rev":%q}`, id, rev)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func useDocCache(t *testing.T, size int, ttl time.Duration) (*docStore, func()) {
+	store := newDocStore()
+	restore := useTestServer(t, store)
+	SetDocCache(size, ttl)
+	return store, func() {
+		SetDocCache(0, 0)
+		restore()
+	}
+}
+
+func getCached(ctx context.Context, t *testing.T, id string) *JSONDoc {
+	doc := &JSONDoc{}
+	assert.NoError(t, GetDocContext(ctx, TestPrefix, cachedDoctype, id, doc))
+	return doc
+}
+
+func TestDocCache(t *testing.T) {
+	store, restore := useDocCache(t, 10, time.Minute)
+	defer restore()
+	store.set("settings", map[string]interface{}{"theme": "dark"})
+	ctx := context.Background()
+
+	doc := getCached(ctx, t, "settings")
+	assert.Equal(t, "dark", doc.M["theme"])
+	doc = getCached(ctx, t, "settings")
+	assert.Equal(t, "dark", doc.M["theme"])
+	assert.Equal(t, cachedDoctype, doc.DocType())
+	assert.Equal(t, "1-abc", doc.Rev())
+	assert.Equal(t, 1, store.getCount())
+	stats := GetDocCacheStats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, 1, stats.Size)
+
+	// The cached document is decoded again for each read
+	doc.M["theme"] = "light"
+	assert.Equal(t, "dark", getCached(ctx, t, "settings").M["theme"])
+
+	// A write made by another process is only seen after the TTL
+	store.set("settings", map[string]interface{}{"theme": "blue"})
+	assert.Equal(t, "dark", getCached(ctx, t, "settings").M["theme"])
+	assert.Equal(t, "blue", getCached(WithoutDocCache(ctx), t, "settings").M["theme"])
+	assert.Equal(t, "blue", getCached(ctx, t, "settings").M["theme"])
+
+	// The other doctypes are not cached
+	assert.NoError(t, GetDocContext(ctx, TestPrefix, TestDoctype, "settings", &JSONDoc{}))
+	assert.NoError(t, GetDocContext(ctx, TestPrefix, TestDoctype, "settings", &JSONDoc{}))
+	assert.Equal(t, 4, store.getCount())
+
+	// The missing documents are not cached
+	err := GetDocContext(ctx, TestPrefix, cachedDoctype, "missing", &JSONDoc{})
+	assert.True(t, IsNotFoundError(err))
+	err = GetDocContext(ctx, TestPrefix, cachedDoctype, "missing", &JSONDoc{})
+	assert.True(t, IsNotFoundError(err))
+	assert.Equal(t, 6, store.getCount())
+}
+
+func TestDocCacheReadYourOwnWrites(t *testing.T) {
+	store, restore := useDocCache(t, 10, time.Minute)
+	defer restore()
+	store.set("settings", map[string]interface{}{"theme": "dark"})
+	store.set("other", map[string]interface{}{"theme": "dark"})
+	ctx := context.Background()
+
+	doc := getCached(ctx, t, "settings")
+	doc.Type = cachedDoctype
+	doc.M["theme"] = "light"
+	assert.NoError(t, UpdateDocContext(ctx, TestPrefix, doc))
+	fresh := getCached(ctx, t, "settings")
+	assert.Equal(t, "light", fresh.M["theme"])
+	assert.Equal(t, doc.Rev(), fresh.Rev())
+
+	// The bulk writes invalidate the whole database
+	getCached(ctx, t, "other")
+	before := store.getCount()
+	assert.NoError(t, BulkUpdateDocsContext(ctx, TestPrefix, cachedDoctype, []interface{}{
+		&JSONDoc{Type: cachedDoctype, M: map[string]interface{}{"_id": "new", "theme": "red"}},
+	}, nil))
+	getCached(ctx, t, "other")
+	getCached(ctx, t, "settings")
+	assert.Equal(t, before+2, store.getCount())
+}
+
+func TestDocCacheNotFilledByAReadBeforeAWrite(t *testing.T) {
+	SetDocCache(10, time.Minute)
+	defer SetDocCache(0, 0)
+	c := getDocCache()
+	key := docCacheKey{dbname: "db", id: "settings"}
+
+	// A read starts, a write happens, and then the read ends
+	_, epoch, ok := c.get(key)
+	assert.False(t, ok)
+	c.invalidate("db", "settings", "")
+	c.put(key, "1-abc", []byte(`{}`), epoch)
+	_, _, ok = c.get(key)
+	assert.False(t, ok)
+
+	_, epoch, _ = c.get(key)
+	c.put(key, "2-abc", []byte(`{}`), epoch)
+	_, _, ok = c.get(key)
+	assert.True(t, ok)
+
+	// A change for the same revision keeps the entry
+	c.invalidate("db", "settings", "2-abc")
+	_, _, ok = c.get(key)
+	assert.True(t, ok)
+	c.invalidate("db", "settings", "3-abc")
+	_, _, ok = c.get(key)
+	assert.False(t, ok)
+}
+
+func TestDocCacheEviction(t *testing.T) {
+	store, restore := useDocCache(t, 2, 50*time.Millisecond)
+	defer restore()
+	for _, id := range []string{"a", "b", "c"} {
+		store.set(id, map[string]interface{}{"name": id})
+	}
+	ctx := context.Background()
+
+	getCached(ctx, t, "a")
+	getCached(ctx, t, "b")
+	getCached(ctx, t, "a")
+	getCached(ctx, t, "c")
+	assert.Equal(t, 3, store.getCount())
+	stats := GetDocCacheStats()
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, 2, stats.Size)
+
+	// b was the least recently used
+	getCached(ctx, t, "a")
+	assert.Equal(t, 3, store.getCount())
+	getCached(ctx, t, "b")
+	assert.Equal(t, 4, store.getCount())
+
+	// The entries expire after the TTL
+	time.Sleep(60 * time.Millisecond)
+	getCached(ctx, t, "b")
+	assert.Equal(t, 5, store.getCount())
+}
+
+type cacheMetrics struct {
+	nopMetrics
+	mu     sync.Mutex
+	hits   int
+	misses int
+}
+
+func (m *cacheMetrics) ObserveCacheHit(doctype string) {
+	m.mu.Lock()
+	m.hits++
+	m.mu.Unlock()
+}
+
+func (m *cacheMetrics) ObserveCacheMiss(doctype string) {
+	m.mu.Lock()
+	m.misses++
+	m.mu.Unlock()
+}
+
+func TestDocCacheMetricsAndWatch(t *testing.T) {
+	store, restore := useDocCache(t, 10, time.Minute)
+	defer restore()
+	metrics := &cacheMetrics{}
+	SetMetricsCollector(metrics)
+	defer SetMetricsCollector(nil)
+	store.set("settings", map[string]interface{}{"theme": "dark"})
+	ctx := context.Background()
+
+	getCached(ctx, t, "settings")
+	getCached(ctx, t, "settings")
+	assert.Equal(t, 1, metrics.hits)
+	assert.Equal(t, 1, metrics.misses)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- WatchDocCache(watchCtx, TestPrefix, cachedDoctype) }()
+
+	store.set("settings", map[string]interface{}{"theme": "blue"})
+	store.changes <- "settings"
+	deadline := time.Now().Add(5 * time.Second)
+	for GetDocCacheStats().Size > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, "blue", getCached(ctx, t, "settings").M["theme"])
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
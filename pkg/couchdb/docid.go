@@ -0,0 +1,79 @@
+package couchdb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrBadDocID is the error matched by errors.Is when a request has not been
+// sent to CouchDB because the identifier of the document is not valid.
+var ErrBadDocID = errors.New("CouchDB: bad document ID")
+
+const (
+	designDocPrefix = "_design/"
+	localDocPrefix  = "_local/"
+)
+
+// MaxDocIDLength is the maximal length, in bytes, of the identifier of a
+// document.
+const MaxDocIDLength = 512
+
+// ValidateDocID checks that an identifier can be used for a document: it
+// must be a non-empty UTF-8 string, not longer than MaxDocIDLength, and must
+// not start with an underscore, as those identifiers are reserved by CouchDB.
+// The only exceptions are the design documents, with the _design/ prefix, and
+// the local documents, with the _local/ prefix, but they have their own code
+// paths: DefineViews and DefineIndexes for the design documents, and
+// GetLocal, PutLocal and DeleteLocal for the local documents.
+//
+// The error matches ErrBadDocID, and has a 400 status for the API responses.
+func ValidateDocID(id string) error {
+	switch {
+	case id == "":
+		return newInvalidDocIDError("the document ID is empty")
+	case !utf8.ValidString(id):
+		return newInvalidDocIDError("the document ID is not valid UTF-8")
+	case len(id) > MaxDocIDLength:
+		return newInvalidDocIDError(fmt.Sprintf("the document ID is longer than %d bytes", MaxDocIDLength))
+	case id[0] == '_':
+		return validateSpecialDocID(id)
+	}
+	return nil
+}
+
+// validateSpecialDocID checks an identifier starting with an underscore.
+func validateSpecialDocID(id string) error {
+	switch {
+	case id == designDocPrefix || id == localDocPrefix:
+		return newInvalidDocIDError(fmt.Sprintf("the document ID %s has no name", id))
+	case strings.HasPrefix(id, designDocPrefix), strings.HasPrefix(id, localDocPrefix):
+		return nil
+	}
+	return newInvalidDocIDError("the document IDs starting with an underscore are reserved by CouchDB: " +
+		"use DefineViews or DefineIndexes for the _design/ documents, " +
+		"and GetLocal, PutLocal or DeleteLocal for the _local/ documents")
+}
+
+// validateDocID checks the identifier of a document when it is not empty: an
+// empty identifier is reported by the callers, with their own message.
+func validateDocID(id string) (string, error) {
+	if id == "" {
+		return "", nil
+	}
+	if err := ValidateDocID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func newInvalidDocIDError(reason string) error {
+	return &Error{
+		StatusCode: http.StatusBadRequest,
+		Name:       "bad_id",
+		Reason:     reason,
+		notSent:    true,
+	}
+}
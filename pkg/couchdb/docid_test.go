@@ -0,0 +1,67 @@
+package couchdb
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDocID(t *testing.T) {
+	assert.NoError(t, ValidateDocID("foo"))
+	assert.NoError(t, ValidateDocID("io.cozy.files/été?#"))
+	assert.NoError(t, ValidateDocID(strings.Repeat("a", MaxDocIDLength)))
+	assert.NoError(t, ValidateDocID("_design/foo"))
+	assert.NoError(t, ValidateDocID("_local/foo"))
+
+	for _, id := range []string{
+		"",
+		"_design/",
+		"_local/",
+		"_foo",
+		"_designfoo",
+		"foo\xff",
+		strings.Repeat("a", MaxDocIDLength+1),
+	} {
+		err := ValidateDocID(id)
+		assert.True(t, errors.Is(err, ErrBadDocID), id)
+		if couchErr, ok := IsCouchError(err); assert.True(t, ok) {
+			assert.Equal(t, http.StatusBadRequest, couchErr.HTTPStatus())
+			assert.NotEmpty(t, couchErr.Reason)
+		}
+	}
+
+	// The reason points to the functions for the design and local documents
+	err := ValidateDocID("_foo")
+	assert.Contains(t, err.Error(), "DefineViews")
+	assert.Contains(t, err.Error(), "PutLocal")
+
+	// An error of CouchDB with the same name has been sent to CouchDB
+	couchErr := &Error{StatusCode: http.StatusBadRequest, Name: "bad_id", Reason: "Document id must not be empty"}
+	assert.False(t, errors.Is(couchErr, ErrBadDocID))
+}
+
+func TestBadDocIDNoRequest(t *testing.T) {
+	requests := 0
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer restore()
+
+	const bad = "_bad"
+	doc := &testDoc{TestID: bad, TestRev: "1-abc"}
+	assert.True(t, errors.Is(GetDoc(TestPrefix, TestDoctype, bad, &testDoc{}), ErrBadDocID))
+	assert.True(t, errors.Is(UpdateDoc(TestPrefix, doc), ErrBadDocID))
+	assert.True(t, errors.Is(DeleteDoc(TestPrefix, doc), ErrBadDocID))
+	assert.True(t, errors.Is(CreateNamedDoc(TestPrefix, &testDoc{TestID: bad}), ErrBadDocID))
+	err := BulkUpdateDocs(TestPrefix, TestDoctype, []interface{}{&testDoc{TestID: "ok"}, doc}, nil)
+	assert.True(t, errors.Is(err, ErrBadDocID))
+	err = BulkDeleteDocs(TestPrefix, TestDoctype, []Doc{&testDoc{TestID: "ok", TestRev: "1-abc"}, doc})
+	assert.True(t, errors.Is(err, ErrBadDocID))
+	err = BulkDeleteDocs(TestPrefix, TestDoctype, []Doc{&testDoc{TestRev: "1-abc"}})
+	assert.True(t, errors.Is(err, ErrBadDocID))
+	assert.Equal(t, 0, requests)
+}
@@ -0,0 +1,77 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+type maxDocSizeKey struct{}
+
+// WithMaxDocumentSize returns a context where the documents sent to CouchDB
+// can be up to the given size in bytes, instead of the limit from the
+// configuration. It is meant for the doctypes known to hold big payloads, and
+// the limit of CouchDB (max_document_size) must be raised accordingly. A zero
+// size disables the check.
+func WithMaxDocumentSize(ctx context.Context, size int) context.Context {
+	return context.WithValue(ctx, maxDocSizeKey{}, size)
+}
+
+func maxDocumentSizeFor(ctx context.Context) int {
+	if size, ok := ctx.Value(maxDocSizeKey{}).(int); ok {
+		return size
+	}
+	return config.GetConfig().CouchDB.MaxDocumentSize
+}
+
+// checkDocumentSize returns an error if the body of a request that writes
+// documents is larger than the limit, so that it is not uploaded to CouchDB
+// only to be rejected. For _bulk_docs, the limit applies to each document,
+// and the error tells which one is too large.
+func checkDocumentSize(ctx context.Context, method, path string, reqjson []byte) error {
+	limit := maxDocumentSizeFor(ctx)
+	if limit <= 0 || len(reqjson) <= limit {
+		return nil
+	}
+	switch {
+	case method == http.MethodPost && strings.HasSuffix(path, "_bulk_docs"):
+		var body struct {
+			Docs []json.RawMessage `json:"docs"`
+		}
+		if err := json.Unmarshal(reqjson, &body); err != nil {
+			return nil
+		}
+		for i, doc := range body.Docs {
+			if len(doc) > limit {
+				return newDocumentTooLargeError(doc, i, limit)
+			}
+		}
+	case method == http.MethodPost && path == "", method == http.MethodPut:
+		return newDocumentTooLargeError(reqjson, -1, limit)
+	}
+	return nil
+}
+
+func newDocumentTooLargeError(doc []byte, index, limit int) error {
+	var d struct {
+		ID string `json:"_id"`
+	}
+	_ = json.Unmarshal(doc, &d)
+	what := "the document"
+	if d.ID != "" {
+		what += " " + d.ID
+	}
+	if index >= 0 {
+		what += fmt.Sprintf(" (#%d of the bulk)", index)
+	}
+	return &Error{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Name:       "document_too_large",
+		Reason: fmt.Sprintf("%s is %d bytes, over the limit of %d bytes",
+			what, len(doc), limit),
+	}
+}
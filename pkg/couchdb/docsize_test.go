@@ -0,0 +1,62 @@
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocumentSize(t *testing.T) {
+	var requests int
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if strings.HasSuffix(r.URL.Path, "/_bulk_docs") {
+			_, _ = w.Write([]byte(`[{"ok":true,"id":"a","rev":"1-a"},{"ok":true,"id":"b","rev":"1-b"}]`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"ok":true,"id":"foo","rev":"1-abc"}`))
+	}))
+	defer restore()
+	config.GetConfig().CouchDB.MaxDocumentSize = 100
+
+	big := func(id string) *JSONDoc {
+		return &JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+			"_id":  id,
+			"data": strings.Repeat("x", 100),
+		}}
+	}
+	small := func(id string) *JSONDoc {
+		return &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": id}}
+	}
+
+	err := CreateNamedDoc(TestPrefix, big("foo"))
+	assert.True(t, errors.Is(err, ErrDocumentTooLarge))
+	if couchErr, ok := IsCouchError(err); assert.True(t, ok) {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, couchErr.StatusCode)
+		assert.Contains(t, couchErr.Reason, "the document foo is ")
+		assert.Contains(t, couchErr.Reason, "over the limit of 100 bytes")
+	}
+	assert.Equal(t, 0, requests)
+
+	err = BulkUpdateDocs(TestPrefix, TestDoctype, []interface{}{small("a"), big("b")}, nil)
+	assert.True(t, errors.Is(err, ErrDocumentTooLarge))
+	if couchErr, ok := IsCouchError(err); assert.True(t, ok) {
+		assert.Contains(t, couchErr.Reason, "the document b (#1 of the bulk) is ")
+	}
+	assert.Equal(t, 0, requests)
+
+	// Many small documents can be sent in a bulk larger than the limit
+	docs := []interface{}{small(strings.Repeat("a", 60)), small(strings.Repeat("b", 60))}
+	assert.NoError(t, BulkUpdateDocs(TestPrefix, TestDoctype, docs, nil))
+	assert.Equal(t, 1, requests)
+
+	ctx := WithMaxDocumentSize(context.Background(), 0)
+	assert.NoError(t, CreateNamedDocContext(ctx, TestPrefix, big("foo")))
+	assert.Equal(t, 2, requests)
+}
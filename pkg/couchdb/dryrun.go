@@ -0,0 +1,145 @@
+package couchdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type dryRunKey struct{}
+
+// DryRunOperation is a write that would have been made to CouchDB without
+// the dry-run mode.
+type DryRunOperation struct {
+	Method  string
+	Doctype string
+	DocID   string
+	// Size is the size in bytes of the document, or of the body of the
+	// request for the writes that are not on a document
+	Size int
+}
+
+// DryRunReport records the writes made with a dry-run context.
+type DryRunReport struct {
+	mu         sync.Mutex
+	operations []DryRunOperation
+}
+
+// Operations returns the writes that have been recorded, in order.
+func (r *DryRunReport) Operations() []DryRunOperation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ops := make([]DryRunOperation, len(r.operations))
+	copy(ops, r.operations)
+	return ops
+}
+
+func (r *DryRunReport) record(op DryRunOperation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.operations = append(r.operations, op)
+}
+
+// WithDryRun returns a context where the requests that write to CouchDB are
+// not sent, but recorded in the returned report. They succeed with a fake
+// response, where the documents have a new revision, so that a job can be run
+// to see what it would do. The reads are made normally, and the realtime
+// events are not published for the fake writes.
+func WithDryRun(ctx context.Context) (context.Context, *DryRunReport) {
+	report := &DryRunReport{}
+	return context.WithValue(ctx, dryRunKey{}, report), report
+}
+
+func dryRunFor(ctx context.Context) *DryRunReport {
+	report, _ := ctx.Value(dryRunKey{}).(*DryRunReport)
+	return report
+}
+
+// rtEvent publishes a realtime event, except for the fake writes of the
+// dry-run mode.
+func rtEvent(ctx context.Context, db Database, verb string, doc, oldDoc Doc) {
+	if dryRunFor(ctx) == nil {
+		RTEvent(db, verb, doc, oldDoc)
+	}
+}
+
+// fake records a write instead of sending it to CouchDB, and fills resbody
+// with a response like the one CouchDB would have sent.
+func (r *DryRunReport) fake(method, doctype, path string, reqjson []byte, resbody interface{}) {
+	var query url.Values
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		query, _ = url.ParseQuery(path[i+1:])
+		path = path[:i]
+	}
+
+	if method == http.MethodPost && path == "_bulk_docs" {
+		var body struct {
+			Docs []json.RawMessage `json:"docs"`
+		}
+		_ = json.Unmarshal(reqjson, &body)
+		results := make([]UpdateResponse, len(body.Docs))
+		for i, raw := range body.Docs {
+			id, rev := fakeWrite(raw, "", "")
+			r.record(DryRunOperation{Method: method, Doctype: doctype, DocID: id, Size: len(raw)})
+			results[i] = UpdateResponse{ID: id, Rev: rev, Ok: true}
+		}
+		if res, ok := resbody.(*[]UpdateResponse); ok {
+			*res = results
+		}
+		return
+	}
+
+	// The writes on a document: POST on the database, or PUT and DELETE on
+	// the document (path is its escaped ID)
+	isDoc := (method == http.MethodPost && path == "") ||
+		((method == http.MethodPut || method == http.MethodDelete) && path != "" &&
+			doctype != "" && !strings.HasPrefix(path, "_index/"))
+	if !isDoc {
+		r.record(DryRunOperation{Method: method, Doctype: doctype, Size: len(reqjson)})
+		return
+	}
+	id, _ := url.PathUnescape(path)
+	id, rev := fakeWrite(reqjson, id, query.Get("rev"))
+	r.record(DryRunOperation{Method: method, Doctype: doctype, DocID: id, Size: len(reqjson)})
+	if res, ok := resbody.(*UpdateResponse); ok {
+		*res = UpdateResponse{ID: id, Rev: rev, Ok: true}
+		res.setStatus(http.StatusCreated)
+	}
+}
+
+// fakeWrite returns the ID and the new revision of a document written in
+// dry-run mode. A random ID is generated for a new document, like CouchDB
+// does, and the generation of the revision is incremented.
+func fakeWrite(doc []byte, id, rev string) (string, string) {
+	var d struct {
+		ID  string `json:"_id"`
+		Rev string `json:"_rev"`
+	}
+	_ = json.Unmarshal(doc, &d)
+	if id == "" {
+		id = d.ID
+	}
+	if id == "" {
+		id = randomHex()
+	}
+	if rev == "" {
+		rev = d.Rev
+	}
+	gen := 0
+	if parts := strings.SplitN(rev, "-", 2); len(parts) == 2 {
+		gen, _ = strconv.Atoi(parts[0])
+	}
+	return id, strconv.Itoa(gen+1) + "-" + randomHex()
+}
+
+func randomHex() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
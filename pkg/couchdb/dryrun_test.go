@@ -0,0 +1,73 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRun(t *testing.T) {
+	var requests []string
+	noWrites := func() {
+		for _, method := range requests {
+			assert.Equal(t, http.MethodGet, method)
+		}
+	}
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			_, _ = w.Write([]byte(`{"couchdb":"Welcome","version":"3.1.1"}`))
+			return
+		}
+		requests = append(requests, r.Method)
+		_, _ = w.Write([]byte(`{"_id":"foo","_rev":"4-abc","test":"bar"}`))
+	}))
+	defer restore()
+
+	ctx, report := WithDryRun(context.Background())
+
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"test": "foo"}}
+	assert.NoError(t, CreateDocContext(ctx, TestPrefix, doc))
+	assert.Len(t, doc.ID(), 32)
+	assert.True(t, strings.HasPrefix(doc.Rev(), "1-"))
+	assert.NoError(t, UpdateDocContext(ctx, TestPrefix, doc))
+	assert.True(t, strings.HasPrefix(doc.Rev(), "2-"))
+	assert.NoError(t, DeleteDocContext(ctx, TestPrefix, doc))
+	assert.True(t, strings.HasPrefix(doc.Rev(), "3-"))
+
+	// The reads are made normally
+	existing := &JSONDoc{}
+	assert.NoError(t, GetDocContext(ctx, TestPrefix, TestDoctype, "foo", existing))
+	assert.Equal(t, "4-abc", existing.Rev())
+	existing.Type = TestDoctype
+	noWrites()
+
+	other := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"test": "baz"}}
+	err := BulkUpdateDocsContext(ctx, TestPrefix, TestDoctype, []interface{}{existing, other}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", existing.ID())
+	assert.True(t, strings.HasPrefix(existing.Rev(), "5-"))
+	assert.Len(t, other.ID(), 32)
+	assert.True(t, strings.HasPrefix(other.Rev(), "1-"))
+	noWrites()
+
+	ops := report.Operations()
+	if assert.Len(t, ops, 5) {
+		assert.Equal(t, http.MethodPost, ops[0].Method)
+		assert.Equal(t, TestDoctype, ops[0].Doctype)
+		assert.Equal(t, http.MethodPut, ops[1].Method)
+		assert.Equal(t, doc.ID(), ops[1].DocID)
+		assert.NotZero(t, ops[1].Size)
+		assert.Equal(t, http.MethodDelete, ops[2].Method)
+		assert.Equal(t, doc.ID(), ops[2].DocID)
+		assert.Equal(t, "foo", ops[3].DocID)
+		assert.Equal(t, other.ID(), ops[4].DocID)
+	}
+
+	// Without the dry-run context, the writes are sent
+	requests = nil
+	_ = DeleteDoc(TestPrefix, existing)
+	assert.Equal(t, []string{http.MethodDelete}, requests)
+}
@@ -0,0 +1,352 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The fields registered with RegisterEncryptedFields are encrypted by the
+// stack before being sent to CouchDB, with AES-GCM. The value of such a field
+// is replaced by an envelope, like:
+//
+//	{"$enc": "base64 of the nonce and ciphertext", "alg": "AES-GCM", "kid": "1a2b3c4d"}
+//
+// and the envelopes are decrypted in the responses of CouchDB, so the
+// callers only see the values in clear. The continuous changes feeds are not
+// decrypted, and the views cannot use the encrypted fields.
+
+// EncryptionAlgorithm is the algorithm written in the envelopes of the
+// encrypted fields.
+const EncryptionAlgorithm = "AES-GCM"
+
+// ErrEncryptedField is the error matched by errors.Is when a query, a sort
+// or an index uses an encrypted field: CouchDB only knows its ciphertext.
+var ErrEncryptedField = errors.New("CouchDB: encrypted field")
+
+// ErrNoEncryptionKey is the error returned when a document with encrypted
+// fields is written or read, but no encryption key has been set.
+var ErrNoEncryptionKey = errors.New("CouchDB: no encryption key")
+
+// ErrDecryption is the error returned when an encrypted field cannot be
+// decrypted, for example when its key is no longer known.
+var ErrDecryption = errors.New("CouchDB: cannot decrypt a field")
+
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var (
+	encryptionMu   sync.RWMutex
+	encryptionKeys []encryptionKey
+
+	encryptedFields = make(map[string][]string)
+)
+
+// SetEncryptionKeys sets the keys used to encrypt the fields, encoded in
+// base64. They must have 16, 24 or 32 bytes. The first key encrypts the
+// fields, and the others are the old keys, still used to decrypt the fields
+// written before a rotation: the documents are encrypted with the new key on
+// their next write.
+func SetEncryptionKeys(keys []string) error {
+	parsed := make([]encryptionKey, 0, len(keys))
+	for _, key := range keys {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return fmt.Errorf("invalid encryption key: %w", err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return fmt.Errorf("invalid encryption key: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(raw)
+		parsed = append(parsed, encryptionKey{id: hex.EncodeToString(sum[:4]), aead: aead})
+	}
+	encryptionMu.Lock()
+	defer encryptionMu.Unlock()
+	encryptionKeys = parsed
+	return nil
+}
+
+// RegisterEncryptedFields registers the fields of a doctype that are
+// encrypted, as paths with dots like "auth.password". It is meant to be
+// called in an init function.
+func RegisterEncryptedFields(doctype string, paths ...string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	encryptedFields[doctype] = append(encryptedFields[doctype], paths...)
+}
+
+func encryptedFieldsFor(doctype string) []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return encryptedFields[doctype]
+}
+
+// encryptRequest encrypts the registered fields of the documents in the body
+// of a write request, and rejects the queries and indexes on them.
+func encryptRequest(doctype, method, path string, body []byte) ([]byte, error) {
+	paths := encryptedFieldsFor(doctype)
+	if len(paths) == 0 {
+		return body, nil
+	}
+	switch {
+	case method == http.MethodPost && (path == "_find" || path == "_explain" || path == "_index"):
+		return body, checkQueryFields(paths, body)
+	case method == http.MethodPost && path == "_bulk_docs":
+		var bulk map[string]interface{}
+		if err := decodeUseNumber(body, &bulk); err != nil {
+			return nil, err
+		}
+		docs, _ := bulk["docs"].([]interface{})
+		for _, doc := range docs {
+			if err := encryptFields(doc, paths); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(bulk)
+	case (method == http.MethodPost && path == "") ||
+		(method == http.MethodPut && path != "" && !strings.HasPrefix(path, "_")):
+		var doc interface{}
+		if err := decodeUseNumber(body, &doc); err != nil {
+			return nil, err
+		}
+		if err := encryptFields(doc, paths); err != nil {
+			return nil, err
+		}
+		return json.Marshal(doc)
+	}
+	return body, nil
+}
+
+func encryptFields(doc interface{}, paths []string) error {
+	m, ok := doc.(map[string]interface{})
+	if !ok || m["_deleted"] == true {
+		return nil
+	}
+	j := &JSONDoc{M: m}
+	for _, path := range paths {
+		value, ok := j.GetPath(path)
+		if !ok || value == nil || isEnvelope(value) {
+			continue
+		}
+		envelope, err := encryptValue(value)
+		if err != nil {
+			return err
+		}
+		if err := j.SetPath(path, envelope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encryptValue(value interface{}) (map[string]interface{}, error) {
+	encryptionMu.RLock()
+	keys := encryptionKeys
+	encryptionMu.RUnlock()
+	if len(keys) == 0 {
+		return nil, ErrNoEncryptionKey
+	}
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	key := keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := key.aead.Seal(nonce, nonce, plaintext, nil)
+	return map[string]interface{}{
+		"$enc": base64.StdEncoding.EncodeToString(sealed),
+		"alg":  EncryptionAlgorithm,
+		"kid":  key.id,
+	}, nil
+}
+
+func isEnvelope(value interface{}) bool {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, hasEnc := m["$enc"].(string)
+	return hasEnc && m["alg"] == EncryptionAlgorithm
+}
+
+func decryptValue(envelope map[string]interface{}) (interface{}, error) {
+	encryptionMu.RLock()
+	keys := encryptionKeys
+	encryptionMu.RUnlock()
+	if len(keys) == 0 {
+		return nil, ErrNoEncryptionKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(envelope["$enc"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDecryption, err)
+	}
+	kid, _ := envelope["kid"].(string)
+	for _, key := range keys {
+		if kid != "" && kid != key.id {
+			continue
+		}
+		size := key.aead.NonceSize()
+		if len(sealed) < size {
+			break
+		}
+		plaintext, err := key.aead.Open(nil, sealed[:size], sealed[size:], nil)
+		if err != nil {
+			continue
+		}
+		var value interface{}
+		if err := decodeUseNumber(plaintext, &value); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrDecryption, err)
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("%w: no key for %q", ErrDecryption, kid)
+}
+
+// decryptEnvelopes replaces the envelopes by their decrypted values, where
+// they are in a response: a document, or a list of documents in the rows,
+// results or docs of the response.
+func decryptEnvelopes(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if isEnvelope(v) {
+			return decryptValue(v)
+		}
+		for k, item := range v {
+			decrypted, err := decryptEnvelopes(item)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = decrypted
+		}
+	case []interface{}:
+		for i, item := range v {
+			decrypted, err := decryptEnvelopes(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = decrypted
+		}
+	}
+	return value, nil
+}
+
+// decryptedBody returns the body of a response with the encrypted fields
+// decrypted. The streaming responses are kept as they are.
+func decryptedBody(ctx context.Context, doctype string, body io.Reader) io.Reader {
+	if len(encryptedFieldsFor(doctype)) == 0 || isStreaming(ctx) {
+		return body
+	}
+	return &decryptingReader{body: body}
+}
+
+// decryptingReader reads the whole response on its first call, to decrypt
+// it, and returns the error of the decryption as a read error.
+type decryptingReader struct {
+	body io.Reader
+	r    io.Reader
+	err  error
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = decryptResponse(d.body)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.r.Read(p)
+}
+
+func decryptResponse(body io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(data, []byte(`"$enc"`)) {
+		return bytes.NewReader(data), nil
+	}
+	var value interface{}
+	if err := decodeUseNumber(data, &value); err != nil {
+		return nil, err
+	}
+	if value, err = decryptEnvelopes(value); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(value); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// checkQueryFields returns an error if the selector, the sort or the index
+// of a query uses an encrypted field.
+func checkQueryFields(paths []string, body []byte) error {
+	var query map[string]interface{}
+	if err := json.Unmarshal(body, &query); err != nil {
+		return err
+	}
+	names := make(map[string]struct{})
+	collectFields(query["selector"], "", names)
+	sortFields(query["sort"], names)
+	if index, ok := query["index"].(map[string]interface{}); ok {
+		sortFields(index["fields"], names)
+		collectFields(index["partial_filter_selector"], "", names)
+	}
+	for field := range names {
+		for _, path := range paths {
+			if field == path || strings.HasPrefix(field, path+".") || strings.HasPrefix(path, field+".") {
+				return &Error{
+					StatusCode: http.StatusBadRequest,
+					Name:       "encrypted_field",
+					Reason:     fmt.Sprintf("the field %s is encrypted and cannot be used in a query", field),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sortFields adds the field names of a sort, or of the fields of an index, to
+// names.
+func sortFields(sort interface{}, names map[string]struct{}) {
+	items, _ := sort.([]interface{})
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			names[v] = struct{}{}
+		case map[string]interface{}:
+			for k := range v {
+				names[k] = struct{}{}
+			}
+		}
+	}
+}
+
+func decodeUseNumber(data []byte, out interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(out)
+}
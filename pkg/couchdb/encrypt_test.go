@@ -0,0 +1,196 @@
+package couchdb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+const secretDoctype = "io.cozy.tests.secrets"
+
+type secretDoc struct {
+	BaseDoc
+	Name string `json:"name"`
+	Auth struct {
+		Login    string `json:"login"`
+		Password string `json:"password"`
+	} `json:"auth"`
+	PIN int `json:"pin,omitempty"`
+}
+
+func (s *secretDoc) DocType() string { return secretDoctype }
+func (s *secretDoc) Clone() Doc      { cloned := *s; return &cloned }
+
+func TestEncryptedFields(t *testing.T) {
+	key1 := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	key2 := base64.StdEncoding.EncodeToString([]byte("fedcba9876543210"))
+	assert.Error(t, SetEncryptionKeys([]string{"not base64!"}))
+	assert.Error(t, SetEncryptionKeys([]string{base64.StdEncoding.EncodeToString([]byte("short"))}))
+	RegisterEncryptedFields(secretDoctype, "auth.password", "pin")
+	defer func() {
+		_ = SetEncryptionKeys(nil)
+		registryMu.Lock()
+		delete(encryptedFields, secretDoctype)
+		registryMu.Unlock()
+	}()
+
+	var mu sync.Mutex
+	stored := make(map[string]json.RawMessage)
+	requests := 0
+	save := func(doc map[string]interface{}) UpdateResponse {
+		id, _ := doc["_id"].(string)
+		if id == "" {
+			id = "generated"
+		}
+		doc["_id"] = id
+		doc["_rev"] = "1-abc"
+		stored[id], _ = json.Marshal(doc)
+		return UpdateResponse{ID: id, Rev: "1-abc", Ok: true}
+	}
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		parts := strings.Split(r.URL.EscapedPath(), "/")
+		last, _ := url.PathUnescape(parts[len(parts)-1])
+		ids := make([]string, 0, len(stored))
+		for id := range stored {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		switch {
+		case last == "_bulk_docs":
+			var body struct {
+				Docs []map[string]interface{} `json:"docs"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			res := make([]UpdateResponse, len(body.Docs))
+			for i, doc := range body.Docs {
+				res[i] = save(doc)
+			}
+			_ = json.NewEncoder(w).Encode(res)
+		case last == "_find":
+			docs := make([]json.RawMessage, 0, len(ids))
+			for _, id := range ids {
+				docs = append(docs, stored[id])
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"docs": docs})
+		case last == "_all_docs":
+			rows := make([]map[string]interface{}, 0, len(ids))
+			for _, id := range ids {
+				rows = append(rows, map[string]interface{}{"id": id, "doc": stored[id]})
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"rows": rows})
+		case r.Method == http.MethodGet:
+			_, _ = w.Write(stored[last])
+		default:
+			var doc map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&doc)
+			_ = json.NewEncoder(w).Encode(save(doc))
+		}
+	}))
+	defer restore()
+
+	// Without a key, the encrypted fields cannot be written
+	doc := &secretDoc{BaseDoc: BaseDoc{DocID: "typed"}, Name: "foo", PIN: 1234}
+	doc.Auth.Login = "alice"
+	doc.Auth.Password = "s3cr3t"
+	err := CreateNamedDoc(TestPrefix, doc)
+	assert.True(t, errors.Is(err, ErrNoEncryptionKey))
+	assert.Equal(t, 0, requests)
+
+	// The typed structs and the JSONDocs are encrypted in CouchDB
+	assert.NoError(t, SetEncryptionKeys([]string{key1}))
+	assert.NoError(t, CreateNamedDoc(TestPrefix, doc))
+	assert.Equal(t, "s3cr3t", doc.Auth.Password)
+	jsonDoc := &JSONDoc{Type: secretDoctype, M: map[string]interface{}{
+		"_id":  "json",
+		"name": "bar",
+		"auth": map[string]interface{}{"login": "bob", "password": "hunter2"},
+	}}
+	assert.NoError(t, CreateNamedDoc(TestPrefix, jsonDoc))
+	bulk := &JSONDoc{Type: secretDoctype, M: map[string]interface{}{
+		"_id": "bulk",
+		"pin": 42,
+	}}
+	assert.NoError(t, BulkUpdateDocs(TestPrefix, secretDoctype, []interface{}{bulk}, nil))
+	for id, raw := range stored {
+		assert.NotContains(t, string(raw), "s3cr3t", id)
+		assert.NotContains(t, string(raw), "hunter2", id)
+		assert.Contains(t, string(raw), `"$enc"`, id)
+	}
+	assert.Contains(t, string(stored["typed"]), `"login":"alice"`)
+	var raw map[string]interface{}
+	assert.NoError(t, json.Unmarshal(stored["typed"], &raw))
+	assert.Equal(t, EncryptionAlgorithm, raw["pin"].(map[string]interface{})["alg"])
+
+	// And they are decrypted transparently on the read paths
+	fetched := &secretDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, secretDoctype, "typed", fetched))
+	assert.Equal(t, "s3cr3t", fetched.Auth.Password)
+	assert.Equal(t, "alice", fetched.Auth.Login)
+	assert.Equal(t, 1234, fetched.PIN)
+	fetchedJSON := &JSONDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, secretDoctype, "json", fetchedJSON))
+	password, _ := fetchedJSON.GetPath("auth.password")
+	assert.Equal(t, "hunter2", password)
+	fetchedJSON = &JSONDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, secretDoctype, "bulk", fetchedJSON))
+	assert.Equal(t, 42, fetchedJSON.GetInt("pin"))
+
+	var found []secretDoc
+	req := &FindRequest{Selector: mango.Equal("name", "foo")}
+	assert.NoError(t, FindDocs(TestPrefix, secretDoctype, req, &found))
+	if assert.Len(t, found, 3) {
+		assert.Equal(t, "s3cr3t", found[2].Auth.Password)
+	}
+	var all []*secretDoc
+	assert.NoError(t, GetAllDocs(TestPrefix, secretDoctype, &AllDocsRequest{}, &all))
+	if assert.Len(t, all, 3) {
+		assert.Equal(t, "hunter2", all[1].Auth.Password)
+	}
+
+	// The queries on the encrypted fields are rejected
+	before := requests
+	for _, req := range []*FindRequest{
+		{Selector: mango.Equal("auth.password", "s3cr3t")},
+		{Selector: mango.Exists("auth")},
+		{Selector: mango.And(mango.Equal("name", "foo"), mango.Gt("pin", 1000))},
+		{Selector: mango.Equal("name", "foo"), Sort: mango.SortBy{{Field: "pin", Direction: mango.Asc}}},
+	} {
+		err = FindDocs(TestPrefix, secretDoctype, req, &found)
+		assert.True(t, errors.Is(err, ErrEncryptedField))
+		if couchErr, ok := IsCouchError(err); assert.True(t, ok) {
+			assert.Equal(t, http.StatusBadRequest, couchErr.HTTPStatus())
+		}
+	}
+	err = DefineIndex(TestPrefix, mango.IndexOnFields(secretDoctype, "by-pin", []string{"pin"}))
+	assert.True(t, errors.Is(err, ErrEncryptedField))
+	assert.Equal(t, before, requests)
+
+	// After a rotation, the old documents can still be read, and they are
+	// encrypted with the new key on their next write
+	assert.NoError(t, SetEncryptionKeys([]string{key2, key1}))
+	fetched = &secretDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, secretDoctype, "typed", fetched))
+	assert.Equal(t, "s3cr3t", fetched.Auth.Password)
+	oldCiphertext := string(stored["typed"])
+	assert.NoError(t, UpdateDoc(TestPrefix, fetched))
+	assert.NotEqual(t, oldCiphertext, string(stored["typed"]))
+
+	assert.NoError(t, SetEncryptionKeys([]string{key2}))
+	fetched = &secretDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, secretDoctype, "typed", fetched))
+	assert.Equal(t, "s3cr3t", fetched.Auth.Password)
+	err = GetDoc(TestPrefix, secretDoctype, "json", &JSONDoc{})
+	assert.True(t, errors.Is(err, ErrDecryption))
+}
@@ -0,0 +1,109 @@
+package couchdb
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"golang.org/x/sync/errgroup"
+)
+
+// requiredIndexes are the indexes and views registered for a doctype with
+// RegisterIndexes.
+type requiredIndexes struct {
+	indexes []*mango.Index
+	views   []*View
+}
+
+var registeredIndexes = make(map[string]requiredIndexes)
+
+// RegisterIndexes registers indexes and views required by a doctype, in
+// addition to those of the Indexes and Views lists. They are defined as soon
+// as the database of the doctype is created, including by the creation of
+// its first document, so that the first queries do not fail for a missing
+// index. It is meant to be called in an init function.
+func RegisterIndexes(doctype string, indexes []*mango.Index, views []*View) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	required := registeredIndexes[doctype]
+	required.indexes = append(required.indexes, indexes...)
+	required.views = append(required.views, views...)
+	registeredIndexes[doctype] = required
+}
+
+// indexesFor returns the indexes and views to define on the database of a
+// doctype.
+func indexesFor(doctype string) ([]*mango.Index, []*View) {
+	registryMu.RLock()
+	required := registeredIndexes[doctype]
+	registryMu.RUnlock()
+	indexes := append(IndexesByDoctype(doctype), required.indexes...)
+	views := append(ViewsByDoctype(doctype), required.views...)
+	return indexes, views
+}
+
+// defineRequiredIndexes defines the indexes and views of a doctype.
+func defineRequiredIndexes(ctx context.Context, db Database, doctype string) error {
+	indexes, views := indexesFor(doctype)
+	if len(indexes) == 0 && len(views) == 0 {
+		return nil
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	DefineIndexesContext(ctx, g, db, indexes)
+	DefineViewsContext(ctx, g, db, views)
+	return g.Wait()
+}
+
+type skipIndexesKey struct{}
+
+// withoutIndexes returns a context where createDBOnce does not define the
+// indexes, for the callers that define them just after.
+func withoutIndexes(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipIndexesKey{}, true)
+}
+
+// pendingIndexes are the databases created without all their indexes, as
+// their definition has failed. It is tried again on the next creation of a
+// document.
+var pendingIndexes = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// ensureIndexes is called by CreateDBContext after the creation of a
+// database. The failures are logged, and not returned, as the database has
+// been created, and they are retried by retryIndexes.
+func ensureIndexes(ctx context.Context, db Database, doctype string) {
+	if skip, _ := ctx.Value(skipIndexesKey{}).(bool); skip {
+		return
+	}
+	dbname := makeDBName(db, doctype)
+	// A database deleted in the meantime is created again without its
+	// indexes, to not loop
+	err := defineRequiredIndexes(withoutIndexes(ctx), db, doctype)
+	pendingIndexes.Lock()
+	defer pendingIndexes.Unlock()
+	if err != nil {
+		loggerFor(db).Warnf("cannot define the indexes of %s after its creation: %s", doctype, err)
+		pendingIndexes.names[dbname] = true
+	} else {
+		delete(pendingIndexes.names, dbname)
+	}
+}
+
+// retryIndexes defines the indexes of a database whose creation has not
+// been able to define them. The concurrent calls for the same database send
+// the requests only once.
+func retryIndexes(ctx context.Context, db Database, doctype string) {
+	dbname := makeDBName(db, doctype)
+	pendingIndexes.Lock()
+	pending := pendingIndexes.names[dbname]
+	pendingIndexes.Unlock()
+	if !pending {
+		return
+	}
+	_, _, _ = theKnownDBs.group.Do("indexes/"+dbname, func() (interface{}, error) {
+		ensureIndexes(ctx, db, doctype)
+		return nil, nil
+	})
+}
@@ -0,0 +1,91 @@
+package couchdb
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+func registerTestIndexes(doctype string) func() {
+	RegisterIndexes(doctype, []*mango.Index{
+		mango.IndexOnFields(doctype, "by-name", []string{"name"}),
+	}, []*View{
+		{Name: "by-size", Doctype: doctype, Map: "function(doc) { emit(doc.size) }"},
+	})
+	return func() {
+		registryMu.Lock()
+		delete(registeredIndexes, doctype)
+		registryMu.Unlock()
+	}
+}
+
+func TestCreateDocDefinesIndexes(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	doctype := "io.cozy.tests.indexed"
+	defer registerTestIndexes(doctype)()
+	server := newBootstrapServer()
+	restore := useTestServer(t, server)
+	defer restore()
+
+	// The concurrent first writes create the database and its indexes once
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"name": "foo"}}
+			assert.NoError(t, CreateDoc(TestPrefix, doc))
+		}()
+	}
+	wg.Wait()
+	dbname := makeDBName(TestPrefix, doctype)
+	assert.Equal(t, 5, server.docs[dbname])
+	assert.Equal(t, 1, server.indexes[dbname])
+	assert.Equal(t, 1, server.views[dbname])
+
+	// CreateAllDBs also defines the registered indexes
+	other := "io.cozy.tests.indexed.other"
+	defer registerTestIndexes(other)()
+	assert.NoError(t, CreateAllDBs(TestPrefix, []string{other}))
+	assert.Equal(t, 1, server.indexes[makeDBName(TestPrefix, other)])
+	assert.Equal(t, 1, server.views[makeDBName(TestPrefix, other)])
+
+	// And so do CreateDB and ResetDB
+	created := "io.cozy.tests.indexed.created"
+	defer registerTestIndexes(created)()
+	assert.NoError(t, CreateDB(TestPrefix, created))
+	assert.Equal(t, 1, server.indexes[makeDBName(TestPrefix, created)])
+	assert.NoError(t, ResetDB(TestPrefix, created))
+	assert.Equal(t, 2, server.indexes[makeDBName(TestPrefix, created)])
+}
+
+func TestCreateDocRetriesIndexes(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	doctype := "io.cozy.tests.indexed.retry"
+	defer registerTestIndexes(doctype)()
+	server := newBootstrapServer()
+	server.failIndexes = true
+	restore := useTestServer(t, server)
+	defer restore()
+	dbname := makeDBName(TestPrefix, doctype)
+
+	// The failure to define the indexes does not fail the write
+	doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"name": "foo"}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	assert.Equal(t, 1, server.docs[dbname])
+	assert.Equal(t, 0, server.indexes[dbname])
+
+	// They are defined by the next write
+	server.mu.Lock()
+	server.failIndexes = false
+	server.mu.Unlock()
+	doc = &JSONDoc{Type: doctype, M: map[string]interface{}{"name": "bar"}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	assert.Equal(t, 1, server.indexes[dbname])
+
+	doc = &JSONDoc{Type: doctype, M: map[string]interface{}{"name": "baz"}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	assert.Equal(t, 1, server.indexes[dbname])
+}
@@ -2,9 +2,11 @@ package couchdb
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -61,16 +63,175 @@ type Error struct {
 	Name        string `json:"error"`
 	Reason      string `json:"reason"`
 	Original    error  `json:"-"`
+	// RequestID is the ID of the request to CouchDB, as echoed by CouchDB in
+	// the X-Couch-Request-ID header, to find it in the CouchDB logs
+	RequestID string `json:"-"`
+	// Method and Doctype are the HTTP method and the doctype of the request
+	// that has failed. The database name is not kept, as it contains the
+	// prefix of the instance.
+	Method  string `json:"-"`
+	Doctype string `json:"-"`
+	// DocID is the identifier of the document that has not been found, for
+	// the errors of GetDoc matching ErrDocNotFound
+	DocID string `json:"-"`
+	// Credentials tells which credentials were used for a request rejected
+	// with a 401 or a 403: CredentialsAdmin or CredentialsInstance
+	Credentials string `json:"-"`
+	// notSent is true for the errors of the checks made before sending a
+	// request, like ErrBadDocID, to not confuse them with the errors of
+	// CouchDB with the same name
+	notSent bool
 }
 
+const (
+	// CredentialsAdmin is for the requests made with the credentials of the
+	// configuration.
+	CredentialsAdmin = "admin"
+	// CredentialsInstance is for the requests made with the CouchDB user of
+	// an instance, via the proxy authentication.
+	CredentialsInstance = "instance"
+)
+
+// Error returns a message like:
+//
+//	CouchDB(not_found): missing [GET io.cozy.files 404]
+//
+// The original error, if any, is added after the reason, and the part
+// between brackets is only present for the errors of a request.
 func (e *Error) Error() string {
 	msg := fmt.Sprintf("CouchDB(%s): %s", e.Name, e.Reason)
 	if e.Original != nil {
 		msg += " - " + e.Original.Error()
 	}
+	if e.Method != "" {
+		msg += " [" + e.Method
+		if e.Doctype != "" {
+			msg += " " + e.Doctype
+		}
+		msg += " " + strconv.Itoa(e.StatusCode) + "]"
+	}
 	return msg
 }
 
+// addAuthContext tells which credentials were used for a request rejected
+// by CouchDB with a 401 or a 403.
+func addAuthContext(err error, db Database) {
+	couchErr, ok := IsCouchError(err)
+	if !ok || couchErr.Credentials != "" || !isAuthError(couchErr) {
+		return
+	}
+	couchErr.Credentials = CredentialsAdmin
+	if proxyAuthFor(db) != nil {
+		couchErr.Credentials = CredentialsInstance
+	}
+}
+
+// addRequestContext adds the method and doctype of a request to its error,
+// if they are not already set.
+func addRequestContext(err error, method, doctype string) {
+	if couchErr, ok := IsCouchError(err); ok && couchErr.Method == "" {
+		couchErr.Method = method
+		couchErr.Doctype = doctype
+	}
+}
+
+// ErrUnauthorized is the error matched by errors.Is when CouchDB has
+// rejected the credentials of the stack (401 Unauthorized).
+var ErrUnauthorized = errors.New("CouchDB: unauthorized")
+
+// ErrForbidden is the error matched by errors.Is when CouchDB has denied a
+// request (403 Forbidden), for example because of the _security object of
+// the database.
+var ErrForbidden = errors.New("CouchDB: forbidden")
+
+// ErrRateLimited is the error matched by errors.Is when a request has not
+// been sent to CouchDB because the instance has exceeded its rate limit.
+var ErrRateLimited = errors.New("CouchDB: rate limited")
+
+// ErrTooManyRequests is the error matched by errors.Is when a request has not
+// been sent to CouchDB because too many requests were already in flight.
+var ErrTooManyRequests = errors.New("CouchDB: too many requests in flight")
+
+// ErrCircuitOpen is the error matched by errors.Is when a request has not
+// been sent because CouchDB has failed too many times recently.
+var ErrCircuitOpen = errors.New("CouchDB: circuit open")
+
+// ErrWriteAccepted is the error matched by errors.Is when CouchDB has only
+// accepted a write, without meeting the quorum, and the configuration asks
+// to treat it as an error.
+var ErrWriteAccepted = errors.New("CouchDB: write only accepted")
+
+// ErrDocumentTooLarge is the error matched by errors.Is when a document has
+// not been sent to CouchDB because it is larger than the limit.
+var ErrDocumentTooLarge = errors.New("CouchDB: document too large")
+
+// ErrResponseTooLarge is the error matched by errors.Is when the response of
+// CouchDB has not been read because it is larger than the limit.
+var ErrResponseTooLarge = errors.New("CouchDB: response too large")
+
+// ErrReadOnly is the error matched by errors.Is when a request that writes
+// to CouchDB has not been sent because of the read-only mode.
+var ErrReadOnly = errors.New("CouchDB: read-only mode")
+
+// ErrQuotaExceeded is the error matched by errors.Is when a request that
+// writes to CouchDB has not been sent because the instance has exceeded its
+// quota of disk usage.
+var ErrQuotaExceeded = errors.New("CouchDB: quota exceeded")
+
+// ErrNoDatabase is the error matched by errors.Is when the database of the
+// doctype does not exist, as the doctype has never been used on the instance.
+// The doctype is given by the Doctype field of the *Error.
+var ErrNoDatabase = errors.New("CouchDB: no database")
+
+// ErrDocNotFound is the error matched by errors.Is when a document does not
+// exist, or has been deleted, in a database that exists. The doctype and the
+// identifier are given by the Doctype and DocID fields of the *Error.
+var ErrDocNotFound = errors.New("CouchDB: document not found")
+
+// Is allows to compare a CouchDB error with the sentinel errors of this
+// package via errors.Is.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrRateLimited:
+		return e.Name == "rate_limited"
+	case ErrTooManyRequests:
+		return e.Name == "too_many_requests"
+	case ErrCircuitOpen:
+		return e.Name == "circuit_open"
+	case ErrWriteAccepted:
+		return e.Name == "accepted"
+	case ErrDocumentTooLarge:
+		return e.Name == "document_too_large"
+	case ErrResponseTooLarge:
+		return e.Name == "response_too_large"
+	case ErrReadOnly:
+		return e.Name == "read_only"
+	case ErrQuotaExceeded:
+		return e.Name == "quota_exceeded"
+	case ErrInvalidDoc:
+		return e.Name == "invalid_doc"
+	case ErrBadDocID:
+		return e.notSent
+	case ErrEncryptedField:
+		return e.Name == "encrypted_field"
+	case ErrNoDatabase:
+		return isNoDatabaseReason(e.Reason)
+	case ErrDocNotFound:
+		return e.Name == "not_found" && !isNoDatabaseReason(e.Reason)
+	}
+	return false
+}
+
+// Unwrap returns the original error, if any. It allows to check with
+// errors.Is if a request has failed because its context was canceled.
+func (e *Error) Unwrap() error {
+	return e.Original
+}
+
 // JSON returns the json representation of this error
 func (e *Error) JSON() map[string]interface{} {
 	jsonMap := map[string]interface{}{
@@ -82,21 +243,104 @@ func (e *Error) JSON() map[string]interface{} {
 	if e.Original != nil {
 		jsonMap["original"] = e.Original.Error()
 	}
+	if e.RequestID != "" {
+		jsonMap["request_id"] = e.RequestID
+	}
 	return jsonMap
 }
 
+// APIError is the JSON-API representation of an error from CouchDB, that can
+// be sent to the clients of the stack.
+type APIError struct {
+	Status int               `json:"status,string"`
+	Title  string            `json:"title"`
+	Detail string            `json:"detail,omitempty"`
+	Source map[string]string `json:"source,omitempty"`
+}
+
+// HTTPStatus returns the HTTP status code to use in the response of the stack
+// for this error. It is not always the status code from CouchDB: for
+// example, a 401 from CouchDB means that the stack is misconfigured, and not
+// that the client is not authorized.
+func (e *Error) HTTPStatus() int {
+	switch e.Name {
+	case "not_found":
+		return http.StatusNotFound
+	case "conflict", "file_exists":
+		return http.StatusConflict
+	case "no_usable_index", "invalid_selector", "bad_request", "no_index",
+		"defined_id", "bad_id", "query_parse_error":
+		return http.StatusBadRequest
+	case "rate_limited":
+		return http.StatusTooManyRequests
+	case "circuit_open", "too_many_requests", "read_only":
+		return http.StatusServiceUnavailable
+	case "quota_exceeded":
+		return http.StatusRequestEntityTooLarge
+	case "no_couch":
+		if e.Reason == "could not create a request to the server" {
+			return http.StatusInternalServerError
+		}
+		return http.StatusServiceUnavailable
+	}
+	if IsNoDatabaseError(e) {
+		return http.StatusNotFound
+	}
+	switch {
+	case e.StatusCode == http.StatusUnauthorized:
+		return http.StatusBadGateway
+	case e.StatusCode >= 500:
+		return http.StatusBadGateway
+	case e.StatusCode >= 400:
+		return e.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+var (
+	urlRegexp = regexp.MustCompile(`[a-z]+://\S+`)
+	seqRegexp = regexp.MustCompile(`\b\d+-[A-Za-z0-9_-]{20,}`)
+	// dbRegexp matches the names of the databases, with the prefix of an
+	// instance and a doctype, escaped or not
+	dbRegexp = regexp.MustCompile(`[A-Za-z0-9_.:$()+-]+(?:/|%2[Ff])(?:[a-z0-9_]+[.-]){2,}[a-z0-9_]+`)
+)
+
+// APIError returns the error to send to the clients of the stack. The
+// details that are internal to the stack, like the URLs of CouchDB, the
+// names of the databases or the sequence numbers, are removed.
+func (e *Error) APIError() *APIError {
+	detail := e.Reason
+	detail = urlRegexp.ReplaceAllString(detail, "[url]")
+	detail = dbRegexp.ReplaceAllString(detail, "[db]")
+	detail = seqRegexp.ReplaceAllString(detail, "[seq]")
+	apiErr := &APIError{
+		Status: e.HTTPStatus(),
+		Title:  e.Name,
+		Detail: detail,
+	}
+	switch e.Name {
+	case "no_usable_index", "invalid_selector", "no_index":
+		apiErr.Source = map[string]string{"pointer": "/selector"}
+	case "defined_id", "bad_id":
+		apiErr.Source = map[string]string{"pointer": "/_id"}
+	}
+	return apiErr
+}
+
 // IsCouchError returns whether or not the given error is of type
-// couchdb.Error.
+// couchdb.Error, or wraps such an error.
 func IsCouchError(err error) (*Error, bool) {
 	if err == nil {
 		return nil, false
 	}
-	couchErr, isCouchErr := err.(*Error)
+	var couchErr *Error
+	isCouchErr := errors.As(err, &couchErr)
 	return couchErr, isCouchErr
 }
 
-// IsInternalServerError checks if CouchDB has returned a 5xx code
-func IsInternalServerError(err error) bool {
+// IsServerError checks if CouchDB has returned a 5xx code, or if the stack
+// has not been able to talk to CouchDB.
+func IsServerError(err error) bool {
 	couchErr, isCouchErr := IsCouchError(err)
 	if !isCouchErr {
 		return false
@@ -104,27 +348,78 @@ func IsInternalServerError(err error) bool {
 	return couchErr.StatusCode/100 == 5
 }
 
-// IsNoDatabaseError checks if the given error is a couch no_db_file
-// error
-func IsNoDatabaseError(err error) bool {
+// IsInternalServerError is an alias of IsServerError.
+func IsInternalServerError(err error) bool {
+	return IsServerError(err)
+}
+
+// IsUnauthorizedError checks if CouchDB has rejected the credentials of the
+// stack (401 Unauthorized).
+func IsUnauthorizedError(err error) bool {
 	couchErr, isCouchErr := IsCouchError(err)
 	if !isCouchErr {
 		return false
 	}
-	return couchErr.Reason == "no_db_file" ||
-		couchErr.Reason == "Database does not exist."
+	return couchErr.StatusCode == http.StatusUnauthorized
 }
 
-// IsNotFoundError checks if the given error is a couch not_found
+// legacyNoDatabaseReason is the reason given by the /data API to the
+// no-database errors, see WrongDoctypeError.
+const legacyNoDatabaseReason = "wrong_doctype"
+
+// isNoDatabaseReason returns true for the reasons of the 404 given by
+// CouchDB when the database does not exist: no_db_file for the requests on a
+// document, and "Database does not exist." for those on the database.
+func isNoDatabaseReason(reason string) bool {
+	return reason == "no_db_file" ||
+		reason == "Database does not exist." ||
+		reason == legacyNoDatabaseReason
+}
+
+// IsForbiddenError checks if CouchDB has denied a request (403 Forbidden).
+func IsForbiddenError(err error) bool {
+	return errors.Is(err, ErrForbidden)
+}
+
+// isAuthError returns true for the errors of authentication and
+// authorization (401 and 403). They are not transient, and they don't tell
+// anything about the health of a node, as all the nodes share the users.
+func isAuthError(err error) bool {
+	return errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrForbidden)
+}
+
+// IsNoDatabaseError checks if the given error is a couch no_db_file
 // error
+func IsNoDatabaseError(err error) bool {
+	return errors.Is(err, ErrNoDatabase)
+}
+
+// IsDocNotFoundError checks if the given error is a couch not_found error for
+// a document that is missing or deleted, in a database that exists.
+func IsDocNotFoundError(err error) bool {
+	return errors.Is(err, ErrDocNotFound)
+}
+
+// IsNotFoundError checks if the given error is a couch not_found
+// error, for a document or for a database
 func IsNotFoundError(err error) bool {
-	couchErr, isCouchErr := IsCouchError(err)
-	if !isCouchErr {
-		return false
+	return IsDocNotFoundError(err) || IsNoDatabaseError(err)
+}
+
+// WrongDoctypeError returns a copy of a no-database error with the reason
+// wrong_doctype, as the /data API has always given it to its clients. The
+// copy still matches ErrNoDatabase. The other errors are returned as is.
+//
+// Deprecated: it is only kept while the clients of /data migrate to the
+// no_db_file reason.
+func WrongDoctypeError(err error) error {
+	couchErr, ok := IsCouchError(err)
+	if !ok || !IsNoDatabaseError(err) {
+		return err
 	}
-	return (couchErr.Name == "not_found" ||
-		couchErr.Reason == "no_db_file" ||
-		couchErr.Reason == "Database does not exist.")
+	copied := *couchErr
+	copied.Reason = legacyNoDatabaseReason
+	return &copied
 }
 
 // IsFileExists checks if the given error is a couch conflict error
@@ -190,6 +485,30 @@ func newIOReadError(originalError error) error {
 	}
 }
 
+func newRateLimitedError() error {
+	return &Error{
+		StatusCode: http.StatusTooManyRequests,
+		Name:       "rate_limited",
+		Reason:     "too many requests to the database",
+	}
+}
+
+func newTooManyRequestsError() error {
+	return &Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Name:       "too_many_requests",
+		Reason:     "too many requests in flight to CouchDB",
+	}
+}
+
+func newCircuitOpenError() error {
+	return &Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Name:       "circuit_open",
+		Reason:     "CouchDB is unavailable, the request has not been sent",
+	}
+}
+
 func newDefinedIDError() error {
 	return &Error{
 		StatusCode: http.StatusBadRequest,
@@ -198,6 +517,14 @@ func newDefinedIDError() error {
 	}
 }
 
+func newInvalidDocError(reason string) error {
+	return &Error{
+		StatusCode: http.StatusBadRequest,
+		Name:       "invalid_doc",
+		Reason:     reason,
+	}
+}
+
 func newBadIDError(id string) error {
 	return &Error{
 		StatusCode: http.StatusBadRequest,
@@ -227,16 +554,21 @@ func newCouchdbError(statusCode int, couchdbJSON []byte) error {
 	return err
 }
 
+// cleanURLError removes the credentials and the path from the URL of an
+// error, as the path contains the prefix of the instance.
 func cleanURLError(e error) error {
 	if erru, ok := e.(*url.Error); ok {
 		u, err := url.Parse(erru.URL)
 		if err != nil {
 			return erru
 		}
-		if u.User == nil {
+		if u.User == nil && (u.Path == "" || u.Path == "/") && u.RawQuery == "" {
 			return erru
 		}
 		u.User = nil
+		u.Path = "/"
+		u.RawPath = ""
+		u.RawQuery = ""
 		return &url.Error{
 			Op:  erru.Op,
 			URL: u.String(),
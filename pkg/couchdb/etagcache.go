@@ -0,0 +1,279 @@
+package couchdb
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// DefaultValidationCacheBytes is the maximal size of the bodies kept by the
+// validation cache, when no size is given to SetValidationCache.
+const DefaultValidationCacheBytes = 64 << 20
+
+var errNotModifiedWithoutBody = errors.New("CouchDB: not modified without a body in the cache")
+
+// conditionalResponse can be implemented by a response body to send a
+// conditional request: makeRequest sends its ETag in If-None-Match, and tells
+// it when CouchDB answers 304 Not Modified instead of decoding the response.
+type conditionalResponse interface {
+	ifNoneMatch() string
+	setETag(etag string)
+	setNotModified()
+}
+
+// ValidationMetricsCollector can be implemented by a MetricsCollector to also
+// observe the conditional reads of the validation cache, and the size of the
+// bodies that CouchDB has not sent again.
+type ValidationMetricsCollector interface {
+	ObserveNotModified(doctype string, savedBytes int)
+	ObserveModified(doctype string)
+}
+
+// ValidationCacheStats are the counters of the validation cache.
+type ValidationCacheStats struct {
+	// NotModified is the number of reads answered by a 304 Not Modified
+	NotModified uint64
+	// Modified is the number of reads where the body has been sent by
+	// CouchDB, with or without an ETag in the request
+	Modified uint64
+	// SavedBytes is the size of the bodies served by the cache after a 304
+	SavedBytes uint64
+	// Evictions is the number of bodies dropped to respect the limits
+	Evictions uint64
+	// Entries is the number of ETags in the cache
+	Entries int
+	// Bodies is the number of ETags that still have their body
+	Bodies int
+	// Bytes is the size of the bodies in the cache
+	Bytes int64
+}
+
+var validatedDoctypes = make(map[string]bool)
+
+// RegisterValidatedDoctype enables the validation cache for a doctype. It is
+// meant for the doctypes read often by their ID, but that are too volatile
+// for the cache of the documents: every read is still a request to CouchDB,
+// but a conditional one, and CouchDB answers it without the document when
+// it has not changed. The cache must also be enabled with
+// SetValidationCache.
+//
+// The reads are never stale, as CouchDB validates each of them. Like for the
+// cache of the documents, the Go type of the documents must decode the JSON
+// of a document like they do for a response of CouchDB.
+func RegisterValidatedDoctype(doctype string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	validatedDoctypes[doctype] = true
+}
+
+func isValidatedDoctype(doctype string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return validatedDoctypes[doctype]
+}
+
+type validationEntry struct {
+	key  docCacheKey
+	etag string
+	// body is nil when it has been evicted, and is never modified in place
+	body []byte
+}
+
+// validationCache is a LRU store of the ETags of the documents, bounded by a
+// number of entries. The bodies are bounded by their total size too: when it
+// is over the limit, the bodies of the least recently used entries are
+// dropped, but their ETags are kept.
+type validationCache struct {
+	mu          sync.Mutex
+	size        int
+	maxBytes    int64
+	bytes       int64
+	bodies      int
+	lru         *list.List
+	entries     map[docCacheKey]*list.Element
+	notModified uint64
+	modified    uint64
+	savedBytes  uint64
+	evictions   uint64
+}
+
+var (
+	validationCacheMu  sync.RWMutex
+	theValidationCache *validationCache
+)
+
+// SetValidationCache enables the validation cache for the registered
+// doctypes, with a maximal number of ETags, and a maximal size in bytes for
+// the bodies (DefaultValidationCacheBytes if zero). A size of zero disables
+// the cache. The entries of the previous cache are dropped.
+func SetValidationCache(size int, maxBytes int64) {
+	var c *validationCache
+	if size > 0 {
+		if maxBytes <= 0 {
+			maxBytes = DefaultValidationCacheBytes
+		}
+		c = &validationCache{
+			size:     size,
+			maxBytes: maxBytes,
+			lru:      list.New(),
+			entries:  make(map[docCacheKey]*list.Element),
+		}
+	}
+	validationCacheMu.Lock()
+	theValidationCache = c
+	validationCacheMu.Unlock()
+}
+
+func getValidationCache() *validationCache {
+	validationCacheMu.RLock()
+	defer validationCacheMu.RUnlock()
+	return theValidationCache
+}
+
+// GetValidationCacheStats returns the counters of the validation cache.
+func GetValidationCacheStats() ValidationCacheStats {
+	c := getValidationCache()
+	if c == nil {
+		return ValidationCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ValidationCacheStats{
+		NotModified: c.notModified,
+		Modified:    c.modified,
+		SavedBytes:  c.savedBytes,
+		Evictions:   c.evictions,
+		Entries:     c.lru.Len(),
+		Bodies:      c.bodies,
+		Bytes:       c.bytes,
+	}
+}
+
+// lookup returns the ETag and the body of a document. The ETag is empty when
+// the body is not in the cache, as a 304 could not be served without it.
+func (c *validationCache) lookup(key docCacheKey) (string, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", nil
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*validationEntry)
+	if entry.body == nil {
+		return "", nil
+	}
+	return entry.etag, entry.body
+}
+
+// store keeps the ETag and the body of a document read from CouchDB.
+func (c *validationCache) store(key docCacheKey, etag string, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.modified++
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	if etag == "" {
+		return
+	}
+	entry := &validationEntry{key: key, etag: etag, body: body}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += int64(len(body))
+	c.bodies++
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+	for elem := c.lru.Back(); elem != nil && c.bytes > c.maxBytes; elem = elem.Prev() {
+		if entry := elem.Value.(*validationEntry); entry.body != nil {
+			c.dropBody(entry)
+			c.evictions++
+		}
+	}
+}
+
+// hit records a read answered by a 304 Not Modified.
+func (c *validationCache) hit(saved int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notModified++
+	c.savedBytes += uint64(saved)
+}
+
+func (c *validationCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*validationEntry)
+	delete(c.entries, entry.key)
+	if entry.body != nil {
+		c.dropBody(entry)
+	}
+}
+
+func (c *validationCache) dropBody(entry *validationEntry) {
+	c.bytes -= int64(len(entry.body))
+	c.bodies--
+	entry.body = nil
+}
+
+// observeValidation reports a conditional read to the metrics collector, if
+// it is interested.
+func observeValidation(doctype string, notModified bool, saved int) {
+	collector, ok := metricsCollector.(ValidationMetricsCollector)
+	if !ok {
+		return
+	}
+	if notModified {
+		collector.ObserveNotModified(doctype, saved)
+	} else {
+		collector.ObserveModified(doctype)
+	}
+}
+
+// conditionalDecoder is the response body of a conditional read: it keeps
+// the body and the ETag of the response for the validation cache.
+type conditionalDecoder struct {
+	capturingDecoder
+	etag        string
+	notModified bool
+}
+
+// ifNoneMatch is part of the conditionalResponse interface.
+func (d *conditionalDecoder) ifNoneMatch() string { return d.etag }
+
+// setETag is part of the conditionalResponse interface.
+func (d *conditionalDecoder) setETag(etag string) { d.etag = etag }
+
+// setNotModified is part of the conditionalResponse interface.
+func (d *conditionalDecoder) setNotModified() { d.notModified = true }
+
+// getValidatedDoc is GetDoc for a validated doctype: the request is sent with
+// the ETag of the body in the cache, and this body is decoded if CouchDB
+// answers that the document has not changed. Without a body in the cache, it
+// is a normal read.
+func getValidatedDoc(ctx context.Context, c *validationCache, db Database, doctype, id string, out Doc) error {
+	key := docCacheKey{dbname: makeDBName(db, doctype), id: id}
+	etag, body := c.lookup(key)
+	cond := &conditionalDecoder{
+		capturingDecoder: capturingDecoder{out: strictOut(ctx, doctype, out)},
+		etag:             etag,
+	}
+	if err := makeRequest(ctx, db, doctype, http.MethodGet, url.PathEscape(id), nil, cond); err != nil {
+		return err
+	}
+	if cond.notModified {
+		if body == nil {
+			// CouchDB should not answer 304 to a request without ETag
+			return newIOReadError(errNotModifiedWithoutBody)
+		}
+		c.hit(len(body))
+		observeValidation(doctype, true, len(body))
+		return decodeResponse(bytes.NewReader(body), strictOut(ctx, doctype, out))
+	}
+	c.store(key, cond.etag, cond.buf.Bytes())
+	observeValidation(doctype, false, 0)
+	return nil
+}
@@ -0,0 +1,175 @@
+package couchdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const validatedDoctype = "io.cozy.tests.validated"
+
+func init() {
+	RegisterValidatedDoctype(validatedDoctype)
+}
+
+func useValidationCache(t *testing.T, size int, maxBytes int64) (*docStore, func()) {
+	store := newDocStore()
+	restore := useTestServer(t, store)
+	SetValidationCache(size, maxBytes)
+	return store, func() {
+		SetValidationCache(0, 0)
+		restore()
+	}
+}
+
+func getValidated(t *testing.T, id string) *JSONDoc {
+	doc := &JSONDoc{}
+	assert.NoError(t, GetDocContext(context.Background(), TestPrefix, validatedDoctype, id, doc))
+	return doc
+}
+
+func TestValidationCache(t *testing.T) {
+	store, restore := useValidationCache(t, 10, 0)
+	defer restore()
+	store.set("settings", map[string]interface{}{"theme": "dark"})
+
+	doc := getValidated(t, "settings")
+	assert.Equal(t, "dark", doc.M["theme"])
+	doc.M["theme"] = "light"
+	doc = getValidated(t, "settings")
+	assert.Equal(t, "dark", doc.M["theme"])
+	assert.Equal(t, validatedDoctype, doc.DocType())
+	assert.Equal(t, "1-abc", doc.Rev())
+	assert.Equal(t, 2, store.getCount())
+	assert.Equal(t, 1, store.notModifiedCount())
+	stats := GetValidationCacheStats()
+	assert.Equal(t, uint64(1), stats.NotModified)
+	assert.Equal(t, uint64(1), stats.Modified)
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, 1, stats.Bodies)
+	assert.True(t, stats.Bytes > 0)
+	assert.Equal(t, uint64(stats.Bytes), stats.SavedBytes)
+
+	// The reads are never stale
+	store.set("settings", map[string]interface{}{"theme": "blue"})
+	doc = getValidated(t, "settings")
+	assert.Equal(t, "blue", doc.M["theme"])
+	assert.Equal(t, "2-abc", doc.Rev())
+	assert.Equal(t, 1, store.notModifiedCount())
+	assert.Equal(t, "blue", getValidated(t, "settings").M["theme"])
+	assert.Equal(t, 2, store.notModifiedCount())
+
+	// The other doctypes are not validated
+	assert.NoError(t, GetDocContext(context.Background(), TestPrefix, TestDoctype, "settings", &JSONDoc{}))
+	assert.NoError(t, GetDocContext(context.Background(), TestPrefix, TestDoctype, "settings", &JSONDoc{}))
+	assert.Equal(t, 2, store.notModifiedCount())
+
+	err := GetDocContext(context.Background(), TestPrefix, validatedDoctype, "missing", &JSONDoc{})
+	assert.True(t, IsNotFoundError(err))
+}
+
+func TestValidationCacheBodyEviction(t *testing.T) {
+	store, restore := useValidationCache(t, 2, 60)
+	defer restore()
+	for _, id := range []string{"a", "b", "c"} {
+		store.set(id, map[string]interface{}{"name": id})
+	}
+
+	// A body is about 40 bytes, so only one body fits
+	getValidated(t, "a")
+	getValidated(t, "b")
+	stats := GetValidationCacheStats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, 1, stats.Bodies)
+	assert.Equal(t, uint64(1), stats.Evictions)
+
+	// The ETag of a has been kept without its body: it is a normal read
+	assert.Equal(t, "a", getValidated(t, "a").M["name"])
+	assert.Equal(t, 0, store.notModifiedCount())
+	assert.Equal(t, "a", getValidated(t, "a").M["name"])
+	assert.Equal(t, 1, store.notModifiedCount())
+
+	// The least recently used ETag is evicted with its body
+	getValidated(t, "c")
+	stats = GetValidationCacheStats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, 1, stats.Bodies)
+	assert.True(t, stats.Bytes <= 60)
+}
+
+func TestValidationCacheParallelReaders(t *testing.T) {
+	store, restore := useValidationCache(t, 5, 200)
+	defer restore()
+	ids := make([]string, 10)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("doc%d", i)
+		store.set(ids[i], map[string]interface{}{"name": ids[i]})
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := ids[(w+i*i)%len(ids)]
+				if w == 0 && i%10 == 0 {
+					store.set(id, map[string]interface{}{"name": id})
+				}
+				doc := &JSONDoc{}
+				err := GetDocContext(context.Background(), TestPrefix, validatedDoctype, id, doc)
+				if assert.NoError(t, err) {
+					assert.Equal(t, id, doc.ID())
+					assert.Equal(t, id, doc.M["name"])
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	stats := GetValidationCacheStats()
+	assert.True(t, stats.NotModified > 0)
+	assert.Equal(t, uint64(8*200), stats.NotModified+stats.Modified)
+	assert.True(t, stats.Entries <= 5)
+	assert.True(t, stats.Bodies <= stats.Entries)
+	assert.True(t, stats.Bytes <= 200)
+}
+
+type validationMetrics struct {
+	nopMetrics
+	mu       sync.Mutex
+	saved    int
+	modified int
+}
+
+func (m *validationMetrics) ObserveNotModified(doctype string, savedBytes int) {
+	m.mu.Lock()
+	m.saved += savedBytes
+	m.mu.Unlock()
+}
+
+func (m *validationMetrics) ObserveModified(doctype string) {
+	m.mu.Lock()
+	m.modified++
+	m.mu.Unlock()
+}
+
+func TestValidationCacheMetrics(t *testing.T) {
+	store, restore := useValidationCache(t, 10, 0)
+	defer restore()
+	metrics := &validationMetrics{}
+	SetMetricsCollector(metrics)
+	defer SetMetricsCollector(nil)
+	store.set("settings", map[string]interface{}{"theme": "dark"})
+
+	for i := 0; i < 3; i++ {
+		getValidated(t, "settings")
+	}
+	assert.Equal(t, 1, metrics.modified)
+	stats := GetValidationCacheStats()
+	assert.Equal(t, 2*int(stats.Bytes), metrics.saved)
+	assert.Equal(t, uint64(metrics.saved), stats.SavedBytes)
+}
@@ -0,0 +1,356 @@
+package couchdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+// DefaultEventBufferSize is the number of events kept for a subscriber of
+// the EventHub that does not read them fast enough.
+const DefaultEventBufferSize = 100
+
+// maxLocalRevs is the maximal number of revisions remembered for a database,
+// to not publish again the writes of the stack seen in its changes feed.
+const maxLocalRevs = 10000
+
+// hubRetryDelay is the delay before following again a changes feed of the
+// EventHub that has failed.
+var hubRetryDelay = time.Second
+
+// EventHubOptions are the options of StartEventHub.
+type EventHubOptions struct {
+	// BufferSize is the number of events kept for each subscriber, and
+	// DefaultEventBufferSize is used when it is 0
+	BufferSize int
+	// FollowChanges makes the hub follow the changes feeds of the databases
+	// with subscribers, to also publish the writes made by the other
+	// processes, or directly on CouchDB
+	FollowChanges bool
+}
+
+// EventHub dispatches the events of the documents to the subscribers of the
+// stack process. The events of the writes made by the stack are published as
+// they are made, and with FollowChanges, the hub follows the changes feed of
+// the databases with subscribers: CouchDB sees at most one feed for a
+// database, whatever the number of its subscribers.
+//
+// A subscriber that does not read its events fast enough does not block the
+// hub: when its buffer is full, its oldest event is dropped.
+type EventHub struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	opts   EventHubOptions
+
+	dropped uint64 // Accessed atomically
+
+	mu     sync.Mutex
+	closed bool
+	topics map[string]*hubTopic
+}
+
+// hubTopic is the state of the subscriptions on a database.
+type hubTopic struct {
+	db      Database
+	doctype string
+	subs    map[*hubSub]struct{}
+	// cancel stops the changes feed, if any
+	cancel context.CancelFunc
+	// localRevs are the revisions published by the stack, by document ID
+	localRevs map[string]string
+}
+
+type hubSub struct {
+	ch chan *realtime.Event
+}
+
+var (
+	eventHubMu sync.Mutex
+	eventHub   *EventHub
+)
+
+// StartEventHub starts an EventHub, that runs until the context is canceled
+// or the hub is closed. The options can be nil.
+func StartEventHub(ctx context.Context, opts *EventHubOptions) *EventHub {
+	ctx, cancel := context.WithCancel(ctx)
+	h := &EventHub{
+		ctx:    ctx,
+		cancel: cancel,
+		topics: make(map[string]*hubTopic),
+	}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.BufferSize <= 0 {
+		h.opts.BufferSize = DefaultEventBufferSize
+	}
+	eventHubMu.Lock()
+	eventHub = h
+	eventHubMu.Unlock()
+	return h
+}
+
+func getEventHub() *EventHub {
+	eventHubMu.Lock()
+	defer eventHubMu.Unlock()
+	return eventHub
+}
+
+// Subscribe subscribes to the events of a doctype on the EventHub of the
+// stack. See EventHub.Subscribe. If no hub has been started, the returned
+// channel is closed.
+func Subscribe(db Database, doctype string) (<-chan *realtime.Event, func()) {
+	if h := getEventHub(); h != nil {
+		return h.Subscribe(db, doctype)
+	}
+	ch := make(chan *realtime.Event)
+	close(ch)
+	return ch, func() {}
+}
+
+// Subscribe returns a channel with the events of the documents of the given
+// doctype, and a function to call to unsubscribe. The channel is closed by
+// the unsubscribe, and when the hub is closed.
+func (h *EventHub) Subscribe(db Database, doctype string) (<-chan *realtime.Event, func()) {
+	sub := &hubSub{ch: make(chan *realtime.Event, h.opts.BufferSize)}
+	dbname := makeDBName(db, doctype)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	t, ok := h.topics[dbname]
+	if !ok {
+		t = &hubTopic{
+			db:        db,
+			doctype:   doctype,
+			subs:      make(map[*hubSub]struct{}),
+			localRevs: make(map[string]string),
+		}
+		h.topics[dbname] = t
+		if h.opts.FollowChanges {
+			h.follow(t)
+		}
+	}
+	t.subs[sub] = struct{}{}
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() { h.unsubscribe(dbname, t, sub) })
+	}
+	return sub.ch, unsubscribe
+}
+
+func (h *EventHub) unsubscribe(dbname string, t *hubTopic, sub *hubSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := t.subs[sub]; !ok {
+		// The channel has already been closed by the hub
+		return
+	}
+	delete(t.subs, sub)
+	close(sub.ch)
+	if len(t.subs) == 0 {
+		if t.cancel != nil {
+			t.cancel()
+		}
+		delete(h.topics, dbname)
+	}
+}
+
+// publishEvent is called by RTEvent, to publish the writes of the stack on
+// the EventHub.
+func publishEvent(db Database, verb string, doc, oldDoc Doc) {
+	if h := getEventHub(); h != nil {
+		h.publish(db, verb, doc, oldDoc, true)
+	}
+}
+
+func (h *EventHub) publish(db Database, verb string, doc, oldDoc Doc, local bool) {
+	dbname := makeDBName(db, doc.DocType())
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.topics[dbname]
+	if !ok {
+		return
+	}
+	if local && t.cancel != nil {
+		if len(t.localRevs) >= maxLocalRevs {
+			t.localRevs = make(map[string]string)
+		}
+		t.localRevs[doc.ID()] = doc.Rev()
+	}
+	event := &realtime.Event{
+		Domain: db.DomainName(),
+		Prefix: db.DBPrefix(),
+		Verb:   verb,
+		Doc:    doc,
+		OldDoc: oldDoc,
+	}
+	for sub := range t.subs {
+		h.deliver(sub, event)
+	}
+}
+
+// deliver sends an event to a subscriber, without blocking. It must be
+// called with the lock, as only one event must be sent at a time for the
+// oldest event to be dropped safely.
+func (h *EventHub) deliver(sub *hubSub, event *realtime.Event) {
+	for {
+		select {
+		case sub.ch <- event:
+			return
+		default:
+		}
+		select {
+		case <-sub.ch:
+			atomic.AddUint64(&h.dropped, 1)
+		default:
+		}
+	}
+}
+
+// follow starts the changes feed of a topic. It must be called with the lock.
+func (h *EventHub) follow(t *hubTopic) {
+	ctx, cancel := context.WithCancel(h.ctx)
+	t.cancel = cancel
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.followChanges(ctx, t)
+	}()
+}
+
+// followChanges publishes the changes of a database made by the other
+// processes, from the current sequence. The changes of the writes already
+// published by the stack are skipped, but a write seen in the feed before
+// the response of CouchDB to the stack is published twice.
+func (h *EventHub) followChanges(ctx context.Context, t *hubTopic) {
+	var since string
+	for ctx.Err() == nil {
+		if since == "" {
+			seq, err := GetLastSeqContext(ctx, t.db, t.doctype)
+			if err != nil {
+				h.waitRetry(ctx, t, err)
+				continue
+			}
+			since = seq.String()
+		}
+		req := &ChangesRequest{
+			DocType:     t.doctype,
+			Feed:        ChangesModeLongpoll,
+			Since:       since,
+			IncludeDocs: true,
+		}
+		res, err := ForeachChangeContext(ctx, t.db, req, func(change *Change) error {
+			h.publishChange(t, change)
+			since = change.Seq
+			return nil
+		})
+		if err != nil {
+			h.waitRetry(ctx, t, err)
+			continue
+		}
+		since = res.LastSeq
+	}
+}
+
+func (h *EventHub) waitRetry(ctx context.Context, t *hubTopic, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	loggerFor(t.db).Warnf("cannot follow the changes of %s for the event hub: %s", t.doctype, err)
+	select {
+	case <-ctx.Done():
+	case <-time.After(hubRetryDelay):
+	}
+}
+
+func (h *EventHub) publishChange(t *hubTopic, change *Change) {
+	if len(change.Changes) == 0 {
+		return
+	}
+	rev := change.Changes[0].Rev
+	h.mu.Lock()
+	local := t.localRevs[change.DocID] == rev
+	if local {
+		delete(t.localRevs, change.DocID)
+	}
+	h.mu.Unlock()
+	if local {
+		return
+	}
+
+	doc := change.Doc
+	if doc.M == nil {
+		doc.M = map[string]interface{}{"_id": change.DocID, "_rev": rev}
+	}
+	doc.Type = t.doctype
+	verb := EventUpdate
+	if deleted, _ := doc.M["_deleted"].(bool); deleted {
+		verb = EventDelete
+	} else if strings.HasPrefix(rev, "1-") {
+		verb = EventCreate
+	}
+	h.publish(t.db, verb, &doc, nil, false)
+}
+
+// Dropped returns the number of events dropped for the subscribers that were
+// too slow.
+func (h *EventHub) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// Feeds returns the number of changes feeds followed.
+func (h *EventHub) Feeds() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, t := range h.topics {
+		if t.cancel != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Close stops the changes feeds, and closes the channels of all the
+// subscribers. No event is sent after Close has returned.
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	h.closed = true
+	h.cancel()
+	h.mu.Unlock()
+	h.wg.Wait()
+
+	h.mu.Lock()
+	for dbname, t := range h.topics {
+		for sub := range t.subs {
+			close(sub.ch)
+			delete(t.subs, sub)
+		}
+		delete(h.topics, dbname)
+	}
+	h.mu.Unlock()
+
+	eventHubMu.Lock()
+	if eventHub == h {
+		eventHub = nil
+	}
+	eventHubMu.Unlock()
+}
+
+// Shutdown implements the utils.Shutdowner interface.
+func (h *EventHub) Shutdown(ctx context.Context) error {
+	fmt.Print("  shutting down couchdb event hub...")
+	h.Close()
+	fmt.Println("ok.")
+	return nil
+}
@@ -0,0 +1,172 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/stretchr/testify/assert"
+)
+
+func hubDoc(id, rev string) *JSONDoc {
+	return &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": id, "_rev": rev}}
+}
+
+func receiveEvent(t *testing.T, ch <-chan *realtime.Event) *realtime.Event {
+	t.Helper()
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+// hubFeed is a fake CouchDB that sends the changes written on its channel to
+// the longpoll feeds, and counts them.
+type hubFeed struct {
+	mu      sync.Mutex
+	feeds   int
+	changes chan string
+}
+
+func (f *hubFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/_changes") {
+		_, _ = w.Write([]byte(`{"update_seq":"0-a","doc_count":0}`))
+		return
+	}
+	f.mu.Lock()
+	f.feeds++
+	f.mu.Unlock()
+	select {
+	case results := <-f.changes:
+		_, _ = w.Write([]byte(`{"results":[` + results + `],"last_seq":"1-a"}`))
+	case <-r.Context().Done():
+	}
+}
+
+func TestEventHubSubscribe(t *testing.T) {
+	hub := StartEventHub(context.Background(), nil)
+	defer hub.Close()
+
+	ch1, unsubscribe1 := Subscribe(TestPrefix, TestDoctype)
+	ch2, unsubscribe2 := Subscribe(TestPrefix, TestDoctype)
+	defer unsubscribe2()
+	other, unsubscribeOther := Subscribe(TestPrefix, "io.cozy.tests.other")
+	defer unsubscribeOther()
+
+	RTEvent(TestPrefix, EventCreate, hubDoc("foo", "1-a"), nil)
+	for _, ch := range []<-chan *realtime.Event{ch1, ch2} {
+		event := receiveEvent(t, ch)
+		assert.Equal(t, EventCreate, event.Verb)
+		assert.Equal(t, "foo", event.Doc.ID())
+		assert.Equal(t, TestPrefix.DBPrefix(), event.DBPrefix())
+	}
+	assert.Len(t, other, 0)
+
+	// The channel is closed by the unsubscribe
+	unsubscribe1()
+	unsubscribe1()
+	_, ok := <-ch1
+	assert.False(t, ok)
+	RTEvent(TestPrefix, EventDelete, hubDoc("foo", "2-b"), nil)
+	assert.Equal(t, EventDelete, receiveEvent(t, ch2).Verb)
+
+	// The writes of the dry-run mode have no events
+	ctx, _ := WithDryRun(context.Background())
+	rtEvent(ctx, TestPrefix, EventCreate, hubDoc("bar", "1-a"), nil)
+	assert.Len(t, ch2, 0)
+}
+
+func TestEventHubSlowSubscriber(t *testing.T) {
+	hub := StartEventHub(context.Background(), &EventHubOptions{BufferSize: 2})
+	defer hub.Close()
+
+	ch, unsubscribe := hub.Subscribe(TestPrefix, TestDoctype)
+	defer unsubscribe()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		publishEvent(TestPrefix, EventCreate, hubDoc(id, "1-a"), nil)
+	}
+	// The oldest events are dropped
+	assert.Equal(t, uint64(3), hub.Dropped())
+	assert.Equal(t, "d", receiveEvent(t, ch).Doc.ID())
+	assert.Equal(t, "e", receiveEvent(t, ch).Doc.ID())
+}
+
+func TestEventHubFollowChanges(t *testing.T) {
+	feed := &hubFeed{changes: make(chan string)}
+	restore := useTestServer(t, feed)
+	defer restore()
+	hub := StartEventHub(context.Background(), &EventHubOptions{FollowChanges: true})
+	defer hub.Close()
+
+	ch1, unsubscribe1 := hub.Subscribe(TestPrefix, TestDoctype)
+	ch2, unsubscribe2 := hub.Subscribe(TestPrefix, TestDoctype)
+	defer unsubscribe2()
+	assert.Equal(t, 1, hub.Feeds())
+
+	// The write of the stack is published once
+	publishEvent(TestPrefix, EventUpdate, hubDoc("local", "2-b"), nil)
+	assert.Equal(t, "local", receiveEvent(t, ch1).Doc.ID())
+	feed.changes <- `{"seq":"1-a","id":"local","changes":[{"rev":"2-b"}],"doc":{"_id":"local","_rev":"2-b"}},
+		{"seq":"1-a","id":"ext","changes":[{"rev":"1-x"}],"doc":{"_id":"ext","_rev":"1-x","name":"ext"}},
+		{"seq":"1-a","id":"gone","changes":[{"rev":"3-y"}],"doc":{"_id":"gone","_rev":"3-y","_deleted":true}}`
+	event := receiveEvent(t, ch1)
+	assert.Equal(t, EventCreate, event.Verb)
+	assert.Equal(t, "ext", event.Doc.ID())
+	assert.Equal(t, TestDoctype, event.Doc.DocType())
+	assert.Equal(t, EventDelete, receiveEvent(t, ch1).Verb)
+	assert.Len(t, ch1, 0)
+	assert.Len(t, ch2, 3)
+
+	// There is only one feed, even with several subscribers
+	assert.Eventually(t, func() bool {
+		feed.mu.Lock()
+		defer feed.mu.Unlock()
+		return feed.feeds == 2
+	}, 5*time.Second, 5*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	feed.mu.Lock()
+	assert.Equal(t, 2, feed.feeds)
+	feed.mu.Unlock()
+
+	// The feed is stopped with the last subscriber
+	unsubscribe1()
+	assert.Equal(t, 1, hub.Feeds())
+	unsubscribe2()
+	assert.Equal(t, 0, hub.Feeds())
+}
+
+func TestEventHubClose(t *testing.T) {
+	feed := &hubFeed{changes: make(chan string)}
+	restore := useTestServer(t, feed)
+	defer restore()
+	hub := StartEventHub(context.Background(), &EventHubOptions{FollowChanges: true})
+
+	ch1, unsubscribe1 := hub.Subscribe(TestPrefix, TestDoctype)
+	ch2, _ := hub.Subscribe(TestPrefix, "io.cozy.tests.other")
+	publishEvent(TestPrefix, EventCreate, hubDoc("foo", "1-a"), nil)
+
+	// All the channels are closed, after the events already sent
+	hub.Close()
+	assert.Equal(t, "foo", receiveEvent(t, ch1).Doc.ID())
+	_, ok := <-ch1
+	assert.False(t, ok)
+	_, ok = <-ch2
+	assert.False(t, ok)
+	unsubscribe1()
+
+	// No event is sent after the close
+	publishEvent(TestPrefix, EventCreate, hubDoc("bar", "1-a"), nil)
+	ch3, _ := hub.Subscribe(TestPrefix, TestDoctype)
+	_, ok = <-ch3
+	assert.False(t, ok)
+	ch4, _ := Subscribe(TestPrefix, TestDoctype)
+	_, ok = <-ch4
+	assert.False(t, ok)
+}
@@ -0,0 +1,150 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ExportAttachments tells what ExportDocs does with the attachments of the
+// documents.
+type ExportAttachments int
+
+const (
+	// ExportAttachmentsSkip is the default: the _attachments field is removed
+	// from the exported documents.
+	ExportAttachmentsSkip ExportAttachments = iota
+	// ExportAttachmentsStub keeps the stubs of the attachments, with their
+	// content type, length and digest, but not their data.
+	ExportAttachmentsStub
+	// ExportAttachmentsInline inlines the data of the attachments, encoded in
+	// base64. The documents with attachments are fetched one by one for that.
+	ExportAttachmentsInline
+)
+
+// ExportOptions are the options of ExportDocs.
+type ExportOptions struct {
+	// StripRev removes the _rev of the exported documents, for an import in
+	// another database as new documents.
+	StripRev bool
+	// Attachments tells what to do with the attachments.
+	Attachments ExportAttachments
+	// Anonymize replaces the fields registered with RegisterAnonymizedFields
+	// by fakes, to share the shape of the data without the personal content.
+	// The attachments are not anonymized.
+	Anonymize bool
+	// AnonymizeSeed makes the fakes: two anonymized exports of the same data
+	// with the same seed are the same.
+	AnonymizeSeed int64
+}
+
+// ExportHeader is the first line of an export made by ExportDocs.
+type ExportHeader struct {
+	Doctype    string    `json:"doctype"`
+	ExportedAt time.Time `json:"exported_at"`
+	// DocCount is the number of documents in the database when the export
+	// has started, design documents included, as an estimate of the size of
+	// the export.
+	DocCount int `json:"doc_count,omitempty"`
+}
+
+// exportWriter records the error of the writer, to tell it apart from the
+// errors of CouchDB.
+type exportWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *exportWriter) writeLine(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := e.w.Write(data); err != nil {
+		e.err = err
+		return err
+	}
+	return nil
+}
+
+// ExportDocs calls ExportDocsContext with a background context.
+func ExportDocs(db Database, doctype string, w io.Writer, opts ExportOptions) (int, error) {
+	return ExportDocsContext(context.Background(), db, doctype, w, opts)
+}
+
+// ExportDocsContext writes the documents of a doctype to w, as JSON with a
+// document per line, for the backups and the data portability. The first
+// line is an ExportHeader. The documents are read by pages of _all_docs, so
+// the memory used does not depend on the size of the database, and the
+// design documents are not exported. It returns the number of documents
+// written, even on error. When w fails, its error is returned as is.
+func ExportDocsContext(ctx context.Context, db Database, doctype string, w io.Writer, opts ExportOptions) (int, error) {
+	status, err := DBStatusContext(ctx, db, doctype)
+	if err != nil {
+		return 0, err
+	}
+	out := &exportWriter{w: w}
+	header := ExportHeader{
+		Doctype:    doctype,
+		ExportedAt: time.Now().UTC(),
+		DocCount:   status.DocCount,
+	}
+	if err := out.writeLine(header); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	var exportErr error
+	seq, res := AllDocsSeqContext(ctx, db, doctype, AllDocsRequest{})
+	seq(func(id string, raw json.RawMessage) bool {
+		doc, err := exportDoc(ctx, db, doctype, id, raw, opts)
+		if err == nil {
+			err = out.writeLine(doc)
+		}
+		if err != nil {
+			exportErr = err
+			return false
+		}
+		count++
+		return true
+	})
+	if exportErr != nil {
+		return count, exportErr
+	}
+	return count, res.Err()
+}
+
+// exportDoc returns a document as it must be exported.
+func exportDoc(ctx context.Context, db Database, doctype, id string, raw json.RawMessage, opts ExportOptions) (map[string]json.RawMessage, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	if _, ok := doc["_attachments"]; ok {
+		switch opts.Attachments {
+		case ExportAttachmentsSkip:
+			delete(doc, "_attachments")
+		case ExportAttachmentsInline:
+			var rev string
+			_ = json.Unmarshal(doc["_rev"], &rev)
+			path := url.PathEscape(id) + "?attachments=true&rev=" + url.QueryEscape(rev)
+			doc = nil
+			if err := makeRequest(ctx, db, doctype, http.MethodGet, path, nil, &doc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opts.StripRev {
+		delete(doc, "_rev")
+	}
+	if opts.Anonymize {
+		if err := anonymizeDoc(doc, doctype, opts.AnonymizeSeed); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
@@ -0,0 +1,145 @@
+package couchdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exportServer is a fake CouchDB with n documents, where the first one has
+// an attachment. The documents are served by _all_docs, by pages.
+type exportServer struct {
+	n int
+}
+
+func (s *exportServer) doc(i int, inline bool) string {
+	attachments := ""
+	if i == 0 {
+		attachments = `,"_attachments":{"a.txt":{"content_type":"text/plain","length":5,"digest":"md5-x","stub":true}}`
+		if inline {
+			attachments = `,"_attachments":{"a.txt":{"content_type":"text/plain","digest":"md5-x","data":"aGVsbG8="}}`
+		}
+	}
+	return fmt.Sprintf(`{"_id":"doc%03d","_rev":"1-abc","n":%d%s}`, i, i, attachments)
+}
+
+func (s *exportServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case strings.HasSuffix(path, "/_all_docs"):
+		q := r.URL.Query()
+		start := 0
+		if key := q.Get("startkey"); key != "" {
+			_, _ = fmt.Sscanf(strings.Trim(key, `"`), "doc%d", &start)
+			start++
+		}
+		var rows []string
+		if start == 0 {
+			rows = append(rows, `{"id":"_design/foo","key":"_design/foo","value":{"rev":"1-d"},"doc":{"_id":"_design/foo"}}`)
+		}
+		for i := start; i < s.n && len(rows) < seqPageSize; i++ {
+			rows = append(rows, fmt.Sprintf(`{"id":"doc%03d","key":"doc%03d","value":{"rev":"1-abc"},"doc":%s}`, i, i, s.doc(i, false)))
+		}
+		_, _ = fmt.Fprintf(w, `{"total_rows":%d,"rows":[%s]}`, s.n+1, strings.Join(rows, ","))
+	case strings.HasSuffix(path, "/doc000"):
+		if r.URL.Query().Get("attachments") != "true" || r.URL.Query().Get("rev") != "1-abc" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(s.doc(0, true)))
+	default:
+		_, _ = fmt.Fprintf(w, `{"db_name":"foo","doc_count":%d}`, s.n+1)
+	}
+}
+
+func readExport(t *testing.T, data []byte) (ExportHeader, []map[string]interface{}) {
+	var header ExportHeader
+	var docs []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if header.Doctype == "" {
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &header))
+			continue
+		}
+		var doc map[string]interface{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+		docs = append(docs, doc)
+	}
+	return header, docs
+}
+
+type failingWriter struct {
+	max int
+	n   int
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.n+len(p) > f.max {
+		return 0, errDiskFull
+	}
+	f.n += len(p)
+	return len(p), nil
+}
+
+func TestExportDocs(t *testing.T) {
+	restore := useTestServer(t, &exportServer{n: 250})
+	defer restore()
+
+	var buf bytes.Buffer
+	count, err := ExportDocs(TestPrefix, TestDoctype, &buf, ExportOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 250, count)
+	header, docs := readExport(t, buf.Bytes())
+	assert.Equal(t, TestDoctype, header.Doctype)
+	assert.Equal(t, 251, header.DocCount)
+	assert.False(t, header.ExportedAt.IsZero())
+	if assert.Len(t, docs, 250) {
+		assert.Equal(t, "doc000", docs[0]["_id"])
+		assert.Equal(t, "1-abc", docs[0]["_rev"])
+		assert.NotContains(t, docs[0], "_attachments")
+		assert.Equal(t, "doc249", docs[249]["_id"])
+	}
+
+	buf.Reset()
+	_, err = ExportDocs(TestPrefix, TestDoctype, &buf, ExportOptions{
+		StripRev:    true,
+		Attachments: ExportAttachmentsStub,
+	})
+	assert.NoError(t, err)
+	_, docs = readExport(t, buf.Bytes())
+	assert.NotContains(t, docs[0], "_rev")
+	stub := docs[0]["_attachments"].(map[string]interface{})["a.txt"].(map[string]interface{})
+	assert.Equal(t, true, stub["stub"])
+
+	buf.Reset()
+	_, err = ExportDocs(TestPrefix, TestDoctype, &buf, ExportOptions{Attachments: ExportAttachmentsInline})
+	assert.NoError(t, err)
+	_, docs = readExport(t, buf.Bytes())
+	inlined := docs[0]["_attachments"].(map[string]interface{})["a.txt"].(map[string]interface{})
+	assert.Equal(t, "aGVsbG8=", inlined["data"])
+	assert.NotContains(t, docs[1], "_attachments")
+}
+
+func TestExportDocsWriteError(t *testing.T) {
+	restore := useTestServer(t, &exportServer{n: 250})
+	defer restore()
+
+	w := &failingWriter{max: 2000}
+	count, err := ExportDocs(TestPrefix, TestDoctype, w, ExportOptions{})
+	assert.Equal(t, errDiskFull, err)
+	assert.True(t, count > 0)
+	assert.True(t, count < 250)
+
+	count, err = ExportDocs(TestPrefix, TestDoctype, &failingWriter{}, ExportOptions{})
+	assert.Equal(t, errDiskFull, err)
+	assert.Equal(t, 0, count)
+}
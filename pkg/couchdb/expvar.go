@@ -0,0 +1,101 @@
+package couchdb
+
+import (
+	"expvar"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// expvarEnabled is set by InitExpvar. The counters below are not maintained
+// until then, so that they cost nothing when they are not published.
+var expvarEnabled uint32
+
+var (
+	expvarOnce     sync.Once
+	expvarRequests = new(expvar.Map).Init()
+	expvarErrors   = new(expvar.Map).Init()
+	expvarRetries  = new(expvar.Int)
+	expvarRead     = new(expvar.Int)
+	expvarWritten  = new(expvar.Int)
+	expvarInFlight = new(expvar.Int)
+)
+
+// InitExpvar publishes some counters on the requests made to CouchDB as the
+// "couchdb" expvar: the number of requests by method, the errors by kind,
+// the retries, the bytes read and written, and the requests in flight. It
+// is meant for debugging in production without a metrics stack.
+func InitExpvar() {
+	expvarOnce.Do(func() {
+		m := new(expvar.Map).Init()
+		m.Set("requests", expvarRequests)
+		m.Set("errors", expvarErrors)
+		m.Set("retries", expvarRetries)
+		m.Set("bytes_read", expvarRead)
+		m.Set("bytes_written", expvarWritten)
+		m.Set("in_flight", expvarInFlight)
+		expvar.Publish("couchdb", m)
+		atomic.StoreUint32(&expvarEnabled, 1)
+	})
+}
+
+func expvarOn() bool {
+	return atomic.LoadUint32(&expvarEnabled) == 1
+}
+
+// observeError reports a failed request to the metrics collector and to the
+// expvar counters.
+func observeError(kind string) {
+	metricsCollector.ObserveError(kind)
+	if expvarOn() {
+		expvarErrors.Add(kind, 1)
+	}
+}
+
+// observeRetry reports a retried request to the metrics collector and to the
+// expvar counters.
+func observeRetry(method, doctype string) {
+	metricsCollector.ObserveRetry(method, doctype)
+	if expvarOn() {
+		expvarRetries.Add(1)
+	}
+}
+
+// trackInFlight counts a request, and returns a function to call when it is
+// finished, ie when its response has been read.
+func trackInFlight(method string) func() {
+	if !expvarOn() {
+		return func() {}
+	}
+	expvarRequests.Add(method, 1)
+	expvarInFlight.Add(1)
+	return func() { expvarInFlight.Add(-1) }
+}
+
+// countWritten counts the bytes of a request body sent to CouchDB.
+func countWritten(n int) {
+	if expvarOn() && n > 0 {
+		expvarWritten.Add(int64(n))
+	}
+}
+
+// countRead returns the body of a response, wrapped to count the bytes read
+// from CouchDB.
+func countRead(body io.ReadCloser) io.ReadCloser {
+	if !expvarOn() {
+		return body
+	}
+	return &countingBody{body}
+}
+
+type countingBody struct {
+	io.ReadCloser
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		expvarRead.Add(int64(n))
+	}
+	return n, err
+}
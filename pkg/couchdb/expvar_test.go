@@ -0,0 +1,61 @@
+package couchdb
+
+import (
+	"expvar"
+	"net/http"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpvar(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			_, _ = w.Write([]byte(`{"db_name":"foo"}`))
+		case http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"ok":true,"id":"foo","rev":"1-abc"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+		}
+	}))
+	defer restore()
+	config.GetConfig().CouchDB.Retry = config.CouchDBRetry{MaxAttempts: 1}
+
+	InitExpvar()
+	InitExpvar() // It can be called several times
+	vars, ok := expvar.Get("couchdb").(*expvar.Map)
+	if !assert.True(t, ok) {
+		return
+	}
+	counter := func(name string) int64 {
+		return vars.Get(name).(*expvar.Int).Value()
+	}
+	byKey := func(name, key string) int64 {
+		if v, ok := vars.Get(name).(*expvar.Map).Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	gets := byKey("requests", http.MethodGet)
+	puts := byKey("requests", http.MethodPut)
+	errs := byKey("errors", ErrorKindCouchDB)
+	read := counter("bytes_read")
+	written := counter("bytes_written")
+
+	_, err := DBStatus(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo"}}
+	assert.NoError(t, CreateNamedDoc(TestPrefix, doc))
+	assert.Error(t, DeleteDB(TestPrefix, TestDoctype))
+
+	assert.Equal(t, gets+1, byKey("requests", http.MethodGet))
+	assert.Equal(t, puts+1, byKey("requests", http.MethodPut))
+	assert.Equal(t, errs+1, byKey("errors", ErrorKindCouchDB))
+	assert.True(t, counter("bytes_read") > read)
+	assert.Equal(t, written+int64(len(`{"_id":"foo"}`)), counter("bytes_written"))
+	assert.EqualValues(t, 0, counter("in_flight"))
+}
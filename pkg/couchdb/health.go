@@ -0,0 +1,219 @@
+package couchdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// healthSamples is the number of latencies kept for each node, to compute
+// the percentiles.
+const healthSamples = 20
+
+// NodeHealth is the health of a CouchDB node, as seen by the pings of the
+// HealthChecker.
+type NodeHealth struct {
+	Node       string        `json:"node"`
+	Cluster    string        `json:"cluster,omitempty"`
+	Healthy    bool          `json:"healthy"`
+	LastCheck  time.Time     `json:"last_check"`
+	LastError  string        `json:"last_error,omitempty"`
+	LatencyP50 time.Duration `json:"latency_p50"`
+	LatencyP90 time.Duration `json:"latency_p90"`
+}
+
+type nodeHealthStats struct {
+	cluster   string
+	healthy   bool
+	lastCheck time.Time
+	lastError string
+	samples   []time.Duration
+	next      int
+}
+
+// HealthChecker pings the _up endpoint of all the CouchDB nodes in
+// background, to know which ones are healthy before the requests fail. The
+// results are used to pick the nodes for the requests.
+type HealthChecker struct {
+	interval time.Duration
+	mu       sync.Mutex
+	nodes    map[string]*nodeHealthStats
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+var (
+	healthCheckerMu sync.Mutex
+	healthChecker   *HealthChecker
+)
+
+// StartHealthChecker starts a goroutine that pings the CouchDB nodes every
+// interval, until the context is canceled or the checker is closed. The
+// nodes are pinged once before the function returns.
+func StartHealthChecker(ctx context.Context, interval time.Duration) *HealthChecker {
+	ctx, cancel := context.WithCancel(ctx)
+	h := &HealthChecker{
+		interval: interval,
+		nodes:    make(map[string]*nodeHealthStats),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	h.check(ctx)
+	go h.loop(ctx)
+
+	healthCheckerMu.Lock()
+	healthChecker = h
+	healthCheckerMu.Unlock()
+	return h
+}
+
+// GetNodesHealth returns the health of the CouchDB nodes, as seen by the
+// running HealthChecker, or nil if there is none.
+func GetNodesHealth() []NodeHealth {
+	healthCheckerMu.Lock()
+	h := healthChecker
+	healthCheckerMu.Unlock()
+	if h == nil {
+		return nil
+	}
+	return h.Snapshot()
+}
+
+func (h *HealthChecker) loop(ctx context.Context) {
+	defer close(h.done)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.check(ctx)
+		}
+	}
+}
+
+// check pings all the nodes, in parallel.
+func (h *HealthChecker) check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, cl := range allClusters() {
+		for _, u := range cl.urls {
+			wg.Add(1)
+			go func(cl *cluster, u *url.URL) {
+				defer wg.Done()
+				latency, err := pingNode(ctx, cl, u)
+				if ctx.Err() != nil {
+					return
+				}
+				// A node that rejects the credentials is not down: the
+				// other nodes would do the same
+				recordNode(u.Host, err != nil && !isAuthError(err))
+				h.record(cl.name, u.Host, latency, err)
+			}(cl, u)
+		}
+	}
+	wg.Wait()
+}
+
+func (h *HealthChecker) record(cluster, node string, latency time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats, ok := h.nodes[node]
+	if !ok {
+		stats = &nodeHealthStats{cluster: cluster}
+		h.nodes[node] = stats
+	}
+	stats.lastCheck = time.Now()
+	stats.healthy = err == nil
+	if err != nil {
+		stats.lastError = err.Error()
+		return
+	}
+	stats.lastError = ""
+	if len(stats.samples) < healthSamples {
+		stats.samples = append(stats.samples, latency)
+	} else {
+		stats.samples[stats.next] = latency
+		stats.next = (stats.next + 1) % healthSamples
+	}
+}
+
+// pingNode sends a request to the _up endpoint of a node.
+func pingNode(ctx context.Context, cl *cluster, u *url.URL) (time.Duration, error) {
+	ctx, watchdog := withRequestTimeout(ctx)
+	defer watchdog.stop()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nodeURL(u, "_up"), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Accept", "application/json")
+	setAuth(nil, cl, req)
+	before := time.Now()
+	res, err := httpClient().Do(req)
+	latency := time.Since(before)
+	if err != nil {
+		return 0, cleanURLError(err)
+	}
+	defer drainAndClose(res.Body)
+	switch res.StatusCode {
+	case http.StatusUnauthorized:
+		return 0, &Error{StatusCode: res.StatusCode, Name: "unauthorized", Reason: "Invalid response code: 401"}
+	case http.StatusForbidden:
+		return 0, &Error{StatusCode: res.StatusCode, Name: "forbidden", Reason: "Invalid response code: 403"}
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return 0, fmt.Errorf("Invalid response code: %d", res.StatusCode)
+	}
+	return latency, nil
+}
+
+// Snapshot returns the health of the nodes, sorted by cluster and node.
+func (h *HealthChecker) Snapshot() []NodeHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snap := make([]NodeHealth, 0, len(h.nodes))
+	for node, stats := range h.nodes {
+		samples := make([]time.Duration, len(stats.samples))
+		copy(samples, stats.samples)
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		snap = append(snap, NodeHealth{
+			Node:       node,
+			Cluster:    stats.cluster,
+			Healthy:    stats.healthy,
+			LastCheck:  stats.lastCheck,
+			LastError:  stats.lastError,
+			LatencyP50: percentile(samples, 0.5),
+			LatencyP90: percentile(samples, 0.9),
+		})
+	}
+	sort.Slice(snap, func(i, j int) bool {
+		if snap[i].Cluster != snap[j].Cluster {
+			return snap[i].Cluster < snap[j].Cluster
+		}
+		return snap[i].Node < snap[j].Node
+	})
+	return snap
+}
+
+// Close stops the pings, and waits for the goroutine to exit.
+func (h *HealthChecker) Close() {
+	h.cancel()
+	<-h.done
+	healthCheckerMu.Lock()
+	if healthChecker == h {
+		healthChecker = nil
+	}
+	healthCheckerMu.Unlock()
+}
+
+// Shutdown implements the utils.Shutdowner interface.
+func (h *HealthChecker) Shutdown(ctx context.Context) error {
+	fmt.Print("  shutting down couchdb health checker...")
+	h.Close()
+	fmt.Println("ok.")
+	return nil
+}
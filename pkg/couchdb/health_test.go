@@ -0,0 +1,73 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthChecker(t *testing.T) {
+	var pings int32
+	var down int32
+	up := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pings, 1)
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	})
+	flaky := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	})
+	restore := useTestCluster(t, up, flaky)
+	defer restore()
+	urls := config.CouchURLs()
+
+	assert.Nil(t, GetNodesHealth())
+	atomic.StoreInt32(&down, 1)
+	h := StartHealthChecker(context.Background(), 10*time.Millisecond)
+
+	// The nodes are pinged before StartHealthChecker returns
+	snap := GetNodesHealth()
+	if assert.Len(t, snap, 2) {
+		health := make(map[string]NodeHealth)
+		for _, node := range snap {
+			health[node.Node] = node
+		}
+		assert.True(t, health[urls[0].Host].Healthy)
+		assert.Empty(t, health[urls[0].Host].LastError)
+		assert.True(t, health[urls[0].Host].LatencyP50 > 0)
+		assert.False(t, health[urls[1].Host].Healthy)
+		assert.Contains(t, health[urls[1].Host].LastError, "503")
+	}
+
+	// The failed node is avoided by the requests
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, urls[0], pickNode(urls, nil))
+	}
+
+	// And it is used again when it has recovered
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(50 * time.Millisecond)
+	for _, node := range h.Snapshot() {
+		assert.True(t, node.Healthy)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		seen[pickNode(urls, nil).Host] = true
+	}
+	assert.Len(t, seen, 2)
+
+	// No more pings after Close
+	h.Close()
+	assert.Nil(t, GetNodesHealth())
+	count := atomic.LoadInt32(&pings)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, count, atomic.LoadInt32(&pings))
+}
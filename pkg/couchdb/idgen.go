@@ -0,0 +1,102 @@
+package couchdb
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// IDGenerator chooses the identifiers of the new documents. The document is
+// given to allow the content-addressed identifiers, and its doctype to
+// prefix them. An empty identifier lets CouchDB generate a random one.
+//
+// The generated identifiers can be prefixed by the doctype and a slash, but
+// must not have another slash, a plus sign, or start with an underscore.
+type IDGenerator interface {
+	GenerateID(doc Doc) (string, error)
+}
+
+// IDGeneratorFunc is a function that implements IDGenerator.
+type IDGeneratorFunc func(doc Doc) (string, error)
+
+// GenerateID calls the function.
+func (f IDGeneratorFunc) GenerateID(doc Doc) (string, error) {
+	return f(doc)
+}
+
+var (
+	globalIDGenerator IDGenerator
+	idGenerators      = make(map[string]IDGenerator)
+)
+
+// SetIDGenerator sets the generator used for the identifiers of the new
+// documents, when there is none registered for their doctype. With nil, the
+// default, the identifiers are generated by CouchDB.
+func SetIDGenerator(gen IDGenerator) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	globalIDGenerator = gen
+}
+
+// RegisterIDGenerator registers the generator used for the identifiers of
+// the new documents of a doctype. It is meant to be called in an init
+// function, and it panics if a generator is already registered for the
+// doctype.
+func RegisterIDGenerator(doctype string, gen IDGenerator) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := idGenerators[doctype]; ok {
+		panic(fmt.Sprintf("couchdb: ID generator for %s is already registered", doctype))
+	}
+	idGenerators[doctype] = gen
+}
+
+// counterIDGenerator generates deterministic identifiers, from a counter.
+type counterIDGenerator struct {
+	counter uint64
+}
+
+// NewCounterIDGenerator returns a generator of deterministic identifiers,
+// useful for the tests. The identifiers are 32 hexadecimal digits, like the
+// ones generated by CouchDB, for the values of a counter that starts after
+// seed, so they are sorted by creation.
+func NewCounterIDGenerator(seed uint64) IDGenerator {
+	return &counterIDGenerator{counter: seed}
+}
+
+func (g *counterIDGenerator) GenerateID(doc Doc) (string, error) {
+	n := atomic.AddUint64(&g.counter, 1)
+	return fmt.Sprintf("%032x", n), nil
+}
+
+// setGeneratedID sets the identifier of a new document from the generator
+// of its doctype, if any.
+func setGeneratedID(doc Doc) error {
+	doctype := doc.DocType()
+	registryMu.RLock()
+	gen, ok := idGenerators[doctype]
+	if !ok {
+		gen = globalIDGenerator
+	}
+	registryMu.RUnlock()
+	if gen == nil {
+		return nil
+	}
+	id, err := gen.GenerateID(doc)
+	if err != nil || id == "" {
+		return err
+	}
+	if !isValidGeneratedID(doctype, id) {
+		return newBadIDError(id)
+	}
+	if hasBareIDs(doctype) {
+		id = BareID(doctype, id)
+	}
+	doc.SetID(id)
+	return nil
+}
+
+func isValidGeneratedID(doctype, id string) bool {
+	id = strings.TrimPrefix(id, doctype+"/")
+	return id != "" && id[0] != '_' && !strings.ContainsAny(id, "/+")
+}
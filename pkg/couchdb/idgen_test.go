@@ -0,0 +1,107 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDGenerator(t *testing.T) {
+	var sent []string
+	fail := false
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"internal","reason":"oops"}`))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/_bulk_docs") {
+			var bulk struct {
+				Docs []map[string]interface{} `json:"docs"`
+			}
+			_ = json.Unmarshal(body, &bulk)
+			res := make([]UpdateResponse, len(bulk.Docs))
+			for i, doc := range bulk.Docs {
+				id, _ := doc["_id"].(string)
+				sent = append(sent, id)
+				res[i] = UpdateResponse{ID: id, Rev: "1-abc", Ok: true}
+			}
+			_ = json.NewEncoder(w).Encode(res)
+			return
+		}
+		var doc map[string]interface{}
+		_ = json.Unmarshal(body, &doc)
+		id, _ := doc["_id"].(string)
+		sent = append(sent, id)
+		_ = json.NewEncoder(w).Encode(UpdateResponse{ID: id, Rev: "1-abc", Ok: true})
+	}))
+	defer restore()
+	ctx := context.Background()
+
+	// By default, the IDs are generated by CouchDB
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{}}
+	assert.NoError(t, CreateDocContext(ctx, TestPrefix, doc))
+	assert.Equal(t, []string{""}, sent)
+
+	SetIDGenerator(NewCounterIDGenerator(41))
+	defer SetIDGenerator(nil)
+	const doctype = "io.cozy.tests.prefixed"
+	RegisterIDGenerator(doctype, IDGeneratorFunc(func(doc Doc) (string, error) {
+		return doctype + "/" + doc.(*JSONDoc).GetString("name"), nil
+	}))
+	defer func() {
+		registryMu.Lock()
+		delete(idGenerators, doctype)
+		registryMu.Unlock()
+	}()
+	assert.Panics(t, func() {
+		RegisterIDGenerator(doctype, NewCounterIDGenerator(0))
+	})
+
+	sent = nil
+	doc = &JSONDoc{Type: TestDoctype, M: map[string]interface{}{}}
+	assert.NoError(t, CreateDocContext(ctx, TestPrefix, doc))
+	assert.Equal(t, "0000000000000000000000000000002a", doc.ID())
+	docs := []interface{}{
+		&JSONDoc{Type: TestDoctype, M: map[string]interface{}{}},
+		&JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo", "_rev": "1-abc"}},
+	}
+	assert.NoError(t, BulkUpdateDocsContext(ctx, TestPrefix, TestDoctype, docs, nil))
+	assert.Equal(t, "0000000000000000000000000000002b", docs[0].(Doc).ID())
+	prefixed := &JSONDoc{Type: doctype, M: map[string]interface{}{"name": "bar"}}
+	assert.NoError(t, CreateDocContext(ctx, TestPrefix, prefixed))
+	assert.Equal(t, []string{
+		"0000000000000000000000000000002a",
+		"0000000000000000000000000000002b",
+		"foo",
+		doctype + "/bar",
+	}, sent)
+
+	// The invalid IDs are rejected
+	for _, name := range []string{"a/b", "a+b", "_design", ""} {
+		sent = nil
+		invalid := &JSONDoc{Type: doctype, M: map[string]interface{}{"name": name}}
+		err := CreateDocContext(ctx, TestPrefix, invalid)
+		couchErr, ok := IsCouchError(err)
+		if assert.True(t, ok, name) {
+			assert.Equal(t, "bad_id", couchErr.Name)
+		}
+		assert.Empty(t, sent, name)
+		assert.Empty(t, invalid.ID(), name)
+	}
+
+	// The generated ID is not kept when the creation fails
+	fail = true
+	doc = &JSONDoc{Type: TestDoctype, M: map[string]interface{}{}}
+	err := CreateDocContext(ctx, TestPrefix, doc)
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrInvalidDoc))
+	assert.Empty(t, doc.ID())
+}
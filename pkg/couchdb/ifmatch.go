@@ -0,0 +1,153 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ifMatchMinVersion is the first version of CouchDB where the revision of a
+// document is taken from the If-Match header for its updates and deletions.
+// The older servers, and those whose version is unknown, get the revision
+// in the body or in the query string, as before.
+var ifMatchMinVersion = [3]int{2, 0, 0}
+
+var (
+	ifMatchMu      sync.Mutex
+	ifMatchSupport = make(map[string]bool)
+)
+
+// ifMatchBody is given to makeRequest for the update or the deletion of a
+// document: the revision is sent in the If-Match header, and the document,
+// if any, is sent without it.
+type ifMatchBody struct {
+	doc interface{}
+	rev string
+}
+
+// revlessBody encodes a document without its _rev.
+type revlessBody struct {
+	doc interface{}
+}
+
+func (b revlessBody) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(b.doc)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["_rev"]; !ok {
+		return data, nil
+	}
+	delete(fields, "_rev")
+	return json.Marshal(fields)
+}
+
+// unwrapIfMatch returns the body to send and the revision for the If-Match
+// header of a request.
+func unwrapIfMatch(reqbody interface{}) (interface{}, string) {
+	m, ok := reqbody.(*ifMatchBody)
+	if !ok {
+		return reqbody, ""
+	}
+	if m.doc == nil {
+		return nil, m.rev
+	}
+	return revlessBody{m.doc}, m.rev
+}
+
+// revRequest returns the path and the body of a request that updates (with a
+// doc) or deletes (with a nil doc) the document at path, with the revision
+// in the If-Match header if the cluster of the doctype supports it, or else
+// in the body or in the query string.
+func revRequest(ctx context.Context, db Database, doctype, path string, doc interface{}, rev string) (string, interface{}) {
+	if useIfMatch(ctx, db, doctype) {
+		return path, &ifMatchBody{doc: doc, rev: rev}
+	}
+	if doc == nil {
+		return path + "?rev=" + url.QueryEscape(rev), nil
+	}
+	return path, doc
+}
+
+// useIfMatch returns true if the cluster of the doctype supports the
+// If-Match header. Its version is probed on the first call, and the result
+// is kept once the version has been read: a probe that has failed, for
+// example on a 401 or a 503, is made again on the next call.
+func useIfMatch(ctx context.Context, db Database, doctype string) bool {
+	cl := clusterFor(ctx, doctype)
+	key := cl.name
+	for _, u := range cl.urls {
+		key += " " + u.String()
+	}
+	ifMatchMu.Lock()
+	supported, ok := ifMatchSupport[key]
+	ifMatchMu.Unlock()
+	if ok {
+		return supported
+	}
+
+	var info struct {
+		Version string `json:"version"`
+	}
+	err := makeRequest(withCluster(ctx, cl), db, "", http.MethodGet, "", nil, &info)
+	if err != nil {
+		loggerFor(db).Debugf("cannot probe the CouchDB version for If-Match: %s", err)
+		return false
+	}
+	if info.Version == "" {
+		return false
+	}
+	supported = versionAtLeast(info.Version, ifMatchMinVersion)
+	if !supported {
+		loggerFor(db).Infof("CouchDB version %q: the revisions are not sent with If-Match", info.Version)
+	}
+	ifMatchMu.Lock()
+	ifMatchSupport[key] = supported
+	ifMatchMu.Unlock()
+	return supported
+}
+
+// versionAtLeast compares a version like 3.1.1 with a minimum. It returns
+// false for a version that cannot be parsed.
+func versionAtLeast(version string, min [3]int) bool {
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	for i := range min {
+		n := 0
+		if i < len(parts) {
+			var err error
+			if n, err = strconv.Atoi(parts[i]); err != nil {
+				return false
+			}
+		} else if i == 0 {
+			return false
+		}
+		if n != min[i] {
+			return n > min[i]
+		}
+	}
+	return true
+}
+
+// conflictOnPrecondition turns the 412 Precondition Failed of a request
+// with If-Match into the same conflict error as a 409, as it means that the
+// revision is not the current one.
+func conflictOnPrecondition(err *Error) *Error {
+	if err.StatusCode != http.StatusPreconditionFailed {
+		return err
+	}
+	err.StatusCode = http.StatusConflict
+	err.Name = "conflict"
+	err.Reason = "Document update conflict."
+	return err
+}
@@ -0,0 +1,137 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionAtLeast(t *testing.T) {
+	min := [3]int{2, 0, 0}
+	assert.True(t, versionAtLeast("2.0.0", min))
+	assert.True(t, versionAtLeast("3.1.1", min))
+	assert.True(t, versionAtLeast("2.3", min))
+	assert.True(t, versionAtLeast("3.2.0-abc123", min))
+	assert.False(t, versionAtLeast("1.7.2", min))
+	assert.False(t, versionAtLeast("", min))
+	assert.False(t, versionAtLeast("unknown", min))
+}
+
+// revServer is a fake CouchDB of the given version, that records how the
+// revisions are sent for the writes.
+type revServer struct {
+	version  string
+	probes   int
+	ifMatch  []string
+	queryRev []string
+	bodyRev  []string
+	status   int
+}
+
+func (s *revServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		s.probes++
+		if s.version == "" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"couchdb":"Welcome","version":"` + s.version + `"}`))
+		return
+	}
+	if r.Method == http.MethodGet {
+		_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc","test":"foo"}`))
+		return
+	}
+	s.ifMatch = append(s.ifMatch, r.Header.Get("If-Match"))
+	s.queryRev = append(s.queryRev, r.URL.Query().Get("rev"))
+	var body struct {
+		Rev string `json:"_rev"`
+	}
+	if data, _ := ioutil.ReadAll(r.Body); len(data) > 0 {
+		_ = json.Unmarshal(data, &body)
+	}
+	s.bodyRev = append(s.bodyRev, body.Rev)
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		_, _ = w.Write([]byte(`{"error":"precondition_failed","reason":"Precondition failed"}`))
+		return
+	}
+	_, _ = w.Write([]byte(`{"ok":true,"id":"foo","rev":"2-def"}`))
+}
+
+func TestIfMatch(t *testing.T) {
+	s := &revServer{version: "3.1.1"}
+	restore := useTestServer(t, s)
+	defer restore()
+
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo", "_rev": "1-abc", "test": "bar"}}
+	assert.NoError(t, UpdateDoc(TestPrefix, doc))
+	assert.Equal(t, "2-def", doc.Rev())
+	assert.NoError(t, UpdateDocWithOld(TestPrefix, doc, doc.Clone()))
+	assert.NoError(t, DeleteDoc(TestPrefix, doc))
+
+	// The version is probed only once
+	assert.Equal(t, 1, s.probes)
+	assert.Equal(t, []string{"1-abc", "2-def", "2-def"}, s.ifMatch)
+	assert.Equal(t, []string{"", "", ""}, s.queryRev)
+	assert.Equal(t, []string{"", "", ""}, s.bodyRev)
+}
+
+func TestIfMatchFallback(t *testing.T) {
+	// The failed probes are made again, as the version is still unknown
+	for version, probes := range map[string]int{"1.7.2": 1, "": 2} {
+		s := &revServer{version: version}
+		restore := useTestServer(t, s)
+
+		doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo", "_rev": "1-abc", "test": "bar"}}
+		assert.NoError(t, UpdateDoc(TestPrefix, doc))
+		assert.NoError(t, DeleteDoc(TestPrefix, doc))
+
+		assert.Equal(t, probes, s.probes, version)
+		assert.Equal(t, []string{"", ""}, s.ifMatch)
+		assert.Equal(t, []string{"", "2-def"}, s.queryRev)
+		assert.Equal(t, []string{"1-abc", ""}, s.bodyRev)
+		restore()
+	}
+}
+
+func TestIfMatchProbeNotKept(t *testing.T) {
+	s := &revServer{version: "3.1.1"}
+	restore := useTestServer(t, s)
+	defer restore()
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo", "_rev": "1-abc", "test": "bar"}}
+
+	// CouchDB is unavailable for the probe, and the revision is sent without
+	// If-Match
+	s.version = ""
+	assert.NoError(t, UpdateDoc(TestPrefix, doc))
+	// The version is probed again once CouchDB is back
+	s.version = "3.1.1"
+	assert.NoError(t, UpdateDoc(TestPrefix, doc))
+	assert.NoError(t, UpdateDoc(TestPrefix, doc))
+	assert.Equal(t, 2, s.probes)
+	assert.Equal(t, []string{"", "2-def", "2-def"}, s.ifMatch)
+}
+
+func TestIfMatchPreconditionFailed(t *testing.T) {
+	s := &revServer{version: "3.1.1", status: http.StatusPreconditionFailed}
+	restore := useTestServer(t, s)
+	defer restore()
+
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo", "_rev": "1-abc", "test": "bar"}}
+	err := UpdateDocWithOld(TestPrefix, doc, doc.Clone())
+	assert.True(t, IsConflictError(err))
+	assert.Equal(t, http.StatusConflict, err.(*Error).StatusCode)
+	assert.Equal(t, "conflict", err.(*Error).Name)
+	assert.Equal(t, "1-abc", doc.Rev())
+
+	// Without If-Match, a 412 is not a conflict (like file_exists)
+	err = makeRequest(context.Background(), TestPrefix, TestDoctype, http.MethodPut, "foo", doc, nil)
+	assert.False(t, IsConflictError(err))
+	assert.Equal(t, http.StatusPreconditionFailed, err.(*Error).StatusCode)
+}
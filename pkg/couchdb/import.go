@@ -0,0 +1,286 @@
+package couchdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// defaultImportBatchSize is the default number of lines in a batch of
+// ImportDocs.
+const defaultImportBatchSize = 1000
+
+// ConflictStrategy tells what ImportDocs does with a document whose _id
+// already exists in the database.
+type ConflictStrategy int
+
+const (
+	// ConflictSkip is the default: the existing documents are left untouched.
+	ConflictSkip ConflictStrategy = iota
+	// ConflictOverwrite replaces the existing documents by the imported ones,
+	// with a new revision.
+	ConflictOverwrite
+	// ConflictFail stops the import on the first existing document, before
+	// writing its batch.
+	ConflictFail
+)
+
+// ImportOptions are the options of ImportDocs. The zero value imports all
+// the lines, by batches of 1000, with no progress callback.
+type ImportOptions struct {
+	// BatchSize is the number of lines written in a _bulk_docs request
+	BatchSize int
+	// SkipLines is the number of lines to skip at the start, to resume an
+	// import with the Lines of its last progress
+	SkipLines int
+	// Progress is called after each batch
+	Progress func(ImportProgress)
+}
+
+// ImportProgress tells how far an import is. Lines is the number of lines
+// of the input that have been fully handled: an import that has stopped can
+// be resumed with it as SkipLines.
+type ImportProgress struct {
+	Lines     int `json:"lines"`
+	Written   int `json:"written"`
+	Skipped   int `json:"skipped"`
+	Malformed int `json:"malformed"`
+}
+
+// ImportLineError is the error of a line that has not been imported, with
+// its number in the input, starting at 1.
+type ImportLineError struct {
+	Line int
+	ID   string
+	Err  error
+}
+
+func (e *ImportLineError) Error() string {
+	if e.ID != "" {
+		return fmt.Sprintf("line %d (%s): %s", e.Line, e.ID, e.Err)
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+func (e *ImportLineError) Unwrap() error {
+	return e.Err
+}
+
+// ImportResult is the result of ImportDocs, with the errors of the lines
+// that have not been imported.
+type ImportResult struct {
+	ImportProgress
+	Errors []*ImportLineError
+}
+
+// importLine is a document of an import, with its line number.
+type importLine struct {
+	line int
+	id   string
+	doc  map[string]json.RawMessage
+}
+
+// ImportDocs calls ImportDocsContext with a background context.
+func ImportDocs(db Database, doctype string, r io.Reader, strategy ConflictStrategy, opts *ImportOptions) (*ImportResult, error) {
+	return ImportDocsContext(context.Background(), db, doctype, r, strategy, opts)
+}
+
+// ImportDocsContext reads documents as JSON, one per line, like the output of
+// ExportDocs (whose header line is ignored), and writes them in the database
+// of the doctype by batches. The database is created if needed. The
+// documents that exist in the database are handled according to the
+// strategy, and the _rev of the lines is ignored: the new documents are
+// created, and the overwritten ones get a new revision. The malformed lines,
+// and the documents rejected by CouchDB, are in the errors of the result,
+// and the import goes on. The realtime events are not published, as for a
+// restore. The result is returned even with an error, and its Lines can be
+// used to resume the import.
+func ImportDocsContext(ctx context.Context, db Database, doctype string, r io.Reader, strategy ConflictStrategy, opts *ImportOptions) (*ImportResult, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+	res := &ImportResult{}
+	if err := EnsureDBExistContext(ctx, db, doctype); err != nil {
+		return res, err
+	}
+	reader := bufio.NewReader(r)
+	lineNum := 0
+	eof := false
+	for !eof {
+		var batch []*importLine
+		first := lineNum
+		for lineNum-first < batchSize {
+			data, err := reader.ReadBytes('\n')
+			if err == io.EOF {
+				eof = true
+				if len(data) == 0 {
+					break
+				}
+			} else if err != nil {
+				return res, err
+			}
+			lineNum++
+			if lineNum <= opts.SkipLines {
+				continue
+			}
+			item, err := parseImportLine(lineNum, data)
+			if err != nil {
+				res.Malformed++
+				res.Errors = append(res.Errors, &ImportLineError{Line: lineNum, Err: err})
+			} else if item != nil {
+				batch = append(batch, item)
+			}
+			if eof {
+				break
+			}
+		}
+		if len(batch) > 0 {
+			if err := importBatch(ctx, db, doctype, batch, strategy, res); err != nil {
+				return res, err
+			}
+		}
+		if lineNum > res.Lines {
+			res.Lines = lineNum
+			if opts.Progress != nil {
+				opts.Progress(res.ImportProgress)
+			}
+		}
+	}
+	return res, nil
+}
+
+// parseImportLine validates a line of an import. It returns nil for the
+// empty lines and the header of an export.
+func parseImportLine(lineNum int, data []byte) (*importLine, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, errors.New("not a JSON object")
+	}
+	_, hasID := doc["_id"]
+	if _, ok := doc["exported_at"]; ok && !hasID && lineNum == 1 {
+		return nil, nil
+	}
+	item := &importLine{line: lineNum, doc: doc}
+	if hasID {
+		if err := json.Unmarshal(doc["_id"], &item.id); err != nil {
+			return nil, fmt.Errorf("invalid _id: %s", err)
+		}
+		if err := ValidateDocID(item.id); err != nil {
+			return nil, err
+		}
+		// The exports have no design documents, and the local documents
+		// are not replicated: they are not imported either
+		if item.id[0] == '_' {
+			return nil, newInvalidDocIDError("the design and local documents are not imported")
+		}
+	}
+	delete(doc, "_rev")
+	return item, nil
+}
+
+// importBatch writes a batch of documents, after having looked for the
+// existing ones to apply the conflict strategy.
+func importBatch(ctx context.Context, db Database, doctype string, batch []*importLine, strategy ConflictStrategy, res *ImportResult) error {
+	revs, err := currentRevs(ctx, db, doctype, batch)
+	if err != nil {
+		return err
+	}
+	docs := make([]interface{}, 0, len(batch))
+	written := make([]*importLine, 0, len(batch))
+	for _, item := range batch {
+		rev, exists := revs[item.id]
+		if exists {
+			switch strategy {
+			case ConflictSkip:
+				res.Skipped++
+				continue
+			case ConflictFail:
+				return &Error{
+					StatusCode: http.StatusConflict,
+					Name:       "conflict",
+					Reason: fmt.Sprintf("the document %s of line %d already exists",
+						item.id, item.line),
+				}
+			case ConflictOverwrite:
+				item.doc["_rev"], _ = json.Marshal(rev)
+			}
+		}
+		docs = append(docs, item.doc)
+		written = append(written, item)
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+
+	var rows []UpdateResponse
+	if err := makeRequest(ctx, db, doctype, http.MethodPost, "_bulk_docs", newBulkDocsBody(docs), &rows); err != nil {
+		return err
+	}
+	if len(rows) != len(written) {
+		return fmt.Errorf("unexpected number of rows: %d for %d documents", len(rows), len(written))
+	}
+	for i, row := range rows {
+		if row.Error != "" {
+			res.Errors = append(res.Errors, &ImportLineError{
+				Line: written[i].line,
+				ID:   row.ID,
+				Err:  newBulkRowError(row),
+			})
+			continue
+		}
+		res.Written++
+	}
+	return nil
+}
+
+// currentRevs returns the revisions of the documents of a batch that exist in
+// the database, by their _id. The deleted documents are not included.
+func currentRevs(ctx context.Context, db Database, doctype string, batch []*importLine) (map[string]string, error) {
+	keys := make([]string, 0, len(batch))
+	for _, item := range batch {
+		if item.id != "" {
+			keys = append(keys, item.id)
+		}
+	}
+	revs := make(map[string]string)
+	if len(keys) == 0 {
+		return revs, nil
+	}
+	var res struct {
+		Rows []struct {
+			ID    string `json:"id"`
+			Value struct {
+				Rev     string `json:"rev"`
+				Deleted bool   `json:"deleted"`
+			} `json:"value"`
+		} `json:"rows"`
+	}
+	body := struct {
+		Keys []string `json:"keys"`
+	}{Keys: keys}
+	if err := makeRequest(ctx, db, doctype, http.MethodPost, "_all_docs", body, &res); err != nil {
+		return nil, err
+	}
+	for _, row := range res.Rows {
+		if row.ID != "" && !row.Value.Deleted {
+			revs[row.ID] = row.Value.Rev
+		}
+	}
+	return revs, nil
+}
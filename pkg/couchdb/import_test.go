@@ -0,0 +1,160 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// importServer is a fake CouchDB database, where the documents can be
+// written with _bulk_docs and their revisions read with _all_docs.
+type importServer struct {
+	mu    sync.Mutex
+	docs  map[string]map[string]interface{}
+	bulks int
+}
+
+func newImportServer() *importServer {
+	return &importServer{docs: make(map[string]map[string]interface{})}
+}
+
+func (s *importServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_all_docs"):
+		var req struct {
+			Keys []string `json:"keys"`
+		}
+		_ = json.Unmarshal(body, &req)
+		rows := make([]string, len(req.Keys))
+		for i, key := range req.Keys {
+			if doc, ok := s.docs[key]; ok {
+				rows[i] = fmt.Sprintf(`{"id":%q,"key":%q,"value":{"rev":%q}}`, key, key, doc["_rev"])
+			} else {
+				rows[i] = fmt.Sprintf(`{"key":%q,"error":"not_found"}`, key)
+			}
+		}
+		_, _ = fmt.Fprintf(w, `{"rows":[%s]}`, strings.Join(rows, ","))
+	case strings.HasSuffix(r.URL.Path, "/_bulk_docs"):
+		s.bulks++
+		var req struct {
+			Docs []map[string]interface{} `json:"docs"`
+		}
+		_ = json.Unmarshal(body, &req)
+		res := make([]UpdateResponse, len(req.Docs))
+		for i, doc := range req.Docs {
+			id, _ := doc["_id"].(string)
+			if id == "" {
+				id = fmt.Sprintf("generated%d", len(s.docs))
+				doc["_id"] = id
+			}
+			rev, _ := doc["_rev"].(string)
+			old, exists := s.docs[id]
+			if (exists && old["_rev"] != rev) || (!exists && rev != "") {
+				res[i] = UpdateResponse{ID: id, Error: "conflict", Reason: "Document update conflict."}
+				continue
+			}
+			gen := 1
+			if exists {
+				gen = 2
+			}
+			doc["_rev"] = fmt.Sprintf("%d-abc", gen)
+			s.docs[id] = doc
+			res[i] = UpdateResponse{ID: id, Rev: doc["_rev"].(string), Ok: true}
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	default:
+		_, _ = w.Write([]byte(`{"db_name":"foo","doc_count":0}`))
+	}
+}
+
+func importInput(n int) string {
+	lines := []string{`{"doctype":"io.cozy.tests","exported_at":"2026-01-01T00:00:00Z","doc_count":3}`}
+	for i := 0; i < n; i++ {
+		lines = append(lines, fmt.Sprintf(`{"_id":"doc%02d","_rev":"3-old","n":%d}`, i, i))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestImportDocs(t *testing.T) {
+	server := newImportServer()
+	restore := useTestServer(t, server)
+	defer restore()
+
+	input := importInput(3) + "\n" +
+		`{"_id":"broken",` + "\n" +
+		`{"_id":"_design/foo"}` + "\n" +
+		`[1,2]` + "\n" +
+		`{"name":"no id"}`
+	var progress []ImportProgress
+	res, err := ImportDocs(TestPrefix, TestDoctype, strings.NewReader(input), ConflictSkip, &ImportOptions{
+		BatchSize: 3,
+		Progress:  func(p ImportProgress) { progress = append(progress, p) },
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 9, res.Lines)
+	assert.Equal(t, 4, res.Written)
+	assert.Equal(t, 3, res.Malformed)
+	if assert.Len(t, res.Errors, 3) {
+		assert.Equal(t, 6, res.Errors[0].Line)
+		assert.Equal(t, 7, res.Errors[1].Line)
+		assert.Equal(t, 8, res.Errors[2].Line)
+		assert.Contains(t, res.Errors[0].Error(), "line 6: ")
+	}
+	if assert.Len(t, progress, 3) {
+		assert.Equal(t, 3, progress[0].Lines)
+		assert.Equal(t, 2, progress[0].Written)
+	}
+	assert.Equal(t, "1-abc", server.docs["doc00"]["_rev"])
+	assert.Equal(t, float64(2), server.docs["doc02"]["n"])
+}
+
+func TestImportDocsConflicts(t *testing.T) {
+	server := newImportServer()
+	restore := useTestServer(t, server)
+	defer restore()
+	server.docs["doc01"] = map[string]interface{}{"_id": "doc01", "_rev": "1-abc", "n": "existing"}
+
+	// Skip
+	res, err := ImportDocs(TestPrefix, TestDoctype, strings.NewReader(importInput(3)), ConflictSkip, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Skipped)
+	assert.Equal(t, 2, res.Written)
+	assert.Equal(t, "existing", server.docs["doc01"]["n"])
+
+	// Overwrite
+	res, err = ImportDocs(TestPrefix, TestDoctype, strings.NewReader(importInput(3)), ConflictOverwrite, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Written)
+	assert.Equal(t, float64(1), server.docs["doc01"]["n"])
+	assert.Equal(t, "2-abc", server.docs["doc01"]["_rev"])
+
+	// Fail, and resume
+	delete(server.docs, "doc00")
+	delete(server.docs, "doc02")
+	bulks := server.bulks
+	res, err = ImportDocs(TestPrefix, TestDoctype, strings.NewReader(importInput(3)), ConflictFail, &ImportOptions{BatchSize: 2})
+	assert.True(t, IsConflictError(err))
+	assert.Contains(t, err.Error(), "doc01 of line 3")
+	// The first batch, with the header and doc00, has been written
+	assert.Equal(t, 2, res.Lines)
+	assert.Equal(t, bulks+1, server.bulks)
+	assert.Contains(t, server.docs, "doc00")
+	assert.NotContains(t, server.docs, "doc02")
+
+	res, err = ImportDocs(TestPrefix, TestDoctype, strings.NewReader(importInput(3)), ConflictSkip, &ImportOptions{SkipLines: res.Lines})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, res.Lines)
+	assert.Equal(t, 1, res.Skipped)
+	assert.Equal(t, 1, res.Written)
+	assert.Equal(t, "1-abc", server.docs["doc00"]["_rev"])
+	assert.Contains(t, server.docs, "doc02")
+}
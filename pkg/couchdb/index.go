@@ -308,12 +308,20 @@ var globalViews = []*View{
 	DomainAndAliasesView,
 }
 
-// InitGlobalDB defines views and indexes on the global databases. It is called
-// on every startup of the stack.
+// InitGlobalDB calls InitGlobalDBContext with a background context. It is kept
+// for compatibility, new code should use InitGlobalDBContext.
+//
+// Deprecated: use InitGlobalDBContext.
 func InitGlobalDB() error {
-	g, _ := errgroup.WithContext(context.Background())
-	DefineIndexes(g, GlobalSecretsDB, secretIndexes)
-	DefineIndexes(g, GlobalDB, globalIndexes)
-	DefineViews(g, GlobalDB, globalViews)
+	return InitGlobalDBContext(context.Background())
+}
+
+// InitGlobalDBContext defines views and indexes on the global databases. It is called
+// on every startup of the stack.
+func InitGlobalDBContext(ctx context.Context) error {
+	g, ctx := errgroup.WithContext(ctx)
+	DefineIndexesContext(ctx, g, GlobalSecretsDB, secretIndexes)
+	DefineIndexesContext(ctx, g, GlobalDB, globalIndexes)
+	DefineViewsContext(ctx, g, GlobalDB, globalViews)
 	return g.Wait()
 }
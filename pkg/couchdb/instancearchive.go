@@ -0,0 +1,216 @@
+package couchdb
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// InstanceArchiveVersion is the version of the format of the archives
+	// written by ExportInstance.
+	InstanceArchiveVersion = 1
+	// instanceManifestName is the name of the manifest in an archive, its
+	// first file.
+	instanceManifestName = "manifest.json"
+)
+
+// InstanceManifest is the manifest of an archive of ExportInstance.
+type InstanceManifest struct {
+	Version    int                    `json:"version"`
+	ExportedAt time.Time              `json:"exported_at"`
+	Doctypes   []InstanceManifestDump `json:"doctypes"`
+}
+
+// InstanceManifestDump is a dump of a doctype in an archive.
+type InstanceManifestDump struct {
+	Doctype string `json:"doctype"`
+	File    string `json:"file"`
+	Count   int    `json:"count"`
+}
+
+// ImportInstanceOptions are the options of ImportInstance.
+type ImportInstanceOptions struct {
+	// Strategy is the conflict strategy used for all the doctypes
+	Strategy ConflictStrategy
+	// BatchSize is the number of lines written in a _bulk_docs request
+	BatchSize int
+}
+
+// ImportInstanceError is returned by ImportInstance when the import of a
+// doctype has failed. The doctypes before it have been imported.
+type ImportInstanceError struct {
+	Doctype string
+	Err     error
+}
+
+func (e *ImportInstanceError) Error() string {
+	return fmt.Sprintf("CouchDB: cannot import the doctype %s: %s", e.Doctype, e.Err)
+}
+
+func (e *ImportInstanceError) Unwrap() error {
+	return e.Err
+}
+
+// ExportInstance calls ExportInstanceContext with a background context.
+func ExportInstance(db Database, w io.Writer) (*InstanceManifest, error) {
+	return ExportInstanceContext(context.Background(), db, w)
+}
+
+// ExportInstanceContext writes the documents of all the doctypes of an
+// instance to w, as a tar archive, to move the instance to another stack. The
+// first file of the archive is the manifest, followed by a dump of each
+// doctype made by ExportDocs. As the size of a file must be known before it
+// is written in a tar archive, the dumps are made in temporary files first.
+// The attachments are inlined, and the revisions are kept.
+func ExportInstanceContext(ctx context.Context, db Database, w io.Writer) (*InstanceManifest, error) {
+	doctypes, err := AllDoctypesContext(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "cozy-export-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := &InstanceManifest{
+		Version:    InstanceArchiveVersion,
+		ExportedAt: time.Now().UTC(),
+	}
+	for _, doctype := range doctypes {
+		dump := InstanceManifestDump{Doctype: doctype, File: doctype + ".ndjson"}
+		f, err := os.Create(filepath.Join(dir, dump.File))
+		if err != nil {
+			return nil, err
+		}
+		dump.Count, err = ExportDocsContext(ctx, db, doctype, f, ExportOptions{
+			Attachments: ExportAttachmentsInline,
+		})
+		if errc := f.Close(); err == nil {
+			err = errc
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest.Doctypes = append(manifest.Doctypes, dump)
+	}
+
+	tw := tar.NewWriter(w)
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeArchiveFile(tw, instanceManifestName, int64(len(data)), manifest.ExportedAt); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+	for _, dump := range manifest.Doctypes {
+		if err := copyDumpToArchive(tw, filepath.Join(dir, dump.File), dump.File, manifest.ExportedAt); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, size int64, modTime time.Time) error {
+	return tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0640,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+}
+
+func copyDumpToArchive(tw *tar.Writer, filename, name string, modTime time.Time) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	infos, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(tw, name, infos.Size(), modTime); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ImportInstance calls ImportInstanceContext with a background context.
+func ImportInstance(db Database, r io.Reader, opts *ImportInstanceOptions) (map[string]*ImportResult, error) {
+	return ImportInstanceContext(context.Background(), db, r, opts)
+}
+
+// ImportInstanceContext reads an archive written by ExportInstance, and
+// imports its dumps with ImportDocs, in the databases of the given instance
+// (that can have another prefix than the exported one). The archive is read
+// as a stream. The databases are created if needed, and the indexes and
+// views of the doctypes are defined once their documents are imported. The
+// documents of the doctypes that the stack does not know are imported as
+// they are. It returns the result of the import of each doctype, even on
+// error.
+func ImportInstanceContext(ctx context.Context, db Database, r io.Reader, opts *ImportInstanceOptions) (map[string]*ImportResult, error) {
+	if opts == nil {
+		opts = &ImportInstanceOptions{}
+	}
+	results := make(map[string]*ImportResult)
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return results, err
+	}
+	if hdr.Name != instanceManifestName {
+		return results, fmt.Errorf("CouchDB: the archive does not start with its manifest, but with %s", hdr.Name)
+	}
+	var manifest InstanceManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return results, err
+	}
+	if manifest.Version > InstanceArchiveVersion {
+		return results, fmt.Errorf("CouchDB: the version %d of the archive is not supported", manifest.Version)
+	}
+	doctypes := make(map[string]string, len(manifest.Doctypes))
+	for _, dump := range manifest.Doctypes {
+		doctypes[dump.File] = dump.Doctype
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+		doctype, ok := doctypes[hdr.Name]
+		if !ok {
+			continue
+		}
+		// The indexes are defined after the import of the documents
+		res, err := ImportDocsContext(withoutIndexes(ctx), db, doctype, tr, opts.Strategy, &ImportOptions{
+			BatchSize: opts.BatchSize,
+		})
+		results[doctype] = res
+		if err == nil {
+			err = createDBWithIndexes(ctx, db, doctype)
+		}
+		if err != nil {
+			return results, &ImportInstanceError{Doctype: doctype, Err: err}
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package couchdb
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+// memCouch is a fake CouchDB that keeps its databases in memory, with enough
+// of the API for the export, import, clone and rename of an instance. The attachments are
+// kept inline, and sent as stubs by _all_docs.
+type memCouch struct {
+	mu      sync.Mutex
+	dbs     map[string]map[string]map[string]json.RawMessage
+	indexes map[string]int
+	views   map[string]int
+}
+
+func newMemCouch() *memCouch {
+	return &memCouch{
+		dbs:     make(map[string]map[string]map[string]json.RawMessage),
+		indexes: make(map[string]int),
+		views:   make(map[string]int),
+	}
+}
+
+func (c *memCouch) seed(db Database, doctype string, docs ...string) {
+	name := EscapeCouchdbName(db.DBPrefix() + "/" + doctype)
+	if c.dbs[name] == nil {
+		c.dbs[name] = make(map[string]map[string]json.RawMessage)
+	}
+	for _, data := range docs {
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(data), &doc); err != nil {
+			panic(err)
+		}
+		var id string
+		_ = json.Unmarshal(doc["_id"], &id)
+		doc["_rev"] = json.RawMessage(`"1-seed"`)
+		c.dbs[name][id] = doc
+	}
+}
+
+func (c *memCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r.URL.Path == "/_all_dbs" {
+		start := strings.Trim(r.URL.Query().Get("start_key"), `"`)
+		var names []string
+		for name := range c.dbs {
+			if strings.HasPrefix(name, start) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		_ = json.NewEncoder(w).Encode(names)
+		return
+	}
+	parts := strings.SplitN(strings.Trim(r.URL.EscapedPath(), "/"), "/", 2)
+	name, _ := url.PathUnescape(parts[0])
+	docs, exists := c.dbs[name]
+	if len(parts) == 1 && r.Method == http.MethodPut {
+		if exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = w.Write([]byte(`{"error":"file_exists","reason":"The database could not be created, the file already exists."}`))
+			return
+		}
+		c.dbs[name] = make(map[string]map[string]json.RawMessage)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"ok":true}`))
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"not_found","reason":"Database does not exist."}`))
+		return
+	}
+	if len(parts) == 1 && r.Method == http.MethodDelete {
+		delete(c.dbs, name)
+		_, _ = w.Write([]byte(`{"ok":true}`))
+		return
+	}
+	if len(parts) == 1 {
+		size := 0
+		for _, doc := range docs {
+			data, _ := json.Marshal(doc)
+			size += len(data)
+		}
+		_, _ = fmt.Fprintf(w, `{"db_name":%q,"doc_count":%d,"sizes":{"file":%d,"active":%d}}`, name, len(docs), size, size)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case parts[1] == "_all_docs" && r.Method == http.MethodPost:
+		var req struct {
+			Keys []string `json:"keys"`
+		}
+		_ = json.Unmarshal(body, &req)
+		rows := make([]string, len(req.Keys))
+		for i, key := range req.Keys {
+			if doc, ok := docs[key]; ok {
+				rows[i] = fmt.Sprintf(`{"id":%q,"key":%q,"value":{"rev":%s}}`, key, key, doc["_rev"])
+			} else {
+				rows[i] = fmt.Sprintf(`{"key":%q,"error":"not_found"}`, key)
+			}
+		}
+		_, _ = fmt.Fprintf(w, `{"rows":[%s]}`, strings.Join(rows, ","))
+	case parts[1] == "_all_docs":
+		c.allDocs(w, r, docs)
+	case parts[1] == "_bulk_docs":
+		c.bulkDocs(w, body, docs)
+	case parts[1] == "_revs_diff":
+		var req map[string][]string
+		_ = json.Unmarshal(body, &req)
+		missing := make(map[string]map[string][]string)
+		for id, revs := range req {
+			for _, rev := range revs {
+				if doc, ok := docs[id]; !ok || string(doc["_rev"]) != fmt.Sprintf("%q", rev) {
+					missing[id] = map[string][]string{"missing": {rev}}
+				}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(missing)
+	case parts[1] == "_index":
+		c.indexes[name]++
+		_, _ = w.Write([]byte(`{"result":"created","id":"_design/idx","name":"idx"}`))
+	case strings.HasPrefix(parts[1], "_design"):
+		c.views[name]++
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"ok":true,"id":"_design/view","rev":"1-abc"}`))
+	default:
+		id, _ := url.PathUnescape(parts[1])
+		doc, ok := docs[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(doc)
+	}
+}
+
+func (c *memCouch) allDocs(w http.ResponseWriter, r *http.Request, docs map[string]map[string]json.RawMessage) {
+	ids := make([]string, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	q := r.URL.Query()
+	var start string
+	_ = json.Unmarshal([]byte(q.Get("startkey")), &start)
+	if start == "" {
+		start = q.Get("startkey_docid")
+	}
+	var rows []string
+	for _, id := range ids {
+		if id < start || (id == start && q.Get("skip") == "1") {
+			continue
+		}
+		if limit := q.Get("limit"); limit != "" && fmt.Sprint(len(rows)) == limit {
+			break
+		}
+		doc := make(map[string]json.RawMessage, len(docs[id]))
+		for k, v := range docs[id] {
+			doc[k] = v
+		}
+		if raw, ok := doc["_attachments"]; ok {
+			var atts map[string]map[string]interface{}
+			_ = json.Unmarshal(raw, &atts)
+			for _, att := range atts {
+				delete(att, "data")
+				att["stub"] = true
+			}
+			doc["_attachments"], _ = json.Marshal(atts)
+		}
+		data, _ := json.Marshal(doc)
+		rows = append(rows, fmt.Sprintf(`{"id":%q,"key":%q,"value":{"rev":%s},"doc":%s}`, id, id, doc["_rev"], data))
+	}
+	_, _ = fmt.Fprintf(w, `{"total_rows":%d,"rows":[%s]}`, len(ids), strings.Join(rows, ","))
+}
+
+func (c *memCouch) bulkDocs(w http.ResponseWriter, body []byte, docs map[string]map[string]json.RawMessage) {
+	var req struct {
+		Docs []map[string]json.RawMessage `json:"docs"`
+	}
+	_ = json.Unmarshal(body, &req)
+	res := make([]UpdateResponse, len(req.Docs))
+	for i, doc := range req.Docs {
+		var id, rev string
+		_ = json.Unmarshal(doc["_id"], &id)
+		_ = json.Unmarshal(doc["_rev"], &rev)
+		old, exists := docs[id]
+		if exists && string(old["_rev"]) != fmt.Sprintf("%q", rev) {
+			res[i] = UpdateResponse{ID: id, Error: "conflict", Reason: "Document update conflict."}
+			continue
+		}
+		doc["_rev"] = json.RawMessage(`"1-imported"`)
+		docs[id] = doc
+		res[i] = UpdateResponse{ID: id, Rev: "1-imported", Ok: true}
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// dumpLines returns the lines of the dumps of an archive, without the _rev,
+// by doctype.
+func dumpLines(t *testing.T, archive []byte) (*InstanceManifest, map[string][]string) {
+	var manifest InstanceManifest
+	lines := make(map[string][]string)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+		if hdr.Name == instanceManifestName {
+			assert.NoError(t, json.NewDecoder(tr).Decode(&manifest))
+			continue
+		}
+		scanner := bufio.NewScanner(tr)
+		scanner.Scan() // The header
+		for scanner.Scan() {
+			var doc map[string]json.RawMessage
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+			delete(doc, "_rev")
+			data, _ := json.Marshal(doc)
+			lines[hdr.Name] = append(lines[hdr.Name], string(data))
+		}
+	}
+	return &manifest, lines
+}
+
+func TestExportImportInstance(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := newMemCouch()
+	restore := useTestServer(t, server)
+	defer restore()
+
+	source := prefixer.NewPrefixer("source.cozy.tools", "archivesource")
+	target := prefixer.NewPrefixer("target.cozy.tools", "archivetarget")
+	server.seed(source, consts.Files,
+		`{"_id":"file1","type":"file","name":"a.txt","tags":["x","y"],"size":"12","_attachments":{"thumb":{"content_type":"image/png","data":"aGVsbG8="}}}`,
+		`{"_id":"dir1","type":"directory","name":"photos","metadata":{"nested":{"n":1.5,"s":"été"}}}`,
+	)
+	unknown := "io.cozy.tests.unknown"
+	var docs []string
+	for i := 0; i < 250; i++ {
+		docs = append(docs, fmt.Sprintf(`{"_id":"u%03d","value":%d,"html":"<b>&</b>"}`, i, i))
+	}
+	server.seed(source, unknown, docs...)
+
+	var buf bytes.Buffer
+	manifest, err := ExportInstance(source, &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, InstanceArchiveVersion, manifest.Version)
+	if assert.Len(t, manifest.Doctypes, 2) {
+		assert.Equal(t, consts.Files, manifest.Doctypes[0].Doctype)
+		assert.Equal(t, 2, manifest.Doctypes[0].Count)
+		assert.Equal(t, unknown, manifest.Doctypes[1].Doctype)
+		assert.Equal(t, 250, manifest.Doctypes[1].Count)
+	}
+	exported := buf.Bytes()
+
+	results, err := ImportInstance(target, bytes.NewReader(exported), &ImportInstanceOptions{BatchSize: 100})
+	assert.NoError(t, err)
+	if assert.Contains(t, results, unknown) {
+		assert.Equal(t, 250, results[unknown].Written)
+		assert.Empty(t, results[unknown].Errors)
+	}
+	files := EscapeCouchdbName(target.DBPrefix() + "/" + consts.Files)
+	assert.Equal(t, len(IndexesByDoctype(consts.Files)), server.indexes[files])
+	assert.Equal(t, len(ViewsByDoctype(consts.Files)), server.views[files])
+
+	// The documents are the same, apart from their revisions
+	buf.Reset()
+	_, err = ExportInstance(target, &buf)
+	assert.NoError(t, err)
+	_, before := dumpLines(t, exported)
+	_, after := dumpLines(t, buf.Bytes())
+	assert.Len(t, before[consts.Files+".ndjson"], 2)
+	assert.Len(t, before[unknown+".ndjson"], 250)
+	assert.Equal(t, before, after)
+	assert.Contains(t, strings.Join(after[consts.Files+".ndjson"], "\n"), `"data":"aGVsbG8="`)
+
+	// An import in an instance with the documents skips them
+	results, err = ImportInstance(target, bytes.NewReader(exported), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 250, results[unknown].Skipped)
+}
+
+func TestImportInstanceInvalidArchive(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.NoError(t, writeArchiveFile(tw, "foo.ndjson", 0, time.Time{}))
+	assert.NoError(t, tw.Close())
+	_, err := ImportInstance(TestPrefix, &buf, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "manifest")
+}
@@ -0,0 +1,372 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// CloneByReplication is the method of the doctypes cloned with a CouchDB
+	// replication.
+	CloneByReplication = "replication"
+	// CloneByStream is the method of the doctypes cloned with an export
+	// streamed to an import.
+	CloneByStream = "stream"
+)
+
+// CloneInstanceOptions are the options of CloneInstance.
+type CloneInstanceOptions struct {
+	// Stream clones the doctypes with an export streamed to an import,
+	// instead of trying a replication first.
+	Stream bool
+	// Progress is called after each doctype
+	Progress func(CloneProgress)
+}
+
+// CloneProgress tells how the clone of a doctype has ended.
+type CloneProgress struct {
+	Doctype string
+	// Method is CloneByReplication or CloneByStream
+	Method string
+	// Fixed is the number of documents where the prefix of the source has
+	// been replaced by the prefix of the target
+	Fixed int
+	Err   error
+}
+
+// CloneInstanceError is returned by CloneInstance when some doctypes have
+// failed. The other doctypes have been cloned.
+type CloneInstanceError struct {
+	// Cloned are the doctypes cloned successfully
+	Cloned []string
+	// Errors are the errors by doctype
+	Errors map[string]error
+}
+
+// Doctypes returns the doctypes that have failed, sorted.
+func (e *CloneInstanceError) Doctypes() []string {
+	doctypes := make([]string, 0, len(e.Errors))
+	for doctype := range e.Errors {
+		doctypes = append(doctypes, doctype)
+	}
+	sort.Strings(doctypes)
+	return doctypes
+}
+
+func (e *CloneInstanceError) Error() string {
+	doctypes := e.Doctypes()
+	msgs := make([]string, len(doctypes))
+	for i, doctype := range doctypes {
+		msgs[i] = fmt.Sprintf("%s (%s)", doctype, e.Errors[doctype])
+	}
+	return fmt.Sprintf("CouchDB: cannot clone %d doctypes: %s",
+		len(doctypes), strings.Join(msgs, ", "))
+}
+
+// CloneInstance calls CloneInstanceContext with a background context.
+func CloneInstance(src, dst Database, doctypes []string, opts *CloneInstanceOptions) error {
+	return CloneInstanceContext(context.Background(), src, dst, doctypes, opts)
+}
+
+// CloneInstanceContext copies the documents of the doctypes (all the
+// doctypes of the source if nil) from an instance to another, for example to
+// debug the data of a user in a sandbox. A doctype is cloned with a CouchDB
+// replication that creates the target database, or, if it fails, with an
+// export streamed to an import. Then, the prefix of the source is replaced
+// by the prefix of the target in the fields of the cloned documents, and the
+// indexes and views of the doctype are defined. The doctypes are cloned one
+// after the other, and a failure does not stop the others: they are returned
+// in a *CloneInstanceError, with the doctypes that have been cloned.
+func CloneInstanceContext(ctx context.Context, src, dst Database, doctypes []string, opts *CloneInstanceOptions) error {
+	if opts == nil {
+		opts = &CloneInstanceOptions{}
+	}
+	if doctypes == nil {
+		var err error
+		if doctypes, err = AllDoctypesContext(ctx, src); err != nil {
+			return err
+		}
+	}
+	cloneErr := &CloneInstanceError{Errors: make(map[string]error)}
+	for _, doctype := range doctypes {
+		progress := cloneDoctype(ctx, src, dst, doctype, opts.Stream)
+		if progress.Err != nil {
+			cloneErr.Errors[doctype] = progress.Err
+		} else {
+			cloneErr.Cloned = append(cloneErr.Cloned, doctype)
+		}
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+	if len(cloneErr.Errors) > 0 {
+		return cloneErr
+	}
+	return nil
+}
+
+func cloneDoctype(ctx context.Context, src, dst Database, doctype string, stream bool) CloneProgress {
+	progress := CloneProgress{Doctype: doctype, Method: CloneByReplication}
+	var err error
+	if !stream {
+		err = replicateDB(ctx, src, dst, doctype)
+	}
+	// The stream is not started if the replication may still be running,
+	// as they would write the same documents
+	if stream || isReplicationRefused(err) {
+		progress.Method = CloneByStream
+		err = streamDB(ctx, src, dst, doctype)
+	}
+	if err == nil {
+		progress.Fixed, err = fixPrefix(ctx, dst, doctype, src.DBPrefix())
+	}
+	if err == nil {
+		err = createDBWithIndexes(ctx, dst, doctype)
+	}
+	progress.Err = err
+	return progress
+}
+
+// DefaultReplicationURL is the URL where CouchDB reaches itself for the
+// replications, when the configuration has no replication_url.
+const DefaultReplicationURL = "http://127.0.0.1:5984/"
+
+// replicationTimeout is the maximal duration of a replication, as CouchDB
+// answers only once all the documents have been replicated.
+var replicationTimeout = 24 * time.Hour
+
+// replicationEndpoint is the source or the target of a replication. The
+// credentials are sent in a header, and not in the URL, so that they are
+// masked in the logs of the bodies.
+type replicationEndpoint struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type replicationRequest struct {
+	Source       replicationEndpoint `json:"source"`
+	Target       replicationEndpoint `json:"target"`
+	CreateTarget bool                `json:"create_target,omitempty"`
+	Cancel       bool                `json:"cancel,omitempty"`
+}
+
+// replicateDB replicates the database of a doctype to another instance, on
+// the same cluster, and creates the target database if needed. If it fails
+// without an answer from CouchDB, the replication is canceled, as it may
+// still be running.
+func replicateDB(ctx context.Context, src, dst Database, doctype string) error {
+	cl := clusterFor(ctx, doctype)
+	body := replicationRequest{
+		Source:       replicationEndpointFor(cl, src, doctype),
+		Target:       replicationEndpointFor(cl, dst, doctype),
+		CreateTarget: true,
+	}
+	var res struct {
+		OK bool `json:"ok"`
+	}
+	ctx = withCluster(ctx, cl)
+	err := makeRequest(WithTimeout(ctx, replicationTimeout), src, "", http.MethodPost, "_replicate", &body, &res)
+	if err != nil {
+		if !isReplicationRefused(err) {
+			cancelReplication(withCluster(context.Background(), cl), src, doctype, body)
+		}
+		return err
+	}
+	if !res.OK {
+		return fmt.Errorf("CouchDB: the replication of %s has failed", doctype)
+	}
+	return nil
+}
+
+func cancelReplication(ctx context.Context, db Database, doctype string, body replicationRequest) {
+	body.CreateTarget = false
+	body.Cancel = true
+	if err := makeRequest(ctx, db, "", http.MethodPost, "_replicate", &body, nil); err != nil {
+		loggerFor(db).Warnf("cannot cancel the replication of %s: %s", doctype, err)
+	}
+}
+
+// isReplicationRefused returns true if CouchDB has refused to replicate, for
+// example because the source cannot be opened: the replication is not
+// running. A timeout, or a failure to reach CouchDB, is not a refusal.
+func isReplicationRefused(err error) bool {
+	couchErr, ok := IsCouchError(err)
+	return ok && couchErr.StatusCode >= 400 && couchErr.StatusCode < 500
+}
+
+// replicationEndpointFor returns the URL of a database for a replication,
+// with the credentials of its cluster, as CouchDB needs full URLs for both
+// ends. The URL is the one where CouchDB reaches itself, as the URL of the
+// stack can be a unix socket or a reverse proxy.
+func replicationEndpointFor(cl *cluster, db Database, doctype string) replicationEndpoint {
+	base := cl.replicationURL
+	if base == nil {
+		base, _ = url.Parse(DefaultReplicationURL)
+	}
+	endpoint := replicationEndpoint{URL: nodeURL(base, makeDBName(db, doctype))}
+	if cl.auth != nil {
+		password, _ := cl.auth.Password()
+		credentials := cl.auth.Username() + ":" + password
+		endpoint.Headers = map[string]string{
+			"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)),
+		}
+	}
+	return endpoint
+}
+
+// streamDB copies the documents of a doctype to another instance, with an
+// export streamed to an import, through a pipe.
+func streamDB(ctx context.Context, src, dst Database, doctype string) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ExportDocsContext(ctx, src, doctype, pw, ExportOptions{
+			Attachments: ExportAttachmentsInline,
+		})
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	res, err := ImportDocsContext(ctx, dst, doctype, pr, ConflictOverwrite, nil)
+	// The export stops if the import has ended before reading everything
+	pr.CloseWithError(io.ErrClosedPipe)
+	if exportErr := <-done; exportErr != nil && exportErr != io.ErrClosedPipe {
+		return exportErr
+	}
+	if err != nil {
+		return err
+	}
+	if len(res.Errors) > 0 {
+		return fmt.Errorf("CouchDB: %d documents not cloned, the first one on %s",
+			len(res.Errors), res.Errors[0])
+	}
+	return nil
+}
+
+// fixPrefix replaces the old prefix by the prefix of the database in the
+// string values of its documents (but not their _id) that reference it: the
+// values equal to the prefix, and those that are the name of a database with
+// this prefix. The other values, like the texts of the user, are left
+// untouched, even if they contain the prefix. It returns the number of
+// documents updated.
+func fixPrefix(ctx context.Context, db Database, doctype, oldPrefix string) (int, error) {
+	newPrefix := db.DBPrefix()
+	if oldPrefix == "" || oldPrefix == newPrefix {
+		return 0, nil
+	}
+	// The documents are decoded only if the prefix is in their JSON
+	oldJSON, _ := json.Marshal(oldPrefix)
+	oldJSON = oldJSON[1 : len(oldJSON)-1]
+	escapedJSON, _ := json.Marshal(EscapeCouchdbName(oldPrefix))
+	escapedJSON = escapedJSON[1 : len(escapedJSON)-1]
+
+	fixed := 0
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var rows []UpdateResponse
+		err := makeRequest(ctx, db, doctype, http.MethodPost, "_bulk_docs", newBulkDocsBody(batch), &rows)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if row.Error != "" {
+				return newBulkRowError(row)
+			}
+		}
+		fixed += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	var fixErr error
+	seq, res := AllDocsSeqContext(ctx, db, doctype, AllDocsRequest{})
+	seq(func(id string, raw json.RawMessage) bool {
+		if !bytes.Contains(raw, oldJSON) && !bytes.Contains(raw, escapedJSON) {
+			return true
+		}
+		var doc map[string]json.RawMessage
+		if fixErr = json.Unmarshal(raw, &doc); fixErr != nil {
+			return false
+		}
+		changed := false
+		for key, value := range doc {
+			if key == "_id" || key == "_rev" || key == "_attachments" {
+				continue
+			}
+			if !bytes.Contains(value, oldJSON) && !bytes.Contains(value, escapedJSON) {
+				continue
+			}
+			var v interface{}
+			dec := json.NewDecoder(bytes.NewReader(value))
+			dec.UseNumber()
+			if fixErr = dec.Decode(&v); fixErr != nil {
+				return false
+			}
+			if v, ok := replacePrefix(v, oldPrefix, newPrefix); ok {
+				if doc[key], fixErr = json.Marshal(v); fixErr != nil {
+					return false
+				}
+				changed = true
+			}
+		}
+		if !changed {
+			return true
+		}
+		batch = append(batch, doc)
+		if len(batch) >= seqPageSize {
+			fixErr = flush()
+		}
+		return fixErr == nil
+	})
+	if fixErr == nil {
+		fixErr = res.Err()
+	}
+	if fixErr == nil {
+		fixErr = flush()
+	}
+	return fixed, fixErr
+}
+
+// replacePrefix replaces the old prefix in the strings of a JSON value that
+// reference it, and tells if the value has changed.
+func replacePrefix(value interface{}, oldPrefix, newPrefix string) (interface{}, bool) {
+	changed := false
+	switch v := value.(type) {
+	case string:
+		oldDBPrefix := EscapeCouchdbName(oldPrefix + "/")
+		switch {
+		case v == oldPrefix:
+			return newPrefix, true
+		case strings.HasPrefix(v, oldPrefix+"/"):
+			return newPrefix + strings.TrimPrefix(v, oldPrefix), true
+		case strings.HasPrefix(v, oldDBPrefix):
+			return EscapeCouchdbName(newPrefix+"/") + strings.TrimPrefix(v, oldDBPrefix), true
+		}
+	case map[string]interface{}:
+		for key, val := range v {
+			if fixed, ok := replacePrefix(val, oldPrefix, newPrefix); ok {
+				v[key] = fixed
+				changed = true
+			}
+		}
+	case []interface{}:
+		for i, val := range v {
+			if fixed, ok := replacePrefix(val, oldPrefix, newPrefix); ok {
+				v[i] = fixed
+				changed = true
+			}
+		}
+	}
+	return value, changed
+}
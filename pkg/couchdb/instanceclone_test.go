@@ -0,0 +1,206 @@
+package couchdb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+// replicatingCouch is a memCouch that can also replicate a database, unless
+// refuse is set. When lossy is set, the replications miss a document, and
+// when broken is set, they fail without telling if they have started.
+type replicatingCouch struct {
+	*memCouch
+	refuse       bool
+	lossy        bool
+	broken       bool
+	replications []string
+	canceled     int
+	bodies       []string
+}
+
+func (c *replicatingCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/_replicate" {
+		c.memCouch.ServeHTTP(w, r)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var req struct {
+		Source       replicationEndpoint `json:"source"`
+		Target       replicationEndpoint `json:"target"`
+		CreateTarget bool                `json:"create_target"`
+		Cancel       bool                `json:"cancel"`
+	}
+	_ = json.Unmarshal(body, &req)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bodies = append(c.bodies, string(body))
+	if req.Cancel {
+		c.canceled++
+		_, _ = w.Write([]byte(`{"ok":true}`))
+		return
+	}
+	c.replications = append(c.replications, req.Source.URL+" -> "+req.Target.URL)
+	if c.broken {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error":"unknown_error","reason":"timeout"}`))
+		return
+	}
+	source, _ := url.Parse(req.Source.URL)
+	target, _ := url.Parse(req.Target.URL)
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+	docs, ok := c.dbs[strings.TrimPrefix(source.Path, "/")]
+	if c.refuse || !ok || !req.CreateTarget || source.User != nil || req.Source.Headers["Authorization"] != auth {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"db_not_found","reason":"could not open source"}`))
+		return
+	}
+	targetName := strings.TrimPrefix(target.Path, "/")
+	copied := c.dbs[targetName]
+	if copied == nil {
+		copied = make(map[string]map[string]json.RawMessage, len(docs))
+	}
+	for id, doc := range docs {
+		if c.lossy && len(copied) == len(docs)-1 {
+			break
+		}
+		copied[id] = doc
+	}
+	c.dbs[targetName] = copied
+	_, _ = w.Write([]byte(`{"ok":true}`))
+}
+
+func TestCloneInstance(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := &replicatingCouch{memCouch: newMemCouch()}
+	restore := useTestServer(t, server)
+	defer restore()
+	// The credentials are sent in the URLs of the replication (restore resets
+	// the configuration)
+	config.GetConfig().CouchDB.Auth = url.UserPassword("admin", "secret")
+	config.GetConfig().CouchDB.SessionAuth = false
+
+	src := prefixer.NewPrefixer("source.cozy.tools", "clonesource")
+	dst := prefixer.NewPrefixer("sandbox.cozy.tools", "clonesandbox")
+	server.seed(src, consts.Files,
+		`{"_id":"file1","type":"file","name":"a.txt"}`,
+		`{"_id":"file2","type":"file","name":"b.txt","path":"/clonesource/b.txt",
+		  "owner":"clonesource","refs":[{"db":"clonesource/io.cozy.notes"}]}`,
+	)
+	server.seed(src, "io.cozy.tests.notes", `{"_id":"note1","title":"hello"}`)
+
+	var progress []CloneProgress
+	err := CloneInstance(src, dst, nil, &CloneInstanceOptions{
+		Progress: func(p CloneProgress) { progress = append(progress, p) },
+	})
+	assert.NoError(t, err)
+	assert.Len(t, server.replications, 2)
+	assert.Contains(t, server.replications[0], DefaultReplicationURL+"clonesource%2Fio-cozy-files -> ")
+	// The credentials are not in the logs of the bodies
+	assert.NotContains(t, redactBody([]byte(server.bodies[0])), "Basic")
+	if assert.Len(t, progress, 2) {
+		assert.Equal(t, consts.Files, progress[0].Doctype)
+		assert.Equal(t, CloneByReplication, progress[0].Method)
+		assert.Equal(t, 1, progress[0].Fixed)
+		assert.NoError(t, progress[0].Err)
+	}
+	files := server.dbs[EscapeCouchdbName(dst.DBPrefix()+"/"+consts.Files)]
+	if assert.Len(t, files, 2) {
+		// Only the values that reference the prefix are replaced
+		assert.JSONEq(t, `"clonesandbox"`, string(files["file2"]["owner"]))
+		assert.JSONEq(t, `[{"db":"clonesandbox/io.cozy.notes"}]`, string(files["file2"]["refs"]))
+		assert.JSONEq(t, `"/clonesource/b.txt"`, string(files["file2"]["path"]))
+		assert.JSONEq(t, `"file2"`, string(files["file2"]["_id"]))
+	}
+	filesDB := EscapeCouchdbName(dst.DBPrefix() + "/" + consts.Files)
+	assert.Equal(t, len(IndexesByDoctype(consts.Files)), server.indexes[filesDB])
+	// The source is untouched
+	srcFiles := server.dbs[EscapeCouchdbName(src.DBPrefix()+"/"+consts.Files)]
+	assert.JSONEq(t, `"clonesource"`, string(srcFiles["file2"]["owner"]))
+}
+
+func TestCloneInstanceReplicationURL(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := &replicatingCouch{memCouch: newMemCouch(), refuse: true}
+	restore := useTestServer(t, server)
+	defer restore()
+	replicationURL, _ := url.Parse("https://couchdb.internal:6984/")
+	config.GetConfig().CouchDB.ReplicationURL = replicationURL
+
+	src := prefixer.NewPrefixer("source.cozy.tools", "urlsource")
+	dst := prefixer.NewPrefixer("sandbox.cozy.tools", "urlsandbox")
+	server.seed(src, "io.cozy.tests.notes", `{"_id":"note1"}`)
+	assert.NoError(t, CloneInstance(src, dst, []string{"io.cozy.tests.notes"}, nil))
+	if assert.Len(t, server.replications, 1) {
+		assert.Equal(t, "https://couchdb.internal:6984/urlsource%2Fio-cozy-tests-notes -> "+
+			"https://couchdb.internal:6984/urlsandbox%2Fio-cozy-tests-notes", server.replications[0])
+	}
+}
+
+func TestCloneInstanceNoFallbackWhileReplicating(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := &replicatingCouch{memCouch: newMemCouch(), broken: true}
+	restore := useTestServer(t, server)
+	defer restore()
+
+	src := prefixer.NewPrefixer("source.cozy.tools", "brokensource")
+	dst := prefixer.NewPrefixer("sandbox.cozy.tools", "brokensandbox")
+	server.seed(src, "io.cozy.tests.notes", `{"_id":"note1"}`)
+	var progress []CloneProgress
+	err := CloneInstance(src, dst, []string{"io.cozy.tests.notes"}, &CloneInstanceOptions{
+		Progress: func(p CloneProgress) { progress = append(progress, p) },
+	})
+	assert.Error(t, err)
+	// The replication may still be running: it is canceled, and the
+	// documents are not streamed
+	if assert.Len(t, progress, 1) {
+		assert.Equal(t, CloneByReplication, progress[0].Method)
+	}
+	assert.Equal(t, 1, server.canceled)
+	assert.Nil(t, server.dbs[EscapeCouchdbName(dst.DBPrefix()+"/io.cozy.tests.notes")])
+}
+
+func TestCloneInstanceFallback(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := &replicatingCouch{memCouch: newMemCouch(), refuse: true}
+	restore := useTestServer(t, server)
+	defer restore()
+
+	src := prefixer.NewPrefixer("source.cozy.tools", "fallbacksource")
+	dst := prefixer.NewPrefixer("sandbox.cozy.tools", "fallbacksandbox")
+	var docs []string
+	for i := 0; i < 150; i++ {
+		docs = append(docs, fmt.Sprintf(`{"_id":"note%03d","owner":"fallbacksource","n":%d}`, i, i))
+	}
+	server.seed(src, "io.cozy.tests.notes", docs...)
+
+	var progress []CloneProgress
+	err := CloneInstance(src, dst, []string{"io.cozy.tests.notes", "io.cozy.tests.missing"}, &CloneInstanceOptions{
+		Progress: func(p CloneProgress) { progress = append(progress, p) },
+	})
+	var cloneErr *CloneInstanceError
+	if assert.True(t, errors.As(err, &cloneErr)) {
+		assert.Equal(t, []string{"io.cozy.tests.notes"}, cloneErr.Cloned)
+		assert.Equal(t, []string{"io.cozy.tests.missing"}, cloneErr.Doctypes())
+		assert.True(t, IsNoDatabaseError(cloneErr.Errors["io.cozy.tests.missing"]))
+	}
+	if assert.Len(t, progress, 2) {
+		assert.Equal(t, CloneByStream, progress[0].Method)
+		assert.Equal(t, 150, progress[0].Fixed)
+	}
+	notes := server.dbs[EscapeCouchdbName(dst.DBPrefix()+"/io.cozy.tests.notes")]
+	if assert.Len(t, notes, 150) {
+		assert.JSONEq(t, `"fallbacksandbox"`, string(notes["note042"]["owner"]))
+	}
+}
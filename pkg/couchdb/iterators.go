@@ -0,0 +1,180 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// The sequences returned by AllDocsSeq and ChangesSeq are functions that
+// take a yield function, like the iter.Seq and iter.Seq2 of Go 1.23. They can
+// be used in a range loop with a recent version of Go:
+//
+//	seq, res := couchdb.AllDocsSeq(db, doctype, couchdb.AllDocsRequest{})
+//	for id, doc := range seq {
+//	    // ...
+//	}
+//	if err := res.Err(); err != nil {
+//	    // ...
+//	}
+//
+// or called directly with a yield function that returns false to stop. The
+// documents are fetched by pages, only when the loop needs them, and the
+// response in progress is closed when the loop stops early.
+
+// seqPageSize is the number of documents or changes fetched by request for
+// the sequences.
+const seqPageSize = 100
+
+// errStopSeq is returned by the callbacks when the consumer of a sequence
+// has stopped the loop.
+var errStopSeq = errors.New("sequence stopped")
+
+// SeqResult gives the error that has stopped a sequence, after the loop.
+type SeqResult struct {
+	err error
+}
+
+// Err returns the error that has stopped the sequence, or nil if all the
+// items have been read or if the loop has been stopped by its consumer.
+func (r *SeqResult) Err() error {
+	return r.err
+}
+
+func (r *SeqResult) finish(err error) {
+	if err == errStopSeq {
+		err = nil
+	}
+	r.err = err
+}
+
+// AllDocsSeq calls AllDocsSeqContext with a background context.
+func AllDocsSeq(db Database, doctype string, opts AllDocsRequest) (func(yield func(id string, doc json.RawMessage) bool), *SeqResult) {
+	return AllDocsSeqContext(context.Background(), db, doctype, opts)
+}
+
+// AllDocsSeqContext returns a sequence of the documents of a doctype, with
+// their identifiers, and the result where its error can be checked after
+// the loop. The design documents are skipped, and opts.Limit is the maximal
+// number of rows for the whole sequence, not by page.
+func AllDocsSeqContext(ctx context.Context, db Database, doctype string, opts AllDocsRequest) (func(yield func(id string, doc json.RawMessage) bool), *SeqResult) {
+	res := &SeqResult{}
+	seq := func(yield func(id string, doc json.RawMessage) bool) {
+		res.finish(allDocsPages(ctx, db, doctype, opts, yield))
+	}
+	return seq, res
+}
+
+func allDocsPages(ctx context.Context, db Database, doctype string, opts AllDocsRequest, yield func(id string, doc json.RawMessage) bool) error {
+	remaining := opts.Limit
+	page := opts
+	for {
+		page.Limit = seqPageSize
+		if remaining > 0 && remaining < seqPageSize {
+			page.Limit = remaining
+		}
+		count := 0
+		lastID := ""
+		stream := newRowStream("rows", func(item json.RawMessage) error {
+			var row struct {
+				ID  string          `json:"id"`
+				Doc json.RawMessage `json:"doc"`
+			}
+			if err := json.Unmarshal(item, &row); err != nil {
+				return err
+			}
+			count++
+			lastID = row.ID
+			if row.ID == "" || strings.HasPrefix(row.ID, "_design") || isNullJSON(row.Doc) {
+				// The missing and deleted documents for the keys
+				return nil
+			}
+			if !yield(row.ID, row.Doc) {
+				return errStopSeq
+			}
+			return nil
+		})
+		if err := requestAllDocs(ctx, db, doctype, &page, stream); err != nil {
+			return err
+		}
+		if len(page.Keys) > 0 || count < page.Limit {
+			return nil
+		}
+		if remaining > 0 {
+			remaining -= count
+			if remaining <= 0 {
+				return nil
+			}
+		}
+		page.StartKey = lastID
+		page.StartKeyDocID = ""
+		page.Skip = 1
+	}
+}
+
+func requestAllDocs(ctx context.Context, db Database, doctype string, req *AllDocsRequest, stream *rowStream) error {
+	v, err := req.Values()
+	if err != nil {
+		return err
+	}
+	v.Add("include_docs", "true")
+	if len(req.Keys) == 0 {
+		return makeRequest(ctx, db, doctype, http.MethodGet, "_all_docs?"+v.Encode(), nil, stream)
+	}
+	v.Del("keys")
+	body := struct {
+		Keys []string `json:"keys"`
+	}{
+		Keys: req.Keys,
+	}
+	return makeRequest(ctx, db, doctype, http.MethodPost, "_all_docs?"+v.Encode(), body, stream)
+}
+
+func isNullJSON(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+// ChangesSeq calls ChangesSeqContext with a background context.
+func ChangesSeq(db Database, doctype, since string) (func(yield func(change Change) bool), *SeqResult) {
+	return ChangesSeqContext(context.Background(), db, doctype, since)
+}
+
+// ChangesSeqContext returns a sequence of the changes of a doctype since the
+// given sequence number, with their documents, and the result where its
+// error can be checked after the loop. The changes feed is requested by
+// pages, until the last change.
+func ChangesSeqContext(ctx context.Context, db Database, doctype, since string) (func(yield func(change Change) bool), *SeqResult) {
+	res := &SeqResult{}
+	seq := func(yield func(change Change) bool) {
+		res.finish(changesPages(ctx, db, doctype, since, yield))
+	}
+	return seq, res
+}
+
+func changesPages(ctx context.Context, db Database, doctype, since string, yield func(change Change) bool) error {
+	req := &ChangesRequest{
+		DocType:     doctype,
+		Since:       since,
+		Limit:       seqPageSize,
+		IncludeDocs: true,
+	}
+	for {
+		count := 0
+		response, err := ForeachChangeContext(ctx, db, req, func(change *Change) error {
+			count++
+			if !yield(*change) {
+				return errStopSeq
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if count < req.Limit || response.LastSeq == "" {
+			return nil
+		}
+		req.Since = response.LastSeq
+	}
+}
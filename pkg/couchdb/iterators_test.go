@@ -0,0 +1,227 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// allDocsServer answers the _all_docs requests with n documents, sorted by
+// their ids, and a design document.
+func allDocsServer(n int, failAt int) (http.HandlerFunc, func() []string) {
+	var mu sync.Mutex
+	var queries []string
+	ids := []string{"_design/foo"}
+	for i := 0; i < n; i++ {
+		ids = append(ids, fmt.Sprintf("doc%04d", i))
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		nb := len(queries)
+		mu.Unlock()
+		if nb == failAt {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"internal","reason":"boom"}`))
+			return
+		}
+		q := r.URL.Query()
+		start := 0
+		if key := q.Get("startkey"); key != "" {
+			var id string
+			_ = json.Unmarshal([]byte(key), &id)
+			for start < len(ids) && ids[start] < id {
+				start++
+			}
+		}
+		skip, _ := strconv.Atoi(q.Get("skip"))
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		rows := make([]map[string]interface{}, 0, limit)
+		for i := start + skip; i < len(ids) && len(rows) < limit; i++ {
+			doc := map[string]interface{}{"_id": ids[i], "_rev": "1-abc"}
+			rows = append(rows, map[string]interface{}{"id": ids[i], "doc": doc})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"rows": rows})
+	}
+	return handler, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries
+	}
+}
+
+func TestAllDocsSeq(t *testing.T) {
+	handler, queries := allDocsServer(250, 0)
+	restore := useTestServer(t, handler)
+	defer restore()
+
+	seq, res := AllDocsSeq(TestPrefix, TestDoctype, AllDocsRequest{})
+	var ids []string
+	seq(func(id string, doc json.RawMessage) bool {
+		var m map[string]interface{}
+		assert.NoError(t, json.Unmarshal(doc, &m))
+		assert.Equal(t, id, m["_id"])
+		ids = append(ids, id)
+		return true
+	})
+	assert.NoError(t, res.Err())
+	if assert.Len(t, ids, 250) {
+		assert.Equal(t, "doc0000", ids[0])
+		assert.Equal(t, "doc0249", ids[249])
+	}
+	assert.Len(t, queries(), 3)
+
+	// The limit is for the whole sequence
+	handler, queries = allDocsServer(250, 0)
+	restore2 := useTestServer(t, handler)
+	defer restore2()
+	seq, res = AllDocsSeq(TestPrefix, TestDoctype, AllDocsRequest{Limit: 150})
+	count := 0
+	seq(func(id string, doc json.RawMessage) bool {
+		count++
+		return true
+	})
+	assert.NoError(t, res.Err())
+	assert.Equal(t, 149, count) // The design doc is in the first 150 rows
+	assert.Len(t, queries(), 2)
+}
+
+func TestAllDocsSeqStop(t *testing.T) {
+	handler, queries := allDocsServer(250, 0)
+	restore := useTestServer(t, handler)
+	defer restore()
+
+	// The loop is stopped in the second page: no other page is requested, and
+	// yield is not called again
+	seq, res := AllDocsSeq(TestPrefix, TestDoctype, AllDocsRequest{})
+	count := 0
+	seq(func(id string, doc json.RawMessage) bool {
+		count++
+		return count < 120
+	})
+	assert.NoError(t, res.Err())
+	assert.Equal(t, 120, count)
+	assert.Len(t, queries(), 2)
+}
+
+func TestAllDocsSeqError(t *testing.T) {
+	handler, _ := allDocsServer(250, 2)
+	restore := useTestServer(t, handler)
+	defer restore()
+
+	seq, res := AllDocsSeq(TestPrefix, TestDoctype, AllDocsRequest{})
+	count := 0
+	seq(func(id string, doc json.RawMessage) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 99, count)
+	if couchErr, ok := IsCouchError(res.Err()); assert.True(t, ok) {
+		assert.Equal(t, http.StatusInternalServerError, couchErr.StatusCode)
+	}
+}
+
+// TestAllDocsSeqClosesBody checks that the response in progress is closed
+// when the loop stops early, even if the server has more to send.
+func TestAllDocsSeqClosesBody(t *testing.T) {
+	closed := make(chan struct{})
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(closed)
+		flusher := w.(http.Flusher)
+		_, _ = w.Write([]byte(`{"rows":[`))
+		for i := 0; ; i++ {
+			if i > 0 {
+				_, _ = w.Write([]byte(","))
+			}
+			row := fmt.Sprintf(`{"id":"doc%08d","doc":{"_id":"doc%08d","padding":"%0512d"}}`, i, i, 0)
+			if _, err := w.Write([]byte(row)); err != nil {
+				return
+			}
+			flusher.Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			default:
+			}
+		}
+	}))
+	defer restore()
+
+	seq, res := AllDocsSeq(TestPrefix, TestDoctype, AllDocsRequest{})
+	count := 0
+	seq(func(id string, doc json.RawMessage) bool {
+		count++
+		return count < 3
+	})
+	assert.NoError(t, res.Err())
+	assert.Equal(t, 3, count)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the response has not been closed")
+	}
+}
+
+func TestChangesSeq(t *testing.T) {
+	var mu sync.Mutex
+	var sinces []string
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		mu.Lock()
+		sinces = append(sinces, q.Get("since"))
+		mu.Unlock()
+		assert.Equal(t, "true", q.Get("include_docs"))
+		start, _ := strconv.Atoi(q.Get("since"))
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		results := make([]map[string]interface{}, 0, limit)
+		seq := start
+		for seq < 230 && len(results) < limit {
+			seq++
+			id := fmt.Sprintf("doc%d", seq)
+			results = append(results, map[string]interface{}{
+				"seq":     strconv.Itoa(seq),
+				"id":      id,
+				"changes": []map[string]string{{"rev": "1-abc"}},
+				"doc":     map[string]interface{}{"_id": id, "_rev": "1-abc"},
+			})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"results":  results,
+			"last_seq": strconv.Itoa(seq),
+			"pending":  230 - seq,
+		})
+	}))
+	defer restore()
+
+	seq, res := ChangesSeq(TestPrefix, TestDoctype, "10")
+	var changes []Change
+	seq(func(change Change) bool {
+		changes = append(changes, change)
+		return true
+	})
+	assert.NoError(t, res.Err())
+	if assert.Len(t, changes, 220) {
+		assert.Equal(t, "doc11", changes[0].DocID)
+		assert.Equal(t, "doc11", changes[0].Doc.ID())
+		assert.Equal(t, "230", changes[219].Seq)
+	}
+	assert.Equal(t, []string{"10", "110", "210"}, sinces)
+
+	// Stopping the loop does not request the next pages
+	sinces = nil
+	seq, res = ChangesSeq(TestPrefix, TestDoctype, "")
+	count := 0
+	seq(func(change Change) bool {
+		count++
+		return count < 5
+	})
+	assert.NoError(t, res.Err())
+	assert.Equal(t, 5, count)
+	assert.Equal(t, []string{""}, sinces)
+}
@@ -0,0 +1,68 @@
+package couchdb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// JSONAPIError is an error object of JSON-API, made from a CouchDB error for
+// the clients of the stack. Its fields are a contract with these clients:
+// they are checked by the golden file testdata/jsonapi_errors.golden.json.
+type JSONAPIError struct {
+	Status string            `json:"status"`
+	Title  string            `json:"title"`
+	Detail string            `json:"detail,omitempty"`
+	Source map[string]string `json:"source,omitempty"`
+}
+
+// JSONAPI returns the JSON-API error object for this error, with the same
+// status, title and sanitized detail as APIError.
+func (e *Error) JSONAPI() JSONAPIError {
+	apiErr := e.APIError()
+	return JSONAPIError{
+		Status: strconv.Itoa(apiErr.Status),
+		Title:  apiErr.Title,
+		Detail: apiErr.Detail,
+		Source: apiErr.Source,
+	}
+}
+
+// JSONAPIErrors returns the JSON-API error objects for an error. An error on
+// the documents of a bulk gives an object per invalid document, with a
+// pointer to it in the source, and the other CouchDB errors give a single
+// object. It returns nil for the errors that are not from CouchDB.
+func JSONAPIErrors(err error) []JSONAPIError {
+	couchErr, ok := IsCouchError(err)
+	if !ok {
+		return nil
+	}
+	var bulkErr *BulkValidationError
+	if !errors.As(err, &bulkErr) || len(bulkErr.Errors) == 0 {
+		return []JSONAPIError{couchErr.JSONAPI()}
+	}
+
+	indexes := make([]int, 0, len(bulkErr.Errors))
+	for i := range bulkErr.Errors {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	objs := make([]JSONAPIError, len(indexes))
+	for j, i := range indexes {
+		rowErr, ok := IsCouchError(bulkErr.Errors[i])
+		if !ok {
+			rowErr = &Error{
+				StatusCode: http.StatusBadRequest,
+				Name:       "invalid_doc",
+				Reason:     bulkErr.Errors[i].Error(),
+			}
+		}
+		obj := rowErr.JSONAPI()
+		// The pointer of the row error, like /_id, is relative to the document
+		obj.Source = map[string]string{"pointer": fmt.Sprintf("/docs/%d%s", i, obj.Source["pointer"])}
+		objs[j] = obj
+	}
+	return objs
+}
@@ -0,0 +1,381 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrProtectedField is the error returned by JSONDoc.Set and JSONDoc.Delete
+// for the fields that can only be changed with SetID, SetRev, or the Type.
+var ErrProtectedField = errors.New("CouchDB: protected field")
+
+// The typed getters of JSONDoc return the zero value when the field is
+// missing or has another type, and their Ok variants also return false in
+// these cases.
+
+// GetString returns the value of a string field.
+func (j *JSONDoc) GetString(key string) string {
+	s, _ := j.GetStringOk(key)
+	return s
+}
+
+// GetStringOk returns the value of a string field.
+func (j *JSONDoc) GetStringOk(key string) (string, bool) {
+	return j.stringField(key)
+}
+
+// GetBool returns the value of a boolean field.
+func (j *JSONDoc) GetBool(key string) bool {
+	b, _ := j.GetBoolOk(key)
+	return b
+}
+
+// GetBoolOk returns the value of a boolean field.
+func (j *JSONDoc) GetBoolOk(key string) (bool, bool) {
+	b, ok := j.Get(key).(bool)
+	return b, ok
+}
+
+// GetInt returns the value of an integer field.
+func (j *JSONDoc) GetInt(key string) int {
+	i, _ := j.GetIntOk(key)
+	return i
+}
+
+// GetIntOk returns the value of an integer field. It returns false if the
+// number has a fractional part, or does not fit in an int.
+func (j *JSONDoc) GetIntOk(key string) (int, bool) {
+	i, ok := j.GetInt64Ok(key)
+	if !ok || int64(int(i)) != i {
+		return 0, false
+	}
+	return int(i), true
+}
+
+// GetInt64 returns the value of an integer field as an int64.
+func (j *JSONDoc) GetInt64(key string) int64 {
+	i, _ := j.GetInt64Ok(key)
+	return i
+}
+
+// GetInt64Ok returns the value of an integer field as an int64. It works
+// with the numbers decoded as json.Number, for the documents fetched from
+// CouchDB, and with the numbers of the documents built in Go code.
+func (j *JSONDoc) GetInt64Ok(key string) (int64, bool) {
+	switch v := j.Get(key).(type) {
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// GetFloat64 returns the value of a number field as a float64.
+func (j *JSONDoc) GetFloat64(key string) float64 {
+	f, _ := j.GetFloat64Ok(key)
+	return f
+}
+
+// GetFloat64Ok returns the value of a number field as a float64.
+func (j *JSONDoc) GetFloat64Ok(key string) (float64, bool) {
+	switch v := j.Get(key).(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// GetTime returns the value of a date field, written in the RFC3339 format.
+func (j *JSONDoc) GetTime(key string) time.Time {
+	t, _ := j.GetTimeOk(key)
+	return t
+}
+
+// GetTimeOk returns the value of a date field, written in the RFC3339
+// format.
+func (j *JSONDoc) GetTimeOk(key string) (time.Time, bool) {
+	s, ok := j.GetStringOk(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func isProtectedField(key string) bool {
+	return key == "_id" || key == "_rev" || key == "_type"
+}
+
+// Set sets the value of a field. The _id, _rev and _type fields are
+// protected, and ErrProtectedField is returned for them.
+func (j *JSONDoc) Set(key string, value interface{}) error {
+	if isProtectedField(key) {
+		return fmt.Errorf("%w: %s", ErrProtectedField, key)
+	}
+	if j.M == nil {
+		j.M = make(map[string]interface{})
+	}
+	j.M[key] = value
+	return nil
+}
+
+// Delete removes a field. The _id, _rev and _type fields are protected, and
+// ErrProtectedField is returned for them.
+func (j *JSONDoc) Delete(key string) error {
+	if isProtectedField(key) {
+		return fmt.Errorf("%w: %s", ErrProtectedField, key)
+	}
+	delete(j.M, key)
+	return nil
+}
+
+// ErrInvalidPath is the error returned by the JSONDoc methods for a nested
+// path that is empty, or that goes through a value that is neither an object
+// nor an array.
+var ErrInvalidPath = errors.New("CouchDB: invalid path")
+
+// The nested paths are written with dots, like "metadata.datetime", and the
+// elements of an array are accessed by their index, like
+// "cozyMetadata.updatedByApps.0.slug". The Slice variants take the segments
+// of the path, for the keys with a dot.
+
+// GetPath returns the value of a nested field, and false if it is missing.
+func (j *JSONDoc) GetPath(path string) (interface{}, bool) {
+	return j.GetPathSlice(splitPath(path))
+}
+
+// GetPathSlice returns the value of a nested field, and false if it is
+// missing.
+func (j *JSONDoc) GetPathSlice(segments []string) (interface{}, bool) {
+	if j == nil || len(segments) == 0 {
+		return nil, false
+	}
+	var cur interface{} = j.M
+	for _, segment := range segments {
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			value, ok := v[segment]
+			if !ok {
+				return nil, false
+			}
+			cur = value
+		case []interface{}:
+			i, ok := arrayIndex(v, segment)
+			if !ok {
+				return nil, false
+			}
+			cur = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// SetPath sets the value of a nested field. The missing objects on the path
+// are created, but not the arrays: an index must be in the array.
+func (j *JSONDoc) SetPath(path string, value interface{}) error {
+	return j.SetPathSlice(splitPath(path), value)
+}
+
+// SetPathSlice sets the value of a nested field, like SetPath.
+func (j *JSONDoc) SetPathSlice(segments []string, value interface{}) error {
+	if len(segments) > 0 && isProtectedField(segments[0]) {
+		return fmt.Errorf("%w: %s", ErrProtectedField, segments[0])
+	}
+	if len(segments) == 1 {
+		return j.Set(segments[0], value)
+	}
+	parent, last, err := j.parentForPath(segments, true)
+	if err != nil {
+		return err
+	}
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[last] = value
+	case []interface{}:
+		i, ok := arrayIndex(p, last)
+		if !ok {
+			return invalidPathError(segments)
+		}
+		p[i] = value
+	}
+	return nil
+}
+
+// DeletePath removes a nested field. It does nothing if the field is
+// missing, and returns an error for an element of an array, as they cannot
+// be removed.
+func (j *JSONDoc) DeletePath(path string) error {
+	return j.DeletePathSlice(splitPath(path))
+}
+
+// DeletePathSlice removes a nested field, like DeletePath.
+func (j *JSONDoc) DeletePathSlice(segments []string) error {
+	if len(segments) > 0 && isProtectedField(segments[0]) {
+		return fmt.Errorf("%w: %s", ErrProtectedField, segments[0])
+	}
+	if len(segments) == 1 {
+		return j.Delete(segments[0])
+	}
+	parent, last, err := j.parentForPath(segments, false)
+	if err != nil || parent == nil {
+		return err
+	}
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		delete(p, last)
+	case []interface{}:
+		return invalidPathError(segments)
+	}
+	return nil
+}
+
+// parentForPath returns the object or array that contains the last segment
+// of the path. When create is true, the missing objects are created;
+// otherwise, nil is returned for a missing parent.
+func (j *JSONDoc) parentForPath(segments []string, create bool) (interface{}, string, error) {
+	if len(segments) == 0 {
+		return nil, "", invalidPathError(segments)
+	}
+	if j.M == nil {
+		if !create {
+			return nil, "", nil
+		}
+		j.M = make(map[string]interface{})
+	}
+	var cur interface{} = j.M
+	for _, segment := range segments[:len(segments)-1] {
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			next := v[segment]
+			if next == nil {
+				if !create {
+					return nil, "", nil
+				}
+				next = make(map[string]interface{})
+				v[segment] = next
+			}
+			cur = next
+		case []interface{}:
+			i, ok := arrayIndex(v, segment)
+			if !ok {
+				if !create {
+					return nil, "", nil
+				}
+				return nil, "", invalidPathError(segments)
+			}
+			cur = v[i]
+		default:
+			return nil, "", invalidPathError(segments)
+		}
+	}
+	switch cur.(type) {
+	case map[string]interface{}, []interface{}:
+		return cur, segments[len(segments)-1], nil
+	}
+	return nil, "", invalidPathError(segments)
+}
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+func arrayIndex(array []interface{}, segment string) (int, bool) {
+	i, err := strconv.Atoi(segment)
+	if err != nil || i < 0 || i >= len(array) {
+		return 0, false
+	}
+	return i, true
+}
+
+func invalidPathError(segments []string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPath, strings.Join(segments, "."))
+}
+
+// reservedKeys are the keys that the stack can put in the map of a JSONDoc,
+// like _type for ToMapWithType, but that are not fields of the document: they
+// are never written to CouchDB.
+var reservedKeys = []string{"_type"}
+
+// withoutReservedKeys returns the map of the document, or a copy of it
+// without the reserved keys if it has some.
+func (j *JSONDoc) withoutReservedKeys() map[string]interface{} {
+	for _, key := range reservedKeys {
+		if _, ok := j.M[key]; ok {
+			m := make(map[string]interface{}, len(j.M))
+			for k, v := range j.M {
+				m[k] = v
+			}
+			for _, reserved := range reservedKeys {
+				delete(m, reserved)
+			}
+			return m
+		}
+	}
+	return j.M
+}
+
+// fetchedJSONDoc is used to fetch a JSONDoc: the doctype is the one of the
+// database, even for the old documents where a _type has been persisted.
+type fetchedJSONDoc struct {
+	doc     *JSONDoc
+	doctype string
+}
+
+func (f *fetchedJSONDoc) decodeResponse(r io.Reader) error {
+	if err := f.doc.decodeResponse(r); err != nil {
+		return err
+	}
+	f.doc.Type = f.doctype
+	return nil
+}
+
+// ToJSONAPI returns a view of the document for the API clients, in the
+// JSON-API style: the identifier, the revision and the doctype are given as
+// id, meta.rev and type, and the other fields are the attributes.
+func (j *JSONDoc) ToJSONAPI() map[string]interface{} {
+	attrs := make(map[string]interface{}, len(j.M))
+	for k, v := range j.withoutReservedKeys() {
+		if k != "_id" && k != "_rev" {
+			attrs[k] = v
+		}
+	}
+	obj := map[string]interface{}{
+		"type":       j.DocType(),
+		"id":         j.ID(),
+		"attributes": attrs,
+	}
+	if rev := j.Rev(); rev != "" {
+		obj["meta"] = map[string]interface{}{"rev": rev}
+	}
+	return obj
+}
@@ -0,0 +1,271 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONDocGetters(t *testing.T) {
+	const data = `{
+		"_id": "foo",
+		"string": "bar",
+		"empty": "",
+		"true": true,
+		"false": false,
+		"int": 42,
+		"negative": -7,
+		"float": 1.5,
+		"big": 9007199254740993,
+		"huge": 1e300,
+		"date": "2021-03-04T05:06:07.89Z",
+		"offset": "2021-03-04T06:06:07+01:00",
+		"not_a_date": "yesterday",
+		"null": null,
+		"object": {"a": 1},
+		"array": [1, 2]
+	}`
+	date := time.Date(2021, 3, 4, 5, 6, 7, 890000000, time.UTC)
+
+	type expected struct {
+		str   string
+		strOk bool
+		b     bool
+		bOk   bool
+		i     int
+		iOk   bool
+		f     float64
+		fOk   bool
+		tm    time.Time
+		tmOk  bool
+	}
+	cases := map[string]expected{
+		"string":     {str: "bar", strOk: true},
+		"empty":      {strOk: true},
+		"true":       {b: true, bOk: true},
+		"false":      {bOk: true},
+		"int":        {i: 42, iOk: true, f: 42, fOk: true},
+		"negative":   {i: -7, iOk: true, f: -7, fOk: true},
+		"float":      {f: 1.5, fOk: true},
+		"huge":       {f: 1e300, fOk: true},
+		"date":       {str: "2021-03-04T05:06:07.89Z", strOk: true, tm: date, tmOk: true},
+		"not_a_date": {str: "yesterday", strOk: true},
+		"null":       {},
+		"object":     {},
+		"array":      {},
+		"missing":    {},
+	}
+
+	// The documents fetched from CouchDB have json.Number, and the others
+	// float64
+	fetched := &JSONDoc{}
+	assert.NoError(t, fetched.decodeResponse(strings.NewReader(data)))
+	unmarshaled := &JSONDoc{}
+	assert.NoError(t, json.Unmarshal([]byte(data), unmarshaled))
+
+	for name, doc := range map[string]*JSONDoc{"fetched": fetched, "unmarshaled": unmarshaled} {
+		for key, c := range cases {
+			msg := name + " " + key
+			str, ok := doc.GetStringOk(key)
+			assert.Equal(t, c.str, str, msg)
+			assert.Equal(t, c.strOk, ok, msg)
+			assert.Equal(t, c.str, doc.GetString(key), msg)
+
+			b, ok := doc.GetBoolOk(key)
+			assert.Equal(t, c.b, b, msg)
+			assert.Equal(t, c.bOk, ok, msg)
+			assert.Equal(t, c.b, doc.GetBool(key), msg)
+
+			i, ok := doc.GetIntOk(key)
+			assert.Equal(t, c.i, i, msg)
+			assert.Equal(t, c.iOk, ok, msg)
+			assert.Equal(t, c.i, doc.GetInt(key), msg)
+
+			f, ok := doc.GetFloat64Ok(key)
+			assert.Equal(t, c.f, f, msg)
+			assert.Equal(t, c.fOk, ok, msg)
+			assert.Equal(t, c.f, doc.GetFloat64(key), msg)
+
+			tm, ok := doc.GetTimeOk(key)
+			assert.True(t, c.tm.Equal(tm), msg)
+			assert.Equal(t, c.tmOk, ok, msg)
+			assert.True(t, c.tm.Equal(doc.GetTime(key)), msg)
+		}
+	}
+
+	// The big integers are only exact with json.Number
+	big, ok := fetched.GetInt64Ok("big")
+	assert.True(t, ok)
+	assert.EqualValues(t, 9007199254740993, big)
+	big, ok = unmarshaled.GetInt64Ok("big")
+	assert.True(t, ok)
+	assert.EqualValues(t, 9007199254740992, big)
+	_, ok = fetched.GetInt64Ok("huge")
+	assert.False(t, ok)
+	_, ok = unmarshaled.GetInt64Ok("huge")
+	assert.False(t, ok)
+
+	offset, ok := fetched.GetTimeOk("offset")
+	assert.True(t, ok)
+	assert.True(t, date.Truncate(time.Second).Equal(offset))
+
+	// The documents built in Go code
+	built := &JSONDoc{M: map[string]interface{}{"int": 3, "int64": int64(4)}}
+	assert.Equal(t, 3, built.GetInt("int"))
+	assert.Equal(t, 4, built.GetInt("int64"))
+	assert.Equal(t, 3.0, built.GetFloat64("int"))
+	var nilDoc *JSONDoc
+	assert.Equal(t, "", nilDoc.GetString("string"))
+	assert.Equal(t, 0, nilDoc.GetInt("int"))
+}
+
+func TestJSONDocSetters(t *testing.T) {
+	doc := &JSONDoc{Type: TestDoctype}
+	assert.NoError(t, doc.Set("name", "foo"))
+	assert.Equal(t, "foo", doc.GetString("name"))
+	assert.NoError(t, doc.Delete("name"))
+	_, ok := doc.GetStringOk("name")
+	assert.False(t, ok)
+
+	doc.SetID("foo")
+	doc.SetRev("1-abc")
+	for _, key := range []string{"_id", "_rev", "_type"} {
+		assert.True(t, errors.Is(doc.Set(key, "bar"), ErrProtectedField), key)
+		assert.True(t, errors.Is(doc.Delete(key), ErrProtectedField), key)
+	}
+	assert.Equal(t, "foo", doc.ID())
+	assert.Equal(t, "1-abc", doc.Rev())
+	assert.Equal(t, TestDoctype, doc.DocType())
+}
+
+func TestJSONDocPaths(t *testing.T) {
+	doc := &JSONDoc{}
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"_id": "foo",
+		"metadata": {"datetime": "2021-03-04T05:06:07Z", "gps": null},
+		"cozyMetadata": {"updatedByApps": [{"slug": "drive"}, {"slug": "photos"}]},
+		"dotted": {"a.b": 1},
+		"name": "bar"
+	}`), doc))
+
+	get := func(path string) interface{} {
+		value, ok := doc.GetPath(path)
+		if !ok {
+			return "<missing>"
+		}
+		return value
+	}
+	assert.Equal(t, "2021-03-04T05:06:07Z", get("metadata.datetime"))
+	assert.Equal(t, "photos", get("cozyMetadata.updatedByApps.1.slug"))
+	assert.Equal(t, "bar", get("name"))
+	assert.Nil(t, get("metadata.gps"))
+	assert.Equal(t, "<missing>", get("metadata.gps.lat"))
+	assert.Equal(t, "<missing>", get("metadata.missing"))
+	assert.Equal(t, "<missing>", get("cozyMetadata.updatedByApps.2.slug"))
+	assert.Equal(t, "<missing>", get("cozyMetadata.updatedByApps.-1.slug"))
+	assert.Equal(t, "<missing>", get("cozyMetadata.updatedByApps.slug"))
+	assert.Equal(t, "<missing>", get("name.first"))
+	assert.Equal(t, "<missing>", get("dotted.a.b"))
+	assert.Equal(t, "<missing>", get(""))
+	value, ok := doc.GetPathSlice([]string{"dotted", "a.b"})
+	assert.True(t, ok)
+	assert.EqualValues(t, 1, value)
+	_, ok = doc.GetPathSlice(nil)
+	assert.False(t, ok)
+	var nilDoc *JSONDoc
+	_, ok = nilDoc.GetPath("name")
+	assert.False(t, ok)
+
+	// The missing and null objects are created
+	assert.NoError(t, doc.SetPath("metadata.gps.lat", 1.5))
+	assert.Equal(t, 1.5, get("metadata.gps.lat"))
+	assert.NoError(t, doc.SetPath("a.b.c", true))
+	assert.Equal(t, true, get("a.b.c"))
+	assert.NoError(t, doc.SetPath("cozyMetadata.updatedByApps.0.slug", "notes"))
+	assert.Equal(t, "notes", get("cozyMetadata.updatedByApps.0.slug"))
+	assert.NoError(t, doc.SetPath("cozyMetadata.updatedByApps.1", "store"))
+	assert.Equal(t, "store", get("cozyMetadata.updatedByApps.1"))
+	assert.NoError(t, doc.SetPathSlice([]string{"dotted", "c.d"}, 2))
+	assert.Equal(t, 2, doc.M["dotted"].(map[string]interface{})["c.d"])
+	assert.NoError(t, doc.SetPath("top", "level"))
+	assert.Equal(t, "level", get("top"))
+
+	// But not the arrays, and the other values are not replaced
+	for _, path := range []string{
+		"",
+		"cozyMetadata.updatedByApps.2.slug",
+		"cozyMetadata.updatedByApps.2",
+		"cozyMetadata.updatedByApps.foo",
+		"name.first",
+		"a.b.c.d",
+	} {
+		err := doc.SetPath(path, "x")
+		assert.True(t, errors.Is(err, ErrInvalidPath), path)
+	}
+	assert.Equal(t, "bar", get("name"))
+	for _, path := range []string{"_id", "_id.foo", "_rev", "_type.foo"} {
+		assert.True(t, errors.Is(doc.SetPath(path, "x"), ErrProtectedField), path)
+		assert.True(t, errors.Is(doc.DeletePath(path), ErrProtectedField), path)
+	}
+	assert.Equal(t, "foo", doc.ID())
+
+	assert.NoError(t, doc.DeletePath("metadata.gps.lat"))
+	assert.Equal(t, "<missing>", get("metadata.gps.lat"))
+	assert.NotNil(t, get("metadata.gps"))
+	assert.NoError(t, doc.DeletePathSlice([]string{"dotted", "a.b"}))
+	assert.Equal(t, "<missing>", get("dotted.a.b"))
+	assert.NoError(t, doc.DeletePath("top"))
+	assert.Equal(t, "<missing>", get("top"))
+	// Deleting a missing field does nothing
+	assert.NoError(t, doc.DeletePath("metadata.missing.field"))
+	assert.NoError(t, doc.DeletePath("cozyMetadata.updatedByApps.5.slug"))
+	assert.NoError(t, (&JSONDoc{}).DeletePath("a.b"))
+	// The elements of an array cannot be deleted
+	assert.True(t, errors.Is(doc.DeletePath("cozyMetadata.updatedByApps.0"), ErrInvalidPath))
+	assert.True(t, errors.Is(doc.DeletePath("name.first"), ErrInvalidPath))
+	assert.True(t, errors.Is(doc.DeletePath(""), ErrInvalidPath))
+}
+
+func TestJSONDocReservedKeys(t *testing.T) {
+	var sent map[string]interface{}
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// An old document, where the _type has been persisted
+			_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc","_type":"io.cozy.old","name":"bar"}`))
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		_, _ = w.Write([]byte(`{"ok":true,"id":"foo","rev":"2-abc"}`))
+	}))
+	defer restore()
+
+	doc := &JSONDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", doc))
+	assert.Equal(t, TestDoctype, doc.DocType())
+	assert.Equal(t, "bar", doc.GetString("name"))
+
+	// The _type added for the API responses is not persisted
+	out := doc.ToMapWithType()
+	assert.Equal(t, TestDoctype, out["_type"])
+	assert.NoError(t, UpdateDocWithOld(TestPrefix, doc, doc.Clone()))
+	assert.Equal(t, map[string]interface{}{"_id": "foo", "_rev": "1-abc", "name": "bar"}, sent)
+
+	data, err := json.Marshal(doc)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"_id":"foo","_rev":"2-abc","name":"bar"}`, string(data))
+
+	assert.Equal(t, map[string]interface{}{
+		"type":       TestDoctype,
+		"id":         "foo",
+		"attributes": map[string]interface{}{"name": "bar"},
+		"meta":       map[string]interface{}{"rev": "2-abc"},
+	}, doc.ToJSONAPI())
+	created := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"name": "baz"}}
+	_, hasMeta := created.ToJSONAPI()["meta"]
+	assert.False(t, hasMeta)
+}
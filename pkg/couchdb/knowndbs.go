@@ -0,0 +1,129 @@
+package couchdb
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultKnownDBsSize is the number of databases remembered as existing by a
+// process, when SetKnownDBsSize has not been called.
+const DefaultKnownDBsSize = 100000
+
+// knownDBs is the set of the databases that are known to exist, as a request
+// on them has succeeded. It is a LRU bounded by a number of databases, for
+// the processes that serve many instances.
+type knownDBs struct {
+	mu    sync.Mutex
+	size  int
+	lru   *list.List
+	names map[string]*list.Element
+	// group deduplicates the concurrent creations of a database
+	group singleflight.Group
+}
+
+var theKnownDBs = newKnownDBs(DefaultKnownDBsSize)
+
+func newKnownDBs(size int) *knownDBs {
+	return &knownDBs{
+		size:  size,
+		lru:   list.New(),
+		names: make(map[string]*list.Element),
+	}
+}
+
+// SetKnownDBsSize sets the maximal number of databases remembered as
+// existing, and forgets the current ones. A size of zero disables it: the
+// existence of the databases is then checked with CouchDB each time.
+func SetKnownDBsSize(size int) {
+	theKnownDBs.mu.Lock()
+	defer theKnownDBs.mu.Unlock()
+	theKnownDBs.size = size
+	theKnownDBs.lru.Init()
+	theKnownDBs.names = make(map[string]*list.Element)
+}
+
+func (k *knownDBs) has(dbname string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	elem, ok := k.names[dbname]
+	if ok {
+		k.lru.MoveToFront(elem)
+	}
+	return ok
+}
+
+func (k *knownDBs) add(dbname string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if elem, ok := k.names[dbname]; ok {
+		k.lru.MoveToFront(elem)
+		return
+	}
+	if k.size <= 0 {
+		return
+	}
+	k.names[dbname] = k.lru.PushFront(dbname)
+	for k.lru.Len() > k.size {
+		delete(k.names, k.lru.Remove(k.lru.Back()).(string))
+	}
+}
+
+func (k *knownDBs) forget(dbname string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if elem, ok := k.names[dbname]; ok {
+		k.lru.Remove(elem)
+		delete(k.names, dbname)
+	}
+}
+
+// trackKnownDB is called by makeRequest with the result of a request on a
+// database: a success means that the database exists, except for its
+// deletion, and a no_db_file error that it does not exist anymore.
+func trackKnownDB(db Database, doctype, method, path string, err error) {
+	dbname := makeDBName(db, doctype)
+	switch {
+	case err == nil && method == http.MethodDelete && path == "":
+		theKnownDBs.forget(dbname)
+	case err == nil:
+		theKnownDBs.add(dbname)
+	case IsNoDatabaseError(err):
+		theKnownDBs.forget(dbname)
+	}
+}
+
+// isKnownDB returns true if the database for the doctype is known to exist.
+func isKnownDB(db Database, doctype string) bool {
+	return theKnownDBs.has(makeDBName(db, doctype))
+}
+
+// createDBOnce creates the database for the doctype, if it is not known to
+// exist. The concurrent calls for the same database send only one request to
+// CouchDB, with the context of the first caller, and the waiting goroutines
+// share its result. A database created by another process in the meantime is
+// not an error. The indexes required by the doctype are defined after the
+// creation of the database, before the waiting goroutines are released.
+func createDBOnce(ctx context.Context, db Database, doctype string) error {
+	if isKnownDB(db, doctype) {
+		return nil
+	}
+	dbname := makeDBName(db, doctype)
+	ch := theKnownDBs.group.DoChan(dbname, func() (interface{}, error) {
+		err := CreateDBContext(ctx, db, doctype)
+		if IsFileExists(err) {
+			theKnownDBs.add(dbname)
+			err = nil
+		}
+		return nil, err
+	})
+	select {
+	case res := <-ch:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,133 @@
+package couchdb
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dbServer is a fake CouchDB for a database that may not exist, and that
+// counts the requests by method.
+type dbServer struct {
+	mu       sync.Mutex
+	exists   bool
+	requests map[string]int
+}
+
+func (s *dbServer) count(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+func (s *dbServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.requests == nil {
+		s.requests = make(map[string]int)
+	}
+	s.requests[r.Method]++
+	onDB := !strings.Contains(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	noDB := `{"error":"not_found","reason":"Database does not exist."}`
+	switch {
+	case r.Method == http.MethodPut && onDB:
+		if s.exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = w.Write([]byte(`{"error":"file_exists","reason":"The database could not be created, the file already exists."}`))
+			return
+		}
+		// Let the concurrent writers fail on the missing database
+		time.Sleep(20 * time.Millisecond)
+		s.exists = true
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	case r.Method == http.MethodDelete && onDB:
+		s.exists = false
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	case !s.exists:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(noDB))
+	case r.Method == http.MethodGet && onDB:
+		_, _ = w.Write([]byte(`{"db_name":"test","doc_count":0}`))
+	case r.Method == http.MethodPost && onDB:
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"ok":true,"id":"abc","rev":"1-abc"}`))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCreateDocCreatesTheDBOnce(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := &dbServer{}
+	restore := useTestServer(t, server)
+	defer restore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, CreateDoc(TestPrefix, &testDoc{Test: "concurrent"}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, server.count(http.MethodPut))
+
+	// The database is known to exist now
+	posts := server.count(http.MethodPost)
+	assert.NoError(t, CreateDoc(TestPrefix, &testDoc{Test: "known"}))
+	assert.Equal(t, posts+1, server.count(http.MethodPost))
+	assert.NoError(t, EnsureDBExist(TestPrefix, TestDoctype))
+	assert.Equal(t, 0, server.count(http.MethodGet))
+}
+
+func TestKnownDBsInvalidation(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := &dbServer{exists: true}
+	restore := useTestServer(t, server)
+	defer restore()
+
+	assert.NoError(t, EnsureDBExist(TestPrefix, TestDoctype))
+	assert.NoError(t, EnsureDBExist(TestPrefix, TestDoctype))
+	assert.Equal(t, 1, server.count(http.MethodGet))
+
+	// A deletion by this process
+	assert.NoError(t, DeleteDB(TestPrefix, TestDoctype))
+	assert.False(t, isKnownDB(TestPrefix, TestDoctype))
+	assert.NoError(t, EnsureDBExist(TestPrefix, TestDoctype))
+	assert.Equal(t, 2, server.count(http.MethodGet))
+	assert.Equal(t, 1, server.count(http.MethodPut))
+	assert.True(t, isKnownDB(TestPrefix, TestDoctype))
+
+	assert.NoError(t, ResetDB(TestPrefix, TestDoctype))
+	assert.True(t, isKnownDB(TestPrefix, TestDoctype))
+
+	// A deletion by another process is seen on the next request
+	server.mu.Lock()
+	server.exists = false
+	server.mu.Unlock()
+	assert.NoError(t, CreateDoc(TestPrefix, &testDoc{Test: "recreated"}))
+	assert.Equal(t, 3, server.count(http.MethodPut))
+}
+
+func TestKnownDBsBounded(t *testing.T) {
+	k := newKnownDBs(2)
+	k.add("a")
+	k.add("b")
+	assert.True(t, k.has("a"))
+	k.add("c")
+	assert.True(t, k.has("a"))
+	assert.False(t, k.has("b"))
+	assert.True(t, k.has("c"))
+	k.forget("a")
+	assert.False(t, k.has("a"))
+
+	k = newKnownDBs(0)
+	k.add("a")
+	assert.False(t, k.has("a"))
+}
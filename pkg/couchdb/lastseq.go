@@ -0,0 +1,94 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Seq is a sequence number of a CouchDB database, as used by the changes
+// feeds. It was an integer with CouchDB 1.x, and it is an opaque string since
+// CouchDB 2.0: both are decoded to a Seq, and the zero Seq means the
+// beginning of the database.
+type Seq string
+
+// IsZero returns true for the sequence of the beginning of a database.
+func (s Seq) IsZero() bool {
+	return s == "" || s == "0"
+}
+
+// String returns the sequence as it can be given to the since parameter of
+// a changes feed.
+func (s Seq) String() string {
+	if s == "" {
+		return "0"
+	}
+	return string(s)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (s *Seq) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+		*s = Seq(str)
+		return nil
+	}
+	if bytes.Equal(data, []byte("null")) {
+		*s = ""
+		return nil
+	}
+	var num json.Number
+	if err := json.Unmarshal(data, &num); err != nil {
+		return err
+	}
+	*s = Seq(num.String())
+	return nil
+}
+
+// LastSeqInfo is the last sequence of a database, with its number of
+// documents at this sequence.
+type LastSeqInfo struct {
+	Seq      Seq `json:"update_seq"`
+	DocCount int `json:"doc_count"`
+}
+
+// GetLastSeq calls GetLastSeqContext with a background context.
+func GetLastSeq(db Database, doctype string) (Seq, error) {
+	return GetLastSeqContext(context.Background(), db, doctype)
+}
+
+// GetLastSeqContext returns the last sequence of the database for the given
+// doctype. The zero Seq is returned, without error, if the database does not
+// exist, so that a changes feed can start from it.
+func GetLastSeqContext(ctx context.Context, db Database, doctype string) (Seq, error) {
+	info, err := GetLastSeqInfoContext(ctx, db, doctype)
+	if err != nil {
+		return "", err
+	}
+	return info.Seq, nil
+}
+
+// GetLastSeqInfo calls GetLastSeqInfoContext with a background context.
+func GetLastSeqInfo(db Database, doctype string) (*LastSeqInfo, error) {
+	return GetLastSeqInfoContext(context.Background(), db, doctype)
+}
+
+// GetLastSeqInfoContext is like GetLastSeqContext, but it also returns the
+// number of documents of the database. They are read with the same request,
+// and so the count is consistent with the sequence.
+func GetLastSeqInfoContext(ctx context.Context, db Database, doctype string) (*LastSeqInfo, error) {
+	var info LastSeqInfo
+	err := makeRequest(ctx, db, doctype, http.MethodGet, "", nil, &info)
+	if IsNoDatabaseError(err) {
+		return &LastSeqInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
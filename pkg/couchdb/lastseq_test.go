@@ -0,0 +1,68 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeqUnmarshalJSON(t *testing.T) {
+	cases := []struct {
+		json string
+		seq  Seq
+	}{
+		{`42`, "42"},
+		{`0`, "0"},
+		{`"12-g1AAAAFTeJzLYWBg4MhgTmHgz8tPSTV0MDQy"`, "12-g1AAAAFTeJzLYWBg4MhgTmHgz8tPSTV0MDQy"},
+		{`null`, ""},
+	}
+	for _, c := range cases {
+		var seq Seq
+		assert.NoError(t, json.Unmarshal([]byte(c.json), &seq))
+		assert.Equal(t, c.seq, seq)
+	}
+	var seq Seq
+	assert.Error(t, json.Unmarshal([]byte(`{}`), &seq))
+
+	assert.True(t, Seq("").IsZero())
+	assert.True(t, Seq("0").IsZero())
+	assert.False(t, Seq("12-g1AAAA").IsZero())
+	assert.Equal(t, "0", Seq("").String())
+}
+
+func TestGetLastSeq(t *testing.T) {
+	body := `{"db_name":"db","update_seq":"12-g1AAAA","doc_count":7}`
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body == "" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"Database does not exist."}`))
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer restore()
+
+	seq, err := GetLastSeq(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.Equal(t, Seq("12-g1AAAA"), seq)
+	info, err := GetLastSeqInfo(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.Equal(t, &LastSeqInfo{Seq: "12-g1AAAA", DocCount: 7}, info)
+
+	// CouchDB 1.x
+	body = `{"db_name":"db","update_seq":42,"doc_count":3}`
+	info, err = GetLastSeqInfo(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.Equal(t, &LastSeqInfo{Seq: "42", DocCount: 3}, info)
+
+	// A missing database is at the beginning
+	body = ""
+	seq, err = GetLastSeq(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.True(t, seq.IsZero())
+	info, err = GetLastSeqInfo(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, info.DocCount)
+}
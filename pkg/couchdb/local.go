@@ -1,35 +1,63 @@
 package couchdb
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 )
 
-// GetLocal fetch a local document from CouchDB
-// http://docs.couchdb.org/en/stable/api/local.html#get--db-_local-docid
+// GetLocal calls GetLocalContext with a background context. It is kept for
+// compatibility, new code should use GetLocalContext.
+//
+// Deprecated: use GetLocalContext.
 func GetLocal(db Database, doctype, id string) (map[string]interface{}, error) {
+	return GetLocalContext(context.Background(), db, doctype, id)
+}
+
+// GetLocalContext fetch a local document from CouchDB
+// http://docs.couchdb.org/en/stable/api/local.html#get--db-_local-docid
+func GetLocalContext(ctx context.Context, db Database, doctype, id string) (map[string]interface{}, error) {
 	var out map[string]interface{}
 	u := "_local/" + url.PathEscape(id)
-	if err := makeRequest(db, doctype, http.MethodGet, u, nil, &out); err != nil {
+	if err := makeRequest(ctx, db, doctype, http.MethodGet, u, nil, &out); err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-// PutLocal will put a local document in CouchDB.
-// Note that you should put the last revision in `doc` to avoid conflicts.
+// PutLocal calls PutLocalContext with a background context. It is kept for
+// compatibility, new code should use PutLocalContext.
+//
+// Deprecated: use PutLocalContext.
 func PutLocal(db Database, doctype, id string, doc map[string]interface{}) error {
+	return PutLocalContext(context.Background(), db, doctype, id, doc)
+}
+
+// PutLocalContext will put a local document in CouchDB.
+// Note that you should put the last revision in `doc` to avoid conflicts.
+func PutLocalContext(ctx context.Context, db Database, doctype, id string, doc map[string]interface{}) error {
 	u := "_local/" + url.PathEscape(id)
 	var out UpdateResponse
-	if err := makeRequest(db, doctype, http.MethodPut, u, doc, &out); err != nil {
+	if err := makeRequest(ctx, db, doctype, http.MethodPut, u, doc, &out); err != nil {
+		return err
+	}
+	if err := out.check(); err != nil {
 		return err
 	}
 	doc["_rev"] = out.Rev
-	return nil
+	return checkAccepted(db, doctype, &out)
 }
 
-// DeleteLocal will delete a local document in CouchDB.
+// DeleteLocal calls DeleteLocalContext with a background context. It is kept
+// for compatibility, new code should use DeleteLocalContext.
+//
+// Deprecated: use DeleteLocalContext.
 func DeleteLocal(db Database, doctype, id string) error {
+	return DeleteLocalContext(context.Background(), db, doctype, id)
+}
+
+// DeleteLocalContext will delete a local document in CouchDB.
+func DeleteLocalContext(ctx context.Context, db Database, doctype, id string) error {
 	u := "_local/" + url.PathEscape(id)
-	return makeRequest(db, doctype, http.MethodDelete, u, nil, nil)
+	return makeRequest(ctx, db, doctype, http.MethodDelete, u, nil, nil)
 }
@@ -0,0 +1,68 @@
+package couchdb
+
+import (
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is the interface of the logs written by the couchdb package for the
+// requests made to CouchDB. It is implemented by *logrus.Entry.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// LoggerFunc returns the logger to use for the requests on a database.
+type LoggerFunc func(db Database) Logger
+
+var loggerFunc LoggerFunc = defaultLogger
+
+// SetLogger sets the function that returns the logger for the requests on a
+// database. By default, the logger of the stack is used, with the domain of
+// the instance. A nil function disables the logs.
+func SetLogger(fn LoggerFunc) {
+	loggerFunc = fn
+}
+
+func defaultLogger(db Database) Logger {
+	return logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb")
+}
+
+// loggerFor returns the logger for the requests on the given database.
+func loggerFor(db Database) Logger {
+	if loggerFunc == nil {
+		return nopLogger{}
+	}
+	return loggerFunc(db)
+}
+
+// isDebug returns true if the debug logs are not discarded by the logger,
+// to avoid formatting them for nothing.
+func isDebug(log Logger) bool {
+	switch l := log.(type) {
+	case nopLogger:
+		return false
+	case *logrus.Entry:
+		return logger.IsDebug(l)
+	}
+	return true
+}
+
+// logBodies returns true if the bodies of the requests and responses should
+// be logged, in addition to the method, path, status and duration. They are
+// never logged for the redacted doctypes, like the accounts.
+func logBodies(log Logger, doctype string) bool {
+	return config.GetConfig().CouchDB.LogBodies &&
+		!isRedactedDoctype(doctype) &&
+		isDebug(log)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
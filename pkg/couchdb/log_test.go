@@ -0,0 +1,58 @@
+package couchdb
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *recordLogger) record(level, format string, args ...interface{}) {
+	r.mu.Lock()
+	r.lines = append(r.lines, level+" "+fmt.Sprintf(format, args...))
+	r.mu.Unlock()
+}
+
+func (r *recordLogger) Debugf(format string, args ...interface{}) { r.record("debug", format, args...) }
+func (r *recordLogger) Infof(format string, args ...interface{})  { r.record("info", format, args...) }
+func (r *recordLogger) Warnf(format string, args ...interface{})  { r.record("warn", format, args...) }
+func (r *recordLogger) Errorf(format string, args ...interface{}) { r.record("error", format, args...) }
+
+func (r *recordLogger) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.lines, "\n")
+}
+
+func TestLogger(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc","note":"private"}`))
+	}))
+	defer restore()
+	defer SetLogger(defaultLogger)
+
+	rec := &recordLogger{}
+	SetLogger(func(db Database) Logger { return rec })
+	var doc JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &doc))
+	assert.Contains(t, rec.String(), "debug GET ")
+	assert.Contains(t, rec.String(), "/foo 200 (")
+	assert.NotContains(t, rec.String(), "private")
+
+	rec = &recordLogger{}
+	config.GetConfig().CouchDB.LogBodies = true
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &doc))
+	assert.Contains(t, rec.String(), "private")
+
+	SetLogger(nil)
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &doc))
+}
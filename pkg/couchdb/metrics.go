@@ -0,0 +1,228 @@
+package couchdb
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The kinds of errors reported to the MetricsCollector.
+const (
+	// ErrorKindRequest is for the requests that cannot be built
+	ErrorKindRequest = "request"
+	// ErrorKindConnection is for the requests that have failed before a
+	// response was received (connection refused, timeout, etc.)
+	ErrorKindConnection = "connection"
+	// ErrorKindCouchDB is for the responses with an error status code
+	ErrorKindCouchDB = "couchdb"
+	// ErrorKindRead is for the responses whose body cannot be read
+	ErrorKindRead = "read"
+	// ErrorKindDecode is for the responses that are not valid JSON
+	ErrorKindDecode = "decode"
+	// ErrorKindRateLimited is for the requests not sent because of the rate
+	// limiting
+	ErrorKindRateLimited = "rate_limited"
+	// ErrorKindCircuitOpen is for the requests not sent because the circuit
+	// breaker is open
+	ErrorKindCircuitOpen = "circuit_open"
+	// ErrorKindTooManyRequests is for the requests not sent because too many
+	// requests were in flight
+	ErrorKindTooManyRequests = "too_many_requests"
+)
+
+// MetricsCollector is the interface for instrumenting the requests made to
+// CouchDB. The doctype is given without the prefix of the instance, to keep
+// the cardinality low, and is empty for the requests not made on a database.
+type MetricsCollector interface {
+	// ObserveRequest is called once for each request sent to CouchDB, with
+	// the status of the last attempt (0 if no response has been received),
+	// and the duration of all the attempts.
+	ObserveRequest(method, doctype string, status int, duration time.Duration)
+	// ObserveRetry is called each time a request is retried.
+	ObserveRetry(method, doctype string)
+	// ObserveError is called once for each request that has failed.
+	ObserveError(kind string)
+}
+
+// FeedMetricsCollector can be implemented by a MetricsCollector to also
+// observe the streaming requests, like the changes feeds made with an idle
+// timeout, while they are open.
+type FeedMetricsCollector interface {
+	ObserveFeedOpened(doctype string)
+	ObserveFeedClosed(doctype string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveRequest(method, doctype string, status int, duration time.Duration) {}
+func (nopMetrics) ObserveRetry(method, doctype string)                                       {}
+func (nopMetrics) ObserveError(kind string)                                                  {}
+
+var metricsCollector MetricsCollector = nopMetrics{}
+
+// SetMetricsCollector sets the collector called for the requests made to
+// CouchDB. A nil collector disables the metrics.
+func SetMetricsCollector(collector MetricsCollector) {
+	if collector == nil {
+		collector = nopMetrics{}
+	}
+	metricsCollector = collector
+}
+
+// observeFeed reports the opening of a streaming request to the collector, if
+// it is interested, and returns a function to call when the feed is closed.
+func observeFeed(doctype string) func() {
+	collector, ok := metricsCollector.(FeedMetricsCollector)
+	if !ok {
+		return func() {}
+	}
+	collector.ObserveFeedOpened(doctype)
+	return func() { collector.ObserveFeedClosed(doctype) }
+}
+
+// maxSamples is the number of durations kept by MemoryMetrics for each
+// method and doctype, to compute the percentiles.
+const maxSamples = 1000
+
+// MemoryMetrics is a MetricsCollector that keeps the metrics in memory, with
+// counters and percentiles on a sample of the last durations. It is meant
+// for debugging.
+type MemoryMetrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]*requestStats
+	retries  map[requestKey]int64
+	errors   map[string]int64
+}
+
+type requestKey struct {
+	method  string
+	doctype string
+}
+
+type requestStats struct {
+	count    int64
+	statuses map[int]int64
+	samples  []time.Duration
+	next     int
+}
+
+// NewMemoryMetrics returns a new MemoryMetrics.
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{
+		requests: make(map[requestKey]*requestStats),
+		retries:  make(map[requestKey]int64),
+		errors:   make(map[string]int64),
+	}
+}
+
+// ObserveRequest is part of the MetricsCollector interface.
+func (m *MemoryMetrics) ObserveRequest(method, doctype string, status int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := requestKey{method, doctype}
+	stats, ok := m.requests[key]
+	if !ok {
+		stats = &requestStats{statuses: make(map[int]int64)}
+		m.requests[key] = stats
+	}
+	stats.count++
+	stats.statuses[status]++
+	if len(stats.samples) < maxSamples {
+		stats.samples = append(stats.samples, duration)
+	} else {
+		stats.samples[stats.next] = duration
+		stats.next = (stats.next + 1) % maxSamples
+	}
+}
+
+// ObserveRetry is part of the MetricsCollector interface.
+func (m *MemoryMetrics) ObserveRetry(method, doctype string) {
+	m.mu.Lock()
+	m.retries[requestKey{method, doctype}]++
+	m.mu.Unlock()
+}
+
+// ObserveError is part of the MetricsCollector interface.
+func (m *MemoryMetrics) ObserveError(kind string) {
+	m.mu.Lock()
+	m.errors[kind]++
+	m.mu.Unlock()
+}
+
+// RequestMetrics are the metrics for the requests with a method on a doctype.
+type RequestMetrics struct {
+	Method   string        `json:"method"`
+	Doctype  string        `json:"doctype"`
+	Count    int64         `json:"count"`
+	Statuses map[int]int64 `json:"statuses"`
+	Retries  int64         `json:"retries"`
+	P50      time.Duration `json:"p50"`
+	P90      time.Duration `json:"p90"`
+	P99      time.Duration `json:"p99"`
+}
+
+// MetricsSnapshot is a copy of the metrics collected by MemoryMetrics.
+type MetricsSnapshot struct {
+	Requests []RequestMetrics `json:"requests"`
+	Errors   map[string]int64 `json:"errors"`
+}
+
+// Snapshot returns a copy of the current metrics.
+func (m *MemoryMetrics) Snapshot() *MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := &MetricsSnapshot{Errors: make(map[string]int64, len(m.errors))}
+	for kind, count := range m.errors {
+		snap.Errors[kind] = count
+	}
+	keys := make(map[requestKey]bool)
+	for key := range m.requests {
+		keys[key] = true
+	}
+	for key := range m.retries {
+		keys[key] = true
+	}
+	for key := range keys {
+		rm := RequestMetrics{
+			Method:   key.method,
+			Doctype:  key.doctype,
+			Statuses: make(map[int]int64),
+			Retries:  m.retries[key],
+		}
+		if stats, ok := m.requests[key]; ok {
+			rm.Count = stats.count
+			for status, count := range stats.statuses {
+				rm.Statuses[status] = count
+			}
+			samples := make([]time.Duration, len(stats.samples))
+			copy(samples, stats.samples)
+			sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+			rm.P50 = percentile(samples, 0.5)
+			rm.P90 = percentile(samples, 0.9)
+			rm.P99 = percentile(samples, 0.99)
+		}
+		snap.Requests = append(snap.Requests, rm)
+	}
+	sort.Slice(snap.Requests, func(i, j int) bool {
+		if snap.Requests[i].Doctype != snap.Requests[j].Doctype {
+			return snap.Requests[i].Doctype < snap.Requests[j].Doctype
+		}
+		return snap.Requests[i].Method < snap.Requests[j].Method
+	})
+	return snap
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
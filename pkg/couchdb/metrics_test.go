@@ -0,0 +1,92 @@
+package couchdb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsCollector(t *testing.T) {
+	var calls int32
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path.Base(r.URL.Path) {
+		case "missing":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+		case "flaky":
+			if atomic.AddInt32(&calls, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte(`{"_id":"flaky","_rev":"1-abc"}`))
+		default:
+			_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc"}`))
+		}
+	}))
+	defer restore()
+	defer SetMetricsCollector(nil)
+	config.GetConfig().CouchDB.Retry = config.CouchDBRetry{MaxAttempts: 2}
+	metrics := NewMemoryMetrics()
+	SetMetricsCollector(metrics)
+
+	// Success
+	var doc JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &doc))
+	snap := metrics.Snapshot()
+	if assert.Len(t, snap.Requests, 1) {
+		assert.Equal(t, RequestMetrics{
+			Method:   http.MethodGet,
+			Doctype:  TestDoctype,
+			Count:    1,
+			Statuses: map[int]int64{200: 1},
+			P50:      snap.Requests[0].P50,
+			P90:      snap.Requests[0].P90,
+			P99:      snap.Requests[0].P99,
+		}, snap.Requests[0])
+	}
+	assert.Empty(t, snap.Errors)
+
+	// CouchDB error
+	assert.Error(t, GetDoc(TestPrefix, TestDoctype, "missing", &doc))
+	snap = metrics.Snapshot()
+	assert.Equal(t, int64(2), snap.Requests[0].Count)
+	assert.Equal(t, int64(1), snap.Requests[0].Statuses[404])
+	assert.Equal(t, map[string]int64{ErrorKindCouchDB: 1}, snap.Errors)
+
+	// Retry
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "flaky", &doc))
+	snap = metrics.Snapshot()
+	assert.Equal(t, int64(3), snap.Requests[0].Count)
+	assert.Equal(t, int64(2), snap.Requests[0].Statuses[200])
+	assert.Equal(t, int64(1), snap.Requests[0].Retries)
+	assert.Equal(t, map[string]int64{ErrorKindCouchDB: 1}, snap.Errors)
+
+	// Connection error
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	config.GetConfig().CouchDB.URL, _ = url.Parse(ts.URL + "/")
+	config.GetConfig().CouchDB.Retry = config.CouchDBRetry{MaxAttempts: 1}
+	assert.Error(t, GetDoc(TestPrefix, TestDoctype, "foo", &doc))
+	snap = metrics.Snapshot()
+	assert.Equal(t, int64(4), snap.Requests[0].Count)
+	assert.Equal(t, int64(1), snap.Requests[0].Statuses[0])
+	assert.Equal(t, map[string]int64{ErrorKindCouchDB: 1, ErrorKindConnection: 1}, snap.Errors)
+}
+
+func TestPercentile(t *testing.T) {
+	var samples []time.Duration
+	for i := 1; i <= 100; i++ {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, percentile(samples, 0.5))
+	assert.Equal(t, 90*time.Millisecond, percentile(samples, 0.9))
+	assert.Equal(t, 99*time.Millisecond, percentile(samples, 0.99))
+	assert.Equal(t, time.Duration(0), percentile(nil, 0.5))
+}
@@ -0,0 +1,171 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestHook is called before each request sent to CouchDB, including the
+// retries. It can modify the request, like adding a header, or abort it by
+// returning an error, which is then returned to the caller.
+type RequestHook func(req *http.Request) error
+
+// ResponseHook is called after each request sent to CouchDB, with the
+// response or the error, and the duration of the request. The body of the
+// response must not be read by the hook.
+type ResponseHook func(req *http.Request, resp *http.Response, err error, d time.Duration)
+
+type hookChain struct {
+	requests  []RequestHook
+	responses []ResponseHook
+}
+
+var (
+	hooksMu      sync.Mutex
+	pendingHooks hookChain
+	// frozenHooks is the *hookChain used for the requests. It is set on the
+	// first request, and the hooks can no longer be registered after that,
+	// so that the chain can be read without a lock.
+	frozenHooks atomic.Value
+)
+
+func init() {
+	RegisterResponseHook(logResponse)
+	RegisterResponseHook(logSlowRequest)
+}
+
+// RegisterRequestHook adds a hook called before sending the requests to
+// CouchDB. The hooks are called in the order of their registration, and
+// they must be registered before the first request, typically in an init
+// function: it panics otherwise.
+func RegisterRequestHook(hook RequestHook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	checkHooksNotFrozen()
+	pendingHooks.requests = append(pendingHooks.requests, hook)
+}
+
+// RegisterResponseHook adds a hook called after the requests sent to
+// CouchDB. The hooks are called in the order of their registration, and
+// they must be registered before the first request, typically in an init
+// function: it panics otherwise.
+func RegisterResponseHook(hook ResponseHook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	checkHooksNotFrozen()
+	pendingHooks.responses = append(pendingHooks.responses, hook)
+}
+
+func checkHooksNotFrozen() {
+	if frozenHooks.Load() != nil {
+		panic("couchdb: the hooks must be registered before the first request")
+	}
+}
+
+// currentHooks returns the chain of hooks, and freezes it.
+func currentHooks() *hookChain {
+	if chain, ok := frozenHooks.Load().(*hookChain); ok {
+		return chain
+	}
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	if chain, ok := frozenHooks.Load().(*hookChain); ok {
+		return chain
+	}
+	chain := &hookChain{
+		requests:  pendingHooks.requests,
+		responses: pendingHooks.responses,
+	}
+	frozenHooks.Store(chain)
+	return chain
+}
+
+// hookError is the error of a request hook, returned as is to the caller.
+type hookError struct {
+	err error
+}
+
+func (e *hookError) Error() string {
+	return e.err.Error()
+}
+
+// sendWithHooks sends a request to CouchDB, with the hooks around it.
+func sendWithHooks(ctx context.Context, db Database, req *http.Request) (*http.Response, error) {
+	chain := currentHooks()
+	for _, hook := range chain.requests {
+		if err := hook(req); err != nil {
+			return nil, &hookError{err}
+		}
+	}
+	start := time.Now()
+	resp, err := doRequestWithBreaker(ctx, db, req)
+	elapsed := time.Since(start)
+	for _, hook := range chain.responses {
+		hook(req, resp, err, elapsed)
+	}
+	return resp, err
+}
+
+type databaseKey struct{}
+
+// withDatabase returns a context where the database of the requests is
+// known, for the hooks.
+func withDatabase(ctx context.Context, db Database) context.Context {
+	return context.WithValue(ctx, databaseKey{}, db)
+}
+
+// RequestInfo describes a request made to CouchDB, for the hooks. It does
+// not contain the prefix of the instance.
+type RequestInfo struct {
+	// Doctype is the doctype of the database, or "" if the request is not
+	// made on the database of a doctype
+	Doctype string
+	// Path is the path of the request, without the name of the database, and
+	// with its query string. It can contain the ID of a document.
+	Path string
+	// Retries is the number of times the request has already been sent
+	Retries int
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo returns a context where the request is described, for the
+// hooks.
+func withRequestInfo(ctx context.Context, doctype, path string) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, RequestInfo{Doctype: doctype, Path: path})
+}
+
+// withRetries returns a context for a new attempt of the request.
+func withRetries(ctx context.Context, retries int) context.Context {
+	info, ok := ctx.Value(requestInfoKey{}).(RequestInfo)
+	if !ok {
+		return ctx
+	}
+	info.Retries = retries
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// GetRequestInfo returns the description of a request made to CouchDB. It
+// can be used by the hooks.
+func GetRequestInfo(req *http.Request) (RequestInfo, bool) {
+	info, ok := req.Context().Value(requestInfoKey{}).(RequestInfo)
+	return info, ok
+}
+
+// logResponse is the hook that logs the requests made to CouchDB, with their
+// status and duration, at the debug level.
+func logResponse(req *http.Request, resp *http.Response, err error, d time.Duration) {
+	db, ok := req.Context().Value(databaseKey{}).(Database)
+	if !ok || resp == nil {
+		// The errors are logged by makeRequest
+		return
+	}
+	log := loggerFor(db)
+	if isDebug(log) {
+		reqID := responseRequestID(resp, req.Header.Get(RequestIDHeader))
+		log.Debugf("%s %s %d (%s, request %s)", req.Method, req.URL.RequestURI(), resp.StatusCode, d, reqID)
+	}
+}
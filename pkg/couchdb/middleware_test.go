@@ -0,0 +1,123 @@
+package couchdb
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// unfreezeHooks allows a test to register some hooks, and returns a function
+// to restore the previous chain.
+func unfreezeHooks() func() {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	pending := pendingHooks
+	frozen := frozenHooks.Load()
+	frozenHooks = atomic.Value{}
+	return func() {
+		hooksMu.Lock()
+		defer hooksMu.Unlock()
+		pendingHooks = pending
+		frozenHooks = atomic.Value{}
+		if frozen != nil {
+			frozenHooks.Store(frozen)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var calls int32
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		assert.Equal(t, "first,second", r.Header.Get("X-Hooks"))
+		_, _ = w.Write([]byte(`{"db_name":"foo"}`))
+	}))
+	defer restore()
+	defer unfreezeHooks()()
+
+	var order []string
+	RegisterRequestHook(func(req *http.Request) error {
+		order = append(order, "request 1")
+		req.Header.Set("X-Hooks", "first")
+		return nil
+	})
+	RegisterRequestHook(func(req *http.Request) error {
+		order = append(order, "request 2")
+		req.Header.Set("X-Hooks", req.Header.Get("X-Hooks")+",second")
+		return nil
+	})
+	RegisterResponseHook(func(req *http.Request, resp *http.Response, err error, d time.Duration) {
+		order = append(order, "response")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.True(t, d > 0)
+	})
+
+	_, err := DBStatus(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"request 1", "request 2", "response"}, order)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	// The chain is frozen after the first request
+	assert.Panics(t, func() {
+		RegisterRequestHook(func(req *http.Request) error { return nil })
+	})
+	assert.Panics(t, func() {
+		RegisterResponseHook(func(req *http.Request, resp *http.Response, err error, d time.Duration) {})
+	})
+}
+
+func TestHookAbort(t *testing.T) {
+	var calls int32
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer restore()
+	defer unfreezeHooks()()
+
+	errChaos := errors.New("chaos")
+	var responses int32
+	RegisterRequestHook(func(req *http.Request) error { return errChaos })
+	RegisterResponseHook(func(req *http.Request, resp *http.Response, err error, d time.Duration) {
+		atomic.AddInt32(&responses, 1)
+	})
+
+	_, err := DBStatus(TestPrefix, TestDoctype)
+	assert.Equal(t, errChaos, err)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&calls))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&responses))
+}
+
+func TestRequestInfo(t *testing.T) {
+	var calls int32
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"db_name":"foo"}`))
+	}))
+	defer restore()
+	defer unfreezeHooks()()
+	config.GetConfig().CouchDB.Retry = config.CouchDBRetry{MaxAttempts: 2}
+
+	var infos []RequestInfo
+	RegisterRequestHook(func(req *http.Request) error {
+		info, ok := GetRequestInfo(req)
+		assert.True(t, ok)
+		infos = append(infos, info)
+		return nil
+	})
+
+	_, err := DBStatus(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.Equal(t, []RequestInfo{
+		{Doctype: TestDoctype, Path: "", Retries: 0},
+		{Doctype: TestDoctype, Path: "", Retries: 1},
+	}, infos)
+}
@@ -0,0 +1,273 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Migration is a named change of the shape of the documents of a doctype,
+// like the rename of a field. Up is called for each document, and returns
+// true if it has modified the document. It should be idempotent: after a
+// crash, the documents of the last batch can be migrated again.
+type Migration struct {
+	Name string
+	Up   func(doc *JSONDoc) (changed bool, err error)
+}
+
+// ErrMigrationFailed is the error returned by RunMigrations when some
+// documents could not be migrated. The migrations are not recorded as
+// applied in this case, and they can be run again.
+var ErrMigrationFailed = errors.New("CouchDB: migration failed")
+
+// MigrationReport is the result of RunMigrations, also used to report the
+// progress of a run.
+type MigrationReport struct {
+	Doctype string
+	// Migrations are the names of the migrations applied by this run
+	Migrations []string
+	// Processed is the number of documents read
+	Processed int
+	// Changed is the number of documents modified and saved
+	Changed int
+	// Failed are the errors for the documents that could not be migrated,
+	// by their identifiers
+	Failed map[string]error
+}
+
+// migrationsLocalID is the identifier of the _local document where the
+// migrations of a database are recorded.
+const migrationsLocalID = "migrations"
+
+// migrationBatchSize is the number of documents read between two
+// checkpoints, and so the maximal number of documents written in bulk.
+const migrationBatchSize = 100
+
+var migrations = make(map[string][]Migration)
+
+// RegisterMigrations adds migrations for a doctype. They are applied in the
+// order of their registration by RunMigrations. It is meant to be called in
+// an init function, and it panics if a migration with the same name is
+// already registered for the doctype.
+func RegisterMigrations(doctype string, list ...Migration) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, m := range list {
+		for _, existing := range migrations[doctype] {
+			if existing.Name == m.Name {
+				panic(fmt.Sprintf("couchdb: migration %s is already registered for %s", m.Name, doctype))
+			}
+		}
+		migrations[doctype] = append(migrations[doctype], m)
+	}
+}
+
+type migrationProgressKey struct{}
+
+// WithMigrationProgress returns a context where RunMigrations calls fn after
+// each batch of documents, with the report of the run so far. The Failed map
+// must not be modified.
+func WithMigrationProgress(ctx context.Context, fn func(report MigrationReport)) context.Context {
+	return context.WithValue(ctx, migrationProgressKey{}, fn)
+}
+
+// RunMigrations calls RunMigrationsContext with a background context.
+func RunMigrations(db Database, doctype string) (*MigrationReport, error) {
+	return RunMigrationsContext(context.Background(), db, doctype)
+}
+
+// RunMigrationsContext applies the pending migrations of a doctype to all of
+// its documents. The changed documents are written back in bulk, and the
+// names of the applied migrations are recorded in a _local document, so
+// running it again does nothing. A checkpoint is saved after each batch, and
+// an interrupted run is resumed from it.
+//
+// The documents that fail to be migrated are listed in the report, and
+// ErrMigrationFailed is returned after all the other documents have been
+// migrated.
+func RunMigrationsContext(ctx context.Context, db Database, doctype string) (*MigrationReport, error) {
+	registryMu.RLock()
+	registered := migrations[doctype]
+	registryMu.RUnlock()
+	report := &MigrationReport{Doctype: doctype, Failed: make(map[string]error)}
+	if len(registered) == 0 {
+		return report, nil
+	}
+
+	state, err := GetLocalContext(ctx, db, doctype, migrationsLocalID)
+	if IsNoDatabaseError(err) {
+		return report, nil
+	}
+	if err != nil {
+		if !IsNotFoundError(err) {
+			return nil, err
+		}
+		state = map[string]interface{}{}
+	}
+	applied := stringList(state["applied"])
+	var pending []Migration
+	for _, m := range registered {
+		if !containsString(applied, m.Name) {
+			pending = append(pending, m)
+			report.Migrations = append(report.Migrations, m.Name)
+		}
+	}
+	if len(pending) == 0 {
+		return report, nil
+	}
+
+	// Resume after the checkpoint if the same migrations were running
+	var startAfter string
+	if equalStrings(stringList(state["running"]), report.Migrations) {
+		startAfter, _ = state["checkpoint"].(string)
+	}
+	state["running"] = report.Migrations
+	progress, _ := ctx.Value(migrationProgressKey{}).(func(MigrationReport))
+
+	var batch []interface{}
+	var lastID string
+	flush := func() error {
+		if err := writeMigrated(ctx, db, doctype, batch, report); err != nil {
+			return err
+		}
+		batch = nil
+		state["checkpoint"] = lastID
+		if err := PutLocalContext(ctx, db, doctype, migrationsLocalID, state); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(*report)
+		}
+		return nil
+	}
+
+	err = foreachDocsAfter(ctx, db, doctype, migrationBatchSize, startAfter, func(id string, raw json.RawMessage) error {
+		report.Processed++
+		lastID = id
+		doc, changed, err := migrateDoc(doctype, raw, pending)
+		if err != nil {
+			report.Failed[id] = err
+		} else if changed {
+			batch = append(batch, doc)
+		}
+		if report.Processed%migrationBatchSize == 0 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if err := writeMigrated(ctx, db, doctype, batch, report); err != nil {
+		return report, err
+	}
+
+	delete(state, "running")
+	delete(state, "checkpoint")
+	if len(report.Failed) == 0 {
+		state["applied"] = append(applied, report.Migrations...)
+	}
+	if err := PutLocalContext(ctx, db, doctype, migrationsLocalID, state); err != nil {
+		return report, err
+	}
+	if progress != nil {
+		progress(*report)
+	}
+	if len(report.Failed) > 0 {
+		return report, fmt.Errorf("%w: %d documents", ErrMigrationFailed, len(report.Failed))
+	}
+	return report, nil
+}
+
+// migrateDoc applies the migrations to a document, and returns true if one
+// of them has changed it.
+func migrateDoc(doctype string, raw json.RawMessage, pending []Migration) (*JSONDoc, bool, error) {
+	doc := &JSONDoc{}
+	if err := doc.decodeResponse(bytes.NewReader(raw)); err != nil {
+		return nil, false, err
+	}
+	doc.Type = doctype
+	changed := false
+	for _, m := range pending {
+		c, err := m.Up(doc)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %w", m.Name, err)
+		}
+		changed = changed || c
+	}
+	return doc, changed, nil
+}
+
+// writeMigrated saves the migrated documents in bulk. The documents rejected
+// by the validators or by CouchDB are added to the failures of the report.
+func writeMigrated(ctx context.Context, db Database, doctype string, batch []interface{}, report *MigrationReport) error {
+	for len(batch) > 0 {
+		err := BulkUpdateDocsContext(ctx, db, doctype, batch, nil)
+		var bulkErr *BulkValidationError
+		if err != nil && errors.As(err, &bulkErr) {
+			// Retry without the invalid documents
+			var valid []interface{}
+			for i, doc := range batch {
+				if e, ok := bulkErr.Errors[i]; ok {
+					report.Failed[doc.(Doc).ID()] = e
+				} else {
+					valid = append(valid, doc)
+				}
+			}
+			batch = valid
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, doc := range batch {
+			d := doc.(Doc)
+			if d.Rev() == "" {
+				report.Failed[d.ID()] = &Error{
+					StatusCode: http.StatusConflict,
+					Name:       "not_saved",
+					Reason:     "the migrated document has not been saved",
+				}
+			} else {
+				report.Changed++
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+func stringList(value interface{}) []string {
+	items, _ := value.([]interface{})
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunMigrations(t *testing.T) {
+	const doctype = "io.cozy.tests.migrations"
+	RegisterMigrations(doctype, Migration{
+		Name: "rename-title",
+		Up: func(doc *JSONDoc) (bool, error) {
+			title, ok := doc.GetStringOk("title")
+			if !ok {
+				return false, nil
+			}
+			if title == "broken" {
+				return false, errors.New("cannot migrate")
+			}
+			_ = doc.Delete("title")
+			return true, doc.Set("name", title)
+		},
+	})
+	defer func() {
+		registryMu.Lock()
+		delete(migrations, doctype)
+		registryMu.Unlock()
+	}()
+	assert.Panics(t, func() {
+		RegisterMigrations(doctype, Migration{Name: "rename-title"})
+	})
+
+	var mu sync.Mutex
+	docs := make(map[string]map[string]interface{})
+	var local map[string]interface{}
+	var allDocs int
+	for i := 0; i < 250; i++ {
+		id := fmt.Sprintf("doc%03d", i)
+		docs[id] = map[string]interface{}{"_id": id, "_rev": "1-abc", "title": id}
+	}
+	docs["doc100"]["title"] = "broken"
+	docs["doc200"] = map[string]interface{}{"_id": "doc200", "_rev": "1-abc", "name": "already"}
+
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path := r.URL.Path
+		switch {
+		case strings.HasSuffix(path, "/_local/migrations"):
+			if r.Method == http.MethodPut {
+				local = nil
+				_ = json.NewDecoder(r.Body).Decode(&local)
+				_, _ = w.Write([]byte(`{"ok":true,"id":"_local/migrations","rev":"0-1"}`))
+				return
+			}
+			if local == nil {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(local)
+		case strings.HasSuffix(path, "/_all_docs"):
+			allDocs++
+			ids := make([]string, 0, len(docs))
+			for id := range docs {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			q := r.URL.Query()
+			start := sort.SearchStrings(ids, q.Get("startkey_docid"))
+			skip, _ := strconv.Atoi(q.Get("skip"))
+			limit, _ := strconv.Atoi(q.Get("limit"))
+			start += skip
+			end := start + limit
+			if start > len(ids) {
+				start = len(ids)
+			}
+			if end > len(ids) {
+				end = len(ids)
+			}
+			type row struct {
+				ID  string                 `json:"id"`
+				Doc map[string]interface{} `json:"doc"`
+			}
+			rows := []row{}
+			for _, id := range ids[start:end] {
+				rows = append(rows, row{ID: id, Doc: docs[id]})
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"rows": rows})
+		case strings.HasSuffix(path, "/_bulk_docs"):
+			var body struct {
+				Docs []map[string]interface{} `json:"docs"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			res := make([]UpdateResponse, len(body.Docs))
+			for i, doc := range body.Docs {
+				id := doc["_id"].(string)
+				doc["_rev"] = "2-migrated"
+				docs[id] = doc
+				res[i] = UpdateResponse{ID: id, Rev: "2-migrated", Ok: true}
+			}
+			_ = json.NewEncoder(w).Encode(res)
+		}
+	}))
+	defer restore()
+
+	var calls []MigrationReport
+	ctx := WithMigrationProgress(context.Background(), func(report MigrationReport) {
+		calls = append(calls, report)
+	})
+	report, err := RunMigrationsContext(ctx, TestPrefix, doctype)
+	assert.True(t, errors.Is(err, ErrMigrationFailed))
+	if assert.NotNil(t, report) {
+		assert.Equal(t, []string{"rename-title"}, report.Migrations)
+		assert.Equal(t, 250, report.Processed)
+		assert.Equal(t, 248, report.Changed)
+		assert.Len(t, report.Failed, 1)
+		assert.Contains(t, report.Failed, "doc100")
+	}
+	assert.Len(t, calls, 3)
+	assert.Equal(t, "doc042", docs["doc042"]["name"])
+	assert.NotContains(t, docs["doc042"], "title")
+	assert.Equal(t, "already", docs["doc200"]["name"])
+	// The migration is not recorded, as a document has failed
+	assert.NotContains(t, local, "applied")
+	assert.NotContains(t, local, "checkpoint")
+
+	// After a fix of the failed document, and a crash during the run, the
+	// migration is resumed from the checkpoint
+	docs["doc100"]["title"] = "fixed"
+	docs["doc201"]["title"] = "doc201"
+	local["running"] = []interface{}{"rename-title"}
+	local["checkpoint"] = "doc099"
+	report, err = RunMigrations(TestPrefix, doctype)
+	assert.NoError(t, err)
+	assert.Equal(t, 150, report.Processed)
+	assert.Equal(t, 2, report.Changed)
+	assert.Equal(t, "fixed", docs["doc100"]["name"])
+	assert.Equal(t, []interface{}{"rename-title"}, local["applied"])
+	assert.NotContains(t, local, "running")
+
+	// Running it again does nothing
+	allDocs = 0
+	report, err = RunMigrations(TestPrefix, doctype)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Migrations)
+	assert.Equal(t, 0, allDocs)
+}
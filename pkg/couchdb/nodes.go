@@ -0,0 +1,123 @@
+package couchdb
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// defaultNodeCoolDown is how long a node is avoided after a failure, when the
+// circuit breaker has no cool-down configured.
+const defaultNodeCoolDown = 10 * time.Second
+
+var (
+	nodesMu sync.Mutex
+	// nodeFailures are the times of the last failure of the CouchDB nodes,
+	// indexed by host. A node without a failure is not in the map.
+	nodeFailures = make(map[string]time.Time)
+	// nextNode is used to spread the requests over the nodes, round-robin.
+	nextNode uint32
+)
+
+func nodeCoolDown() time.Duration {
+	if d := config.GetConfig().CouchDB.CircuitBreaker.CoolDown; d > 0 {
+		return d
+	}
+	return defaultNodeCoolDown
+}
+
+// pickNode returns the URL of the node of a cluster where a request should be
+// sent. The healthy nodes are used round-robin, and the nodes in tried are
+// skipped if possible. When no node is healthy, the one that has failed the
+// least recently is used.
+func pickNode(urls []*url.URL, tried map[string]bool) *url.URL {
+	if len(urls) == 1 {
+		return urls[0]
+	}
+
+	now := time.Now()
+	coolDown := nodeCoolDown()
+	start := int(atomic.AddUint32(&nextNode, 1))
+	var fallback *url.URL
+	var fallbackFailure time.Time
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	for i := range urls {
+		u := urls[(start+i)%len(urls)]
+		if tried[u.Host] {
+			continue
+		}
+		failure := nodeFailures[u.Host]
+		if now.Sub(failure) >= coolDown && !isCircuitOpen(u.Host) {
+			return u
+		}
+		if fallback == nil || failure.Before(fallbackFailure) {
+			fallback = u
+			fallbackFailure = failure
+		}
+	}
+	if fallback != nil {
+		return fallback
+	}
+	// All the nodes have been tried, take the one that failed first
+	for _, u := range urls {
+		failure := nodeFailures[u.Host]
+		if fallback == nil || failure.Before(fallbackFailure) {
+			fallback = u
+			fallbackFailure = failure
+		}
+	}
+	return fallback
+}
+
+// hasUntriedNode returns true if a node of the cluster has not been tried
+// yet.
+func hasUntriedNode(urls []*url.URL, tried map[string]bool) bool {
+	for _, u := range urls {
+		if !tried[u.Host] {
+			return true
+		}
+	}
+	return false
+}
+
+// recordNode keeps the result of a request on a node, for picking the next
+// nodes.
+func recordNode(host string, failed bool) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	if failed {
+		nodeFailures[host] = time.Now()
+	} else {
+		delete(nodeFailures, host)
+	}
+}
+
+// isNodeDown returns true if the response or error of a request means that
+// the node cannot serve it, and that another node should be tried: the
+// connection has failed, its circuit is open, or it has responded with a 503.
+func isNodeDown(resp *http.Response, err error) bool {
+	if err != nil {
+		couchErr, isCouchErr := IsCouchError(err)
+		return !isCouchErr || couchErr.Name == "circuit_open"
+	}
+	return resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// nodeURL returns the URL of a path on a CouchDB node. The path of the node
+// is kept, as CouchDB can be served under a prefix by a reverse proxy. The
+// given path must be escaped, like the names of the databases.
+func nodeURL(node *url.URL, path string) string {
+	return node.Scheme + "://" + node.Host + nodePath(node, path)
+}
+
+// nodePath returns the escaped path of a path on a CouchDB node, with the
+// prefix of the node.
+func nodePath(node *url.URL, path string) string {
+	return strings.TrimSuffix(node.EscapedPath(), "/") + "/" + strings.TrimPrefix(path, "/")
+}
@@ -0,0 +1,208 @@
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// useTestCluster makes the couchdb package send its requests to a cluster
+// with a node for each handler, the first node being picked first. It
+// returns a function to restore the configuration.
+func useTestCluster(t *testing.T, handlers ...http.Handler) func() {
+	t.Helper()
+	couch := config.GetConfig().CouchDB
+	var servers []*httptest.Server
+	var urls []*url.URL
+	for _, h := range handlers {
+		ts := httptest.NewServer(h)
+		servers = append(servers, ts)
+		u, err := url.Parse(ts.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+	config.GetConfig().CouchDB.URL = urls[0]
+	config.GetConfig().CouchDB.URLs = urls
+	config.GetConfig().CouchDB.Client = servers[0].Client()
+	config.GetConfig().CouchDB.CircuitBreaker = config.CouchDBCircuitBreaker{}
+	atomic.StoreUint32(&nextNode, uint32(len(urls)-1))
+	return func() {
+		config.GetConfig().CouchDB = couch
+		for _, ts := range servers {
+			ts.Close()
+		}
+		nodesMu.Lock()
+		nodeFailures = make(map[string]time.Time)
+		nodesMu.Unlock()
+	}
+}
+
+func TestFailover(t *testing.T) {
+	var calls [2]int32
+	handler := func(i int, status int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls[i], 1)
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"db_name":"foo"}`))
+		})
+	}
+	restore := useTestCluster(t,
+		handler(0, http.StatusServiceUnavailable),
+		handler(1, http.StatusOK))
+	defer restore()
+	config.GetConfig().CouchDB.Retry = config.CouchDBRetry{MaxAttempts: 1}
+
+	// The request is retried on the other node, even with a single attempt
+	res, err := DBStatus(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", res.DBName)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls[0]))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls[1]))
+
+	// And the failed node is avoided for the next requests
+	for i := 0; i < 3; i++ {
+		_, err = DBStatus(TestPrefix, TestDoctype)
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls[0]))
+	assert.EqualValues(t, 4, atomic.LoadInt32(&calls[1]))
+}
+
+func TestFailoverNotIdempotent(t *testing.T) {
+	var calls int32
+	down := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	up := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		_, _ = w.Write([]byte(`{"id":"123","rev":"1-abc","ok":true}`))
+	})
+	restore := useTestCluster(t, down, up)
+	defer restore()
+	config.GetConfig().CouchDB.Retry = config.CouchDBRetry{MaxAttempts: 3}
+
+	// A POST that creates a document is not replayed on another node
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"test": true}}
+	err := CreateDoc(TestPrefix, doc)
+	assert.True(t, IsServerError(err))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&calls))
+}
+
+func TestPickNode(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	restore := useTestCluster(t, ok, ok, ok)
+	defer restore()
+	urls := config.CouchURLs()
+
+	// Round-robin
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		seen[pickNode(urls, nil).Host]++
+	}
+	for _, u := range urls {
+		assert.Equal(t, 2, seen[u.Host])
+	}
+
+	// The failed nodes are skipped
+	recordNode(urls[0].Host, true)
+	recordNode(urls[2].Host, true)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, urls[1], pickNode(urls, nil))
+	}
+
+	// When all the nodes are unavailable, the least recently failed is used
+	recordNode(urls[1].Host, true)
+	assert.Equal(t, urls[0], pickNode(urls, nil))
+	assert.Equal(t, urls[2], pickNode(urls, map[string]bool{urls[0].Host: true}))
+
+	// And a success makes the node healthy again
+	recordNode(urls[1].Host, false)
+	assert.Equal(t, urls[1], pickNode(urls, nil))
+}
+
+func TestChangesFeedResume(t *testing.T) {
+	var sinces []string
+	dying := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sinces = append(sinces, r.URL.Query().Get("since"))
+		_, _ = w.Write([]byte(`{"results":[{"id":"a","seq":"1-x","changes":[]},{"id":"b","seq":"2-x","changes":[]},`))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+	healthy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sinces = append(sinces, r.URL.Query().Get("since"))
+		_, _ = fmt.Fprint(w, `{"results":[{"id":"c","seq":"3-x","changes":[]}],"last_seq":"3-x","pending":0}`)
+	})
+	restore := useTestCluster(t, dying, healthy)
+	defer restore()
+
+	var ids []string
+	res, err := ForeachChangeContext(context.Background(), TestPrefix, &ChangesRequest{
+		DocType:   TestDoctype,
+		Feed:      ChangesModeLongpoll,
+		Heartbeat: 1000,
+		Since:     "0",
+	}, func(change *Change) error {
+		ids = append(ids, change.DocID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, ids)
+	assert.Equal(t, "3-x", res.LastSeq)
+	assert.Equal(t, []string{"0", "2-x"}, sinces)
+}
+
+func TestAuthErrorsNoFailover(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		var calls [2]int32
+		handler := func(i int, status int) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls[i], 1)
+				w.WriteHeader(status)
+				_, _ = w.Write([]byte(`{"error":"denied","reason":"You are not allowed to access this db."}`))
+			})
+		}
+		restore := useTestCluster(t, handler(0, status), handler(1, http.StatusOK))
+		config.GetConfig().CouchDB.Retry = config.CouchDBRetry{MaxAttempts: 3}
+
+		// The request is neither retried nor sent to the other node
+		_, err := DBStatus(TestPrefix, TestDoctype)
+		assert.Equal(t, status == http.StatusUnauthorized, errors.Is(err, ErrUnauthorized), status)
+		assert.Equal(t, status == http.StatusForbidden, IsForbiddenError(err), status)
+		if couchErr, ok := IsCouchError(err); assert.True(t, ok) {
+			assert.Equal(t, TestDoctype, couchErr.Doctype)
+			assert.Equal(t, CredentialsAdmin, couchErr.Credentials)
+		}
+		assert.EqualValues(t, 1, atomic.LoadInt32(&calls[0]))
+		assert.EqualValues(t, 0, atomic.LoadInt32(&calls[1]))
+
+		// With the user of the instance
+		atomic.StoreUint32(&nextNode, 1)
+		SetProxyAuthResolver(func(db Database) *ProxyAuth {
+			return &ProxyAuth{UserName: "user-" + db.DBPrefix()}
+		})
+		_, err = DBStatus(TestPrefix, TestDoctype)
+		SetProxyAuthResolver(nil)
+		if couchErr, ok := IsCouchError(err); assert.True(t, ok) {
+			assert.Equal(t, CredentialsInstance, couchErr.Credentials)
+		}
+
+		// And the node is not marked as down, even by the health checks
+		h := StartHealthChecker(context.Background(), time.Hour)
+		h.Close()
+		nodesMu.Lock()
+		assert.Empty(t, nodeFailures, status)
+		nodesMu.Unlock()
+		restore()
+	}
+}
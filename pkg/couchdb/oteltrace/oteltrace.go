@@ -0,0 +1,182 @@
+// Package oteltrace traces the requests made to CouchDB with OpenTelemetry.
+// It is built on the request hooks of the couchdb package, and is kept in its
+// own package so that the couchdb package does not depend on OpenTelemetry.
+package oteltrace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/cozy/cozy-stack/pkg/couchdb"
+
+// The attributes of the spans, in addition to the semantic conventions.
+const (
+	// DoctypeKey is the doctype of the database of the request
+	DoctypeKey = attribute.Key("couchdb.doctype")
+	// RetriesKey is the number of times the request has already been sent
+	RetriesKey = attribute.Key("couchdb.retries")
+	// PathKey is the path of the request, without the database name. It is
+	// only set with the WithPath option, as it can contain a document ID.
+	PathKey = attribute.Key("couchdb.path")
+	// CanceledKey is set when the context of the request has been canceled,
+	// or its deadline exceeded.
+	CanceledKey = attribute.Key("couchdb.canceled")
+)
+
+// Tracer starts a client span for each request sent to CouchDB, including
+// the retries.
+type Tracer struct {
+	tracer   trace.Tracer
+	withPath bool
+}
+
+// Option is an option for New.
+type Option func(t *Tracer)
+
+// WithPath adds the path of the requests to the spans. The prefix of the
+// instance is never added, but the path can contain the ID of a document.
+func WithPath() Option {
+	return func(t *Tracer) { t.withPath = true }
+}
+
+// New returns a Tracer that creates the spans with the given provider. It
+// must be registered with Register to be used, see also Init.
+func New(provider trace.TracerProvider, opts ...Option) *Tracer {
+	t := &Tracer{tracer: provider.Tracer(instrumentationName)}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Register adds the tracer to the hooks of the couchdb package. Like the
+// other hooks, it must be called before the first request to CouchDB, and it
+// should be the last request hook, as its span is not ended if a request is
+// aborted by another hook.
+func (t *Tracer) Register() {
+	couchdb.RegisterRequestHook(t.startSpan)
+	couchdb.RegisterResponseHook(t.endSpan)
+}
+
+// Init traces the requests made to CouchDB with the global tracer provider
+// of OpenTelemetry.
+func Init(opts ...Option) {
+	New(otel.GetTracerProvider(), opts...).Register()
+}
+
+type spanKey struct{}
+
+func (t *Tracer) startSpan(req *http.Request) error {
+	info, ok := couchdb.GetRequestInfo(req)
+	if !ok {
+		return nil
+	}
+	op := operationName(req.Method, info)
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemCouchDB,
+		semconv.DBOperationKey.String(op),
+		semconv.HTTPMethodKey.String(req.Method),
+		RetriesKey.Int(info.Retries),
+	}
+	if info.Doctype != "" {
+		attrs = append(attrs, DoctypeKey.String(info.Doctype))
+	}
+	if t.withPath {
+		attrs = append(attrs, PathKey.String(info.Path))
+	}
+	ctx, span := t.tracer.Start(req.Context(), "couchdb."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	// The span is also kept under our own key, to not end the span of the
+	// caller if this hook has not been called.
+	ctx = context.WithValue(ctx, spanKey{}, span)
+	*req = *req.WithContext(ctx)
+	return nil
+}
+
+func (t *Tracer) endSpan(req *http.Request, resp *http.Response, err error, d time.Duration) {
+	span, ok := req.Context().Value(spanKey{}).(trace.Span)
+	if !ok {
+		return
+	}
+	defer span.End()
+	if err != nil {
+		// The URL of the request is not recorded, as it contains the prefix
+		// of the instance
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			span.SetAttributes(CanceledKey.Bool(true))
+			err = ctxErr
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+}
+
+// operationName returns the name of the operation of a request, like get,
+// find or bulk_docs. It is built from the method and the path, without the
+// ID of the document.
+func operationName(method string, info couchdb.RequestInfo) string {
+	path := info.Path
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if info.Doctype == "" {
+		// A request on the server, or on a database given by its name
+		if strings.HasPrefix(path, "_") {
+			return firstSegment(path)
+		}
+		return strings.ToLower(method)
+	}
+	switch {
+	case path == "":
+		switch method {
+		case http.MethodPut:
+			return "create_db"
+		case http.MethodDelete:
+			return "delete_db"
+		case http.MethodPost:
+			return "create"
+		}
+		return "db_info"
+	case strings.HasPrefix(path, "_design/"):
+		if strings.Contains(path, "/_view/") {
+			return "view"
+		}
+		return "design_" + strings.ToLower(method)
+	case strings.HasPrefix(path, "_local/"):
+		return "local_" + strings.ToLower(method)
+	case strings.HasPrefix(path, "_"):
+		return firstSegment(path)
+	}
+	return strings.ToLower(method)
+}
+
+// firstSegment returns the first segment of a path like _find or
+// _index/_design/foo, without the leading underscore.
+func firstSegment(path string) string {
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		path = path[:i]
+	}
+	return strings.TrimPrefix(path, "_")
+}
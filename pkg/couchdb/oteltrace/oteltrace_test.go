@@ -0,0 +1,123 @@
+package oteltrace
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// exporter records the spans of the tracer, that is registered once for all
+// the tests, as the middlewares cannot be registered after the first request.
+var exporter = tracetest.NewInMemoryExporter()
+
+func TestTracer(t *testing.T) {
+	exporter.Reset()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/tests%2Fio-cozy-files/_find":
+			_, _ = w.Write([]byte(`{"docs":[]}`))
+		case "/tests%2Fio-cozy-files/_bulk_docs":
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+		}
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL + "/")
+	config.GetConfig().CouchDB.URL = u
+	config.GetConfig().CouchDB.Client = ts.Client()
+
+	db := prefixer.NewPrefixer("", "tests")
+	var docs []couchdb.JSONDoc
+	err := couchdb.FindDocs(db, "io.cozy.files", &couchdb.FindRequest{Limit: 1}, &docs)
+	assert.NoError(t, err)
+	doc := &couchdb.JSONDoc{}
+	err = couchdb.GetDoc(db, "io.cozy.files", "secret-id", doc)
+	assert.True(t, couchdb.IsNotFoundError(err))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = couchdb.BulkUpdateDocsContext(ctx, db, "io.cozy.files",
+		[]interface{}{&couchdb.JSONDoc{Type: "io.cozy.files", M: map[string]interface{}{}}}, []interface{}{nil})
+	assert.Error(t, err)
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	attrs := func(i int) map[attribute.Key]attribute.Value {
+		m := make(map[attribute.Key]attribute.Value)
+		for _, kv := range spans[i].Attributes {
+			m[kv.Key] = kv.Value
+		}
+		return m
+	}
+
+	assert.Equal(t, "couchdb.find", spans[0].Name)
+	assert.Equal(t, trace.SpanKindClient, spans[0].SpanKind)
+	assert.Equal(t, "io.cozy.files", attrs(0)[DoctypeKey].AsString())
+	assert.Equal(t, "POST", attrs(0)["http.method"].AsString())
+	assert.EqualValues(t, 200, attrs(0)["http.status_code"].AsInt64())
+	assert.EqualValues(t, 0, attrs(0)[RetriesKey].AsInt64())
+	assert.Equal(t, codes.Unset, spans[0].StatusCode)
+
+	assert.Equal(t, "couchdb.get", spans[1].Name)
+	assert.EqualValues(t, 404, attrs(1)["http.status_code"].AsInt64())
+	assert.Equal(t, codes.Error, spans[1].StatusCode)
+	for _, kv := range spans[1].Attributes {
+		assert.NotContains(t, kv.Value.Emit(), "secret-id")
+		assert.NotContains(t, kv.Value.Emit(), "tests")
+	}
+
+	assert.Equal(t, "couchdb.bulk_docs", spans[2].Name)
+	assert.True(t, attrs(2)[CanceledKey].AsBool())
+	assert.Equal(t, codes.Error, spans[2].StatusCode)
+	assert.Equal(t, context.Canceled.Error(), spans[2].StatusMessage)
+	if assert.Len(t, spans[2].MessageEvents, 1) {
+		for _, kv := range spans[2].MessageEvents[0].Attributes {
+			assert.NotContains(t, kv.Value.Emit(), "tests")
+		}
+	}
+}
+
+func TestOperationName(t *testing.T) {
+	files := func(path string) couchdb.RequestInfo {
+		return couchdb.RequestInfo{Doctype: "io.cozy.files", Path: path}
+	}
+	assert.Equal(t, "get", operationName("GET", files("foo")))
+	assert.Equal(t, "put", operationName("PUT", files("foo")))
+	assert.Equal(t, "delete", operationName("DELETE", files("foo?rev=1-abc")))
+	assert.Equal(t, "create", operationName("POST", files("")))
+	assert.Equal(t, "create_db", operationName("PUT", files("")))
+	assert.Equal(t, "db_info", operationName("GET", files("")))
+	assert.Equal(t, "find", operationName("POST", files("_find")))
+	assert.Equal(t, "bulk_docs", operationName("POST", files("_bulk_docs")))
+	assert.Equal(t, "all_docs", operationName("GET", files("_all_docs?include_docs=true")))
+	assert.Equal(t, "changes", operationName("GET", files("_changes?since=0")))
+	assert.Equal(t, "index", operationName("DELETE", files("_index/_design/foo/json/bar")))
+	assert.Equal(t, "view", operationName("GET", files("_design/foo/_view/bar")))
+	assert.Equal(t, "design_put", operationName("PUT", files("_design/foo")))
+	assert.Equal(t, "local_get", operationName("GET", files("_local/foo")))
+	assert.Equal(t, "all_dbs", operationName("GET", couchdb.RequestInfo{Path: "_all_dbs"}))
+	assert.Equal(t, "delete", operationName("DELETE", couchdb.RequestInfo{Path: "tests%2Fio-cozy-files"}))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	New(provider).Register()
+	os.Exit(m.Run())
+}
@@ -0,0 +1,122 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// bulkGetBatchSize is the number of documents asked in a _bulk_get
+	// request by ParallelBulkGet.
+	bulkGetBatchSize = 100
+	// defaultBulkGetConcurrency is the number of _bulk_get requests sent at
+	// the same time by ParallelBulkGet, when the concurrency is not given.
+	defaultBulkGetConcurrency = 4
+	// maxBulkGetConcurrency is the maximal number of _bulk_get requests sent
+	// at the same time by ParallelBulkGet, to not overload CouchDB.
+	maxBulkGetConcurrency = 16
+)
+
+// bulkGetResults is the response of _bulk_get, with the identifiers.
+type bulkGetResults struct {
+	Results []struct {
+		ID   string `json:"id"`
+		Docs []struct {
+			OK map[string]interface{} `json:"ok"`
+		} `json:"docs"`
+	} `json:"results"`
+}
+
+// ParallelBulkGet calls ParallelBulkGetContext with a background context.
+func ParallelBulkGet(db Database, doctype string, ids []string, concurrency int) ([]map[string]interface{}, error) {
+	return ParallelBulkGetContext(context.Background(), db, doctype, ids, concurrency)
+}
+
+// ParallelBulkGetContext fetches the documents with the given identifiers,
+// with _bulk_get requests of 100 documents sent by concurrent workers. The
+// concurrency is 4 by default (when it is zero or negative), and at most 16.
+// The documents are returned in the order of the identifiers, with nil for
+// the missing ones. On the first error of a request, the other requests are
+// canceled and the error is returned.
+func ParallelBulkGetContext(ctx context.Context, db Database, doctype string, ids []string, concurrency int) ([]map[string]interface{}, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if concurrency <= 0 {
+		concurrency = defaultBulkGetConcurrency
+	}
+	if concurrency > maxBulkGetConcurrency {
+		concurrency = maxBulkGetConcurrency
+	}
+	batches := (len(ids) + bulkGetBatchSize - 1) / bulkGetBatchSize
+	if concurrency > batches {
+		concurrency = batches
+	}
+
+	docs := make([]map[string]interface{}, len(ids))
+	starts := make(chan int)
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		defer close(starts)
+		for start := 0; start < len(ids); start += bulkGetBatchSize {
+			select {
+			case starts <- start:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	for i := 0; i < concurrency; i++ {
+		g.Go(func() error {
+			for start := range starts {
+				end := start + bulkGetBatchSize
+				if end > len(ids) {
+					end = len(ids)
+				}
+				// Each batch fills its own part of docs
+				if err := bulkGetBatch(ctx, db, doctype, ids[start:end], docs[start:end]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// bulkGetBatch fetches the documents of a batch, and puts them in docs, at
+// the index of their identifier.
+func bulkGetBatch(ctx context.Context, db Database, doctype string, ids []string, docs []map[string]interface{}) error {
+	payload := make([]IDRev, len(ids))
+	for i, id := range ids {
+		payload[i] = IDRev{ID: id}
+	}
+	body := struct {
+		Docs []IDRev `json:"docs"`
+	}{
+		Docs: payload,
+	}
+	var response bulkGetResults
+	if err := makeRequest(ctx, db, doctype, http.MethodPost, "_bulk_get", body, &response); err != nil {
+		return err
+	}
+	// CouchDB returns the results in the order of the request
+	for i, r := range response.Results {
+		if i >= len(ids) || r.ID != ids[i] {
+			continue
+		}
+		for _, doc := range r.Docs {
+			if doc.OK != nil {
+				docs[i] = doc.OK
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bulkGetServer answers to _bulk_get, after the given latency, with the
+// documents that don't start with missing. It fails for the documents that
+// start with fail.
+type bulkGetServer struct {
+	latency  time.Duration
+	inflight int32
+	max      int32
+	requests int32
+}
+
+func (s *bulkGetServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&s.inflight, 1)
+	defer atomic.AddInt32(&s.inflight, -1)
+	for {
+		max := atomic.LoadInt32(&s.max)
+		if n <= max || atomic.CompareAndSwapInt32(&s.max, max, n) {
+			break
+		}
+	}
+	atomic.AddInt32(&s.requests, 1)
+	var body struct {
+		Docs []IDRev `json:"docs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(body.Docs[0].ID, "fail") {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error":"unknown_error","reason":"badarg"}`))
+		return
+	}
+	select {
+	case <-time.After(s.latency):
+	case <-r.Context().Done():
+		return
+	}
+	var results []string
+	for _, doc := range body.Docs {
+		if strings.HasPrefix(doc.ID, "missing") {
+			results = append(results, fmt.Sprintf(`{"id":%q,"docs":[{"error":{"id":%q,"rev":"undefined","error":"not_found","reason":"missing"}}]}`, doc.ID, doc.ID))
+		} else {
+			results = append(results, fmt.Sprintf(`{"id":%q,"docs":[{"ok":{"_id":%q,"_rev":"1-abc"}}]}`, doc.ID, doc.ID))
+		}
+	}
+	_, _ = w.Write([]byte(`{"results":[` + strings.Join(results, ",") + `]}`))
+}
+
+func bulkGetIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("doc%05d", i)
+	}
+	return ids
+}
+
+func TestParallelBulkGet(t *testing.T) {
+	server := &bulkGetServer{latency: 5 * time.Millisecond}
+	restore := useTestServer(t, server)
+	defer restore()
+
+	ids := bulkGetIDs(1050)
+	ids[7] = "missing7"
+	ids[512] = "missing512"
+	docs, err := ParallelBulkGet(TestPrefix, TestDoctype, ids, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, docs, len(ids)) {
+		for i, id := range ids {
+			if strings.HasPrefix(id, "missing") {
+				assert.Nil(t, docs[i])
+			} else {
+				assert.Equal(t, id, docs[i]["_id"])
+			}
+		}
+	}
+	assert.Equal(t, int32(11), server.requests)
+	assert.Equal(t, int32(defaultBulkGetConcurrency), server.max)
+
+	// The concurrency is capped
+	server.max, server.requests = 0, 0
+	_, err = ParallelBulkGet(TestPrefix, TestDoctype, bulkGetIDs(3000), 100)
+	assert.NoError(t, err)
+	assert.True(t, server.max <= maxBulkGetConcurrency)
+
+	docs, err = ParallelBulkGet(TestPrefix, TestDoctype, nil, 4)
+	assert.NoError(t, err)
+	assert.Empty(t, docs)
+}
+
+func TestParallelBulkGetCancelsOnError(t *testing.T) {
+	server := &bulkGetServer{latency: time.Second}
+	restore := useTestServer(t, server)
+	defer restore()
+
+	ids := bulkGetIDs(1000)
+	ids[300] = "fail300"
+	start := time.Now()
+	docs, err := ParallelBulkGet(TestPrefix, TestDoctype, ids, 4)
+	assert.Nil(t, docs)
+	couchErr, ok := IsCouchError(err)
+	if assert.True(t, ok) {
+		assert.Equal(t, "unknown_error", couchErr.Name)
+	}
+	// The requests in flight have been canceled, and the other batches have
+	// not been sent
+	assert.True(t, time.Since(start) < time.Second)
+	assert.True(t, atomic.LoadInt32(&server.requests) <= 4)
+}
+
+// BenchmarkBulkGet compares the sequential _bulk_get (a concurrency of 1)
+// with the parallel ones, for 3000 documents and a round trip of 2ms.
+func BenchmarkBulkGet(b *testing.B) {
+	server := &bulkGetServer{latency: 2 * time.Millisecond}
+	restore := useTestServer(b, server)
+	defer restore()
+	ids := bulkGetIDs(3000)
+	for _, concurrency := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ParallelBulkGet(TestPrefix, TestDoctype, ids, concurrency); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
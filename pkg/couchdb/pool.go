@@ -0,0 +1,118 @@
+package couchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// errBodyClosed is returned by the reads on a closed request body.
+var errBodyClosed = errors.New("read on a closed request body")
+
+// pooledEncoder is a JSON encoder with its buffer, reused between the
+// requests to encode their bodies.
+type pooledEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		p := &pooledEncoder{}
+		p.enc = json.NewEncoder(&p.buf)
+		return p
+	},
+}
+
+// requestBody is the JSON of the body of a request, in the buffer of a
+// pooled encoder. The HTTP transport can still read a body after the
+// response has been received, so the buffer is put back in the pool only
+// when makeRequest has released it and all the readers have been closed.
+type requestBody struct {
+	data []byte
+	p    *pooledEncoder
+	refs int32
+}
+
+// marshalRequest encodes v like json.Marshal, in a pooled buffer.
+func marshalRequest(v interface{}) (*requestBody, error) {
+	p := encoderPool.Get().(*pooledEncoder)
+	p.buf.Reset()
+	if err := p.enc.Encode(v); err != nil {
+		putEncoder(p)
+		return nil, err
+	}
+	// Encode adds a newline that json.Marshal doesn't
+	data := bytes.TrimSuffix(p.buf.Bytes(), []byte{'\n'})
+	return &requestBody{data: data, p: p, refs: 1}, nil
+}
+
+// reader returns a reader on the body for a request. It must be closed, and
+// the HTTP transport always closes the body of a request.
+func (b *requestBody) reader() io.ReadCloser {
+	atomic.AddInt32(&b.refs, 1)
+	r := &requestBodyReader{body: b}
+	r.r.Reset(b.data)
+	return r
+}
+
+// release is called when makeRequest has finished with the body.
+func (b *requestBody) release() {
+	if atomic.AddInt32(&b.refs, -1) == 0 && b.p != nil {
+		b.data = nil
+		putEncoder(b.p)
+		b.p = nil
+	}
+}
+
+func putEncoder(p *pooledEncoder) {
+	if p.buf.Cap() > maxPooledBuffer {
+		return
+	}
+	p.buf.Reset()
+	encoderPool.Put(p)
+}
+
+// requestBodyReader is a reader on a request body. The HTTP transport can
+// close it from another goroutine, while it is read, so the reads and the
+// close are serialized: once closed, the buffer is never read again.
+type requestBodyReader struct {
+	mu     sync.Mutex
+	r      bytes.Reader
+	body   *requestBody
+	closed bool
+}
+
+func (r *requestBodyReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, errBodyClosed
+	}
+	return r.r.Read(p)
+}
+
+func (r *requestBodyReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		r.closed = true
+		r.r.Reset(nil)
+		r.body.release()
+	}
+	return nil
+}
+
+// readErrorBody reads the body of an error response, with a pooled buffer
+// for the reads, and returns a copy of it.
+func readErrorBody(body io.Reader) ([]byte, error) {
+	buf := getRemarshalBuffer()
+	defer putRemarshalBuffer(buf)
+	if _, err := buf.ReadFrom(body); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
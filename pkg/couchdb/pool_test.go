@@ -0,0 +1,199 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+// cannedTransport reads the request bodies, and answers with the same
+// response to all the requests.
+type cannedTransport struct {
+	status int
+	body   []byte
+}
+
+func (c *cannedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_, _ = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+	}
+	return &http.Response{
+		StatusCode: c.status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(c.body)),
+		Request:    req,
+	}, nil
+}
+
+// checkingTransport checks that the body of each request is the document of
+// its path, and reads half of the bodies after having returned the response,
+// like the HTTP transport can do.
+type checkingTransport struct {
+	t      *testing.T
+	wg     sync.WaitGroup
+	errors int32
+}
+
+func (c *checkingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := path.Base(req.URL.Path)
+	check := func() {
+		defer req.Body.Close()
+		var doc testDoc
+		if err := json.NewDecoder(req.Body).Decode(&doc); err != nil || doc.TestID != id || doc.Test != strings.Repeat(id, 10) {
+			atomic.AddInt32(&c.errors, 1)
+		}
+	}
+	if strings.HasSuffix(id, "0") || strings.HasSuffix(id, "2") || strings.HasSuffix(id, "4") {
+		check()
+	} else {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			check()
+		}()
+	}
+	if req.GetBody != nil && strings.HasSuffix(id, "5") {
+		// A retry of the transport on a new connection
+		body, err := req.GetBody()
+		if err != nil {
+			atomic.AddInt32(&c.errors, 1)
+		} else {
+			data, _ := ioutil.ReadAll(body)
+			body.Close()
+			if !bytes.Contains(data, []byte(`"_id":"`+id+`"`)) {
+				atomic.AddInt32(&c.errors, 1)
+			}
+		}
+	}
+	return &http.Response{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"ok":true,"id":"` + id + `","rev":"1-abc"}`)),
+		Request:    req,
+	}, nil
+}
+
+// TestPooledRequestBodies sends many requests in parallel, with bodies of
+// different sizes, to check with the race detector that a pooled buffer is
+// never shared by two requests.
+func TestPooledRequestBodies(t *testing.T) {
+	transport := &checkingTransport{t: t}
+	SetTransport(transport)
+	defer SetClient(nil)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := fmt.Sprintf("doc-%d-%d", g, i)
+				doc := &testDoc{TestID: id, Test: strings.Repeat(id, 10)}
+				if i%50 == 0 {
+					doc.FieldA = strings.Repeat("x", maxPooledBuffer+1)
+				}
+				var res UpdateResponse
+				err := makeRequest(context.Background(), TestPrefix, TestDoctype, http.MethodPut, id, doc, &res)
+				assert.NoError(t, err)
+				assert.Equal(t, id, res.ID)
+			}
+		}(g)
+	}
+	wg.Wait()
+	transport.wg.Wait()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&transport.errors))
+}
+
+func TestMarshalRequest(t *testing.T) {
+	for _, v := range []interface{}{
+		map[string]interface{}{"html": "<a href=\"x\">&</a>", "n": 1.5},
+		&testDoc{TestID: "foo", Test: "bar"},
+		json.RawMessage(`{"a":  [1, 2]}`),
+		[]string{"a", "b"},
+	} {
+		expected, err := json.Marshal(v)
+		assert.NoError(t, err)
+		body, err := marshalRequest(v)
+		if assert.NoError(t, err) {
+			assert.Equal(t, string(expected), string(body.data))
+			r := body.reader()
+			body.release()
+			data, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, string(expected), string(data))
+			assert.NoError(t, r.Close())
+			assert.NoError(t, r.Close())
+			_, err = r.Read(make([]byte, 1))
+			assert.Error(t, err)
+		}
+	}
+	_, err := marshalRequest(make(chan int))
+	assert.Error(t, err)
+}
+
+func BenchmarkMakeRequestSmallDoc(b *testing.B) {
+	SetTransport(&cannedTransport{status: http.StatusCreated, body: []byte(`{"ok":true,"id":"foo","rev":"2-abc"}`)})
+	defer SetClient(nil)
+	doc := &testDoc{TestID: "foo", TestRev: "1-abc", Test: "a small document", FieldA: "bar", FieldB: 42}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var res UpdateResponse
+		if err := makeRequest(ctx, TestPrefix, TestDoctype, http.MethodPut, "foo", doc, &res); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMakeRequestQuery1k(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString(`{"docs":[`)
+	for i := 0; i < 1000; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, `{"_id":"doc%04d","_rev":"1-abc","test":"value %d","fieldA":"a","fieldB":%d}`, i, i, i)
+	}
+	sb.WriteString(`]}`)
+	SetTransport(&cannedTransport{status: http.StatusOK, body: []byte(sb.String())})
+	defer SetClient(nil)
+	req := &FindRequest{
+		Selector: mango.And(mango.Equal("test", "value"), mango.Gt("fieldB", 10)),
+		Limit:    1000,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var docs []testDoc
+		if err := FindDocs(TestPrefix, TestDoctype, req, &docs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMakeRequestError(b *testing.B) {
+	SetTransport(&cannedTransport{status: http.StatusNotFound, body: []byte(`{"error":"not_found","reason":"missing"}`)})
+	defer SetClient(nil)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out json.RawMessage
+		if err := makeRequest(ctx, TestPrefix, TestDoctype, http.MethodGet, "foo", nil, &out); !IsNotFoundError(err) {
+			b.Fatal(err)
+		}
+	}
+}
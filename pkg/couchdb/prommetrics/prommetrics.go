@@ -0,0 +1,241 @@
+// Package prommetrics exports the metrics of the requests made to CouchDB to
+// Prometheus. It is built on the couchdb.MetricsCollector hooks, and is kept
+// in its own package so that the couchdb package does not depend on the
+// Prometheus client.
+package prommetrics
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a couchdb.MetricsCollector that exports the metrics to
+// Prometheus. It is also a prometheus.Collector, so that it can be
+// registered as a whole.
+type Collector struct {
+	durations *prometheus.HistogramVec
+	retries   *prometheus.CounterVec
+	errors    *prometheus.CounterVec
+	feeds     *prometheus.GaugeVec
+	cache     *prometheus.CounterVec
+	validated *prometheus.CounterVec
+	saved     *prometheus.CounterVec
+	saturated *prometheus.CounterVec
+}
+
+// New returns a new Collector. It must be registered to a Prometheus
+// registry and set with couchdb.SetMetricsCollector to be used, see Register
+// and Init.
+func New() *Collector {
+	return &Collector{
+		durations: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "couchdb",
+				Subsystem: "request",
+				Name:      "duration_seconds",
+
+				Help: `Duration in seconds of the requests made to CouchDB, retries included, labelled
+by method, doctype and class of the status code (2xx, 4xx, 5xx, or error when
+no response has been received).`,
+
+				Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+			},
+			[]string{"method", "doctype", "status"},
+		),
+		retries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "couchdb",
+				Subsystem: "request",
+				Name:      "retries_total",
+
+				Help: `Number of retries of the requests made to CouchDB, labelled by method and doctype.`,
+			},
+			[]string{"method", "doctype"},
+		),
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "couchdb",
+				Subsystem: "request",
+				Name:      "errors_total",
+
+				Help: `Number of requests made to CouchDB that have failed, labelled by kind of error.`,
+			},
+			[]string{"kind"},
+		),
+		feeds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "couchdb",
+				Subsystem: "feeds",
+				Name:      "open",
+
+				Help: `Number of streaming requests to CouchDB, like the changes feeds, currently open,
+labelled by doctype.`,
+			},
+			[]string{"doctype"},
+		),
+		cache: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "couchdb",
+				Subsystem: "doc_cache",
+				Name:      "lookups_total",
+
+				Help: `Number of documents looked up in the cache of the documents, labelled by doctype
+and result (hit or miss).`,
+			},
+			[]string{"doctype", "result"},
+		),
+		validated: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "couchdb",
+				Subsystem: "validation_cache",
+				Name:      "reads_total",
+
+				Help: `Number of documents read with the validation cache, labelled by doctype and result
+(not_modified when CouchDB has answered 304, or modified).`,
+			},
+			[]string{"doctype", "result"},
+		),
+		saved: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "couchdb",
+				Subsystem: "validation_cache",
+				Name:      "saved_bytes_total",
+
+				Help: `Size in bytes of the documents that CouchDB has not sent again thanks to the
+validation cache, labelled by doctype.`,
+			},
+			[]string{"doctype"},
+		),
+		saturated: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "couchdb",
+				Subsystem: "concurrency",
+				Name:      "saturated_total",
+
+				Help: `Number of requests to CouchDB that have waited for a slot, as the limit of requests
+in flight was reached, labelled by slots (requests, prefix or feeds).`,
+			},
+			[]string{"slots"},
+		),
+	}
+}
+
+// Describe is part of the prometheus.Collector interface.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.durations.Describe(ch)
+	c.retries.Describe(ch)
+	c.errors.Describe(ch)
+	c.feeds.Describe(ch)
+	c.cache.Describe(ch)
+	c.validated.Describe(ch)
+	c.saved.Describe(ch)
+	c.saturated.Describe(ch)
+}
+
+// Collect is part of the prometheus.Collector interface.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.durations.Collect(ch)
+	c.retries.Collect(ch)
+	c.errors.Collect(ch)
+	c.feeds.Collect(ch)
+	c.cache.Collect(ch)
+	c.validated.Collect(ch)
+	c.saved.Collect(ch)
+	c.saturated.Collect(ch)
+}
+
+// ObserveRequest is part of the couchdb.MetricsCollector interface.
+func (c *Collector) ObserveRequest(method, doctype string, status int, duration time.Duration) {
+	c.durations.WithLabelValues(method, doctype, statusClass(status)).Observe(duration.Seconds())
+}
+
+// ObserveRetry is part of the couchdb.MetricsCollector interface.
+func (c *Collector) ObserveRetry(method, doctype string) {
+	c.retries.WithLabelValues(method, doctype).Inc()
+}
+
+// ObserveError is part of the couchdb.MetricsCollector interface.
+func (c *Collector) ObserveError(kind string) {
+	c.errors.WithLabelValues(kind).Inc()
+}
+
+// ObserveFeedOpened is part of the couchdb.FeedMetricsCollector interface.
+func (c *Collector) ObserveFeedOpened(doctype string) {
+	c.feeds.WithLabelValues(doctype).Inc()
+}
+
+// ObserveFeedClosed is part of the couchdb.FeedMetricsCollector interface.
+func (c *Collector) ObserveFeedClosed(doctype string) {
+	c.feeds.WithLabelValues(doctype).Dec()
+}
+
+// ObserveCacheHit is part of the couchdb.CacheMetricsCollector interface.
+func (c *Collector) ObserveCacheHit(doctype string) {
+	c.cache.WithLabelValues(doctype, "hit").Inc()
+}
+
+// ObserveCacheMiss is part of the couchdb.CacheMetricsCollector interface.
+func (c *Collector) ObserveCacheMiss(doctype string) {
+	c.cache.WithLabelValues(doctype, "miss").Inc()
+}
+
+// ObserveNotModified is part of the couchdb.ValidationMetricsCollector
+// interface.
+func (c *Collector) ObserveNotModified(doctype string, savedBytes int) {
+	c.validated.WithLabelValues(doctype, "not_modified").Inc()
+	c.saved.WithLabelValues(doctype).Add(float64(savedBytes))
+}
+
+// ObserveModified is part of the couchdb.ValidationMetricsCollector
+// interface.
+func (c *Collector) ObserveModified(doctype string) {
+	c.validated.WithLabelValues(doctype, "modified").Inc()
+}
+
+// ObserveSaturated is part of the couchdb.SaturationMetricsCollector
+// interface.
+func (c *Collector) ObserveSaturated(slots string) {
+	c.saturated.WithLabelValues(slots).Inc()
+}
+
+// statusClass returns the label for a status code, to keep the cardinality
+// of the histogram low.
+func statusClass(status int) string {
+	if status <= 0 {
+		return "error"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// Register registers a new Collector to the given registry, and returns it.
+// If a Collector has already been registered, it is returned instead, so
+// that Register can be called several times without error.
+func Register(reg prometheus.Registerer) (*Collector, error) {
+	c := New()
+	if err := reg.Register(c); err != nil {
+		var already prometheus.AlreadyRegisteredError
+		if errors.As(err, &already) {
+			if existing, ok := already.ExistingCollector.(*Collector); ok {
+				return existing, nil
+			}
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// Init registers a Collector to the default Prometheus registry and uses it
+// for the requests made to CouchDB. It can be called several times. The stack
+// calls it on startup when the couchdb.prometheus option is enabled.
+func Init() error {
+	c, err := Register(prometheus.DefaultRegisterer)
+	if err != nil {
+		return err
+	}
+	couchdb.SetMetricsCollector(c)
+	return nil
+}
@@ -0,0 +1,65 @@
+package prommetrics
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegister(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c1, err := Register(reg)
+	assert.NoError(t, err)
+	c2, err := Register(reg)
+	assert.NoError(t, err)
+	assert.True(t, c1 == c2)
+
+	c1.ObserveRequest("GET", "io.cozy.files", 200, 10*time.Millisecond)
+	c1.ObserveRequest("GET", "io.cozy.files", 404, 10*time.Millisecond)
+	c1.ObserveRequest("PUT", "io.cozy.files", 0, time.Second)
+	c1.ObserveRetry("GET", "io.cozy.files")
+	c1.ObserveError(couchdb.ErrorKindConnection)
+	c1.ObserveFeedOpened("io.cozy.files")
+	c1.ObserveFeedOpened("io.cozy.files")
+	c1.ObserveFeedClosed("io.cozy.files")
+	c1.ObserveCacheHit("io.cozy.settings")
+	c1.ObserveCacheHit("io.cozy.settings")
+	c1.ObserveCacheMiss("io.cozy.settings")
+	c1.ObserveNotModified("io.cozy.apps", 1200)
+	c1.ObserveNotModified("io.cozy.apps", 800)
+	c1.ObserveModified("io.cozy.apps")
+	c1.ObserveSaturated("feeds")
+
+	assert.Equal(t, 3, testutil.CollectAndCount(c1.durations))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c1.retries.WithLabelValues("GET", "io.cozy.files")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c1.errors.WithLabelValues("connection")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c1.feeds.WithLabelValues("io.cozy.files")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(c1.cache.WithLabelValues("io.cozy.settings", "hit")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c1.cache.WithLabelValues("io.cozy.settings", "miss")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(c1.validated.WithLabelValues("io.cozy.apps", "not_modified")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c1.validated.WithLabelValues("io.cozy.apps", "modified")))
+	assert.Equal(t, 2000.0, testutil.ToFloat64(c1.saved.WithLabelValues("io.cozy.apps")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c1.saturated.WithLabelValues("feeds")))
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "error", statusClass(0))
+	assert.Equal(t, "2xx", statusClass(201))
+	assert.Equal(t, "4xx", statusClass(409))
+	assert.Equal(t, "5xx", statusClass(503))
+}
+
+func Example() {
+	// Export the metrics of the requests made to CouchDB on the default
+	// Prometheus registry, and serve them on /metrics.
+	if err := Init(); err != nil {
+		panic(err)
+	}
+	http.Handle("/metrics", promhttp.Handler())
+}
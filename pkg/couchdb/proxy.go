@@ -2,6 +2,7 @@ package couchdb
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -9,7 +10,6 @@ import (
 	"net/url"
 	"strings"
 
-	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/labstack/echo/v4"
 )
@@ -17,33 +17,21 @@ import (
 // Proxy generate a httputil.ReverseProxy which forwards the request to the
 // correct route.
 func Proxy(db Database, doctype, path string) *httputil.ReverseProxy {
-	couchURL := config.CouchURL()
-	couchAuth := config.GetConfig().CouchDB.Auth
-
+	cl := clusterFor(context.Background(), doctype)
 	director := func(req *http.Request) {
+		couchURL := pickNode(cl.urls, nil)
 		req.URL.Scheme = couchURL.Scheme
 		req.URL.Host = couchURL.Host
 		req.Header.Del(echo.HeaderAuthorization) // drop stack auth
 		req.Header.Del(echo.HeaderCookie)
-		req.URL.RawPath = "/" + makeDBName(db, doctype) + "/" + path
+		req.URL.RawPath = nodePath(couchURL, makeDBName(db, doctype)+"/"+path)
 		req.URL.Path, _ = url.PathUnescape(req.URL.RawPath)
-		if couchAuth != nil {
-			if p, ok := couchAuth.Password(); ok {
-				req.SetBasicAuth(couchAuth.Username(), p)
-			}
-		}
-	}
-
-	var transport http.RoundTripper
-	if client := config.GetConfig().CouchDB.Client; client != nil {
-		transport = client.Transport
-	} else {
-		transport = http.DefaultTransport
+		setAuth(db, cl, req)
 	}
 
 	return &httputil.ReverseProxy{
 		Director:  director,
-		Transport: transport,
+		Transport: httpTransport(),
 	}
 }
 
@@ -52,6 +40,10 @@ func Proxy(db Database, doctype, path string) *httputil.ReverseProxy {
 // mutate many document in database, the stack has to read the response from
 // couch to emit the correct realtime events.
 func ProxyBulkDocs(db Database, doctype string, req *http.Request) (*httputil.ReverseProxy, *http.Request, error) {
+	if isReadOnly(db) {
+		return nil, nil, newReadOnlyError()
+	}
+
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		return nil, nil, err
@@ -75,16 +67,9 @@ func ProxyBulkDocs(db Database, doctype string, req *http.Request) (*httputil.Re
 	// reset body to proxy
 	req.Body = ioutil.NopCloser(bytes.NewReader(body))
 
-	var transport http.RoundTripper
-	if client := config.GetConfig().CouchDB.Client; client != nil {
-		transport = client.Transport
-	} else {
-		transport = http.DefaultTransport
-	}
-
-	p := Proxy(db, doctype, "/_bulk_docs")
+	p := Proxy(db, doctype, "_bulk_docs")
 	p.Transport = &bulkTransport{
-		RoundTripper: transport,
+		RoundTripper: httpTransport(),
 		OnResponseRead: func(data []byte) {
 			type respValue struct {
 				ID    string `json:"id"`
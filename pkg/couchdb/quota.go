@@ -0,0 +1,225 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaChecker is consulted before the writes that can make the databases of
+// an instance grow: the creations and updates of documents, in bulk or not,
+// with their attachments. The deletions and the reads are never checked.
+type QuotaChecker interface {
+	// CheckQuota returns an error matching ErrQuotaExceeded if the instance
+	// cannot use size more bytes. The size is an estimation, and it is 0
+	// when the body of the request is streamed.
+	CheckQuota(ctx context.Context, db Database, size int64) error
+}
+
+var (
+	quotaMu      sync.RWMutex
+	quotaChecker QuotaChecker
+)
+
+// SetQuotaChecker sets the checker consulted before the writes, or removes
+// it with nil (the default).
+func SetQuotaChecker(checker QuotaChecker) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	quotaChecker = checker
+}
+
+func getQuotaChecker() QuotaChecker {
+	quotaMu.RLock()
+	defer quotaMu.RUnlock()
+	return quotaChecker
+}
+
+// checkQuota consults the quota checker, if any, before a request that
+// writes to CouchDB. The size is the one of the encoded body, when it is
+// known. The deletions are always allowed, but as the body has to be parsed
+// to know it, it is done only when the quota is exceeded.
+func checkQuota(ctx context.Context, db Database, method, path string, reqjson []byte, bulk *bulkDocsBody) error {
+	checker := getQuotaChecker()
+	if checker == nil || !growsData(method, path) {
+		return nil
+	}
+	err := checker.CheckQuota(ctx, db, int64(len(reqjson)))
+	if err != nil && isDeletion(reqjson, bulk) {
+		return nil
+	}
+	return err
+}
+
+// growsData returns true for the requests that create or update documents:
+// a POST on the database or on _bulk_docs, and a PUT of a document or of an
+// attachment. The creation of a database, the design and local documents,
+// and the maintenance requests are not counted.
+func growsData(method, path string) bool {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	switch method {
+	case http.MethodPost:
+		return path == "" || path == "_bulk_docs"
+	case http.MethodPut:
+		return path != "" && !strings.HasPrefix(path, "_")
+	}
+	return false
+}
+
+// isDeletion returns true if the body only deletes documents.
+func isDeletion(reqjson []byte, bulk *bulkDocsBody) bool {
+	type deleted struct {
+		Deleted bool `json:"_deleted"`
+	}
+	if bulk != nil && reqjson == nil {
+		for i := 0; i < bulk.n; i++ {
+			data, err := json.Marshal(bulk.doc(i))
+			var d deleted
+			if err != nil || json.Unmarshal(data, &d) != nil || !d.Deleted {
+				return false
+			}
+		}
+		return bulk.n > 0
+	}
+	var body struct {
+		deleted
+		Docs []deleted `json:"docs"`
+	}
+	if len(reqjson) == 0 || json.Unmarshal(reqjson, &body) != nil {
+		return false
+	}
+	if body.Docs == nil {
+		return body.Deleted
+	}
+	for _, d := range body.Docs {
+		if !d.Deleted {
+			return false
+		}
+	}
+	return len(body.Docs) > 0
+}
+
+func newQuotaExceededError(used, size, limit int64) error {
+	return &Error{
+		StatusCode: http.StatusInsufficientStorage,
+		Name:       "quota_exceeded",
+		Reason: fmt.Sprintf("the databases of the instance use %d bytes, and %d more would exceed the quota of %d bytes",
+			used, size, limit),
+	}
+}
+
+// DefaultQuotaTTL is how long DiskUsageQuota uses the disk usage of an
+// instance before refreshing it.
+const DefaultQuotaTTL = 5 * time.Minute
+
+// DiskUsageQuota is a QuotaChecker that compares the size on the disk of the
+// databases of an instance, from DoctypeReport, with its quota. The usage is
+// cached by prefix: it is fetched on the first write, and then refreshed in
+// the background when it is older than the TTL, while the writes are checked
+// against the cached value (plus what they have added since).
+type DiskUsageQuota struct {
+	limit func(db Database) int64
+	ttl   time.Duration
+
+	mu     sync.Mutex
+	usages map[string]*diskUsage
+}
+
+type diskUsage struct {
+	used       int64
+	fetchedAt  time.Time
+	refreshing bool
+}
+
+// NewDiskUsageQuota returns a DiskUsageQuota. The limit function gives the
+// quota in bytes of an instance, or 0 for no quota. A ttl of 0 means
+// DefaultQuotaTTL.
+func NewDiskUsageQuota(limit func(db Database) int64, ttl time.Duration) *DiskUsageQuota {
+	if ttl <= 0 {
+		ttl = DefaultQuotaTTL
+	}
+	return &DiskUsageQuota{
+		limit:  limit,
+		ttl:    ttl,
+		usages: make(map[string]*diskUsage),
+	}
+}
+
+// CheckQuota implements the QuotaChecker interface. If the disk usage cannot
+// be fetched, the write is allowed.
+func (q *DiskUsageQuota) CheckQuota(ctx context.Context, db Database, size int64) error {
+	limit := q.limit(db)
+	if limit <= 0 {
+		return nil
+	}
+	prefix := db.DBPrefix()
+	q.mu.Lock()
+	usage, ok := q.usages[prefix]
+	q.mu.Unlock()
+	if !ok {
+		used, err := diskUsageOf(ctx, db)
+		if err != nil {
+			loggerFor(db).Warnf("cannot fetch the disk usage for the quota: %s", err)
+			return nil
+		}
+		q.mu.Lock()
+		if usage, ok = q.usages[prefix]; !ok {
+			usage = &diskUsage{used: used, fetchedAt: time.Now()}
+			q.usages[prefix] = usage
+		}
+		q.mu.Unlock()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !usage.refreshing && time.Since(usage.fetchedAt) > q.ttl {
+		usage.refreshing = true
+		go q.refresh(db, usage)
+	}
+	if usage.used+size > limit {
+		return newQuotaExceededError(usage.used, size, limit)
+	}
+	usage.used += size
+	return nil
+}
+
+// Forget removes the cached disk usage of an instance, for example after a
+// change of its quota or a cleanup, so that it is fetched on the next write.
+func (q *DiskUsageQuota) Forget(db Database) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.usages, db.DBPrefix())
+}
+
+func (q *DiskUsageQuota) refresh(db Database, usage *diskUsage) {
+	// The refresh is not tied to the request that has triggered it
+	used, err := diskUsageOf(context.Background(), db)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage.refreshing = false
+	if err != nil {
+		loggerFor(db).Warnf("cannot refresh the disk usage for the quota: %s", err)
+		return
+	}
+	usage.used = used
+	usage.fetchedAt = time.Now()
+}
+
+// diskUsageOf returns the size on the disk of the databases of an instance.
+func diskUsageOf(ctx context.Context, db Database) (int64, error) {
+	stats, err := DoctypeReportContext(ctx, db, DoctypeReportOptions{})
+	if err != nil {
+		return 0, err
+	}
+	var used int64
+	for _, s := range stats {
+		used += int64(s.FileSize)
+	}
+	return used, nil
+}
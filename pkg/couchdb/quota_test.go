@@ -0,0 +1,155 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeQuota struct {
+	mu     sync.Mutex
+	sizes  []int64
+	refuse bool
+}
+
+func (q *fakeQuota) CheckQuota(ctx context.Context, db Database, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sizes = append(q.sizes, size)
+	if q.refuse {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func TestGrowsData(t *testing.T) {
+	grows := []struct{ method, path string }{
+		{"POST", ""},
+		{"POST", "_bulk_docs"},
+		{"PUT", "foo"},
+		{"PUT", "foo/thumb?rev=1-abc"},
+	}
+	for _, r := range grows {
+		assert.True(t, growsData(r.method, r.path), "%s %s", r.method, r.path)
+	}
+	others := []struct{ method, path string }{
+		{"GET", "foo"},
+		{"DELETE", "foo?rev=1-abc"},
+		{"PUT", ""},
+		{"PUT", "_local/foo"},
+		{"PUT", "_design/foo"},
+		{"POST", "_find"},
+		{"POST", "_index"},
+		{"POST", "_purge"},
+	}
+	for _, r := range others {
+		assert.False(t, growsData(r.method, r.path), "%s %s", r.method, r.path)
+	}
+}
+
+func TestQuotaChecker(t *testing.T) {
+	var writes int
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writes++
+		}
+		if strings.HasSuffix(r.URL.Path, "_bulk_docs") {
+			var body struct {
+				Docs []map[string]interface{} `json:"docs"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			rows := make([]string, len(body.Docs))
+			for i, doc := range body.Docs {
+				rows[i] = fmt.Sprintf(`{"ok":true,"id":%q,"rev":"2-abc"}`, doc["_id"])
+			}
+			_, _ = fmt.Fprintf(w, "[%s]", strings.Join(rows, ","))
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"ok":true,"id":"foo","rev":"1-abc"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc"}`))
+	}))
+	defer restore()
+	quota := &fakeQuota{}
+	SetQuotaChecker(quota)
+	defer SetQuotaChecker(nil)
+
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"title": "hello"}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &JSONDoc{}))
+	if assert.Len(t, quota.sizes, 1) {
+		assert.True(t, quota.sizes[0] > 0)
+	}
+
+	quota.refuse = true
+	writes = 0
+	err := UpdateDoc(TestPrefix, doc)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	other := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "bar", "_rev": "1-abc"}}
+	err = BulkUpdateDocs(TestPrefix, TestDoctype, []interface{}{doc, other}, nil)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	assert.Equal(t, 0, writes)
+
+	// The reads and the deletions are never blocked
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &JSONDoc{}))
+	assert.NoError(t, DeleteDoc(TestPrefix, doc))
+	other.M["_deleted"] = true
+	assert.NoError(t, BulkUpdateDocs(TestPrefix, TestDoctype, []interface{}{other}, nil))
+	assert.Equal(t, 2, writes)
+}
+
+func TestDiskUsageQuota(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := newMemCouch()
+	restore := useTestServer(t, server)
+	defer restore()
+
+	db := prefixer.NewPrefixer("quota.cozy.tools", "quota")
+	unlimited := prefixer.NewPrefixer("unlimited.cozy.tools", "unlimited")
+	server.seed(db, "io.cozy.tests.notes", `{"_id":"note1","title":"hello"}`)
+	server.seed(db, "io.cozy.tests.todos", `{"_id":"todo1"}`)
+	used := int64(0)
+	for _, docs := range server.dbs {
+		for _, doc := range docs {
+			data, _ := json.Marshal(doc)
+			used += int64(len(data))
+		}
+	}
+
+	quota := NewDiskUsageQuota(func(d Database) int64 {
+		if d.DBPrefix() == unlimited.DBPrefix() {
+			return 0
+		}
+		return used + 100
+	}, 10*time.Millisecond)
+	ctx := context.Background()
+	assert.NoError(t, quota.CheckQuota(ctx, unlimited, 1000))
+	assert.NoError(t, quota.CheckQuota(ctx, db, 60))
+	// The writes allowed since the last fetch are counted
+	err := quota.CheckQuota(ctx, db, 60)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	// The usage is refreshed in the background
+	server.mu.Lock()
+	delete(server.dbs, EscapeCouchdbName(db.DBPrefix()+"/io.cozy.tests.todos"))
+	server.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return quota.CheckQuota(ctx, db, 60) == nil
+	}, time.Second, 5*time.Millisecond)
+
+	quota.Forget(db)
+	assert.True(t, errors.Is(quota.CheckQuota(ctx, db, 200), ErrQuotaExceeded))
+}
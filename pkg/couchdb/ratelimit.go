@@ -0,0 +1,179 @@
+package couchdb
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// RateLimitUsage is the current usage of the rate limit of an instance.
+type RateLimitUsage struct {
+	Prefix string  `json:"prefix"`
+	Rate   float64 `json:"rate"`
+	Burst  int     `json:"burst"`
+	// Available is the number of requests that can be made right now
+	Available float64 `json:"available"`
+}
+
+// bucket is a token bucket for the requests of an instance.
+type bucket struct {
+	prefix string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per instance. The buckets are kept in a
+// LRU list, and the least recently used one is evicted when there are too
+// many instances.
+type rateLimiter struct {
+	mu      sync.Mutex
+	conf    config.CouchDBRateLimit
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+func newRateLimiter(conf config.CouchDBRateLimit) *rateLimiter {
+	return &rateLimiter{
+		conf:    conf,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+var (
+	limiterMu sync.Mutex
+	limiter   *rateLimiter
+)
+
+// getRateLimiter returns the rate limiter for the current configuration, or
+// nil if the rate limiting is disabled.
+func getRateLimiter() *rateLimiter {
+	conf := config.GetConfig().CouchDB.RateLimit
+	if conf.Rate <= 0 {
+		return nil
+	}
+	if conf.Burst < 1 {
+		conf.Burst = 1
+	}
+	limiterMu.Lock()
+	defer limiterMu.Unlock()
+	if limiter == nil || limiter.conf != conf {
+		limiter = newRateLimiter(conf)
+	}
+	return limiter
+}
+
+// isRateLimited returns true for the databases whose requests are limited:
+// the databases of the instances, not the global ones.
+func isRateLimited(db Database) bool {
+	prefix := db.DBPrefix()
+	return prefix != GlobalDB.DBPrefix() && prefix != GlobalSecretsDB.DBPrefix()
+}
+
+// waitRateLimit checks that the instance of the given database can make a
+// request to CouchDB. If the limit is exceeded, it returns an error, or
+// waits for a token if the configuration allows it and the deadline of the
+// context is not too close.
+func waitRateLimit(ctx context.Context, db Database) error {
+	l := getRateLimiter()
+	if l == nil || !isRateLimited(db) {
+		return nil
+	}
+	maxWait := time.Duration(0)
+	if l.conf.Wait {
+		maxWait = time.Duration(math.MaxInt64)
+		if deadline, ok := ctx.Deadline(); ok {
+			maxWait = time.Until(deadline)
+		}
+	}
+	delay, ok := l.reserve(db.DBPrefix(), time.Now(), maxWait)
+	if !ok {
+		return newRateLimitedError()
+	}
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// get returns the bucket for the given prefix, with its tokens refilled up
+// to now. It must be called with the lock held.
+func (l *rateLimiter) get(prefix string, now time.Time) *bucket {
+	if elem, ok := l.buckets[prefix]; ok {
+		l.lru.MoveToFront(elem)
+		b := elem.Value.(*bucket)
+		if elapsed := now.Sub(b.last); elapsed > 0 {
+			b.tokens += elapsed.Seconds() * l.conf.Rate
+			if b.tokens > float64(l.conf.Burst) {
+				b.tokens = float64(l.conf.Burst)
+			}
+			b.last = now
+		}
+		return b
+	}
+	b := &bucket{prefix: prefix, tokens: float64(l.conf.Burst), last: now}
+	l.buckets[prefix] = l.lru.PushFront(b)
+	if l.conf.MaxPrefixes > 0 {
+		for l.lru.Len() > l.conf.MaxPrefixes {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).prefix)
+		}
+	}
+	return b
+}
+
+// reserve takes a token from the bucket of the given prefix, and returns
+// how long the caller must wait before the token is really available. If
+// this delay is more than maxWait, no token is taken and false is returned.
+func (l *rateLimiter) reserve(prefix string, now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.get(prefix, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	delay := time.Duration((1 - b.tokens) / l.conf.Rate * float64(time.Second))
+	if delay > maxWait {
+		return 0, false
+	}
+	b.tokens--
+	return delay, true
+}
+
+// GetRateLimitUsage returns the current usage of the rate limit for the
+// given database, or nil if the rate limiting is disabled.
+func GetRateLimitUsage(db Database) *RateLimitUsage {
+	l := getRateLimiter()
+	if l == nil || !isRateLimited(db) {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	usage := &RateLimitUsage{
+		Prefix:    db.DBPrefix(),
+		Rate:      l.conf.Rate,
+		Burst:     l.conf.Burst,
+		Available: float64(l.conf.Burst),
+	}
+	if elem, ok := l.buckets[db.DBPrefix()]; ok {
+		b := elem.Value.(*bucket)
+		tokens := b.tokens + time.Since(b.last).Seconds()*l.conf.Rate
+		if tokens < float64(l.conf.Burst) {
+			usage.Available = tokens
+		}
+	}
+	return usage
+}
@@ -0,0 +1,83 @@
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterBucket(t *testing.T) {
+	l := newRateLimiter(config.CouchDBRateLimit{Rate: 10, Burst: 2, MaxPrefixes: 2})
+	now := time.Now()
+
+	_, ok := l.reserve("alice", now, 0)
+	assert.True(t, ok)
+	_, ok = l.reserve("alice", now, 0)
+	assert.True(t, ok)
+	_, ok = l.reserve("alice", now, 0)
+	assert.False(t, ok)
+
+	// A token is added every 100ms
+	delay, ok := l.reserve("alice", now, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, delay)
+	_, ok = l.reserve("alice", now.Add(200*time.Millisecond), 0)
+	assert.True(t, ok)
+
+	// The buckets of the least recently used prefixes are evicted
+	_, ok = l.reserve("bob", now, 0)
+	assert.True(t, ok)
+	_, ok = l.reserve("charlie", now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, 2, l.lru.Len())
+	assert.NotContains(t, l.buckets, "alice")
+	assert.Contains(t, l.buckets, "bob")
+	assert.Contains(t, l.buckets, "charlie")
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"db_name":"foo","doc_count":0}`))
+	}))
+	defer restore()
+	config.GetConfig().CouchDB.RateLimit = config.CouchDBRateLimit{Rate: 1, Burst: 1}
+
+	db := prefixer.NewPrefixer("ratelimit.cozy.tools", fmt.Sprintf("ratelimit%d", time.Now().UnixNano()))
+	_, err := DBStatus(db, TestDoctype)
+	assert.NoError(t, err)
+	_, err = DBStatus(db, TestDoctype)
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	couchErr, ok := IsCouchError(err)
+	if assert.True(t, ok) {
+		assert.Equal(t, http.StatusTooManyRequests, couchErr.StatusCode)
+	}
+
+	// The global databases are not limited
+	_, err = DBStatus(GlobalDB, TestDoctype)
+	assert.NoError(t, err)
+	_, err = DBStatus(GlobalDB, TestDoctype)
+	assert.NoError(t, err)
+
+	usage := GetRateLimitUsage(db)
+	if assert.NotNil(t, usage) {
+		assert.Equal(t, 1, usage.Burst)
+		assert.True(t, usage.Available < 1)
+	}
+
+	// In wait mode, the request waits for a token, unless the deadline is too
+	// close
+	config.GetConfig().CouchDB.RateLimit.Wait = true
+	_, err = DBStatus(db, TestDoctype)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = DBStatusContext(ctx, db, TestDoctype)
+	assert.True(t, errors.Is(err, ErrRateLimited))
+}
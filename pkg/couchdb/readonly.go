@@ -0,0 +1,95 @@
+package couchdb
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	readOnly int32 // 1 when all the writes are refused
+
+	readOnlyMu       sync.RWMutex
+	readOnlyPrefixes map[string]bool
+)
+
+// SetReadOnly puts the stack in read-only mode for CouchDB, or gets it out of
+// this mode. In read-only mode, the requests that write to CouchDB are
+// refused with an error (ErrReadOnly), without being sent, while the reads
+// still work. It is meant for the maintenances of CouchDB.
+func SetReadOnly(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&readOnly, v)
+}
+
+// SetReadOnlyPrefix is like SetReadOnly, but only for the databases of the
+// given prefix, for example while an instance is migrated.
+func SetReadOnlyPrefix(prefix string, enabled bool) {
+	readOnlyMu.Lock()
+	defer readOnlyMu.Unlock()
+	if enabled {
+		if readOnlyPrefixes == nil {
+			readOnlyPrefixes = make(map[string]bool)
+		}
+		readOnlyPrefixes[prefix] = true
+	} else {
+		delete(readOnlyPrefixes, prefix)
+	}
+}
+
+func isReadOnly(db Database) bool {
+	if atomic.LoadInt32(&readOnly) == 1 {
+		return true
+	}
+	readOnlyMu.RLock()
+	defer readOnlyMu.RUnlock()
+	return len(readOnlyPrefixes) > 0 && readOnlyPrefixes[db.DBPrefix()]
+}
+
+// readEndpoints are the endpoints of CouchDB that accept a POST but don't
+// write anything: the POST is used to send the parameters in the body.
+var readEndpoints = map[string]bool{
+	"_find":         true,
+	"_explain":      true,
+	"_all_docs":     true,
+	"_design_docs":  true,
+	"_local_docs":   true,
+	"_bulk_get":     true,
+	"_changes":      true,
+	"_view":         true,
+	"_revs_diff":    true,
+	"_missing_revs": true,
+}
+
+// isWrite returns true if a request to CouchDB with this method and path
+// (without the database) can modify the data.
+func isWrite(method, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	case http.MethodPost:
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		for _, segment := range strings.Split(path, "/") {
+			if readEndpoints[segment] {
+				return false
+			}
+		}
+	}
+	// PUT, DELETE, COPY, and the POST for creating a document, _bulk_docs,
+	// _purge, _index, _compact, etc.
+	return true
+}
+
+func newReadOnlyError() error {
+	return &Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Name:       "read_only",
+		Reason:     "CouchDB is in read-only mode for a maintenance",
+	}
+}
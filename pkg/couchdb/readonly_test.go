@@ -0,0 +1,85 @@
+package couchdb
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsWrite(t *testing.T) {
+	reads := []struct{ method, path string }{
+		{"GET", "foo"},
+		{"HEAD", "foo"},
+		{"GET", "_all_dbs"},
+		{"POST", "_find"},
+		{"POST", "_explain"},
+		{"POST", "_all_docs?include_docs=true"},
+		{"POST", "_bulk_get?revs=true"},
+		{"POST", "_changes?filter=_doc_ids"},
+		{"POST", "_design/foo/_view/bar"},
+		{"POST", "_revs_diff"},
+	}
+	for _, r := range reads {
+		assert.False(t, isWrite(r.method, r.path), "%s %s", r.method, r.path)
+	}
+	writes := []struct{ method, path string }{
+		{"POST", ""},
+		{"PUT", "foo"},
+		{"PUT", ""},
+		{"DELETE", "foo?rev=1-abc"},
+		{"DELETE", ""},
+		{"COPY", "foo"},
+		{"POST", "_bulk_docs"},
+		{"POST", "_purge"},
+		{"POST", "_index"},
+		{"PUT", "_local/foo"},
+		{"PUT", "_design/foo"},
+	}
+	for _, w := range writes {
+		assert.True(t, isWrite(w.method, w.path), "%s %s", w.method, w.path)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	var requests int
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"ok":true,"id":"foo","rev":"1-abc","docs":[]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc"}`))
+	}))
+	defer restore()
+	defer SetReadOnly(false)
+
+	create := func(db Database) error {
+		return CreateDoc(db, &JSONDoc{Type: TestDoctype, M: map[string]interface{}{}})
+	}
+
+	SetReadOnly(true)
+	err := create(TestPrefix)
+	assert.True(t, errors.Is(err, ErrReadOnly))
+	assert.Equal(t, 0, requests)
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &JSONDoc{}))
+	var docs []JSONDoc
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, &FindRequest{}, &docs))
+	assert.Equal(t, 2, requests)
+
+	SetReadOnly(false)
+	assert.NoError(t, create(TestPrefix))
+	assert.Equal(t, 3, requests)
+
+	other := prefixer.NewPrefixer("", "other-tests")
+	SetReadOnlyPrefix(other.DBPrefix(), true)
+	defer SetReadOnlyPrefix(other.DBPrefix(), false)
+	assert.True(t, errors.Is(create(other), ErrReadOnly))
+	assert.NoError(t, create(TestPrefix))
+	assert.Equal(t, 4, requests)
+	SetReadOnlyPrefix(other.DBPrefix(), false)
+	assert.NoError(t, create(other))
+}
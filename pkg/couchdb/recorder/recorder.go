@@ -0,0 +1,277 @@
+// Package recorder provides an http.RoundTripper that records the exchanges
+// with CouchDB in golden files, and replays them later, so that the tests
+// of the behaviors that depend on the real responses of CouchDB can run
+// without a CouchDB. It is used with couchdb.SetTransport.
+package recorder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Mode tells if a Recorder records the exchanges or replays them.
+type Mode int
+
+const (
+	// Replay serves the responses from the golden file, without network.
+	Replay Mode = iota
+	// Record sends the requests to CouchDB, and writes the exchanges in the
+	// golden file.
+	Record
+)
+
+// EnvRecord is the environment variable that enables the Record mode in
+// ModeFromEnv.
+const EnvRecord = "COZY_COUCHDB_RECORD"
+
+// ModeFromEnv returns Record if the COZY_COUCHDB_RECORD environment variable
+// is set, and Replay otherwise.
+func ModeFromEnv() Mode {
+	if os.Getenv(EnvRecord) != "" {
+		return Record
+	}
+	return Replay
+}
+
+// ScrubbedHeaders are the headers that are never written in the golden
+// files, as they can have credentials.
+var ScrubbedHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+}
+
+// volatileHeaders are the headers that change on each response, and would
+// only make noise in the golden files.
+var volatileHeaders = []string{
+	"Content-Length",
+	"Date",
+	"X-Couch-Request-Id",
+	"X-Couchdb-Body-Time",
+}
+
+// Interaction is a request and its response, in a golden file. The request
+// is identified by its method, its path with the query string, and the
+// SHA-256 of its body.
+type Interaction struct {
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	BodyHash   string      `json:"body_hash,omitempty"`
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 string      `json:"body_base64,omitempty"`
+}
+
+// Recorder is an http.RoundTripper that records or replays the exchanges
+// with CouchDB. In the Replay mode, a request that is not in the golden
+// file is an error, for the caller and for Close.
+type Recorder struct {
+	file string
+	mode Mode
+	next http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []*Interaction
+	used         []bool
+	unmatched    []string
+}
+
+// New returns a Recorder for the given golden file. In the Record mode, the
+// requests are sent with next, or http.DefaultTransport if it is nil. In the
+// Replay mode, the golden file must exist.
+func New(file string, mode Mode, next http.RoundTripper) (*Recorder, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	r := &Recorder{file: file, mode: mode, next: next}
+	if mode == Record {
+		return r, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("recorder: cannot read the golden file (record it with %s=1): %w", EnvRecord, err)
+	}
+	if err := json.Unmarshal(data, &r.interactions); err != nil {
+		return nil, fmt.Errorf("recorder: invalid golden file %s: %w", file, err)
+	}
+	r.used = make([]bool, len(r.interactions))
+	return r, nil
+}
+
+// RoundTrip is part of the http.RoundTripper interface.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	hash, err := hashBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.mode == Record {
+		return r.record(req, hash)
+	}
+	return r.replay(req, hash)
+}
+
+func (r *Recorder) record(req *http.Request, hash string) (*http.Response, error) {
+	res, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var reader = res.Body
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+		res.Header.Del("Content-Encoding")
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	it := &Interaction{
+		Method:   req.Method,
+		Path:     req.URL.RequestURI(),
+		BodyHash: hash,
+		Status:   res.StatusCode,
+		Header:   scrubHeader(res.Header),
+	}
+	if utf8.Valid(body) {
+		it.Body = string(body)
+	} else {
+		it.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+	r.mu.Lock()
+	r.interactions = append(r.interactions, it)
+	r.used = append(r.used, true)
+	r.mu.Unlock()
+	return it.response(req)
+}
+
+func (r *Recorder) replay(req *http.Request, hash string) (*http.Response, error) {
+	path := req.URL.RequestURI()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, it := range r.interactions {
+		if r.used[i] || it.Method != req.Method || it.Path != path || it.BodyHash != hash {
+			continue
+		}
+		r.used[i] = true
+		return it.response(req)
+	}
+	unmatched := req.Method + " " + path
+	if hash != "" {
+		unmatched += " (body " + hash + ")"
+	}
+	r.unmatched = append(r.unmatched, unmatched)
+	return nil, fmt.Errorf("recorder: unmatched request %s in %s", unmatched, r.file)
+}
+
+// Close writes the golden file in the Record mode. In the Replay mode, it
+// returns an error if a request has not been found in the golden file, or
+// if an exchange of the golden file has not been replayed.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mode == Record {
+		data, err := json.MarshalIndent(r.interactions, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(r.file), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(r.file, append(data, '\n'), 0644)
+	}
+	var msgs []string
+	for _, unmatched := range r.unmatched {
+		msgs = append(msgs, "unmatched request "+unmatched)
+	}
+	for i, used := range r.used {
+		if !used {
+			it := r.interactions[i]
+			msgs = append(msgs, "unused exchange "+it.Method+" "+it.Path)
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.New("recorder: " + r.file + ": " + strings.Join(msgs, ", "))
+	}
+	return nil
+}
+
+func (it *Interaction) response(req *http.Request) (*http.Response, error) {
+	body := []byte(it.Body)
+	if it.BodyBase64 != "" {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(it.BodyBase64); err != nil {
+			return nil, err
+		}
+	}
+	header := make(http.Header, len(it.Header)+1)
+	for k, v := range it.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status:        strconv.Itoa(it.Status) + " " + http.StatusText(it.Status),
+		StatusCode:    it.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// hashBody returns the SHA-256 of the body of a request, and puts the body
+// back in the request so that it can still be sent.
+func hashBody(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return "", nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if len(body) == 0 {
+		return "", nil
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func scrubHeader(h http.Header) http.Header {
+	scrubbed := h.Clone()
+	for _, k := range ScrubbedHeaders {
+		scrubbed.Del(k)
+	}
+	for _, k := range volatileHeaders {
+		scrubbed.Del(k)
+	}
+	if len(scrubbed) == 0 {
+		return nil
+	}
+	return scrubbed
+}
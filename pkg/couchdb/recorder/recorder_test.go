@@ -0,0 +1,140 @@
+package recorder
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, client *http.Client, method, url, body string) (int, string, error) {
+	var req *http.Request
+	var err error
+	if body == "" {
+		req, err = http.NewRequest(method, url, nil)
+	} else {
+		req, err = http.NewRequest(method, url, strings.NewReader(body))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "s3cr3t")
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(data), err
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "AuthSession=secret")
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/db/foo":
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			_, _ = gz.Write([]byte(`{"_id":"foo","_rev":"1-abc"}`))
+			_ = gz.Close()
+		case r.Method == http.MethodPost:
+			body, _ := ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"echo":` + string(body) + `}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+		}
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "golden", "test.json")
+
+	// Record
+	rec, err := New(file, Record, nil)
+	assert.NoError(t, err)
+	client := &http.Client{Transport: rec}
+	status, body, err := get(t, client, http.MethodGet, ts.URL+"/db/foo", "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"_id":"foo","_rev":"1-abc"}`, body)
+	status, body, err = get(t, client, http.MethodPost, ts.URL+"/db/_find?x=1", `{"a":1}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, `{"echo":{"a":1}}`, body)
+	status, _, err = get(t, client, http.MethodPost, ts.URL+"/db/_find?x=1", `{"a":2}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+	status, _, err = get(t, client, http.MethodGet, ts.URL+"/db/bar", "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.NoError(t, rec.Close())
+
+	golden, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(golden), "secret")
+	assert.NotContains(t, string(golden), "s3cr3t")
+	assert.NotContains(t, string(golden), "Authorization")
+	assert.NotContains(t, string(golden), "gzip")
+	assert.Contains(t, string(golden), `"path": "/db/_find?x=1"`)
+
+	// Replay, without the server
+	ts.Close()
+	rec, err = New(file, Replay, nil)
+	assert.NoError(t, err)
+	client = &http.Client{Transport: rec}
+	status, body, err = get(t, client, http.MethodPost, ts.URL+"/db/_find?x=1", `{"a":2}`)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, `{"echo":{"a":2}}`, body)
+	status, body, err = get(t, client, http.MethodGet, ts.URL+"/db/foo", "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"_id":"foo","_rev":"1-abc"}`, body)
+	status, body, err = get(t, client, http.MethodGet, ts.URL+"/db/bar", "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Contains(t, body, "not_found")
+
+	// The requests are matched on their body, and an exchange is replayed
+	// only once
+	_, _, err = get(t, client, http.MethodPost, ts.URL+"/db/_find?x=1", `{"a":3}`)
+	assert.Error(t, err)
+	_, _, err = get(t, client, http.MethodGet, ts.URL+"/db/foo", "")
+	assert.Error(t, err)
+	err = rec.Close()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unmatched request POST /db/_find?x=1 (body ")
+		assert.Contains(t, err.Error(), "unmatched request GET /db/foo")
+		assert.Contains(t, err.Error(), `unused exchange POST /db/_find?x=1`)
+	}
+
+	_, err = New(filepath.Join(dir, "missing.json"), Replay, nil)
+	assert.Error(t, err)
+}
+
+func TestModeFromEnv(t *testing.T) {
+	old, had := os.LookupEnv(EnvRecord)
+	defer func() {
+		if had {
+			os.Setenv(EnvRecord, old)
+		} else {
+			os.Unsetenv(EnvRecord)
+		}
+	}()
+	os.Unsetenv(EnvRecord)
+	assert.Equal(t, Replay, ModeFromEnv())
+	os.Setenv(EnvRecord, "1")
+	assert.Equal(t, Record, ModeFromEnv())
+}
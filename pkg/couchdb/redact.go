@@ -0,0 +1,98 @@
+package couchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// redactedValue replaces the values of the sensitive fields in the logs.
+const redactedValue = "[REDACTED]"
+
+// defaultRedactedFields are the names of the fields whose values are masked
+// in the logs, when the configuration doesn't give its own list. A field is
+// masked if its name contains one of them.
+var defaultRedactedFields = []string{"password", "token", "secret", "auth"}
+
+// defaultMaxLoggedBodySize is the size after which a body is truncated in the
+// logs, when the configuration doesn't give its own limit.
+const defaultMaxLoggedBodySize = 4096
+
+var (
+	redactedDoctypesMu sync.RWMutex
+	redactedDoctypes   = map[string]bool{accountDocType: true}
+)
+
+// RegisterRedactedDoctype declares that the documents of the given doctype
+// must never be logged, even when the logs of the bodies are enabled. The
+// accounts are always redacted.
+func RegisterRedactedDoctype(doctype string) {
+	redactedDoctypesMu.Lock()
+	redactedDoctypes[doctype] = true
+	redactedDoctypesMu.Unlock()
+}
+
+func isRedactedDoctype(doctype string) bool {
+	redactedDoctypesMu.RLock()
+	defer redactedDoctypesMu.RUnlock()
+	return redactedDoctypes[doctype]
+}
+
+// redactBody returns a version of a JSON body that can be written in the
+// logs: the values of the sensitive fields are masked, and it is truncated if
+// it is too large.
+func redactBody(body []byte) string {
+	couch := config.GetConfig().CouchDB
+	fields := couch.LogRedactedFields
+	if len(fields) == 0 {
+		fields = defaultRedactedFields
+	}
+	maxSize := couch.LogMaxBodySize
+	if maxSize <= 0 {
+		maxSize = defaultMaxLoggedBodySize
+	}
+
+	body = bytes.TrimSpace(body)
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err == nil {
+		if redacted, err := json.Marshal(redactValue(value, fields)); err == nil {
+			body = redacted
+		}
+	}
+	if len(body) > maxSize {
+		return fmt.Sprintf("%s... (truncated, %d bytes)", body[:maxSize], len(body))
+	}
+	return string(body)
+}
+
+func redactValue(value interface{}, fields []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			if isSensitiveField(key, fields) {
+				v[key] = redactedValue
+			} else {
+				v[key] = redactValue(val, fields)
+			}
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = redactValue(val, fields)
+		}
+	}
+	return value
+}
+
+func isSensitiveField(key string, fields []string) bool {
+	key = strings.ToLower(key)
+	for _, field := range fields {
+		if strings.Contains(key, strings.ToLower(field)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package couchdb
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactBody(t *testing.T) {
+	body := `{"_id":"foo","name":"Alice","auth":{"login":"alice","password":"s3cr3t"},"access_token":"abc"}`
+	redacted := redactBody([]byte(body))
+	assert.Contains(t, redacted, `"name":"Alice"`)
+	assert.Contains(t, redacted, `"auth":"[REDACTED]"`)
+	assert.Contains(t, redacted, `"access_token":"[REDACTED]"`)
+	assert.NotContains(t, redacted, "s3cr3t")
+
+	bulk := `{"docs":[{"_id":"1","secret":"a"},{"_id":"2","Password":"b"}]}`
+	redacted = redactBody([]byte(bulk))
+	assert.Equal(t, `{"docs":[{"_id":"1","secret":"[REDACTED]"},{"Password":"[REDACTED]","_id":"2"}]}`, redacted)
+
+	large := `{"content":"` + strings.Repeat("x", 2*defaultMaxLoggedBodySize) + `"}`
+	redacted = redactBody([]byte(large))
+	assert.True(t, len(redacted) < defaultMaxLoggedBodySize+100)
+	assert.Contains(t, redacted, "truncated")
+
+	assert.Equal(t, "not json", redactBody([]byte("not json\n")))
+}
+
+func TestRedactedDoctype(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc","note":"private"}`))
+	}))
+	defer restore()
+	defer SetLogger(defaultLogger)
+	config.GetConfig().CouchDB.LogBodies = true
+
+	rec := &recordLogger{}
+	SetLogger(func(db Database) Logger { return rec })
+	RegisterRedactedDoctype("io.cozy.tests.redacted")
+	var doc JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, "io.cozy.tests.redacted", "foo", &doc))
+	assert.NotContains(t, rec.String(), "private")
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", &doc))
+	assert.Contains(t, rec.String(), "private")
+}
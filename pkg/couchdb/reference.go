@@ -1,7 +1,174 @@
 package couchdb
 
+import (
+	"context"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"golang.org/x/sync/errgroup"
+)
+
 // DocReference is a reference to a document
 type DocReference struct {
 	ID   string `json:"id"`
 	Type string `json:"type"`
 }
+
+// Referencer is the interface of the Go types with a referenced_by field,
+// like the files and the directories. The JSONDoc are supported without it.
+type Referencer interface {
+	AddReferencedBy(refs ...DocReference)
+	RemoveReferencedBy(refs ...DocReference)
+}
+
+// ReferencedByView returns the view on the referenced_by field of a doctype,
+// keyed on [ref.Type, ref.ID].
+func ReferencedByView(doctype string) *View {
+	if doctype == consts.Files {
+		return FilesReferencedByView
+	}
+	return &View{
+		Name:    FilesReferencedByView.Name,
+		Doctype: doctype,
+		Reduce:  FilesReferencedByView.Reduce,
+		Map:     FilesReferencedByView.Map,
+	}
+}
+
+// RegisterReferences adds the view on the referenced_by field of a doctype to
+// the views created for the instances. It is meant to be called in an init
+// function.
+func RegisterReferences(doctype string) {
+	if doctype == consts.Files {
+		return
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	Views = append(Views, ReferencedByView(doctype))
+}
+
+// AddReferencedBy calls AddReferencedByContext with a background context.
+func AddReferencedBy(db Database, doc Doc, refs ...DocReference) error {
+	return AddReferencedByContext(context.Background(), db, doc, refs...)
+}
+
+// AddReferencedByContext adds references to the referenced_by field of a
+// document, and updates it. A reference already present is not added twice.
+// The update is retried on conflicts.
+func AddReferencedByContext(ctx context.Context, db Database, doc Doc, refs ...DocReference) error {
+	refs = uniqueReferences(refs)
+	return UpdateDocWithRetry(ctx, db, doc, func(doc Doc) error {
+		return changeReferences(doc, refs, true)
+	})
+}
+
+// RemoveReferencedBy calls RemoveReferencedByContext with a background
+// context.
+func RemoveReferencedBy(db Database, doc Doc, refs ...DocReference) error {
+	return RemoveReferencedByContext(context.Background(), db, doc, refs...)
+}
+
+// RemoveReferencedByContext removes references from the referenced_by field
+// of a document, and updates it. The update is retried on conflicts.
+func RemoveReferencedByContext(ctx context.Context, db Database, doc Doc, refs ...DocReference) error {
+	return UpdateDocWithRetry(ctx, db, doc, func(doc Doc) error {
+		return changeReferences(doc, refs, false)
+	})
+}
+
+func changeReferences(doc Doc, refs []DocReference, add bool) error {
+	switch d := doc.(type) {
+	case Referencer:
+		// Removing the references before adding them avoids duplicates
+		d.RemoveReferencedBy(refs...)
+		if add {
+			d.AddReferencedBy(refs...)
+		}
+	case *JSONDoc:
+		var kept []interface{}
+		existing, _ := d.Get("referenced_by").([]interface{})
+		for _, item := range existing {
+			ref, _ := item.(map[string]interface{})
+			id, _ := ref["id"].(string)
+			typ, _ := ref["type"].(string)
+			if !containsReference(refs, DocReference{ID: id, Type: typ}) {
+				kept = append(kept, item)
+			}
+		}
+		if add {
+			for _, ref := range refs {
+				kept = append(kept, map[string]interface{}{"type": ref.Type, "id": ref.ID})
+			}
+		}
+		if kept == nil {
+			kept = []interface{}{}
+		}
+		return d.Set("referenced_by", kept)
+	default:
+		return newInvalidDocError("the document has no referenced_by")
+	}
+	return nil
+}
+
+func uniqueReferences(refs []DocReference) []DocReference {
+	unique := make([]DocReference, 0, len(refs))
+	for _, ref := range refs {
+		if !containsReference(unique, ref) {
+			unique = append(unique, ref)
+		}
+	}
+	return unique
+}
+
+func containsReference(refs []DocReference, ref DocReference) bool {
+	for _, r := range refs {
+		if r.ID == ref.ID && r.Type == ref.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// FindReferencedBy calls FindReferencedByContext with a background context.
+func FindReferencedBy(db Database, doctype string, ref DocReference, cursor Cursor) ([]string, error) {
+	return FindReferencedByContext(context.Background(), db, doctype, ref, cursor)
+}
+
+// FindReferencedByContext returns the identifiers of the documents of a
+// doctype that reference the given document. The cursor is optional, and is
+// used for the pagination. The view is created if it does not exist yet.
+func FindReferencedByContext(ctx context.Context, db Database, doctype string, ref DocReference, cursor Cursor) ([]string, error) {
+	view := ReferencedByView(doctype)
+	req := &ViewRequest{
+		Key:    []string{ref.Type, ref.ID},
+		Reduce: false,
+	}
+	if cursor != nil {
+		cursor.ApplyTo(req)
+	}
+	var res ViewResponse
+	err := ExecViewContext(ctx, db, view, req, &res)
+	if isMissingView(err) {
+		g, _ := errgroup.WithContext(ctx)
+		DefineViewsContext(ctx, g, db, []*View{view})
+		if err = g.Wait(); err == nil {
+			err = ExecViewContext(ctx, db, view, req, &res)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cursor != nil {
+		cursor.UpdateFrom(&res)
+	}
+	ids := make([]string, len(res.Rows))
+	for i, row := range res.Rows {
+		ids[i] = row.ID
+	}
+	return ids, nil
+}
+
+func isMissingView(err error) bool {
+	couchErr, ok := IsCouchError(err)
+	return ok && couchErr.StatusCode == http.StatusNotFound && !IsNoDatabaseError(err)
+}
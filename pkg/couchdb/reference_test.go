@@ -0,0 +1,95 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferencedBy(t *testing.T) {
+	var puts int
+	var sent map[string]interface{}
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			// The document has been modified by someone else
+			_, _ = w.Write([]byte(`{"_id":"foo","_rev":"2-abc","name":"bar","referenced_by":[{"type":"io.cozy.albums","id":"a1"}]}`))
+		case http.MethodPut:
+			puts++
+			if puts == 1 {
+				w.WriteHeader(http.StatusConflict)
+				_, _ = w.Write([]byte(`{"error":"conflict","reason":"Document update conflict."}`))
+				return
+			}
+			sent = nil
+			_ = json.NewDecoder(r.Body).Decode(&sent)
+			_, _ = w.Write([]byte(`{"ok":true,"id":"foo","rev":"3-abc"}`))
+		}
+	}))
+	defer restore()
+
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo", "_rev": "1-abc"}}
+	album := DocReference{Type: "io.cozy.albums", ID: "a1"}
+	other := DocReference{Type: "io.cozy.albums", ID: "a2"}
+	assert.NoError(t, AddReferencedBy(TestPrefix, doc, album, other, other))
+	assert.Equal(t, 2, puts)
+	assert.Equal(t, "3-abc", doc.Rev())
+	assert.Equal(t, "bar", doc.GetString("name"))
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"type": "io.cozy.albums", "id": "a1"},
+		map[string]interface{}{"type": "io.cozy.albums", "id": "a2"},
+	}, sent["referenced_by"])
+
+	assert.NoError(t, RemoveReferencedBy(TestPrefix, doc, album))
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"type": "io.cozy.albums", "id": "a2"},
+	}, sent["referenced_by"])
+
+	err := AddReferencedBy(TestPrefix, &testDoc{TestID: "foo", TestRev: "1-abc"}, album)
+	assert.True(t, errors.Is(err, ErrInvalidDoc))
+}
+
+func TestFindReferencedBy(t *testing.T) {
+	var viewDefined bool
+	var query string
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/_design/") && r.Method == http.MethodGet && !strings.Contains(r.URL.Path, "/_view/"):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+		case strings.Contains(r.URL.Path, "/_design/") && r.Method == http.MethodPut:
+			viewDefined = true
+			_, _ = w.Write([]byte(`{"ok":true}`))
+		case strings.Contains(r.URL.Path, "/_view/"):
+			if !viewDefined {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+				return
+			}
+			query = r.URL.RawQuery
+			_, _ = w.Write([]byte(`{"total_rows":3,"rows":[
+				{"id":"f1","key":["io.cozy.albums","a1"]},
+				{"id":"f2","key":["io.cozy.albums","a1"]}
+			]}`))
+		}
+	}))
+	defer restore()
+
+	ref := DocReference{Type: "io.cozy.albums", ID: "a1"}
+	ids, err := FindReferencedBy(TestPrefix, TestDoctype, ref, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"f1", "f2"}, ids)
+	assert.True(t, viewDefined)
+	assert.Contains(t, query, "reduce=false")
+	assert.Contains(t, query, "io.cozy.albums")
+
+	cursor := NewKeyCursor(1, nil, "")
+	ids, err = FindReferencedBy(TestPrefix, TestDoctype, ref, cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"f1"}, ids)
+	assert.True(t, cursor.HasMore())
+}
@@ -0,0 +1,92 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DocFactory returns a new empty document of the Go type used for a doctype.
+type DocFactory func() Doc
+
+// ErrDoctypeNotRegistered is the error returned by NewDocForType when no
+// factory has been registered for the doctype.
+var ErrDoctypeNotRegistered = errors.New("CouchDB: doctype not registered")
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]DocFactory)
+)
+
+// RegisterDoctype registers the factory of the Go type to use for the
+// documents of a doctype, when the code handles documents of several
+// doctypes, like the consumers of the changes feeds. It is meant to be called
+// in an init function, and it panics if the doctype is already registered.
+func RegisterDoctype(doctype string, factory DocFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[doctype]; ok {
+		panic(fmt.Sprintf("couchdb: doctype %s is already registered", doctype))
+	}
+	registry[doctype] = factory
+}
+
+// NewDocForType returns a new empty document of the Go type registered for
+// the doctype.
+func NewDocForType(doctype string) (Doc, error) {
+	registryMu.RLock()
+	factory, ok := registry[doctype]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrDoctypeNotRegistered, doctype)
+	}
+	return factory(), nil
+}
+
+// newDocOrJSON returns a new document of the registered Go type for the
+// doctype, or a JSONDoc if there is none.
+func newDocOrJSON(doctype string) Doc {
+	if doc, err := NewDocForType(doctype); err == nil {
+		return doc
+	}
+	return &JSONDoc{Type: doctype}
+}
+
+// DecodeDoc unmarshals a document of the given doctype in the Go type
+// registered for it, or in a JSONDoc if there is none.
+func DecodeDoc(doctype string, data []byte) (Doc, error) {
+	doc := newDocOrJSON(doctype)
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+	if jsonDoc, ok := doc.(*JSONDoc); ok {
+		jsonDoc.Type = doctype
+	}
+	return doc, nil
+}
+
+// GetTypedDocContext fetches a document in the Go type registered for its
+// doctype, or in a JSONDoc if there is none.
+func GetTypedDocContext(ctx context.Context, db Database, doctype, id string) (Doc, error) {
+	doc := newDocOrJSON(doctype)
+	if err := GetDocContext(ctx, db, doctype, id, doc); err != nil {
+		return nil, err
+	}
+	if jsonDoc, ok := doc.(*JSONDoc); ok {
+		jsonDoc.Type = doctype
+	}
+	return doc, nil
+}
+
+// TypedDoc returns the document of a change in the Go type registered for its
+// doctype, or a JSONDoc if there is none. The changes feed must have been
+// requested with IncludeDocs.
+func (c *Change) TypedDoc(doctype string) (Doc, error) {
+	data, err := json.Marshal(c.Doc.M)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeDoc(doctype, data)
+}
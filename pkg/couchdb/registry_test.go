@@ -0,0 +1,68 @@
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoctypeRegistry(t *testing.T) {
+	const doctype = "io.cozy.tests.registry"
+	RegisterDoctype(doctype, func() Doc { return &testDoc{} })
+	defer func() {
+		registryMu.Lock()
+		delete(registry, doctype)
+		registryMu.Unlock()
+	}()
+	assert.Panics(t, func() {
+		RegisterDoctype(doctype, func() Doc { return &JSONDoc{} })
+	})
+
+	doc, err := NewDocForType(doctype)
+	assert.NoError(t, err)
+	assert.IsType(t, &testDoc{}, doc)
+	_, err = NewDocForType("io.cozy.tests.unknown")
+	assert.True(t, errors.Is(err, ErrDoctypeNotRegistered))
+
+	data := []byte(`{"_id":"foo","_rev":"1-abc","test":"bar"}`)
+	doc, err = DecodeDoc(doctype, data)
+	if assert.NoError(t, err) && assert.IsType(t, &testDoc{}, doc) {
+		assert.Equal(t, "bar", doc.(*testDoc).Test)
+	}
+	doc, err = DecodeDoc("io.cozy.tests.unknown", data)
+	if assert.NoError(t, err) && assert.IsType(t, &JSONDoc{}, doc) {
+		assert.Equal(t, "io.cozy.tests.unknown", doc.DocType())
+		assert.Equal(t, "foo", doc.ID())
+	}
+
+	change := &Change{DocID: "foo", Doc: JSONDoc{M: map[string]interface{}{"_id": "foo", "test": "baz"}}}
+	doc, err = change.TypedDoc(doctype)
+	if assert.NoError(t, err) && assert.IsType(t, &testDoc{}, doc) {
+		assert.Equal(t, "baz", doc.(*testDoc).Test)
+	}
+
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer restore()
+	doc, err = GetTypedDocContext(context.Background(), TestPrefix, doctype, "foo")
+	if assert.NoError(t, err) && assert.IsType(t, &testDoc{}, doc) {
+		assert.Equal(t, "1-abc", doc.Rev())
+	}
+
+	// The registry can be read concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := NewDocForType(doctype)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+}
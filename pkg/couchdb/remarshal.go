@@ -0,0 +1,107 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// remarshalBuffers are reused between the conversions, to avoid allocating
+// a new buffer for the JSON of each document.
+var remarshalBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// maxPooledBuffer is the size over which a buffer is not put back in the
+// pool, to not keep a large buffer for a rare large document.
+const maxPooledBuffer = 64 * 1024
+
+func getRemarshalBuffer() *bytes.Buffer {
+	buf := remarshalBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putRemarshalBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		remarshalBuffers.Put(buf)
+	}
+}
+
+// encodeInBuffer writes the JSON of v in buf, without escaping the HTML
+// characters, as the JSON is only decoded again.
+func encodeInBuffer(buf *bytes.Buffer, v interface{}) error {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// Remarshal calls RemarshalContext with a background context.
+func Remarshal(src JSONDoc, dst interface{}) error {
+	return RemarshalContext(context.Background(), src, dst)
+}
+
+// RemarshalContext converts a JSONDoc, like one received by the /data API or
+// in a changes feed, into dst, typically a pointer to the Go type of its
+// doctype. It is the same as a json.Marshal followed by a json.Unmarshal,
+// but with a reused buffer. The _id and _rev are kept, and the numbers are
+// decoded as json.Number in the interface{} values of dst.
+//
+// The conversion is strict, like the fetch of a document, when asked by the
+// context or for the doctype of src: an unknown field is an
+// UnknownFieldError.
+func RemarshalContext(ctx context.Context, src JSONDoc, dst interface{}) error {
+	buf := getRemarshalBuffer()
+	defer putRemarshalBuffer(buf)
+	if err := encodeInBuffer(buf, src.withoutReservedKeys()); err != nil {
+		return err
+	}
+	doctype := src.DocType()
+	if isStrict(ctx, doctype) && !isLoose(dst) {
+		data := buf.Bytes()
+		if err := decodeStrict(bytes.NewReader(data), dst); err != nil {
+			return unknownFieldError(err, doctype, data)
+		}
+		return nil
+	}
+	dec := json.NewDecoder(buf)
+	dec.UseNumber()
+	if doc, ok := dst.(*JSONDoc); ok {
+		// The UnmarshalJSON method of JSONDoc would not keep the json.Number
+		doc.M = nil
+		doc.Type = doctype
+		return dec.Decode(&doc.M)
+	}
+	return dec.Decode(dst)
+}
+
+// ToJSONDoc converts a document into a JSONDoc, with the same doctype, _id
+// and _rev. The numbers are kept as json.Number, like in the documents
+// fetched from CouchDB. A JSONDoc is deeply copied.
+func ToJSONDoc(src Doc) (JSONDoc, error) {
+	if j, ok := src.(*JSONDoc); ok {
+		return JSONDoc{Type: j.Type, M: deepClone(j.M)}, nil
+	}
+	buf := getRemarshalBuffer()
+	defer putRemarshalBuffer(buf)
+	if err := encodeInBuffer(buf, src); err != nil {
+		return JSONDoc{}, err
+	}
+	doc := JSONDoc{Type: src.DocType()}
+	dec := json.NewDecoder(buf)
+	dec.UseNumber()
+	if err := dec.Decode(&doc.M); err != nil {
+		return JSONDoc{}, err
+	}
+	if doc.M == nil {
+		doc.M = make(map[string]interface{})
+	}
+	if id := src.ID(); id != "" {
+		doc.M["_id"] = id
+	}
+	if rev := src.Rev(); rev != "" {
+		doc.M["_rev"] = rev
+	}
+	return doc, nil
+}
@@ -0,0 +1,163 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type remarshalDoc struct {
+	testDoc
+	Size  json.Number            `json:"size"`
+	Extra map[string]interface{} `json:"extra"`
+}
+
+func TestRemarshal(t *testing.T) {
+	src := JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+		"_id":    "foo",
+		"_rev":   "1-abc",
+		"_type":  TestDoctype,
+		"test":   "<bar>",
+		"fieldB": json.Number("42"),
+		"size":   json.Number("9007199254740993"),
+		"extra":  map[string]interface{}{"n": json.Number("1.5")},
+	}}
+
+	var typed remarshalDoc
+	assert.NoError(t, Remarshal(src, &typed))
+	assert.Equal(t, "foo", typed.ID())
+	assert.Equal(t, "1-abc", typed.Rev())
+	assert.Equal(t, "<bar>", typed.Test)
+	assert.Equal(t, 42, typed.FieldB)
+	assert.Equal(t, json.Number("9007199254740993"), typed.Size)
+	assert.Equal(t, json.Number("1.5"), typed.Extra["n"])
+
+	var m map[string]interface{}
+	assert.NoError(t, Remarshal(src, &m))
+	assert.Equal(t, json.Number("9007199254740993"), m["size"])
+	assert.NotContains(t, m, "_type")
+
+	var j JSONDoc
+	assert.NoError(t, Remarshal(src, &j))
+	assert.Equal(t, TestDoctype, j.DocType())
+	assert.Equal(t, json.Number("42"), j.M["fieldB"])
+	assert.Equal(t, "foo", j.ID())
+
+	// The strict decoding is honored
+	var small testDoc
+	assert.NoError(t, Remarshal(src, &small))
+	err := RemarshalContext(WithStrictDecoding(context.Background()), src, &small)
+	if fieldErr, ok := IsUnknownFieldError(err); assert.True(t, ok) {
+		assert.Equal(t, "foo", fieldErr.DocID)
+		assert.Equal(t, TestDoctype, fieldErr.Doctype)
+	}
+	assert.NoError(t, RemarshalContext(WithStrictDecoding(context.Background()), src, &m))
+
+	// And back
+	back, err := ToJSONDoc(&typed)
+	assert.NoError(t, err)
+	assert.Equal(t, TestDoctype, back.DocType())
+	assert.Equal(t, "foo", back.ID())
+	assert.Equal(t, "1-abc", back.Rev())
+	assert.Equal(t, json.Number("9007199254740993"), back.M["size"])
+	assert.Equal(t, json.Number("42"), back.M["fieldB"])
+
+	copied, err := ToJSONDoc(&src)
+	assert.NoError(t, err)
+	copied.M["extra"].(map[string]interface{})["n"] = "changed"
+	assert.Equal(t, json.Number("1.5"), src.M["extra"].(map[string]interface{})["n"])
+}
+
+// TestRemarshalNoFieldLoss checks with random documents that the round trips
+// keep all the fields and values.
+func TestRemarshalNoFieldLoss(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 500; i++ {
+		m := make(map[string]interface{})
+		for k := r.Intn(8); k >= 0; k-- {
+			m["field"+strconv.Itoa(r.Intn(20))] = randomValue(r, 0)
+		}
+		m["_id"] = "doc" + strconv.Itoa(i)
+		m["_rev"] = "1-abc"
+		m["number"] = json.Number(strconv.FormatInt(r.Int63(), 10))
+		src := JSONDoc{Type: TestDoctype, M: m}
+
+		var dst JSONDoc
+		assert.NoError(t, Remarshal(src, &dst))
+		assert.Equal(t, src.M, dst.M)
+
+		typed := &testDoc{}
+		assert.NoError(t, Remarshal(src, typed))
+		back, err := ToJSONDoc(typed)
+		assert.NoError(t, err)
+		assert.Equal(t, src.M["_id"], back.M["_id"])
+		assert.Equal(t, src.M["_rev"], back.M["_rev"])
+
+		full := &remarshalDoc{}
+		m["extra"] = randomValue(r, 3)
+		if _, ok := m["extra"].(map[string]interface{}); !ok {
+			m["extra"] = map[string]interface{}{"value": m["extra"]}
+		}
+		m["size"] = json.Number(strconv.Itoa(r.Int()))
+		assert.NoError(t, Remarshal(src, full))
+		back, err = ToJSONDoc(full)
+		assert.NoError(t, err)
+		for _, key := range []string{"_id", "_rev", "size", "extra"} {
+			assert.Equal(t, m[key], back.M[key], key)
+		}
+	}
+}
+
+func makeRemarshalDoc() JSONDoc {
+	extra := make(map[string]interface{})
+	for i := 0; i < 50; i++ {
+		extra["key"+strconv.Itoa(i)] = json.Number(strconv.Itoa(i * 1000))
+	}
+	return JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+		"_id":    "foo",
+		"_rev":   "1-abc",
+		"test":   "bar",
+		"fieldA": "baz",
+		"fieldB": json.Number("42"),
+		"size":   json.Number("123456"),
+		"extra":  extra,
+	}}
+}
+
+// BenchmarkRemarshalNaive is how a JSONDoc was converted before Remarshal,
+// with a json.Number for the numbers to not lose the big integers.
+func BenchmarkRemarshalNaive(b *testing.B) {
+	src := makeRemarshalDoc()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := json.Marshal(src.M)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var dst remarshalDoc
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&dst); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRemarshal converts the same document with Remarshal.
+func BenchmarkRemarshal(b *testing.B) {
+	src := makeRemarshalDoc()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var dst remarshalDoc
+		if err := Remarshal(src, &dst); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
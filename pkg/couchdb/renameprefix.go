@@ -0,0 +1,161 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// RenamePrefixOptions are the options of RenamePrefix.
+type RenamePrefixOptions struct {
+	// DeleteOld deletes the old databases once all the databases have been
+	// replicated and verified. By default, they are kept, so that they can
+	// be checked manually, and RenamePrefix can then be run again with this
+	// option to delete them.
+	DeleteOld bool
+	// SpotCheck limits the number of documents of each database whose
+	// revision is checked in the new database with _revs_diff, after the
+	// counts. All the documents are checked when it is 0.
+	SpotCheck int
+}
+
+// RenamePrefixResult tells what RenamePrefix has done, by doctype.
+type RenamePrefixResult struct {
+	// Replicated are the doctypes replicated to the new prefix
+	Replicated []string
+	// Skipped are the doctypes already replicated by a previous run
+	Skipped []string
+	// Deleted are the doctypes whose old database has been deleted
+	Deleted []string
+}
+
+// RenamePrefixError is the error of RenamePrefix, with the doctype and the
+// step where it has failed.
+type RenamePrefixError struct {
+	Doctype string
+	// Step is "replicate", "verify" or "delete"
+	Step string
+	Err  error
+}
+
+func (e *RenamePrefixError) Error() string {
+	return fmt.Sprintf("CouchDB: cannot %s the database of %s for the new prefix: %s",
+		e.Step, e.Doctype, e.Err)
+}
+
+func (e *RenamePrefixError) Unwrap() error {
+	return e.Err
+}
+
+// RenamePrefix calls RenamePrefixContext with a background context.
+func RenamePrefix(oldDB, newDB Database, opts *RenamePrefixOptions) (*RenamePrefixResult, error) {
+	return RenamePrefixContext(context.Background(), oldDB, newDB, opts)
+}
+
+// RenamePrefixContext moves the databases of an instance to a new prefix,
+// when its domain changes. Each database is replicated to the database of
+// the same doctype with the new prefix, and the replication is verified: the
+// numbers of documents must be the same, and the revisions of the documents
+// must be in the new database. The old databases are deleted only with
+// DeleteOld, once all the databases have been verified. It can be run
+// again after a failure or a crash: the databases already replicated and
+// verified are skipped, and those already deleted are no longer listed. The
+// result is returned even with an error.
+func RenamePrefixContext(ctx context.Context, oldDB, newDB Database, opts *RenamePrefixOptions) (*RenamePrefixResult, error) {
+	if opts == nil {
+		opts = &RenamePrefixOptions{}
+	}
+	res := &RenamePrefixResult{}
+	doctypes, err := AllDoctypesContext(ctx, oldDB)
+	if err != nil {
+		return res, err
+	}
+
+	for _, doctype := range doctypes {
+		if err := verifyRenamed(ctx, oldDB, newDB, doctype, opts.SpotCheck); err == nil {
+			res.Skipped = append(res.Skipped, doctype)
+			continue
+		}
+		if err := replicateDB(ctx, oldDB, newDB, doctype); err != nil {
+			return res, &RenamePrefixError{Doctype: doctype, Step: "replicate", Err: err}
+		}
+		if err := verifyRenamed(ctx, oldDB, newDB, doctype, opts.SpotCheck); err != nil {
+			return res, &RenamePrefixError{Doctype: doctype, Step: "verify", Err: err}
+		}
+		res.Replicated = append(res.Replicated, doctype)
+	}
+
+	if !opts.DeleteOld {
+		return res, nil
+	}
+	for _, doctype := range doctypes {
+		if err := DeleteDBContext(ctx, oldDB, doctype); err != nil && !IsNoDatabaseError(err) {
+			return res, &RenamePrefixError{Doctype: doctype, Step: "delete", Err: err}
+		}
+		res.Deleted = append(res.Deleted, doctype)
+	}
+	return res, nil
+}
+
+// verifyRenamed checks that the database of a doctype with the new prefix
+// has the same number of documents as the old one, and the revisions of its
+// documents, or of the first spotCheck ones.
+func verifyRenamed(ctx context.Context, oldDB, newDB Database, doctype string, spotCheck int) error {
+	oldStatus, err := DBStatusContext(ctx, oldDB, doctype)
+	if err != nil {
+		return err
+	}
+	newStatus, err := DBStatusContext(ctx, newDB, doctype)
+	if err != nil {
+		return err
+	}
+	if oldStatus.DocCount != newStatus.DocCount {
+		return fmt.Errorf("%d documents instead of %d", newStatus.DocCount, oldStatus.DocCount)
+	}
+
+	revs := make(map[string][]string)
+	var checkErr error
+	seq, res := AllDocsSeqContext(ctx, oldDB, doctype, AllDocsRequest{Limit: spotCheck})
+	seq(func(id string, doc json.RawMessage) bool {
+		var d struct {
+			Rev string `json:"_rev"`
+		}
+		if checkErr = json.Unmarshal(doc, &d); checkErr != nil {
+			return false
+		}
+		revs[id] = []string{d.Rev}
+		if len(revs) >= seqPageSize {
+			checkErr = checkRevsDiff(ctx, newDB, doctype, revs)
+			revs = make(map[string][]string)
+		}
+		return checkErr == nil
+	})
+	if checkErr != nil {
+		return checkErr
+	}
+	if err := res.Err(); err != nil {
+		return err
+	}
+	return checkRevsDiff(ctx, newDB, doctype, revs)
+}
+
+// checkRevsDiff returns an error if one of the revisions is missing in the
+// database.
+func checkRevsDiff(ctx context.Context, db Database, doctype string, revs map[string][]string) error {
+	if len(revs) == 0 {
+		return nil
+	}
+	var missing map[string]struct {
+		Missing []string `json:"missing"`
+	}
+	if err := makeRequest(ctx, db, doctype, http.MethodPost, "_revs_diff", revs, &missing); err != nil {
+		return err
+	}
+	for id, diff := range missing {
+		if len(diff.Missing) > 0 {
+			return fmt.Errorf("the revision %s of %s is missing", diff.Missing[0], id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package couchdb
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenamePrefix(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := &replicatingCouch{memCouch: newMemCouch()}
+	restore := useTestServer(t, server)
+	defer restore()
+	config.GetConfig().CouchDB.Auth = url.UserPassword("admin", "secret")
+	config.GetConfig().CouchDB.SessionAuth = false
+
+	oldDB := prefixer.NewPrefixer("old.cozy.tools", "renameold")
+	newDB := prefixer.NewPrefixer("new.cozy.tools", "renamenew")
+	server.seed(oldDB, consts.Files, `{"_id":"file1","name":"a"}`, `{"_id":"file2","name":"b"}`)
+	var notes []string
+	for i := 0; i < 20; i++ {
+		notes = append(notes, fmt.Sprintf(`{"_id":"note%02d"}`, i))
+	}
+	server.seed(oldDB, "io.cozy.tests.notes", notes...)
+	opts := &RenamePrefixOptions{}
+
+	// A replication that has missed a document is not verified
+	server.lossy = true
+	res, err := RenamePrefix(oldDB, newDB, opts)
+	var renameErr *RenamePrefixError
+	if assert.True(t, errors.As(err, &renameErr)) {
+		assert.Equal(t, consts.Files, renameErr.Doctype)
+		assert.Equal(t, "verify", renameErr.Step)
+	}
+	assert.Empty(t, res.Replicated)
+	assert.Empty(t, res.Deleted)
+
+	// The old databases are kept for a manual check by default
+	server.lossy = false
+	res, err = RenamePrefix(oldDB, newDB, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{consts.Files, "io.cozy.tests.notes"}, res.Replicated)
+	assert.Empty(t, res.Deleted)
+	assert.Len(t, server.dbs, 4)
+
+	// And deleted by another run, which skips the replications
+	replications := len(server.replications)
+	opts.DeleteOld = true
+	res, err = RenamePrefix(oldDB, newDB, opts)
+	assert.NoError(t, err)
+	assert.Empty(t, res.Replicated)
+	assert.Equal(t, []string{consts.Files, "io.cozy.tests.notes"}, res.Skipped)
+	assert.Equal(t, []string{consts.Files, "io.cozy.tests.notes"}, res.Deleted)
+	assert.Equal(t, replications, len(server.replications))
+	assert.Len(t, server.dbs, 2)
+	assert.Len(t, server.dbs[EscapeCouchdbName(newDB.DBPrefix()+"/io.cozy.tests.notes")], 20)
+
+	// Nothing is left to do
+	res, err = RenamePrefix(oldDB, newDB, opts)
+	assert.NoError(t, err)
+	assert.Empty(t, res.Deleted)
+}
+
+func TestRenamePrefixSpotCheck(t *testing.T) {
+	SetKnownDBsSize(DefaultKnownDBsSize)
+	server := &replicatingCouch{memCouch: newMemCouch()}
+	restore := useTestServer(t, server)
+	defer restore()
+	config.GetConfig().CouchDB.Auth = url.UserPassword("admin", "secret")
+	config.GetConfig().CouchDB.SessionAuth = false
+
+	oldDB := prefixer.NewPrefixer("old.cozy.tools", "spotold")
+	newDB := prefixer.NewPrefixer("new.cozy.tools", "spotnew")
+	server.seed(oldDB, "io.cozy.tests.notes", `{"_id":"note1"}`, `{"_id":"note2"}`)
+	// The new database has the same count, but not the same revisions
+	server.seed(newDB, "io.cozy.tests.notes", `{"_id":"note1"}`, `{"_id":"note2"}`)
+	server.dbs[EscapeCouchdbName(newDB.DBPrefix()+"/io.cozy.tests.notes")]["note2"]["_rev"] = []byte(`"2-other"`)
+	server.refuse = true
+
+	_, err := RenamePrefix(oldDB, newDB, &RenamePrefixOptions{SpotCheck: 10})
+	var renameErr *RenamePrefixError
+	if assert.True(t, errors.As(err, &renameErr)) {
+		assert.Equal(t, "replicate", renameErr.Step)
+	}
+
+	// Without the spot check, all the revisions are checked, and the same
+	// count is not enough to skip the replication and delete the source
+	res, err := RenamePrefix(oldDB, newDB, &RenamePrefixOptions{DeleteOld: true})
+	if assert.True(t, errors.As(err, &renameErr)) {
+		assert.Equal(t, "replicate", renameErr.Step)
+	}
+	assert.Empty(t, res.Skipped)
+	assert.Empty(t, res.Deleted)
+	assert.Len(t, server.dbs[EscapeCouchdbName(oldDB.DBPrefix()+"/io.cozy.tests.notes")], 2)
+}
@@ -0,0 +1,125 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// doctypeReportConcurrency is the number of databases queried at the same
+// time by DoctypeReport.
+const doctypeReportConcurrency = 8
+
+// DoctypeStats are the statistics of the database of a doctype, as returned
+// by DoctypeReport.
+type DoctypeStats struct {
+	Doctype string `json:"doctype"`
+	// DocCount is the number of documents, without the design documents if
+	// they are counted separately
+	DocCount     int `json:"doc_count"`
+	DeletedCount int `json:"deleted_count"`
+	// ActiveSize is the size in bytes of the live data in the database
+	ActiveSize int `json:"active_size"`
+	// FileSize is the size in bytes of the database files on the disk
+	FileSize int `json:"file_size"`
+	// DesignDocCount is the number of design documents, only filled when
+	// asked with the CountDesignDocs option
+	DesignDocCount int `json:"design_doc_count,omitempty"`
+}
+
+// DoctypeReportOptions are the options of DoctypeReportContext.
+type DoctypeReportOptions struct {
+	// CountDesignDocs counts the design documents of each database, with an
+	// extra request, and removes them from the DocCount.
+	CountDesignDocs bool
+}
+
+// DoctypeReport calls DoctypeReportContext with a background context and the
+// default options.
+func DoctypeReport(db Database) ([]DoctypeStats, error) {
+	return DoctypeReportContext(context.Background(), db, DoctypeReportOptions{})
+}
+
+// DoctypeReportContext returns the statistics of the databases of an
+// instance, one per doctype, sorted by file size (the largest first), to see
+// what is taking space. The databases are queried concurrently, 8 at a time,
+// and the first error cancels the report. A database deleted while the
+// report is made is skipped.
+func DoctypeReportContext(ctx context.Context, db Database, opts DoctypeReportOptions) ([]DoctypeStats, error) {
+	doctypes, err := AllDoctypesContext(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	stats := make([]DoctypeStats, 0, len(doctypes))
+	queue := make(chan string)
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		defer close(queue)
+		for _, doctype := range doctypes {
+			select {
+			case queue <- doctype:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	for i := 0; i < doctypeReportConcurrency && i < len(doctypes); i++ {
+		g.Go(func() error {
+			for doctype := range queue {
+				s, err := doctypeStats(ctx, db, doctype, opts)
+				if IsNoDatabaseError(err) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				stats = append(stats, *s)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].FileSize != stats[j].FileSize {
+			return stats[i].FileSize > stats[j].FileSize
+		}
+		return stats[i].Doctype < stats[j].Doctype
+	})
+	return stats, nil
+}
+
+// doctypeStats returns the statistics of the database of a doctype.
+func doctypeStats(ctx context.Context, db Database, doctype string, opts DoctypeReportOptions) (*DoctypeStats, error) {
+	status, err := DBStatusContext(ctx, db, doctype)
+	if err != nil {
+		return nil, err
+	}
+	s := &DoctypeStats{
+		Doctype:      doctype,
+		DocCount:     status.DocCount,
+		DeletedCount: status.DocDelCount,
+		ActiveSize:   status.Sizes.Active,
+		FileSize:     status.Sizes.File,
+	}
+	if opts.CountDesignDocs {
+		var designRes ViewResponse
+		err := makeRequest(ctx, db, doctype, http.MethodGet, "_design_docs", nil, &designRes)
+		if err != nil {
+			return nil, err
+		}
+		s.DesignDocCount = len(designRes.Rows)
+		s.DocCount -= s.DesignDocCount
+	}
+	return s, nil
+}
@@ -0,0 +1,81 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reportServer is a fake CouchDB with the databases of an instance and their
+// statistics. The databases listed but not in stats have been deleted.
+type reportServer struct {
+	dbs   []string
+	stats map[string]string
+}
+
+func (s *reportServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/_all_dbs" {
+		names := make([]string, len(s.dbs))
+		for i, doctype := range s.dbs {
+			names[i] = fmt.Sprintf("%q", EscapeCouchdbName(TestPrefix.DBPrefix()+"/"+doctype))
+		}
+		_, _ = fmt.Fprintf(w, "[%s]", strings.Join(names, ","))
+		return
+	}
+	parts := strings.SplitN(strings.Trim(r.URL.EscapedPath(), "/"), "/", 2)
+	dbname, _ := url.PathUnescape(parts[0])
+	stats, ok := s.stats[dbname]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"not_found","reason":"Database does not exist."}`))
+		return
+	}
+	if len(parts) == 2 && parts[1] == "_design_docs" {
+		_, _ = w.Write([]byte(`{"total_rows":2,"offset":0,"rows":[{"id":"_design/a"},{"id":"_design/b"}]}`))
+		return
+	}
+	_, _ = w.Write([]byte(stats))
+}
+
+func TestDoctypeReport(t *testing.T) {
+	server := &reportServer{
+		dbs:   []string{"io.cozy.small", "io.cozy.big", "io.cozy.gone", "io.cozy.empty"},
+		stats: make(map[string]string),
+	}
+	dbStats := map[string]string{
+		"io.cozy.small": `{"doc_count":10,"doc_del_count":1,"sizes":{"active":100,"file":300,"external":90}}`,
+		"io.cozy.big":   `{"doc_count":1000,"doc_del_count":20,"sizes":{"active":5000,"file":9000,"external":4000}}`,
+		"io.cozy.empty": `{"doc_count":2,"doc_del_count":0,"sizes":{"active":10,"file":20,"external":0}}`,
+	}
+	for doctype, stats := range dbStats {
+		server.stats[EscapeCouchdbName(TestPrefix.DBPrefix()+"/"+doctype)] = stats
+	}
+	restore := useTestServer(t, server)
+	defer restore()
+
+	report, err := DoctypeReport(TestPrefix)
+	assert.NoError(t, err)
+	assert.Equal(t, []DoctypeStats{
+		{Doctype: "io.cozy.big", DocCount: 1000, DeletedCount: 20, ActiveSize: 5000, FileSize: 9000},
+		{Doctype: "io.cozy.small", DocCount: 10, DeletedCount: 1, ActiveSize: 100, FileSize: 300},
+		{Doctype: "io.cozy.empty", DocCount: 2, ActiveSize: 10, FileSize: 20},
+	}, report)
+
+	data, err := json.Marshal(report[1])
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"doctype":"io.cozy.small","doc_count":10,"deleted_count":1,"active_size":100,"file_size":300}`, string(data))
+
+	report, err = DoctypeReportContext(context.Background(), TestPrefix, DoctypeReportOptions{CountDesignDocs: true})
+	assert.NoError(t, err)
+	if assert.Len(t, report, 3) {
+		assert.Equal(t, 998, report[0].DocCount)
+		assert.Equal(t, 2, report[0].DesignDocCount)
+		assert.Equal(t, 0, report[2].DocCount)
+	}
+}
@@ -0,0 +1,48 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const (
+	// RequestIDHeader is the header used to send the request ID to CouchDB.
+	RequestIDHeader = "X-Request-ID"
+	// couchRequestIDHeader is the header where CouchDB echoes the request ID.
+	couchRequestIDHeader = "X-Couch-Request-ID"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context where the requests made to CouchDB are sent
+// with the given request ID, to correlate the logs of the stack with the
+// logs of CouchDB.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID of the context, if any.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// requestIDFor returns the request ID of the context, or a new one if the
+// context has none.
+func requestIDFor(ctx context.Context) string {
+	if id, ok := RequestIDFromContext(ctx); ok {
+		return id
+	}
+	return utils.RandomString(16)
+}
+
+// responseRequestID returns the request ID echoed by CouchDB in a response,
+// or the one sent by the stack if CouchDB has not echoed it.
+func responseRequestID(resp *http.Response, sent string) string {
+	if id := resp.Header.Get(couchRequestIDHeader); id != "" {
+		return id
+	}
+	return sent
+}
@@ -0,0 +1,67 @@
+package couchdb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// DefaultMaxResponseSize is the size in bytes over which the response of
+// CouchDB is not read, unless SetMaxResponseSize is called.
+const DefaultMaxResponseSize = 64 << 20
+
+var maxResponseSize int64 = DefaultMaxResponseSize
+
+// SetMaxResponseSize sets the size in bytes over which a response from
+// CouchDB is not read, to protect the memory of the stack from the requests
+// that return too many documents. The streaming requests, like ForeachDocs
+// or the continuous changes feeds, are not limited. A size of 0 disables the
+// limit.
+func SetMaxResponseSize(size int64) {
+	atomic.StoreInt64(&maxResponseSize, size)
+}
+
+// limitResponse returns the body with the size limit, if any.
+func limitResponse(body io.ReadCloser) io.ReadCloser {
+	limit := atomic.LoadInt64(&maxResponseSize)
+	if limit <= 0 {
+		return body
+	}
+	return &limitedBody{ReadCloser: body, remaining: limit, limit: limit}
+}
+
+// limitedBody is like an io.LimitReader, but it returns an error instead of
+// io.EOF when the body is larger than the limit.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	limit     int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Check if the body ends exactly at the limit
+		var b [1]byte
+		n, err := l.ReadCloser.Read(b[:])
+		if n > 0 {
+			return 0, newResponseTooLargeError(l.limit)
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func newResponseTooLargeError(limit int64) error {
+	return &Error{
+		StatusCode: http.StatusInternalServerError,
+		Name:       "response_too_large",
+		Reason: fmt.Sprintf("the response is larger than %d bytes, "+
+			"a paginated or streaming API should be used", limit),
+	}
+}
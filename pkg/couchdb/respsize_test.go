@@ -0,0 +1,60 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxResponseSize(t *testing.T) {
+	body := `{"rows":[{"id":"a","doc":{"_id":"a","data":"` + strings.Repeat("x", 200) + `"}}]}`
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer restore()
+	defer SetMaxResponseSize(DefaultMaxResponseSize)
+
+	SetMaxResponseSize(100)
+	var docs []JSONDoc
+	err := GetAllDocs(TestPrefix, TestDoctype, nil, &docs)
+	assert.True(t, errors.Is(err, ErrResponseTooLarge))
+	if couchErr, ok := IsCouchError(err); assert.True(t, ok) {
+		assert.Contains(t, couchErr.Reason, "larger than 100 bytes")
+		assert.NotEmpty(t, couchErr.RequestID)
+	}
+
+	// The streaming APIs are not limited
+	count := 0
+	err = ForeachDocs(TestPrefix, TestDoctype, func(id string, doc json.RawMessage) error {
+		count++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	SetMaxResponseSize(0)
+	assert.NoError(t, GetAllDocs(TestPrefix, TestDoctype, nil, &docs))
+	assert.Len(t, docs, 1)
+}
+
+func TestLimitedBody(t *testing.T) {
+	read := func(body string, limit int64) (string, error) {
+		l := &limitedBody{
+			ReadCloser: ioutil.NopCloser(strings.NewReader(body)),
+			remaining:  limit,
+			limit:      limit,
+		}
+		data, err := ioutil.ReadAll(l)
+		return string(data), err
+	}
+	data, err := read("0123456789", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", data)
+	_, err = read("0123456789", 9)
+	assert.True(t, errors.Is(err, ErrResponseTooLarge))
+}
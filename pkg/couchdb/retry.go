@@ -0,0 +1,251 @@
+package couchdb
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+const (
+	// retryBaseDelay is the delay before the first retry, it is doubled for
+	// each new attempt.
+	retryBaseDelay = 100 * time.Millisecond
+	// retryMaxDelay is the maximal delay between two attempts.
+	retryMaxDelay = 5 * time.Second
+)
+
+// RetryPolicy tells which requests can be sent again automatically when
+// CouchDB is overloaded or when the connection has failed.
+type RetryPolicy int
+
+const (
+	// RetryIdempotent is the default policy: only the requests that have the
+	// same effect when they are sent twice are retried. It means the GET and
+	// HEAD requests, the POST requests that only read data (_find, _all_docs,
+	// etc.), and the PUT and DELETE requests on a known revision.
+	RetryIdempotent RetryPolicy = iota
+	// RetryNever disables the automatic retries.
+	RetryNever
+	// RetryAlways retries all the requests, even the POST that can create
+	// documents. It can be used when a duplicate is not an issue, like for the
+	// bulk writes where the conflicts are handled row by row.
+	RetryAlways
+)
+
+type retryPolicyKey struct{}
+
+// WithRetryPolicy returns a context where the requests made to CouchDB are
+// retried according to the given policy.
+func WithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+func retryPolicyFor(ctx context.Context) (RetryPolicy, bool) {
+	policy, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy)
+	return policy, ok
+}
+
+// canRetry returns true if a request can be retried with the policy of the
+// context.
+func canRetry(ctx context.Context, idempotent bool) bool {
+	policy, _ := retryPolicyFor(ctx)
+	switch policy {
+	case RetryAlways:
+		return true
+	case RetryIdempotent:
+		return idempotent
+	default:
+		return false
+	}
+}
+
+// isIdempotent returns true if sending the request to CouchDB twice has the
+// same effect as sending it once.
+func isIdempotent(method, path string, reqbody interface{}) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		return isReadOnlyPost(path)
+	case http.MethodPut, http.MethodDelete:
+		return hasRev(path, reqbody)
+	}
+	return false
+}
+
+// readOnlyEndpoints are the endpoints where POST is used to send a query,
+// and not to write documents.
+var readOnlyEndpoints = []string{
+	"_all_docs",
+	"_bulk_get",
+	"_explain",
+	"_find",
+	"_view/",
+}
+
+func isReadOnlyPost(path string) bool {
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	for _, endpoint := range readOnlyEndpoints {
+		if strings.Contains(path, endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRev returns true if the request is made on a known revision of a
+// document: CouchDB will reject a replay with a conflict.
+func hasRev(path string, reqbody interface{}) bool {
+	if i := strings.Index(path, "?"); i >= 0 {
+		if q, err := url.ParseQuery(path[i+1:]); err == nil && q.Get("rev") != "" {
+			return true
+		}
+	}
+	switch doc := reqbody.(type) {
+	case Doc:
+		return doc.Rev() != ""
+	case map[string]interface{}:
+		rev, _ := doc["_rev"].(string)
+		return rev != ""
+	}
+	return false
+}
+
+// sendWithRetry sends a request to CouchDB, and retries it with an
+// exponential backoff if CouchDB is overloaded (429 and 503) or if the
+// connection has failed, when the retry policy allows it. The newRequest
+// function is called for each attempt with the URL of the node to use, so
+// that the body of the request can be read again. With a cluster, a request
+// that has failed because its node is down is retried immediately on another
+// node, if it has not been tried yet.
+//
+// The returned watchdog must be stopped when the response has been read.
+func sendWithRetry(ctx context.Context, db Database, doctype string, log Logger, idempotent bool, newRequest func(ctx context.Context, node *url.URL) (*http.Request, error)) (*http.Response, *watchdog, error) {
+	retry := config.GetConfig().CouchDB.Retry
+	retryable := canRetry(ctx, idempotent)
+	if !retryable {
+		retry.MaxAttempts = 1
+	}
+	urls := clusterFromContext(ctx).urls
+	tried := make(map[string]bool)
+	start := time.Now()
+	for attempt, sent := 1, 0; ; attempt, sent = attempt+1, sent+1 {
+		node := pickNode(urls, tried)
+		tried[node.Host] = true
+		reqCtx, watchdog := withRequestTimeout(ctx)
+		req, err := newRequest(withRetries(reqCtx, sent), node)
+		if err != nil {
+			watchdog.stop()
+			return nil, nil, newRequestError(err)
+		}
+		resp, err := sendWithHooks(ctx, db, req)
+		if _, ok := err.(*hookError); ok {
+			watchdog.stop()
+			return nil, nil, err
+		}
+		failover := retryable && reqCtx.Err() == nil &&
+			isNodeDown(resp, err) && hasUntriedNode(urls, tried)
+		if !failover && (attempt >= retry.MaxAttempts || !shouldRetry(reqCtx, resp, err)) {
+			return resp, watchdog, err
+		}
+		var delay time.Duration
+		if !failover {
+			delay = retryDelay(attempt, resp)
+			if retry.MaxDuration > 0 && time.Since(start)+delay > retry.MaxDuration {
+				return resp, watchdog, err
+			}
+		}
+
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			drainAndClose(resp.Body)
+		}
+		watchdog.stop()
+		observeRetry(req.Method, doctype)
+		if failover {
+			log.Warnf("failover %s %s from %s (attempt %d): %s",
+				req.Method, req.URL.Path, node.Host, attempt, reason)
+			// Another node can take the request right now, and this attempt
+			// does not count
+			attempt--
+			continue
+		}
+		log.Warnf("retry %s %s in %s (attempt %d): %s",
+			req.Method, req.URL.Path, delay, attempt, reason)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// shouldRetry returns true if the request can be sent again after the given
+// response or error. A request that has been canceled or has timed out is not
+// retried.
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		// The errors from CouchDB, like a failed login, are not transient,
+		// contrary to the connection errors.
+		_, isCouchErr := IsCouchError(err)
+		return !isCouchErr
+	}
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// retryDelay returns how long to wait before the next attempt: the
+// Retry-After header if CouchDB has sent one, or else an exponential backoff
+// with jitter.
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return d
+		}
+	}
+	backoff := retryBaseDelay << uint(attempt-1)
+	if backoff <= 0 || backoff > retryMaxDelay {
+		backoff = retryMaxDelay
+	}
+	// Add some jitter, to avoid having all the stack goroutines retrying at the
+	// same time
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which can be a
+// number of seconds or an HTTP date.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
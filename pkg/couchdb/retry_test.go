@@ -0,0 +1,145 @@
+package couchdb
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryOnOverload(t *testing.T) {
+	var calls int32
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error":"too_many_requests","reason":"all_dbs_active"}`))
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			assert.Equal(t, `{"keys":["foo"]}`, string(body))
+			_, _ = w.Write([]byte(`{"total_rows":1,"rows":[]}`))
+		}
+	}))
+	defer restore()
+	config.GetConfig().CouchDB.Retry = config.CouchDBRetry{MaxAttempts: 3}
+
+	var results []JSONDoc
+	req := &AllDocsRequest{Keys: []string{"foo"}}
+	err := GetAllDocs(TestPrefix, TestDoctype, req, &results)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	config.GetConfig().CouchDB.Retry = config.CouchDBRetry{MaxAttempts: 2}
+	err = GetAllDocs(TestPrefix, TestDoctype, req, &results)
+	if assert.Error(t, err) {
+		couchErr, ok := IsCouchError(err)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusServiceUnavailable, couchErr.StatusCode)
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestRetryBudget(t *testing.T) {
+	var calls int32
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer restore()
+	config.GetConfig().CouchDB.Retry = config.CouchDBRetry{
+		MaxAttempts: 5,
+		MaxDuration: time.Second,
+	}
+
+	_, err := DBStatus(TestPrefix, TestDoctype)
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	d, ok := parseRetryAfter("", now)
+	assert.False(t, ok)
+	d, ok = parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, d)
+	d, ok = parseRetryAfter("Thu, 01 Oct 2020 12:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+
+	for attempt := 1; attempt < 100; attempt++ {
+		d = retryDelay(attempt, nil)
+		assert.True(t, d > 0 && d <= retryMaxDelay)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var calls int32
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc"}`))
+		default:
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"ok":true,"id":"foo","rev":"1-abc"}`))
+		}
+	}))
+	defer restore()
+	config.GetConfig().CouchDB.Retry = config.CouchDBRetry{MaxAttempts: 3}
+
+	// GET is replayed
+	var doc JSONDoc
+	err := GetDoc(TestPrefix, TestDoctype, "foo", &doc)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+	// POST to create a document is not replayed by default
+	atomic.StoreInt32(&calls, 0)
+	created := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"foo": "bar"}}
+	err = CreateDoc(TestPrefix, created)
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	// Unless the caller opts in
+	atomic.StoreInt32(&calls, 0)
+	ctx := WithRetryPolicy(context.Background(), RetryAlways)
+	err = CreateDocContext(ctx, TestPrefix, created)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+	// And GET is not replayed when the retries are disabled
+	atomic.StoreInt32(&calls, 0)
+	ctx = WithRetryPolicy(context.Background(), RetryNever)
+	err = GetDocContext(ctx, TestPrefix, TestDoctype, "foo", &doc)
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestIsIdempotent(t *testing.T) {
+	assert.True(t, isIdempotent(http.MethodGet, "db/foo", nil))
+	assert.True(t, isIdempotent(http.MethodPost, "db/_find", nil))
+	assert.True(t, isIdempotent(http.MethodPost, "db/_design/foo/_view/bar?limit=1", nil))
+	assert.False(t, isIdempotent(http.MethodPost, "db/", nil))
+	assert.False(t, isIdempotent(http.MethodPost, "db/_bulk_docs", nil))
+	assert.True(t, isIdempotent(http.MethodDelete, "db/foo?rev=1-abc", nil))
+	assert.False(t, isIdempotent(http.MethodPut, "db/foo", map[string]interface{}{}))
+	assert.True(t, isIdempotent(http.MethodPut, "db/foo", map[string]interface{}{"_rev": "1-abc"}))
+	assert.True(t, isIdempotent(http.MethodPut, "db/foo", &JSONDoc{M: map[string]interface{}{"_rev": "1-abc"}}))
+}
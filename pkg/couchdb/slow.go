@@ -0,0 +1,155 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSlowRequestThreshold is the duration after which a request to
+// CouchDB is logged as slow, unless SetSlowRequestThresholds is called.
+const DefaultSlowRequestThreshold = 1 * time.Second
+
+var (
+	slowMu        sync.RWMutex
+	slowThreshold = DefaultSlowRequestThreshold
+	slowDoctypes  map[string]time.Duration
+	// slowMin is the lowest of the thresholds, to check a request with a
+	// single comparison when it is fast
+	slowMin = int64(DefaultSlowRequestThreshold)
+)
+
+// SetSlowRequestThresholds sets the duration after which a request to CouchDB
+// is logged as slow, with a warning. The thresholds of some doctypes can be
+// overridden, for example for the changes feeds of the files. A threshold of
+// 0 disables the logs.
+func SetSlowRequestThresholds(threshold time.Duration, perDoctype map[string]time.Duration) {
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	slowThreshold = threshold
+	slowDoctypes = make(map[string]time.Duration, len(perDoctype))
+	min := time.Duration(math.MaxInt64)
+	if threshold > 0 {
+		min = threshold
+	}
+	for doctype, d := range perDoctype {
+		slowDoctypes[doctype] = d
+		if d > 0 && d < min {
+			min = d
+		}
+	}
+	atomic.StoreInt64(&slowMin, int64(min))
+}
+
+func slowThresholdFor(doctype string) time.Duration {
+	slowMu.RLock()
+	defer slowMu.RUnlock()
+	if d, ok := slowDoctypes[doctype]; ok {
+		return d
+	}
+	return slowThreshold
+}
+
+// logSlowRequest is the hook that logs the requests to CouchDB that have
+// taken more time than their threshold.
+func logSlowRequest(req *http.Request, resp *http.Response, err error, d time.Duration) {
+	if int64(d) < atomic.LoadInt64(&slowMin) {
+		return
+	}
+	db, ok := req.Context().Value(databaseKey{}).(Database)
+	if !ok {
+		return
+	}
+	info, _ := GetRequestInfo(req)
+	threshold := slowThresholdFor(info.Doctype)
+	if threshold <= 0 || d < threshold {
+		return
+	}
+
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	doctype := info.Doctype
+	if doctype == "" {
+		doctype = "-"
+	}
+	reqID := responseRequestID(resp, req.Header.Get(RequestIDHeader))
+	var fields string
+	if strings.HasSuffix(req.URL.Path, "/_find") {
+		fields = " on fields " + strings.Join(selectorFields(req), ",")
+	}
+	loggerFor(db).Warnf("slow request %s %s%s: %s (status %d, request %s)",
+		req.Method, doctype, fields, d, status, reqID)
+}
+
+// selectorFields returns the names of the fields used in the selector of a
+// _find request, without their values.
+func selectorFields(req *http.Request) []string {
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil
+	}
+	var find struct {
+		Selector interface{} `json:"selector"`
+	}
+	if err := json.Unmarshal(data, &find); err != nil {
+		return nil
+	}
+	names := make(map[string]struct{})
+	collectFields(find.Selector, "", names)
+	fields := make([]string, 0, len(names))
+	for name := range names {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// collectFields adds the field names of a selector to names. The operators,
+// like $or or $gt, are not fields, but they can contain some, and the fields
+// of the nested objects are named with a dot, like metadata.datetime.
+func collectFields(selector interface{}, prefix string, names map[string]struct{}) {
+	switch s := selector.(type) {
+	case map[string]interface{}:
+		for key, val := range s {
+			if strings.HasPrefix(key, "$") {
+				collectFields(val, prefix, names)
+				continue
+			}
+			name := prefix + key
+			if sub, ok := val.(map[string]interface{}); ok && hasField(sub) {
+				collectFields(sub, name+".", names)
+			} else {
+				names[name] = struct{}{}
+			}
+		}
+	case []interface{}:
+		for _, val := range s {
+			collectFields(val, prefix, names)
+		}
+	}
+}
+
+func hasField(obj map[string]interface{}) bool {
+	for key := range obj {
+		if !strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package couchdb
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowRequests(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"docs":[]}`))
+	}))
+	defer restore()
+	defer SetLogger(defaultLogger)
+	defer SetSlowRequestThresholds(DefaultSlowRequestThreshold, nil)
+
+	rec := &recordLogger{}
+	SetLogger(func(db Database) Logger { return rec })
+	SetSlowRequestThresholds(10*time.Millisecond, map[string]time.Duration{
+		"io.cozy.files": time.Minute,
+	})
+
+	var docs []JSONDoc
+	req := &FindRequest{Selector: mango.And(
+		mango.Equal("dir_id", "secret-value"),
+		mango.Gt("metadata.datetime", "2020"),
+	)}
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, req, &docs))
+	assert.Contains(t, rec.String(), "warn slow request POST io.cozy.testobject on fields dir_id,metadata.datetime: ")
+	assert.Contains(t, rec.String(), "(status 200, request ")
+	assert.NotContains(t, rec.String(), "secret-value")
+
+	rec = &recordLogger{}
+	assert.NoError(t, FindDocs(TestPrefix, "io.cozy.files", req, &docs))
+	assert.NotContains(t, rec.String(), "slow request")
+
+	SetSlowRequestThresholds(0, nil)
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, req, &docs))
+	assert.NotContains(t, rec.String(), "slow request")
+}
+
+func TestSelectorFields(t *testing.T) {
+	fields := make(map[string]struct{})
+	collectFields(map[string]interface{}{
+		"dir_id": "foo",
+		"$or": []interface{}{
+			map[string]interface{}{"name": map[string]interface{}{"$regex": "^a"}},
+			map[string]interface{}{"trashed": true},
+		},
+		"metadata": map[string]interface{}{"datetime": map[string]interface{}{"$gt": "2020"}},
+	}, "", fields)
+	assert.Equal(t, map[string]struct{}{
+		"dir_id":            {},
+		"name":              {},
+		"trashed":           {},
+		"metadata.datetime": {},
+	}, fields)
+}
@@ -0,0 +1,124 @@
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// SoftDeleteField is the field with the date of the soft-deletion of a
+// document. CouchDB refuses the fields starting with an underscore, so it is
+// namespaced with cozy instead.
+const SoftDeleteField = "cozyTrashedAt"
+
+// softDeleteIndexName is the name of the index on SoftDeleteField.
+const softDeleteIndexName = "by-cozy-trashed-at"
+
+// purgeBatch is the number of documents deleted at once by PurgeTrashed.
+const purgeBatch = 100
+
+// ErrNotSoftDeletable is the error returned by SoftDelete for a document
+// that is neither a JSONDoc nor a SoftDeletable.
+var ErrNotSoftDeletable = errors.New("CouchDB: the document cannot be soft-deleted")
+
+// SoftDeletable is the interface of the Go types that can be soft-deleted.
+// They must serialize the date in the SoftDeleteField field, and omit it when
+// it is nil.
+type SoftDeletable interface {
+	SetTrashedAt(at *time.Time)
+}
+
+// SoftDeleteIndex returns the index on SoftDeleteField for a doctype, used
+// by PurgeTrashed.
+func SoftDeleteIndex(doctype string) *mango.Index {
+	return mango.IndexOnFields(doctype, softDeleteIndexName, []string{SoftDeleteField})
+}
+
+// RegisterSoftDelete adds the index on SoftDeleteField for a doctype to the
+// indexes created for the instances. It is meant to be called in an init
+// function.
+func RegisterSoftDelete(doctype string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	Indexes = append(Indexes, SoftDeleteIndex(doctype))
+}
+
+// SoftDelete calls SoftDeleteContext with a background context.
+func SoftDelete(db Database, doc Doc) error {
+	return SoftDeleteContext(context.Background(), db, doc)
+}
+
+// SoftDeleteContext puts a document in the trash: it is kept in CouchDB, with
+// the date of its soft-deletion in SoftDeleteField, and it can be excluded
+// from the results of FindDocs with FindRequest.ExcludeTrashed.
+func SoftDeleteContext(ctx context.Context, db Database, doc Doc) error {
+	now := timestampNow()
+	switch d := doc.(type) {
+	case SoftDeletable:
+		d.SetTrashedAt(&now)
+	case *JSONDoc:
+		if err := d.Set(SoftDeleteField, now.Format(timestampLayout)); err != nil {
+			return err
+		}
+	default:
+		return ErrNotSoftDeletable
+	}
+	return UpdateDocContext(ctx, db, doc)
+}
+
+// excludingTrashed returns a copy of the request where the selector excludes
+// the soft-deleted documents.
+func (r *FindRequest) excludingTrashed() *FindRequest {
+	notTrashed := mango.Map{SoftDeleteField: mango.Map{"$exists": false}}
+	req := *r
+	if r.Selector == nil {
+		req.Selector = notTrashed
+	} else {
+		req.Selector = mango.And(r.Selector, notTrashed)
+	}
+	return &req
+}
+
+// PurgeTrashed calls PurgeTrashedContext with a background context.
+func PurgeTrashed(db Database, doctype string, olderThan time.Duration) (int, error) {
+	return PurgeTrashedContext(context.Background(), db, doctype, olderThan)
+}
+
+// PurgeTrashedContext deletes for real the documents of a doctype that have
+// been soft-deleted for longer than olderThan, and returns how many there
+// were.
+func PurgeTrashedContext(ctx context.Context, db Database, doctype string, olderThan time.Duration) (int, error) {
+	if err := DefineIndexContext(ctx, db, SoftDeleteIndex(doctype)); err != nil {
+		return 0, err
+	}
+	cutoff := timestampNow().Add(-olderThan).Format(timestampLayout)
+	purged := 0
+	for {
+		var docs []JSONDoc
+		req := &FindRequest{
+			UseIndex: softDeleteIndexName,
+			Selector: mango.Lt(SoftDeleteField, cutoff),
+			Limit:    purgeBatch,
+		}
+		if err := FindDocsContext(ctx, db, doctype, req, &docs); err != nil {
+			return purged, err
+		}
+		if len(docs) == 0 {
+			return purged, nil
+		}
+		toDelete := make([]Doc, len(docs))
+		for i := range docs {
+			docs[i].Type = doctype
+			toDelete[i] = &docs[i]
+		}
+		if err := BulkDeleteDocsContext(ctx, db, doctype, toDelete); err != nil {
+			return purged, err
+		}
+		purged += len(docs)
+		if len(docs) < purgeBatch {
+			return purged, nil
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+type trashableDoc struct {
+	testDoc
+	TrashedAt *time.Time `json:"cozyTrashedAt,omitempty"`
+}
+
+func (d *trashableDoc) SetTrashedAt(at *time.Time) { d.TrashedAt = at }
+
+func TestSoftDelete(t *testing.T) {
+	var sent []string
+	remaining := 150
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_index"):
+			sent = append(sent, "index "+string(body))
+			_, _ = w.Write([]byte(`{"result":"exists"}`))
+		case strings.HasSuffix(r.URL.Path, "/_find"):
+			sent = append(sent, "find "+string(body))
+			n := remaining
+			if n > 100 {
+				n = 100
+			}
+			docs := make([]string, n)
+			for i := range docs {
+				docs[i] = fmt.Sprintf(`{"_id":"doc%d","_rev":"1-abc"}`, remaining-i)
+			}
+			_, _ = w.Write([]byte(`{"docs":[` + strings.Join(docs, ",") + `]}`))
+		case strings.HasSuffix(r.URL.Path, "/_bulk_docs"):
+			var bulk struct {
+				Docs []interface{} `json:"docs"`
+			}
+			_ = json.Unmarshal(body, &bulk)
+			remaining -= len(bulk.Docs)
+			res := make([]UpdateResponse, len(bulk.Docs))
+			_ = json.NewEncoder(w).Encode(res)
+		case r.Method == http.MethodPut:
+			sent = append(sent, "put "+string(body))
+			_, _ = w.Write([]byte(`{"ok":true,"id":"foo","rev":"2-abc"}`))
+		default:
+			_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc"}`))
+		}
+	}))
+	defer restore()
+
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo", "_rev": "1-abc"}}
+	assert.NoError(t, SoftDelete(TestPrefix, doc))
+	assert.Equal(t, []string{`put {"_id":"foo","_rev":"1-abc","cozyTrashedAt":"2021-03-04T05:06:07.000Z"}`}, sent)
+	typed := &trashableDoc{testDoc: testDoc{TestID: "foo", TestRev: "1-abc"}}
+	assert.NoError(t, SoftDelete(TestPrefix, typed))
+	if assert.NotNil(t, typed.TrashedAt) {
+		assert.Equal(t, now, *typed.TrashedAt)
+	}
+	err := SoftDelete(TestPrefix, &testDoc{TestID: "foo", TestRev: "1-abc"})
+	assert.True(t, errors.Is(err, ErrNotSoftDeletable))
+
+	sent = nil
+	var results []JSONDoc
+	req := &FindRequest{Selector: mango.Equal("name", "bar"), ExcludeTrashed: true}
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, req, &results))
+	req = &FindRequest{ExcludeTrashed: true}
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, req, &results))
+	assert.Equal(t, []string{
+		`find {"selector":{"$and":[{"name":"bar"},{"cozyTrashedAt":{"$exists":false}}]}}`,
+		`find {"selector":{"cozyTrashedAt":{"$exists":false}}}`,
+	}, sent)
+
+	sent = nil
+	purged, err := PurgeTrashedContext(context.Background(), TestPrefix, TestDoctype, 30*24*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 150, purged)
+	assert.Equal(t, 0, remaining)
+	if assert.Len(t, sent, 3) {
+		assert.Equal(t, `index {"ddoc":"by-cozy-trashed-at","index":{"fields":["cozyTrashedAt"]}}`, sent[0])
+		assert.Equal(t, `find {"selector":{"cozyTrashedAt":{"$lt":"2021-02-02T05:06:07.000Z"}},"use_index":"by-cozy-trashed-at","limit":100}`, sent[1])
+	}
+
+	// The index is created with the others for the registered doctypes
+	defer func(indexes []*mango.Index) { Indexes = indexes }(Indexes)
+	assert.Empty(t, IndexesByDoctype(TestDoctype))
+	RegisterSoftDelete(TestDoctype)
+	assert.Equal(t, []*mango.Index{SoftDeleteIndex(TestDoctype)}, IndexesByDoctype(TestDoctype))
+}
@@ -1,6 +1,7 @@
 package couchdb
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -8,28 +9,33 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config/config"
 )
 
-// CheckStatus checks that the stack can talk to CouchDB, and returns an error
-// if it is not the case.
+// CheckStatus calls CheckStatusContext with a background context. It is kept
+// for compatibility, new code should use CheckStatusContext.
+//
+// Deprecated: use CheckStatusContext.
 func CheckStatus() (time.Duration, error) {
-	u := config.CouchURL().String() + "/_up"
-	req, err := http.NewRequest(http.MethodGet, u, nil)
+	return CheckStatusContext(context.Background())
+}
+
+// CheckStatusContext checks that the stack can talk to CouchDB, and returns an error
+// if it is not the case.
+func CheckStatusContext(ctx context.Context) (time.Duration, error) {
+	ctx, watchdog := withRequestTimeout(ctx)
+	defer watchdog.stop()
+	u := nodeURL(config.CouchURL(), "_up")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return 0, err
 	}
 	req.Header.Add("Accept", "application/json")
-	auth := config.GetConfig().CouchDB.Auth
-	if auth != nil {
-		if p, ok := auth.Password(); ok {
-			req.SetBasicAuth(auth.Username(), p)
-		}
-	}
+	setAuth(nil, defaultCluster(), req)
 	before := time.Now()
-	res, err := config.GetConfig().CouchDB.Client.Do(req)
+	res, err := httpClient().Do(req)
 	latency := time.Since(before)
 	if err != nil {
 		return 0, err
 	}
-	defer res.Body.Close()
+	defer drainAndClose(res.Body)
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		return 0, fmt.Errorf("Invalid responde code: %d", res.StatusCode)
 	}
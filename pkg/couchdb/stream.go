@@ -0,0 +1,132 @@
+package couchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// responseDecoder can be implemented by the resbody given to makeRequest to
+// decode the response itself, instead of json.Unmarshal.
+type responseDecoder interface {
+	decodeResponse(r io.Reader) error
+}
+
+// rowStream decodes the responses of CouchDB for the endpoints that return a
+// list of items, like the rows of _all_docs, the docs of _find, or the
+// results of _changes. The items of the array in the given field are given
+// one at a time to fn, so that the whole response is never kept in memory.
+// The other fields are kept as raw JSON in meta.
+type rowStream struct {
+	field string
+	fn    func(item json.RawMessage) error
+	meta  map[string]json.RawMessage
+}
+
+func newRowStream(field string, fn func(item json.RawMessage) error) *rowStream {
+	return &rowStream{
+		field: field,
+		fn:    fn,
+		meta:  make(map[string]json.RawMessage),
+	}
+}
+
+// callbackError is used to distinguish the errors returned by the callback
+// of a rowStream from the errors of decoding.
+type callbackError struct {
+	err error
+}
+
+func (e *callbackError) Error() string { return e.err.Error() }
+
+func (s *rowStream) decodeResponse(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("unexpected token %v", tok)
+		}
+		if key != s.field {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+			s.meta[key] = raw
+			continue
+		}
+		if err := expectDelim(dec, '['); err != nil {
+			return err
+		}
+		for dec.More() {
+			var item json.RawMessage
+			if err := dec.Decode(&item); err != nil {
+				return err
+			}
+			if err := s.fn(item); err != nil {
+				return &callbackError{err}
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// decodeMeta unmarshals the fields other than the list of items into v.
+func (s *rowStream) decodeMeta(v interface{}) error {
+	data, err := json.Marshal(s.meta)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %s, got %v", delim, tok)
+	}
+	return nil
+}
+
+// decodeResponse decodes the body of a response from CouchDB into resbody,
+// as it is read: the body is not kept in memory.
+func decodeResponse(r io.Reader, resbody interface{}) error {
+	if dec, ok := resbody.(responseDecoder); ok {
+		return dec.decodeResponse(r)
+	}
+	return json.NewDecoder(r).Decode(&resbody)
+}
+
+// decodeJSONDocs decodes a JSON array of documents, with json.Number for the
+// numbers, like JSONDoc.decodeResponse. They are given the doctype of their
+// database.
+func decodeJSONDocs(data []byte, doctype string, docs *[]JSONDoc) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var maps []map[string]interface{}
+	if err := dec.Decode(&maps); err != nil {
+		return err
+	}
+	*docs = make([]JSONDoc, len(maps))
+	for i, m := range maps {
+		(*docs)[i].M = m
+		(*docs)[i].extractType()
+		if doctype != "" {
+			(*docs)[i].Type = doctype
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRowStream(t *testing.T) {
+	body := `{"total_rows":3,"offset":0,"rows":[{"id":"a"},{"id":"b"},{"id":"c"}],"extra":{"x":[1,2]}}`
+	var ids []string
+	stream := newRowStream("rows", func(item json.RawMessage) error {
+		var row struct {
+			ID string `json:"id"`
+		}
+		assert.NoError(t, json.Unmarshal(item, &row))
+		ids = append(ids, row.ID)
+		return nil
+	})
+	assert.NoError(t, stream.decodeResponse(strings.NewReader(body)))
+	assert.Equal(t, []string{"a", "b", "c"}, ids)
+	var meta struct {
+		TotalRows int `json:"total_rows"`
+	}
+	assert.NoError(t, stream.decodeMeta(&meta))
+	assert.Equal(t, 3, meta.TotalRows)
+
+	stop := errors.New("stop")
+	stream = newRowStream("rows", func(item json.RawMessage) error { return stop })
+	err := stream.decodeResponse(strings.NewReader(body))
+	if assert.IsType(t, &callbackError{}, err) {
+		assert.Equal(t, stop, err.(*callbackError).err)
+	}
+
+	stream = newRowStream("rows", func(item json.RawMessage) error { return nil })
+	assert.Error(t, stream.decodeResponse(strings.NewReader(`{"rows":[{"id":"a"}`)))
+	assert.Error(t, stream.decodeResponse(strings.NewReader(`[]`)))
+}
+
+func TestForeachDocsStreaming(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("startkey_docid") == "" {
+			_, _ = w.Write([]byte(`{"total_rows":3,"offset":0,"rows":[
+				{"id":"_design/foo","doc":{"_id":"_design/foo"}},
+				{"id":"a","doc":{"_id":"a"}}
+			]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"total_rows":3,"offset":2,"rows":[{"id":"b","doc":{"_id":"b"}}]}`))
+	}))
+	defer restore()
+
+	var ids []string
+	err := ForeachDocsWithCustomPagination(TestPrefix, TestDoctype, 2, func(id string, doc json.RawMessage) error {
+		ids = append(ids, id)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ids)
+
+	stop := errors.New("stop")
+	err = ForeachDocs(TestPrefix, TestDoctype, func(id string, doc json.RawMessage) error {
+		return stop
+	})
+	assert.Equal(t, stop, err)
+}
+
+func TestGetChangesStreaming(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"results":[
+			{"seq":"1-a","id":"foo","changes":[{"rev":"1-abc"}]},
+			{"seq":"2-b","id":"bar","changes":[{"rev":"1-def"}]}
+		],"last_seq":"2-b","pending":3}`))
+	}))
+	defer restore()
+
+	res, err := GetChanges(TestPrefix, &ChangesRequest{DocType: TestDoctype})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2-b", res.LastSeq)
+		assert.Equal(t, 3, res.Pending)
+		if assert.Len(t, res.Results, 2) {
+			assert.Equal(t, "foo", res.Results[0].DocID)
+			assert.Equal(t, "1-def", res.Results[1].Changes[0].Rev)
+		}
+	}
+}
+
+func TestGetChangesSinceNow(t *testing.T) {
+	var since []string
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_changes") {
+			_, _ = w.Write([]byte(`{"update_seq":"7-g1AAAA","doc_count":4}`))
+			return
+		}
+		since = append(since, r.URL.Query().Get("since"))
+		_, _ = w.Write([]byte(`{"results":[],"last_seq":"7-g1AAAA","pending":0}`))
+	}))
+	defer restore()
+
+	// The normal feeds start at the current update sequence
+	res, err := GetChanges(TestPrefix, &ChangesRequest{DocType: TestDoctype, Since: ChangesSinceNow})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "7-g1AAAA", res.LastSeq)
+		assert.Empty(t, res.Results)
+	}
+
+	// And now is sent as is for the longpoll feeds
+	req := &ChangesRequest{DocType: TestDoctype, Feed: ChangesModeLongpoll, Since: ChangesSinceNow}
+	_, err = GetChanges(TestPrefix, req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"7-g1AAAA", "now"}, since)
+}
+
+// BenchmarkDecodeAllDocsBuffered is how a page of _all_docs was decoded
+// before the streaming: the body is read in memory, and then unmarshaled.
+func BenchmarkDecodeAllDocsBuffered(b *testing.B) {
+	body := makeAllDocsResponse(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := ioutil.ReadAll(bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var res AllDocsResponse
+		if err := json.Unmarshal(data, &res); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeAllDocsStreamed decodes the same page with a rowStream.
+func BenchmarkDecodeAllDocsStreamed(b *testing.B) {
+	body := makeAllDocsResponse(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream := newRowStream("rows", func(item json.RawMessage) error {
+			var row struct {
+				ID  string          `json:"id"`
+				Doc json.RawMessage `json:"doc"`
+			}
+			return json.Unmarshal(item, &row)
+		})
+		if err := stream.decodeResponse(bytes.NewReader(body)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBigIntegers(t *testing.T) {
+	const doc = `{"_id":"foo","_rev":"1-abc","size":9007199254740993,"ratio":0.5}`
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_find"):
+			_, _ = w.Write([]byte(`{"docs":[` + doc + `]}`))
+		case strings.HasSuffix(r.URL.Path, "/_all_docs"):
+			_, _ = w.Write([]byte(`{"rows":[{"id":"foo","doc":` + doc + `}]}`))
+		default:
+			_, _ = w.Write([]byte(doc))
+		}
+	}))
+	defer restore()
+
+	check := func(doc *JSONDoc) {
+		size, ok := doc.GetInt64Ok("size")
+		assert.True(t, ok)
+		assert.EqualValues(t, 9007199254740993, size)
+		_, ok = doc.GetInt64Ok("ratio")
+		assert.False(t, ok)
+		ratio, ok := doc.GetFloat64Ok("ratio")
+		assert.True(t, ok)
+		assert.Equal(t, 0.5, ratio)
+		data, err := json.Marshal(doc)
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), `"size":9007199254740993`)
+	}
+
+	out := &JSONDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", out))
+	check(out)
+
+	var docs []JSONDoc
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, &FindRequest{}, &docs))
+	if assert.Len(t, docs, 1) {
+		check(&docs[0])
+	}
+
+	docs = nil
+	assert.NoError(t, GetAllDocs(TestPrefix, TestDoctype, nil, &docs))
+	if assert.Len(t, docs, 1) {
+		check(&docs[0])
+	}
+
+	// The typed structs are not changed
+	var typed struct {
+		Size float64 `json:"size"`
+	}
+	assert.NoError(t, makeRequest(context.Background(), TestPrefix, TestDoctype, http.MethodGet, "foo", nil, &typed))
+	assert.Equal(t, float64(9007199254740993), typed.Size)
+
+	// The documents built in Go code have float64 or int values
+	built := &JSONDoc{M: map[string]interface{}{"size": float64(42), "count": 3}}
+	size, ok := built.GetInt64Ok("size")
+	assert.True(t, ok)
+	assert.EqualValues(t, 42, size)
+	count, ok := built.GetFloat64Ok("count")
+	assert.True(t, ok)
+	assert.Equal(t, 3.0, count)
+}
@@ -0,0 +1,170 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type strictKey struct{}
+
+var (
+	strictMu       sync.RWMutex
+	strictDoctypes map[string]bool
+)
+
+// WithStrictDecoding returns a context where the documents fetched from
+// CouchDB are decoded strictly: a field of the document that has no
+// counterpart in the Go type is an error (UnknownFieldError), instead of
+// being silently ignored. JSONDoc and the raw JSON are never checked, as they
+// accept any field.
+func WithStrictDecoding(ctx context.Context) context.Context {
+	return context.WithValue(ctx, strictKey{}, true)
+}
+
+// SetStrictDoctypes sets the doctypes for which the documents are always
+// decoded strictly, like with WithStrictDecoding.
+func SetStrictDoctypes(doctypes []string) {
+	strictMu.Lock()
+	defer strictMu.Unlock()
+	strictDoctypes = make(map[string]bool, len(doctypes))
+	for _, doctype := range doctypes {
+		strictDoctypes[doctype] = true
+	}
+}
+
+func isStrict(ctx context.Context, doctype string) bool {
+	if strict, _ := ctx.Value(strictKey{}).(bool); strict {
+		return true
+	}
+	strictMu.RLock()
+	defer strictMu.RUnlock()
+	return strictDoctypes[doctype]
+}
+
+// UnknownFieldError is the error returned when a document decoded strictly
+// has a field that is not known by its Go type. It is not a CouchDB error:
+// the request has succeeded, and a caller that migrates the documents can
+// choose to ignore it.
+type UnknownFieldError struct {
+	Doctype string
+	DocID   string
+	Field   string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("unknown field %q in the document %s of doctype %s",
+		e.Field, e.DocID, e.Doctype)
+}
+
+// IsUnknownFieldError returns whether or not the given error is of type
+// UnknownFieldError, or wraps such an error.
+func IsUnknownFieldError(err error) (*UnknownFieldError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	var fieldErr *UnknownFieldError
+	isFieldErr := errors.As(err, &fieldErr)
+	return fieldErr, isFieldErr
+}
+
+// strictDoc is given to makeRequest instead of a document to decode the
+// response strictly.
+type strictDoc struct {
+	doctype string
+	out     interface{}
+}
+
+// strictOut returns the resbody to use with makeRequest for fetching a
+// document in out. A JSONDoc is given the doctype of its database.
+func strictOut(ctx context.Context, doctype string, out interface{}) interface{} {
+	if doc, ok := out.(*JSONDoc); ok && doctype != "" {
+		return &fetchedJSONDoc{doc: doc, doctype: doctype}
+	}
+	if !isStrict(ctx, doctype) || isLoose(out) {
+		return out
+	}
+	return &strictDoc{doctype: doctype, out: out}
+}
+
+func (s *strictDoc) decodeResponse(r io.Reader) error {
+	var buf bytes.Buffer
+	if err := decodeStrict(io.TeeReader(r, &buf), s.out); err != nil {
+		return unknownFieldError(err, s.doctype, buf.Bytes())
+	}
+	return nil
+}
+
+// decodeDocs unmarshals a JSON array of documents into results, a pointer to
+// a slice, strictly if asked for this doctype. The numbers of the JSONDocs
+// are kept as json.Number.
+func decodeDocs(ctx context.Context, doctype string, data []byte, results interface{}) error {
+	if docs, ok := results.(*[]JSONDoc); ok {
+		return decodeJSONDocs(data, doctype, docs)
+	}
+	if !isStrict(ctx, doctype) || isLoose(results) {
+		return json.Unmarshal(data, results)
+	}
+	slice := reflect.ValueOf(results)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return json.Unmarshal(data, results)
+	}
+	// The documents are decoded one by one to know which one has the unknown
+	// field.
+	var raws []json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return err
+	}
+	elemType := slice.Elem().Type().Elem()
+	docs := reflect.MakeSlice(slice.Elem().Type(), 0, len(raws))
+	for _, raw := range raws {
+		doc := reflect.New(elemType)
+		if err := decodeStrict(bytes.NewReader(raw), doc.Interface()); err != nil {
+			return unknownFieldError(err, doctype, raw)
+		}
+		docs = reflect.Append(docs, doc.Elem())
+	}
+	slice.Elem().Set(docs)
+	return nil
+}
+
+func decodeStrict(r io.Reader, out interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	return dec.Decode(out)
+}
+
+// isLoose returns true for the types that accept any field.
+func isLoose(out interface{}) bool {
+	switch out.(type) {
+	case *JSONDoc, *[]JSONDoc, *[]*JSONDoc, *json.RawMessage, *[]json.RawMessage,
+		*map[string]interface{}, *[]map[string]interface{}:
+		return true
+	}
+	return false
+}
+
+// unknownFieldError transforms the error of json.Decoder for an unknown field
+// into an UnknownFieldError. The other errors are kept as is.
+func unknownFieldError(err error, doctype string, data []byte) error {
+	const prefix = "json: unknown field "
+	msg := err.Error()
+	if !strings.HasPrefix(msg, prefix) {
+		return err
+	}
+	var doc struct {
+		ID string `json:"_id"`
+	}
+	_ = json.Unmarshal(data, &doc)
+	return &UnknownFieldError{
+		Doctype: doctype,
+		DocID:   doc.ID,
+		Field:   strings.Trim(strings.TrimPrefix(msg, prefix), `"`),
+	}
+}
@@ -0,0 +1,57 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrictDecoding(t *testing.T) {
+	const doc = `{"_id":"foo","_rev":"1-abc","test":"bar","fieldC":true}`
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			_, _ = w.Write([]byte(`{"docs":[{"_id":"ok","test":"baz"},` + doc + `]}`))
+		} else {
+			_, _ = w.Write([]byte(doc))
+		}
+	}))
+	defer restore()
+	defer SetStrictDoctypes(nil)
+
+	// The unknown fields are ignored by default
+	out := &testDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", out))
+	assert.Equal(t, "bar", out.Test)
+
+	ctx := WithStrictDecoding(context.Background())
+	err := GetDocContext(ctx, TestPrefix, TestDoctype, "foo", &testDoc{})
+	if fieldErr, ok := IsUnknownFieldError(err); assert.True(t, ok) {
+		assert.Equal(t, &UnknownFieldError{
+			Doctype: TestDoctype,
+			DocID:   "foo",
+			Field:   "fieldC",
+		}, fieldErr)
+	}
+	_, ok := IsCouchError(err)
+	assert.False(t, ok)
+
+	// JSONDoc accepts any field
+	jsonDoc := &JSONDoc{}
+	assert.NoError(t, GetDocContext(ctx, TestPrefix, TestDoctype, "foo", jsonDoc))
+	assert.Equal(t, true, jsonDoc.M["fieldC"])
+
+	SetStrictDoctypes([]string{TestDoctype})
+	var docs []testDoc
+	err = FindDocs(TestPrefix, TestDoctype, &FindRequest{}, &docs)
+	if fieldErr, ok := IsUnknownFieldError(err); assert.True(t, ok) {
+		assert.Equal(t, "foo", fieldErr.DocID)
+		assert.Equal(t, "fieldC", fieldErr.Field)
+	}
+	var jsonDocs []JSONDoc
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, &FindRequest{}, &jsonDocs))
+	assert.Len(t, jsonDocs, 2)
+	assert.NoError(t, FindDocs(TestPrefix, "io.cozy.other", &FindRequest{}, &docs))
+	assert.Len(t, docs, 2)
+}
@@ -0,0 +1,291 @@
+package testutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+// ConformancePrefix is the prefix of the databases used by
+// RunClientConformanceTests. With a real CouchDB, its databases must be
+// deleted before and after the tests, with couchdb.DeleteAllDBs.
+var ConformancePrefix = prefixer.NewPrefixer("conformance.cozy.tools", "conformance")
+
+// The doctypes used by the conformance tests, one by group of tests so that
+// they don't see the documents of the others.
+const (
+	conformanceCRUD     = "io.cozy.tests.conformance.crud"
+	conformanceAllDocs  = "io.cozy.tests.conformance.alldocs"
+	conformanceChanges  = "io.cozy.tests.conformance.changes"
+	conformanceConflict = "io.cozy.tests.conformance.conflicts"
+)
+
+// RunClientConformanceTests checks that a couchdb.Client behaves like
+// CouchDB: the same revisions, the same errors for the same predicates, and
+// the same results for the pagination and the changes feed. It is run with
+// the Mock and with the real client on a CouchDB, so that they can't drift
+// apart: a new feature of the clients should come with its cases here.
+func RunClientConformanceTests(t *testing.T, c couchdb.Client) {
+	t.Run("CRUD", func(t *testing.T) { conformanceCRUDTests(t, c) })
+	t.Run("Conflicts", func(t *testing.T) { conformanceConflictTests(t, c) })
+	t.Run("AllDocs", func(t *testing.T) { conformanceAllDocsTests(t, c) })
+	t.Run("Changes", func(t *testing.T) { conformanceChangesTests(t, c) })
+}
+
+func conformanceDoc(doctype, id string, fields map[string]interface{}) *couchdb.JSONDoc {
+	m := map[string]interface{}{}
+	for k, v := range fields {
+		m[k] = v
+	}
+	if id != "" {
+		m["_id"] = id
+	}
+	return &couchdb.JSONDoc{Type: doctype, M: m}
+}
+
+func conformanceCRUDTests(t *testing.T, c couchdb.Client) {
+	ctx := context.Background()
+	db := ConformancePrefix
+
+	doc := conformanceDoc(conformanceCRUD, "", map[string]interface{}{"name": "foo"})
+	if !assert.NoError(t, c.CreateDoc(ctx, db, doc)) {
+		return
+	}
+	assert.NotEmpty(t, doc.ID())
+	assert.Equal(t, 1, revGeneration(doc.Rev()))
+
+	var fetched couchdb.JSONDoc
+	assert.NoError(t, c.GetDoc(ctx, db, conformanceCRUD, doc.ID(), &fetched))
+	assert.Equal(t, doc.ID(), fetched.ID())
+	assert.Equal(t, doc.Rev(), fetched.Rev())
+	assert.Equal(t, "foo", fetched.M["name"])
+
+	// A document with an ID must be created with CreateNamedDoc
+	named := conformanceDoc(conformanceCRUD, "named", map[string]interface{}{"name": "bar"})
+	err := c.CreateDoc(ctx, db, named)
+	if couchErr, ok := couchdb.IsCouchError(err); assert.True(t, ok) {
+		assert.Equal(t, http.StatusBadRequest, couchErr.StatusCode)
+		assert.Equal(t, "defined_id", couchErr.Name)
+	}
+	assert.NoError(t, c.CreateNamedDoc(ctx, db, named))
+	assert.Equal(t, "named", named.ID())
+	assert.Equal(t, 1, revGeneration(named.Rev()))
+
+	// Each update increments the generation of the revision
+	fetched.Type = conformanceCRUD
+	fetched.M["name"] = "baz"
+	assert.NoError(t, c.UpdateDoc(ctx, db, &fetched))
+	assert.Equal(t, 2, revGeneration(fetched.Rev()))
+	var updated couchdb.JSONDoc
+	assert.NoError(t, c.GetDoc(ctx, db, conformanceCRUD, doc.ID(), &updated))
+	assert.Equal(t, fetched.Rev(), updated.Rev())
+	assert.Equal(t, "baz", updated.M["name"])
+
+	// The deleted documents are not found, with the reason
+	assert.NoError(t, c.DeleteDoc(ctx, db, &fetched))
+	assert.Equal(t, 3, revGeneration(fetched.Rev()))
+	err = c.GetDoc(ctx, db, conformanceCRUD, doc.ID(), &updated)
+	assert.True(t, couchdb.IsNotFoundError(err))
+	assert.False(t, couchdb.IsConflictError(err))
+	if couchErr, ok := couchdb.IsCouchError(err); assert.True(t, ok) {
+		assert.Equal(t, http.StatusNotFound, couchErr.StatusCode)
+		assert.Equal(t, "deleted", couchErr.Reason)
+	}
+	err = c.GetDoc(ctx, db, conformanceCRUD, "missing", &updated)
+	assert.True(t, couchdb.IsNotFoundError(err))
+	assert.False(t, couchdb.IsNoDatabaseError(err))
+	if couchErr, ok := couchdb.IsCouchError(err); assert.True(t, ok) {
+		assert.Equal(t, http.StatusNotFound, couchErr.StatusCode)
+		assert.Equal(t, "missing", couchErr.Reason)
+	}
+
+	// A deleted document can be created again
+	again := conformanceDoc(conformanceCRUD, doc.ID(), map[string]interface{}{"name": "qux"})
+	assert.NoError(t, c.CreateNamedDoc(ctx, db, again))
+	assert.NotEmpty(t, again.Rev())
+}
+
+func conformanceConflictTests(t *testing.T, c couchdb.Client) {
+	ctx := context.Background()
+	db := ConformancePrefix
+
+	doc := conformanceDoc(conformanceConflict, "doc", map[string]interface{}{"n": 1})
+	if !assert.NoError(t, c.CreateNamedDoc(ctx, db, doc)) {
+		return
+	}
+
+	// The same ID cannot be created twice
+	twice := conformanceDoc(conformanceConflict, "doc", map[string]interface{}{"n": 2})
+	err := c.CreateNamedDoc(ctx, db, twice)
+	assert.True(t, couchdb.IsConflictError(err))
+	assert.False(t, couchdb.IsNotFoundError(err))
+	if couchErr, ok := couchdb.IsCouchError(err); assert.True(t, ok) {
+		assert.Equal(t, http.StatusConflict, couchErr.StatusCode)
+		assert.Equal(t, "conflict", couchErr.Name)
+	}
+
+	// The updates and deletions with an old revision are conflicts, and they
+	// don't change the document
+	stale := doc.Clone().(*couchdb.JSONDoc)
+	doc.M["n"] = 3
+	assert.NoError(t, c.UpdateDoc(ctx, db, doc))
+	stale.M["n"] = 4
+	staleRev := stale.Rev()
+	assert.True(t, couchdb.IsConflictError(c.UpdateDoc(ctx, db, stale)))
+	assert.Equal(t, staleRev, stale.Rev())
+	assert.True(t, couchdb.IsConflictError(c.DeleteDoc(ctx, db, stale)))
+
+	var fetched couchdb.JSONDoc
+	assert.NoError(t, c.GetDoc(ctx, db, conformanceConflict, "doc", &fetched))
+	assert.Equal(t, doc.Rev(), fetched.Rev())
+	assert.Equal(t, "3", numberString(fetched.M["n"]))
+}
+
+func conformanceAllDocsTests(t *testing.T, c couchdb.Client) {
+	ctx := context.Background()
+	db := ConformancePrefix
+
+	// The documents are created in a different order than their IDs
+	for _, i := range []int{3, 0, 4, 1, 2, 5} {
+		doc := conformanceDoc(conformanceAllDocs, "doc"+strconv.Itoa(i), map[string]interface{}{"i": i})
+		if !assert.NoError(t, c.CreateNamedDoc(ctx, db, doc)) {
+			return
+		}
+		if i == 5 {
+			assert.NoError(t, c.DeleteDoc(ctx, db, doc))
+		}
+	}
+
+	ids := func(docs []couchdb.JSONDoc) []string {
+		res := make([]string, len(docs))
+		for i, doc := range docs {
+			res[i] = doc.ID()
+		}
+		return res
+	}
+
+	var docs []couchdb.JSONDoc
+	assert.NoError(t, c.GetAllDocs(ctx, db, conformanceAllDocs, &couchdb.AllDocsRequest{}, &docs))
+	assert.Equal(t, []string{"doc0", "doc1", "doc2", "doc3", "doc4"}, ids(docs))
+
+	docs = nil
+	assert.NoError(t, c.GetAllDocs(ctx, db, conformanceAllDocs, &couchdb.AllDocsRequest{Limit: 2}, &docs))
+	assert.Equal(t, []string{"doc0", "doc1"}, ids(docs))
+
+	docs = nil
+	assert.NoError(t, c.GetAllDocs(ctx, db, conformanceAllDocs, &couchdb.AllDocsRequest{Skip: 3, Limit: 10}, &docs))
+	assert.Equal(t, []string{"doc3", "doc4"}, ids(docs))
+
+	// Skipping all the documents gives an empty list, not the previous one
+	assert.NoError(t, c.GetAllDocs(ctx, db, conformanceAllDocs, &couchdb.AllDocsRequest{Skip: 10}, &docs))
+	assert.Len(t, docs, 0)
+
+	// The keys are in the order of the request, without the missing and the
+	// deleted documents
+	docs = nil
+	req := &couchdb.AllDocsRequest{Keys: []string{"doc4", "missing", "doc1", "doc5"}}
+	assert.NoError(t, c.GetAllDocs(ctx, db, conformanceAllDocs, req, &docs))
+	assert.Equal(t, []string{"doc4", "doc1"}, ids(docs))
+	if assert.Len(t, docs, 2) {
+		assert.Equal(t, "4", numberString(docs[0].M["i"]))
+		assert.Equal(t, 1, revGeneration(docs[0].Rev()))
+	}
+}
+
+func conformanceChangesTests(t *testing.T, c couchdb.Client) {
+	ctx := context.Background()
+	db := ConformancePrefix
+
+	var docs []*couchdb.JSONDoc
+	for i := 0; i < 3; i++ {
+		doc := conformanceDoc(conformanceChanges, "doc"+strconv.Itoa(i), map[string]interface{}{"i": i})
+		if !assert.NoError(t, c.CreateNamedDoc(ctx, db, doc)) {
+			return
+		}
+		docs = append(docs, doc)
+	}
+	// Only the last change of a document is in the feed
+	docs[0].M["i"] = 10
+	assert.NoError(t, c.UpdateDoc(ctx, db, docs[0]))
+
+	res, err := c.GetChanges(ctx, db, &couchdb.ChangesRequest{
+		DocType:     conformanceChanges,
+		IncludeDocs: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, res.Results, 3) {
+		assert.Equal(t, "doc1", res.Results[0].DocID)
+		assert.Equal(t, "doc2", res.Results[1].DocID)
+		last := res.Results[2]
+		assert.Equal(t, "doc0", last.DocID)
+		if assert.Len(t, last.Changes, 1) {
+			assert.Equal(t, docs[0].Rev(), last.Changes[0].Rev)
+		}
+		assert.Equal(t, "10", numberString(last.Doc.M["i"]))
+		assert.Equal(t, docs[0].Rev(), last.Doc.Rev())
+	}
+	assert.Equal(t, 0, res.Pending)
+	end := res.LastSeq
+	assert.NotEmpty(t, end)
+
+	// The feed can be read by pages, with the last sequence of a page
+	page, err := c.GetChanges(ctx, db, &couchdb.ChangesRequest{
+		DocType: conformanceChanges,
+		Limit:   2,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, page.Results, 2) {
+		assert.Equal(t, "doc1", page.Results[0].DocID)
+		assert.Nil(t, page.Results[0].Doc.M)
+	}
+	assert.Equal(t, 1, page.Pending)
+	page, err = c.GetChanges(ctx, db, &couchdb.ChangesRequest{
+		DocType: conformanceChanges,
+		Since:   page.LastSeq,
+		Limit:   2,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, page.Results, 1) {
+		assert.Equal(t, "doc0", page.Results[0].DocID)
+	}
+	assert.Equal(t, 0, page.Pending)
+
+	// Nothing after the last sequence, until a new change
+	page, err = c.GetChanges(ctx, db, &couchdb.ChangesRequest{
+		DocType: conformanceChanges,
+		Since:   end,
+	})
+	if assert.NoError(t, err) {
+		assert.Len(t, page.Results, 0)
+		assert.NotEmpty(t, page.LastSeq)
+	}
+	assert.NoError(t, c.DeleteDoc(ctx, db, docs[1]))
+	page, err = c.GetChanges(ctx, db, &couchdb.ChangesRequest{
+		DocType: conformanceChanges,
+		Since:   end,
+	})
+	if assert.NoError(t, err) && assert.Len(t, page.Results, 1) {
+		assert.Equal(t, "doc1", page.Results[0].DocID)
+		if assert.Len(t, page.Results[0].Changes, 1) {
+			assert.Equal(t, docs[1].Rev(), page.Results[0].Changes[0].Rev)
+		}
+	}
+}
+
+// numberString returns a number of a JSONDoc as a string, as it can be a
+// float64 or a json.Number depending on how the document has been decoded.
+func numberString(v interface{}) string {
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,172 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// The fixtures are JSON files, one by doctype, named like the doctype:
+// io.cozy.files.json is an array of documents for io.cozy.files. The
+// documents can have an _id, but no _rev. The files are templates, with
+// these variables and functions:
+//
+//	{{.Domain}}     the domain of the instance, like "alice.cozy.tools"
+//	{{.Prefix}}     the prefix of the databases of the instance
+//	{{now}}         the current time, in RFC 3339
+//	{{now "-24h"}}  the current time plus a duration, like a day ago
+
+type fixtureVars struct {
+	Domain string
+	Prefix string
+}
+
+// LoadFixtures creates the databases for the fixtures of the given directory,
+// and inserts their documents. The test fails on the first invalid document,
+// with the name of its file and its index in the array. The returned function
+// deletes the databases, and is meant to be deferred:
+//
+//	defer testutils.LoadFixtures(t, inst, "testdata/fixtures")()
+func LoadFixtures(t testing.TB, db couchdb.Database, dir string) func() {
+	t.Helper()
+	doctypes, err := loadFixtures(db, dir, time.Now())
+	cleanup := func() {
+		for _, doctype := range doctypes {
+			_ = couchdb.DeleteDB(db, doctype)
+		}
+	}
+	if err != nil {
+		cleanup()
+		t.Fatalf("Cannot load the fixtures: %s", err)
+	}
+	return cleanup
+}
+
+// loadFixtures loads the fixtures of dir, and returns the doctypes of the
+// databases that have been created, even on error.
+func loadFixtures(db couchdb.Database, dir string, now time.Time) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no fixture in %s", dir)
+	}
+	sort.Strings(files)
+	var doctypes []string
+	for _, file := range files {
+		doctype := strings.TrimSuffix(filepath.Base(file), ".json")
+		docs, err := readFixture(db, file, doctype, now)
+		if err != nil {
+			return doctypes, err
+		}
+		if err := couchdb.EnsureDBExist(db, doctype); err != nil {
+			return doctypes, fmt.Errorf("%s: %w", file, err)
+		}
+		doctypes = append(doctypes, doctype)
+		if err := insertFixture(db, file, doctype, docs); err != nil {
+			return doctypes, err
+		}
+	}
+	return doctypes, nil
+}
+
+// readFixture executes the template of a fixture file, and returns its
+// documents.
+func readFixture(db couchdb.Database, file, doctype string, now time.Time) ([]*couchdb.JSONDoc, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(file)).Funcs(template.FuncMap{
+		"now": func(offset ...string) (string, error) {
+			t := now.UTC()
+			if len(offset) > 0 {
+				d, err := time.ParseDuration(offset[0])
+				if err != nil {
+					return "", err
+				}
+				t = t.Add(d)
+			}
+			return t.Format(time.RFC3339Nano), nil
+		},
+	}).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	var buf bytes.Buffer
+	vars := fixtureVars{Domain: db.DomainName(), Prefix: db.DBPrefix()}
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &items); err != nil {
+		return nil, fmt.Errorf("%s: an array of documents is expected: %w", file, err)
+	}
+	docs := make([]*couchdb.JSONDoc, len(items))
+	for i, item := range items {
+		var m map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(item))
+		dec.UseNumber()
+		if err := dec.Decode(&m); err != nil || m == nil {
+			return nil, fmt.Errorf("%s[%d]: the document is not an object", file, i)
+		}
+		doc := &couchdb.JSONDoc{Type: doctype, M: m}
+		if _, ok := m["_rev"]; ok {
+			return nil, fmt.Errorf("%s[%d]: a fixture cannot have a _rev", file, i)
+		}
+		if id, ok := m["_id"]; ok {
+			if s, isString := id.(string); !isString {
+				return nil, fmt.Errorf("%s[%d]: the _id must be a string", file, i)
+			} else if err := couchdb.ValidateDocID(s); err != nil {
+				return nil, fmt.Errorf("%s[%d]: %w", file, i, err)
+			}
+		}
+		docs[i] = doc
+	}
+	return docs, nil
+}
+
+// insertFixture inserts the documents of a fixture file in a bulk.
+func insertFixture(db couchdb.Database, file, doctype string, docs []*couchdb.JSONDoc) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	bulk := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		bulk[i] = doc
+	}
+	err := couchdb.BulkUpdateDocs(db, doctype, bulk, nil)
+	var validationErr *couchdb.BulkValidationError
+	if errors.As(err, &validationErr) {
+		indexes := make([]int, 0, len(validationErr.Errors))
+		for i := range validationErr.Errors {
+			indexes = append(indexes, i)
+		}
+		sort.Ints(indexes)
+		if len(indexes) > 0 {
+			i := indexes[0]
+			return fmt.Errorf("%s[%d]: %w", file, i, validationErr.Errors[i])
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for i, doc := range docs {
+		if doc.Rev() == "" {
+			return fmt.Errorf("%s[%d]: the document %q has not been written", file, i, doc.ID())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package testutils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCouch is a CouchDB that knows only the databases and the bulk writes.
+// The indexes and design docs are accepted, but not kept.
+type fakeCouch struct {
+	mu  sync.Mutex
+	dbs map[string][]map[string]interface{}
+}
+
+func (f *fakeCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path, _ := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/"))
+	name := strings.TrimSuffix(strings.TrimSuffix(path, "/_bulk_docs"), "/")
+	docs, exists := f.dbs[name]
+	switch {
+	case path == "_all_dbs":
+		start, end := r.URL.Query().Get("start_key"), r.URL.Query().Get("end_key")
+		names := []string{}
+		for db := range f.dbs {
+			if `"`+db >= start && `"`+db+`"` <= end {
+				names = append(names, db)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(names)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/_index"):
+		_, _ = w.Write([]byte(`{"result":"created","id":"_design/idx","name":"idx"}`))
+	case r.Method == http.MethodPut && strings.Contains(path, "/_design/"):
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"ok":true,"id":"_design/view","rev":"1-abc"}`))
+	case r.Method == http.MethodGet && !exists, r.Method == http.MethodDelete && !exists:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"not_found","reason":"Database does not exist."}`))
+	case r.Method == http.MethodGet:
+		_, _ = w.Write([]byte(`{"db_name":"` + name + `"}`))
+	case r.Method == http.MethodPut:
+		f.dbs[name] = nil
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	case r.Method == http.MethodDelete:
+		delete(f.dbs, name)
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	default:
+		var body struct {
+			Docs []map[string]interface{} `json:"docs"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		res := make([]map[string]interface{}, len(body.Docs))
+		for i, doc := range body.Docs {
+			if doc["_id"] == "conflict" {
+				res[i] = map[string]interface{}{"id": "conflict", "error": "conflict", "reason": "Document update conflict."}
+				continue
+			}
+			if doc["_id"] == nil {
+				doc["_id"] = "generated-" + strconv.Itoa(len(docs))
+			}
+			docs = append(docs, doc)
+			f.dbs[name] = docs
+			res[i] = map[string]interface{}{"ok": true, "id": doc["_id"], "rev": "1-abc"}
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func useFakeCouch(t *testing.T) (*fakeCouch, func()) {
+	config.UseTestFile()
+	fake := &fakeCouch{dbs: make(map[string][]map[string]interface{})}
+	ts := httptest.NewServer(fake)
+	couch := config.GetConfig().CouchDB
+	u, err := url.Parse(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.GetConfig().CouchDB.URL = u
+	config.GetConfig().CouchDB.Client = ts.Client()
+	return fake, func() {
+		config.GetConfig().CouchDB = couch
+		ts.Close()
+	}
+}
+
+func writeFixtures(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadFixtures(t *testing.T) {
+	fake, restore := useFakeCouch(t)
+	defer restore()
+	db := prefixer.NewPrefixer("alice.cozy.tools", "alice-cozy-tools")
+
+	dir := writeFixtures(t, map[string]string{
+		"io.cozy.contacts.json": `[
+			{"_id": "alice", "email": "alice@{{.Domain}}", "created_at": "{{now}}"},
+			{"fullname": "Bob", "updated_at": "{{now "-24h"}}"}
+		]`,
+		"io.cozy.settings.json": `[{"_id": "io.cozy.settings.instance", "prefix": "{{.Prefix}}"}]`,
+		"README.md":             `not a fixture`,
+	})
+	defer os.RemoveAll(dir)
+
+	cleanup := LoadFixtures(t, db, dir)
+	contacts := fake.dbs["alice-cozy-tools/io-cozy-contacts"]
+	if assert.Len(t, contacts, 2) {
+		assert.Equal(t, "alice", contacts[0]["_id"])
+		assert.Equal(t, "alice@alice.cozy.tools", contacts[0]["email"])
+		created, err := time.Parse(time.RFC3339, contacts[0]["created_at"].(string))
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), created, time.Minute)
+		updated, err := time.Parse(time.RFC3339, contacts[1]["updated_at"].(string))
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(-24*time.Hour), updated, time.Minute)
+		assert.NotEmpty(t, contacts[1]["_id"])
+	}
+	settings := fake.dbs["alice-cozy-tools/io-cozy-settings"]
+	if assert.Len(t, settings, 1) {
+		assert.Equal(t, "alice-cozy-tools", settings[0]["prefix"])
+	}
+
+	cleanup()
+	assert.Len(t, fake.dbs, 0)
+}
+
+func TestLoadFixturesErrors(t *testing.T) {
+	fake, restore := useFakeCouch(t)
+	defer restore()
+	db := prefixer.NewPrefixer("alice.cozy.tools", "alice-cozy-tools")
+	now := time.Now()
+
+	for content, msg := range map[string]string{
+		`{"_id": "foo"}`:                        "io.cozy.tests.json: an array of documents is expected",
+		`[{"_id": "foo"}, 42]`:                  "io.cozy.tests.json[1]: the document is not an object",
+		`[{"_id": "foo", "_rev": "1-abc"}]`:     "io.cozy.tests.json[0]: a fixture cannot have a _rev",
+		`[{}, {}, {"_id": "_foo"}]`:             "io.cozy.tests.json[2]: ",
+		`[{"date": "{{now "tomorrow"}}"}]`:      "io.cozy.tests.json: ",
+		`[{"domain": "{{.Unknown}}"}]`:          "io.cozy.tests.json: ",
+		`[{"_id": "foo"}, {"_id": "conflict"}]`: "io.cozy.tests.json[1]: the document \"conflict\" has not been written",
+		`[]`:                                    "",
+	} {
+		dir := writeFixtures(t, map[string]string{"io.cozy.tests.json": content})
+		doctypes, err := loadFixtures(db, dir, now)
+		if msg == "" {
+			assert.NoError(t, err)
+		} else if assert.Error(t, err, content) {
+			assert.Contains(t, err.Error(), filepath.Join(dir, msg), content)
+		}
+		for _, doctype := range doctypes {
+			assert.NoError(t, couchdb.DeleteDB(db, doctype))
+		}
+		os.RemoveAll(dir)
+	}
+	assert.Len(t, fake.dbs, 0)
+
+	_, err := loadFixtures(db, "/does/not/exist", now)
+	assert.Error(t, err)
+}
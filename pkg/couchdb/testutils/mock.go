@@ -0,0 +1,313 @@
+// Package testutils provides a mock of the couchdb.Client, to unit test the
+// code that uses the couchdb package without a CouchDB.
+package testutils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// ErrNotImplemented is returned by the operations that the mock cannot do by
+// itself, like evaluating a mango selector.
+var ErrNotImplemented = errors.New("not implemented by the couchdb mock")
+
+// Mock is a couchdb.Client that keeps the documents in memory. It can be
+// used with couchdb.SetDefaultClient. The realtime events and the hooks are
+// not triggered.
+type Mock struct {
+	mu      sync.Mutex
+	dbs     map[string]*mockDB
+	seq     int
+	changes []mockChange
+
+	// FindDocsFunc is called by FindDocs, as the mock does not evaluate the
+	// mango selectors.
+	FindDocsFunc func(db couchdb.Database, doctype string, req *couchdb.FindRequest, results interface{}) error
+	// Calls is the list of the operations that have been called, like
+	// "GetDoc io.cozy.files foo".
+	Calls []string
+}
+
+type mockDB struct {
+	docs    map[string]json.RawMessage
+	revs    map[string]string
+	deleted map[string]bool
+}
+
+type mockChange struct {
+	key string
+	seq int
+	id  string
+	rev string
+}
+
+// NewMock returns a new Mock, without any document.
+func NewMock() *Mock {
+	return &Mock{dbs: make(map[string]*mockDB)}
+}
+
+func (m *Mock) db(db couchdb.Database, doctype string) *mockDB {
+	key := db.DBPrefix() + "/" + doctype
+	d, ok := m.dbs[key]
+	if !ok {
+		d = &mockDB{
+			docs:    make(map[string]json.RawMessage),
+			revs:    make(map[string]string),
+			deleted: make(map[string]bool),
+		}
+		m.dbs[key] = d
+	}
+	return d
+}
+
+func (m *Mock) record(op, doctype, id string) {
+	call := op + " " + doctype
+	if id != "" {
+		call += " " + id
+	}
+	m.Calls = append(m.Calls, call)
+}
+
+func (m *Mock) save(db couchdb.Database, doc couchdb.Doc, rev string) error {
+	doc.SetRev(rev)
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	d := m.db(db, doc.DocType())
+	d.docs[doc.ID()] = data
+	d.revs[doc.ID()] = rev
+	delete(d.deleted, doc.ID())
+	m.addChange(db, doc.DocType(), doc.ID(), rev)
+	return nil
+}
+
+// addChange adds a change to the feed. Like CouchDB, only the last change of
+// a document is kept.
+func (m *Mock) addChange(db couchdb.Database, doctype, id, rev string) {
+	key := db.DBPrefix() + "/" + doctype
+	changes := m.changes[:0]
+	for _, c := range m.changes {
+		if c.key != key || c.id != id {
+			changes = append(changes, c)
+		}
+	}
+	m.seq++
+	m.changes = append(changes, mockChange{
+		key: key,
+		seq: m.seq,
+		id:  id,
+		rev: rev,
+	})
+}
+
+// GetDoc is part of the couchdb.Client interface.
+func (m *Mock) GetDoc(ctx context.Context, db couchdb.Database, doctype, id string, out couchdb.Doc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("GetDoc", doctype, id)
+	d := m.db(db, doctype)
+	data, ok := d.docs[id]
+	if !ok {
+		if d.deleted[id] {
+			return notFoundError("deleted")
+		}
+		return notFoundError("missing")
+	}
+	return json.Unmarshal(data, out)
+}
+
+// CreateDoc is part of the couchdb.Client interface.
+func (m *Mock) CreateDoc(ctx context.Context, db couchdb.Database, doc couchdb.Doc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("CreateDoc", doc.DocType(), "")
+	if doc.ID() != "" {
+		return &couchdb.Error{
+			StatusCode: http.StatusBadRequest,
+			Name:       "defined_id",
+			Reason:     "document _id should be empty",
+		}
+	}
+	doc.SetID(newID())
+	return m.save(db, doc, newRev(1))
+}
+
+// CreateNamedDoc is part of the couchdb.Client interface.
+func (m *Mock) CreateNamedDoc(ctx context.Context, db couchdb.Database, doc couchdb.Doc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("CreateNamedDoc", doc.DocType(), doc.ID())
+	if _, ok := m.db(db, doc.DocType()).docs[doc.ID()]; ok {
+		return conflictError()
+	}
+	return m.save(db, doc, newRev(1))
+}
+
+// UpdateDoc is part of the couchdb.Client interface.
+func (m *Mock) UpdateDoc(ctx context.Context, db couchdb.Database, doc couchdb.Doc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("UpdateDoc", doc.DocType(), doc.ID())
+	current, ok := m.db(db, doc.DocType()).revs[doc.ID()]
+	if !ok {
+		return notFoundError("missing")
+	}
+	if current != doc.Rev() {
+		return conflictError()
+	}
+	return m.save(db, doc, newRev(revGeneration(current)+1))
+}
+
+// DeleteDoc is part of the couchdb.Client interface.
+func (m *Mock) DeleteDoc(ctx context.Context, db couchdb.Database, doc couchdb.Doc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("DeleteDoc", doc.DocType(), doc.ID())
+	d := m.db(db, doc.DocType())
+	current, ok := d.revs[doc.ID()]
+	if !ok {
+		return notFoundError("missing")
+	}
+	if current != doc.Rev() {
+		return conflictError()
+	}
+	rev := newRev(revGeneration(current) + 1)
+	delete(d.docs, doc.ID())
+	delete(d.revs, doc.ID())
+	d.deleted[doc.ID()] = true
+	doc.SetRev(rev)
+	m.addChange(db, doc.DocType(), doc.ID(), rev)
+	return nil
+}
+
+// GetAllDocs is part of the couchdb.Client interface. The documents are
+// returned in the order of their IDs.
+func (m *Mock) GetAllDocs(ctx context.Context, db couchdb.Database, doctype string, req *couchdb.AllDocsRequest, results interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("GetAllDocs", doctype, "")
+	d := m.db(db, doctype)
+	var ids []string
+	if req != nil && len(req.Keys) > 0 {
+		ids = req.Keys
+	} else {
+		for id := range d.docs {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+	}
+	docs := make([]json.RawMessage, 0, len(ids))
+	for _, id := range ids {
+		if data, ok := d.docs[id]; ok {
+			docs = append(docs, data)
+		}
+	}
+	if req != nil {
+		if skip := req.Skip; skip > 0 {
+			if skip > len(docs) {
+				skip = len(docs)
+			}
+			docs = docs[skip:]
+		}
+		if req.Limit > 0 && req.Limit < len(docs) {
+			docs = docs[:req.Limit]
+		}
+	}
+	data, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, results)
+}
+
+// FindDocs is part of the couchdb.Client interface. It calls FindDocsFunc,
+// or returns ErrNotImplemented.
+func (m *Mock) FindDocs(ctx context.Context, db couchdb.Database, doctype string, req *couchdb.FindRequest, results interface{}) error {
+	m.mu.Lock()
+	m.record("FindDocs", doctype, "")
+	fn := m.FindDocsFunc
+	m.mu.Unlock()
+	if fn == nil {
+		return ErrNotImplemented
+	}
+	return fn(db, doctype, req, results)
+}
+
+// GetChanges is part of the couchdb.Client interface. The sequences are
+// numbers, and the documents are included if asked.
+func (m *Mock) GetChanges(ctx context.Context, db couchdb.Database, req *couchdb.ChangesRequest) (*couchdb.ChangesResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("GetChanges", req.DocType, "")
+	since, _ := strconv.Atoi(strings.SplitN(req.Since, "-", 2)[0])
+	key := db.DBPrefix() + "/" + req.DocType
+	res := &couchdb.ChangesResponse{
+		LastSeq: strconv.Itoa(since),
+		Results: make([]couchdb.Change, 0),
+	}
+	for _, c := range m.changes {
+		if c.key != key || c.seq <= since {
+			continue
+		}
+		if req.Limit > 0 && len(res.Results) >= req.Limit {
+			res.Pending++
+			continue
+		}
+		change := couchdb.Change{DocID: c.id, Seq: strconv.Itoa(c.seq)}
+		change.Changes = append(change.Changes, struct {
+			Rev string `json:"rev"`
+		}{Rev: c.rev})
+		if data, ok := m.db(db, req.DocType).docs[c.id]; req.IncludeDocs && ok {
+			if err := json.Unmarshal(data, &change.Doc); err != nil {
+				return nil, err
+			}
+		}
+		res.Results = append(res.Results, change)
+		res.LastSeq = change.Seq
+	}
+	return res, nil
+}
+
+func notFoundError(reason string) error {
+	return &couchdb.Error{
+		StatusCode: http.StatusNotFound,
+		Name:       "not_found",
+		Reason:     reason,
+	}
+}
+
+func conflictError() error {
+	return &couchdb.Error{
+		StatusCode: http.StatusConflict,
+		Name:       "conflict",
+		Reason:     "Document update conflict.",
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newRev(generation int) string {
+	return strconv.Itoa(generation) + "-" + newID()
+}
+
+func revGeneration(rev string) int {
+	n, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return n
+}
+
+var _ couchdb.Client = (*Mock)(nil)
@@ -0,0 +1,76 @@
+package testutils
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMock(t *testing.T) {
+	mock := NewMock()
+	couchdb.SetDefaultClient(mock)
+	defer couchdb.SetDefaultClient(nil)
+
+	db := prefixer.NewPrefixer("alice.cozy.tools", "alice")
+	doc := &couchdb.JSONDoc{Type: "io.cozy.tests", M: map[string]interface{}{"foo": "bar"}}
+	assert.NoError(t, couchdb.CreateDoc(db, doc))
+	assert.NotEmpty(t, doc.ID())
+	assert.Equal(t, 1, revGeneration(doc.Rev()))
+
+	var fetched couchdb.JSONDoc
+	assert.NoError(t, couchdb.GetDoc(db, "io.cozy.tests", doc.ID(), &fetched))
+	assert.Equal(t, "bar", fetched.M["foo"])
+	assert.Equal(t, doc.Rev(), fetched.Rev())
+	fetched.Type = "io.cozy.tests"
+
+	// The revisions are checked
+	stale := fetched.Clone()
+	fetched.M["foo"] = "baz"
+	assert.NoError(t, couchdb.UpdateDoc(db, &fetched))
+	assert.True(t, couchdb.IsConflictError(couchdb.UpdateDoc(db, stale)))
+
+	var all []couchdb.JSONDoc
+	assert.NoError(t, couchdb.GetAllDocs(db, "io.cozy.tests", &couchdb.AllDocsRequest{}, &all))
+	if assert.Len(t, all, 1) {
+		assert.Equal(t, "baz", all[0].M["foo"])
+	}
+
+	assert.NoError(t, couchdb.DeleteDoc(db, &fetched))
+	err := couchdb.GetDoc(db, "io.cozy.tests", doc.ID(), &fetched)
+	assert.True(t, couchdb.IsNotFoundError(err))
+
+	changes, err := mock.GetChanges(context.Background(), db, &couchdb.ChangesRequest{DocType: "io.cozy.tests"})
+	assert.NoError(t, err)
+	assert.Len(t, changes.Results, 1)
+	assert.Equal(t, "3", changes.LastSeq)
+
+	err = couchdb.FindDocs(db, "io.cozy.tests", &couchdb.FindRequest{}, &all)
+	assert.Equal(t, ErrNotImplemented, err)
+	assert.Contains(t, mock.Calls, "GetDoc io.cozy.tests "+doc.ID())
+}
+
+func TestMockConformance(t *testing.T) {
+	RunClientConformanceTests(t, NewMock())
+}
+
+// TestCouchClientConformance runs the conformance tests on a real CouchDB,
+// when COZY_COUCHDB_CONFORMANCE is set, like:
+//
+//	COZY_COUCHDB_CONFORMANCE=1 go test ./pkg/couchdb/testutils/
+func TestCouchClientConformance(t *testing.T) {
+	if os.Getenv("COZY_COUCHDB_CONFORMANCE") == "" {
+		t.Skip("COZY_COUCHDB_CONFORMANCE is not set")
+	}
+	config.UseTestFile()
+	if _, err := couchdb.CheckStatus(); err != nil {
+		t.Fatalf("This test need couchdb to run: %s", err)
+	}
+	_ = couchdb.DeleteAllDBs(ConformancePrefix)
+	defer func() { _ = couchdb.DeleteAllDBs(ConformancePrefix) }()
+	RunClientConformanceTests(t, couchdb.NewClient())
+}
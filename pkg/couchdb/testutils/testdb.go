@@ -0,0 +1,116 @@
+package testutils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// maxTestPrefixName is the maximal length of the part of a test prefix that
+// comes from the name of the test.
+const maxTestPrefixName = 64
+
+// pollInterval is the delay between two tries of the Wait functions.
+const pollInterval = 10 * time.Millisecond
+
+// TestDB returns a prefix for the databases of a test, that is unique even
+// for the parallel tests, and creates the databases of the given doctypes.
+// The returned function deletes all the databases of the prefix, and is
+// meant to be deferred, so that they are deleted even on a panic:
+//
+//	db, cleanup := testutils.TestDB(t, consts.Files)
+//	defer cleanup()
+func TestDB(t testing.TB, doctypes ...string) (prefixer.Prefixer, func()) {
+	t.Helper()
+	prefix := UniquePrefix(t.Name())
+	db := prefixer.NewPrefixer(prefix+".cozy.tools", prefix)
+	cleanup := func() {
+		_ = couchdb.DeleteAllDBs(db)
+	}
+	for _, doctype := range doctypes {
+		if err := couchdb.CreateDB(db, doctype); err != nil {
+			cleanup()
+			t.Fatalf("Cannot create the database for %s: %s", doctype, err)
+		}
+	}
+	return db, cleanup
+}
+
+// UniquePrefix returns a database prefix for the given test name, with a
+// random suffix. The name is sanitized for CouchDB: only the lowercase
+// letters, the digits, - and _ are kept, and it starts with a letter.
+func UniquePrefix(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('-')
+		}
+		if sb.Len() >= maxTestPrefixName {
+			break
+		}
+	}
+	sanitized := sb.String()
+	if sanitized == "" || sanitized[0] < 'a' || sanitized[0] > 'z' {
+		sanitized = "test-" + sanitized
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return strings.TrimSuffix(sanitized, "-") + "-" + hex.EncodeToString(suffix)
+}
+
+// WaitForDoc polls CouchDB until the document exists, and returns it. The
+// test fails if it is not found before the timeout.
+func WaitForDoc(t testing.TB, db couchdb.Database, doctype, id string, timeout time.Duration) *couchdb.JSONDoc {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		doc := &couchdb.JSONDoc{}
+		err := couchdb.GetDoc(db, doctype, id, doc)
+		if err == nil {
+			doc.Type = doctype
+			return doc
+		}
+		if !couchdb.IsNotFoundError(err) || time.Now().After(deadline) {
+			t.Fatalf("The document %s/%s has not been found: %s", doctype, id, err)
+			return nil
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// WaitForIndex polls CouchDB until a query can use the index. The test fails
+// if the index is still not usable after the timeout.
+func WaitForIndex(t testing.TB, db couchdb.Database, index *mango.Index, timeout time.Duration) {
+	t.Helper()
+	if index.Request == nil || len(index.Request.Index) == 0 {
+		t.Fatalf("The index has no field")
+		return
+	}
+	req := &couchdb.FindRequest{
+		Selector: mango.Exists(index.Request.Index[0]),
+		UseIndex: index.Request.DDoc,
+		Limit:    1,
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		var docs []couchdb.JSONDoc
+		err := couchdb.FindDocs(db, index.Doctype, req, &docs)
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The index %s of %s is not usable: %s", index.Request.DDoc, index.Doctype, err)
+			return
+		}
+		time.Sleep(pollInterval)
+	}
+}
@@ -0,0 +1,143 @@
+package testutils
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTB is a testing.TB that records the failures instead of stopping
+// the test.
+type recordingTB struct {
+	testing.TB
+	failure string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Fatalf(format string, args ...interface{}) {
+	r.failure = fmt.Sprintf(format, args...)
+}
+
+func TestUniquePrefix(t *testing.T) {
+	valid := regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+	seen := make(map[string]bool)
+	for _, name := range []string{
+		"TestFoo",
+		"TestFoo/sub_test#01",
+		"Example.With:Dots And Spaces",
+		"42",
+		"",
+		strings.Repeat("TestVeryLongName", 20),
+	} {
+		prefix := UniquePrefix(name)
+		assert.Regexp(t, valid, prefix, name)
+		assert.True(t, len(prefix) <= maxTestPrefixName+len("test-")+9, prefix)
+		assert.Equal(t, prefix, couchdb.EscapeCouchdbName(prefix))
+		assert.False(t, seen[prefix])
+		seen[prefix] = true
+	}
+	assert.True(t, strings.HasPrefix(UniquePrefix("TestFoo/sub_test#01"), "testfoo-sub_test-01-"))
+	assert.NotEqual(t, UniquePrefix("TestFoo"), UniquePrefix("TestFoo"))
+}
+
+func TestTestDB(t *testing.T) {
+	fake, restore := useFakeCouch(t)
+	defer restore()
+
+	var mu sync.Mutex
+	prefixes := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, cleanup := TestDB(t, "io.cozy.files", "io.cozy.contacts")
+			mu.Lock()
+			prefixes[db.DBPrefix()] = true
+			mu.Unlock()
+			fake.mu.Lock()
+			_, files := fake.dbs[db.DBPrefix()+"/io-cozy-files"]
+			_, contacts := fake.dbs[db.DBPrefix()+"/io-cozy-contacts"]
+			fake.mu.Unlock()
+			assert.True(t, files)
+			assert.True(t, contacts)
+			cleanup()
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, prefixes, 5)
+	assert.Len(t, fake.dbs, 0)
+
+	// The databases are deleted even if the test panics
+	var prefix string
+	func() {
+		defer func() { _ = recover() }()
+		db, cleanup := TestDB(t, "io.cozy.files")
+		defer cleanup()
+		prefix = db.DBPrefix()
+		panic("boom")
+	}()
+	assert.NotEmpty(t, prefix)
+	assert.Len(t, fake.dbs, 0)
+}
+
+func TestWaitForDoc(t *testing.T) {
+	mock := NewMock()
+	couchdb.SetDefaultClient(mock)
+	defer couchdb.SetDefaultClient(nil)
+	db := ConformancePrefix
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		doc := &couchdb.JSONDoc{Type: "io.cozy.tests", M: map[string]interface{}{"_id": "late", "foo": "bar"}}
+		_ = mock.CreateNamedDoc(context.Background(), db, doc)
+	}()
+	doc := WaitForDoc(t, db, "io.cozy.tests", "late", 5*time.Second)
+	if assert.NotNil(t, doc) {
+		assert.Equal(t, "bar", doc.M["foo"])
+		assert.Equal(t, "io.cozy.tests", doc.DocType())
+	}
+
+	rec := &recordingTB{TB: t}
+	start := time.Now()
+	assert.Nil(t, WaitForDoc(rec, db, "io.cozy.tests", "never", 50*time.Millisecond))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Contains(t, rec.failure, "io.cozy.tests/never")
+}
+
+func TestWaitForIndex(t *testing.T) {
+	mock := NewMock()
+	couchdb.SetDefaultClient(mock)
+	defer couchdb.SetDefaultClient(nil)
+	db := ConformancePrefix
+
+	var mu sync.Mutex
+	tries := 0
+	mock.FindDocsFunc = func(db couchdb.Database, doctype string, req *couchdb.FindRequest, results interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "by-name", req.UseIndex)
+		tries++
+		if tries < 3 {
+			return &couchdb.Error{StatusCode: 400, Name: "no_usable_index"}
+		}
+		return nil
+	}
+	index := mango.IndexOnFields("io.cozy.tests", "by-name", []string{"name"})
+	WaitForIndex(t, db, index, 5*time.Second)
+	assert.Equal(t, 3, tries)
+
+	mock.FindDocsFunc = nil
+	rec := &recordingTB{TB: t}
+	WaitForIndex(rec, db, index, 30*time.Millisecond)
+	assert.Contains(t, rec.failure, "by-name")
+}
@@ -0,0 +1,135 @@
+package couchdb
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+type timeoutKey struct{}
+
+// DefaultTimeout is the maximal duration of a request to CouchDB when the
+// configuration has no timeout.
+const DefaultTimeout = 30 * time.Second
+
+// timeouts are the limits applied to a request made to CouchDB. The total
+// duration is used for the normal requests, and the idle duration for the
+// streaming ones, where only the time without receiving data is limited.
+type timeouts struct {
+	total time.Duration
+	idle  time.Duration
+}
+
+// WithTimeout returns a context where the requests made to CouchDB are
+// limited to the given duration, instead of the timeout from the
+// configuration. It can be used for the operations that are known to be slow.
+// A zero duration disables the timeout.
+func WithTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, timeoutKey{}, timeouts{total: d})
+}
+
+// WithIdleTimeout returns a context where the requests made to CouchDB are
+// not limited in their total duration, but are aborted when no data has been
+// received from CouchDB for the given duration. It is meant for the streaming
+// endpoints, like the continuous changes feeds, that must not be killed while
+// CouchDB sends data or heartbeats.
+func WithIdleTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, timeoutKey{}, timeouts{idle: d})
+}
+
+// isStreaming returns true if the requests made with this context are
+// streaming requests, ie they have an idle timeout.
+func isStreaming(ctx context.Context) bool {
+	return timeoutsFor(ctx).idle > 0
+}
+
+func hasTimeout(ctx context.Context) bool {
+	_, ok := ctx.Value(timeoutKey{}).(timeouts)
+	return ok
+}
+
+func timeoutsFor(ctx context.Context) timeouts {
+	if t, ok := ctx.Value(timeoutKey{}).(timeouts); ok {
+		return t
+	}
+	if d := config.GetConfig().CouchDB.Timeout; d > 0 {
+		return timeouts{total: d}
+	}
+	return timeouts{total: DefaultTimeout}
+}
+
+// withRequestTimeout returns a context for sending a request to CouchDB with
+// the timeouts that apply to it, and a watchdog that must be attached to the
+// response body to enforce the idle timeout.
+func withRequestTimeout(ctx context.Context) (context.Context, *watchdog) {
+	t := timeoutsFor(ctx)
+	if t.total > 0 {
+		ctx, cancel := context.WithTimeout(ctx, t.total)
+		return ctx, &watchdog{cancel: cancel}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &watchdog{cancel: cancel}
+	if t.idle > 0 {
+		w.idle = t.idle
+		w.timer = time.AfterFunc(t.idle, cancel)
+	}
+	return ctx, w
+}
+
+// watchdog cancels the context of a request when its deadline is exceeded.
+// With an idle timeout, the deadline is pushed back each time some data is
+// read from the response.
+type watchdog struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	idle   time.Duration
+	cancel context.CancelFunc
+}
+
+func (w *watchdog) touch() {
+	if w.idle == 0 {
+		return
+	}
+	w.mu.Lock()
+	if w.timer.Stop() {
+		w.timer.Reset(w.idle)
+	}
+	w.mu.Unlock()
+}
+
+// stop releases the resources of the watchdog, and must be called when the
+// request is finished.
+func (w *watchdog) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.cancel()
+}
+
+// body wraps a response body to push back the idle deadline on reads, and to
+// stop the watchdog when the body is closed.
+func (w *watchdog) body(rc io.ReadCloser) io.ReadCloser {
+	return &watchedBody{ReadCloser: rc, w: w}
+}
+
+type watchedBody struct {
+	io.ReadCloser
+	w *watchdog
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.w.touch()
+	}
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.w.stop()
+	return err
+}
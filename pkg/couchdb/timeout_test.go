@@ -0,0 +1,80 @@
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-unblock:
+		case <-time.After(200 * time.Millisecond):
+		}
+		_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc"}`))
+	}))
+	defer restore()
+	defer close(unblock)
+	config.GetConfig().CouchDB.Timeout = 50 * time.Millisecond
+
+	var doc JSONDoc
+	err := GetDoc(TestPrefix, TestDoctype, "foo", &doc)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	ctx := WithTimeout(context.Background(), time.Second)
+	err = GetDocContext(ctx, TestPrefix, TestDoctype, "foo", &doc)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", doc.ID())
+}
+
+func TestIdleTimeout(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		_, _ = w.Write([]byte(`{"results":[`))
+		flusher.Flush()
+		// A heartbeat every 20ms, for more than the idle timeout in total
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			_, _ = w.Write([]byte("\n"))
+			flusher.Flush()
+		}
+		if r.URL.Query().Get("since") == "hang" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(`],"last_seq":"42-abc"}`))
+	}))
+	defer restore()
+
+	ctx := WithIdleTimeout(context.Background(), 50*time.Millisecond)
+	res, err := GetChangesContext(ctx, TestPrefix, &ChangesRequest{DocType: TestDoctype})
+	assert.NoError(t, err)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "42-abc", res.LastSeq)
+	}
+
+	_, err = GetChangesContext(ctx, TestPrefix, &ChangesRequest{DocType: TestDoctype, Since: "hang"})
+	assert.Error(t, err)
+}
+
+func TestLongpollTimeout(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"results":[],"last_seq":"42-abc"}`))
+	}))
+	defer restore()
+	config.GetConfig().CouchDB.Timeout = 50 * time.Millisecond
+
+	req := &ChangesRequest{DocType: TestDoctype, Feed: ChangesModeLongpoll, Timeout: 100}
+	res, err := GetChanges(TestPrefix, req)
+	assert.NoError(t, err)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "42-abc", res.LastSeq)
+	}
+}
@@ -0,0 +1,89 @@
+package couchdb
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Timestamper is the optional interface of the documents that want their
+// creation and modification dates to be set when they are written: the
+// creation functions call SetCreatedAt and SetUpdatedAt, and the update
+// functions only SetUpdatedAt. The given time is in UTC, with a millisecond
+// precision.
+type Timestamper interface {
+	SetCreatedAt(t time.Time)
+	SetUpdatedAt(t time.Time)
+}
+
+// timestampLayout is RFC3339 with a millisecond precision, used for the
+// created_at and updated_at fields of JSONDoc.
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+var (
+	clockMu sync.RWMutex
+	clock   = time.Now
+)
+
+// SetClock changes the function used to get the current time for the
+// timestamps of the documents. It is meant for the tests, and nil restores
+// time.Now.
+func SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	clockMu.Lock()
+	clock = now
+	clockMu.Unlock()
+}
+
+func timestampNow() time.Time {
+	clockMu.RLock()
+	now := clock
+	clockMu.RUnlock()
+	return now().UTC().Truncate(time.Millisecond)
+}
+
+var timestamped = make(map[string]bool)
+
+// RegisterTimestamps enables the created_at and updated_at fields for the
+// JSONDoc of a doctype: they are filled when a document is created, and
+// updated_at is changed on each update. An existing created_at is never
+// overwritten. The other Go types should implement Timestamper instead.
+func RegisterTimestamps(doctype string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	timestamped[doctype] = true
+}
+
+// stampDoc sets the timestamps and the cozyMetadata of a document before
+// writing it. The creation date is only set when created is true.
+func stampDoc(ctx context.Context, doc Doc, created bool) {
+	if doc == nil {
+		return
+	}
+	stampMetadata(ctx, doc, created)
+	switch d := doc.(type) {
+	case Timestamper:
+		now := timestampNow()
+		if created {
+			d.SetCreatedAt(now)
+		}
+		d.SetUpdatedAt(now)
+	case *JSONDoc:
+		registryMu.RLock()
+		enabled := timestamped[d.Type]
+		registryMu.RUnlock()
+		if !enabled {
+			return
+		}
+		now := timestampNow().Format(timestampLayout)
+		if d.M == nil {
+			d.M = make(map[string]interface{})
+		}
+		if _, ok := d.M["created_at"]; created && !ok {
+			d.M["created_at"] = now
+		}
+		d.M["updated_at"] = now
+	}
+}
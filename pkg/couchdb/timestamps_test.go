@@ -0,0 +1,78 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type timestampedDoc struct {
+	testDoc
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (d *timestampedDoc) SetCreatedAt(t time.Time) { d.CreatedAt = t }
+func (d *timestampedDoc) SetUpdatedAt(t time.Time) { d.UpdatedAt = t }
+
+func TestTimestamps(t *testing.T) {
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_bulk_docs") {
+			_, _ = w.Write([]byte(`[{"ok":true,"id":"a","rev":"1-a"},{"ok":true,"id":"foo","rev":"3-b"}]`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"id":"foo","rev":"2-b","_id":"foo","_rev":"1-a"}`))
+	}))
+	defer restore()
+	ctx := context.Background()
+
+	local := time.FixedZone("CET", 3600)
+	now := time.Date(2021, 3, 4, 5, 6, 7, 891234567, local)
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+
+	typed := &timestampedDoc{testDoc: testDoc{Test: "foo"}}
+	assert.NoError(t, CreateDocContext(ctx, TestPrefix, typed))
+	expected := time.Date(2021, 3, 4, 4, 6, 7, 891000000, time.UTC)
+	assert.Equal(t, expected, typed.CreatedAt)
+	assert.Equal(t, expected, typed.UpdatedAt)
+	now = now.Add(time.Hour)
+	assert.NoError(t, UpdateDocContext(ctx, TestPrefix, typed))
+	assert.Equal(t, expected, typed.CreatedAt)
+	assert.Equal(t, expected.Add(time.Hour), typed.UpdatedAt)
+
+	// The JSONDoc have the timestamps only for the registered doctypes
+	const doctype = "io.cozy.tests.timestamped"
+	RegisterTimestamps(doctype)
+	defer func() {
+		registryMu.Lock()
+		delete(timestamped, doctype)
+		registryMu.Unlock()
+	}()
+	other := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{}}
+	assert.NoError(t, CreateDocContext(ctx, TestPrefix, other))
+	assert.Nil(t, other.Get("created_at"))
+
+	doc := &JSONDoc{Type: doctype, M: map[string]interface{}{}}
+	assert.NoError(t, CreateDocContext(ctx, TestPrefix, doc))
+	assert.Equal(t, "2021-03-04T05:06:07.891Z", doc.Get("created_at"))
+	assert.Equal(t, "2021-03-04T05:06:07.891Z", doc.Get("updated_at"))
+	now = now.Add(time.Hour)
+	assert.NoError(t, UpdateDocContext(ctx, TestPrefix, doc))
+	assert.Equal(t, "2021-03-04T05:06:07.891Z", doc.Get("created_at"))
+	assert.Equal(t, "2021-03-04T06:06:07.891Z", doc.Get("updated_at"))
+
+	// The existing created_at are kept
+	imported := &JSONDoc{Type: doctype, M: map[string]interface{}{"created_at": "2020-01-01T00:00:00.000Z"}}
+	now = now.Add(time.Hour)
+	err := BulkUpdateDocsContext(ctx, TestPrefix, doctype, []interface{}{imported, doc}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "2020-01-01T00:00:00.000Z", imported.Get("created_at"))
+	assert.Equal(t, "2021-03-04T07:06:07.891Z", imported.Get("updated_at"))
+	assert.Equal(t, "2021-03-04T05:06:07.891Z", doc.Get("created_at"))
+	assert.Equal(t, "2021-03-04T07:06:07.891Z", doc.Get("updated_at"))
+}
@@ -0,0 +1,122 @@
+package couchdb
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ulidAlphabet is the base32 alphabet of Crockford, used by the ULID. It is in
+// the ASCII order and with a single case, so the identifiers are sorted the
+// same way by the raw and the unicode collations of CouchDB.
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidLength is the number of characters of a ULID: 26 characters of 5 bits
+// for 128 bits, a timestamp in milliseconds on 48 bits, and 80 bits of
+// entropy.
+const ulidLength = 26
+
+// ErrInvalidULID is the error returned by ULIDTime for an identifier that is
+// not a ULID.
+var ErrInvalidULID = errors.New("CouchDB: invalid ULID")
+
+// errULIDOverflow is returned when more than 2^80 identifiers have been
+// generated in the same millisecond.
+var errULIDOverflow = errors.New("CouchDB: ULID entropy overflow")
+
+type ulidGenerator struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+// NewULIDGenerator returns a generator of ULID, for the doctypes where the
+// order of _all_docs should be the order of creation. The identifiers are
+// monotonic: in the same millisecond, the entropy of the previous one is
+// incremented instead of being random.
+func NewULIDGenerator() IDGenerator {
+	return &ulidGenerator{}
+}
+
+func (g *ulidGenerator) GenerateID(doc Doc) (string, error) {
+	ms := uint64(timestampNow().UnixNano() / int64(time.Millisecond))
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ms <= g.lastMs {
+		// The clock can go backward, but the identifiers must not
+		ms = g.lastMs
+		if !incrementEntropy(&g.entropy) {
+			return "", errULIDOverflow
+		}
+	} else {
+		if _, err := rand.Read(g.entropy[:]); err != nil {
+			return "", err
+		}
+		g.lastMs = ms
+	}
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> uint(8*(5-i)))
+	}
+	copy(id[6:], g.entropy[:])
+	return encodeULID(id), nil
+}
+
+func incrementEntropy(entropy *[10]byte) bool {
+	for i := len(entropy) - 1; i >= 0; i-- {
+		entropy[i]++
+		if entropy[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeULID(id [16]byte) string {
+	var hi, lo uint64
+	for i := 0; i < 8; i++ {
+		hi = hi<<8 | uint64(id[i])
+		lo = lo<<8 | uint64(id[i+8])
+	}
+	out := make([]byte, ulidLength)
+	for i := range out {
+		// The first character has only 3 bits, as 26*5 = 130
+		shift := uint(5 * (ulidLength - 1 - i))
+		var bits uint64
+		if shift >= 64 {
+			bits = hi >> (shift - 64)
+		} else {
+			bits = lo>>shift | hi<<(64-shift)
+		}
+		out[i] = ulidAlphabet[bits&31]
+	}
+	return string(out)
+}
+
+// ULIDTime returns the time embedded in an identifier generated by
+// NewULIDGenerator, for debugging. The identifier can be prefixed by the
+// doctype and a slash.
+func ULIDTime(id string) (time.Time, error) {
+	if i := strings.LastIndexByte(id, '/'); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) != ulidLength || id[0] > '7' {
+		return time.Time{}, ErrInvalidULID
+	}
+	var ms int64
+	for i := 0; i < ulidLength; i++ {
+		v := strings.IndexByte(ulidAlphabet, id[i])
+		if v < 0 {
+			return time.Time{}, ErrInvalidULID
+		}
+		// The first 10 characters are the timestamp
+		if i < 10 {
+			ms = ms<<5 | int64(v)
+		}
+	}
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC(), nil
+}
@@ -0,0 +1,84 @@
+package couchdb
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestULIDGenerator(t *testing.T) {
+	// The timestamp of the example of the ULID specification
+	at := time.Unix(1469918176, 385000000)
+	now := at
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+
+	gen := NewULIDGenerator()
+	var ids []string
+	for i := 0; i < 1000; i++ {
+		id, err := gen.GenerateID(nil)
+		assert.NoError(t, err)
+		assert.True(t, isValidGeneratedID(TestDoctype, id))
+		ids = append(ids, id)
+	}
+	assert.Len(t, ids[0], 26)
+	assert.Equal(t, "01ARYZ6S41", ids[0][:10])
+	assert.True(t, sort.StringsAreSorted(ids))
+	assert.Equal(t, ids[0][:10], ids[999][:10])
+
+	// The IDs keep increasing when the clock goes backward
+	now = at.Add(-time.Second)
+	id, err := gen.GenerateID(nil)
+	assert.NoError(t, err)
+	assert.True(t, id > ids[999])
+	now = at.Add(time.Millisecond)
+	next, err := gen.GenerateID(nil)
+	assert.NoError(t, err)
+	assert.True(t, next > id)
+	ids = append(ids, id, next)
+
+	ts, err := ULIDTime(ids[0])
+	assert.NoError(t, err)
+	assert.True(t, at.Equal(ts))
+	ts, err = ULIDTime(TestDoctype + "/" + next)
+	assert.NoError(t, err)
+	assert.True(t, at.Add(time.Millisecond).Equal(ts))
+	ts, err = ULIDTime("01ARYZ6S41TSV4RRFFQ69G5FAV")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1469918176385, ts.UnixNano()/int64(time.Millisecond))
+	for _, invalid := range []string{"", "01ARYZ6S41", "81ARYZ6S41TSV4RRFFQ69G5FAV", "01ARYZ6S41TSV4RRFFQ69G5FAU"} {
+		_, err = ULIDTime(invalid)
+		assert.True(t, errors.Is(err, ErrInvalidULID), invalid)
+	}
+
+	// The entropy is guarded for the concurrent calls
+	seen := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id, err := gen.GenerateID(nil)
+				assert.NoError(t, err)
+				mu.Lock()
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, seen, 1000)
+
+	full := &ulidGenerator{lastMs: 1 << 47}
+	for i := range full.entropy {
+		full.entropy[i] = 0xff
+	}
+	_, err = full.GenerateID(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,107 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// The policies for the writes that CouchDB has only accepted (202), ie
+// without meeting the write quorum of the cluster.
+const (
+	// AcceptedWritesWarn logs a warning, and the write is considered as done.
+	// It is the default.
+	AcceptedWritesWarn = "warn"
+	// AcceptedWritesError returns an error matched by ErrWriteAccepted. The
+	// document has still been updated with its new revision.
+	AcceptedWritesError = "error"
+	// AcceptedWritesIgnore considers the write as done.
+	AcceptedWritesIgnore = "ignore"
+)
+
+// statusSetter can be implemented by a response body to know the status code
+// of the response, as set by makeRequest after decoding it.
+type statusSetter interface {
+	setStatus(code int)
+}
+
+// setStatus is part of the statusSetter interface.
+func (r *UpdateResponse) setStatus(code int) {
+	r.StatusCode = code
+}
+
+// Accepted returns true if CouchDB has only accepted the write, without
+// meeting the write quorum: the document may be lost if a node fails.
+func (r *UpdateResponse) Accepted() bool {
+	return r.StatusCode == http.StatusAccepted
+}
+
+// check returns an error if CouchDB has not acknowledged the write, or has
+// not given the new revision of the document.
+func (r *UpdateResponse) check() error {
+	if !r.Ok {
+		return &Error{
+			StatusCode: r.StatusCode,
+			Name:       "not_ok",
+			Reason:     "CouchDB has not acknowledged the write",
+		}
+	}
+	if r.Rev == "" {
+		return &Error{
+			StatusCode: r.StatusCode,
+			Name:       "missing_rev",
+			Reason:     "CouchDB has not returned the revision of the document",
+		}
+	}
+	return nil
+}
+
+// checkAccepted applies the policy of the configuration to a write that may
+// have only been accepted by CouchDB. It is called after the document has
+// been updated with its new revision, as the write has been made anyway.
+func checkAccepted(db Database, doctype string, r *UpdateResponse) error {
+	if !r.Accepted() {
+		return nil
+	}
+	switch config.GetConfig().CouchDB.AcceptedWrites {
+	case AcceptedWritesIgnore:
+		return nil
+	case AcceptedWritesError:
+		return &Error{
+			StatusCode: http.StatusAccepted,
+			Name:       "accepted",
+			Reason:     "the write quorum has not been met",
+		}
+	default:
+		loggerFor(db).Warnf("write of %s %s only accepted by CouchDB (rev %s)",
+			doctype, r.ID, r.Rev)
+		return nil
+	}
+}
+
+// MaxConflictRetries is the number of times that UpdateDocWithRetry fetches
+// the document again after a conflict.
+const MaxConflictRetries = 5
+
+// UpdateDocWithRetry applies mutate to a document and updates it, like a
+// compare-and-swap: on a conflict, the last version of the document is
+// fetched in doc, and mutate is applied to it again, up to MaxConflictRetries
+// times. The document must be a pointer.
+func UpdateDocWithRetry(ctx context.Context, db Database, doc Doc, mutate func(doc Doc) error) error {
+	for i := 0; ; i++ {
+		if err := mutate(doc); err != nil {
+			return err
+		}
+		err := UpdateDocContext(ctx, db, doc)
+		if err == nil || !IsConflictError(err) || i >= MaxConflictRetries {
+			return err
+		}
+		last := NewEmptyObjectOfSameType(doc).(Doc)
+		if err := GetDocContext(ctx, db, doc.DocType(), doc.ID(), last); err != nil {
+			return err
+		}
+		reflect.ValueOf(doc).Elem().Set(reflect.ValueOf(last).Elem())
+	}
+}
@@ -0,0 +1,64 @@
+package couchdb
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteResponses(t *testing.T) {
+	var status int
+	var body string
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer restore()
+
+	create := func() (*JSONDoc, error) {
+		doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"_id": "foo"}}
+		return doc, CreateNamedDoc(TestPrefix, doc)
+	}
+
+	status, body = http.StatusCreated, `{"ok":true,"id":"foo","rev":"1-abc"}`
+	doc, err := create()
+	assert.NoError(t, err)
+	assert.Equal(t, "1-abc", doc.Rev())
+
+	// The write has only been accepted: the document has its new revision,
+	// and the policy decides if it is an error
+	status, body = http.StatusAccepted, `{"ok":true,"id":"foo","rev":"1-def"}`
+	doc, err = create()
+	assert.NoError(t, err)
+	assert.Equal(t, "1-def", doc.Rev())
+
+	config.GetConfig().CouchDB.AcceptedWrites = AcceptedWritesIgnore
+	_, err = create()
+	assert.NoError(t, err)
+
+	config.GetConfig().CouchDB.AcceptedWrites = AcceptedWritesError
+	doc, err = create()
+	assert.True(t, errors.Is(err, ErrWriteAccepted))
+	assert.Equal(t, "1-def", doc.Rev())
+
+	status, body = http.StatusOK, `{"ok":false,"id":"foo","rev":"1-abc"}`
+	doc, err = create()
+	if assert.Error(t, err) {
+		couchErr, ok := IsCouchError(err)
+		assert.True(t, ok)
+		assert.Equal(t, "not_ok", couchErr.Name)
+	}
+	assert.Equal(t, "", doc.Rev())
+
+	status, body = http.StatusCreated, `{"ok":true,"id":"foo"}`
+	_, err = create()
+	if assert.Error(t, err) {
+		couchErr, ok := IsCouchError(err)
+		assert.True(t, ok)
+		assert.Equal(t, "missing_rev", couchErr.Name)
+	}
+}
@@ -0,0 +1,94 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultUUIDBatch is the number of UUIDs fetched at once from CouchDB by
+// the generator of NewCouchUUIDGenerator.
+const DefaultUUIDBatch = 100
+
+// uuidRetryDelay is the time during which the UUIDs are generated locally,
+// without trying to fetch them, after an error of CouchDB.
+const uuidRetryDelay = 10 * time.Second
+
+type uuidPool struct {
+	db    Database
+	batch int
+
+	mu        sync.Mutex
+	uuids     []string
+	refilling bool
+	failedAt  time.Time
+}
+
+// NewCouchUUIDGenerator returns a generator that uses the UUIDs of CouchDB,
+// to follow the algorithm configured on the server, like the sequential one.
+// They are fetched by batches from the _uuids endpoint and kept in a pool,
+// that is refilled in the background when it runs low. If CouchDB cannot
+// give them, the UUIDs are generated locally, randomly, in the same format.
+func NewCouchUUIDGenerator(batch int) IDGenerator {
+	if batch <= 0 {
+		batch = DefaultUUIDBatch
+	}
+	return &uuidPool{db: GlobalDB, batch: batch}
+}
+
+func (p *uuidPool) GenerateID(doc Doc) (string, error) {
+	if id, ok := p.take(); ok {
+		return id, nil
+	}
+	// The pool is empty: a batch is fetched now, unless CouchDB has failed
+	// recently
+	p.mu.Lock()
+	failed := time.Since(p.failedAt) < uuidRetryDelay
+	p.mu.Unlock()
+	if !failed {
+		p.refill()
+		if id, ok := p.take(); ok {
+			return id, nil
+		}
+	}
+	return randomHex(), nil
+}
+
+// take returns a UUID of the pool, and starts a refill in the background if
+// the pool is running low.
+func (p *uuidPool) take() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.uuids) <= p.batch/4 && !p.refilling && len(p.uuids) > 0 {
+		p.refilling = true
+		go func() {
+			p.refill()
+			p.mu.Lock()
+			p.refilling = false
+			p.mu.Unlock()
+		}()
+	}
+	if len(p.uuids) == 0 {
+		return "", false
+	}
+	id := p.uuids[0]
+	p.uuids = p.uuids[1:]
+	return id, true
+}
+
+func (p *uuidPool) refill() {
+	var out UUIDResponse
+	path := "_uuids?count=" + strconv.Itoa(p.batch)
+	err := makeRequest(context.Background(), p.db, "", http.MethodGet, path, nil, &out)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.failedAt = time.Now()
+		loggerFor(p.db).Warnf("cannot fetch the UUIDs, they are generated locally: %s", err)
+		return
+	}
+	p.failedAt = time.Time{}
+	p.uuids = append(p.uuids, out.UUIDs...)
+}
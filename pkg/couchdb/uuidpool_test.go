@@ -0,0 +1,82 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCouchUUIDGenerator(t *testing.T) {
+	var counter, requests int64
+	var failing int32
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 || r.URL.Path != "/_uuids" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"bad_request","reason":"oops"}`))
+			return
+		}
+		count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+		out := UUIDResponse{}
+		for i := 0; i < count; i++ {
+			out.UUIDs = append(out.UUIDs, fmt.Sprintf("%032x", atomic.AddInt64(&counter, 1)))
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	}))
+	defer restore()
+
+	// No ID is given twice, even with concurrent calls
+	gen := NewCouchUUIDGenerator(50)
+	seen := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				id, err := gen.GenerateID(nil)
+				assert.NoError(t, err)
+				assert.True(t, strings.HasPrefix(id, "00000000"), id)
+				mu.Lock()
+				assert.False(t, seen[id], id)
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, seen, 10000)
+	// Wait for the refill in the background, if any
+	pool := gen.(*uuidPool)
+	for {
+		pool.mu.Lock()
+		refilling := pool.refilling
+		pool.mu.Unlock()
+		if !refilling {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// When CouchDB fails, the IDs are generated locally
+	atomic.StoreInt32(&failing, 1)
+	gen = NewCouchUUIDGenerator(50)
+	atomic.StoreInt64(&requests, 0)
+	for i := 0; i < 100; i++ {
+		id, err := gen.GenerateID(nil)
+		assert.NoError(t, err)
+		assert.Len(t, id, 32)
+		assert.False(t, seen[id], id)
+		seen[id] = true
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt64(&requests))
+}
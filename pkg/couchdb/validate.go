@@ -0,0 +1,116 @@
+package couchdb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Validatable is the optional interface of the documents that check their
+// invariants, like the required fields or the enum values, before being
+// written to CouchDB.
+type Validatable interface {
+	Validate() error
+}
+
+// ValidateFunc is a function that validates the documents of a doctype. It
+// is useful for the doctypes handled with JSONDoc, that cannot have their own
+// Validate method.
+type ValidateFunc func(doc Doc) error
+
+// ErrInvalidDoc is the error matched by errors.Is when a document has not
+// been written to CouchDB because it is not valid. The validation error can
+// be found with errors.As.
+var ErrInvalidDoc = errors.New("CouchDB: invalid document")
+
+// BulkValidationError is the original error of the ErrInvalidDoc returned by
+// the bulk operations, with the validation error of every invalid document,
+// by its index in the bulk.
+type BulkValidationError struct {
+	Errors map[int]error
+}
+
+func (e *BulkValidationError) Error() string {
+	indexes := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	msgs := make([]string, len(indexes))
+	for j, i := range indexes {
+		msgs[j] = fmt.Sprintf("#%d: %s", i, e.Errors[i])
+	}
+	return strings.Join(msgs, ", ")
+}
+
+var validators = make(map[string]ValidateFunc)
+
+// RegisterValidator registers a function that validates the documents of a
+// doctype before they are written to CouchDB, after their Validate method if
+// they have one. It is meant to be called in an init function, and it panics
+// if a validator is already registered for the doctype.
+func RegisterValidator(doctype string, fn ValidateFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := validators[doctype]; ok {
+		panic(fmt.Sprintf("couchdb: validator for %s is already registered", doctype))
+	}
+	validators[doctype] = fn
+}
+
+// checkDoc returns an error if the document cannot be sent to CouchDB: it is
+// nil, or it is rejected by its Validate method or by the validator
+// registered for its doctype.
+func checkDoc(doc Doc) error {
+	if doc == nil {
+		return newInvalidDocError("the document is empty")
+	}
+	if v, ok := doc.(Validatable); ok {
+		if err := v.Validate(); err != nil {
+			return wrapInvalidDoc(err)
+		}
+	}
+	registryMu.RLock()
+	fn := validators[doc.DocType()]
+	registryMu.RUnlock()
+	if fn != nil {
+		if err := fn(doc); err != nil {
+			return wrapInvalidDoc(err)
+		}
+	}
+	return nil
+}
+
+// checkBulk validates all the documents of a bulk before sending it, and
+// returns an error with every invalid document, not just the first one.
+func checkBulk(n int, check func(i int) error) error {
+	invalid := make(map[int]error)
+	for i := 0; i < n; i++ {
+		if err := check(i); err != nil {
+			invalid[i] = err
+		}
+	}
+	if len(invalid) == 0 {
+		return nil
+	}
+	return &Error{
+		StatusCode: http.StatusBadRequest,
+		Name:       "invalid_doc",
+		Reason:     fmt.Sprintf("%d of the %d documents of the bulk are not valid", len(invalid), n),
+		Original:   &BulkValidationError{Errors: invalid},
+	}
+}
+
+func wrapInvalidDoc(err error) error {
+	if errors.Is(err, ErrInvalidDoc) {
+		return err
+	}
+	return &Error{
+		StatusCode: http.StatusBadRequest,
+		Name:       "invalid_doc",
+		Reason:     "the document is not valid",
+		Original:   err,
+	}
+}
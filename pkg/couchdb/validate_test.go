@@ -0,0 +1,92 @@
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errMissingName = errors.New("the name is missing")
+
+type validatedDoc struct {
+	testDoc
+}
+
+func (v *validatedDoc) Validate() error {
+	if v.Test == "" {
+		return errMissingName
+	}
+	return nil
+}
+
+func TestValidation(t *testing.T) {
+	requests := 0
+	restore := useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte(`[{"ok":true,"id":"a","rev":"1-a"},{"ok":true,"id":"b","rev":"1-b"}]`))
+	}))
+	defer restore()
+	ctx := context.Background()
+
+	err := CreateDocContext(ctx, TestPrefix, &validatedDoc{})
+	assert.True(t, errors.Is(err, ErrInvalidDoc))
+	assert.True(t, errors.Is(err, errMissingName))
+	assert.Equal(t, 0, requests)
+
+	// The validation errors of JSONDoc are not wrapped twice
+	err = CreateDocContext(ctx, TestPrefix, &JSONDoc{})
+	assert.True(t, errors.Is(err, ErrInvalidDoc))
+	var couchErr *Error
+	if assert.True(t, errors.As(err, &couchErr)) {
+		assert.Nil(t, couchErr.Original)
+	}
+
+	const doctype = "io.cozy.tests.validated"
+	RegisterValidator(doctype, func(doc Doc) error {
+		if doc.(*JSONDoc).GetString("name") == "" {
+			return errMissingName
+		}
+		return nil
+	})
+	defer func() {
+		registryMu.Lock()
+		delete(validators, doctype)
+		registryMu.Unlock()
+	}()
+	assert.Panics(t, func() {
+		RegisterValidator(doctype, func(doc Doc) error { return nil })
+	})
+	invalid := &JSONDoc{Type: doctype, M: map[string]interface{}{"_id": "foo", "_rev": "1-abc"}}
+	err = UpdateDocContext(ctx, TestPrefix, invalid)
+	assert.True(t, errors.Is(err, ErrInvalidDoc))
+	assert.True(t, errors.Is(err, errMissingName))
+	assert.Equal(t, 0, requests)
+
+	// The bulks report all the invalid documents
+	valid := &JSONDoc{Type: doctype, M: map[string]interface{}{"name": "bar"}}
+	docs := []interface{}{invalid, valid, &JSONDoc{Type: doctype, M: map[string]interface{}{}}}
+	err = BulkUpdateDocsContext(ctx, TestPrefix, doctype, docs, nil)
+	assert.True(t, errors.Is(err, ErrInvalidDoc))
+	var bulkErr *BulkValidationError
+	if assert.True(t, errors.As(err, &bulkErr)) {
+		assert.Len(t, bulkErr.Errors, 2)
+		assert.True(t, errors.Is(bulkErr.Errors[0], errMissingName))
+		assert.True(t, errors.Is(bulkErr.Errors[2], errMissingName))
+		assert.Contains(t, err.Error(), "#0: ")
+		assert.Contains(t, err.Error(), "#2: ")
+	}
+	err = BulkDeleteDocsContext(ctx, TestPrefix, doctype, []Doc{valid, invalid})
+	if assert.True(t, errors.As(err, &bulkErr)) {
+		assert.Len(t, bulkErr.Errors, 1)
+		assert.NotNil(t, bulkErr.Errors[1])
+	}
+	assert.Equal(t, 0, requests)
+
+	valid.SetID("b")
+	err = BulkUpdateDocsContext(ctx, TestPrefix, doctype, []interface{}{&JSONDoc{Type: doctype, M: map[string]interface{}{"name": "foo"}}, valid}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+}
@@ -0,0 +1,168 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultWarmTimeout is the maximal duration of the build of the indexes of
+// a design document by WarmIndexes, when the context has no timeout.
+const DefaultWarmTimeout = 10 * time.Minute
+
+// IndexMetricsCollector can be implemented by a MetricsCollector to also
+// observe the progress of WarmIndexes: it is called after each design
+// document, with the number of design documents warmed so far for the
+// doctype and their total.
+type IndexMetricsCollector interface {
+	ObserveIndexWarmed(doctype, ddoc string, done, total int, duration time.Duration)
+}
+
+// WarmOptions are the options of WarmIndexesContext.
+type WarmOptions struct {
+	// Background warms the indexes in a goroutine, and WarmIndexesContext
+	// returns immediately. WaitForIndex can be used to wait for the end.
+	Background bool
+}
+
+type warming struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	warmingsMu sync.Mutex
+	warmings   = make(map[string]*warming)
+)
+
+// WarmIndexes calls WarmIndexesContext with a background context.
+func WarmIndexes(db Database, doctype string) error {
+	return WarmIndexesContext(context.Background(), db, doctype, nil)
+}
+
+// WarmIndexesContext builds the views and the mango indexes of a doctype,
+// for example after a change of their design documents, so that the build
+// is made at the deploy or at the creation of the instance, and not by the
+// first query of a user. A view is queried with limit=0 and update=true for
+// each design document (all the views of a design document are built
+// together), and the mango indexes are design documents too. The errors do
+// not stop the other design documents, and the first one is returned.
+func WarmIndexesContext(ctx context.Context, db Database, doctype string, opts *WarmOptions) error {
+	if opts == nil || !opts.Background {
+		return warmIndexes(ctx, db, doctype)
+	}
+	key := db.DBPrefix() + "/" + doctype
+	warmingsMu.Lock()
+	defer warmingsMu.Unlock()
+	if _, ok := warmings[key]; ok {
+		return nil
+	}
+	w := &warming{done: make(chan struct{})}
+	warmings[key] = w
+	go func() {
+		// The warming is not tied to the request that has started it
+		w.err = warmIndexes(context.Background(), db, doctype)
+		if w.err != nil {
+			loggerFor(db).Warnf("cannot warm the indexes of %s: %s", doctype, w.err)
+		}
+		warmingsMu.Lock()
+		delete(warmings, key)
+		warmingsMu.Unlock()
+		close(w.done)
+	}()
+	return nil
+}
+
+// WaitForIndex waits for the end of the warming in background of the
+// indexes of a doctype, if any, and returns its error. It returns
+// immediately when no warming is in progress.
+func WaitForIndex(ctx context.Context, db Database, doctype string) error {
+	warmingsMu.Lock()
+	w, ok := warmings[db.DBPrefix()+"/"+doctype]
+	warmingsMu.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-w.done:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func warmIndexes(ctx context.Context, db Database, doctype string) error {
+	ddocs, err := designDocs(ctx, db, doctype)
+	if err != nil {
+		if IsNoDatabaseError(err) {
+			return nil
+		}
+		return err
+	}
+	collector, _ := metricsCollector.(IndexMetricsCollector)
+	var firstErr error
+	for i, ddoc := range ddocs {
+		start := time.Now()
+		if err := warmView(ctx, db, doctype, ddoc.name, ddoc.view); err != nil {
+			loggerFor(db).Warnf("cannot warm the design doc %s of %s: %s", ddoc.name, doctype, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if collector != nil {
+			collector.ObserveIndexWarmed(doctype, ddoc.name, i+1, len(ddocs), time.Since(start))
+		}
+	}
+	return firstErr
+}
+
+// warmView builds the indexes of a design document, by querying one of its
+// views.
+func warmView(ctx context.Context, db Database, doctype, ddoc, view string) error {
+	if !hasTimeout(ctx) {
+		ctx = WithTimeout(ctx, DefaultWarmTimeout)
+	}
+	path := "_design/" + url.PathEscape(ddoc) + "/_view/" + url.PathEscape(view) + "?limit=0&update=true"
+	return makeRequest(ctx, db, doctype, http.MethodGet, path, nil, nil)
+}
+
+type designDoc struct {
+	name string
+	view string
+}
+
+// designDocs returns the design documents of the database of a doctype,
+// with a view of each.
+func designDocs(ctx context.Context, db Database, doctype string) ([]designDoc, error) {
+	var res struct {
+		Rows []struct {
+			ID  string `json:"id"`
+			Doc struct {
+				Views map[string]interface{} `json:"views"`
+			} `json:"doc"`
+		} `json:"rows"`
+	}
+	path := `_all_docs?include_docs=true&startkey=%22_design%2F%22&endkey=%22_design0%22`
+	if err := makeRequest(ctx, db, doctype, http.MethodGet, path, nil, &res); err != nil {
+		return nil, err
+	}
+	var ddocs []designDoc
+	for _, row := range res.Rows {
+		if !strings.HasPrefix(row.ID, "_design/") || len(row.Doc.Views) == 0 {
+			continue
+		}
+		views := make([]string, 0, len(row.Doc.Views))
+		for name := range row.Doc.Views {
+			views = append(views, name)
+		}
+		sort.Strings(views)
+		name := row.ID[len("_design/"):]
+		ddocs = append(ddocs, designDoc{name: name, view: views[0]})
+	}
+	return ddocs, nil
+}
@@ -0,0 +1,107 @@
+package couchdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// warmServer is a fake CouchDB with two design documents, that records the
+// queries on the views. The views are blocked until release is closed.
+type warmServer struct {
+	mu      sync.Mutex
+	queries []string
+	release chan struct{}
+	fail    bool
+}
+
+func (s *warmServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/_all_docs") {
+		_, _ = w.Write([]byte(`{"rows":[
+			{"id":"_design/by-name","doc":{"_id":"_design/by-name","language":"query","views":{"by-name":{}}}},
+			{"id":"_design/stats","doc":{"_id":"_design/stats","views":{"sum":{},"count":{}}}},
+			{"id":"_design/validate","doc":{"_id":"_design/validate","validate_doc_update":"function(){}"}}
+		]}`))
+		return
+	}
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, r.URL.Path[strings.Index(r.URL.Path, "/_design/"):]+"?"+r.URL.RawQuery)
+	s.mu.Unlock()
+	if s.fail && strings.Contains(r.URL.Path, "stats") {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error":"os_process_error","reason":"timeout"}`))
+		return
+	}
+	_, _ = w.Write([]byte(`{"total_rows":0,"offset":0,"rows":[]}`))
+}
+
+type warmMetrics struct {
+	nopMetrics
+	progress []string
+}
+
+func (m *warmMetrics) ObserveIndexWarmed(doctype, ddoc string, done, total int, duration time.Duration) {
+	m.progress = append(m.progress, fmt.Sprintf("%s %s %d/%d", doctype, ddoc, done, total))
+}
+
+func TestWarmIndexes(t *testing.T) {
+	s := &warmServer{}
+	restore := useTestServer(t, s)
+	defer restore()
+	metrics := &warmMetrics{}
+	SetMetricsCollector(metrics)
+	defer SetMetricsCollector(nil)
+
+	assert.NoError(t, WarmIndexes(TestPrefix, TestDoctype))
+	assert.Equal(t, []string{
+		"/_design/by-name/_view/by-name?limit=0&update=true",
+		"/_design/stats/_view/count?limit=0&update=true",
+	}, s.queries)
+	assert.Equal(t, []string{
+		TestDoctype + " by-name 1/2",
+		TestDoctype + " stats 2/2",
+	}, metrics.progress)
+
+	// An error does not stop the other design documents
+	s.queries = nil
+	s.fail = true
+	err := WarmIndexes(TestPrefix, TestDoctype)
+	assert.True(t, IsInternalServerError(err))
+	assert.Len(t, s.queries, 2)
+}
+
+func TestWaitForIndex(t *testing.T) {
+	s := &warmServer{release: make(chan struct{})}
+	restore := useTestServer(t, s)
+	defer restore()
+
+	ctx := context.Background()
+	assert.NoError(t, WaitForIndex(ctx, TestPrefix, TestDoctype))
+
+	opts := &WarmOptions{Background: true}
+	assert.NoError(t, WarmIndexesContext(ctx, TestPrefix, TestDoctype, opts))
+	// A second warming is not started while the first one is in progress
+	assert.NoError(t, WarmIndexesContext(ctx, TestPrefix, TestDoctype, opts))
+
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, WaitForIndex(short, TestPrefix, TestDoctype))
+
+	s.fail = true
+	close(s.release)
+	err := WaitForIndex(ctx, TestPrefix, TestDoctype)
+	assert.True(t, IsInternalServerError(err))
+	s.mu.Lock()
+	assert.Len(t, s.queries, 2)
+	s.mu.Unlock()
+	assert.NoError(t, WaitForIndex(ctx, TestPrefix, TestDoctype))
+}
@@ -123,3 +123,42 @@ func (cm *CozyMetadata) UpdatedByApp(slug, version string) error {
 	cm.UpdatedByApps = append(cm.UpdatedByApps, updated)
 	return nil
 }
+
+// AddUpdatedByApp adds the entry to the list of UpdatedByApps entries. Like
+// for the files, each entry has a unique slug+instance, and the new entry will
+// be in the last position. Only the maxPerSlug most recent entries are kept
+// for each slug, when maxPerSlug is positive.
+func (cm *CozyMetadata) AddUpdatedByApp(entry *UpdatedByAppEntry, maxPerSlug int) {
+	if entry.Slug == "" {
+		return
+	}
+	cm.UpdatedAt = entry.Date
+
+	apps := make([]*UpdatedByAppEntry, 0, len(cm.UpdatedByApps)+1)
+	for _, app := range cm.UpdatedByApps {
+		if app.Slug == entry.Slug && app.Instance == entry.Instance {
+			continue
+		}
+		apps = append(apps, app)
+	}
+	apps = append(apps, entry)
+
+	// The most recent entries are the last ones
+	if maxPerSlug > 0 {
+		count := make(map[string]int)
+		keep := make([]bool, len(apps))
+		for i := len(apps) - 1; i >= 0; i-- {
+			count[apps[i].Slug]++
+			keep[i] = count[apps[i].Slug] <= maxPerSlug
+		}
+		i := 0
+		for j, app := range apps {
+			if keep[j] {
+				apps[i] = app
+				i++
+			}
+		}
+		apps = apps[:i]
+	}
+	cm.UpdatedByApps = apps
+}
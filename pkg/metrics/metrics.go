@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"expvar"
+
 	"github.com/labstack/echo/v4"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -15,4 +17,5 @@ import (
 //  - GoCollector: current go process, goroutines, GC pauses, ...
 func Routes(g *echo.Group) {
 	g.GET("", echo.WrapHandler(promhttp.Handler()))
+	g.GET("/expvar", echo.WrapHandler(expvar.Handler()))
 }
@@ -2,6 +2,7 @@ package tlsclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
@@ -17,6 +18,7 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/utils"
+	"golang.org/x/net/http2"
 )
 
 // HTTPEndpoint is a struct for specifying which parameters to use when
@@ -27,12 +29,34 @@ type HTTPEndpoint struct {
 	Timeout   time.Duration
 	EnvPrefix string
 
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+
 	RootCAFile             string
+	RootCAPEM              []byte
 	ClientCertificateFiles ClientCertificateFilePair
+	ClientCertificatePEM   ClientCertificatePEMPair
 	PinnedKey              string
 	InsecureSkipValidation bool
 	MaxIdleConnsPerHost    int
+	MaxConnsPerHost        int
+	IdleConnTimeout        time.Duration
 	DisableCompression     bool
+
+	// UnixSockets are the paths of the unix sockets to dial for some hosts,
+	// instead of using TCP, indexed by host.
+	UnixSockets map[string]string
+
+	// DisableHTTP2 restricts the client to HTTP/1.1. Else, HTTP/2 is
+	// negotiated with TLS when the server supports it.
+	DisableHTTP2 bool
+	// HTTP2ReadIdleTimeout is the duration without any frame received on a
+	// HTTP/2 connection after which a ping is sent to check that the
+	// connection is still alive. 0 disables these health checks.
+	HTTP2ReadIdleTimeout time.Duration
+	// HTTP2PingTimeout is the duration after which a HTTP/2 connection is
+	// closed if the ping has no response.
+	HTTP2PingTimeout time.Duration
 }
 
 // ClientCertificateFilePair is a struct with a certificate and a key pair
@@ -41,6 +65,13 @@ type ClientCertificateFilePair struct {
 	CertificateFile string
 }
 
+// ClientCertificatePEMPair is a struct with a certificate and a key pair,
+// encoded in PEM
+type ClientCertificatePEMPair struct {
+	Key         []byte
+	Certificate []byte
+}
+
 type tlsConfig struct {
 	clientCertificates []tls.Certificate
 	rootCAs            []*x509.Certificate
@@ -88,6 +119,19 @@ func NewHTTPClient(opt HTTPEndpoint) (client *http.Client, u *url.URL, err error
 			return
 		}
 	}
+	if len(opt.RootCAPEM) > 0 {
+		if err = c.LoadRootCAPEM(opt.RootCAPEM); err != nil {
+			return
+		}
+	}
+	if len(opt.ClientCertificatePEM.Certificate) > 0 {
+		if err = c.LoadClientCertificate(
+			opt.ClientCertificatePEM.Certificate,
+			opt.ClientCertificatePEM.Key,
+		); err != nil {
+			return
+		}
+	}
 	if opt.ClientCertificateFiles.CertificateFile != "" {
 		if err = c.LoadClientCertificateFile(
 			opt.ClientCertificateFiles.CertificateFile,
@@ -106,12 +150,47 @@ func NewHTTPClient(opt HTTPEndpoint) (client *http.Client, u *url.URL, err error
 	}
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.TLSClientConfig = c.Config()
+	if opt.DialTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   opt.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	if len(opt.UnixSockets) > 0 {
+		transport.DialContext = dialUnixSockets(transport.DialContext, opt.UnixSockets)
+	}
+	if opt.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = opt.TLSHandshakeTimeout
+	}
 	if opt.MaxIdleConnsPerHost > 0 {
 		transport.MaxIdleConnsPerHost = opt.MaxIdleConnsPerHost
+		if transport.MaxIdleConns < opt.MaxIdleConnsPerHost {
+			transport.MaxIdleConns = opt.MaxIdleConnsPerHost
+		}
+	}
+	if opt.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = opt.MaxConnsPerHost
+	}
+	if opt.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = opt.IdleConnTimeout
 	}
 	if opt.DisableCompression {
 		transport.DisableCompression = true
 	}
+	if opt.DisableHTTP2 {
+		// A non-nil empty map disables HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	} else if opt.HTTP2ReadIdleTimeout > 0 {
+		var h2 *http2.Transport
+		h2, err = http2.ConfigureTransports(transport)
+		if err != nil {
+			return
+		}
+		h2.ReadIdleTimeout = opt.HTTP2ReadIdleTimeout
+		h2.PingTimeout = opt.HTTP2PingTimeout
+	}
 	client = &http.Client{
 		Timeout:   opt.Timeout,
 		Transport: transport,
@@ -119,6 +198,26 @@ func NewHTTPClient(opt HTTPEndpoint) (client *http.Client, u *url.URL, err error
 	return
 }
 
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialUnixSockets returns a dial function that connects to the unix socket of
+// a host when it has one, and uses dial for the other hosts.
+func dialUnixSockets(dial dialFunc, sockets map[string]string) dialFunc {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if path, ok := sockets[host]; ok {
+			return dial(ctx, "unix", path)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
 func fromURL(c *tlsConfig, u *url.URL) (conf *tlsConfig, uCopy *url.URL, err error) {
 	uCopy = utils.CloneURL(u)
 	q := uCopy.Query()
@@ -209,6 +308,23 @@ func (s *tlsConfig) LoadRootCAFile(rootCAFile string) error {
 	if err != nil {
 		return fmt.Errorf("tlsclient: could not load root CA file %q: %s", rootCAFile, err)
 	}
+	if !s.loadRootCAPEM(pemCerts) {
+		return fmt.Errorf("tlsclient: could not load any certificate from the given ROOTCA file: %q", rootCAFile)
+	}
+	return nil
+}
+
+// LoadRootCAPEM adds the certificates of a PEM bundle, like the content of
+// a ca.pem file, to the root CAs. It returns an error if the bundle has no
+// certificate.
+func (s *tlsConfig) LoadRootCAPEM(pemCerts []byte) error {
+	if !s.loadRootCAPEM(pemCerts) {
+		return fmt.Errorf("tlsclient: could not load any certificate from the given ROOTCA")
+	}
+	return nil
+}
+
+func (s *tlsConfig) loadRootCAPEM(pemCerts []byte) bool {
 	ok := false
 	for len(pemCerts) > 0 {
 		var block *pem.Block
@@ -219,15 +335,12 @@ func (s *tlsConfig) LoadRootCAFile(rootCAFile string) error {
 		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
 			continue
 		}
-		if err = s.LoadRootCA(block.Bytes); err != nil {
+		if err := s.LoadRootCA(block.Bytes); err != nil {
 			continue
 		}
 		ok = true
 	}
-	if !ok {
-		return fmt.Errorf("tlsclient: could not load any certificate from the given ROOTCA file: %q", rootCAFile)
-	}
-	return nil
+	return ok
 }
 
 func (s *tlsConfig) SetInsecureSkipValidation() {
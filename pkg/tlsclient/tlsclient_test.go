@@ -0,0 +1,316 @@
+package tlsclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serverCertPEM(ts *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ts.Certificate().Raw,
+	})
+}
+
+func generateClientCert(t *testing.T) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "cozy-stack"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+func newTLSServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+}
+
+func TestSelfSignedWithoutCA(t *testing.T) {
+	ts := newTLSServer()
+	defer ts.Close()
+
+	client, _, err := NewHTTPClient(HTTPEndpoint{})
+	assert.NoError(t, err)
+	_, err = client.Get(ts.URL)
+	assert.Error(t, err)
+}
+
+func TestRootCAFile(t *testing.T) {
+	ts := newTLSServer()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "tlsclient")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, serverCertPEM(ts), 0600))
+
+	client, _, err := NewHTTPClient(HTTPEndpoint{RootCAFile: caFile})
+	assert.NoError(t, err)
+	res, err := client.Get(ts.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestRootCAPEM(t *testing.T) {
+	ts := newTLSServer()
+	defer ts.Close()
+
+	client, _, err := NewHTTPClient(HTTPEndpoint{RootCAPEM: serverCertPEM(ts)})
+	assert.NoError(t, err)
+	res, err := client.Get(ts.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	_, _, err = NewHTTPClient(HTTPEndpoint{RootCAPEM: []byte("not a PEM")})
+	assert.Error(t, err)
+}
+
+func TestInsecureSkipValidation(t *testing.T) {
+	ts := newTLSServer()
+	defer ts.Close()
+
+	client, _, err := NewHTTPClient(HTTPEndpoint{InsecureSkipValidation: true})
+	assert.NoError(t, err)
+	res, err := client.Get(ts.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestClientCertificate(t *testing.T) {
+	certPEM, keyPEM := generateClientCert(t)
+	block, _ := pem.Decode(certPEM)
+	clientCert, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	client, _, err := NewHTTPClient(HTTPEndpoint{RootCAPEM: serverCertPEM(ts)})
+	assert.NoError(t, err)
+	_, err = client.Get(ts.URL)
+	assert.Error(t, err)
+
+	client, _, err = NewHTTPClient(HTTPEndpoint{
+		RootCAPEM: serverCertPEM(ts),
+		ClientCertificatePEM: ClientCertificatePEMPair{
+			Certificate: certPEM,
+			Key:         keyPEM,
+		},
+	})
+	assert.NoError(t, err)
+	res, err := client.Get(ts.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "cozy-stack", string(body))
+}
+
+func newH2Server(handler http.Handler) *httptest.Server {
+	ts := httptest.NewUnstartedServer(handler)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	return ts
+}
+
+func TestHTTP2(t *testing.T) {
+	ts := newH2Server(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	defer ts.Close()
+
+	for _, opt := range []HTTPEndpoint{
+		{RootCAPEM: serverCertPEM(ts)},
+		{RootCAPEM: serverCertPEM(ts), HTTP2ReadIdleTimeout: time.Second},
+	} {
+		client, _, err := NewHTTPClient(opt)
+		assert.NoError(t, err)
+		res, err := client.Get(ts.URL)
+		if assert.NoError(t, err) {
+			res.Body.Close()
+			assert.Equal(t, 2, res.ProtoMajor)
+		}
+	}
+
+	client, _, err := NewHTTPClient(HTTPEndpoint{RootCAPEM: serverCertPEM(ts), DisableHTTP2: true})
+	assert.NoError(t, err)
+	res, err := client.Get(ts.URL)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 1, res.ProtoMajor)
+	}
+}
+
+// freezingProxy is a TCP proxy that can stop forwarding the data, to
+// simulate a connection that has died without being closed.
+type freezingProxy struct {
+	ln     net.Listener
+	frozen chan struct{}
+	once   sync.Once
+}
+
+func newFreezingProxy(t *testing.T, target string) *freezingProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &freezingProxy{ln: ln, frozen: make(chan struct{})}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			backend, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go p.pipe(conn, backend)
+			go p.pipe(backend, conn)
+		}
+	}()
+	return p
+}
+
+func (p *freezingProxy) pipe(dst, src net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		select {
+		case <-p.frozen:
+			// The data is swallowed
+			n = 0
+		default:
+		}
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			dst.Close()
+			return
+		}
+	}
+}
+
+func (p *freezingProxy) freeze() { p.once.Do(func() { close(p.frozen) }) }
+
+func TestHTTP2DeadConnection(t *testing.T) {
+	done := make(chan struct{})
+	ts := newH2Server(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A streaming response, like a changes feed, that stays open
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+	proxy := newFreezingProxy(t, ts.Listener.Addr().String())
+	defer proxy.ln.Close()
+	defer proxy.freeze()
+
+	client, _, err := NewHTTPClient(HTTPEndpoint{
+		RootCAPEM:            serverCertPEM(ts),
+		HTTP2ReadIdleTimeout: 100 * time.Millisecond,
+		HTTP2PingTimeout:     100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	res, err := client.Get("https://" + proxy.ln.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 2, res.ProtoMajor)
+
+	// Without the pings, reading the body would block until a timeout
+	proxy.freeze()
+	start := time.Now()
+	_, err = ioutil.ReadAll(res.Body)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsclient")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "couchdb.sock")
+	ln, err := net.Listen("unix", socket)
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host))
+	})}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	client, _, err := NewHTTPClient(HTTPEndpoint{
+		DialTimeout: time.Second,
+		UnixSockets: map[string]string{"unix-socket-1": socket},
+	})
+	assert.NoError(t, err)
+	res, err := client.Get("http://unix-socket-1/")
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "unix-socket-1", string(body))
+	}
+
+	// The other hosts are still reached via TCP
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+	res, err = client.Get(ts.URL)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+}
@@ -40,7 +40,7 @@ type folderResponse struct {
 
 func newFolderResponse(f *bitwarden.Folder) *folderResponse {
 	r := folderResponse{
-		ID:     f.CouchID,
+		ID:     f.ID(),
 		Name:   f.Name,
 		Object: "folder",
 	}
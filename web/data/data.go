@@ -41,10 +41,7 @@ func ValidDoctype(next echo.HandlerFunc) echo.HandlerFunc {
 }
 
 func fixErrorNoDatabaseIsWrongDoctype(err error) error {
-	if couchdb.IsNoDatabaseError(err) {
-		err.(*couchdb.Error).Reason = "wrong_doctype"
-	}
-	return err
+	return couchdb.WrongDoctypeError(err) // nolint: megacheck
 }
 
 func allDoctypes(c echo.Context) error {
@@ -406,10 +403,14 @@ func couchdbStyleErrorHandler(next echo.HandlerFunc) echo.HandlerFunc {
 			return nil
 		}
 
-		if ce, ok := err.(*couchdb.Error); ok {
+		if ce, ok := couchdb.IsCouchError(err); ok {
 			return c.JSON(ce.StatusCode, ce.JSON())
 		}
 
+		if fe, ok := couchdb.IsUnknownFieldError(err); ok {
+			return c.JSON(http.StatusUnprocessableEntity, echo.Map{"error": fe.Error()})
+		}
+
 		if he, ok := err.(*echo.HTTPError); ok {
 			return c.JSON(he.Code, echo.Map{"error": he.Error()})
 		}
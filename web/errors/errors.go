@@ -34,12 +34,19 @@ func ErrorHandler(err error, c echo.Context) {
 		je = jsonapi.Conflict(err)
 	} else if os.IsNotExist(err) {
 		je = jsonapi.NotFound(err)
-	} else if ce, ok = err.(*couchdb.Error); ok {
+	} else if ce, ok = couchdb.IsCouchError(err); ok {
+		apiErr := ce.APIError()
 		je = &jsonapi.Error{
-			Status: ce.StatusCode,
-			Title:  ce.Name,
-			Detail: ce.Reason,
+			Status: apiErr.Status,
+			Title:  apiErr.Title,
+			Detail: apiErr.Detail,
+			Source: jsonapi.SourceError{
+				Pointer:   apiErr.Source["pointer"],
+				Parameter: apiErr.Source["parameter"],
+			},
 		}
+	} else if fe, ok := couchdb.IsUnknownFieldError(err); ok {
+		je = jsonapi.InvalidAttribute(fe.Field, err)
 	} else if je, ok = err.(*jsonapi.Error); !ok {
 		je = &jsonapi.Error{
 			Status: http.StatusInternalServerError,
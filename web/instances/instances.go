@@ -317,6 +317,20 @@ func diskUsage(c echo.Context) error {
 	return c.JSON(http.StatusOK, result)
 }
 
+func couchdbRateLimit(c echo.Context) error {
+	domain := c.Param("domain")
+	instance, err := lifecycle.GetInstance(domain)
+	if err != nil {
+		return err
+	}
+
+	usage := couchdb.GetRateLimitUsage(instance)
+	if usage == nil {
+		return jsonapi.NotFound(errors.New("CouchDB rate limiting is disabled"))
+	}
+	return c.JSON(http.StatusOK, usage)
+}
+
 func showPrefix(c echo.Context) error {
 	domain := c.Param("domain")
 
@@ -432,6 +446,7 @@ func Routes(router *echo.Group) {
 	router.POST("/:domain/import", importer)
 	router.GET("/:domain/disk-usage", diskUsage)
 	router.GET("/:domain/prefix", showPrefix)
+	router.GET("/:domain/couchdb-rate-limit", couchdbRateLimit)
 	router.GET("/:domain/swift-prefix", getSwiftBucketName)
 	router.POST("/:domain/auth-mode", setAuthMode)
 
@@ -0,0 +1,44 @@
+package middlewares
+
+import (
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// maxRequestIDLength is the maximal length of a request ID sent by a client.
+const maxRequestIDLength = 64
+
+// RequestID is an echo middleware that gives an ID to each HTTP request: the
+// one sent by the client in the X-Request-ID header if it is valid, or a new
+// one. It is sent back in the response, and put in the context of the
+// request, so that it is also sent to CouchDB.
+func RequestID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := req.Header.Get(couchdb.RequestIDHeader)
+		if !isValidRequestID(id) {
+			id = utils.RandomString(16)
+		}
+		c.Response().Header().Set(couchdb.RequestIDHeader, id)
+		c.SetRequest(req.WithContext(couchdb.WithRequestID(req.Context(), id)))
+		return next(c)
+	}
+}
+
+// isValidRequestID returns true for the IDs that can be safely written in
+// the logs.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
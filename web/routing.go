@@ -134,6 +134,7 @@ func SetupAssets(router *echo.Echo, assetsPath string) (err error) {
 // SetupRoutes sets the routing for HTTP endpoints
 func SetupRoutes(router *echo.Echo) error {
 	router.Use(timersMiddleware)
+	router.Use(middlewares.RequestID)
 
 	if !config.GetConfig().CSPDisabled {
 		secure := middlewares.Secure(&middlewares.SecureConfig{
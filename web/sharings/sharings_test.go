@@ -929,9 +929,9 @@ func TestRevokeSharing(t *testing.T) {
 
 	var sdoc sharing.SharedRef
 	err = couchdb.GetDoc(aliceInstance, sharedRefs[0].DocType(), sharedRefs[0].ID(), &sdoc)
-	assert.EqualError(t, err, "CouchDB(not_found): deleted")
+	assert.EqualError(t, err, "CouchDB(not_found): deleted [GET io.cozy.shared 404]")
 	err = couchdb.GetDoc(aliceInstance, sharedRefs[1].DocType(), sharedRefs[1].ID(), &sdoc)
-	assert.EqualError(t, err, "CouchDB(not_found): deleted")
+	assert.EqualError(t, err, "CouchDB(not_found): deleted [GET io.cozy.shared 404]")
 }
 
 func assertOneRecipientIsRevoked(t *testing.T, s *sharing.Sharing) {
@@ -959,9 +959,9 @@ func assertLastRecipientIsRevoked(t *testing.T, s *sharing.Sharing, refs []*shar
 
 	var sdoc sharing.SharedRef
 	err = couchdb.GetDoc(aliceInstance, refs[0].DocType(), refs[0].ID(), &sdoc)
-	assert.EqualError(t, err, "CouchDB(not_found): deleted")
+	assert.EqualError(t, err, "CouchDB(not_found): deleted [GET io.cozy.shared 404]")
 	err = couchdb.GetDoc(aliceInstance, refs[1].DocType(), refs[1].ID(), &sdoc)
-	assert.EqualError(t, err, "CouchDB(not_found): deleted")
+	assert.EqualError(t, err, "CouchDB(not_found): deleted [GET io.cozy.shared 404]")
 }
 
 func TestRevokeRecipient(t *testing.T) {
@@ -72,6 +72,10 @@ func Status(c echo.Context) error {
 		"status":  status,
 		"latency": latencies,
 		"message": status, // Legacy, kept for compatibility
+		// The state of the circuit breakers of the CouchDB nodes
+		"couchdb_circuits": couchdb.GetCircuitBreakers(),
+		// The health of the CouchDB nodes, if they are pinged in background
+		"couchdb_nodes": couchdb.GetNodesHealth(),
 	})
 }
 